@@ -5,17 +5,25 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
 	"github.com/SynologyOpenSource/synology-csi/pkg/driver"
 	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/common"
 	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/service"
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
 	"github.com/SynologyOpenSource/synology-csi/pkg/logger"
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+	"github.com/SynologyOpenSource/synology-csi/pkg/tracing"
 	"github.com/SynologyOpenSource/synology-csi/pkg/utils/hostexec"
 )
 
@@ -28,26 +36,60 @@ var (
 	logLevel       = "info"
 	webapiDebug    = false
 	multipathForUC = true
+	multipathAll   = false
+	placement      = string(service.PlacementFirst)
+	unlockSnaps    = false
+	lunsPerTarget  = 1
+	thinOvercommit = 0.0
+	metricsAddr    = ""
+	healthAddr     = ""
+	healthInterval = time.Minute
+	healthTimeout  = 5 * time.Second
+	shutdownGrace  = 25 * time.Second
+	otlpEndpoint   = ""
+	otlpInsecure   = false
 	// Locations is tools and directories
 	chrootDir      = ""
+	execStrategy   = "chroot"
+	chrootPath     = ""
+	execTimeout    time.Duration
+	cmdTimeouts    = map[string]string{}
+	fstrimInterval time.Duration
+	inodeThreshold float64
+	failureEvents  bool
+	minVolumeSize  = ""
+	maxVolumeSize  = ""
+	topologySite   = ""
+	fsckMode       = string(driver.FsckAlways)
 	iscsiadmPath   = ""
 	multipathPath  = ""
 	multipathdPath = ""
+	validateCmds   = false
+	initiatorName  = ""
+	initiatorFile  = ""
 )
 
 var rootCmd = &cobra.Command{
 	Use:          "synology-csi-driver",
 	Short:        "Synology CSI Driver",
 	SilenceUsage: true,
-	RunE: func(_ *cobra.Command, _ []string) error {
+	RunE: func(cmd *cobra.Command, _ []string) error {
 		if webapiDebug {
 			logger.WebapiDebug = true
 			logLevel = "debug"
 		}
 		logger.Init(logLevel)
 
-		if !multipathForUC {
-			driver.MultipathEnabled = false
+		if err := configureDriver(); err != nil {
+			return err
+		}
+
+		if !cmd.Flags().Changed("endpoint") {
+			csiEndpoint = driver.DefaultEndpoint()
+		}
+		if err := driver.PrepareDataDirs(csiEndpoint); err != nil {
+			log.Errorf("Invalid data directories: %v", err)
+			return err
 		}
 
 		err := driverStart()
@@ -59,10 +101,69 @@ var rootCmd = &cobra.Command{
 	},
 }
 
+// configureDriver sets the options of the driver package from the flags
+func configureDriver() error {
+	if !multipathForUC {
+		driver.MultipathEnabled = false
+	}
+	driver.MultipathAllPortals = multipathAll
+	driver.FstrimInterval = fstrimInterval
+	driver.InodeWarningThreshold = inodeThreshold
+	driver.ProvisioningEvents = failureEvents
+	driver.NodeSite = topologySite
+	if err := driver.ConfigureVolumeSizeLimits(minVolumeSize, maxVolumeSize); err != nil {
+		log.Errorf("Invalid volume size limits: %v", err)
+		return err
+	}
+	if err := driver.ValidateVolumeLimits(); err != nil {
+		log.Errorf("Invalid volume limits: %v", err)
+		return err
+	}
+	if err := driver.ConfigureInitiatorName(csiNodeID, initiatorName, initiatorFile); err != nil {
+		log.Errorf("Invalid initiator name: %v", err)
+		return err
+	}
+	return nil
+}
+
 func driverStart() error {
 	log.Infof("CSI Options = {%s, %s, %s}", csiNodeID, csiEndpoint, csiClientInfoPath)
 
+	shutdownTracing, err := tracing.Init(context.Background(), otlpEndpoint, otlpInsecure)
+	if err != nil {
+		log.Errorf("Failed to set up tracing: %v", err)
+		return err
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			log.Warnf("Failed to flush the spans: %v", err)
+		}
+	}()
+
 	dsmService := service.NewDsmService()
+	placementStrategy, err := service.ParsePlacementStrategy(placement)
+	if err != nil {
+		log.Errorf("Invalid volume placement: %v", err)
+		return err
+	}
+	dsmService.SetPlacementStrategy(placementStrategy)
+	dsmService.SetUnlockSnapshotsOnDelete(unlockSnaps)
+	if lunsPerTarget < 1 {
+		log.Errorf("Invalid number of LUNs per target: %d", lunsPerTarget)
+		return fmt.Errorf("--luns-per-target must be at least 1")
+	}
+	dsmService.SetLunsPerTarget(lunsPerTarget)
+	dsmService.SetThinOvercommitRatio(thinOvercommit)
+	if service.VolumeIdVersion < models.VolumeIdV0 || service.VolumeIdVersion > models.VolumeIdLatest {
+		log.Errorf("Invalid volume ID version: %d", service.VolumeIdVersion)
+		return fmt.Errorf("--volume-id-version must be from %d to %d", models.VolumeIdV0, models.VolumeIdLatest)
+	}
+	if driver.DefaultFsckMode, err = driver.ParseFsckMode(fsckMode); err != nil {
+		log.Errorf("Invalid fsck mode: %v", err)
+		return err
+	}
 
 	// 1. Login DSMs by given ClientInfo
 	info, err := common.LoadConfig(csiClientInfoPath)
@@ -70,6 +171,10 @@ func driverStart() error {
 		log.Errorf("Failed to read config: %v", err)
 		return err
 	}
+	if driver.NamespaceQuotas, err = info.NamespaceQuotaBytes(); err != nil {
+		log.Errorf("Failed to read config: %v", err)
+		return err
+	}
 
 	for _, client := range info.Clients {
 		err := dsmService.AddDsm(client)
@@ -79,15 +184,15 @@ func driverStart() error {
 	}
 	defer dsmService.RemoveAllDsms()
 
-	// 2. Create command executor
-	cmdMap := map[string]string{
-		"iscsiadm":   iscsiadmPath,
-		"multipath":  multipathPath,
-		"multipathd": multipathdPath,
+	if healthInterval > 0 {
+		healthCtx, stopHealthCheck := context.WithCancel(context.Background())
+		defer stopHealthCheck()
+		go dsmService.RunHealthCheck(healthCtx, healthInterval, healthTimeout)
 	}
-	cmdExecutor, err := hostexec.New(cmdMap, chrootDir)
+
+	// 2. Create command executor
+	cmdExecutor, err := newCommandExecutor()
 	if err != nil {
-		log.Errorf("Failed to create command executor: %v", err)
 		return err
 	}
 	tools := driver.NewTools(cmdExecutor)
@@ -100,17 +205,111 @@ func driverStart() error {
 	}
 	drv.Activate()
 
+	muxes := map[string]*http.ServeMux{} // address => endpoints served on it
+	serveOn := func(addr string) *http.ServeMux {
+		if muxes[addr] == nil {
+			muxes[addr] = http.NewServeMux()
+		}
+		return muxes[addr]
+	}
+	if metricsAddr != "" {
+		serveOn(metricsAddr).Handle("/metrics", promhttp.Handler())
+	}
+	if healthAddr != "" {
+		health := drv.HealthHandler()
+		serveOn(healthAddr).Handle("/healthz", health)
+		serveOn(healthAddr).Handle("/readyz", health)
+	}
+	for addr, mux := range muxes {
+		go serveHTTP(addr, mux)
+	}
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	// Block until a signal is received.
 	<-c
-	log.Infof("Shutting down.")
+	log.Infof("Shutting down, waiting up to %v for in-flight RPCs.", shutdownGrace)
+	if !drv.Shutdown(shutdownGrace) {
+		log.Warnf("Some RPCs didn't complete before the shutdown grace period ended.")
+	}
 	return nil
 }
 
+// newCommandExecutor returns the executor of the host commands configured by the flags
+func newCommandExecutor() (hostexec.Executor, error) {
+	cmdMap := map[string]string{
+		"iscsiadm":   iscsiadmPath,
+		"multipath":  multipathPath,
+		"multipathd": multipathdPath,
+	}
+	strategy, err := hostexec.ParseStrategy(execStrategy)
+	if err != nil {
+		log.Errorf("Invalid command execution strategy: %v", err)
+		return nil, err
+	}
+	execOpts := []hostexec.Option{hostexec.WithStrategy(strategy)}
+	if chrootPath != "" {
+		execOpts = append(execOpts, hostexec.WithChrootBinary(chrootPath))
+	}
+	if execTimeout > 0 {
+		execOpts = append(execOpts, hostexec.WithDefaultTimeout(execTimeout))
+	}
+	timeouts, err := commandTimeouts(cmdTimeouts)
+	if err != nil {
+		log.Errorf("Invalid command timeouts: %v", err)
+		return nil, err
+	}
+	execOpts = append(execOpts, hostexec.WithCommandTimeouts(timeouts))
+	if validateCmds {
+		execOpts = append(execOpts, hostexec.WithCommandValidation())
+	}
+	cmdExecutor, err := hostexec.New(cmdMap, chrootDir, execOpts...)
+	if err != nil {
+		log.Errorf("Failed to create command executor: %v", err)
+		return nil, err
+	}
+	if r, ok := cmdExecutor.(hostexec.Resolver); ok {
+		for _, c := range []string{"iscsiadm", "multipath", "mount", "umount", "blkid", "mkfs.ext4", "mkfs.xfs", "e2fsck", "dumpe2fs", "resize2fs", "xfs_growfs", "fstrim"} {
+			rc, ra := r.Resolve(c)
+			log.Infof("Host command %s runs as %q", c, append([]string{rc}, ra...))
+		}
+	}
+	return cmdExecutor, nil
+}
+
+// commandTimeouts returns the default timeouts of the node commands overridden by the given ones
+func commandTimeouts(overrides map[string]string) (map[string]time.Duration, error) {
+	timeouts := make(map[string]time.Duration, len(driver.CommandTimeouts)+len(overrides))
+	for cmd, timeout := range driver.CommandTimeouts {
+		timeouts[cmd] = timeout
+	}
+	for cmd, value := range overrides {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout < 0 {
+			return nil, fmt.Errorf("Invalid timeout %q of command %s", value, cmd)
+		}
+		timeouts[cmd] = timeout
+	}
+	return timeouts, nil
+}
+
+// serveHTTP serves the metrics and health endpoints of the driver on addr
+func serveHTTP(addr string, mux *http.ServeMux) {
+	log.Infof("Serving HTTP endpoints on %s", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Errorf("Failed to serve HTTP endpoints on %s: %v", addr, err)
+	}
+}
+
 func main() {
 	rootCmd.FParseErrWhitelist.UnknownFlags = true
 	addFlags(rootCmd)
+	addOrphanLunsFlags(orphanLunsCmd)
+	rootCmd.AddCommand(orphanLunsCmd)
+	addShrinkLunFlags(shrinkLunCmd)
+	rootCmd.AddCommand(shrinkLunCmd)
+	addSelfTestFlags(selfTestCmd)
+	rootCmd.AddCommand(selfTestCmd)
 
 	if err := rootCmd.Execute(); err != nil {
 		os.Exit(1)
@@ -121,17 +320,65 @@ func main() {
 
 func addFlags(cmd *cobra.Command) {
 	cmd.PersistentFlags().StringVar(&csiNodeID, "nodeid", csiNodeID, "Node ID")
-	cmd.PersistentFlags().StringVarP(&csiEndpoint, "endpoint", "e", csiEndpoint, "CSI endpoint")
+	cmd.PersistentFlags().StringVarP(&csiEndpoint, "endpoint", "e", csiEndpoint, "CSI endpoint, the csi.sock socket of --data-dir if unset")
+	cmd.PersistentFlags().StringVar(&driver.DataDir, "data-dir", driver.DataDir, "Directory of the node plugin, holding its state and by default its socket")
+	cmd.PersistentFlags().StringVar(&driver.StateDir, "state-dir", driver.StateDir, "Directory of the state files of the node server (default: --data-dir)")
 	cmd.PersistentFlags().StringVarP(&csiClientInfoPath, "client-info", "f", csiClientInfoPath, "Path of Synology config yaml file")
 	cmd.PersistentFlags().StringVar(&logLevel, "log-level", logLevel, "Log level (debug, info, warn, error, fatal)")
 	cmd.PersistentFlags().BoolVarP(&webapiDebug, "debug", "d", webapiDebug, "Enable webapi debugging logs")
+	cmd.PersistentFlags().StringVar(&metricsAddr, "metrics-address", metricsAddr, "Address to serve Prometheus metrics on, e.g. :8080 (empty disables)")
+	cmd.PersistentFlags().StringVar(&healthAddr, "health-address", healthAddr, "Address to serve /healthz (liveness) and /readyz (DSM reachability) on, e.g. :9808, may be --metrics-address (empty disables)")
+	cmd.PersistentFlags().DurationVar(&healthInterval, "dsm-health-interval", healthInterval, "Interval to probe the reachability of the DSMs, unreachable ones get no new volumes (0 disables)")
+	cmd.PersistentFlags().DurationVar(&healthTimeout, "dsm-health-timeout", healthTimeout, "Timeout of a DSM health probe")
+	cmd.PersistentFlags().StringVar(&otlpEndpoint, "otlp-endpoint", otlpEndpoint, "host:port of the OTLP gRPC collector to export spans to, OTEL_EXPORTER_OTLP_ENDPOINT if unset (empty disables tracing)")
+	cmd.PersistentFlags().BoolVar(&otlpInsecure, "otlp-insecure", otlpInsecure, "Export spans to --otlp-endpoint without TLS")
+	cmd.PersistentFlags().DurationVar(&shutdownGrace, "shutdown-grace-period", shutdownGrace, "How long in-flight RPCs may run after SIGTERM before they are canceled, keep it below the terminationGracePeriodSeconds of the pod")
+	cmd.PersistentFlags().IntVar(&webapi.Retry.MaxAttempts, "dsm-request-attempts", webapi.Retry.MaxAttempts, "Attempts of a read-only or idempotent DSM request failing with a connection error or a 5xx status (1 disables retries)")
+	cmd.PersistentFlags().DurationVar(&webapi.Retry.MaxElapsedTime, "dsm-request-retry-timeout", webapi.Retry.MaxElapsedTime, "Maximum time spent retrying a DSM request, shortened to the deadline of the CSI call")
+	cmd.PersistentFlags().StringVar(&placement, "placement", placement, "How a DSM is chosen for new volumes (first, most-free, round-robin)")
+	cmd.PersistentFlags().BoolVar(&unlockSnaps, "unlock-snapshots-on-delete", unlockSnaps, "Unlock locked DSM snapshots instead of refusing to delete them")
+	cmd.PersistentFlags().BoolVar(&driver.ReportConsumedSnapshotSize, "report-consumed-snapshot-size", driver.ReportConsumedSnapshotSize, "Report the space consumed by the snapshots as their size, when DSM tells it, instead of the size of their source volume")
+	cmd.PersistentFlags().Float64Var(&thinOvercommit, "thin-overcommit-ratio", thinOvercommit, "Maximum ratio of the capacity of the LUNs of a DSM volume to its size when a thin LUN is created (0 disables the check)")
+	cmd.PersistentFlags().IntVar(&service.VolumeIdVersion, "volume-id-version", service.VolumeIdVersion, "Version of the IDs of the new volumes: 0 for the UUID of the LUN or share, 1 to add the DSM and volume type. Volumes are found by their IDs of any version")
+	cmd.PersistentFlags().IntVar(&lunsPerTarget, "luns-per-target", lunsPerTarget, "Number of LUNs mapped to each iSCSI target, more than 1 shares targets among volumes")
+	cmd.PersistentFlags().BoolVar(&driver.EnabledFeatures.Clone, "enable-clone", driver.EnabledFeatures.Clone, "Advertise and allow cloning volumes")
+	cmd.PersistentFlags().BoolVar(&driver.EnabledFeatures.Expand, "enable-expand", driver.EnabledFeatures.Expand, "Advertise and allow expanding volumes")
+	cmd.PersistentFlags().BoolVar(&driver.EnabledFeatures.ListVolumes, "enable-list-volumes", driver.EnabledFeatures.ListVolumes, "Advertise and allow listing volumes")
+	cmd.PersistentFlags().BoolVar(&driver.EnabledFeatures.ListSnapshots, "enable-list-snapshots", driver.EnabledFeatures.ListSnapshots, "Advertise and allow listing snapshots")
+	cmd.PersistentFlags().BoolVar(&driver.EnabledFeatures.SingleNodeMultiWriter, "enable-single-node-multi-writer", driver.EnabledFeatures.SingleNodeMultiWriter, "Advertise the SINGLE_NODE_SINGLE_WRITER and SINGLE_NODE_MULTI_WRITER access modes")
+	cmd.PersistentFlags().BoolVar(&driver.EnabledFeatures.PublishUnpublish, "enable-controller-publish", driver.EnabledFeatures.PublishUnpublish, "Advertise ControllerPublishVolume, which only lets the nodes an iSCSI volume is published to log into its target")
 	cmd.PersistentFlags().BoolVar(&multipathForUC, "multipath", multipathForUC, "Set to 'false' to disable multipath for UC")
+	cmd.PersistentFlags().BoolVar(&multipathAll, "multipath-all-portals", multipathAll, "Log into every portal of a target and use the multipath device when multipathd runs")
 	cmd.PersistentFlags().StringVar(&chrootDir, "chroot-dir", chrootDir, "Host directory to chroot into (empty disables chroot)")
+	cmd.PersistentFlags().StringVar(&execStrategy, "exec-strategy", execStrategy, "How host commands are executed (chroot, nsenter)")
+	cmd.PersistentFlags().StringVar(&chrootPath, "chroot-path", chrootPath, "Full path of chroot executable (default: search PATH)")
+	cmd.PersistentFlags().DurationVar(&execTimeout, "exec-timeout", execTimeout, "Default timeout for host commands without a deadline and without a timeout of their own (0 disables)")
+	cmd.PersistentFlags().StringToStringVar(&cmdTimeouts, "command-timeouts", cmdTimeouts, "Timeouts of individual host commands overriding their defaults, e.g. iscsiadm=5m,blkid=10s (0 leaves a command to --exec-timeout)")
+	cmd.PersistentFlags().DurationVar(&fstrimInterval, "fstrim-interval", fstrimInterval, "Interval to run fstrim on staged LUNs with space reclamation and without discard (0 disables)")
+	cmd.PersistentFlags().Float64Var(&inodeThreshold, "inode-warning-threshold", inodeThreshold, "Percentage of used inodes above which NodeGetVolumeStats emits a warning event on the PVC (0 disables)")
+	cmd.PersistentFlags().BoolVar(&failureEvents, "provisioning-events", failureEvents, "Emit a warning event on the PVC of a volume which failed to be created for a reason retrying won't fix, needs an in-cluster client")
+	cmd.PersistentFlags().StringVar(&fsckMode, "fsck-mode", fsckMode, "When ext3/ext4 filesystems are checked on stage (always, on-dirty, never), unless their StorageClass sets fsckMode")
+	cmd.PersistentFlags().IntVar(&driver.UnmountBusyRetries, "unmount-busy-retries", driver.UnmountBusyRetries, "Retries, with a doubling backoff from 1s, of the unmount of a busy staging path in NodeUnstageVolume")
+	cmd.PersistentFlags().BoolVar(&driver.LazyUnmount, "lazy-unmount", driver.LazyUnmount, "Unmount staging paths still busy after --unmount-busy-retries with umount -l and log out of their target, instead of failing")
+	cmd.PersistentFlags().DurationVar(&driver.LogoutGrace, "logout-grace", driver.LogoutGrace, "Wait after a lazy unmount before logging out of the target, for the pending writes to reach the LUN")
+	cmd.PersistentFlags().BoolVar(&driver.RemountStaleNfs, "remount-stale-nfs", driver.RemountStaleNfs, "Unmount and remount NFS volumes whose mount went stale, e.g. after the DSM rebooted")
+	cmd.PersistentFlags().StringToInt64Var(&driver.MaxVolumesPerNode, "max-volumes-per-node", driver.MaxVolumesPerNode, "Volumes of each protocol the node attaches, e.g. iscsi=256,nfs=0 (0 is unbounded), the smallest of --node-protocols is reported to the scheduler")
+	cmd.PersistentFlags().StringSliceVar(&driver.NodeProtocols, "node-protocols", driver.NodeProtocols, "Protocols of the volumes the node attaches, for --max-volumes-per-node")
+	cmd.PersistentFlags().StringVar(&topologySite, "topology-site", topologySite, "Topology site reported by the node, it can only use the volumes of DSMs of the same site")
+	cmd.PersistentFlags().DurationVar(&driver.ISCSILoginTimeout, "iscsi-login-timeout", driver.ISCSILoginTimeout, "Login timeout of the iSCSI sessions (0 keeps the iscsid default)")
+	cmd.PersistentFlags().DurationVar(&driver.SessionReconcileInterval, "session-reconcile-interval", driver.SessionReconcileInterval, "Interval to log out the iSCSI sessions of the driver's targets which no staged volume uses (0 disables)")
+	cmd.PersistentFlags().DurationVar(&driver.DeviceWaitTimeout, "device-wait-timeout", driver.DeviceWaitTimeout, "How long to wait for the device of a LUN to appear after login")
+	cmd.PersistentFlags().Int64Var(&driver.LunSizeGranularity, "lun-size-granularity", driver.LunSizeGranularity, "Allocation unit of LUNs on DSM in bytes, the sizes of new and expanded LUNs are rounded up to it")
+	cmd.PersistentFlags().StringVar(&minVolumeSize, "min-volume-size", minVolumeSize, "Smallest volume created, e.g. 5Gi, smaller requests are raised to it (default 1Gi)")
+	cmd.PersistentFlags().StringVar(&maxVolumeSize, "max-volume-size", maxVolumeSize, "Largest volume created or expanded, e.g. 10Ti, larger requests fail with OutOfRange (default no limit)")
+	cmd.PersistentFlags().IntVar(&driver.DeviceScanRetries, "device-scan-retries", driver.DeviceScanRetries, "Rescans of the iSCSI target when the device of a LUN doesn't appear within --device-wait-timeout")
+	cmd.PersistentFlags().StringVar(&initiatorName, "initiator-name", initiatorName, "IQN the node logs into iSCSI targets with and reports in its node ID (default: the initiator of the host)")
+	cmd.PersistentFlags().StringVar(&initiatorFile, "initiator-name-file", initiatorFile, "File with the InitiatorName of the node, in the format of /etc/iscsi/initiatorname.iscsi, unless --initiator-name is set")
 	cmd.PersistentFlags().StringVar(&iscsiadmPath, "iscsiadm-path", iscsiadmPath, "Full path of iscsiadm executable")
 	cmd.PersistentFlags().StringVar(&multipathPath, "multipath-path", multipathPath, "Full path of multipath executable")
 	cmd.PersistentFlags().StringVar(&multipathdPath, "multipathd-path", multipathdPath, "Full path of multipathd executable")
+	cmd.PersistentFlags().BoolVar(&validateCmds, "validate-commands", validateCmds, "Fail at startup if a command path is missing from the chroot dir")
 
-	cmd.MarkFlagRequired("endpoint")
 	cmd.MarkFlagRequired("client-info")
 	cmd.Flags().SortFlags = false
 	cmd.PersistentFlags().SortFlags = false
@@ -0,0 +1,139 @@
+/*
+ * Copyright 2021 Synology Inc.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/driver"
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/common"
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/service"
+	"github.com/SynologyOpenSource/synology-csi/pkg/logger"
+)
+
+var (
+	orphanPVIds       []string
+	orphanFromCluster = false
+	orphanDelete      = false
+	orphanConfirm     = false
+)
+
+var orphanLunsCmd = &cobra.Command{
+	Use:   "orphan-luns",
+	Short: "List the LUNs created by the driver which back no PV, and optionally delete them",
+	Long: `List the LUNs created by the driver which back none of the given PVs.
+The PVs are given by their volume handle with --pv-ids, or listed from the
+cluster with --from-cluster. With --delete the orphans are only reported
+unless --confirm is given too.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		logger.Init(logLevel)
+		ctx := cmd.Context()
+
+		if !orphanFromCluster && !cmd.Flags().Changed("pv-ids") {
+			return fmt.Errorf("Either --pv-ids or --from-cluster is needed, or every LUN would be an orphan")
+		}
+		volumeIds := orphanPVIds
+		if orphanFromCluster {
+			ids, err := listClusterVolumeIds(ctx)
+			if err != nil {
+				return err
+			}
+			volumeIds = append(volumeIds, ids...)
+		}
+
+		info, err := common.LoadConfig(csiClientInfoPath)
+		if err != nil {
+			return fmt.Errorf("Failed to read config: %v", err)
+		}
+		dsmService := service.NewDsmService()
+		for _, client := range info.Clients {
+			if err := dsmService.AddDsm(client); err != nil {
+				return fmt.Errorf("Failed to add DSM: %s, error: %v", client.Host, err)
+			}
+		}
+		defer dsmService.RemoveAllDsms()
+
+		orphans, err := dsmService.ListOrphanLuns(ctx, volumeIds)
+		if err != nil {
+			return err
+		}
+		printOrphanLuns(orphans)
+
+		if !orphanDelete || len(orphans) == 0 {
+			return nil
+		}
+		if !orphanConfirm {
+			fmt.Printf("Dry run: %d LUNs would be deleted, add --confirm to delete them.\n", len(orphans))
+			return nil
+		}
+		failed := 0
+		for _, orphan := range orphans {
+			if err := dsmService.DeleteOrphanLun(ctx, orphan); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to delete LUN %s(%s) of DSM %s: %v\n", orphan.Lun.Name, orphan.Lun.Uuid, orphan.DsmIp, err)
+				failed++
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("Failed to delete %d of %d orphaned LUNs", failed, len(orphans))
+		}
+		fmt.Printf("Deleted %d orphaned LUNs.\n", len(orphans))
+		return nil
+	},
+}
+
+// listClusterVolumeIds returns the volume handles of the PVs of the driver, using the in-cluster config
+func listClusterVolumeIds(ctx context.Context) ([]string, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read in-cluster config: %v", err)
+	}
+	client, err := clientset.NewForConfig(config)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create Kubernetes client: %v", err)
+	}
+
+	pvs, err := client.CoreV1().PersistentVolumes().List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list PVs: %v", err)
+	}
+	ids := []string{}
+	for _, pv := range pvs.Items {
+		if pv.Spec.CSI != nil && pv.Spec.CSI.Driver == driver.DriverName {
+			ids = append(ids, pv.Spec.CSI.VolumeHandle)
+		}
+	}
+	return ids, nil
+}
+
+func printOrphanLuns(orphans []service.OrphanLun) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DSM\tNAME\tUUID\tSIZE\tTARGET")
+	for _, orphan := range orphans {
+		target := "-"
+		if orphan.Target != nil {
+			target = orphan.Target.Name
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", orphan.DsmIp, orphan.Lun.Name, orphan.Lun.Uuid, orphan.Lun.Size, target)
+	}
+	w.Flush()
+}
+
+func addOrphanLunsFlags(cmd *cobra.Command) {
+	cmd.Flags().StringSliceVar(&orphanPVIds, "pv-ids", orphanPVIds, "Volume handles of the PVs of the driver, comma separated")
+	cmd.Flags().BoolVar(&orphanFromCluster, "from-cluster", orphanFromCluster, "List the PVs of the driver from the cluster the command runs in")
+	cmd.Flags().BoolVar(&orphanDelete, "delete", orphanDelete, "Delete the orphaned LUNs, a dry run without --confirm")
+	cmd.Flags().BoolVar(&orphanConfirm, "confirm", orphanConfirm, "Confirm the deletion of the orphaned LUNs")
+	cmd.Flags().SortFlags = false
+}
@@ -0,0 +1,162 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+// StorageClass parameters narrowing the sizes of its volumes within MinVolumeSize and MaxVolumeSize
+const (
+	minVolumeSizeParam = "minVolumeSize"
+	maxVolumeSizeParam = "maxVolumeSize"
+)
+
+// sizeLimits are the smallest and largest capacities of a volume in bytes, 0 is no limit
+type sizeLimits struct {
+	min int64
+	max int64
+}
+
+// parseVolumeSize parses a size limit given as a Kubernetes quantity, e.g. 10Gi
+func parseVolumeSize(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil || quantity.Sign() <= 0 {
+		return 0, fmt.Errorf("Invalid volume size %q, must be a positive quantity, e.g. 10Gi", value)
+	}
+	return quantity.Value(), nil
+}
+
+func newSizeLimits(min, max string) (sizeLimits, error) {
+	var limits sizeLimits
+	var err error
+	if limits.min, err = parseVolumeSize(min); err != nil {
+		return sizeLimits{}, err
+	}
+	if limits.max, err = parseVolumeSize(max); err != nil {
+		return sizeLimits{}, err
+	}
+	if limits.max > 0 && limits.min > limits.max {
+		return sizeLimits{}, fmt.Errorf("Minimum volume size %s is larger than the maximum %s", min, max)
+	}
+	return limits, nil
+}
+
+// ConfigureVolumeSizeLimits sets MinVolumeSize and MaxVolumeSize from quantities, an empty
+// one keeping its default
+func ConfigureVolumeSizeLimits(min, max string) error {
+	limits, err := newSizeLimits(min, max)
+	if err != nil {
+		return err
+	}
+	if min != "" {
+		MinVolumeSize = limits.min
+	}
+	if max != "" {
+		MaxVolumeSize = limits.max
+	}
+	if MaxVolumeSize > 0 && MinVolumeSize > MaxVolumeSize {
+		return fmt.Errorf("Minimum volume size %d is larger than the maximum %d", MinVolumeSize, MaxVolumeSize)
+	}
+	return nil
+}
+
+// globalSizeLimits are the limits of all the volumes
+func globalSizeLimits() sizeLimits {
+	return sizeLimits{min: MinVolumeSize, max: MaxVolumeSize}
+}
+
+// volumeSizeLimits returns the limits of the volumes of a StorageClass, which may narrow
+// the global ones but not widen them
+func volumeSizeLimits(params map[string]string) (sizeLimits, error) {
+	limits, err := newSizeLimits(params[minVolumeSizeParam], params[maxVolumeSizeParam])
+	if err != nil {
+		return sizeLimits{}, err
+	}
+	global := globalSizeLimits()
+	if global.min > limits.min {
+		limits.min = global.min
+	}
+	if global.max > 0 && (limits.max == 0 || global.max < limits.max) {
+		limits.max = global.max
+	}
+	return limits, nil
+}
+
+// limitCapacity returns the size to provision for the size required by capRange within
+// limits, rounded up like roundCapacity. A size below the minimum is raised to it, as CSI
+// allows volumes larger than required, unless the limit of capRange is below the minimum
+// too. A size larger than the maximum fails with OutOfRange.
+func limitCapacity(size int64, capRange *csi.CapacityRange, protocol string, limits sizeLimits) (int64, error) {
+	if limits.min > 0 && size < limits.min {
+		if limit := capRange.GetLimitBytes(); limit > 0 && limit < limits.min {
+			return 0, status.Errorf(codes.OutOfRange, "Limit bytes %d is smaller than the minimum volume size %d", limit, limits.min)
+		}
+		size = limits.min
+	}
+	if limits.max > 0 && size > limits.max {
+		return 0, status.Errorf(codes.OutOfRange, "Required bytes %d is larger than the maximum volume size %d", size, limits.max)
+	}
+
+	rounded, err := roundCapacity(size, capRange, protocol)
+	if err != nil {
+		return 0, err
+	}
+	if limits.max > 0 && rounded > limits.max {
+		return 0, status.Errorf(codes.OutOfRange,
+			"Required bytes %d rounded up to the allocation unit %d of DSM is %d, larger than the maximum volume size %d",
+			size, sizeGranularity(protocol), rounded, limits.max)
+	}
+	return rounded, nil
+}
+
+// sizeGranularity returns the unit DSM allocates the volumes of protocol in
+func sizeGranularity(protocol string) int64 {
+	if protocol == utils.ProtocolIscsi && LunSizeGranularity > 0 {
+		return LunSizeGranularity
+	}
+	// share quotas are set in MB
+	return utils.UNIT_MB
+}
+
+// roundUpSize rounds size up to a multiple of granularity
+func roundUpSize(size int64, granularity int64) int64 {
+	return (size + granularity - 1) / granularity * granularity
+}
+
+// roundCapacity rounds the size required by capRange up to the allocation granularity of
+// protocol, so the volume gets the capacity it is reported with. It fails with OutOfRange
+// if the rounded size exceeds the limit of capRange.
+func roundCapacity(size int64, capRange *csi.CapacityRange, protocol string) (int64, error) {
+	rounded := roundUpSize(size, sizeGranularity(protocol))
+	if limit := capRange.GetLimitBytes(); limit > 0 && rounded > limit {
+		return 0, status.Errorf(codes.OutOfRange,
+			"Required bytes %d rounded up to the allocation unit %d of DSM is %d, larger than limit bytes %d",
+			size, sizeGranularity(protocol), rounded, limit)
+	}
+	return rounded, nil
+}
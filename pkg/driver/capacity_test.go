@@ -0,0 +1,244 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+func TestRoundCapacity(t *testing.T) {
+	defer func(granularity int64) { LunSizeGranularity = granularity }(LunSizeGranularity)
+	LunSizeGranularity = utils.UNIT_GB
+
+	tests := []struct {
+		name     string
+		size     int64
+		limit    int64
+		protocol string
+		want     int64
+		wantCode codes.Code
+	}{
+		{name: "aligned", size: 2 * utils.UNIT_GB, protocol: utils.ProtocolIscsi, want: 2 * utils.UNIT_GB},
+		{name: "round up", size: 3 * utils.UNIT_GB / 2, protocol: utils.ProtocolIscsi, want: 2 * utils.UNIT_GB},
+		{name: "round up within limit", size: 3 * utils.UNIT_GB / 2, limit: 2 * utils.UNIT_GB, protocol: utils.ProtocolIscsi, want: 2 * utils.UNIT_GB},
+		{name: "round up beyond limit", size: 3 * utils.UNIT_GB / 2, limit: 7 * utils.UNIT_GB / 4, protocol: utils.ProtocolIscsi, wantCode: codes.OutOfRange},
+		{name: "share in MB", size: 3*utils.UNIT_GB/2 + 1, protocol: utils.ProtocolNfs, want: 3*utils.UNIT_GB/2 + utils.UNIT_MB},
+		{name: "share beyond limit", size: 3*utils.UNIT_GB/2 + 1, limit: 3*utils.UNIT_GB/2 + 2, protocol: utils.ProtocolSmb, wantCode: codes.OutOfRange},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := roundCapacity(tt.size, &csi.CapacityRange{RequiredBytes: tt.size, LimitBytes: tt.limit}, tt.protocol)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("roundCapacity() code = %v, want %v (err: %v)", code, tt.wantCode, err)
+			}
+			if got != tt.want {
+				t.Errorf("roundCapacity() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateVolume_capacityRounding(t *testing.T) {
+	dsmService := newFakeDsmService()
+	cs := newTestControllerServer(dsmService)
+
+	req := newCreateVolumeRequest("pvc-1", map[string]string{})
+	req.CapacityRange = &csi.CapacityRange{RequiredBytes: utils.UNIT_GB + 1, LimitBytes: 2 * utils.UNIT_GB}
+	resp, err := cs.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("CreateVolume() error = %v", err)
+	}
+	if want := int64(utils.UNIT_GB + utils.UNIT_MB); dsmService.created[0].Size != want || resp.Volume.CapacityBytes != want {
+		t.Errorf("CreateVolume() created %d bytes and reported %d, want %d", dsmService.created[0].Size, resp.Volume.CapacityBytes, want)
+	}
+
+	// the same request finds the volume with the rounded capacity
+	if _, err := cs.CreateVolume(context.Background(), req); err != nil {
+		t.Errorf("CreateVolume() again error = %v", err)
+	}
+
+	req = newCreateVolumeRequest("pvc-2", map[string]string{})
+	req.CapacityRange = &csi.CapacityRange{RequiredBytes: utils.UNIT_GB + 1, LimitBytes: utils.UNIT_GB + 2}
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.OutOfRange {
+		t.Errorf("CreateVolume() error = %v, want OutOfRange", err)
+	}
+}
+
+func TestControllerExpandVolume_capacityRounding(t *testing.T) {
+	dsmService := newFakeDsmService()
+	dsmService.volumes["lun-uuid"] = &models.K8sVolumeRespSpec{VolumeId: "lun-uuid", Protocol: utils.ProtocolIscsi, SizeInBytes: utils.UNIT_GB}
+	dsmService.volumes["share-uuid"] = &models.K8sVolumeRespSpec{VolumeId: "share-uuid", Protocol: utils.ProtocolNfs, SizeInBytes: utils.UNIT_GB}
+	cs := newTestControllerServer(dsmService)
+
+	tests := []struct {
+		name              string
+		volumeId          string
+		capRange          *csi.CapacityRange
+		want              int64
+		wantNodeExpansion bool
+		wantCode          codes.Code
+	}{
+		{name: "round up", volumeId: "lun-uuid", capRange: &csi.CapacityRange{RequiredBytes: 2*utils.UNIT_GB - 1}, want: 2 * utils.UNIT_GB, wantNodeExpansion: true},
+		// the quota of a share is its size, nothing is left to do on the node
+		{name: "share quota", volumeId: "share-uuid", capRange: &csi.CapacityRange{RequiredBytes: 2 * utils.UNIT_GB}, want: 2 * utils.UNIT_GB},
+		{name: "beyond limit", volumeId: "lun-uuid", capRange: &csi.CapacityRange{RequiredBytes: 3*utils.UNIT_GB - 1, LimitBytes: 3*utils.UNIT_GB - 1}, wantCode: codes.OutOfRange},
+		{name: "missing volume", volumeId: "gone", capRange: &csi.CapacityRange{RequiredBytes: 2 * utils.UNIT_GB}, wantCode: codes.NotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := cs.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{
+				VolumeId:      tt.volumeId,
+				CapacityRange: tt.capRange,
+			})
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("ControllerExpandVolume() code = %v, want %v (err: %v)", code, tt.wantCode, err)
+			}
+			if err == nil && resp.CapacityBytes != tt.want {
+				t.Errorf("ControllerExpandVolume() capacity = %d, want %d", resp.CapacityBytes, tt.want)
+			}
+			if err == nil && resp.NodeExpansionRequired != tt.wantNodeExpansion {
+				t.Errorf("ControllerExpandVolume() node expansion required = %v, want %v", resp.NodeExpansionRequired, tt.wantNodeExpansion)
+			}
+		})
+	}
+}
+
+func TestLimitCapacity(t *testing.T) {
+	limits := sizeLimits{min: 5 * utils.UNIT_GB, max: 10 * utils.UNIT_GB}
+	tests := []struct {
+		name     string
+		capRange *csi.CapacityRange
+		limits   sizeLimits
+		want     int64
+		wantCode codes.Code
+	}{
+		{name: "within range", capRange: &csi.CapacityRange{RequiredBytes: 6 * utils.UNIT_GB}, limits: limits, want: 6 * utils.UNIT_GB},
+		{name: "below min", capRange: &csi.CapacityRange{RequiredBytes: utils.UNIT_MB}, limits: limits, want: 5 * utils.UNIT_GB},
+		{name: "below min within limit", capRange: &csi.CapacityRange{RequiredBytes: utils.UNIT_MB, LimitBytes: 8 * utils.UNIT_GB}, limits: limits, want: 5 * utils.UNIT_GB},
+		{name: "limit below min", capRange: &csi.CapacityRange{RequiredBytes: utils.UNIT_MB, LimitBytes: utils.UNIT_GB}, limits: limits, wantCode: codes.OutOfRange},
+		{name: "above max", capRange: &csi.CapacityRange{RequiredBytes: 11 * utils.UNIT_GB}, limits: limits, wantCode: codes.OutOfRange},
+		{name: "max", capRange: &csi.CapacityRange{RequiredBytes: 10 * utils.UNIT_GB}, limits: limits, want: 10 * utils.UNIT_GB},
+		{name: "rounded above max", capRange: &csi.CapacityRange{RequiredBytes: utils.UNIT_GB + 1}, limits: sizeLimits{max: utils.UNIT_GB + 2}, wantCode: codes.OutOfRange},
+		{name: "no limits", capRange: &csi.CapacityRange{RequiredBytes: 100 * utils.UNIT_GB}, want: 100 * utils.UNIT_GB},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := limitCapacity(tt.capRange.GetRequiredBytes(), tt.capRange, utils.ProtocolNfs, tt.limits)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("limitCapacity() code = %v, want %v (err: %v)", code, tt.wantCode, err)
+			}
+			if got != tt.want {
+				t.Errorf("limitCapacity() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVolumeSizeLimits(t *testing.T) {
+	defer func(min, max int64) { MinVolumeSize, MaxVolumeSize = min, max }(MinVolumeSize, MaxVolumeSize)
+	MinVolumeSize, MaxVolumeSize = 2*utils.UNIT_GB, 100*utils.UNIT_GB
+
+	tests := []struct {
+		params map[string]string
+		want   sizeLimits
+	}{
+		{params: map[string]string{}, want: sizeLimits{min: 2 * utils.UNIT_GB, max: 100 * utils.UNIT_GB}},
+		{params: map[string]string{"minVolumeSize": "5Gi", "maxVolumeSize": "10Gi"}, want: sizeLimits{min: 5 * utils.UNIT_GB, max: 10 * utils.UNIT_GB}},
+		// a StorageClass can't widen the global limits
+		{params: map[string]string{"minVolumeSize": "1Gi", "maxVolumeSize": "1Ti"}, want: sizeLimits{min: 2 * utils.UNIT_GB, max: 100 * utils.UNIT_GB}},
+	}
+	for _, tt := range tests {
+		got, err := volumeSizeLimits(tt.params)
+		if err != nil || got != tt.want {
+			t.Errorf("volumeSizeLimits(%v) = %+v, %v, want %+v", tt.params, got, err, tt.want)
+		}
+	}
+}
+
+func TestCreateVolume_sizeLimits(t *testing.T) {
+	defer func(max int64) { MaxVolumeSize = max }(MaxVolumeSize)
+	MaxVolumeSize = 100 * utils.UNIT_GB
+
+	dsmService := newFakeDsmService()
+	cs := newTestControllerServer(dsmService)
+	params := map[string]string{"protocol": "nfs", "minVolumeSize": "5Gi", "maxVolumeSize": "10Gi"}
+
+	tests := []struct {
+		name     string
+		required int64
+		want     int64
+		wantCode codes.Code
+	}{
+		{name: "below min", required: utils.UNIT_MB, want: 5 * utils.UNIT_GB},
+		{name: "within range", required: 7 * utils.UNIT_GB, want: 7 * utils.UNIT_GB},
+		{name: "above max", required: 20 * utils.UNIT_GB, wantCode: codes.OutOfRange},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := newCreateVolumeRequest("pvc-"+strings.ReplaceAll(tt.name, " ", "-"), params)
+			req.CapacityRange = &csi.CapacityRange{RequiredBytes: tt.required}
+			resp, err := cs.CreateVolume(context.Background(), req)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("CreateVolume() code = %v, want %v (err: %v)", code, tt.wantCode, err)
+			}
+			if err == nil && resp.Volume.CapacityBytes != tt.want {
+				t.Errorf("CreateVolume() capacity = %d, want %d", resp.Volume.CapacityBytes, tt.want)
+			}
+		})
+	}
+}
+
+func TestControllerExpandVolume_sizeLimits(t *testing.T) {
+	defer func(max int64) { MaxVolumeSize = max }(MaxVolumeSize)
+	MaxVolumeSize = 10 * utils.UNIT_GB
+
+	dsmService := newFakeDsmService()
+	dsmService.volumes["lun-uuid"] = &models.K8sVolumeRespSpec{VolumeId: "lun-uuid", Protocol: utils.ProtocolIscsi, SizeInBytes: utils.UNIT_GB}
+	cs := newTestControllerServer(dsmService)
+
+	for required, wantCode := range map[int64]codes.Code{10 * utils.UNIT_GB: codes.OK, 11 * utils.UNIT_GB: codes.OutOfRange} {
+		_, err := cs.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{
+			VolumeId:      "lun-uuid",
+			CapacityRange: &csi.CapacityRange{RequiredBytes: required},
+		})
+		if code := status.Code(err); code != wantCode {
+			t.Errorf("ControllerExpandVolume() to %d bytes code = %v, want %v (err: %v)", required, code, wantCode, err)
+		}
+	}
+}
+
+func TestConfigureVolumeSizeLimits(t *testing.T) {
+	defer func(min, max int64) { MinVolumeSize, MaxVolumeSize = min, max }(MinVolumeSize, MaxVolumeSize)
+
+	if err := ConfigureVolumeSizeLimits("", "1Ti"); err != nil || MinVolumeSize != utils.UNIT_GB || MaxVolumeSize != 1024*utils.UNIT_GB {
+		t.Errorf("ConfigureVolumeSizeLimits() = %v, min %d max %d, want the default min and a 1Ti max", err, MinVolumeSize, MaxVolumeSize)
+	}
+	for _, limits := range [][2]string{{"10Gi", "5Gi"}, {"-1Gi", ""}, {"", "big"}} {
+		if err := ConfigureVolumeSizeLimits(limits[0], limits[1]); err == nil {
+			t.Errorf("ConfigureVolumeSizeLimits(%q, %q) = nil, want an error", limits[0], limits[1])
+		}
+	}
+}
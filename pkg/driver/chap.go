@@ -0,0 +1,71 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+)
+
+// Keys of the CHAP secret referenced by the StorageClass
+const (
+	chapUserKey           = "chapUser"
+	chapPasswordKey       = "chapPassword"
+	chapMutualUserKey     = "chapMutualUser"
+	chapMutualPasswordKey = "chapMutualPassword"
+)
+
+// parseChapSecrets reads the CHAP credentials from the secrets of a CSI request
+func parseChapSecrets(secrets map[string]string) (*models.ChapCredentials, error) {
+	chap := &models.ChapCredentials{
+		User:           strings.TrimSpace(secrets[chapUserKey]),
+		Password:       secrets[chapPasswordKey],
+		MutualUser:     strings.TrimSpace(secrets[chapMutualUserKey]),
+		MutualPassword: secrets[chapMutualPasswordKey],
+	}
+
+	if chap.User == "" || chap.Password == "" {
+		return nil, fmt.Errorf("CHAP is enabled but the secret has no %s and %s", chapUserKey, chapPasswordKey)
+	}
+	if (chap.MutualUser == "") != (chap.MutualPassword == "") {
+		return nil, fmt.Errorf("Mutual CHAP needs both %s and %s", chapMutualUserKey, chapMutualPasswordKey)
+	}
+	return chap, nil
+}
+
+// iscsiadm_update_node_auth stores the CHAP credentials in the node record used by --login
+func (t *tools) iscsiadm_update_node_auth(iqn, portal string, chap *models.ChapCredentials) error {
+	settings := [][2]string{
+		{"node.session.auth.authmethod", "CHAP"},
+		{"node.session.auth.username", chap.User},
+		{"node.session.auth.password", chap.Password},
+	}
+	if chap.Mutual() {
+		settings = append(settings,
+			[2]string{"node.session.auth.username_in", chap.MutualUser},
+			[2]string{"node.session.auth.password_in", chap.MutualPassword})
+	}
+
+	for _, setting := range settings {
+		if err := t.iscsiadm_update_node(iqn, portal, setting[0], setting[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
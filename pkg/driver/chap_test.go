@@ -0,0 +1,117 @@
+package driver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils/hostexec"
+)
+
+func TestIscsiadmUpdateNodeAuth(t *testing.T) {
+	update := func(name, value string) []string {
+		return []string{"iscsiadm", "-m", "node", "--targetname", "iqn.test", "--portal", "10.0.0.1:3260",
+			"--op", "update", "--name", name, "--value", value}
+	}
+
+	tests := []struct {
+		name string
+		chap *models.ChapCredentials
+		want [][]string
+	}{
+		{
+			name: "chap",
+			chap: &models.ChapCredentials{User: "user", Password: "secret"},
+			want: [][]string{
+				update("node.session.auth.authmethod", "CHAP"),
+				update("node.session.auth.username", "user"),
+				update("node.session.auth.password", "secret"),
+			},
+		},
+		{
+			name: "mutual chap",
+			chap: &models.ChapCredentials{User: "user", Password: "secret", MutualUser: "target", MutualPassword: "secret2"},
+			want: [][]string{
+				update("node.session.auth.authmethod", "CHAP"),
+				update("node.session.auth.username", "user"),
+				update("node.session.auth.password", "secret"),
+				update("node.session.auth.username_in", "target"),
+				update("node.session.auth.password_in", "secret2"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := hostexec.NewFake(nil, "/host")
+			tools := NewTools(fake)
+
+			if err := tools.iscsiadm_update_node_auth("iqn.test", "10.0.0.1:3260", tt.chap); err != nil {
+				t.Fatalf("iscsiadm_update_node_auth() error = %v", err)
+			}
+			assertInvocations(t, fake, tt.want)
+		})
+	}
+}
+
+func TestParseChapSecrets(t *testing.T) {
+	tests := []struct {
+		name    string
+		secrets map[string]string
+		wantErr bool
+	}{
+		{name: "missing secret", secrets: nil, wantErr: true},
+		{name: "missing password", secrets: map[string]string{"chapUser": "user"}, wantErr: true},
+		{name: "chap", secrets: map[string]string{"chapUser": "user", "chapPassword": "secret"}},
+		{name: "incomplete mutual chap", secrets: map[string]string{"chapUser": "user", "chapPassword": "secret", "chapMutualUser": "target"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := parseChapSecrets(tt.secrets); (err != nil) != tt.wantErr {
+				t.Errorf("parseChapSecrets() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestCreateVolume_chap(t *testing.T) {
+	dsmService := newFakeDsmService()
+	cs := newTestControllerServer(dsmService)
+
+	req := newCreateVolumeRequest("pvc-chap", map[string]string{"enableChap": "true"})
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("CreateVolume() without secret code = %v, want %v", status.Code(err), codes.InvalidArgument)
+	}
+
+	req.Secrets = map[string]string{"chapUser": "user", "chapPassword": "secret"}
+	resp, err := cs.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("CreateVolume() error = %v", err)
+	}
+	if chap := dsmService.created[len(dsmService.created)-1].Chap; chap == nil || chap.User != "user" {
+		t.Errorf("CreateVolume() spec.Chap = %+v", chap)
+	}
+	if resp.Volume.VolumeContext["enableChap"] != "true" {
+		t.Errorf("CreateVolume() context = %v", resp.Volume.VolumeContext)
+	}
+}
+
+func TestNodeStageVolume_chapSecretMissing(t *testing.T) {
+	ns := &nodeServer{}
+
+	_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol-1",
+		StagingTargetPath: "/staging",
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+		VolumeContext: map[string]string{"protocol": "iscsi", "enableChap": "true"},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("NodeStageVolume() code = %v, want %v (err: %v)", status.Code(err), codes.InvalidArgument, err)
+	}
+}
@@ -0,0 +1,51 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils/hostexec"
+)
+
+// CommandTimeouts are the timeouts of the host commands run by the node server, by
+// command name. Commands missing here only have the default timeout of hostexec.
+// mkfs and fsck are left out, their time grows with the size of the volume.
+var CommandTimeouts = map[string]time.Duration{
+	"blkid":      30 * time.Second,
+	"blockdev":   30 * time.Second,
+	"dumpe2fs":   time.Minute,
+	"iscsiadm":   2 * time.Minute,
+	"multipath":  time.Minute,
+	"multipathd": time.Minute,
+}
+
+// execError wraps the error of a host command in a status, DeadlineExceeded naming the
+// command if it was killed by its timeout, or else Internal
+func execError(err error, format string, args ...interface{}) error {
+	code := codes.Internal
+	var timeoutErr hostexec.TimeoutError
+	if errors.As(err, &timeoutErr) {
+		code = codes.DeadlineExceeded
+	}
+	return status.Errorf(code, "%s, err: %v", fmt.Sprintf(format, args...), err)
+}
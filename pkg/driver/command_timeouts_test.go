@@ -0,0 +1,62 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/mount-utils"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils/hostexec"
+)
+
+func TestFormatAndMount_commandTimeout(t *testing.T) {
+	fake := hostexec.NewFake(nil, "/host", hostexec.WithCommandTimeouts(map[string]time.Duration{"blkid": 20 * time.Millisecond}))
+	fake.Respond(hostexec.FakeResult{Output: []byte("TYPE=ext4\n"), Delay: 5 * time.Second})
+	mounter := mount.NewFakeMounter(nil)
+	ns := &nodeServer{
+		Mounter: &mount.SafeFormatAndMount{Interface: mounter},
+		tools:   NewTools(fake),
+	}
+
+	err := ns.formatAndMount("/dev/sdb", "/staging", "ext4", []string{"rw"}, nil, FsckAlways)
+	if code := status.Code(err); code != codes.DeadlineExceeded || !strings.Contains(err.Error(), "blkid timed out") {
+		t.Fatalf("formatAndMount() error = %v, want DeadlineExceeded naming blkid", err)
+	}
+	if log := mounter.GetLog(); len(log) != 0 {
+		t.Errorf("formatAndMount() mounted %v after blkid timed out", log)
+	}
+}
+
+func TestExecError(t *testing.T) {
+	err := execError(hostexec.TimeoutError{Cmd: "iscsiadm", Timeout: time.Minute}, "Failed to login with target iqn [%s]", "iqn.test")
+	if code := status.Code(err); code != codes.DeadlineExceeded {
+		t.Errorf("execError() code = %v for a timed out command, want %v", code, codes.DeadlineExceeded)
+	}
+	if msg := status.Convert(err).Message(); !strings.HasPrefix(msg, "Failed to login with target iqn [iqn.test], err: iscsiadm timed out after 1m0s") {
+		t.Errorf("execError() message = %q", msg)
+	}
+
+	if code := status.Code(execError(errors.New("exit status 1"), "Failed to rescan")); code != codes.Internal {
+		t.Errorf("execError() code = %v for a failed command, want %v", code, codes.Internal)
+	}
+}
@@ -18,19 +18,20 @@ package driver
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sort"
 	"strconv"
 	"strings"
-	"time"
 
 	log "github.com/sirupsen/logrus"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
-	"google.golang.org/protobuf/types/known/timestamppb"
+	"k8s.io/client-go/tools/record"
 
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
 	"github.com/SynologyOpenSource/synology-csi/pkg/interfaces"
 	"github.com/SynologyOpenSource/synology-csi/pkg/models"
 	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
@@ -40,6 +41,11 @@ type controllerServer struct {
 	Driver     *Driver
 	dsmService interfaces.IDsmService
 	Initiator  *initiatorDriver
+	// volumeLocks serializes the calls for the same volume, by name or ID
+	volumeLocks volumeLocks
+	// recorder emits the provisioning failure events, nil unless ProvisioningEvents
+	recorder      record.EventRecorder
+	failureEvents *eventLimiter
 }
 
 func getSizeByCapacityRange(capRange *csi.CapacityRange) (int64, error) {
@@ -52,10 +58,11 @@ func getSizeByCapacityRange(capRange *csi.CapacityRange) (int64, error) {
 	if 0 < maxSize && maxSize < minSize {
 		return 0, status.Error(codes.InvalidArgument, "Invalid input: limitBytes is smaller than requiredBytes")
 	}
-	if minSize < utils.UNIT_GB {
-		return 0, status.Error(codes.InvalidArgument, "Invalid input: required bytes is smaller than 1G")
+	if minSize < 0 {
+		return 0, status.Error(codes.InvalidArgument, "Invalid input: required bytes is negative")
 	}
 
+	// raised to MinVolumeSize by limitCapacity
 	return int64(minSize), nil
 }
 
@@ -96,7 +103,66 @@ func parseDevAttribs(params map[string]string) (map[string]bool, error) {
 	return attribFlags, nil
 }
 
+// parseLunQos reads the IOPS and throughput limits of the LUN, 0 or unset is unlimited
+func parseLunQos(params map[string]string, protocol string) (webapi.LunQos, error) {
+	qos := webapi.LunQos{}
+	for key, value := range map[string]*int{"maxIops": &qos.MaxIops, "maxThroughputMBps": &qos.MaxThroughput} {
+		if params[key] == "" {
+			continue
+		}
+		limit, err := strconv.Atoi(params[key])
+		if err != nil || limit < 0 {
+			return qos, fmt.Errorf("Invalid %s: %s, must be a non-negative integer", key, params[key])
+		}
+		*value = limit
+	}
+	if qos.IsSet() && protocol != utils.ProtocolIscsi {
+		return qos, fmt.Errorf("maxIops and maxThroughputMBps are only supported by the iSCSI protocol")
+	}
+	return qos, nil
+}
+
+// parseLunBlockSize reads the logical block size of the LUN, 0 if unset
+func parseLunBlockSize(params map[string]string, protocol string) (int, error) {
+	if params["blockSize"] == "" {
+		return 0, nil
+	}
+	if protocol != utils.ProtocolIscsi {
+		return 0, fmt.Errorf("blockSize is only supported by the iSCSI protocol")
+	}
+	blockSize, err := strconv.Atoi(params["blockSize"])
+	if err != nil || (blockSize != models.LunBlockSize512 && blockSize != models.LunBlockSize4Kn) {
+		return 0, fmt.Errorf("Invalid blockSize: %s, must be %d or %d", params["blockSize"], models.LunBlockSize512, models.LunBlockSize4Kn)
+	}
+	return blockSize, nil
+}
+
+// validateLocation checks that location is one of the volumes of the given DSM,
+// or of any DSM if dsmIp is empty
+func (cs *controllerServer) validateLocation(ctx context.Context, dsmIp string, location string) error {
+	volInfos, err := cs.dsmService.ListDsmVolumes(ctx, dsmIp)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Failed to list dsm volumes, err: %v", err)
+	}
+
+	for _, info := range volInfos {
+		if info.Path == location {
+			return nil
+		}
+	}
+
+	return status.Errorf(codes.InvalidArgument, "Location [%s] does not exist", location)
+}
+
 func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+	resp, err := cs.createVolume(ctx, req)
+	if err != nil {
+		cs.reportProvisioningFailure(ctx, req, err)
+	}
+	return resp, err
+}
+
+func (cs *controllerServer) createVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
 	sizeInByte, err := getSizeByCapacityRange(req.GetCapacityRange())
 	volName, volCap := req.GetName(), req.GetVolumeCapabilities()
 	volContentSrc := req.GetVolumeContentSource()
@@ -113,6 +179,12 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		return nil, status.Errorf(codes.InvalidArgument, "No name is provided")
 	}
 
+	unlock, err := cs.volumeLocks.lock(ctx, volName)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
 	if volCap == nil {
 		return nil, status.Errorf(codes.InvalidArgument, "No volume capabilities are provided")
 	}
@@ -139,6 +211,9 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		if srcSnapshot := volContentSrc.GetSnapshot(); srcSnapshot != nil {
 			srcSnapshotId = srcSnapshot.SnapshotId
 		} else if srcVolume := volContentSrc.GetVolume(); srcVolume != nil {
+			if !cs.Driver.features.Clone {
+				return nil, status.Error(codes.InvalidArgument, "Volume cloning is disabled")
+			}
 			srcVolumeId = srcVolume.VolumeId
 		} else {
 			return nil, status.Errorf(codes.InvalidArgument, "Invalid volume content source")
@@ -146,27 +221,66 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	}
 
 	params := req.GetParameters()
+	if err := ValidateStorageClassParameters(params); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 
 	isThin := true
 	if params["thin_provisioning"] != "" {
 		isThin = utils.StringToBoolean(params["thin_provisioning"])
 	}
+	lunType := strings.ToUpper(params["type"])
+	if lunType != "" {
+		// validated, the contradictions included
+		isThin, _ = models.IsThinLunType(lunType)
+	}
+	snapshots := utils.StringToBoolean(params["requireSnapshots"])
 
 	protocol := strings.ToLower(params["protocol"])
 	if protocol == "" {
 		protocol = utils.ProtocolDefault
-	} else if !isProtocolSupport(protocol) {
-		return nil, status.Error(codes.InvalidArgument, "Unsupported volume protocol")
+	}
+
+	for _, cap := range volCap {
+		if err := validateAccessModeForProtocol(protocol, cap); err != nil {
+			return nil, err
+		}
+	}
+
+	limits, err := volumeSizeLimits(params)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if sizeInByte, err = limitCapacity(sizeInByte, req.GetCapacityRange(), protocol, limits); err != nil {
+		return nil, err
 	}
 
 	// not needed during CreateVolume method
 	// used only in NodeStageVolume through VolumeContext
 	formatOptions := params["formatOptions"]
+	if mkfsOptions, ok := params["mkfsOptions"]; ok {
+		formatOptions = mkfsOptions
+	}
+	fsType := params["fsType"]
+	fsckMode := params["fsckMode"]
 	mountPermissions := params["mountPermissions"]
-	// check mountPermissions valid
-	if mountPermissions != "" {
-		if _, err := strconv.ParseUint(mountPermissions, 8, 32); err != nil {
-			return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("invalid mountPermissions %s in storage class", mountPermissions))
+
+	var chap *models.ChapCredentials
+	enableChap := utils.StringToBoolean(params["enableChap"])
+	if enableChap {
+		if chap, err = parseChapSecrets(req.GetSecrets()); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	var passphrase webapi.Passphrase
+	encryption := utils.StringToBoolean(params[shareEncryptionParam])
+	if encryption {
+		if volContentSrc != nil {
+			return nil, status.Error(codes.InvalidArgument, "Encrypted shares can't be created from a volume content source")
+		}
+		if passphrase, err = parseEncryptionPassphrase(req.GetSecrets()); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
 		}
 	}
 
@@ -174,17 +288,66 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	if err != nil {
 		return nil, err
 	}
-	if enabled, exists := devAttribs["emulate_tpu"]; exists && enabled && !isThin {
-		return nil, status.Error(codes.InvalidArgument, "Invalid provisioning type: space reclamation only supported for thin LUNs")
+
+	qos, err := parseLunQos(params, protocol)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	blockSize, err := parseLunBlockSize(params, protocol)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	spaceReclamation := devAttribs["emulate_tpu"]
+	// used only in NodeStageVolume through VolumeContext
+	discard := utils.StringToBoolean(params["discard"])
+
+	// if the /pvc/name is present, the namespace is present too
+	// as these parameters are reserved by external-provisioner
+	lunDescription := models.GenLunDescription(params["csi.storage.k8s.io/pvc/namespace"],
+		params["csi.storage.k8s.io/pvc/name"], params["csi.storage.k8s.io/pv/name"])
+
+	lunName := models.GenLunName(volName)
+	lunNameTemplate := params["lunNameTemplate"]
+	if lunNameTemplate != "" && protocol == utils.ProtocolIscsi {
+		vars := lunNameVars{
+			PVCName:      params["csi.storage.k8s.io/pvc/name"],
+			PVCNamespace: params["csi.storage.k8s.io/pvc/namespace"],
+			PVName:       volName,
+			Suffix:       lunNameSuffix(volName),
+		}
+		if lunName, err = renderLunName(lunNameTemplate, vars); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
 	}
 
-	lunDescription := ""
-	if _, ok := params["csi.storage.k8s.io/pvc/name"]; ok {
-		// if the /pvc/name is present, the namespace is present too
-		// as these parameters are reserved by external-provisioner
-		pvcNamespace := params["csi.storage.k8s.io/pvc/namespace"]
-		pvcName := params["csi.storage.k8s.io/pvc/name"]
-		lunDescription = pvcNamespace + "/" + pvcName
+	location := params["location"]
+	if location != "" {
+		if err := cs.validateLocation(ctx, params["dsm"], location); err != nil {
+			return nil, err
+		}
+	}
+
+	// the NFS mount options of the StorageClass are merged with the PV's in NodePublishVolume
+	nfsMountOptions := []string{}
+	if protocol == utils.ProtocolNfs {
+		if nfsMountOptions, err = parseNfsMountOptions(params); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if mountOptions, err = mergeNfsMountOptions(nfsMountOptions, mountOptions); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+	}
+
+	nfsExport, err := parseNfsExportOptions(params)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	parentShare := params[parentShareParam]
+	subDirOnDelete, _ := parseSubDirOnDelete(params) // validated
+	if parentShare != "" && volContentSrc != nil {
+		return nil, status.Error(codes.InvalidArgument, "Subdirectory volumes can't be created from a volume content source")
 	}
 
 	nfsVer := parseNfsVesrion(mountOptions)
@@ -195,33 +358,91 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 	spec := &models.CreateK8sVolumeSpec{
 		DsmIp:            params["dsm"],
 		K8sVolumeName:    volName,
-		LunName:          models.GenLunName(volName),
+		LunName:          lunName,
 		LunDescription:   lunDescription,
 		ShareName:        models.GenShareName(volName),
-		Location:         params["location"],
+		Location:         location,
 		Size:             sizeInByte,
-		Type:             params["type"],
+		Type:             lunType,
 		ThinProvisioning: isThin,
-		TargetName:       fmt.Sprintf("%s-%s", models.TargetPrefix, volName),
+		Snapshots:        snapshots,
+		TargetName:       models.GenTargetName(volName),
 		MultipleSession:  multiSession,
 		SourceSnapshotId: srcSnapshotId,
 		SourceVolumeId:   srcVolumeId,
 		Protocol:         protocol,
 		NfsVersion:       nfsVer,
 		DevAttribs:       devAttribs,
+		Chap:             chap,
+		DryRun:           utils.StringToBoolean(params["dryRun"]),
+		Sites:            requirementSites(req.GetAccessibilityRequirements()),
+		Profile:          params["credentialRef"],
+		Qos:              qos,
+		BlockSize:        blockSize,
+		NfsExport:        nfsExport,
+		ParentShare:      parentShare,
+		SubDirOnDelete:   subDirOnDelete,
+
+		EncryptionPassphrase: passphrase,
+	}
+
+	if parentShare != "" {
+		spec.SubDir = volName
 	}
 
 	// idempotency
 	// Note: an SMB PV may not be tested existed precisely because the share folder name was sliced from k8sVolumeName
-	k8sVolume := cs.dsmService.GetVolumeByName(volName)
+	k8sVolume := cs.dsmService.GetVolumeByName(ctx, volName)
 	if k8sVolume == nil {
-		k8sVolume, err = cs.dsmService.CreateVolume(spec)
+		if err := cs.checkNamespaceQuota(ctx, protocol, params["csi.storage.k8s.io/pvc/namespace"], sizeInByte); err != nil {
+			return nil, err
+		}
+		if lunNameTemplate != "" && cs.isLunNameTaken(ctx, spec.LunName) {
+			spec.LunName = withLunNameSuffix(spec.LunName, lunNameSuffix(volName))
+			log.WithContext(ctx).Infof("LUN name of volume [%s] is taken, using [%s]", volName, spec.LunName)
+		}
+		k8sVolume, err = cs.dsmService.CreateVolume(ctx, spec)
 		if err != nil {
 			return nil, err
 		}
+		if spec.DryRun {
+			// fail even when valid, the external-provisioner would bind a PV to the never created volume
+			log.WithContext(ctx).Infof("Dry run of creating volume [%s] succeeded in [%s], location: [%s]", volName, k8sVolume.DsmIp, k8sVolume.Location)
+			return nil, status.Errorf(codes.FailedPrecondition, "dry run: validation passed, volume [%s] would be created in [%s], location: [%s]",
+				volName, k8sVolume.DsmIp, k8sVolume.Location)
+		}
 	} else {
 		// already existed
-		log.Debugf("Volume [%s] already exists in [%s], backing name: [%s]", volName, k8sVolume.DsmIp, k8sVolume.Name)
+		log.WithContext(ctx).Debugf("Volume [%s] already exists in [%s], backing name: [%s]", volName, k8sVolume.DsmIp, k8sVolume.Name)
+	}
+	accessibleTopology := cs.volumeTopology(ctx, k8sVolume.DsmIp)
+
+	volumeContext := map[string]string{
+		"dsm":                    k8sVolume.DsmIp,
+		"protocol":               k8sVolume.Protocol,
+		"source":                 k8sVolume.Source,
+		"formatOptions":          formatOptions,
+		"fsType":                 fsType,
+		"fsckMode":               fsckMode,
+		"mountPermissions":       mountPermissions,
+		"baseDir":                k8sVolume.BaseDir,
+		"location":               k8sVolume.Location,
+		"enableChap":             strconv.FormatBool(enableChap),
+		"enableSpaceReclamation": strconv.FormatBool(spaceReclamation),
+		"discard":                strconv.FormatBool(discard),
+		"mountOptions":           strings.Join(nfsMountOptions, ","),
+	}
+	// NodePublishVolume mounts the subdirectory of the share
+	if k8sVolume.SubDir != "" {
+		volumeContext[subDirContextKey] = k8sVolume.SubDir
+	}
+	// NodeStageVolume checks that encrypted shares are unlocked
+	if encryption {
+		volumeContext[shareEncryptionParam] = "true"
+	}
+	// NodeStageVolume saves the privilege rules of NFS shares
+	for key, value := range nfsExportContext(params) {
+		volumeContext[key] = value
 	}
 
 	if (k8sVolume.Protocol == utils.ProtocolIscsi && k8sVolume.SizeInBytes != sizeInByte) ||
@@ -232,17 +453,11 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 
 	return &csi.CreateVolumeResponse{
 		Volume: &csi.Volume{
-			VolumeId:      k8sVolume.VolumeId,
-			CapacityBytes: k8sVolume.SizeInBytes,
-			ContentSource: volContentSrc,
-			VolumeContext: map[string]string{
-				"dsm":              k8sVolume.DsmIp,
-				"protocol":         k8sVolume.Protocol,
-				"source":           k8sVolume.Source,
-				"formatOptions":    formatOptions,
-				"mountPermissions": mountPermissions,
-				"baseDir":          k8sVolume.BaseDir,
-			},
+			VolumeId:           k8sVolume.VolumeId,
+			CapacityBytes:      k8sVolume.SizeInBytes,
+			ContentSource:      volContentSrc,
+			AccessibleTopology: accessibleTopology,
+			VolumeContext:      volumeContext,
 		},
 	}, nil
 }
@@ -253,7 +468,17 @@ func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 		return nil, status.Errorf(codes.InvalidArgument, "No volume id is provided")
 	}
 
-	if err := cs.dsmService.DeleteVolume(volumeId); err != nil {
+	unlock, err := cs.volumeLocks.lock(ctx, volumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	if err := cs.dsmService.DeleteVolume(ctx, volumeId); err != nil {
+		// keep the retryable codes of a LUN in use or a busy DSM
+		if code := status.Code(err); code == codes.FailedPrecondition || code == codes.Unavailable {
+			return nil, err
+		}
 		return nil, status.Errorf(codes.Internal,
 			fmt.Sprintf("Failed to DeleteVolume(%s), err: %v", volumeId, err))
 	}
@@ -261,12 +486,75 @@ func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVol
 	return &csi.DeleteVolumeResponse{}, nil
 }
 
+// ControllerPublishVolume adds the initiator of the node to the ACLs of the target of an
+// iSCSI volume, so only the nodes it is published to can log into the target
 func (cs *controllerServer) ControllerPublishVolume(ctx context.Context, req *csi.ControllerPublishVolumeRequest) (*csi.ControllerPublishVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	if !cs.Driver.features.PublishUnpublish {
+		return nil, status.Error(codes.Unimplemented, "")
+	}
+
+	volumeId, nodeId, volCap := req.GetVolumeId(), req.GetNodeId(), req.GetVolumeCapability()
+	if volumeId == "" || nodeId == "" || volCap == nil {
+		return nil, status.Error(codes.InvalidArgument,
+			"InvalidArgument: Please check volume ID, node ID and volume capability.")
+	}
+
+	unlock, err := cs.volumeLocks.lock(ctx, volumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	k8sVolume := cs.dsmService.GetVolume(ctx, volumeId)
+	if k8sVolume == nil {
+		return nil, status.Errorf(codes.NotFound, "Volume[%s] does not exist", volumeId)
+	}
+	if err := validateAccessModeForProtocol(k8sVolume.Protocol, volCap); err != nil {
+		return nil, err
+	}
+	// NFS and SMB shares are only reachable by the clients their protocols allow
+	if k8sVolume.Protocol != utils.ProtocolIscsi {
+		return &csi.ControllerPublishVolumeResponse{}, nil
+	}
+
+	node, iqn := parseNodeId(nodeId)
+	if iqn == "" {
+		return nil, status.Errorf(codes.FailedPrecondition,
+			"Node[%s] reports no initiator name for the ACLs of volume[%s], start its node server with --initiator-name or --initiator-name-file", node, volumeId)
+	}
+	if err := cs.dsmService.PublishVolume(ctx, volumeId, iqn, isReadOnlyPublish(volCap, req.GetReadonly())); err != nil {
+		return nil, err
+	}
+	return &csi.ControllerPublishVolumeResponse{}, nil
 }
 
+// ControllerUnpublishVolume removes the initiator of the node from the ACLs of the target of
+// an iSCSI volume, or every initiator if no node is given
 func (cs *controllerServer) ControllerUnpublishVolume(ctx context.Context, req *csi.ControllerUnpublishVolumeRequest) (*csi.ControllerUnpublishVolumeResponse, error) {
-	return nil, status.Error(codes.Unimplemented, "")
+	if !cs.Driver.features.PublishUnpublish {
+		return nil, status.Error(codes.Unimplemented, "")
+	}
+
+	volumeId, nodeId := req.GetVolumeId(), req.GetNodeId()
+	if volumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "Volume ID missing in request")
+	}
+
+	unlock, err := cs.volumeLocks.lock(ctx, volumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
+	_, iqn := parseNodeId(nodeId)
+	// the volume was never published to a node without an initiator name
+	if nodeId != "" && iqn == "" {
+		return &csi.ControllerUnpublishVolumeResponse{}, nil
+	}
+	if err := cs.dsmService.UnpublishVolume(ctx, volumeId, iqn); err != nil {
+		return nil, err
+	}
+	return &csi.ControllerUnpublishVolumeResponse{}, nil
 }
 
 func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
@@ -279,20 +567,66 @@ func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req
 		return nil, status.Error(codes.InvalidArgument, "No volume capabilities are provided")
 	}
 
-	if cs.dsmService.GetVolume(volumeId) == nil {
+	k8sVolume := cs.dsmService.GetVolume(ctx, volumeId)
+	if k8sVolume == nil {
 		return nil, status.Errorf(codes.NotFound, "Volume[%s] does not exist", volumeId)
 	}
 
+	// Confirmed is set only if every capability is supported, as the spec requires
+	rejections := []string{}
 	for _, cap := range volCap {
-		if !cs.isVolumeAccessModeSupport(cap.GetAccessMode().GetMode()) {
-			return nil, status.Errorf(codes.NotFound, "Driver does not support volume capabilities:%v", volCap)
+		if err := cs.validateVolumeCapability(k8sVolume.Protocol, cap); err != nil {
+			rejections = append(rejections, err.Error())
 		}
 	}
+	if len(rejections) > 0 {
+		return &csi.ValidateVolumeCapabilitiesResponse{
+			Message: fmt.Sprintf("Unsupported capabilities of %s volume[%s]: %s", k8sVolume.Protocol, volumeId, strings.Join(rejections, "; ")),
+		}, nil
+	}
+
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.GetVolumeContext(),
+			VolumeCapabilities: volCap,
+			Parameters:         req.GetParameters(),
+		},
+	}, nil
+}
+
+// validateVolumeCapability tells why a volume of protocol can't be used with cap
+func (cs *controllerServer) validateVolumeCapability(protocol string, cap *csi.VolumeCapability) error {
+	mode := cap.GetAccessMode().GetMode()
+	if !cs.isVolumeAccessModeSupport(mode) {
+		return fmt.Errorf("access mode %s is not supported", mode)
+	}
+
+	switch {
+	case cap.GetBlock() != nil:
+		if protocol != utils.ProtocolIscsi {
+			return fmt.Errorf("raw block access is only supported for iSCSI volumes")
+		}
+	case cap.GetMount() != nil:
+		if protocol == utils.ProtocolIscsi {
+			if _, err := parseFsType(cap.GetMount().GetFsType()); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("no access type is provided")
+	}
 
-	return &csi.ValidateVolumeCapabilitiesResponse{}, nil
+	if err := validateAccessModeForProtocol(protocol, cap); err != nil {
+		return errors.New(status.Convert(err).Message())
+	}
+	return nil
 }
 
 func (cs *controllerServer) ListVolumes(ctx context.Context, req *csi.ListVolumesRequest) (*csi.ListVolumesResponse, error) {
+	if !cs.Driver.features.ListVolumes {
+		return nil, status.Error(codes.Unimplemented, "")
+	}
+
 	maxEntries := req.GetMaxEntries()
 	startingToken := req.GetStartingToken()
 
@@ -304,7 +638,7 @@ func (cs *controllerServer) ListVolumes(ctx context.Context, req *csi.ListVolume
 	}
 
 	pagingSkip := ("" != startingToken)
-	infos := cs.dsmService.ListVolumes()
+	infos := cs.dsmService.ListVolumes(ctx)
 
 	sort.Sort(models.ByVolumeId(infos))
 
@@ -353,7 +687,7 @@ func (cs *controllerServer) ListVolumes(ctx context.Context, req *csi.ListVolume
 func (cs *controllerServer) GetCapacity(ctx context.Context, req *csi.GetCapacityRequest) (*csi.GetCapacityResponse, error) {
 	params := req.GetParameters()
 
-	volInfos, err := cs.dsmService.ListDsmVolumes(params["dsm"])
+	volInfos, err := cs.dsmService.ListDsmVolumes(ctx, params["dsm"])
 
 	if err != nil {
 		return nil, status.Error(codes.InvalidArgument, "Failed to list dsm volumes")
@@ -400,23 +734,17 @@ func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateS
 	}
 
 	// idempotency
-	orgSnap := cs.dsmService.GetSnapshotByName(snapshotName)
+	orgSnap := cs.dsmService.GetSnapshotByName(ctx, snapshotName)
 	if orgSnap != nil {
 		// already existed
-		if orgSnap.ParentUuid != srcVolId {
+		if !models.SameVolume(orgSnap.SourceVolumeId(), srcVolId) {
 			return nil, status.Errorf(codes.AlreadyExists, fmt.Sprintf("Snapshot [%s] already exists but volume id is incompatible", snapshotName))
 		}
 		if orgSnap.CreateTime < 0 {
 			return nil, status.Errorf(codes.Internal, fmt.Sprintf("Bad create time: %v", orgSnap.CreateTime))
 		}
 		return &csi.CreateSnapshotResponse{
-			Snapshot: &csi.Snapshot{
-				SizeBytes:      orgSnap.SizeInBytes,
-				SnapshotId:     orgSnap.Uuid,
-				SourceVolumeId: orgSnap.ParentUuid,
-				CreationTime:   timestamppb.New(time.Unix(orgSnap.CreateTime, 0)),
-				ReadyToUse:     (orgSnap.Status == "Healthy"),
-			},
+			Snapshot: csiSnapshot(orgSnap),
 		}, nil
 	}
 
@@ -429,20 +757,14 @@ func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateS
 		IsLocked:     utils.StringToBoolean(params["is_locked"]),
 	}
 
-	snapshot, err := cs.dsmService.CreateSnapshot(spec)
+	snapshot, err := cs.dsmService.CreateSnapshot(ctx, spec)
 	if err != nil {
-		log.Errorf("Failed to CreateSnapshot, snapshotName: %s, srcVolId: %s, err: %v", snapshotName, srcVolId, err)
+		log.WithContext(ctx).Errorf("Failed to CreateSnapshot, snapshotName: %s, srcVolId: %s, err: %v", snapshotName, srcVolId, err)
 		return nil, err
 	}
 
 	return &csi.CreateSnapshotResponse{
-		Snapshot: &csi.Snapshot{
-			SizeBytes:      snapshot.SizeInBytes,
-			SnapshotId:     snapshot.Uuid,
-			SourceVolumeId: snapshot.ParentUuid,
-			CreationTime:   timestamppb.New(time.Unix(snapshot.CreateTime, 0)),
-			ReadyToUse:     (snapshot.Status == "Healthy"),
-		},
+		Snapshot: csiSnapshot(snapshot),
 	}, nil
 }
 
@@ -453,8 +775,11 @@ func (cs *controllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteS
 		return nil, status.Error(codes.InvalidArgument, "Snapshot id is empty.")
 	}
 
-	err := cs.dsmService.DeleteSnapshot(snapshotId)
+	err := cs.dsmService.DeleteSnapshot(ctx, snapshotId)
 	if err != nil {
+		if status.Code(err) == codes.FailedPrecondition {
+			return nil, err
+		}
 		return nil, status.Errorf(codes.Internal, fmt.Sprintf("Failed to DeleteSnapshot(%s), err: %v", snapshotId, err))
 	}
 
@@ -462,6 +787,10 @@ func (cs *controllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteS
 }
 
 func (cs *controllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (*csi.ListSnapshotsResponse, error) {
+	if !cs.Driver.features.ListSnapshots {
+		return nil, status.Error(codes.Unimplemented, "")
+	}
+
 	srcVolId := req.GetSourceVolumeId()
 	snapshotId := req.GetSnapshotId()
 	maxEntries := req.GetMaxEntries()
@@ -477,10 +806,17 @@ func (cs *controllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnap
 	pagingSkip := ("" != startingToken)
 	var snapshots []*models.K8sSnapshotRespSpec
 
-	if srcVolId != "" {
-		snapshots = cs.dsmService.ListSnapshots(srcVolId)
-	} else {
-		snapshots = cs.dsmService.ListAllSnapshots()
+	// unknown snapshots and source volumes give an empty list
+	switch {
+	case snapshotId != "":
+		snapshot := cs.dsmService.GetSnapshotByUuid(ctx, snapshotId)
+		if snapshot != nil && (srcVolId == "" || models.SameVolume(snapshot.SourceVolumeId(), srcVolId)) {
+			snapshots = append(snapshots, snapshot)
+		}
+	case srcVolId != "":
+		snapshots = cs.dsmService.ListSnapshots(ctx, srcVolId)
+	default:
+		snapshots = cs.dsmService.ListAllSnapshots(ctx)
 	}
 
 	sort.Sort(models.BySnapshotAndParentUuid(snapshots))
@@ -495,22 +831,12 @@ func (cs *controllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnap
 			continue
 		}
 
-		if snapshotId != "" && snapshot.Uuid != snapshotId {
-			continue
-		}
-
 		if maxEntries > 0 && count >= maxEntries {
 			nextToken = snapshot.Uuid
 			break
 		}
 		entries = append(entries, &csi.ListSnapshotsResponse_Entry{
-			Snapshot: &csi.Snapshot{
-				SizeBytes:      snapshot.SizeInBytes,
-				SnapshotId:     snapshot.Uuid,
-				SourceVolumeId: snapshot.ParentUuid,
-				CreationTime:   timestamppb.New(time.Unix(snapshot.CreateTime, 0)),
-				ReadyToUse:     (snapshot.Status == "Healthy"),
-			},
+			Snapshot: csiSnapshot(snapshot),
 		})
 
 		count++
@@ -527,6 +853,10 @@ func (cs *controllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnap
 }
 
 func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (*csi.ControllerExpandVolumeResponse, error) {
+	if !cs.Driver.features.Expand {
+		return nil, status.Error(codes.Unimplemented, "")
+	}
+
 	volumeId, capRange := req.GetVolumeId(), req.GetCapacityRange()
 
 	if volumeId == "" || capRange == nil {
@@ -534,13 +864,28 @@ func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi
 			"InvalidArgument: Please check volume ID and capacity range.")
 	}
 
+	unlock, err := cs.volumeLocks.lock(ctx, volumeId)
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+
 	sizeInByte, err := getSizeByCapacityRange(capRange)
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument,
 			"InvalidArgument: Please check CapacityRange[%v]", capRange)
 	}
 
-	k8sVolume, err := cs.dsmService.ExpandVolume(volumeId, sizeInByte)
+	volume := cs.dsmService.GetVolume(ctx, volumeId)
+	if volume == nil {
+		return nil, status.Errorf(codes.NotFound, "Volume[%s] does not exist", volumeId)
+	}
+	// the limits of the StorageClass aren't known, only the global ones apply
+	if sizeInByte, err = limitCapacity(sizeInByte, capRange, volume.Protocol, globalSizeLimits()); err != nil {
+		return nil, err
+	}
+
+	k8sVolume, err := cs.dsmService.ExpandVolume(ctx, volumeId, sizeInByte)
 	if err != nil {
 		return nil, err
 	}
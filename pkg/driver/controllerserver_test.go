@@ -0,0 +1,871 @@
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+	"github.com/SynologyOpenSource/synology-csi/pkg/interfaces"
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+// fakeDsmService implements the parts of IDsmService used by the tests,
+// calling any other method panics
+type fakeDsmService struct {
+	interfaces.IDsmService
+	dsms       map[string]*webapi.DSM
+	unhealthy  map[string]error
+	dsmVolumes []webapi.VolInfo
+	volumes    map[string]*models.K8sVolumeRespSpec
+	created    []*models.CreateK8sVolumeSpec
+	snapshots  map[string]*models.K8sSnapshotRespSpec
+	snapSpecs  []*models.CreateK8sVolumeSnapshotSpec
+	publishes  []string // "publish|unpublish <volume ID> <IQN>[ ro]"
+}
+
+func newFakeDsmService(dsmVolumes ...webapi.VolInfo) *fakeDsmService {
+	return &fakeDsmService{
+		dsms:       map[string]*webapi.DSM{"10.0.0.1": {Ip: "10.0.0.1"}},
+		dsmVolumes: dsmVolumes,
+		volumes:    make(map[string]*models.K8sVolumeRespSpec),
+		snapshots:  make(map[string]*models.K8sSnapshotRespSpec),
+	}
+}
+
+func (f *fakeDsmService) GetDsm(ip string) (*webapi.DSM, error) {
+	dsm, ok := f.dsms[ip]
+	if !ok {
+		return nil, fmt.Errorf("Requested dsm [%s] does not exist", ip)
+	}
+	return dsm, nil
+}
+
+func (f *fakeDsmService) GetDsmsCount() int {
+	return len(f.dsms)
+}
+
+func (f *fakeDsmService) UnhealthyDsms() map[string]error {
+	return f.unhealthy
+}
+
+func (f *fakeDsmService) ListDsmVolumes(ctx context.Context, ip string) ([]webapi.VolInfo, error) {
+	return f.dsmVolumes, nil
+}
+
+func (f *fakeDsmService) GetVolumeByName(ctx context.Context, volName string) *models.K8sVolumeRespSpec {
+	for _, vol := range f.volumes {
+		if vol.Name == models.GenLunName(volName) || vol.Name == models.GenShareName(volName) ||
+			vol.Target.Name == models.GenTargetName(volName) {
+			return vol
+		}
+	}
+	return nil
+}
+
+func (f *fakeDsmService) GetVolume(ctx context.Context, volId string) *models.K8sVolumeRespSpec {
+	return f.volumes[volId]
+}
+
+func (f *fakeDsmService) CreateVolume(ctx context.Context, spec *models.CreateK8sVolumeSpec) (*models.K8sVolumeRespSpec, error) {
+	f.created = append(f.created, spec)
+
+	location := spec.Location
+	if location == "" && len(f.dsmVolumes) > 0 {
+		location = f.dsmVolumes[0].Path
+	}
+	vol := &models.K8sVolumeRespSpec{
+		DsmIp:       "10.0.0.1",
+		VolumeId:    "uuid-" + spec.K8sVolumeName,
+		SizeInBytes: spec.Size,
+		Location:    location,
+		Name:        spec.LunName,
+		Protocol:    spec.Protocol,
+		Lun:         webapi.LunInfo{Description: spec.LunDescription},
+		Target:      webapi.TargetInfo{Name: spec.TargetName},
+		SubDir:      spec.SubDir,
+	}
+	if spec.DryRun {
+		vol.VolumeId = models.DryRunVolumePrefix + spec.K8sVolumeName
+		return vol, nil
+	}
+	f.volumes[vol.VolumeId] = vol
+	return vol, nil
+}
+
+func (f *fakeDsmService) DeleteVolume(ctx context.Context, volId string) error {
+	delete(f.volumes, volId)
+	return nil
+}
+
+func (f *fakeDsmService) ExpandVolume(ctx context.Context, volId string, newSize int64) (*models.K8sVolumeRespSpec, error) {
+	vol, ok := f.volumes[volId]
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "Volume[%s] does not exist", volId)
+	}
+	vol.SizeInBytes = newSize
+	return vol, nil
+}
+
+func (f *fakeDsmService) PublishVolume(ctx context.Context, volId string, iqn string, readonly bool) error {
+	call := "publish " + volId + " " + iqn
+	if readonly {
+		call += " ro"
+	}
+	f.publishes = append(f.publishes, call)
+	return nil
+}
+
+func (f *fakeDsmService) UnpublishVolume(ctx context.Context, volId string, iqn string) error {
+	f.publishes = append(f.publishes, "unpublish "+volId+" "+iqn)
+	return nil
+}
+
+func (f *fakeDsmService) GetSnapshotByName(ctx context.Context, snapshotName string) *models.K8sSnapshotRespSpec {
+	for _, snap := range f.snapshots {
+		if snap.Name == snapshotName {
+			return snap
+		}
+	}
+	return nil
+}
+
+func (f *fakeDsmService) CreateSnapshot(ctx context.Context, spec *models.CreateK8sVolumeSnapshotSpec) (*models.K8sSnapshotRespSpec, error) {
+	f.snapSpecs = append(f.snapSpecs, spec)
+
+	snap := &models.K8sSnapshotRespSpec{
+		Name:       spec.SnapshotName,
+		Uuid:       "uuid-" + spec.SnapshotName,
+		ParentUuid: spec.K8sVolumeId,
+		Status:     "Healthy",
+		IsLocked:   spec.IsLocked,
+	}
+	f.snapshots[snap.Uuid] = snap
+	return snap, nil
+}
+
+func (f *fakeDsmService) DeleteSnapshot(ctx context.Context, snapshotUuid string) error {
+	snap, ok := f.snapshots[snapshotUuid]
+	if !ok {
+		return nil
+	}
+	if snap.IsLocked {
+		return status.Errorf(codes.FailedPrecondition, "Snapshot [%s] is locked", snapshotUuid)
+	}
+	delete(f.snapshots, snapshotUuid)
+	return nil
+}
+
+func newTestControllerServer(dsmService interfaces.IDsmService) *controllerServer {
+	d, _ := NewControllerAndNodeDriver("node", "unix:///tmp/csi.sock", dsmService, tools{})
+	return &controllerServer{Driver: d, dsmService: dsmService}
+}
+
+func newCreateVolumeRequest(name string, params map[string]string) *csi.CreateVolumeRequest {
+	return &csi.CreateVolumeRequest{
+		Name:          name,
+		CapacityRange: &csi.CapacityRange{RequiredBytes: utils.UNIT_GB},
+		VolumeCapabilities: []*csi.VolumeCapability{{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		}},
+		Parameters: params,
+	}
+}
+
+func TestCreateVolume_location(t *testing.T) {
+	dsmService := newFakeDsmService(
+		webapi.VolInfo{Path: "/volume1", FsType: models.FsTypeBtrfs},
+		webapi.VolInfo{Path: "/volume2", FsType: models.FsTypeExt4},
+	)
+	cs := newTestControllerServer(dsmService)
+
+	tests := []struct {
+		name         string
+		location     string
+		wantCode     codes.Code
+		wantLocation string
+	}{
+		{name: "default location", location: "", wantCode: codes.OK, wantLocation: "/volume1"},
+		{name: "requested location", location: "/volume2", wantCode: codes.OK, wantLocation: "/volume2"},
+		{name: "unknown location", location: "/volume3", wantCode: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := cs.CreateVolume(context.Background(), newCreateVolumeRequest("pvc-"+tt.name, map[string]string{"location": tt.location}))
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("CreateVolume() code = %v, want %v (err: %v)", code, tt.wantCode, err)
+			}
+			if err != nil {
+				return
+			}
+			if got := resp.Volume.VolumeContext["location"]; got != tt.wantLocation {
+				t.Errorf("CreateVolume() location = %v, want %v", got, tt.wantLocation)
+			}
+			if spec := dsmService.created[len(dsmService.created)-1]; spec.Location != tt.location {
+				t.Errorf("CreateVolume() spec.Location = %v, want %v", spec.Location, tt.location)
+			}
+		})
+	}
+}
+
+func TestCreateVolume_dryRun(t *testing.T) {
+	dsmService := newFakeDsmService(webapi.VolInfo{Path: "/volume1", FsType: models.FsTypeBtrfs})
+	cs := newTestControllerServer(dsmService)
+
+	_, err := cs.CreateVolume(context.Background(), newCreateVolumeRequest("pvc-1", map[string]string{"dryRun": "true"}))
+	if code := status.Code(err); code != codes.FailedPrecondition {
+		t.Fatalf("CreateVolume() code = %v, want %v (err: %v)", code, codes.FailedPrecondition, err)
+	}
+	if !strings.Contains(err.Error(), "dry run: validation passed") {
+		t.Errorf("CreateVolume() err = %v, want a passed dry run", err)
+	}
+	if len(dsmService.created) != 1 || !dsmService.created[0].DryRun {
+		t.Errorf("CreateVolume() specs = %+v, want one dry run", dsmService.created)
+	}
+	if len(dsmService.volumes) != 0 {
+		t.Errorf("CreateVolume() created %d volumes in a dry run", len(dsmService.volumes))
+	}
+}
+
+func TestCreateSnapshot_descriptionAndLock(t *testing.T) {
+	dsmService := newFakeDsmService()
+	cs := newTestControllerServer(dsmService)
+
+	resp, err := cs.CreateSnapshot(context.Background(), &csi.CreateSnapshotRequest{
+		SourceVolumeId: "vol-1",
+		Name:           "snapshot-1",
+		Parameters:     map[string]string{"description": "nightly backup", "is_locked": "true"},
+	})
+	if err != nil {
+		t.Fatalf("CreateSnapshot() error = %v", err)
+	}
+
+	spec := dsmService.snapSpecs[0]
+	if spec.Description != "nightly backup" || !spec.IsLocked || spec.TakenBy != models.K8sCsiName {
+		t.Errorf("CreateSnapshot() spec = %+v", spec)
+	}
+
+	_, err = cs.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: resp.Snapshot.SnapshotId})
+	if code := status.Code(err); code != codes.FailedPrecondition {
+		t.Errorf("DeleteSnapshot() of locked snapshot code = %v, want %v", code, codes.FailedPrecondition)
+	}
+
+	dsmService.snapshots[resp.Snapshot.SnapshotId].IsLocked = false
+	if _, err := cs.DeleteSnapshot(context.Background(), &csi.DeleteSnapshotRequest{SnapshotId: resp.Snapshot.SnapshotId}); err != nil {
+		t.Errorf("DeleteSnapshot() of unlocked snapshot error = %v", err)
+	}
+}
+
+func (f *fakeDsmService) ListVolumes(ctx context.Context) []*models.K8sVolumeRespSpec {
+	var infos []*models.K8sVolumeRespSpec
+	for _, vol := range f.volumes {
+		infos = append(infos, vol)
+	}
+	return infos
+}
+
+func (f *fakeDsmService) ListAllSnapshots(ctx context.Context) []*models.K8sSnapshotRespSpec {
+	var infos []*models.K8sSnapshotRespSpec
+	for _, snap := range f.snapshots {
+		infos = append(infos, snap)
+	}
+	return infos
+}
+
+func (f *fakeDsmService) ListSnapshots(ctx context.Context, volId string) []*models.K8sSnapshotRespSpec {
+	var infos []*models.K8sSnapshotRespSpec
+	for _, snap := range f.snapshots {
+		if snap.ParentUuid == volId {
+			infos = append(infos, snap)
+		}
+	}
+	return infos
+}
+
+func (f *fakeDsmService) GetSnapshotByUuid(ctx context.Context, snapshotUuid string) *models.K8sSnapshotRespSpec {
+	return f.snapshots[snapshotUuid]
+}
+
+func TestListVolumesAndSnapshots_pagination(t *testing.T) {
+	dsmService := newFakeDsmService()
+	for i := 0; i < 25; i++ {
+		id := fmt.Sprintf("uuid-%02d", i)
+		dsmService.volumes[id] = &models.K8sVolumeRespSpec{VolumeId: id, SizeInBytes: utils.UNIT_GB, Protocol: utils.ProtocolIscsi}
+		dsmService.snapshots["snap-"+id] = &models.K8sSnapshotRespSpec{Uuid: "snap-" + id, ParentUuid: id}
+	}
+	cs := newTestControllerServer(dsmService)
+
+	var volumeIds []string
+	var pages int
+	token := ""
+	for {
+		resp, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{MaxEntries: 10, StartingToken: token})
+		if err != nil {
+			t.Fatalf("ListVolumes() error = %v", err)
+		}
+		pages++
+		for _, entry := range resp.Entries {
+			if entry.Volume.CapacityBytes != utils.UNIT_GB {
+				t.Errorf("ListVolumes() capacity = %d, want %d", entry.Volume.CapacityBytes, utils.UNIT_GB)
+			}
+			volumeIds = append(volumeIds, entry.Volume.VolumeId)
+		}
+		if token = resp.NextToken; token == "" {
+			break
+		}
+	}
+	if pages != 3 || len(volumeIds) != 25 || volumeIds[0] != "uuid-00" || volumeIds[24] != "uuid-24" {
+		t.Errorf("ListVolumes() paged %d times over %v", pages, volumeIds)
+	}
+
+	var snapshotIds []string
+	token = ""
+	for {
+		resp, err := cs.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{MaxEntries: 10, StartingToken: token})
+		if err != nil {
+			t.Fatalf("ListSnapshots() error = %v", err)
+		}
+		for _, entry := range resp.Entries {
+			snapshotIds = append(snapshotIds, entry.Snapshot.SnapshotId)
+		}
+		if token = resp.NextToken; token == "" {
+			break
+		}
+	}
+	if len(snapshotIds) != 25 {
+		t.Errorf("ListSnapshots() returned %d snapshots, want 25", len(snapshotIds))
+	}
+
+	if _, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{StartingToken: "expired"}); status.Code(err) != codes.Aborted {
+		t.Errorf("ListVolumes() with invalid token code = %v, want %v", status.Code(err), codes.Aborted)
+	}
+	if _, err := cs.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{StartingToken: "expired"}); status.Code(err) != codes.Aborted {
+		t.Errorf("ListSnapshots() with invalid token code = %v, want %v", status.Code(err), codes.Aborted)
+	}
+}
+
+func TestCreateVolume_lunType(t *testing.T) {
+	tests := []struct {
+		name     string
+		params   map[string]string
+		wantCode codes.Code
+		wantType string
+		wantThin bool
+	}{
+		{name: "default", params: map[string]string{}, wantCode: codes.OK, wantThin: true},
+		{name: "thick", params: map[string]string{"thin_provisioning": "false"}, wantCode: codes.OK, wantThin: false},
+		{name: "thick type", params: map[string]string{"type": "blun_thick"}, wantCode: codes.OK, wantType: models.LunTypeBlunThick, wantThin: false},
+		{name: "thin type", params: map[string]string{"type": "BLUN", "thin_provisioning": "true"}, wantCode: codes.OK, wantType: models.LunTypeBlun, wantThin: true},
+		{name: "contradicting", params: map[string]string{"type": "FILE", "thin_provisioning": "true"}, wantCode: codes.InvalidArgument},
+		{name: "unknown type", params: map[string]string{"type": "SPARSE"}, wantCode: codes.InvalidArgument},
+		{name: "snapshots", params: map[string]string{"requireSnapshots": "true"}, wantCode: codes.OK, wantThin: true},
+		{name: "snapshots of advanced type", params: map[string]string{"type": "ADV", "requireSnapshots": "true"}, wantCode: codes.OK, wantType: models.LunTypeAdv, wantThin: true},
+		{name: "snapshots of thick type", params: map[string]string{"type": "BLUN_THICK", "requireSnapshots": "true"}, wantCode: codes.OK, wantType: models.LunTypeBlunThick, wantThin: false},
+		{name: "snapshots of legacy thin type", params: map[string]string{"type": "THIN", "requireSnapshots": "true"}, wantCode: codes.InvalidArgument},
+		{name: "snapshots of file type", params: map[string]string{"type": "FILE", "requireSnapshots": "true"}, wantCode: codes.InvalidArgument},
+		{name: "snapshots of share", params: map[string]string{"protocol": "nfs", "requireSnapshots": "true"}, wantCode: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dsmService := newFakeDsmService()
+			cs := newTestControllerServer(dsmService)
+
+			_, err := cs.CreateVolume(context.Background(), newCreateVolumeRequest("pvc-"+tt.name, tt.params))
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("CreateVolume() code = %v, want %v (err: %v)", code, tt.wantCode, err)
+			}
+			if err != nil {
+				return
+			}
+			if spec := dsmService.created[0]; spec.Type != tt.wantType || spec.ThinProvisioning != tt.wantThin {
+				t.Errorf("CreateVolume() spec type = %q, thin = %v, want %q, %v", spec.Type, spec.ThinProvisioning, tt.wantType, tt.wantThin)
+			}
+			if spec := dsmService.created[0]; spec.Snapshots != (tt.params["requireSnapshots"] == "true") {
+				t.Errorf("CreateVolume() spec snapshots = %v, want requireSnapshots %q", spec.Snapshots, tt.params["requireSnapshots"])
+			}
+		})
+	}
+}
+
+func TestCreateVolume_qos(t *testing.T) {
+	tests := []struct {
+		name     string
+		params   map[string]string
+		wantCode codes.Code
+		wantQos  webapi.LunQos
+	}{
+		{name: "unlimited", params: map[string]string{}, wantCode: codes.OK},
+		{name: "limits", params: map[string]string{"maxIops": "500", "maxThroughputMBps": "100"}, wantCode: codes.OK,
+			wantQos: webapi.LunQos{MaxIops: 500, MaxThroughput: 100}},
+		{name: "negative", params: map[string]string{"maxIops": "-1"}, wantCode: codes.InvalidArgument},
+		{name: "not a number", params: map[string]string{"maxThroughputMBps": "1G"}, wantCode: codes.InvalidArgument},
+		{name: "share", params: map[string]string{"protocol": "nfs", "maxIops": "500"}, wantCode: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dsmService := newFakeDsmService()
+			cs := newTestControllerServer(dsmService)
+
+			_, err := cs.CreateVolume(context.Background(), newCreateVolumeRequest("pvc-"+tt.name, tt.params))
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("CreateVolume() code = %v, want %v (err: %v)", code, tt.wantCode, err)
+			}
+			if err != nil {
+				return
+			}
+			if got := dsmService.created[0].Qos; got != tt.wantQos {
+				t.Errorf("CreateVolume() spec QoS = %+v, want %+v", got, tt.wantQos)
+			}
+		})
+	}
+}
+
+func TestCreateVolume_blockSize(t *testing.T) {
+	tests := []struct {
+		name      string
+		params    map[string]string
+		wantCode  codes.Code
+		wantBlock int
+	}{
+		{name: "default", params: map[string]string{}, wantCode: codes.OK},
+		{name: "512", params: map[string]string{"blockSize": "512"}, wantCode: codes.OK, wantBlock: 512},
+		{name: "4kn", params: map[string]string{"blockSize": "4096"}, wantCode: codes.OK, wantBlock: 4096},
+		{name: "unsupported size", params: map[string]string{"blockSize": "1024"}, wantCode: codes.InvalidArgument},
+		{name: "not a number", params: map[string]string{"blockSize": "4k"}, wantCode: codes.InvalidArgument},
+		{name: "share", params: map[string]string{"protocol": "smb", "blockSize": "4096"}, wantCode: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dsmService := newFakeDsmService()
+			cs := newTestControllerServer(dsmService)
+
+			_, err := cs.CreateVolume(context.Background(), newCreateVolumeRequest("pvc-"+tt.name, tt.params))
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("CreateVolume() code = %v, want %v (err: %v)", code, tt.wantCode, err)
+			}
+			if err == nil && dsmService.created[0].BlockSize != tt.wantBlock {
+				t.Errorf("CreateVolume() spec block size = %d, want %d", dsmService.created[0].BlockSize, tt.wantBlock)
+			}
+		})
+	}
+}
+
+func TestCreateVolume_nfsExport(t *testing.T) {
+	dsmService := newFakeDsmService()
+	cs := newTestControllerServer(dsmService)
+
+	params := map[string]string{"protocol": "nfs", "nfsClients": "10.0.0.0/24", "nfsRootSquash": "no_mapping"}
+	resp, err := cs.CreateVolume(context.Background(), newCreateVolumeRequest("pvc-nfs", params))
+	if err != nil {
+		t.Fatalf("CreateVolume() error = %v", err)
+	}
+	if export := dsmService.created[0].NfsExport; export == nil || len(export.Clients) != 1 || export.Clients[0] != "10.0.0.0/24" {
+		t.Errorf("CreateVolume() spec NFS export = %+v", export)
+	}
+	if got := resp.Volume.VolumeContext["nfsClients"]; got != "10.0.0.0/24" {
+		t.Errorf("CreateVolume() VolumeContext nfsClients = %q", got)
+	}
+
+	for name, params := range map[string]map[string]string{
+		"malformed cidr": {"protocol": "nfs", "nfsClients": "10.0.0.300/24"},
+		"iscsi":          {"protocol": "iscsi", "nfsClients": "10.0.0.0/24"},
+	} {
+		if _, err := cs.CreateVolume(context.Background(), newCreateVolumeRequest("pvc-"+name, params)); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("CreateVolume() with %s code = %v, want %v", name, status.Code(err), codes.InvalidArgument)
+		}
+	}
+}
+
+func TestCreateVolume_credentialRef(t *testing.T) {
+	dsmService := newFakeDsmService()
+	cs := newTestControllerServer(dsmService)
+
+	for _, profile := range []string{"", "team-a"} {
+		params := map[string]string{"protocol": "iscsi"}
+		if profile != "" {
+			params["credentialRef"] = profile
+		}
+		if _, err := cs.CreateVolume(context.Background(), newCreateVolumeRequest("pvc-"+profile, params)); err != nil {
+			t.Fatalf("CreateVolume() error = %v", err)
+		}
+		if got := dsmService.created[len(dsmService.created)-1].Profile; got != profile {
+			t.Errorf("CreateVolume() spec profile = %q, want %q", got, profile)
+		}
+	}
+}
+
+func TestCreateVolume_parentShare(t *testing.T) {
+	dsmService := newFakeDsmService()
+	cs := newTestControllerServer(dsmService)
+
+	params := map[string]string{"protocol": "nfs", "parentShare": "k8s", "subDirOnDelete": "retain"}
+	resp, err := cs.CreateVolume(context.Background(), newCreateVolumeRequest("pvc-sub", params))
+	if err != nil {
+		t.Fatalf("CreateVolume() error = %v", err)
+	}
+	spec := dsmService.created[0]
+	if spec.ParentShare != "k8s" || spec.SubDir != "pvc-sub" || spec.SubDirOnDelete != models.SubDirRetain {
+		t.Errorf("CreateVolume() spec = %+v, want subdirectory pvc-sub of k8s retained on delete", spec)
+	}
+	if got := resp.Volume.VolumeContext["subDir"]; got != "pvc-sub" {
+		t.Errorf("CreateVolume() volume context subDir = %q, want pvc-sub", got)
+	}
+
+	req := newCreateVolumeRequest("pvc-clone", params)
+	req.VolumeContentSource = &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Snapshot{
+		Snapshot: &csi.VolumeContentSource_SnapshotSource{SnapshotId: "snapshot-1"},
+	}}
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("CreateVolume() from a snapshot error = %v, want %v", err, codes.InvalidArgument)
+	}
+}
+
+func TestCreateVolume_encryption(t *testing.T) {
+	dsmService := newFakeDsmService()
+	cs := newTestControllerServer(dsmService)
+
+	req := newCreateVolumeRequest("pvc-enc", map[string]string{"protocol": "nfs", "encryption": "true"})
+	req.Secrets = map[string]string{"encryptionPassphrase": "secret"}
+	resp, err := cs.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("CreateVolume() error = %v", err)
+	}
+	if got := dsmService.created[0].EncryptionPassphrase; got != "secret" {
+		t.Errorf("CreateVolume() spec passphrase = %q, want the one of the secret", string(got))
+	}
+	if got := resp.Volume.VolumeContext["encryption"]; got != "true" {
+		t.Errorf("CreateVolume() VolumeContext encryption = %q, want true", got)
+	}
+
+	clone := newCreateVolumeRequest("pvc-enc-clone", map[string]string{"protocol": "smb", "encryption": "true"})
+	clone.Secrets = req.Secrets
+	clone.VolumeContentSource = &csi.VolumeContentSource{Type: &csi.VolumeContentSource_Volume{
+		Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: resp.Volume.VolumeId},
+	}}
+	for name, req := range map[string]*csi.CreateVolumeRequest{
+		"no passphrase": newCreateVolumeRequest("pvc-enc-nosecret", map[string]string{"protocol": "nfs", "encryption": "true"}),
+		"iscsi":         newCreateVolumeRequest("pvc-enc-iscsi", map[string]string{"protocol": "iscsi", "encryption": "true"}),
+		"clone":         clone,
+	} {
+		if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+			t.Errorf("CreateVolume() with %s code = %v, want %v", name, status.Code(err), codes.InvalidArgument)
+		}
+	}
+}
+
+func TestCreateVolume_lunDescription(t *testing.T) {
+	longName := strings.Repeat("a", 120)
+	tests := []struct {
+		name   string
+		params map[string]string
+		want   string
+	}{
+		{name: "no metadata", params: map[string]string{}, want: ""},
+		{
+			name: "pvc and pv",
+			params: map[string]string{
+				"csi.storage.k8s.io/pvc/namespace": "default",
+				"csi.storage.k8s.io/pvc/name":      "data",
+				"csi.storage.k8s.io/pv/name":       "pvc-1234",
+			},
+			want: "default/data (pvc-1234)",
+		},
+		{
+			name: "truncated",
+			params: map[string]string{
+				"csi.storage.k8s.io/pvc/namespace": "default",
+				"csi.storage.k8s.io/pvc/name":      longName,
+				"csi.storage.k8s.io/pv/name":       "pvc-1234",
+			},
+			want: ("default/" + longName + " (pvc-1234)")[:models.MaxLunDescLen],
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dsmService := newFakeDsmService()
+			cs := newTestControllerServer(dsmService)
+
+			if _, err := cs.CreateVolume(context.Background(), newCreateVolumeRequest("pvc-"+tt.name, tt.params)); err != nil {
+				t.Fatalf("CreateVolume() error = %v", err)
+			}
+			if got := dsmService.created[0].LunDescription; got != tt.want {
+				t.Errorf("CreateVolume() description = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateVolume_namespaceQuota(t *testing.T) {
+	defer func(quotas map[string]int64) { NamespaceQuotas = quotas }(NamespaceQuotas)
+	NamespaceQuotas = map[string]int64{"team-a": 5 * utils.UNIT_GB}
+
+	tests := []struct {
+		name     string
+		used     int64
+		protocol string
+		wantCode codes.Code
+	}{
+		{name: "under quota", used: 3 * utils.UNIT_GB, wantCode: codes.OK},
+		{name: "at quota", used: 4 * utils.UNIT_GB, wantCode: codes.OK},
+		{name: "over quota", used: 5 * utils.UNIT_GB, wantCode: codes.ResourceExhausted},
+		{name: "untagged share", used: 5 * utils.UNIT_GB, protocol: utils.ProtocolNfs, wantCode: codes.OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nfsLocation := webapi.VolInfo{Path: "/volume1", FsType: models.FsTypeBtrfs}
+			dsmService := newFakeDsmService(nfsLocation)
+			dsmService.volumes["uuid-a"] = &models.K8sVolumeRespSpec{
+				VolumeId: "uuid-a", Protocol: utils.ProtocolIscsi, SizeInBytes: tt.used,
+				Lun: webapi.LunInfo{Description: "team-a/data (pvc-a)"},
+			}
+			dsmService.volumes["uuid-b"] = &models.K8sVolumeRespSpec{
+				VolumeId: "uuid-b", Protocol: utils.ProtocolIscsi, SizeInBytes: 10 * utils.UNIT_GB,
+				Lun: webapi.LunInfo{Description: "team-b/data (pvc-b)"},
+			}
+			cs := newTestControllerServer(dsmService)
+
+			params := map[string]string{
+				"csi.storage.k8s.io/pvc/namespace": "team-a",
+				"csi.storage.k8s.io/pvc/name":      "logs",
+			}
+			if tt.protocol != "" {
+				params["protocol"] = tt.protocol
+			}
+			_, err := cs.CreateVolume(context.Background(), newCreateVolumeRequest("pvc-new", params))
+			if code := status.Code(err); code != tt.wantCode {
+				t.Errorf("CreateVolume() code = %v, want %v (err: %v)", code, tt.wantCode, err)
+			}
+		})
+	}
+}
+
+func TestListSnapshots_filters(t *testing.T) {
+	dsmService := newFakeDsmService()
+	for i := 0; i < 3; i++ {
+		for _, vol := range []string{"vol-a", "vol-b"} {
+			id := fmt.Sprintf("snap-%s-%d", vol, i)
+			dsmService.snapshots[id] = &models.K8sSnapshotRespSpec{Uuid: id, ParentUuid: vol, Status: "Healthy"}
+		}
+	}
+	cs := newTestControllerServer(dsmService)
+
+	tests := []struct {
+		name string
+		req  *csi.ListSnapshotsRequest
+		want []string
+	}{
+		{
+			name: "by source volume",
+			req:  &csi.ListSnapshotsRequest{SourceVolumeId: "vol-a"},
+			want: []string{"snap-vol-a-0", "snap-vol-a-1", "snap-vol-a-2"},
+		},
+		{
+			name: "by source volume, paged",
+			req:  &csi.ListSnapshotsRequest{SourceVolumeId: "vol-b", MaxEntries: 2, StartingToken: "snap-vol-b-1"},
+			want: []string{"snap-vol-b-1", "snap-vol-b-2"},
+		},
+		{
+			name: "by id",
+			req:  &csi.ListSnapshotsRequest{SnapshotId: "snap-vol-b-1"},
+			want: []string{"snap-vol-b-1"},
+		},
+		{
+			name: "by id of another source volume",
+			req:  &csi.ListSnapshotsRequest{SnapshotId: "snap-vol-b-1", SourceVolumeId: "vol-a"},
+			want: []string{},
+		},
+		{name: "unknown source volume", req: &csi.ListSnapshotsRequest{SourceVolumeId: "vol-c"}, want: []string{}},
+		{name: "unknown id", req: &csi.ListSnapshotsRequest{SnapshotId: "snap-missing"}, want: []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := cs.ListSnapshots(context.Background(), tt.req)
+			if err != nil {
+				t.Fatalf("ListSnapshots() error = %v", err)
+			}
+			got := []string{}
+			for _, entry := range resp.Entries {
+				if tt.req.SourceVolumeId != "" && entry.Snapshot.SourceVolumeId != tt.req.SourceVolumeId {
+					t.Errorf("ListSnapshots() returned %s of volume %s", entry.Snapshot.SnapshotId, entry.Snapshot.SourceVolumeId)
+				}
+				got = append(got, entry.Snapshot.SnapshotId)
+			}
+			if strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("ListSnapshots() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateVolumeCapabilities(t *testing.T) {
+	dsmService := newFakeDsmService()
+	dsmService.volumes["lun-uuid"] = &models.K8sVolumeRespSpec{VolumeId: "lun-uuid", Protocol: utils.ProtocolIscsi}
+	dsmService.volumes["share-uuid"] = &models.K8sVolumeRespSpec{VolumeId: "share-uuid", Protocol: utils.ProtocolNfs}
+	cs := newTestControllerServer(dsmService)
+
+	mountCap := func(mode csi.VolumeCapability_AccessMode_Mode, fsType string) *csi.VolumeCapability {
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: fsType}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+		}
+	}
+	blockCap := func(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+		}
+	}
+
+	tests := []struct {
+		name          string
+		volumeId      string
+		caps          []*csi.VolumeCapability
+		wantCode      codes.Code
+		wantConfirmed bool
+	}{
+		{name: "iscsi filesystem", volumeId: "lun-uuid", wantCode: codes.OK, wantConfirmed: true,
+			caps: []*csi.VolumeCapability{mountCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, "xfs")}},
+		{name: "iscsi multi-writer block", volumeId: "lun-uuid", wantCode: codes.OK, wantConfirmed: true,
+			caps: []*csi.VolumeCapability{blockCap(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)}},
+		{name: "iscsi multi-writer filesystem", volumeId: "lun-uuid", wantCode: codes.OK, wantConfirmed: false,
+			caps: []*csi.VolumeCapability{
+				mountCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, ""),
+				mountCap(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, ""),
+			}},
+		{name: "iscsi unknown fsType", volumeId: "lun-uuid", wantCode: codes.OK, wantConfirmed: false,
+			caps: []*csi.VolumeCapability{mountCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, "zfs")}},
+		{name: "share multi-writer", volumeId: "share-uuid", wantCode: codes.OK, wantConfirmed: true,
+			caps: []*csi.VolumeCapability{mountCap(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, "")}},
+		{name: "share block", volumeId: "share-uuid", wantCode: codes.OK, wantConfirmed: false,
+			caps: []*csi.VolumeCapability{blockCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)}},
+		{name: "missing volume", volumeId: "missing", wantCode: codes.NotFound,
+			caps: []*csi.VolumeCapability{mountCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, "")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, err := cs.ValidateVolumeCapabilities(context.Background(), &csi.ValidateVolumeCapabilitiesRequest{
+				VolumeId:           tt.volumeId,
+				VolumeCapabilities: tt.caps,
+			})
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("ValidateVolumeCapabilities() code = %v, want %v (err: %v)", code, tt.wantCode, err)
+			}
+			if err != nil {
+				return
+			}
+			if confirmed := resp.GetConfirmed() != nil; confirmed != tt.wantConfirmed {
+				t.Errorf("ValidateVolumeCapabilities() confirmed = %v, want %v, message: %q", confirmed, tt.wantConfirmed, resp.GetMessage())
+			}
+			if !tt.wantConfirmed && resp.GetMessage() == "" {
+				t.Errorf("ValidateVolumeCapabilities() rejected without a message")
+			}
+		})
+	}
+}
+
+func TestControllerPublishVolume_acls(t *testing.T) {
+	defer func(f Features) { EnabledFeatures = f }(EnabledFeatures)
+	EnabledFeatures.PublishUnpublish = true
+
+	dsmService := newFakeDsmService()
+	dsmService.volumes["lun-uuid"] = &models.K8sVolumeRespSpec{VolumeId: "lun-uuid", Protocol: utils.ProtocolIscsi}
+	dsmService.volumes["share-uuid"] = &models.K8sVolumeRespSpec{VolumeId: "share-uuid", Protocol: utils.ProtocolNfs}
+	cs := newTestControllerServer(dsmService)
+
+	const iqn = "iqn.1993-08.org.debian:01:node1"
+	mountCap := func(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+		}
+	}
+	tests := []struct {
+		name     string
+		req      *csi.ControllerPublishVolumeRequest
+		wantCode codes.Code
+		want     string // the call to the DSM service, empty if none
+	}{
+		{
+			name: "iscsi",
+			req:  &csi.ControllerPublishVolumeRequest{VolumeId: "lun-uuid", NodeId: nodeIdWithIqn("node1", iqn), VolumeCapability: mountCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+			want: "publish lun-uuid " + iqn,
+		},
+		{
+			name: "read-only",
+			req:  &csi.ControllerPublishVolumeRequest{VolumeId: "lun-uuid", NodeId: nodeIdWithIqn("node1", iqn), VolumeCapability: mountCap(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY)},
+			want: "publish lun-uuid " + iqn + " ro",
+		},
+		{
+			name: "share",
+			req:  &csi.ControllerPublishVolumeRequest{VolumeId: "share-uuid", NodeId: "node1", VolumeCapability: mountCap(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)},
+		},
+		{
+			name:     "node without initiator name",
+			req:      &csi.ControllerPublishVolumeRequest{VolumeId: "lun-uuid", NodeId: "node1", VolumeCapability: mountCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+			wantCode: codes.FailedPrecondition,
+		},
+		{
+			name:     "missing volume",
+			req:      &csi.ControllerPublishVolumeRequest{VolumeId: "gone", NodeId: nodeIdWithIqn("node1", iqn), VolumeCapability: mountCap(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)},
+			wantCode: codes.NotFound,
+		},
+		{
+			name:     "no capability",
+			req:      &csi.ControllerPublishVolumeRequest{VolumeId: "lun-uuid", NodeId: nodeIdWithIqn("node1", iqn)},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			// several nodes writing to one filesystem corrupt it
+			name:     "iscsi filesystem multi-writer",
+			req:      &csi.ControllerPublishVolumeRequest{VolumeId: "lun-uuid", NodeId: nodeIdWithIqn("node1", iqn), VolumeCapability: mountCap(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)},
+			wantCode: codes.InvalidArgument,
+		},
+		{
+			name: "iscsi block multi-writer",
+			req: &csi.ControllerPublishVolumeRequest{VolumeId: "lun-uuid", NodeId: nodeIdWithIqn("node1", iqn), VolumeCapability: &csi.VolumeCapability{
+				AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+				AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+			}},
+			want: "publish lun-uuid " + iqn,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dsmService.publishes = nil
+			_, err := cs.ControllerPublishVolume(context.Background(), tt.req)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("ControllerPublishVolume() code = %v, want %v (err: %v)", code, tt.wantCode, err)
+			}
+			if got := strings.Join(dsmService.publishes, ","); got != tt.want {
+				t.Errorf("ControllerPublishVolume() called %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	unpublishes := []struct {
+		nodeId string
+		want   string
+	}{
+		{nodeIdWithIqn("node1", iqn), "unpublish lun-uuid " + iqn},
+		// never published, the node has no initiator name
+		{"node1", ""},
+		// every node
+		{"", "unpublish lun-uuid "},
+	}
+	for _, tt := range unpublishes {
+		dsmService.publishes = nil
+		if _, err := cs.ControllerUnpublishVolume(context.Background(), &csi.ControllerUnpublishVolumeRequest{VolumeId: "lun-uuid", NodeId: tt.nodeId}); err != nil {
+			t.Fatalf("ControllerUnpublishVolume(%q) error = %v", tt.nodeId, err)
+		}
+		if got := strings.Join(dsmService.publishes, ","); got != tt.want {
+			t.Errorf("ControllerUnpublishVolume(%q) called %q, want %q", tt.nodeId, got, tt.want)
+		}
+	}
+}
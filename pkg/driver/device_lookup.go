@@ -0,0 +1,223 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// byPathDir and sysfsDir are where the devices of the LUNs are looked up, replaced by the tests
+var (
+	byPathDir = "/dev/disk/by-path"
+	sysfsDir  = "/sys"
+)
+
+// deviceCacheTTL is how long the device found for a LUN is reused by the next stages
+var deviceCacheTTL = time.Minute
+
+// byPathLink is what udev tells about an iSCSI device by the name of its link in byPathDir
+type byPathLink struct {
+	Portal string
+	Iqn    string
+	Lun    int
+}
+
+// byPathName returns the name of the link udev creates for the LUN of a target, e.g.
+// ip-10.0.0.1:3260-iscsi-iqn.2000-01.com.synology:ds.pvc-1-lun-0
+func byPathName(portal string, iqn string, lun int) string {
+	return fmt.Sprintf("ip-%s-iscsi-%s-lun-%d", portal, iqn, lun)
+}
+
+// parseByPathName parses the name of an iSCSI link in byPathDir, the links of partitions
+// and of other transports aren't
+func parseByPathName(name string) (byPathLink, bool) {
+	rest, ok := strings.CutPrefix(name, "ip-")
+	if !ok {
+		return byPathLink{}, false
+	}
+	portal, rest, ok := strings.Cut(rest, "-iscsi-")
+	if !ok || portal == "" {
+		return byPathLink{}, false
+	}
+	i := strings.LastIndex(rest, "-lun-")
+	if i <= 0 {
+		return byPathLink{}, false
+	}
+	lun, err := strconv.Atoi(rest[i+len("-lun-"):])
+	if err != nil || lun < 0 {
+		return byPathLink{}, false
+	}
+	return byPathLink{Portal: portal, Iqn: rest[:i], Lun: lun}, true
+}
+
+// samePortal tells if two portals are the same address and port, whatever the brackets of IPv6
+func samePortal(a string, b string) bool {
+	hostA, portA, errA := net.SplitHostPort(a)
+	hostB, portB, errB := net.SplitHostPort(b)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+	ipA, ipB := net.ParseIP(hostA), net.ParseIP(hostB)
+	if ipA == nil || ipB == nil {
+		return portA == portB && hostA == hostB
+	}
+	return portA == portB && ipA.Equal(ipB)
+}
+
+// findByPathDevice returns the link in byPathDir of the LUN of a target logged in through
+// portal, empty if udev didn't create it yet
+func findByPathDevice(portal string, iqn string, lun int) (string, error) {
+	path := filepath.Join(byPathDir, byPathName(portal, iqn, lun))
+	if exists, err := devicePathExists(path); err != nil || exists {
+		return path, err
+	}
+
+	// udev may spell the portal differently, e.g. with the brackets of an IPv6 address
+	entries, err := os.ReadDir(byPathDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	for _, entry := range entries {
+		link, ok := parseByPathName(entry.Name())
+		if ok && link.Iqn == iqn && link.Lun == lun && samePortal(link.Portal, portal) {
+			return filepath.Join(byPathDir, entry.Name()), nil
+		}
+	}
+	return "", nil
+}
+
+// findSysfsDevice returns the block device of the LUN of a target logged in through portal
+// from the iSCSI sessions in sysfsDir, empty if the kernel didn't add it yet
+func findSysfsDevice(portal string, iqn string, lun int) (string, error) {
+	names, err := filepath.Glob(filepath.Join(sysfsDir, "class/iscsi_session/session*/targetname"))
+	if err != nil {
+		return "", err
+	}
+	for _, name := range names {
+		if targetname, err := os.ReadFile(name); err != nil || strings.TrimSpace(string(targetname)) != iqn {
+			continue
+		}
+		session := filepath.Dir(name)
+		if !sessionUsesPortal(session, portal) {
+			continue
+		}
+		// session*/device/target<host>:<channel>:<id>/<host>:<channel>:<id>:<lun>/block/<dev>
+		blocks, err := filepath.Glob(filepath.Join(session, "device/target*", fmt.Sprintf("*:*:*:%d", lun), "block/*"))
+		if err != nil {
+			return "", err
+		}
+		if len(blocks) > 0 {
+			return filepath.Join("/dev", filepath.Base(blocks[0])), nil
+		}
+	}
+	return "", nil
+}
+
+// sessionUsesPortal tells if the connection of the iSCSI session in sysfs is to portal
+func sessionUsesPortal(session string, portal string) bool {
+	conns, _ := filepath.Glob(filepath.Join(session, "device/connection*/iscsi_connection/connection*"))
+	for _, conn := range conns {
+		address, errAddress := os.ReadFile(filepath.Join(conn, "persistent_address"))
+		port, errPort := os.ReadFile(filepath.Join(conn, "persistent_port"))
+		if errAddress != nil || errPort != nil {
+			continue
+		}
+		if samePortal(net.JoinHostPort(strings.TrimSpace(string(address)), strings.TrimSpace(string(port))), portal) {
+			return true
+		}
+	}
+	return false
+}
+
+// findLunDevice returns the device of the LUN of a target logged in through portal, the
+// link udev creates in byPathDir if there's one, or else the block device from sysfs.
+// It is empty if neither is there yet.
+func findLunDevice(portal string, iqn string, lun int) (string, error) {
+	path, err := findByPathDevice(portal, iqn, lun)
+	if err != nil || path != "" {
+		return path, err
+	}
+	if path, err = findSysfsDevice(portal, iqn, lun); path != "" {
+		log.Infof("Device [%s] of LUN %d of target [%s] found in sysfs, udev didn't link it yet", path, lun, iqn)
+	}
+	return path, err
+}
+
+// deviceCache remembers the devices found for the LUNs for deviceCacheTTL, the zero
+// value is an empty cache
+type deviceCache struct {
+	mu      sync.Mutex
+	entries map[string]deviceCacheEntry
+}
+
+type deviceCacheEntry struct {
+	path    string
+	expires time.Time
+}
+
+func deviceCacheKey(portal string, iqn string, lun int) string {
+	return fmt.Sprintf("%s,%s,%d", iqn, portal, lun)
+}
+
+// get returns the cached device of the LUN, if it didn't expire and still exists
+func (c *deviceCache) get(portal string, iqn string, lun int) string {
+	c.mu.Lock()
+	entry, ok := c.entries[deviceCacheKey(portal, iqn, lun)]
+	c.mu.Unlock()
+	if !ok || time.Now().After(entry.expires) {
+		return ""
+	}
+	if exists, err := devicePathExists(entry.path); err != nil || !exists {
+		c.mu.Lock()
+		delete(c.entries, deviceCacheKey(portal, iqn, lun))
+		c.mu.Unlock()
+		return ""
+	}
+	return entry.path
+}
+
+func (c *deviceCache) put(portal string, iqn string, lun int, path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]deviceCacheEntry)
+	}
+	c.entries[deviceCacheKey(portal, iqn, lun)] = deviceCacheEntry{path: path, expires: time.Now().Add(deviceCacheTTL)}
+}
+
+// forget drops the devices of the LUNs of a target, e.g. after logging out of it
+func (c *deviceCache) forget(iqn string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for key := range c.entries {
+		if strings.HasPrefix(key, iqn+",") {
+			delete(c.entries, key)
+		}
+	}
+}
@@ -0,0 +1,189 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+const testLunIqn = "iqn.2000-01.com.synology:ds.pvc-1-lun-x"
+
+func TestParseByPathName(t *testing.T) {
+	tests := []struct {
+		name   string
+		want   byPathLink
+		wantOk bool
+	}{
+		{name: "ip-10.0.0.1:3260-iscsi-" + testLunIqn + "-lun-3", want: byPathLink{Portal: "10.0.0.1:3260", Iqn: testLunIqn, Lun: 3}, wantOk: true},
+		{name: "ip-[fd00::1]:3260-iscsi-" + testLunIqn + "-lun-0", want: byPathLink{Portal: "[fd00::1]:3260", Iqn: testLunIqn, Lun: 0}, wantOk: true},
+		{name: "ip-10.0.0.1:3260-iscsi-" + testLunIqn + "-lun-3-part1"},
+		{name: "pci-0000:00:1f.2-ata-1"},
+		{name: "ip-10.0.0.1:3260-iscsi-" + testLunIqn},
+		{name: "ip--iscsi-" + testLunIqn + "-lun-1"},
+	}
+	for _, tt := range tests {
+		got, ok := parseByPathName(tt.name)
+		if ok != tt.wantOk || got != tt.want {
+			t.Errorf("parseByPathName(%q) = %+v, %v, want %+v, %v", tt.name, got, ok, tt.want, tt.wantOk)
+		}
+	}
+
+	if name := byPathName("10.0.0.1:3260", testLunIqn, 3); name != tests[0].name {
+		t.Errorf("byPathName() = %q, want %q", name, tests[0].name)
+	}
+}
+
+func TestSamePortal(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"10.0.0.1:3260", "10.0.0.1:3260", true},
+		{"[fd00::1]:3260", "[fd00:0::1]:3260", true},
+		{"10.0.0.1:3260", "10.0.0.1:3261", false},
+		{"10.0.0.1:3260", "10.0.0.2:3260", false},
+		{"ds1:3260", "ds2:3260", false},
+		{"ds1:3260", "ds1:3260", true},
+	}
+	for _, tt := range tests {
+		if got := samePortal(tt.a, tt.b); got != tt.want {
+			t.Errorf("samePortal(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+// newFakeDeviceDirs points byPathDir and sysfsDir to empty temporary directories
+func newFakeDeviceDirs(t *testing.T) {
+	t.Helper()
+	oldByPath, oldSysfs := byPathDir, sysfsDir
+	t.Cleanup(func() { byPathDir, sysfsDir = oldByPath, oldSysfs })
+	byPathDir = filepath.Join(t.TempDir(), "by-path")
+	sysfsDir = t.TempDir()
+	if err := os.MkdirAll(byPathDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeFakeFile(t *testing.T, path string, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// addFakeSysfsSession adds an iSCSI session to sysfsDir with the block device of a LUN
+func addFakeSysfsSession(t *testing.T, session int, iqn string, address string, port string, lun int, dev string) {
+	t.Helper()
+	dir := filepath.Join(sysfsDir, "class/iscsi_session", fmt.Sprintf("session%d", session))
+	writeFakeFile(t, filepath.Join(dir, "targetname"), iqn+"\n")
+	conn := filepath.Join(dir, "device/connection1:0/iscsi_connection/connection1:0")
+	writeFakeFile(t, filepath.Join(conn, "persistent_address"), address+"\n")
+	writeFakeFile(t, filepath.Join(conn, "persistent_port"), port+"\n")
+	block := filepath.Join(dir, "device/target2:0:0", fmt.Sprintf("2:0:0:%d", lun), "block", dev)
+	if err := os.MkdirAll(block, 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFindLunDevice(t *testing.T) {
+	t.Run("by-path link", func(t *testing.T) {
+		newFakeDeviceDirs(t)
+		link := filepath.Join(byPathDir, byPathName("10.0.0.1:3260", testLunIqn, 1))
+		writeFakeFile(t, link, "")
+		addFakeSysfsSession(t, 1, testLunIqn, "10.0.0.1", "3260", 1, "sdb")
+
+		if got, err := findLunDevice("10.0.0.1:3260", testLunIqn, 1); err != nil || got != link {
+			t.Errorf("findLunDevice() = %q, %v, want the by-path link %q", got, err, link)
+		}
+	})
+	t.Run("by-path link spelled differently", func(t *testing.T) {
+		newFakeDeviceDirs(t)
+		link := filepath.Join(byPathDir, byPathName("[fd00::1]:3260", testLunIqn, 1))
+		writeFakeFile(t, link, "")
+		writeFakeFile(t, filepath.Join(byPathDir, byPathName("[fd00::1]:3260", testLunIqn, 2)), "")
+
+		if got, err := findLunDevice("[fd00:0::1]:3260", testLunIqn, 1); err != nil || got != link {
+			t.Errorf("findLunDevice() = %q, %v, want %q", got, err, link)
+		}
+	})
+	t.Run("sysfs", func(t *testing.T) {
+		newFakeDeviceDirs(t)
+		addFakeSysfsSession(t, 1, testLunIqn, "10.0.0.2", "3260", 1, "sdc")
+		addFakeSysfsSession(t, 2, testLunIqn, "10.0.0.1", "3260", 0, "sdd")
+		addFakeSysfsSession(t, 3, testLunIqn, "10.0.0.1", "3260", 1, "sde")
+
+		if got, err := findLunDevice("10.0.0.1:3260", testLunIqn, 1); err != nil || got != "/dev/sde" {
+			t.Errorf("findLunDevice() = %q, %v, want the LUN of the session of the portal /dev/sde", got, err)
+		}
+	})
+	t.Run("missing", func(t *testing.T) {
+		newFakeDeviceDirs(t)
+		addFakeSysfsSession(t, 1, "iqn.2000-01.com.synology:ds.other", "10.0.0.1", "3260", 1, "sdf")
+
+		if got, err := findLunDevice("10.0.0.1:3260", testLunIqn, 1); err != nil || got != "" {
+			t.Errorf("findLunDevice() = %q, %v, want none", got, err)
+		}
+	})
+}
+
+func TestWaitForLunDevice(t *testing.T) {
+	defer func(interval time.Duration) { devicePollInterval = interval }(devicePollInterval)
+	defer func(timeout time.Duration, retries int) {
+		DeviceWaitTimeout, DeviceScanRetries = timeout, retries
+	}(DeviceWaitTimeout, DeviceScanRetries)
+	devicePollInterval = time.Millisecond
+	DeviceWaitTimeout = time.Second
+	DeviceScanRetries = 0
+	newFakeDeviceDirs(t)
+
+	ns := &nodeServer{}
+	link := filepath.Join(byPathDir, byPathName("10.0.0.1:3260", testLunIqn, 1))
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		os.WriteFile(link, nil, 0644)
+	}()
+	if got, err := ns.waitForLunDevice("10.0.0.1:3260", testLunIqn, 1); err != nil || got != link {
+		t.Fatalf("waitForLunDevice() = %q, %v, want the link created after login %q", got, err, link)
+	}
+
+	// the next stage reuses the device while it exists
+	byPathDir = t.TempDir()
+	if got, err := ns.waitForLunDevice("10.0.0.1:3260", testLunIqn, 1); err != nil || got != link {
+		t.Errorf("waitForLunDevice() = %q, %v, want the cached device %q", got, err, link)
+	}
+
+	ns.devices.forget(testLunIqn)
+	DeviceWaitTimeout = 20 * time.Millisecond
+	start := time.Now()
+	_, err := ns.waitForLunDevice("10.0.0.1:3260", testLunIqn, 1)
+	if code := status.Code(err); code != codes.DeadlineExceeded {
+		t.Errorf("waitForLunDevice() code = %v after logout, want %v (err: %v)", code, codes.DeadlineExceeded, err)
+	}
+	if elapsed := time.Since(start); elapsed < DeviceWaitTimeout || elapsed > time.Second {
+		t.Errorf("waitForLunDevice() gave up after %v, want %v", elapsed, DeviceWaitTimeout)
+	}
+}
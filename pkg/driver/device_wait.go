@@ -0,0 +1,77 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"path/filepath"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/mount-utils"
+)
+
+// devicePathExists and devicePollInterval are replaced by the tests
+var (
+	devicePathExists   = mount.PathExists
+	devicePollInterval = time.Second
+)
+
+// waitForDevice waits DeviceWaitTimeout for the device at path, then calls rescan
+// and waits again, DeviceScanRetries times
+func waitForDevice(path string, rescan func() error) error {
+	return waitForDeviceFunc(path, func() (bool, error) { return devicePathExists(path) }, rescan)
+}
+
+// waitForDeviceFunc is like waitForDevice, exists tells if the device is there
+func waitForDeviceFunc(path string, exists func() (bool, error), rescan func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := pollDevice(path, exists, DeviceWaitTimeout)
+		if err == nil || attempt >= DeviceScanRetries {
+			return err
+		}
+
+		log.Warnf("Device path [%s] didn't appear within %v, rescanning (%d/%d)", path, DeviceWaitTimeout, attempt+1, DeviceScanRetries)
+		if err := rescan(); err != nil {
+			log.Warnf("Failed to rescan for device path [%s]: %v", path, err)
+		}
+	}
+}
+
+// waitForLunDevice waits for the device of the LUN mapped at mappingIndex of the target after
+// logging in through portal, and returns it. A device found by a recent stage is reused.
+func (ns *nodeServer) waitForLunDevice(portal string, targetIqn string, mappingIndex int) (string, error) {
+	if path := ns.devices.get(portal, targetIqn, mappingIndex); path != "" {
+		return path, nil
+	}
+
+	byPath := filepath.Join(byPathDir, byPathName(portal, targetIqn, mappingIndex))
+	var path string
+	find := func() (bool, error) {
+		var err error
+		path, err = findLunDevice(portal, targetIqn, mappingIndex)
+		return path != "", err
+	}
+	if err := waitForDeviceFunc(byPath, find, func() error { return ns.Initiator.rescan(targetIqn) }); err != nil {
+		return "", status.Errorf(codes.DeadlineExceeded, "Device [%s] of LUN %d of target [%s] didn't appear within %v after %d rescans: %v",
+			byPath, mappingIndex, targetIqn, DeviceWaitTimeout, DeviceScanRetries, err)
+	}
+
+	ns.devices.put(portal, targetIqn, mappingIndex, path)
+	return path, nil
+}
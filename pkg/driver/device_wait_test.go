@@ -0,0 +1,93 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils/hostexec"
+)
+
+func TestWaitForDevice(t *testing.T) {
+	defer func(exists func(string) (bool, error), interval time.Duration) {
+		devicePathExists, devicePollInterval = exists, interval
+	}(devicePathExists, devicePollInterval)
+	defer func(timeout time.Duration, retries int) {
+		DeviceWaitTimeout, DeviceScanRetries = timeout, retries
+	}(DeviceWaitTimeout, DeviceScanRetries)
+	devicePollInterval = time.Millisecond
+	DeviceWaitTimeout = 20 * time.Millisecond
+
+	tests := []struct {
+		name string
+		// appearsAfter is the number of rescans after which the device shows up, -1 for never
+		appearsAfter int
+		retries      int
+		wantRescans  int
+		wantErr      bool
+	}{
+		{name: "present", appearsAfter: 0, retries: 2, wantRescans: 0},
+		{name: "after a rescan", appearsAfter: 1, retries: 2, wantRescans: 1},
+		{name: "never", appearsAfter: -1, retries: 2, wantRescans: 2, wantErr: true},
+		{name: "no retries", appearsAfter: 1, retries: 0, wantRescans: 0, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			DeviceScanRetries = tt.retries
+			rescans := 0
+			devicePathExists = func(path string) (bool, error) {
+				return tt.appearsAfter >= 0 && rescans >= tt.appearsAfter, nil
+			}
+
+			start := time.Now()
+			err := waitForDevice("/dev/disk/by-path/lun-1", func() error {
+				rescans++
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("waitForDevice() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if rescans != tt.wantRescans {
+				t.Errorf("waitForDevice() rescans = %d, want %d", rescans, tt.wantRescans)
+			}
+			if tt.wantErr {
+				if !errors.Is(err, os.ErrNotExist) {
+					t.Errorf("waitForDevice() error = %v, want %v", err, os.ErrNotExist)
+				}
+				if elapsed, want := time.Since(start), time.Duration(tt.retries+1)*DeviceWaitTimeout; elapsed < want {
+					t.Errorf("waitForDevice() gave up after %v, want at least %v", elapsed, want)
+				}
+			}
+		})
+	}
+}
+
+func TestIscsiadmUpdateNodeLoginTimeout(t *testing.T) {
+	fake := hostexec.NewFake(nil, "/host")
+	tools := NewTools(fake)
+
+	if err := tools.iscsiadm_update_node_login_timeout("iqn.test", "10.0.0.1:3260", 45*time.Second); err != nil {
+		t.Fatalf("iscsiadm_update_node_login_timeout() error = %v", err)
+	}
+	assertInvocations(t, fake, [][]string{
+		{"iscsiadm", "-m", "node", "--targetname", "iqn.test", "--portal", "10.0.0.1:3260",
+			"--op", "update", "--name", "node.conn[0].timeo.login_timeout", "--value", "45"},
+	})
+}
@@ -17,10 +17,14 @@ limitations under the License.
 package driver
 
 import (
+	"time"
+
 	"github.com/SynologyOpenSource/synology-csi/pkg/interfaces"
 	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 const (
@@ -30,12 +34,48 @@ const (
 
 var (
 	MultipathEnabled      = true
+	MultipathAllPortals   = false                // log into every discovered portal of a target
+	FstrimInterval        time.Duration          // trim volumes with space reclamation, 0 disables
+	InodeWarningThreshold float64                // percentage of used inodes above which a PVC gets a warning event, 0 disables
+	ProvisioningEvents    = false                // emit warning events on the PVCs of the volumes failing to be created
+	NamespaceQuotas       map[string]int64       // capacity of the iSCSI volumes each namespace may provision
+	NodeSite              string                 // topology site reported by the node, see TopologyKeySite
+	RemountStaleNfs       = false                // remount NFS volumes whose mount went stale in NodePublishVolume
+	ISCSILoginTimeout     time.Duration          // login timeout of the iSCSI sessions, 0 keeps the iscsid default
+	DeviceWaitTimeout     = 20 * time.Second     // how long to wait for the device of a LUN after login
+	DeviceScanRetries     = 0                    // rescans of the target if the device of a LUN doesn't appear in time
+	LunSizeGranularity    = int64(utils.UNIT_MB) // allocation unit of LUNs on DSM, sizes are rounded up to it
+	MinVolumeSize         = int64(utils.UNIT_GB) // smaller volumes are raised to it
+	MaxVolumeSize         int64                  // larger volumes fail with OutOfRange, 0 is no limit
+	DefaultFsckMode       = FsckAlways           // when filesystems are checked on stage, unless their StorageClass sets fsckMode
+	UnmountBusyRetries    = 3                    // retries of the unmount of a busy staging path
+	LazyUnmount           = false                // unmount staging paths still busy after the retries with umount -l
+	LogoutGrace           = 5 * time.Second      // wait after a lazy unmount before logging out of the target
 	supportedProtocolList = []string{utils.ProtocolIscsi, utils.ProtocolSmb, utils.ProtocolNfs}
 	allowedNfsVersionList = []string{"3", "4", "4.0", "4.1"}
 )
 
+// Features are the optional capabilities of the driver, advertised only when enabled
+type Features struct {
+	Clone                 bool
+	Expand                bool
+	ListVolumes           bool
+	ListSnapshots         bool
+	SingleNodeMultiWriter bool // SINGLE_NODE_SINGLE_WRITER and SINGLE_NODE_MULTI_WRITER access modes
+	PublishUnpublish      bool // only the nodes an iSCSI volume is published to are in the ACLs of its target
+}
+
+// EnabledFeatures are the features of the drivers created by NewControllerAndNodeDriver
+var EnabledFeatures = Features{
+	Clone:         true,
+	Expand:        true,
+	ListVolumes:   true,
+	ListSnapshots: true,
+}
+
 type IDriver interface {
 	Activate()
+	Shutdown(grace time.Duration) bool
 }
 
 type Driver struct {
@@ -48,6 +88,8 @@ type Driver struct {
 	csCap      []*csi.ControllerServiceCapability
 	vCap       []*csi.VolumeCapability_AccessMode
 	nsCap      []*csi.NodeServiceCapability
+	features   Features
+	server     NonBlockingGRPCServer
 	DsmService interfaces.IDsmService
 }
 
@@ -62,41 +104,95 @@ func NewControllerAndNodeDriver(nodeID string, endpoint string, dsmService inter
 		endpoint:   endpoint,
 		DsmService: dsmService,
 		tools:      tools,
+		features:   EnabledFeatures,
 	}
 
-	d.addControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+	d.addControllerServiceCapabilities(controllerCapabilities(d.features))
+	d.addVolumeCapabilityAccessModes(accessModes(d.features))
+	d.addNodeServiceCapabilities(nodeCapabilities(d.features))
+
+	log.Infof("New driver created: name=%s, nodeID=%s, version=%s, endpoint=%s", d.name, d.nodeID, d.version, d.endpoint)
+	return d, nil
+}
+
+func controllerCapabilities(f Features) []csi.ControllerServiceCapability_RPC_Type {
+	caps := []csi.ControllerServiceCapability_RPC_Type{
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
-		csi.ControllerServiceCapability_RPC_LIST_VOLUMES,
-		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
 		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
-		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
-		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
 		csi.ControllerServiceCapability_RPC_GET_CAPACITY,
-	})
+	}
+	if f.ListVolumes {
+		caps = append(caps, csi.ControllerServiceCapability_RPC_LIST_VOLUMES)
+	}
+	if f.Expand {
+		caps = append(caps, csi.ControllerServiceCapability_RPC_EXPAND_VOLUME)
+	}
+	if f.ListSnapshots {
+		caps = append(caps, csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS)
+	}
+	if f.Clone {
+		caps = append(caps, csi.ControllerServiceCapability_RPC_CLONE_VOLUME)
+	}
+	if f.SingleNodeMultiWriter {
+		caps = append(caps, csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER)
+	}
+	if f.PublishUnpublish {
+		caps = append(caps, csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME)
+	}
+	return caps
+}
 
-	d.addVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{
+func accessModes(f Features) []csi.VolumeCapability_AccessMode_Mode {
+	modes := []csi.VolumeCapability_AccessMode_Mode{
 		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
 		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
-	})
+	}
+	if f.SingleNodeMultiWriter {
+		modes = append(modes,
+			csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+			csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER)
+	}
+	return modes
+}
 
-	d.addNodeServiceCapabilities([]csi.NodeServiceCapability_RPC_Type{
+func nodeCapabilities(f Features) []csi.NodeServiceCapability_RPC_Type {
+	caps := []csi.NodeServiceCapability_RPC_Type{
 		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
-		csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
 		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
 		// csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP,
-	})
-
-	log.Infof("New driver created: name=%s, nodeID=%s, version=%s, endpoint=%s", d.name, d.nodeID, d.version, d.endpoint)
-	return d, nil
+	}
+	if f.Expand {
+		caps = append(caps, csi.NodeServiceCapability_RPC_EXPAND_VOLUME)
+	}
+	if f.SingleNodeMultiWriter {
+		caps = append(caps, csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER)
+	}
+	return caps
 }
 
 // TODO: func NewNodeDriver() {}
 // TODO: func NewControllerDriver() {}
 
 func (d *Driver) Activate() {
-	go func() {
-		RunControllerandNodePublishServer(d.endpoint, d, NewControllerServer(d), NewNodeServer(d))
-	}()
+	ns := NewNodeServer(d)
+	if FstrimInterval > 0 {
+		go ns.runFstrim(FstrimInterval)
+	}
+	if SessionReconcileInterval > 0 {
+		go ns.runSessionReconciler(SessionReconcileInterval)
+	}
+	d.server = RunControllerandNodePublishServer(d.endpoint, d, NewControllerServer(d), ns)
+}
+
+// Shutdown stops the gRPC server of an activated driver, letting the in-flight RPCs complete
+// for up to grace. It tells if they all did.
+func (d *Driver) Shutdown(grace time.Duration) bool {
+	if d.server == nil {
+		return true
+	}
+	drained := d.server.StopWithin(grace)
+	d.server.Wait()
+	return drained
 }
 
 func (d *Driver) addControllerServiceCapabilities(cl []csi.ControllerServiceCapability_RPC_Type) {
@@ -146,3 +242,23 @@ func isProtocolSupport(protocol string) bool {
 func isNfsVersionAllowed(ver string) bool {
 	return utils.SliceContains(allowedNfsVersionList, ver)
 }
+
+// validateAccessModeForProtocol rejects access modes that would let several
+// nodes write to the same iSCSI filesystem, which corrupts it. Raw block
+// volumes and shares may be written from multiple nodes.
+func validateAccessModeForProtocol(protocol string, volCap *csi.VolumeCapability) error {
+	if protocol == "" {
+		protocol = utils.ProtocolDefault
+	}
+	if protocol != utils.ProtocolIscsi || volCap.GetBlock() != nil {
+		return nil
+	}
+
+	switch mode := volCap.GetAccessMode().GetMode(); mode {
+	case csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER:
+		return status.Errorf(codes.InvalidArgument, "Access mode %s is only supported for raw block iSCSI volumes", mode)
+	}
+
+	return nil
+}
@@ -0,0 +1,157 @@
+package driver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+func TestValidateAccessModeForProtocol(t *testing.T) {
+	mountCap := func(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+		}
+	}
+	blockCap := func(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+		}
+	}
+
+	const (
+		sw = csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER
+		ro = csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY
+		ms = csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER
+		mm = csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER
+	)
+
+	tests := []struct {
+		protocol string
+		cap      *csi.VolumeCapability
+		wantErr  bool
+	}{
+		{utils.ProtocolIscsi, mountCap(sw), false},
+		{utils.ProtocolIscsi, mountCap(ro), false},
+		{utils.ProtocolIscsi, mountCap(ms), true},
+		{utils.ProtocolIscsi, mountCap(mm), true},
+		{"", mountCap(mm), true},
+		{utils.ProtocolIscsi, blockCap(ms), false},
+		{utils.ProtocolIscsi, blockCap(mm), false},
+		{utils.ProtocolNfs, mountCap(ms), false},
+		{utils.ProtocolNfs, mountCap(mm), false},
+		{utils.ProtocolSmb, mountCap(ms), false},
+		{utils.ProtocolSmb, mountCap(mm), false},
+	}
+	for _, tt := range tests {
+		mode := tt.cap.GetAccessMode().GetMode()
+		err := validateAccessModeForProtocol(tt.protocol, tt.cap)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validateAccessModeForProtocol(%q, %v, block=%t) error = %v, wantErr %v",
+				tt.protocol, mode, tt.cap.GetBlock() != nil, err, tt.wantErr)
+		}
+	}
+}
+
+func TestNewControllerAndNodeDriver_features(t *testing.T) {
+	defer func(f Features) { EnabledFeatures = f }(EnabledFeatures)
+
+	hasControllerCap := func(d *Driver, c csi.ControllerServiceCapability_RPC_Type) bool {
+		for _, cap := range d.csCap {
+			if cap.GetRpc().GetType() == c {
+				return true
+			}
+		}
+		return false
+	}
+	hasNodeCap := func(d *Driver, c csi.NodeServiceCapability_RPC_Type) bool {
+		for _, cap := range d.nsCap {
+			if cap.GetRpc().GetType() == c {
+				return true
+			}
+		}
+		return false
+	}
+	hasAccessMode := func(d *Driver, m csi.VolumeCapability_AccessMode_Mode) bool {
+		for _, mode := range d.vCap {
+			if mode.GetMode() == m {
+				return true
+			}
+		}
+		return false
+	}
+
+	tests := []struct {
+		name     string
+		features Features
+	}{
+		{name: "none", features: Features{}},
+		{name: "default", features: Features{Clone: true, Expand: true, ListVolumes: true, ListSnapshots: true}},
+		{name: "clone only", features: Features{Clone: true}},
+		{name: "single node multi writer", features: Features{SingleNodeMultiWriter: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			EnabledFeatures = tt.features
+			d, _ := NewControllerAndNodeDriver("node", "unix:///tmp/csi.sock", nil, tools{})
+
+			controllerCaps := map[csi.ControllerServiceCapability_RPC_Type]bool{
+				csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME:     true,
+				csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT:   true,
+				csi.ControllerServiceCapability_RPC_GET_CAPACITY:             true,
+				csi.ControllerServiceCapability_RPC_CLONE_VOLUME:             tt.features.Clone,
+				csi.ControllerServiceCapability_RPC_EXPAND_VOLUME:            tt.features.Expand,
+				csi.ControllerServiceCapability_RPC_LIST_VOLUMES:             tt.features.ListVolumes,
+				csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS:           tt.features.ListSnapshots,
+				csi.ControllerServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER: tt.features.SingleNodeMultiWriter,
+			}
+			for c, want := range controllerCaps {
+				if got := hasControllerCap(d, c); got != want {
+					t.Errorf("controller capability %v = %v, want %v", c, got, want)
+				}
+			}
+			if got := hasNodeCap(d, csi.NodeServiceCapability_RPC_EXPAND_VOLUME); got != tt.features.Expand {
+				t.Errorf("node capability EXPAND_VOLUME = %v, want %v", got, tt.features.Expand)
+			}
+			if got := hasNodeCap(d, csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER); got != tt.features.SingleNodeMultiWriter {
+				t.Errorf("node capability SINGLE_NODE_MULTI_WRITER = %v, want %v", got, tt.features.SingleNodeMultiWriter)
+			}
+			if got := hasAccessMode(d, csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER); got != tt.features.SingleNodeMultiWriter {
+				t.Errorf("access mode SINGLE_NODE_MULTI_WRITER = %v, want %v", got, tt.features.SingleNodeMultiWriter)
+			}
+		})
+	}
+}
+
+func TestControllerServer_disabledFeatures(t *testing.T) {
+	defer func(f Features) { EnabledFeatures = f }(EnabledFeatures)
+	EnabledFeatures = Features{}
+	cs := newTestControllerServer(newFakeDsmService())
+
+	if _, err := cs.ListVolumes(context.Background(), &csi.ListVolumesRequest{}); status.Code(err) != codes.Unimplemented {
+		t.Errorf("ListVolumes() error = %v, want Unimplemented", err)
+	}
+	if _, err := cs.ListSnapshots(context.Background(), &csi.ListSnapshotsRequest{}); status.Code(err) != codes.Unimplemented {
+		t.Errorf("ListSnapshots() error = %v, want Unimplemented", err)
+	}
+	if _, err := cs.ControllerExpandVolume(context.Background(), &csi.ControllerExpandVolumeRequest{}); status.Code(err) != codes.Unimplemented {
+		t.Errorf("ControllerExpandVolume() error = %v, want Unimplemented", err)
+	}
+	if _, err := cs.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{}); status.Code(err) != codes.Unimplemented {
+		t.Errorf("ControllerPublishVolume() error = %v, want Unimplemented", err)
+	}
+
+	req := newCreateVolumeRequest("pvc-clone", map[string]string{})
+	req.VolumeContentSource = &csi.VolumeContentSource{
+		Type: &csi.VolumeContentSource_Volume{Volume: &csi.VolumeContentSource_VolumeSource{VolumeId: "uuid-src"}},
+	}
+	if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("CreateVolume() of a clone error = %v, want InvalidArgument", err)
+	}
+}
@@ -0,0 +1,214 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	utilexec "k8s.io/utils/exec"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+const defaultFsType = "ext4"
+
+// filesystem holds the host tools used to manage one filesystem type
+type filesystem struct {
+	mkfs     string
+	mkfsArgs []string
+	// fsck is empty if the filesystem doesn't need a check before mount
+	fsck     string
+	fsckArgs []string
+	// state prints the superblock, which dirty tells if the filesystem needs a check from
+	state     string
+	stateArgs []string
+	dirty     func(state string) bool
+	grow      string
+	growArgs  []string
+	// growByMountPath is set if the grow tool takes the mount point instead of the device
+	growByMountPath bool
+}
+
+// filesystems are the fsTypes iSCSI volumes can be formatted with. xfs and btrfs
+// recover on mount and their repair tools aren't safe to run unattended, so like
+// fsck.xfs and fsck.btrfs nothing is run before mounting them.
+var filesystems = map[string]filesystem{
+	"btrfs": {
+		mkfs: "mkfs.btrfs", mkfsArgs: []string{"-f"},
+		grow: "btrfs", growArgs: []string{"filesystem", "resize", "max"}, growByMountPath: true,
+	},
+	"ext3": {
+		mkfs: "mkfs.ext3", mkfsArgs: []string{"-F", "-m0"},
+		fsck: "e2fsck", fsckArgs: []string{"-p"},
+		state: "dumpe2fs", stateArgs: []string{"-h"}, dirty: isExtFsDirty,
+		grow: "resize2fs",
+	},
+	"ext4": {
+		mkfs: "mkfs.ext4", mkfsArgs: []string{"-F", "-m0"},
+		fsck: "e2fsck", fsckArgs: []string{"-p"},
+		state: "dumpe2fs", stateArgs: []string{"-h"}, dirty: isExtFsDirty,
+		grow: "resize2fs",
+	},
+	"xfs": {
+		mkfs: "mkfs.xfs", mkfsArgs: []string{"-f"},
+		grow: "xfs_growfs", growByMountPath: true,
+	},
+}
+
+const (
+	fsckErrorsCorrected   = 1
+	fsckErrorsUncorrected = 4
+)
+
+// FsckMode tells when a filesystem is checked before it is mounted
+type FsckMode string
+
+const (
+	FsckAlways  FsckMode = "always"   // every stage, the default
+	FsckOnDirty FsckMode = "on-dirty" // only if the superblock says the filesystem isn't clean
+	FsckNever   FsckMode = "never"
+)
+
+// ParseFsckMode returns the fsck mode of name, always if it is empty
+func ParseFsckMode(name string) (FsckMode, error) {
+	switch mode := FsckMode(strings.ToLower(name)); mode {
+	case "":
+		return FsckAlways, nil
+	case FsckAlways, FsckOnDirty, FsckNever:
+		return mode, nil
+	}
+	return "", fmt.Errorf("Unknown fsck mode: %s", name)
+}
+
+// isExtFsDirty tells if the superblock printed by dumpe2fs -h has a state other than
+// clean, e.g. "not clean" or "clean with errors", or has none
+func isExtFsDirty(state string) bool {
+	for _, line := range strings.Split(state, "\n") {
+		key, value, found := strings.Cut(line, ":")
+		if found && strings.TrimSpace(key) == "Filesystem state" {
+			return strings.TrimSpace(value) != "clean"
+		}
+	}
+	return true
+}
+
+// parseFsType returns the filesystem to format an iSCSI volume with, ext4 if unset
+func parseFsType(fsType string) (string, error) {
+	fsType = strings.ToLower(fsType)
+	if fsType == "" {
+		return defaultFsType, nil
+	}
+	if _, ok := filesystems[fsType]; !ok {
+		return "", fmt.Errorf("Unsupported fsType: %s", fsType)
+	}
+	return fsType, nil
+}
+
+// formatOptionsForbiddenChars can't appear in mkfs options. hostexec never runs
+// them through a shell, but they come from StorageClass authors and anything that
+// looks like shell syntax is refused rather than trusted.
+const formatOptionsForbiddenChars = "`$;&|<>(){}[]\\\"'*?!~#\r\n"
+
+// parseFormatOptions splits the mkfs options of a StorageClass into arguments
+func parseFormatOptions(value string) ([]string, error) {
+	if i := strings.IndexAny(value, formatOptionsForbiddenChars); i >= 0 {
+		return nil, fmt.Errorf("Invalid character %q in mkfs options", value[i])
+	}
+	return utils.StringToSlice(value), nil
+}
+
+// blkid_fstype returns the filesystem type on the device, or "" if there is none
+func (t *tools) blkid_fstype(devPath string) (string, error) {
+	cmd := t.executor.Command("blkid", "-p", "-s", "TYPE", "-s", "PTTYPE", "-o", "export", devPath)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		// blkid exits with 2 when no filesystem is found on the device
+		exitErr, ok := err.(utilexec.ExitError)
+		if ok && exitErr.ExitStatus() == 2 {
+			return "", nil
+		}
+		return "", fmt.Errorf("%s (%w)", string(out), err)
+	}
+
+	var fsType, ptType string
+	for _, line := range strings.Split(string(out), "\n") {
+		key, value, found := strings.Cut(strings.TrimSpace(line), "=")
+		if !found {
+			continue
+		}
+		switch key {
+		case "TYPE":
+			fsType = value
+		case "PTTYPE":
+			ptType = value
+		}
+	}
+	if ptType != "" {
+		return "", fmt.Errorf("Device %s has a %s partition table", devPath, ptType)
+	}
+	return fsType, nil
+}
+
+// formatDevice creates a filesystem of fsType on devPath
+func (t *tools) formatDevice(devPath string, fsType string, formatOptions []string) error {
+	fs, ok := filesystems[fsType]
+	if !ok {
+		return fmt.Errorf("Unsupported fsType: %s", fsType)
+	}
+
+	args := append(append(append([]string{}, fs.mkfsArgs...), formatOptions...), devPath)
+	log.Infof("Formatting %s as %s with options: %v", devPath, fsType, args)
+	out, err := t.executor.Command(fs.mkfs, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %s (%w)", fs.mkfs, string(out), err)
+	}
+	return nil
+}
+
+// checkFilesystem repairs what it can on devPath before it is mounted, depending on mode
+func (t *tools) checkFilesystem(devPath string, fsType string, mode FsckMode) error {
+	fs, ok := filesystems[fsType]
+	if !ok || fs.fsck == "" || mode == FsckNever {
+		return nil
+	}
+	if mode == FsckOnDirty && fs.state != "" {
+		out, err := t.executor.Command(fs.state, append(append([]string{}, fs.stateArgs...), devPath)...).CombinedOutput()
+		if err != nil {
+			// checked anyway, the state is unknown
+			log.Warnf("%s on device %s failed with error %v, output: %s", fs.state, devPath, err, string(out))
+		} else if !fs.dirty(string(out)) {
+			log.Debugf("Skipping %s on clean device %s", fs.fsck, devPath)
+			return nil
+		}
+	}
+
+	out, err := t.executor.Command(fs.fsck, append(append([]string{}, fs.fsckArgs...), devPath)...).CombinedOutput()
+	if err != nil {
+		exitErr, ok := err.(utilexec.ExitError)
+		switch {
+		case ok && exitErr.ExitStatus() == fsckErrorsCorrected:
+			log.Infof("Device %s has errors which were corrected by %s.", devPath, fs.fsck)
+		case ok && exitErr.ExitStatus() == fsckErrorsUncorrected:
+			return fmt.Errorf("%s found errors on device %s but could not correct them: %s", fs.fsck, devPath, string(out))
+		default:
+			log.Warnf("%s on device %s failed with error %v, output: %s", fs.fsck, devPath, err, string(out))
+		}
+	}
+	return nil
+}
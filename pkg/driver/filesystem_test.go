@@ -0,0 +1,200 @@
+package driver
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/mount-utils"
+	utilexec "k8s.io/utils/exec"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils/hostexec"
+)
+
+func TestParseFsType(t *testing.T) {
+	tests := []struct {
+		fsType  string
+		want    string
+		wantErr bool
+	}{
+		{fsType: "", want: "ext4"},
+		{fsType: "ext4", want: "ext4"},
+		{fsType: "XFS", want: "xfs"},
+		{fsType: "btrfs", want: "btrfs"},
+		{fsType: "ntfs", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseFsType(tt.fsType)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("parseFsType(%q) = %v, %v, want %v, wantErr %v", tt.fsType, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestParseFormatOptions(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    []string
+		wantErr bool
+	}{
+		{value: "", want: []string{}},
+		{value: "-b 4096 -i  size=512", want: []string{"-b", "4096", "-i", "size=512"}},
+		{value: "-d su=64k,sw=4", want: []string{"-d", "su=64k,sw=4"}},
+		{value: "-b 4096; rm -rf /", wantErr: true},
+		{value: "-L $(hostname)", wantErr: true},
+		{value: "-L `id`", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseFormatOptions(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("parseFormatOptions(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseFormatOptions(%q) = %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestFormatAndMount(t *testing.T) {
+	unformatted := hostexec.FakeResult{Err: utilexec.CodeExitError{Err: errors.New("exit status 2"), Code: 2}}
+
+	tests := []struct {
+		name          string
+		fsType        string
+		formatOptions []string
+		blkid         hostexec.FakeResult
+		want          [][]string
+		wantCode      codes.Code
+	}{
+		{
+			name:   "format ext4",
+			fsType: "ext4",
+			blkid:  unformatted,
+			want:   [][]string{blkidArgs, {"mkfs.ext4", "-F", "-m0", "/dev/sdb"}},
+		},
+		{
+			name:   "format xfs",
+			fsType: "xfs",
+			blkid:  unformatted,
+			want:   [][]string{blkidArgs, {"mkfs.xfs", "-f", "/dev/sdb"}},
+		},
+		{
+			name:          "format options appended in order",
+			fsType:        "ext4",
+			formatOptions: []string{"-b", "4096", "-i", "size=512"},
+			blkid:         unformatted,
+			want:          [][]string{blkidArgs, {"mkfs.ext4", "-F", "-m0", "-b", "4096", "-i", "size=512", "/dev/sdb"}},
+		},
+		{
+			name:          "format options ignored on formatted device",
+			fsType:        "ext4",
+			formatOptions: []string{"-b", "4096"},
+			blkid:         hostexec.FakeResult{Output: []byte("TYPE=ext4\n")},
+			want:          [][]string{blkidArgs, {"e2fsck", "-p", "/dev/sdb"}},
+		},
+		{
+			name:   "check existing ext4",
+			fsType: "ext4",
+			blkid:  hostexec.FakeResult{Output: []byte("TYPE=ext4\n")},
+			want:   [][]string{blkidArgs, {"e2fsck", "-p", "/dev/sdb"}},
+		},
+		{
+			name:   "existing xfs",
+			fsType: "xfs",
+			blkid:  hostexec.FakeResult{Output: []byte("TYPE=xfs\n")},
+			want:   [][]string{blkidArgs},
+		},
+		{
+			name:     "mismatched existing filesystem",
+			fsType:   "xfs",
+			blkid:    hostexec.FakeResult{Output: []byte("TYPE=ext4\n")},
+			want:     [][]string{blkidArgs},
+			wantCode: codes.FailedPrecondition,
+		},
+		{
+			name:     "partition table",
+			fsType:   "ext4",
+			blkid:    hostexec.FakeResult{Output: []byte("PTTYPE=gpt\n")},
+			want:     [][]string{blkidArgs},
+			wantCode: codes.Internal,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := hostexec.NewFake(nil, "/host")
+			fake.Respond(tt.blkid)
+			mounter := mount.NewFakeMounter(nil)
+			ns := &nodeServer{
+				Mounter: &mount.SafeFormatAndMount{Interface: mounter},
+				tools:   NewTools(fake),
+			}
+
+			err := ns.formatAndMount("/dev/sdb", "/staging", tt.fsType, []string{"rw"}, tt.formatOptions, FsckAlways)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("formatAndMount() code = %v, want %v (err: %v)", code, tt.wantCode, err)
+			}
+			assertInvocations(t, fake, tt.want)
+
+			mounted := len(mounter.GetLog()) == 1
+			if mounted != (tt.wantCode == codes.OK) {
+				t.Errorf("formatAndMount() mounted = %v, log %v", mounted, mounter.GetLog())
+			}
+		})
+	}
+}
+
+func TestCheckFilesystem_fsckMode(t *testing.T) {
+	clean := hostexec.FakeResult{Output: []byte("Filesystem volume name:   <none>\nFilesystem state:         clean\n")}
+	dirty := hostexec.FakeResult{Output: []byte("Filesystem state:         clean with errors\n")}
+	failed := hostexec.FakeResult{Err: utilexec.CodeExitError{Err: errors.New("exit status 1"), Code: 1}}
+	fsck := []string{"e2fsck", "-p", "/dev/sdb"}
+	dumpe2fs := []string{"dumpe2fs", "-h", "/dev/sdb"}
+
+	tests := []struct {
+		name   string
+		fsType string
+		mode   FsckMode
+		state  hostexec.FakeResult
+		want   [][]string
+	}{
+		{name: "always", fsType: "ext4", mode: FsckAlways, want: [][]string{fsck}},
+		{name: "never", fsType: "ext4", mode: FsckNever, want: nil},
+		{name: "on-dirty clean", fsType: "ext4", mode: FsckOnDirty, state: clean, want: [][]string{dumpe2fs}},
+		{name: "on-dirty with errors", fsType: "ext3", mode: FsckOnDirty, state: dirty, want: [][]string{dumpe2fs, fsck}},
+		{name: "on-dirty unknown state", fsType: "ext4", mode: FsckOnDirty, state: failed, want: [][]string{dumpe2fs, fsck}},
+		{name: "on-dirty without fsck", fsType: "xfs", mode: FsckOnDirty, want: nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := hostexec.NewFake(nil, "/host")
+			fake.Respond(tt.state)
+			tools := NewTools(fake)
+			if err := tools.checkFilesystem("/dev/sdb", tt.fsType, tt.mode); err != nil {
+				t.Fatalf("checkFilesystem() error = %v", err)
+			}
+			assertInvocations(t, fake, tt.want)
+		})
+	}
+}
+
+func TestParseFsckMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    FsckMode
+		wantErr bool
+	}{
+		{name: "", want: FsckAlways},
+		{name: "On-Dirty", want: FsckOnDirty},
+		{name: "never", want: FsckNever},
+		{name: "sometimes", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseFsckMode(tt.name)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseFsckMode(%q) = %v, %v, want %v, wantErr %v", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
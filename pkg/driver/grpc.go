@@ -22,6 +22,7 @@ import (
 	"net"
 	"os"
 	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"google.golang.org/grpc"
@@ -37,6 +38,9 @@ type NonBlockingGRPCServer interface {
 	Wait()
 	// Stops the service gracefully
 	Stop()
+	// Stops the service gracefully, forcefully once grace is over. It tells if all the
+	// in-flight RPCs completed in time.
+	StopWithin(grace time.Duration) bool
 	// Stops the service forcefully
 	ForceStop()
 }
@@ -52,10 +56,25 @@ type nonBlockingGRPCServer struct {
 }
 
 func (s *nonBlockingGRPCServer) Start(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(traceGRPC, logGRPC),
+	}
+	server := grpc.NewServer(opts...)
+	s.server = server
+
+	if ids != nil {
+		csi.RegisterIdentityServer(server, ids)
+	}
+	if cs != nil {
+		csi.RegisterControllerServer(server, cs)
+	}
+	if ns != nil {
+		csi.RegisterNodeServer(server, ns)
+	}
 
 	s.wg.Add(1)
 
-	go s.serve(endpoint, ids, cs, ns)
+	go s.serve(endpoint)
 
 	return
 }
@@ -72,7 +91,31 @@ func (s *nonBlockingGRPCServer) ForceStop() {
 	s.server.Stop()
 }
 
-func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, cs csi.ControllerServer, ns csi.NodeServer) {
+// StopWithin refuses new RPCs and waits up to grace for the in-flight ones, e.g. a
+// CreateVolume in the middle of its DSM requests, which keep their contexts meanwhile.
+// The RPCs still running afterwards have their contexts canceled.
+func (s *nonBlockingGRPCServer) StopWithin(grace time.Duration) bool {
+	stopped := make(chan struct{})
+	go func() {
+		s.server.GracefulStop()
+		close(stopped)
+	}()
+
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-stopped:
+		return true
+	case <-timer.C:
+		log.Warnf("In-flight RPCs still running after the shutdown grace period of %v, canceling them", grace)
+		s.server.Stop()
+		<-stopped
+		return false
+	}
+}
+
+func (s *nonBlockingGRPCServer) serve(endpoint string) {
+	defer s.wg.Done()
 
 	proto, addr, err := ParseEndpoint(endpoint)
 	if err != nil {
@@ -91,24 +134,8 @@ func (s *nonBlockingGRPCServer) serve(endpoint string, ids csi.IdentityServer, c
 		log.Fatalf("Failed to listen: %v", err)
 	}
 
-	opts := []grpc.ServerOption{
-		grpc.UnaryInterceptor(logGRPC),
-	}
-	server := grpc.NewServer(opts...)
-	s.server = server
-
-	if ids != nil {
-		csi.RegisterIdentityServer(server, ids)
-	}
-	if cs != nil {
-		csi.RegisterControllerServer(server, cs)
-	}
-	if ns != nil {
-		csi.RegisterNodeServer(server, ns)
-	}
-
 	log.Infof("Listening for connections on address: %#v", listener.Addr())
-	if err := server.Serve(listener); err != nil {
+	if err := s.server.Serve(listener); err != nil && err != grpc.ErrServerStopped {
 		log.Fatal(err.Error())
 	}
 }
@@ -0,0 +1,122 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+)
+
+// blockingIdentityServer answers Probe once release is closed or the RPC is canceled
+type blockingIdentityServer struct {
+	csi.UnimplementedIdentityServer
+	started  chan struct{}
+	release  chan struct{}
+	canceled chan struct{}
+}
+
+func (s *blockingIdentityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
+	s.started <- struct{}{}
+	select {
+	case <-s.release:
+		return &csi.ProbeResponse{}, nil
+	case <-ctx.Done():
+		close(s.canceled)
+		return nil, ctx.Err()
+	}
+}
+
+// startBlockingServer serves a blockingIdentityServer on a unix socket of t and probes it
+func startBlockingServer(t *testing.T) (NonBlockingGRPCServer, *blockingIdentityServer, csi.IdentityClient, chan error) {
+	endpoint := "unix://" + filepath.Join(t.TempDir(), "csi.sock")
+	ids := &blockingIdentityServer{started: make(chan struct{}, 2), release: make(chan struct{}), canceled: make(chan struct{})}
+	s := NewNonBlockingGRPCServer()
+	s.Start(endpoint, ids, nil, nil)
+
+	conn, err := grpc.Dial(endpoint, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("Dial() error = %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	client := csi.NewIdentityClient(conn)
+
+	probed := make(chan error, 1)
+	go func() {
+		_, err := client.Probe(context.Background(), &csi.ProbeRequest{}, grpc.WaitForReady(true))
+		probed <- err
+	}()
+	select {
+	case <-ids.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Probe not received")
+	}
+	return s, ids, client, probed
+}
+
+func TestStopWithin_drainsInFlightRPCs(t *testing.T) {
+	s, ids, client, probed := startBlockingServer(t)
+
+	stopped := make(chan bool, 1)
+	go func() { stopped <- s.StopWithin(5 * time.Second) }()
+
+	select {
+	case <-stopped:
+		t.Fatal("StopWithin() returned before the in-flight RPC completed")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if _, err := client.Probe(context.Background(), &csi.ProbeRequest{}); status.Code(err) != codes.Unavailable {
+		t.Errorf("Probe() during shutdown error = %v, want Unavailable", err)
+	}
+
+	close(ids.release)
+	if err := <-probed; err != nil {
+		t.Errorf("in-flight Probe() error = %v", err)
+	}
+	if drained := <-stopped; !drained {
+		t.Errorf("StopWithin() = false, want the in-flight RPC drained")
+	}
+	s.Wait()
+}
+
+func TestStopWithin_cancelsAfterGrace(t *testing.T) {
+	s, ids, _, probed := startBlockingServer(t)
+
+	start := time.Now()
+	if drained := s.StopWithin(200 * time.Millisecond); drained {
+		t.Errorf("StopWithin() = true with an RPC outliving the grace period")
+	}
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("StopWithin() returned after %v, before the grace period", elapsed)
+	}
+	select {
+	case <-ids.canceled:
+	case <-time.After(5 * time.Second):
+		t.Error("context of the in-flight RPC not canceled")
+	}
+	if err := <-probed; err == nil {
+		t.Errorf("in-flight Probe() succeeded after its server stopped")
+	}
+	s.Wait()
+}
@@ -0,0 +1,50 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"net/http"
+)
+
+// dsmsReady tells if one of the DSMs at least answered its last health probe. A driver with
+// no DSM is ready, as none could be probed.
+func (d *Driver) dsmsReady() (bool, map[string]error) {
+	if d.DsmService == nil || d.DsmService.GetDsmsCount() == 0 {
+		return true, nil
+	}
+	unhealthy := d.DsmService.UnhealthyDsms()
+	return len(unhealthy) < d.DsmService.GetDsmsCount(), unhealthy
+}
+
+// HealthHandler serves /healthz, the liveness of the driver process which never depends on
+// DSM so an outage of the NAS doesn't restart the pod, and /readyz, which fails while all
+// the DSMs are unreachable according to the health checker, like Probe.
+func (d *Driver) HealthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if ready, unhealthy := d.dsmsReady(); !ready {
+			http.Error(w, fmt.Sprintf("all DSMs are unreachable: %v", unhealthy), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
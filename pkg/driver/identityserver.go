@@ -21,6 +21,8 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/protobuf/types/known/wrapperspb"
 )
 
 type identityServer struct {
@@ -42,8 +44,19 @@ func (ids *identityServer) GetPluginInfo(ctx context.Context, req *csi.GetPlugin
 	}, nil
 }
 
+// Probe reports the driver isn't ready when none of the DSMs answered its last health probe
 func (ids *identityServer) Probe(ctx context.Context, req *csi.ProbeRequest) (*csi.ProbeResponse, error) {
-	return &csi.ProbeResponse{}, nil
+	dsmService := ids.Driver.DsmService
+	if dsmService == nil || dsmService.GetDsmsCount() == 0 {
+		return &csi.ProbeResponse{}, nil
+	}
+
+	ready, unhealthy := ids.Driver.dsmsReady()
+	if ready {
+		return &csi.ProbeResponse{Ready: wrapperspb.Bool(true)}, nil
+	}
+	log.WithContext(ctx).Warnf("Probe: all DSMs are unreachable: %v", unhealthy)
+	return &csi.ProbeResponse{Ready: wrapperspb.Bool(false)}, nil
 }
 
 func (ids *identityServer) GetPluginCapabilities(ctx context.Context, req *csi.GetPluginCapabilitiesRequest) (*csi.GetPluginCapabilitiesResponse, error) {
@@ -56,6 +69,13 @@ func (ids *identityServer) GetPluginCapabilities(ctx context.Context, req *csi.G
 					},
 				},
 			},
+			{
+				Type: &csi.PluginCapability_Service_{
+					Service: &csi.PluginCapability_Service{
+						Type: csi.PluginCapability_Service_VOLUME_ACCESSIBILITY_CONSTRAINTS,
+					},
+				},
+			},
 		},
 	}, nil
 }
@@ -0,0 +1,96 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+)
+
+func TestProbe(t *testing.T) {
+	dsmService := newFakeDsmService()
+	dsmService.dsms["10.0.0.2"] = &webapi.DSM{Ip: "10.0.0.2"}
+	ids := &identityServer{Driver: &Driver{DsmService: dsmService}}
+
+	tests := []struct {
+		name      string
+		unhealthy map[string]error
+		want      bool
+	}{
+		{name: "all healthy", want: true},
+		{name: "one unreachable", unhealthy: map[string]error{"10.0.0.1": errors.New("timeout")}, want: true},
+		{
+			name:      "all unreachable",
+			unhealthy: map[string]error{"10.0.0.1": errors.New("timeout"), "10.0.0.2": errors.New("timeout")},
+			want:      false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dsmService.unhealthy = tt.unhealthy
+
+			resp, err := ids.Probe(context.Background(), &csi.ProbeRequest{})
+			if err != nil {
+				t.Fatalf("Probe() error = %v", err)
+			}
+			if got := resp.GetReady().GetValue(); got != tt.want {
+				t.Errorf("Probe() ready = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHealthHandler(t *testing.T) {
+	dsmService := newFakeDsmService()
+	dsmService.dsms["10.0.0.2"] = &webapi.DSM{Ip: "10.0.0.2"}
+	handler := (&Driver{DsmService: dsmService}).HealthHandler()
+
+	tests := []struct {
+		name      string
+		unhealthy map[string]error
+		wantReady int
+	}{
+		{name: "all healthy", wantReady: http.StatusOK},
+		{name: "one unreachable", unhealthy: map[string]error{"10.0.0.1": errors.New("timeout")}, wantReady: http.StatusOK},
+		{
+			name:      "all unreachable",
+			unhealthy: map[string]error{"10.0.0.1": errors.New("timeout"), "10.0.0.2": errors.New("timeout")},
+			wantReady: http.StatusServiceUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dsmService.unhealthy = tt.unhealthy
+
+			// liveness doesn't depend on DSM
+			for path, want := range map[string]int{"/healthz": http.StatusOK, "/readyz": tt.wantReady} {
+				rec := httptest.NewRecorder()
+				handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+				if rec.Code != want {
+					t.Errorf("GET %s status = %d, want %d, body: %s", path, rec.Code, want, rec.Body.String())
+				}
+			}
+		})
+	}
+}
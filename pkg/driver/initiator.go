@@ -23,7 +23,10 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
 	"github.com/SynologyOpenSource/synology-csi/pkg/utils/hostexec"
 	log "github.com/sirupsen/logrus"
 	utilexec "k8s.io/utils/exec"
@@ -108,7 +111,8 @@ func (t *tools) iscsiadm_session() []iscsiSession {
 	return parseSessions(string(out))
 }
 
-func (t *tools) iscsiadm_discovery(portal string) error {
+// iscsiadm_discovery returns the raw stdout listing the discovered targets
+func (t *tools) iscsiadm_discovery(portal string) (string, error) {
 	cmd := t.iscsiadm(
 		"-m", "discoverydb",
 		"--type", "sendtargets",
@@ -116,9 +120,29 @@ func (t *tools) iscsiadm_discovery(portal string) error {
 		"--discover")
 	out, err := cmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("%s (%v)", string(out), err)
+		return "", fmt.Errorf("%s (%w)", string(out), err)
 	}
-	return nil
+	return string(out), nil
+}
+
+// parseDiscoveredPortals takes the raw stdout from sendtargets discovery, lines like
+// "10.0.0.1:3260,1 iqn.2000-01.com.synology:ds.target", and returns the portals of targetIqn
+func parseDiscoveredPortals(lines string, targetIqn string) []string {
+	portals := []string{}
+	for _, entry := range strings.Split(strings.TrimSpace(lines), "\n") {
+		e := strings.Fields(entry)
+		if len(e) < 2 || e[1] != targetIqn {
+			continue
+		}
+		portal := e[0]
+		if i := strings.LastIndex(portal, ","); i >= 0 { // strip the portal group tag
+			portal = portal[:i]
+		}
+		if !utils.SliceContains(portals, portal) {
+			portals = append(portals, portal)
+		}
+	}
+	return portals
 }
 
 func (t *tools) iscsiadm_login(iqn, portal string) error {
@@ -129,26 +153,40 @@ func (t *tools) iscsiadm_login(iqn, portal string) error {
 		"--login")
 	out, err := cmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("%s (%v)", string(out), err)
+		return fmt.Errorf("%s (%w)", string(out), err)
 	}
 	return nil
 }
 
-func (t *tools) iscsiadm_update_node_startup(iqn, portal string) error {
+func (t *tools) iscsiadm_update_node(iqn, portal, name, value string) error {
 	cmd := t.iscsiadm(
 		"-m", "node",
 		"--targetname", iqn,
 		"--portal", portal,
 		"--op", "update",
-		"--name", "node.startup",
-		"--value", "manual")
+		"--name", name,
+		"--value", value)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("%s (%v)", string(out), err)
+		// never include the value, it may be a password
+		return fmt.Errorf("Failed to update %s: %s (%w)", name, string(out), err)
 	}
 	return nil
 }
 
+func (t *tools) iscsiadm_update_node_startup(iqn, portal string) error {
+	return t.iscsiadm_update_node(iqn, portal, "node.startup", "manual")
+}
+
+// iscsiadm_update_node_login_timeout sets the seconds iscsid waits for the login of the node, at least 1
+func (t *tools) iscsiadm_update_node_login_timeout(iqn, portal string, timeout time.Duration) error {
+	seconds := int(timeout.Round(time.Second) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return t.iscsiadm_update_node(iqn, portal, "node.conn[0].timeo.login_timeout", strconv.Itoa(seconds))
+}
+
 func (t *tools) iscsiadm_logout(iqn string) error {
 	cmd := t.iscsiadm(
 		"-m", "node",
@@ -195,17 +233,38 @@ func (t *tools) listSessionsByIqn(targetIqn string) (matchedSessions []iscsiSess
 	return matchedSessions
 }
 
-func (d *initiatorDriver) login(targetIqn string, portal string) error {
+func (d *initiatorDriver) login(targetIqn string, portal string, chap *models.ChapCredentials) error {
 	if d.tools.hasSession(targetIqn, portal) {
 		log.Infof("Session[%s] already exists.", targetIqn)
 		return nil
 	}
 
-	if err := d.tools.iscsiadm_discovery(portal); err != nil {
+	if _, err := d.tools.iscsiadm_discovery(portal); err != nil {
 		log.Errorf("Failed in discovery of the target: %v", err)
 		return err
 	}
 
+	if chap != nil {
+		if err := d.tools.iscsiadm_update_node_auth(targetIqn, portal, chap); err != nil {
+			log.Errorf("Failed to set CHAP credentials of the target: %v", err)
+			return err
+		}
+	}
+
+	if InitiatorName != "" {
+		if err := d.tools.iscsiadm_update_node(targetIqn, portal, "iface.initiatorname", InitiatorName); err != nil {
+			log.Errorf("Failed to set initiator name of the target: %v", err)
+			return err
+		}
+	}
+
+	if ISCSILoginTimeout > 0 {
+		if err := d.tools.iscsiadm_update_node_login_timeout(targetIqn, portal, ISCSILoginTimeout); err != nil {
+			log.Errorf("Failed to set login timeout of the target: %v", err)
+			return err
+		}
+	}
+
 	if err := d.tools.iscsiadm_login(targetIqn, portal); err != nil {
 		log.Errorf("Failed in login of the target: %v", err)
 		return err
@@ -0,0 +1,113 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// InitiatorName is the IQN the node logs into targets with, empty keeps the default of the host
+var InitiatorName string
+
+// maxIqnLen is the longest iSCSI name, in bytes
+const maxIqnLen = 223
+
+// maxNodeIdLen is the longest node ID CSI allows
+const maxNodeIdLen = 256
+
+// nodeIdIqnSeparator separates the node name from the initiator name in the node ID. Node
+// names are DNS subdomains and IQNs have no slash either.
+const nodeIdIqnSeparator = "/"
+
+var (
+	iqnPattern = regexp.MustCompile(`^iqn\.[0-9]{4}-(0[1-9]|1[0-2])\.[a-z0-9]([a-z0-9-]*[a-z0-9])?(\.[a-z0-9]([a-z0-9-]*[a-z0-9])?)*(:[a-z0-9.:-]*)?$`)
+	euiPattern = regexp.MustCompile(`^eui\.[0-9a-f]{16}$`)
+)
+
+// validateIqn checks an initiator name against the iqn. and eui. formats of RFC 3720. Names
+// are normalized to lowercase by iSCSI, so uppercase ones are refused rather than changed.
+func validateIqn(name string) error {
+	if len(name) > maxIqnLen {
+		return fmt.Errorf("Initiator name %q is longer than %d bytes", name, maxIqnLen)
+	}
+	if !iqnPattern.MatchString(name) && !euiPattern.MatchString(name) {
+		return fmt.Errorf("Initiator name %q is neither iqn.yyyy-mm.<reversed domain>[:<name>] nor eui.<16 hex digits>, in lowercase", name)
+	}
+	return nil
+}
+
+// readInitiatorName returns the InitiatorName of a file in the format of /etc/iscsi/initiatorname.iscsi
+func readInitiatorName(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if value := strings.TrimPrefix(line, "InitiatorName="); value != line {
+			return strings.TrimSpace(value), nil
+		}
+	}
+	return "", fmt.Errorf("No InitiatorName in %s", path)
+}
+
+// ConfigureInitiatorName sets the initiator name of the node, given as is or read from a
+// file, name taking precedence. Neither keeps the default initiator of the host.
+func ConfigureInitiatorName(nodeId, name, file string) error {
+	if name == "" && file != "" {
+		var err error
+		if name, err = readInitiatorName(file); err != nil {
+			return err
+		}
+	}
+	if name == "" {
+		return nil
+	}
+	if err := validateIqn(name); err != nil {
+		return err
+	}
+	if id := nodeIdWithIqn(nodeId, name); len(id) > maxNodeIdLen {
+		return fmt.Errorf("Node ID %q with the initiator name is longer than %d bytes", id, maxNodeIdLen)
+	}
+	InitiatorName = name
+	return nil
+}
+
+// nodeIdWithIqn returns the node ID reported by NodeGetInfo, which carries the initiator
+// name of the node, if configured, to the controller
+func nodeIdWithIqn(nodeId, iqn string) string {
+	if iqn == "" {
+		return nodeId
+	}
+	return nodeId + nodeIdIqnSeparator + iqn
+}
+
+// parseNodeId splits a node ID reported by NodeGetInfo into the node name and its
+// initiator name, empty if the node has none configured
+func parseNodeId(nodeId string) (string, string) {
+	i := strings.Index(nodeId, nodeIdIqnSeparator)
+	if i < 0 {
+		return nodeId, ""
+	}
+	return nodeId[:i], nodeId[i+1:]
+}
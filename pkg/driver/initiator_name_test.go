@@ -0,0 +1,124 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils/hostexec"
+)
+
+func TestValidateIqn(t *testing.T) {
+	tests := []struct {
+		name    string
+		wantErr bool
+	}{
+		{"iqn.1993-08.org.debian:01:2a3b4c5d6e7f", false},
+		{"iqn.2000-01.com.synology:ds.pvc-1", false},
+		{"iqn.2004-10.com.ubuntu", false},
+		{"eui.02004567a425678d", false},
+		{"", true},
+		{"iqn.1993-8.org.debian:01:node", true},
+		{"iqn.1993-13.org.debian:01:node", true},
+		{"iqn.1993-08.Org.Debian:01:node", true},
+		{"iqn.1993-08.org.debian:01:node_1", true},
+		{"iqn.1993-08.-org.debian", true},
+		{"eui.02004567A425678D", true},
+		{"eui.02004567a425", true},
+		{"naa.52004567ba64678d", true},
+		{"iqn.1993-08.org.debian:" + strings.Repeat("a", 201), true},
+	}
+	for _, tt := range tests {
+		if err := validateIqn(tt.name); (err != nil) != tt.wantErr {
+			t.Errorf("validateIqn(%q) error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestConfigureInitiatorName(t *testing.T) {
+	defer func(name string) { InitiatorName = name }(InitiatorName)
+
+	file := filepath.Join(t.TempDir(), "initiatorname.iscsi")
+	content := "## DO NOT EDIT OR REMOVE THIS FILE!\nInitiatorName=iqn.1993-08.org.debian:01:node1\n"
+	if err := os.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		iqn     string
+		file    string
+		want    string
+		wantErr bool
+	}{
+		{name: "host default", want: ""},
+		{name: "flag", iqn: "iqn.2004-10.com.ubuntu:node1", want: "iqn.2004-10.com.ubuntu:node1"},
+		{name: "file", file: file, want: "iqn.1993-08.org.debian:01:node1"},
+		{name: "flag over file", iqn: "iqn.2004-10.com.ubuntu:node1", file: file, want: "iqn.2004-10.com.ubuntu:node1"},
+		{name: "invalid", iqn: "iqn.node1", wantErr: true},
+		{name: "missing file", file: filepath.Join(t.TempDir(), "missing"), wantErr: true},
+		{name: "node ID too long", iqn: "iqn.2004-10.com.ubuntu:" + strings.Repeat("a", 200), wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			InitiatorName = ""
+			nodeId := "node1"
+			if tt.name == "node ID too long" {
+				nodeId = strings.Repeat("n", 60)
+			}
+			err := ConfigureInitiatorName(nodeId, tt.iqn, tt.file)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ConfigureInitiatorName() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if InitiatorName != tt.want {
+				t.Errorf("InitiatorName = %q, want %q", InitiatorName, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseNodeId(t *testing.T) {
+	const iqn = "iqn.1993-08.org.debian:01:node1"
+	for _, tt := range []struct{ nodeId, iqn string }{{"node1", ""}, {"node1", iqn}} {
+		id := nodeIdWithIqn(tt.nodeId, tt.iqn)
+		if nodeId, gotIqn := parseNodeId(id); nodeId != tt.nodeId || gotIqn != tt.iqn {
+			t.Errorf("parseNodeId(%q) = %q, %q, want %q, %q", id, nodeId, gotIqn, tt.nodeId, tt.iqn)
+		}
+	}
+}
+
+func TestLogin_initiatorName(t *testing.T) {
+	defer func(name string) { InitiatorName = name }(InitiatorName)
+	InitiatorName = "iqn.1993-08.org.debian:01:node1"
+
+	fake := hostexec.NewFake(nil, "/host")
+	d := &initiatorDriver{tools: NewTools(fake)}
+	if err := d.login("iqn.2000-01.com.synology:ds.pvc-1", "10.0.0.1:3260", nil); err != nil {
+		t.Fatalf("login() error = %v", err)
+	}
+	node := []string{"iscsiadm", "-m", "node", "--targetname", "iqn.2000-01.com.synology:ds.pvc-1", "--portal", "10.0.0.1:3260"}
+	assertInvocations(t, fake, [][]string{
+		{"iscsiadm", "-m", "session"},
+		{"iscsiadm", "-m", "discoverydb", "--type", "sendtargets", "--portal", "10.0.0.1:3260", "--discover"},
+		append(node, "--op", "update", "--name", "iface.initiatorname", "--value", InitiatorName),
+		append(node, "--login"),
+		append(node, "--op", "update", "--name", "node.startup", "--value", "manual"),
+	})
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	log "github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// inodeEventInterval is the minimum time between two inode pressure events of a volume
+const inodeEventInterval = time.Hour
+
+const reasonInodePressure = "InodePressure"
+
+// eventLimiter lets through one event per key and interval
+type eventLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	last     map[string]time.Time
+	now      func() time.Time
+}
+
+func newEventLimiter(interval time.Duration) *eventLimiter {
+	return &eventLimiter{
+		interval: interval,
+		last:     make(map[string]time.Time),
+		now:      time.Now,
+	}
+}
+
+// allow reports whether an event of key can be emitted now, and if so, records it
+func (l *eventLimiter) allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	if last, ok := l.last[key]; ok && now.Sub(last) < l.interval {
+		return false
+	}
+	// keys are dropped once expired, the failures of deleted PVCs would add up otherwise
+	for k, last := range l.last {
+		if now.Sub(last) >= l.interval {
+			delete(l.last, k)
+		}
+	}
+	l.last[key] = now
+	return true
+}
+
+// newEventRecorder returns a recorder of the events emitted by the node server
+func newEventRecorder(client clientset.Interface, nodeId string) record.EventRecorder {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: client.CoreV1().Events("")})
+	return broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: DriverName, Host: nodeId})
+}
+
+// inodeUtilization returns the percentage of used inodes, or 0 if the usage has no inode count
+func inodeUtilization(usage []*csi.VolumeUsage) float64 {
+	for _, u := range usage {
+		if u.GetUnit() == csi.VolumeUsage_INODES && u.GetTotal() > 0 {
+			return float64(u.GetUsed()) * 100 / float64(u.GetTotal())
+		}
+	}
+	return 0
+}
+
+// pvNameFromVolumePath returns the PV name in the kubelet path of a mounted CSI volume,
+// .../volumes/kubernetes.io~csi/<pv name>/mount
+func pvNameFromVolumePath(volumePath string) string {
+	volumePath = filepath.Clean(volumePath)
+	if filepath.Base(volumePath) != "mount" || filepath.Base(filepath.Dir(filepath.Dir(volumePath))) != "kubernetes.io~csi" {
+		return ""
+	}
+	return filepath.Base(filepath.Dir(volumePath))
+}
+
+// warnInodePressure emits a warning event on the PVC of the volume if its inode usage exceeds InodeWarningThreshold
+func (ns *nodeServer) warnInodePressure(ctx context.Context, volumeId string, volumePath string, usage []*csi.VolumeUsage) {
+	if InodeWarningThreshold <= 0 || ns.recorder == nil {
+		return
+	}
+	utilization := inodeUtilization(usage)
+	if utilization < InodeWarningThreshold || !ns.inodeEvents.allow(volumeId) {
+		return
+	}
+
+	pvName := pvNameFromVolumePath(volumePath)
+	if pvName == "" {
+		log.WithContext(ctx).Warnf("Volume[%s] uses %.1f%% of its inodes", volumeId, utilization)
+		return
+	}
+	ref := &v1.ObjectReference{Kind: "PersistentVolume", APIVersion: "v1", Name: pvName}
+	if pv, err := ns.Client.CoreV1().PersistentVolumes().Get(ctx, pvName, metav1.GetOptions{}); err != nil {
+		log.WithContext(ctx).Warnf("Failed to get PV[%s] of volume[%s]: %v", pvName, volumeId, err)
+	} else if pv.Spec.ClaimRef != nil {
+		ref = pv.Spec.ClaimRef
+	}
+
+	ns.recorder.Eventf(ref, v1.EventTypeWarning, reasonInodePressure,
+		"Volume %s uses %.1f%% of its inodes, above the threshold of %.1f%%", pvName, utilization, InodeWarningThreshold)
+}
@@ -0,0 +1,124 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func inodeUsage(used, total int64) []*csi.VolumeUsage {
+	return []*csi.VolumeUsage{
+		{Unit: csi.VolumeUsage_BYTES, Used: 10, Total: 100},
+		{Unit: csi.VolumeUsage_INODES, Used: used, Total: total},
+	}
+}
+
+func TestInodeUtilization(t *testing.T) {
+	tests := []struct {
+		name  string
+		usage []*csi.VolumeUsage
+		want  float64
+	}{
+		{"half", inodeUsage(50, 100), 50},
+		{"full", inodeUsage(100, 100), 100},
+		{"no inodes", inodeUsage(0, 0), 0},
+		{"bytes only", []*csi.VolumeUsage{{Unit: csi.VolumeUsage_BYTES, Used: 90, Total: 100}}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := inodeUtilization(tt.usage); got != tt.want {
+				t.Errorf("inodeUtilization() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPvNameFromVolumePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/var/lib/kubelet/pods/uid/volumes/kubernetes.io~csi/pvc-1/mount", "pvc-1"},
+		{"/var/lib/kubelet/pods/uid/volumes/kubernetes.io~csi/pvc-1/mount/", "pvc-1"},
+		{"/var/lib/kubelet/pods/uid/volumes/kubernetes.io~nfs/pvc-1/mount", ""},
+		{"/mnt/volume", ""},
+	}
+	for _, tt := range tests {
+		if got := pvNameFromVolumePath(tt.path); got != tt.want {
+			t.Errorf("pvNameFromVolumePath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestEventLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newEventLimiter(time.Hour)
+	l.now = func() time.Time { return now }
+
+	if !l.allow("vol-1") {
+		t.Fatal("allow() = false for the first event")
+	}
+	if l.allow("vol-1") {
+		t.Error("allow() = true for a second event within the interval")
+	}
+	if !l.allow("vol-2") {
+		t.Error("allow() = false for the first event of another key")
+	}
+	now = now.Add(time.Hour)
+	if !l.allow("vol-1") {
+		t.Error("allow() = false after the interval")
+	}
+}
+
+func TestWarnInodePressure(t *testing.T) {
+	defer func(threshold float64) { InodeWarningThreshold = threshold }(InodeWarningThreshold)
+	InodeWarningThreshold = 90
+
+	pv := &v1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: "pvc-1"},
+		Spec: v1.PersistentVolumeSpec{
+			ClaimRef: &v1.ObjectReference{Kind: "PersistentVolumeClaim", Namespace: "default", Name: "data"},
+		},
+	}
+	recorder := record.NewFakeRecorder(10)
+	ns := &nodeServer{
+		Client:      fake.NewSimpleClientset(pv),
+		recorder:    recorder,
+		inodeEvents: newEventLimiter(time.Hour),
+	}
+	path := "/var/lib/kubelet/pods/uid/volumes/kubernetes.io~csi/pvc-1/mount"
+
+	ns.warnInodePressure(context.Background(), "vol-1", path, inodeUsage(50, 100))
+	ns.warnInodePressure(context.Background(), "vol-1", path, inodeUsage(95, 100))
+	ns.warnInodePressure(context.Background(), "vol-1", path, inodeUsage(99, 100))
+
+	if len(recorder.Events) != 1 {
+		t.Fatalf("recorded %d events, want 1", len(recorder.Events))
+	}
+	if event := <-recorder.Events; !strings.HasPrefix(event, "Warning InodePressure Volume pvc-1 uses 95.0%") {
+		t.Errorf("event = %q", event)
+	}
+}
@@ -0,0 +1,89 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"text/template"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+// lunNameVars are the variables of a lunNameTemplate
+type lunNameVars struct {
+	PVCName      string
+	PVCNamespace string
+	PVName       string
+	// Suffix is a short hash of the volume name, unique per volume
+	Suffix string
+}
+
+// lunNameInvalidChars are the characters DSM doesn't accept in LUN names
+var lunNameInvalidChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// lunNameSuffix returns the short hash appended to a LUN name to keep it unique
+func lunNameSuffix(volName string) string {
+	sum := sha256.Sum256([]byte(volName))
+	return hex.EncodeToString(sum[:4])
+}
+
+// withLunNameSuffix appends suffix to name, cutting name to fit in the LUN name length limit
+func withLunNameSuffix(name string, suffix string) string {
+	if max := models.MaxLunNameLen - len(suffix) - 1; len(name) > max {
+		name = name[:max]
+	}
+	return name + "-" + suffix
+}
+
+// renderLunName renders the lunNameTemplate of a StorageClass. Invalid characters are
+// replaced by '-', and if that or the length limit altered the name, the suffix of the
+// volume is appended so that different PVCs don't end up with the same LUN name.
+func renderLunName(tmpl string, vars lunNameVars) (string, error) {
+	t, err := template.New("lunNameTemplate").Option("missingkey=error").Parse(tmpl)
+	if err != nil {
+		return "", fmt.Errorf("Invalid lunNameTemplate: %v", err)
+	}
+	var rendered strings.Builder
+	if err := t.Execute(&rendered, vars); err != nil {
+		return "", fmt.Errorf("Failed to render lunNameTemplate: %v", err)
+	}
+
+	name := strings.Trim(lunNameInvalidChars.ReplaceAllString(rendered.String(), "-"), "-")
+	if name == "" {
+		return "", fmt.Errorf("lunNameTemplate %q renders an empty LUN name", tmpl)
+	}
+	if name != rendered.String() || len(name) > models.MaxLunNameLen {
+		name = withLunNameSuffix(name, vars.Suffix)
+	}
+	return name, nil
+}
+
+// isLunNameTaken tells if another volume already has a LUN named lunName
+func (cs *controllerServer) isLunNameTaken(ctx context.Context, lunName string) bool {
+	for _, vol := range cs.dsmService.ListVolumes(ctx) {
+		if vol.Protocol == utils.ProtocolIscsi && vol.Name == lunName {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+)
+
+func TestRenderLunName(t *testing.T) {
+	vars := lunNameVars{PVCName: "data", PVCNamespace: "shop", PVName: "pvc-1234", Suffix: "abcd0123"}
+	long := strings.Repeat("a", models.MaxLunNameLen)
+
+	tests := []struct {
+		name    string
+		tmpl    string
+		vars    lunNameVars
+		want    string
+		wantErr bool
+	}{
+		{name: "plain", tmpl: "prod-{{.PVCNamespace}}-{{.PVCName}}", vars: vars, want: "prod-shop-data"},
+		{name: "all variables", tmpl: "{{.PVName}}_{{.Suffix}}", vars: vars, want: "pvc-1234_abcd0123"},
+		{name: "sanitized", tmpl: "prod/{{.PVCNamespace}} {{.PVCName}}", vars: vars, want: "prod-shop-data-abcd0123"},
+		{name: "too long", tmpl: long + "{{.PVCName}}", vars: vars, want: long[:models.MaxLunNameLen-9] + "-abcd0123"},
+		{name: "empty", tmpl: "{{.PVCName}}", vars: lunNameVars{Suffix: "abcd0123"}, wantErr: true},
+		{name: "unknown variable", tmpl: "{{.Cluster}}", vars: vars, wantErr: true},
+		{name: "invalid template", tmpl: "{{.PVCName", vars: vars, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := renderLunName(tt.tmpl, tt.vars)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("renderLunName() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("renderLunName() = %q, want %q", got, tt.want)
+			}
+			if len(got) > models.MaxLunNameLen {
+				t.Errorf("renderLunName() is %d characters long", len(got))
+			}
+		})
+	}
+}
+
+func TestCreateVolume_lunNameTemplate(t *testing.T) {
+	dsmService := newFakeDsmService()
+	cs := newTestControllerServer(dsmService)
+	params := func(pvc string) map[string]string {
+		return map[string]string{
+			"lunNameTemplate":                  "prod-{{.PVCNamespace}}-{{.PVCName}}",
+			"csi.storage.k8s.io/pvc/namespace": "shop",
+			"csi.storage.k8s.io/pvc/name":      pvc,
+		}
+	}
+
+	first, err := cs.CreateVolume(context.Background(), newCreateVolumeRequest("pvc-1", params("data")))
+	if err != nil {
+		t.Fatalf("CreateVolume() error = %v", err)
+	}
+	if got := dsmService.created[0].LunName; got != "prod-shop-data" {
+		t.Errorf("CreateVolume() LUN name = %q, want %q", got, "prod-shop-data")
+	}
+
+	// retries find the existing volume by its target
+	retry, err := cs.CreateVolume(context.Background(), newCreateVolumeRequest("pvc-1", params("data")))
+	if err != nil || retry.Volume.VolumeId != first.Volume.VolumeId || len(dsmService.created) != 1 {
+		t.Fatalf("CreateVolume() retry = %v, %v, created %d volumes", retry, err, len(dsmService.created))
+	}
+
+	// another volume rendering the same name gets a suffix
+	if _, err := cs.CreateVolume(context.Background(), newCreateVolumeRequest("pvc-2", params("data"))); err != nil {
+		t.Fatalf("CreateVolume() error = %v", err)
+	}
+	if got, want := dsmService.created[1].LunName, "prod-shop-data-"+lunNameSuffix("pvc-2"); got != want {
+		t.Errorf("CreateVolume() LUN name = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,76 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+// mountPropagationFlags are the propagation flags of mount(8). In Kubernetes terms
+// rprivate is None, rslave is HostToContainer and rshared is Bidirectional.
+var mountPropagationFlags = []string{"private", "rprivate", "slave", "rslave", "shared", "rshared"}
+
+// isBidirectionalPropagation tells if mounts made under a mount with propagation flow back to its peers
+func isBidirectionalPropagation(propagation string) bool {
+	return propagation == "shared" || propagation == "rshared"
+}
+
+// parseMountPropagation returns the propagation flag of the mount flags, empty if there is none
+func parseMountPropagation(flags []string) (string, error) {
+	propagation := ""
+	for _, flag := range flags {
+		if !utils.SliceContains(mountPropagationFlags, flag) {
+			continue
+		}
+		if propagation != "" && propagation != flag {
+			return "", fmt.Errorf("Conflicting mount propagation flags: %s and %s", propagation, flag)
+		}
+		propagation = flag
+	}
+	return propagation, nil
+}
+
+// withoutMountPropagation drops the propagation flags, which only apply to the published mount
+func withoutMountPropagation(flags []string) []string {
+	others := []string{}
+	for _, flag := range flags {
+		if !utils.SliceContains(mountPropagationFlags, flag) {
+			others = append(others, flag)
+		}
+	}
+	return others
+}
+
+// publishMountPropagation returns the propagation flag requested by the mount flags of a
+// volume capability, empty if none is. Bidirectional propagation lets the workload mount
+// filesystems seen by the host, so it is only granted when requested, and never to a
+// read-only publish.
+func publishMountPropagation(volCap *csi.VolumeCapability, readonly bool) (string, error) {
+	propagation, err := parseMountPropagation(volCap.GetMount().GetMountFlags())
+	if err != nil || !isBidirectionalPropagation(propagation) {
+		return propagation, err
+	}
+
+	if isReadOnlyPublish(volCap, readonly) {
+		return "", fmt.Errorf("Mount propagation %s can't be used by a read-only volume", propagation)
+	}
+	return propagation, nil
+}
@@ -0,0 +1,111 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/mount-utils"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+func mountCapability(mode csi.VolumeCapability_AccessMode_Mode, flags ...string) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{MountFlags: flags}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+	}
+}
+
+func TestPublishMountPropagation(t *testing.T) {
+	tests := []struct {
+		name     string
+		volCap   *csi.VolumeCapability
+		readonly bool
+		want     string
+		wantErr  bool
+	}{
+		{name: "none", volCap: mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, "nconnect=4")},
+		{name: "block", volCap: &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}}},
+		{name: "host to container", volCap: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, "rslave"), want: "rslave"},
+		{name: "host to container read-only", volCap: mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, "rslave"), readonly: true, want: "rslave"},
+		{name: "private", volCap: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, "private"), want: "private"},
+		{name: "bidirectional", volCap: mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, "hard", "rshared"), want: "rshared"},
+		{name: "bidirectional single writer", volCap: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, "shared"), want: "shared"},
+		{name: "bidirectional read-only publish", volCap: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, "rshared"), readonly: true, wantErr: true},
+		{name: "bidirectional reader only", volCap: mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, "rshared"), wantErr: true},
+		{name: "conflicting", volCap: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, "rslave", "rshared"), wantErr: true},
+		{name: "repeated", volCap: mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER, "rslave", "rslave"), want: "rslave"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := publishMountPropagation(tt.volCap, tt.readonly)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("publishMountPropagation() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("publishMountPropagation() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNodePublishVolume_propagation(t *testing.T) {
+	tests := []struct {
+		name     string
+		volCap   *csi.VolumeCapability
+		readonly bool
+		want     []string
+		wantCode codes.Code
+	}{
+		{name: "default", volCap: mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER), want: []string{"bind"}},
+		{name: "bidirectional", volCap: mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, "rshared"), want: []string{"bind", "rshared"}},
+		{name: "host to container read-only", volCap: mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, "rslave"), readonly: true, want: []string{"ro", "bind", "rslave"}},
+		{name: "bidirectional read-only", volCap: mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, "rshared"), readonly: true, wantCode: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targetPath := filepath.Join(t.TempDir(), "target")
+			mounter := mount.NewFakeMounter(nil)
+			ns := &nodeServer{Mounter: &mount.SafeFormatAndMount{Interface: mounter}}
+
+			_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+				VolumeId:          "vol-1",
+				StagingTargetPath: "/staging",
+				TargetPath:        targetPath,
+				VolumeCapability:  tt.volCap,
+				Readonly:          tt.readonly,
+				VolumeContext:     map[string]string{"protocol": utils.ProtocolSmb},
+			})
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("NodePublishVolume() code = %v, want %v (err: %v)", code, tt.wantCode, err)
+			}
+			if tt.wantCode != codes.OK {
+				return
+			}
+			if len(mounter.MountPoints) != 1 || !reflect.DeepEqual(mounter.MountPoints[0].Opts, tt.want) {
+				t.Errorf("NodePublishVolume() mounts = %+v, want options %v", mounter.MountPoints, tt.want)
+			}
+		})
+	}
+}
@@ -22,12 +22,15 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"path/filepath"
 	"regexp"
 	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	utilexec "k8s.io/utils/exec"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
 )
 
 // IsMultipathEnabled returns true if multipath is enabled
@@ -73,7 +76,7 @@ func (t *tools) execWithTimeout(command string, args []string, timeout time.Dura
 	if err != nil {
 		if ee, ok := err.(utilexec.ExitError); ok {
 			log.Errorf("Non-zero exit code: %s", err)
-			err = fmt.Errorf("%s", ee.ExitStatus())
+			err = fmt.Errorf("%d", ee.ExitStatus())
 		}
 	}
 
@@ -86,7 +89,7 @@ func (t *tools) multipath_resize(devName string) error {
 	cmd := t.executor.Command("multipathd", "resize", "map", devName) // use devName not devPath, or it'll fail
 	out, err := cmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("%s (%v)", string(out), err)
+		return fmt.Errorf("%s (%w)", string(out), err)
 	}
 	return nil
 }
@@ -99,111 +102,85 @@ func (t *tools) multipath_flush(devPath string) error {
 		if _, e := os.Stat(devPath); os.IsNotExist(e) {
 			log.Debugf("Multipath device %v has been removed.", devPath)
 		} else {
-			return fmt.Errorf("%s (%v)", string(out), err)
+			return fmt.Errorf("%s (%w)", string(out), err)
 		}
 	}
 	return nil
 }
 
-// Device contains information about a device
-type Device struct {
-	Name      string   `json:"name"`
-	Hctl      string   `json:"hctl"`
-	Children  []Device `json:"children"`
-	Type      string   `json:"type"`
-	Transport string   `json:"tran"`
-	Size      string   `json:"size,omitempty"`
-}
+var multipathPathRe = regexp.MustCompile(`^[|` + "`" + `\s-]*\d+:\d+:\d+:\d+\s+(\S+)\s+\d+:\d+`)
 
-// returns a multipath device for the configured targets if it exists
-func GetMultipathDevice(devices []Device) (*Device, error) {
-	var multipathDevice *Device
+// parseMultipathMaps takes the raw stdout from the `multipath -ll` command and
+// returns the block devices of each map, keyed by map name
+func parseMultipathMaps(out string) map[string][]string {
+	maps := make(map[string][]string)
 
-	for _, device := range devices {
-		if len(device.Children) != 1 {
-			return nil, fmt.Errorf("device is not mapped to exactly one multipath device: %v", device.Children)
+	var current string
+	for _, line := range strings.Split(out, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
 		}
-		if multipathDevice != nil && device.Children[0].Name != multipathDevice.Name {
-			return nil, fmt.Errorf("devices don't share a common multipath device: %v", devices)
+		if m := multipathPathRe.FindStringSubmatch(line); m != nil {
+			if current != "" {
+				maps[current] = append(maps[current], m[1])
+			}
+			continue
+		}
+		// a map starts with its name at the beginning of the line, e.g.
+		// "mpatha (36001405...) dm-0 SYNOLOGY,iSCSI Storage"
+		first := line[0]
+		if first != ' ' && first != '|' && first != '`' && !strings.HasPrefix(line, "size=") {
+			current = strings.Fields(line)[0]
+			maps[current] = []string{}
 		}
-		multipathDevice = &device.Children[0]
-	}
-
-	if multipathDevice == nil {
-		return nil, fmt.Errorf("multipath device not found")
-	}
-
-	if multipathDevice.Type != "mpath" {
-		return nil, fmt.Errorf("device is not of mpath type: %v", multipathDevice)
 	}
-
-	return multipathDevice, nil
+	return maps
 }
 
-// lsblk execute the lsblk commands
-func lsblk(devicePaths []string, strict bool) ([]Device, error) {
-	executor := utilexec.New()
-	cmd := executor.Command("lsblk", append([]string{"-rn", "-o", "NAME,KNAME,PKNAME,HCTL,TYPE,TRAN,SIZE"}, devicePaths...)...)
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		if ee, ok := err.(utilexec.ExitError); ok {
-			err = fmt.Errorf("%s", strings.Trim(ee.Error(), "\n"))
-			if strict || ee.ExitStatus() != 64 { // ignore the error if some devices have been found when not strict
-				return nil, err
+// multipathMapOf returns the name of the multipath map holding all the given block devices
+func multipathMapOf(maps map[string][]string, devNames []string) (string, error) {
+	var found string
+	for _, devName := range devNames {
+		var mapName string
+		for name, paths := range maps {
+			if utils.SliceContains(paths, devName) {
+				mapName = name
+				break
 			}
-			log.Debugf("Could find only some devices: %v", err)
-		} else {
-			return nil, err
 		}
-	}
-
-	var devices []*Device
-	devicesMap := make(map[string]*Device)
-	pkNames := []string{}
-
-	// Parse devices
-	lines := strings.Split(strings.Trim(string(out), "\n"), "\n")
-	for _, line := range lines {
-		columns := strings.Split(line, " ")
-		if len(columns) < 5 {
-			return nil, fmt.Errorf("invalid output from lsblk: %s", line)
+		if mapName == "" {
+			return "", fmt.Errorf("device %s is not part of a multipath map", devName)
 		}
-		device := &Device{
-			Name:      columns[0],
-			Hctl:      columns[3],
-			Type:      columns[4],
-			Transport: columns[5],
-			Size:      columns[6],
+		if found != "" && found != mapName {
+			return "", fmt.Errorf("devices don't share a common multipath map: %s, %s", found, mapName)
 		}
-		devices = append(devices, device)
-		pkNames = append(pkNames, columns[2])
-		devicesMap[columns[1]] = device
+		found = mapName
 	}
+	if found == "" {
+		return "", fmt.Errorf("multipath map not found")
+	}
+	return found, nil
+}
 
-	// Reconstruct devices tree
-	for i, pkName := range pkNames {
-		if pkName == "" {
-			continue
-		}
-
-		device := devices[i]
-		parent, ok := devicesMap[pkName]
-		if !ok {
-			return nil, fmt.Errorf("invalid output from lsblk: parent device %q not found", pkName)
+// multipath_device returns the /dev/mapper device for the given iSCSI device paths
+func (t *tools) multipath_device(iscsiDevPaths []string) (string, error) {
+	devNames := []string{}
+	for _, path := range iscsiDevPaths {
+		dev, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			return "", err
 		}
-		if parent.Children == nil {
-			parent.Children = []Device{}
-		}
-		parent.Children = append(devicesMap[pkName].Children, *device)
+		devNames = append(devNames, filepath.Base(dev))
 	}
 
-	// Filter devices to keep only the roots of the tree
-	var deviceInfo []Device
-	for i, device := range devices {
-		if pkNames[i] == "" {
-			deviceInfo = append(deviceInfo, *device)
-		}
+	out, err := t.executor.Command("multipath", "-ll").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s (%w)", string(out), err)
 	}
 
-	return deviceInfo, nil
+	mapName, err := multipathMapOf(parseMultipathMaps(string(out)), devNames)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join("/dev/mapper", mapName), nil
 }
@@ -0,0 +1,64 @@
+package driver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDiscoveredPortals(t *testing.T) {
+	out := `10.0.0.1:3260,1 iqn.2000-01.com.synology:ds.pvc-1
+10.0.1.1:3260,1 iqn.2000-01.com.synology:ds.pvc-1
+[fe80::1]:3260,1 iqn.2000-01.com.synology:ds.pvc-1
+10.0.0.1:3260,1 iqn.2000-01.com.synology:ds.pvc-2
+`
+	want := []string{"10.0.0.1:3260", "10.0.1.1:3260", "[fe80::1]:3260"}
+	if got := parseDiscoveredPortals(out, "iqn.2000-01.com.synology:ds.pvc-1"); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseDiscoveredPortals() = %v, want %v", got, want)
+	}
+	if got := parseDiscoveredPortals("", "iqn.2000-01.com.synology:ds.pvc-1"); len(got) != 0 {
+		t.Errorf("parseDiscoveredPortals() of no output = %v, want none", got)
+	}
+}
+
+func TestMultipathMapOf(t *testing.T) {
+	out := `mpatha (36001405d3e1f2a3b4c5d6e7f8a9b0c1d) dm-0 SYNOLOGY,iSCSI Storage
+size=1.0G features='0' hwhandler='1 alua' wp=rw
+|-+- policy='service-time 0' prio=50 status=active
+| ` + "`" + `- 3:0:0:1 sdb 8:16 active ready running
+` + "`" + `-+- policy='service-time 0' prio=50 status=enabled
+  ` + "`" + `- 4:0:0:1 sdc 8:32 active ready running
+36001405aaaabbbbccccddddeeeeffff0 dm-1 SYNOLOGY,iSCSI Storage
+size=2.0G features='0' hwhandler='1 alua' wp=rw
+` + "`" + `-+- policy='service-time 0' prio=50 status=active
+  |- 5:0:0:1 sdd 8:48 active ready running
+  ` + "`" + `- 6:0:0:1 sde 8:64 active ready running
+`
+	maps := parseMultipathMaps(out)
+	wantMaps := map[string][]string{
+		"mpatha":                            {"sdb", "sdc"},
+		"36001405aaaabbbbccccddddeeeeffff0": {"sdd", "sde"},
+	}
+	if !reflect.DeepEqual(maps, wantMaps) {
+		t.Fatalf("parseMultipathMaps() = %v, want %v", maps, wantMaps)
+	}
+
+	tests := []struct {
+		name     string
+		devNames []string
+		want     string
+		wantErr  bool
+	}{
+		{name: "all paths", devNames: []string{"sdb", "sdc"}, want: "mpatha"},
+		{name: "wwid name", devNames: []string{"sde"}, want: "36001405aaaabbbbccccddddeeeeffff0"},
+		{name: "different maps", devNames: []string{"sdb", "sdd"}, wantErr: true},
+		{name: "not multipathed", devNames: []string{"sdf"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := multipathMapOf(maps, tt.devNames)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("multipathMapOf() = %v, %v, want %v, wantErr %v", got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
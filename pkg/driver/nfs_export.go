@@ -0,0 +1,102 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+// StorageClass parameters of the NFS privilege rules, also passed to NodeStageVolume in the VolumeContext
+const (
+	nfsClientsKey    = "nfsClients"
+	nfsRootSquashKey = "nfsRootSquash"
+	nfsReadOnlyKey   = "nfsReadOnly"
+	nfsSyncKey       = "nfsSync"
+)
+
+var nfsExportKeys = []string{nfsClientsKey, nfsRootSquashKey, nfsReadOnlyKey, nfsSyncKey}
+
+// nfsRootSquashModes maps the nfsRootSquash parameter to the squash mode of DSM
+var nfsRootSquashModes = map[string]string{
+	"no_mapping":    webapi.NfsRootSquashNoMapping,
+	"root_to_admin": webapi.NfsRootSquashRootToAdmin,
+	"root_to_guest": webapi.NfsRootSquashRootToGuest,
+	"all_to_admin":  webapi.NfsRootSquashAllToAdmin,
+	"all_to_guest":  webapi.NfsRootSquashAllToGuest,
+}
+
+// parseNfsExportOptions reads the NFS privilege rule settings of a StorageClass, it
+// returns nil if none is set so the share keeps the default rules
+func parseNfsExportOptions(params map[string]string) (*models.NfsExportOptions, error) {
+	set := false
+	for _, key := range nfsExportKeys {
+		if params[key] != "" {
+			set = true
+		}
+	}
+	if !set {
+		return nil, nil
+	}
+
+	opts := &models.NfsExportOptions{
+		RootSquash: webapi.NfsRootSquashNoMapping,
+		ReadOnly:   utils.StringToBoolean(params[nfsReadOnlyKey]),
+		Sync:       utils.StringToBoolean(params[nfsSyncKey]),
+	}
+	if mode := params[nfsRootSquashKey]; mode != "" {
+		squash, ok := nfsRootSquashModes[strings.ToLower(mode)]
+		if !ok {
+			return nil, fmt.Errorf("Invalid %s: %s", nfsRootSquashKey, mode)
+		}
+		opts.RootSquash = squash
+	}
+	for _, client := range utils.StringToSlice(strings.ReplaceAll(params[nfsClientsKey], ",", " ")) {
+		if err := validateNfsClient(client); err != nil {
+			return nil, err
+		}
+		opts.Clients = append(opts.Clients, client)
+	}
+	return opts, nil
+}
+
+// validateNfsClient accepts an IP address or a CIDR
+func validateNfsClient(client string) error {
+	if net.ParseIP(client) != nil {
+		return nil
+	}
+	if _, _, err := net.ParseCIDR(client); err != nil {
+		return fmt.Errorf("Invalid %s: %s is neither an IP address nor a CIDR", nfsClientsKey, client)
+	}
+	return nil
+}
+
+// nfsExportContext returns the NFS privilege rule parameters to pass in the VolumeContext
+func nfsExportContext(params map[string]string) map[string]string {
+	volumeContext := map[string]string{}
+	for _, key := range nfsExportKeys {
+		if params[key] != "" {
+			volumeContext[key] = params[key]
+		}
+	}
+	return volumeContext
+}
@@ -0,0 +1,88 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+)
+
+func TestParseNfsExportOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  map[string]string
+		want    *models.NfsExportOptions
+		wantErr bool
+	}{
+		{name: "unset", params: map[string]string{"protocol": "nfs"}, want: nil},
+		{
+			name:   "all set",
+			params: map[string]string{"nfsClients": "10.0.0.0/24, 192.168.1.5", "nfsRootSquash": "ALL_TO_GUEST", "nfsReadOnly": "true", "nfsSync": "true"},
+			want: &models.NfsExportOptions{Clients: []string{"10.0.0.0/24", "192.168.1.5"},
+				RootSquash: webapi.NfsRootSquashAllToGuest, ReadOnly: true, Sync: true},
+		},
+		{
+			name:   "squash only",
+			params: map[string]string{"nfsRootSquash": "root_to_admin"},
+			want:   &models.NfsExportOptions{RootSquash: webapi.NfsRootSquashRootToAdmin},
+		},
+		{name: "ipv6 cidr", params: map[string]string{"nfsClients": "fd00::/64"},
+			want: &models.NfsExportOptions{Clients: []string{"fd00::/64"}, RootSquash: webapi.NfsRootSquashNoMapping}},
+		{name: "malformed cidr", params: map[string]string{"nfsClients": "10.0.0.0/33"}, wantErr: true},
+		{name: "hostname", params: map[string]string{"nfsClients": "node-1"}, wantErr: true},
+		{name: "unknown squash", params: map[string]string{"nfsRootSquash": "root"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseNfsExportOptions(tt.params)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseNfsExportOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseNfsExportOptions() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNfsExportPrivilegeRules(t *testing.T) {
+	nodeIps := []string{"10.0.0.11", "10.0.0.12"}
+
+	var defaults *models.NfsExportOptions
+	rules := defaults.PrivilegeRules(nodeIps)
+	if len(rules) != 2 || rules[0].Client != "10.0.0.11" || rules[1].Client != "10.0.0.12" {
+		t.Fatalf("PrivilegeRules() of defaults = %+v", rules)
+	}
+	if r := rules[0]; !r.Async || r.Privilege != "rw" || r.RootSquash != webapi.NfsRootSquashNoMapping || !r.SecurityFlavor.Sys {
+		t.Errorf("PrivilegeRules() of defaults = %+v", r)
+	}
+
+	opts, err := parseNfsExportOptions(map[string]string{"nfsClients": "10.1.0.0/16", "nfsRootSquash": "root_to_guest", "nfsReadOnly": "true", "nfsSync": "true"})
+	if err != nil {
+		t.Fatalf("parseNfsExportOptions() error = %v", err)
+	}
+	rules = opts.PrivilegeRules(nodeIps)
+	if len(rules) != 1 {
+		t.Fatalf("PrivilegeRules() = %+v, want a rule for the configured client only", rules)
+	}
+	if r := rules[0]; r.Client != "10.1.0.0/16" || r.Async || r.Privilege != "ro" || r.RootSquash != webapi.NfsRootSquashRootToGuest {
+		t.Errorf("PrivilegeRules() = %+v", r)
+	}
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+// nfsExclusiveOptions are the NFS mount options of which only one can be used at a time
+var nfsExclusiveOptions = [][]string{
+	{"hard", "soft"},
+	{"rw", "ro"},
+	{"sync", "async"},
+	{"ac", "noac"},
+	{"lock", "nolock"},
+	{"cto", "nocto"},
+	{"sharecache", "nosharecache"},
+	{"resvport", "noresvport"},
+}
+
+// nfsOptionKey returns what an NFS mount option sets, so options setting the same thing conflict
+func nfsOptionKey(option string) string {
+	key, _, _ := strings.Cut(option, "=")
+	if key == "vers" {
+		return "nfsvers"
+	}
+	for _, group := range nfsExclusiveOptions {
+		for _, o := range group {
+			if key == o {
+				return group[0]
+			}
+		}
+	}
+	return key
+}
+
+// parseNfsMountOptions reads the comma separated mountOptions and nfsvers parameters of a StorageClass
+func parseNfsMountOptions(params map[string]string) ([]string, error) {
+	options := []string{}
+	for _, option := range strings.Split(params["mountOptions"], ",") {
+		if option = strings.TrimSpace(option); option != "" {
+			options = append(options, option)
+		}
+	}
+	// propagation is requested by the volume capability, never granted by the StorageClass
+	if propagation, _ := parseMountPropagation(options); propagation != "" {
+		return nil, fmt.Errorf("mountOptions can't set the mount propagation %s, set it in the mount options of the PV", propagation)
+	}
+	if params["nfsvers"] != "" {
+		options = append(options, "nfsvers="+params["nfsvers"])
+	}
+	if err := validateNfsMountOptions(options); err != nil {
+		return nil, err
+	}
+	return options, nil
+}
+
+// validateNfsMountOptions rejects options which set the same thing differently, e.g. soft and hard
+func validateNfsMountOptions(options []string) error {
+	seen := map[string]string{}
+	for _, option := range options {
+		key := nfsOptionKey(option)
+		if prev, ok := seen[key]; ok && prev != option {
+			return fmt.Errorf("Conflicting NFS mount options: %s and %s", prev, option)
+		}
+		seen[key] = option
+	}
+	return nil
+}
+
+// mergeNfsMountOptions merges the NFS mount options of the StorageClass parameters with
+// the mount options of the PV, which take precedence over the conflicting ones
+func mergeNfsMountOptions(scOptions []string, pvOptions []string) ([]string, error) {
+	if err := validateNfsMountOptions(scOptions); err != nil {
+		return nil, err
+	}
+	if err := validateNfsMountOptions(pvOptions); err != nil {
+		return nil, err
+	}
+
+	overridden := map[string]bool{}
+	for _, option := range pvOptions {
+		overridden[nfsOptionKey(option)] = true
+	}
+
+	merged := []string{}
+	for _, option := range scOptions {
+		if !overridden[nfsOptionKey(option)] && !utils.SliceContains(merged, option) {
+			merged = append(merged, option)
+		}
+	}
+	for _, option := range pvOptions {
+		if !utils.SliceContains(merged, option) {
+			merged = append(merged, option)
+		}
+	}
+	return merged, nil
+}
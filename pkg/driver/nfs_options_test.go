@@ -0,0 +1,107 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseNfsMountOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		params  map[string]string
+		want    []string
+		wantErr bool
+	}{
+		{name: "none", params: map[string]string{}, want: []string{}},
+		{name: "options", params: map[string]string{"mountOptions": "nconnect=4, hard,,timeo=600"}, want: []string{"nconnect=4", "hard", "timeo=600"}},
+		{name: "nfsvers", params: map[string]string{"mountOptions": "hard", "nfsvers": "4.1"}, want: []string{"hard", "nfsvers=4.1"}},
+		{name: "soft and hard", params: map[string]string{"mountOptions": "soft,hard"}, wantErr: true},
+		{name: "conflicting versions", params: map[string]string{"mountOptions": "vers=3", "nfsvers": "4.1"}, wantErr: true},
+		{name: "propagation", params: map[string]string{"mountOptions": "hard,rshared"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseNfsMountOptions(tt.params)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseNfsMountOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseNfsMountOptions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeNfsMountOptions(t *testing.T) {
+	tests := []struct {
+		name      string
+		scOptions []string
+		pvOptions []string
+		want      []string
+		wantErr   bool
+	}{
+		{
+			name:      "disjoint",
+			scOptions: []string{"nconnect=4"},
+			pvOptions: []string{"hard"},
+			want:      []string{"nconnect=4", "hard"},
+		},
+		{
+			name:      "duplicates",
+			scOptions: []string{"hard", "nconnect=4"},
+			pvOptions: []string{"hard"},
+			want:      []string{"nconnect=4", "hard"},
+		},
+		{
+			name:      "pv value wins",
+			scOptions: []string{"timeo=600", "nconnect=4"},
+			pvOptions: []string{"timeo=100"},
+			want:      []string{"nconnect=4", "timeo=100"},
+		},
+		{
+			name:      "pv flag wins",
+			scOptions: []string{"soft", "nconnect=4"},
+			pvOptions: []string{"hard"},
+			want:      []string{"nconnect=4", "hard"},
+		},
+		{
+			name:      "pv version wins over alias",
+			scOptions: []string{"vers=3"},
+			pvOptions: []string{"nfsvers=4.1"},
+			want:      []string{"nfsvers=4.1"},
+		},
+		{
+			name:      "conflicting pv options",
+			scOptions: []string{"nconnect=4"},
+			pvOptions: []string{"soft", "hard"},
+			wantErr:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mergeNfsMountOptions(tt.scOptions, tt.pvOptions)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("mergeNfsMountOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mergeNfsMountOptions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
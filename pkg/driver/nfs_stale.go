@@ -0,0 +1,67 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/mount-utils"
+)
+
+// staleUnmountTimeout is how long a plain umount of a stale mount may take before it is forced
+const staleUnmountTimeout = 10 * time.Second
+
+// statPath is os.Stat, replaced by the tests to simulate stale mounts
+var statPath = os.Stat
+
+// isStaleMount tells if the NFS mount at path lost its file handle, e.g. after the DSM rebooted.
+// Only ESTALE counts, an empty or unmounted directory is never stale.
+func isStaleMount(path string) bool {
+	_, err := statPath(path)
+	return errors.Is(err, syscall.ESTALE)
+}
+
+// unmountStale unmounts the stale mount at targetPath, forcing it if umount hangs
+func (ns *nodeServer) unmountStale(targetPath string) error {
+	if forcer, ok := ns.Mounter.Interface.(mount.MounterForceUnmounter); ok {
+		return forcer.UnmountWithForce(targetPath, staleUnmountTimeout)
+	}
+	return ns.Mounter.Interface.Unmount(targetPath)
+}
+
+// recoverStaleMount unmounts a stale NFS mount at targetPath so it can be mounted again.
+// Without RemountStaleNfs the mount is left alone and an error tells how to recover it.
+func (ns *nodeServer) recoverStaleMount(volumeId string, targetPath string) error {
+	if !isStaleMount(targetPath) {
+		return nil
+	}
+	if !RemountStaleNfs {
+		return status.Errorf(codes.Internal, "NFS mount %s of volume %s is stale, start the node server with --remount-stale-nfs to remount it", targetPath, volumeId)
+	}
+
+	log.Warnf("NFS mount %s of volume %s is stale, remounting it", targetPath, volumeId)
+	if err := ns.unmountStale(targetPath); err != nil {
+		return status.Errorf(codes.Internal, "Failed to unmount stale NFS mount %s: %v", targetPath, err)
+	}
+	return nil
+}
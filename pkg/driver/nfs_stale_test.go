@@ -0,0 +1,137 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/mount-utils"
+)
+
+// staleOnce makes the first stat of path fail with ESTALE, as after a DSM reboot
+func staleOnce(path string) func(string) (os.FileInfo, error) {
+	stale := true
+	return func(name string) (os.FileInfo, error) {
+		if name == path && stale {
+			stale = false
+			return nil, &os.PathError{Op: "stat", Path: name, Err: syscall.ESTALE}
+		}
+		return os.Stat(name)
+	}
+}
+
+func TestIsStaleMount(t *testing.T) {
+	defer func(stat func(string) (os.FileInfo, error)) { statPath = stat }(statPath)
+	dir := t.TempDir()
+
+	if isStaleMount(dir) {
+		t.Errorf("isStaleMount() on an empty directory = true, want false")
+	}
+	if isStaleMount(filepath.Join(dir, "missing")) {
+		t.Errorf("isStaleMount() on a missing path = true, want false")
+	}
+
+	statPath = staleOnce(dir)
+	if !isStaleMount(dir) {
+		t.Errorf("isStaleMount() on ESTALE = false, want true")
+	}
+}
+
+func TestNodePublishVolume_staleNfs(t *testing.T) {
+	defer func(stat func(string) (os.FileInfo, error)) { statPath = stat }(statPath)
+	defer func(remount bool) { RemountStaleNfs = remount }(RemountStaleNfs)
+
+	tests := []struct {
+		name     string
+		remount  bool
+		wantCode codes.Code
+		wantLog  []mount.FakeAction
+	}{
+		{
+			name:     "remount",
+			remount:  true,
+			wantCode: codes.OK,
+			wantLog: []mount.FakeAction{
+				{Action: mount.FakeActionUnmount},
+				{Action: mount.FakeActionMount, Source: "10.0.0.1:/volume1/pvc-1", FSType: "nfs"},
+			},
+		},
+		{
+			name:     "recovery disabled",
+			remount:  false,
+			wantCode: codes.Internal,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			RemountStaleNfs = tt.remount
+			targetPath := t.TempDir()
+			statPath = staleOnce(targetPath)
+			mounter := mount.NewFakeMounter([]mount.MountPoint{{Device: "10.0.0.1:/volume1/pvc-1", Path: targetPath, Type: "nfs"}})
+			ns := &nodeServer{Mounter: &mount.SafeFormatAndMount{Interface: mounter}}
+
+			_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+				VolumeId:          "vol-1",
+				TargetPath:        targetPath,
+				StagingTargetPath: "/staging",
+				VolumeCapability: &csi.VolumeCapability{
+					AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+					AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+				},
+				VolumeContext: map[string]string{"protocol": "nfs", "dsm": "10.0.0.1", "baseDir": "/volume1/pvc-1"},
+			})
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("NodePublishVolume() code = %v, want %v (err: %v)", code, tt.wantCode, err)
+			}
+
+			got := mounter.GetLog()
+			for i := range tt.wantLog {
+				tt.wantLog[i].Target = targetPath
+			}
+			if len(got) != len(tt.wantLog) || (len(got) > 0 && !reflect.DeepEqual(got, tt.wantLog)) {
+				t.Errorf("NodePublishVolume() mount log = %+v, want %+v", got, tt.wantLog)
+			}
+		})
+	}
+}
+
+func TestNodeUnpublishVolume_staleNfs(t *testing.T) {
+	defer func(stat func(string) (os.FileInfo, error)) { statPath = stat }(statPath)
+
+	targetPath := filepath.Join(t.TempDir(), "target")
+	if err := os.Mkdir(targetPath, 0750); err != nil {
+		t.Fatal(err)
+	}
+	statPath = staleOnce(targetPath)
+	mounter := mount.NewFakeMounter([]mount.MountPoint{{Device: "10.0.0.1:/volume1/pvc-1", Path: targetPath, Type: "nfs"}})
+	ns := &nodeServer{Mounter: &mount.SafeFormatAndMount{Interface: mounter}}
+
+	if _, err := ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{VolumeId: "vol-1", TargetPath: targetPath}); err != nil {
+		t.Fatalf("NodeUnpublishVolume() error = %v", err)
+	}
+	if log := mounter.GetLog(); len(log) != 1 || log[0].Action != mount.FakeActionUnmount {
+		t.Errorf("NodeUnpublishVolume() mount log = %+v, want a single unmount", log)
+	}
+}
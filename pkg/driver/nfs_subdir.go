@@ -0,0 +1,60 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"path"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+)
+
+// StorageClass parameters of the NFS volumes which are subdirectories of an existing
+// share, named after their PV, rather than shares of their own
+const (
+	parentShareParam    = "parentShare"
+	subDirOnDeleteParam = "subDirOnDelete"
+	subDirContextKey    = "subDir"
+)
+
+// parseSubDirOnDelete returns what DeleteVolume does with the subdirectory of a volume,
+// deleting it with its contents unless the StorageClass retains them
+func parseSubDirOnDelete(params map[string]string) (string, error) {
+	switch onDelete := params[subDirOnDeleteParam]; onDelete {
+	case "":
+		return models.SubDirDelete, nil
+	case models.SubDirDelete, models.SubDirRetain:
+		return onDelete, nil
+	default:
+		return "", fmt.Errorf("Invalid %s %q, must be %s or %s", subDirOnDeleteParam, onDelete, models.SubDirDelete, models.SubDirRetain)
+	}
+}
+
+// nfsMountSource returns the "<server>:<path>" NFS mounts of the share exported in baseDir,
+// or of its subdirectory subDir if it isn't empty
+func nfsMountSource(server string, baseDir string, subDir string) (string, error) {
+	if server == "" || baseDir == "" {
+		return "", fmt.Errorf("Invalid inputs: server(dsm) and baseDir are required.")
+	}
+	if subDir == "" {
+		return fmt.Sprintf("%s:%s", server, baseDir), nil
+	}
+	if err := models.ValidateSubDir(subDir); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s:%s", server, path.Join(baseDir, subDir)), nil
+}
@@ -0,0 +1,41 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import "testing"
+
+func TestNfsMountSource(t *testing.T) {
+	tests := []struct {
+		server, baseDir, subDir string
+		want                    string
+		wantErr                 bool
+	}{
+		{server: "10.0.0.1", baseDir: "/volume1/k8s-csi-pvc-1", want: "10.0.0.1:/volume1/k8s-csi-pvc-1"},
+		{server: "10.0.0.1", baseDir: "/volume1/shared", subDir: "pvc-1", want: "10.0.0.1:/volume1/shared/pvc-1"},
+		{server: "10.0.0.1", baseDir: "/volume1/shared/", subDir: "pvc-1", want: "10.0.0.1:/volume1/shared/pvc-1"},
+		{server: "10.0.0.1", baseDir: "/volume1/shared", subDir: "..", wantErr: true},
+		{server: "10.0.0.1", baseDir: "/volume1/shared", subDir: "a/../../b", wantErr: true},
+		{server: "", baseDir: "/volume1/shared", wantErr: true},
+		{server: "10.0.0.1", baseDir: "", subDir: "pvc-1", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := nfsMountSource(tt.server, tt.baseDir, tt.subDir)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("nfsMountSource(%q, %q, %q) = %q, %v, want %q, error %v", tt.server, tt.baseDir, tt.subDir, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// DataDir holds the state the node server keeps across restarts, and its socket by default
+var DataDir = filepath.Join("/var/lib/kubelet/plugins", DriverName)
+
+// readStateFile decodes a state file into v, a missing file leaves v untouched
+func readStateFile(path string, v interface{}) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// writeStateFile replaces a state file with v. It is written to a temporary
+// file first, so a crash never leaves a partial file behind.
+func writeStateFile(path string, v interface{}) error {
+	if path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// stagedVolume is what the node needs to tear down an iSCSI volume without asking DSM
+type stagedVolume struct {
+	DsmIp        string `json:"dsm_ip"`
+	TargetIqn    string `json:"target_iqn"`
+	MappingIndex int    `json:"mapping_index"`
+	DevicePath   string `json:"device_path"`
+	MountPath    string `json:"mount_path"`
+	// Trim is set if the LUN reclaims space and the filesystem isn't mounted with discard
+	Trim bool `json:"trim,omitempty"`
+}
+
+// nodeState records the iSCSI volumes staged on the node, keyed by volume ID
+type nodeState struct {
+	mu      sync.Mutex
+	path    string
+	volumes map[string]stagedVolume
+}
+
+func newNodeState(path string) *nodeState {
+	s := &nodeState{
+		path:    path,
+		volumes: make(map[string]stagedVolume),
+	}
+
+	if err := readStateFile(path, &s.volumes); err != nil {
+		// unstage falls back to discovering the devices through DSM
+		log.Warnf("Ignoring staged volume state in %s: %v", path, err)
+		s.volumes = make(map[string]stagedVolume)
+	}
+	return s
+}
+
+func (s *nodeState) get(volumeId string) (stagedVolume, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	v, ok := s.volumes[volumeId]
+	return v, ok
+}
+
+// list returns a copy of the staged volumes
+func (s *nodeState) list() map[string]stagedVolume {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	volumes := make(map[string]stagedVolume, len(s.volumes))
+	for id, v := range s.volumes {
+		volumes[id] = v
+	}
+	return volumes
+}
+
+func (s *nodeState) put(volumeId string, v stagedVolume) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.volumes[volumeId] = v
+	s.save()
+}
+
+func (s *nodeState) remove(volumeId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.volumes[volumeId]; !ok {
+		return
+	}
+	delete(s.volumes, volumeId)
+	s.save()
+}
+
+// save writes the state, the caller holds s.mu
+func (s *nodeState) save() {
+	if err := writeStateFile(s.path, s.volumes); err != nil {
+		log.Errorf("Failed to save staged volume state: %v", err)
+	}
+}
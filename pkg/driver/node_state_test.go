@@ -0,0 +1,53 @@
+package driver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNodeState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "volumes.json")
+	state := newNodeState(path)
+
+	want := stagedVolume{
+		DsmIp:        "10.0.0.1",
+		TargetIqn:    "iqn.2000-01.com.synology:k8s-csi-pvc-1",
+		MappingIndex: 1,
+		DevicePath:   "/dev/sdb",
+		MountPath:    "/var/lib/kubelet/plugins/csi.san.synology.com/pv/pvc-1/globalmount",
+	}
+	state.put("vol-1", want)
+	state.put("vol-2", stagedVolume{TargetIqn: "iqn.other"})
+
+	// a restarted node server sees the same volumes
+	reloaded := newNodeState(path)
+	if got, ok := reloaded.get("vol-1"); !ok || got != want {
+		t.Errorf("get() after reload = %+v, %v, want %+v, true", got, ok, want)
+	}
+
+	reloaded.remove("vol-1")
+	if _, ok := newNodeState(path).get("vol-1"); ok {
+		t.Errorf("get() of removed volume found it")
+	}
+	if _, ok := newNodeState(path).get("vol-2"); !ok {
+		t.Errorf("get() of remaining volume didn't find it")
+	}
+}
+
+func TestNodeState_corruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "volumes.json")
+	if err := os.WriteFile(path, []byte(`{"vol-1": {"target_iqn": `), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	state := newNodeState(path)
+	if _, ok := state.get("vol-1"); ok {
+		t.Errorf("get() of corrupt file found a volume")
+	}
+
+	state.put("vol-2", stagedVolume{TargetIqn: "iqn.b"})
+	if got, ok := newNodeState(path).get("vol-2"); !ok || got.TargetIqn != "iqn.b" {
+		t.Errorf("get() after rewrite = %+v, %v", got, ok)
+	}
+}
@@ -33,6 +33,7 @@ import (
 	"google.golang.org/grpc/status"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/mount-utils"
 
 	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
@@ -48,25 +49,37 @@ type nodeServer struct {
 	Initiator  *initiatorDriver
 	Client     clientset.Interface
 	tools      tools
+	sessions   *sessionRefs
+	state      *nodeState
+	// devices caches the devices found for the LUNs after login
+	devices deviceCache
+	// recorder is nil if no event is emitted
+	recorder    record.EventRecorder
+	inodeEvents *eventLimiter
 }
 
-func waitForDevicePathToExist(path string) error {
-	ticker := time.NewTicker(1 * time.Second)
+func waitForDevicePathToExist(path string, timeout time.Duration) error {
+	return pollDevice(path, func() (bool, error) { return devicePathExists(path) }, timeout)
+}
+
+// pollDevice polls exists every devicePollInterval until the device it looks for is there
+func pollDevice(path string, exists func() (bool, error), timeout time.Duration) error {
+	ticker := time.NewTicker(devicePollInterval)
 	defer ticker.Stop()
-	timer := time.NewTimer(20 * time.Second)
+	timer := time.NewTimer(timeout)
 	defer timer.Stop()
 
 	for {
 		select {
 		case <-ticker.C:
-			exists, err := mount.PathExists(path)
+			exists, err := exists()
 			if err != nil {
 				return err
 			}
 			if exists == true {
 				return nil
 			}
-			log.Warnf("Device path [%s] doesn't exists yet, retrying in 1 second", path)
+			log.Warnf("Device path [%s] doesn't exists yet, retrying in %v", path, devicePollInterval)
 		case <-timer.C:
 			return os.ErrNotExist
 		}
@@ -79,36 +92,33 @@ func (t *tools) getExistedVolumeMountPath(targetIqn string, mappingIndex int) st
 
 	sessions := t.listSessionsByIqn(targetIqn)
 	for _, session := range sessions {
-		paths = append(paths, fmt.Sprintf("%sip-%s-iscsi-%s-lun-%d", "/dev/disk/by-path/", session.Portal, targetIqn, mappingIndex))
+		paths = append(paths, filepath.Join(byPathDir, byPathName(session.Portal, targetIqn, mappingIndex)))
 	}
 
-	return getVolumeMountPath(paths)
+	return t.getVolumeMountPath(paths)
 }
 
 // for publish, stage volume
-func getVolumeMountPath(iscsiDevPaths []string) string {
+func (t *tools) getVolumeMountPath(iscsiDevPaths []string) string {
 	var path string
 
-	if len(iscsiDevPaths) > 1 { // check multipath exist
-		devices, err := lsblk(iscsiDevPaths, true)
+	if len(iscsiDevPaths) > 1 && t.IsMultipathEnabled() { // check multipath exist
+		mapperPath, err := t.multipath_device(iscsiDevPaths)
 		if err != nil {
-			log.Errorf("Failed to lsblk for iscsi devices: %v", err)
+			log.Errorf("Failed to find multipath device for iscsi devices %v: %v", iscsiDevPaths, err)
 			return ""
 		}
-
-		multipathDevice, err := GetMultipathDevice(devices)
-		if err != nil {
-			log.Error(err)
-			return ""
+		path = mapperPath
+	} else if len(iscsiDevPaths) >= 1 {
+		if len(iscsiDevPaths) > 1 {
+			log.Warnf("multipathd isn't available, using single path %s of %v", iscsiDevPaths[0], iscsiDevPaths)
 		}
-		path = filepath.Join("/dev/mapper", multipathDevice.Name)
-	} else if len(iscsiDevPaths) == 1 {
 		path = iscsiDevPaths[0]
 	} else {
 		return ""
 	}
 
-	if err := waitForDevicePathToExist(path); err != nil {
+	if err := waitForDevicePathToExist(path, DeviceWaitTimeout); err != nil {
 		log.Errorf("Can't find device path [%s],: %v", path, err)
 		return ""
 	}
@@ -159,27 +169,27 @@ func createTargetMountPath(mounter mount.Interface, mountPath string, isBlock bo
 	return notMount, nil
 }
 
-func (ns *nodeServer) getPortals(dsmIp string) []string {
+func (ns *nodeServer) getPortals(ctx context.Context, dsmIp string) []string {
 	portals := []string{}
 
 	dsm, err := ns.dsmService.GetDsm(dsmIp)
 	if err != nil {
-		log.Errorf("Failed to get DSM[%s]", dsmIp)
+		log.WithContext(ctx).Errorf("Failed to get DSM[%s]", dsmIp)
 		return portals
 	}
 
 	ips, err := utils.LookupIPv4(dsmIp)
 	if err != nil {
-		log.Error(err)
+		log.WithContext(ctx).Error(err)
 		portals = append(portals, fmt.Sprintf("%s:%d", dsmIp, ISCSIPort))
 	} else {
 		portals = append(portals, fmt.Sprintf("%s:%d", ips[0], ISCSIPort)) //get the first ip
 	}
 
-	if dsm.IsUC() && ns.tools.IsMultipathEnabled() {
-		dsm2, err := dsm.GetAnotherController()
+	if dsm.IsUC(ctx) && ns.tools.IsMultipathEnabled() {
+		dsm2, err := dsm.GetAnotherController(ctx)
 		if err != nil {
-			log.Errorf("[%s] UC failed to get another controller: %v", err)
+			log.WithContext(ctx).Errorf("[%s] UC failed to get another controller: %v", dsm.Ip, err)
 		} else {
 			portals = append(portals, fmt.Sprintf("%s:%d", dsm2.Ip, ISCSIPort))
 		}
@@ -187,31 +197,71 @@ func (ns *nodeServer) getPortals(dsmIp string) []string {
 	return portals
 }
 
-func (ns *nodeServer) loginTarget(volumeId string) ([]string, error) {
-	paths := []string{}
-	k8sVolume := ns.dsmService.GetVolume(volumeId)
+// loginTarget logs into the target of an iSCSI volume and returns where its device is
+func (ns *nodeServer) loginTarget(ctx context.Context, volumeId string, chap *models.ChapCredentials) (stagedVolume, error) {
+	k8sVolume := ns.dsmService.GetVolume(ctx, volumeId)
 
 	if k8sVolume == nil {
-		return nil, status.Error(codes.NotFound, fmt.Sprintf("Volume[%s] is not found", volumeId))
+		return stagedVolume{}, status.Error(codes.NotFound, fmt.Sprintf("Volume[%s] is not found", volumeId))
+	}
+
+	var paths []string
+	err := ns.sessions.acquire(k8sVolume.Target.Iqn, volumeId, func() error {
+		var err error
+		paths, err = ns.loginPortals(ctx, k8sVolume, chap)
+		return err
+	})
+	if err != nil {
+		return stagedVolume{}, err
 	}
 
-	portals := ns.getPortals(k8sVolume.DsmIp)
+	volumeMountPath := ns.tools.getVolumeMountPath(paths)
+	if volumeMountPath == "" {
+		return stagedVolume{}, status.Error(codes.Internal, "Can't get volume mount path")
+	}
+
+	return stagedVolume{
+		DsmIp:        k8sVolume.DsmIp,
+		TargetIqn:    k8sVolume.Target.Iqn,
+		MappingIndex: k8sVolume.LunMappingIndex(),
+		DevicePath:   volumeMountPath,
+	}, nil
+}
+
+func (ns *nodeServer) loginPortals(ctx context.Context, k8sVolume *models.K8sVolumeRespSpec, chap *models.ChapCredentials) ([]string, error) {
+	paths := []string{}
+
+	portals := ns.getPortals(ctx, k8sVolume.DsmIp)
 	if len(portals) == 0 {
 		return nil, status.Errorf(codes.Internal, fmt.Sprintf("Failed to get portals"))
 	}
 
-	// Assume target and lun 1-1 mapping
-	mappingIndex := k8sVolume.Target.MappedLuns[0].MappingIndex
+	mappingIndex := k8sVolume.LunMappingIndex()
 	for _, portal := range portals {
-		if err := ns.Initiator.login(k8sVolume.Target.Iqn, portal); err != nil {
-			return nil, status.Errorf(codes.Internal,
-				fmt.Sprintf("Failed to login with target iqn [%s], err: %v", k8sVolume.Target.Iqn, err))
+		if err := ns.Initiator.login(k8sVolume.Target.Iqn, portal, chap); err != nil {
+			return nil, execError(err, "Failed to login with target iqn [%s]", k8sVolume.Target.Iqn)
+		}
+
+		path, err := ns.waitForLunDevice(portal, k8sVolume.Target.Iqn, mappingIndex)
+		if err != nil {
+			log.WithContext(ctx).Errorf("Can't find device of portal [%s]: %v", portal, err)
+			return nil, err
+		}
+
+		paths = append(paths, path)
+	}
+
+	// the other portals of the target only add redundancy, a failed one is skipped
+	for _, portal := range ns.discoverPortals(k8sVolume.Target.Iqn, portals) {
+		if err := ns.Initiator.login(k8sVolume.Target.Iqn, portal, chap); err != nil {
+			log.WithContext(ctx).Warnf("Skipping portal [%s] of target iqn [%s]: %v", portal, k8sVolume.Target.Iqn, err)
+			continue
 		}
 
-		path := fmt.Sprintf("%sip-%s-iscsi-%s-lun-%d", "/dev/disk/by-path/", portal, k8sVolume.Target.Iqn, mappingIndex)
-		if err := waitForDevicePathToExist(path); err != nil {
-			log.Errorf("Can't find device path [%s]: %v", path, err)
-			return nil, status.Errorf(codes.Internal, fmt.Sprintf("Can't find device path [%s]: %v", path, err))
+		path, err := ns.waitForLunDevice(portal, k8sVolume.Target.Iqn, mappingIndex)
+		if err != nil {
+			log.WithContext(ctx).Warnf("Skipping portal [%s], can't find its device: %v", portal, err)
+			continue
 		}
 
 		paths = append(paths, path)
@@ -220,24 +270,56 @@ func (ns *nodeServer) loginTarget(volumeId string) ([]string, error) {
 	return paths, nil
 }
 
-func (ns *nodeServer) logoutTarget(volumeId string) {
-	k8sVolume := ns.dsmService.GetVolume(volumeId)
+// discoverPortals returns the portals of the target other than the known ones,
+// if logging into all portals for multipath is enabled
+func (ns *nodeServer) discoverPortals(targetIqn string, known []string) []string {
+	if !MultipathAllPortals || len(known) == 0 || !ns.tools.IsMultipathEnabled() {
+		return nil
+	}
 
-	if k8sVolume == nil || k8sVolume.Protocol != utils.ProtocolIscsi {
-		return
+	out, err := ns.tools.iscsiadm_discovery(known[0])
+	if err != nil {
+		log.Warnf("Failed to discover portals of target iqn [%s]: %v", targetIqn, err)
+		return nil
 	}
 
-	// Assume target and lun 1-1 mapping
-	mappingIndex := k8sVolume.Target.MappedLuns[0].MappingIndex
-	volumeMountPath := ns.tools.getExistedVolumeMountPath(k8sVolume.Target.Iqn, mappingIndex)
+	var portals []string
+	for _, portal := range parseDiscoveredPortals(out, targetIqn) {
+		if !utils.SliceContains(known, portal) {
+			portals = append(portals, portal)
+		}
+	}
+	return portals
+}
 
-	if strings.Contains(volumeMountPath, "/dev/mapper") && ns.tools.IsMultipathEnabled() {
-		if err := ns.tools.multipath_flush(volumeMountPath); err != nil {
-			log.Errorf("Failed to remove multipath device in path %s. err: %v", volumeMountPath, err)
+func (ns *nodeServer) logoutTarget(ctx context.Context, volumeId string) {
+	staged, ok := ns.state.get(volumeId)
+	if !ok {
+		// staged before the state was recorded, or the state was lost
+		k8sVolume := ns.dsmService.GetVolume(ctx, volumeId)
+		if k8sVolume == nil || k8sVolume.Protocol != utils.ProtocolIscsi || len(k8sVolume.Target.MappedLuns) == 0 {
+			return
+		}
+		staged = stagedVolume{
+			DsmIp:        k8sVolume.DsmIp,
+			TargetIqn:    k8sVolume.Target.Iqn,
+			MappingIndex: k8sVolume.LunMappingIndex(),
 		}
 	}
 
-	ns.Initiator.logout(k8sVolume.Target.Iqn, k8sVolume.DsmIp)
+	ns.sessions.release(staged.TargetIqn, volumeId, func() {
+		volumeMountPath := ns.tools.getExistedVolumeMountPath(staged.TargetIqn, staged.MappingIndex)
+
+		if strings.Contains(volumeMountPath, "/dev/mapper") && ns.tools.IsMultipathEnabled() {
+			if err := ns.tools.multipath_flush(volumeMountPath); err != nil {
+				log.WithContext(ctx).Errorf("Failed to remove multipath device in path %s. err: %v", volumeMountPath, err)
+			}
+		}
+
+		ns.Initiator.logout(staged.TargetIqn, staged.DsmIp)
+		ns.devices.forget(staged.TargetIqn)
+	})
+	ns.state.remove(volumeId)
 }
 
 func checkGidPresentInMountFlags(volumeMountGroup string, mountFlags []string) (bool, error) {
@@ -286,7 +368,7 @@ func getNodeAddress(ctx context.Context, client clientset.Interface) ([]string,
 	ips := []string{}
 	nodes, err := client.CoreV1().Nodes().List(ctx, metav1.ListOptions{})
 	if err != nil {
-		log.Errorf("Failed to list nodes, err: %v", err)
+		log.WithContext(ctx).Errorf("Failed to list nodes, err: %v", err)
 		return nil, err
 	}
 
@@ -304,7 +386,7 @@ func getNodeAddress(ctx context.Context, client clientset.Interface) ([]string,
 	return ips, nil
 }
 
-func (ns *nodeServer) setNFSVolumePrivilege(sourcePath string, hostnames []string, authType utils.AuthType) error {
+func (ns *nodeServer) setNFSVolumePrivilege(ctx context.Context, sourcePath string, rules []webapi.PrivilegeRule) error {
 	// NFSTODO: fix the parsing rule
 	s := strings.Split(strings.TrimPrefix(sourcePath, "//"), "/")
 	if len(s) != 2 {
@@ -319,26 +401,10 @@ func (ns *nodeServer) setNFSVolumePrivilege(sourcePath string, hostnames []strin
 
 	priv := webapi.SharePrivilege{
 		ShareName: shareName,
+		Rule:      rules,
 	}
 
-	for _, hostname := range hostnames {
-		priv.Rule = append(priv.Rule, webapi.PrivilegeRule{
-			Async:      true,
-			Client:     hostname,
-			Crossmnt:   true,
-			Insecure:   true,
-			Privilege:  string(authType),
-			RootSquash: "root",
-			SecurityFlavor: webapi.SecurityFlavor{
-				Kerbros:          false,
-				KerbrosIntegrity: false,
-				KerbrosPrivacy:   false,
-				Sys:              true,
-			},
-		})
-	}
-
-	err = dsm.ShareNfsPrivilegeSave(priv)
+	err = dsm.ShareNfsPrivilegeSave(ctx, priv)
 	if err != nil {
 		log.Printf("Failed to save share NFS privilege. Priv:%v. %v", priv, err)
 		return err
@@ -346,7 +412,7 @@ func (ns *nodeServer) setNFSVolumePrivilege(sourcePath string, hostnames []strin
 	return nil
 }
 
-func (ns *nodeServer) setSMBVolumePermission(sourcePath string, userName string, authType utils.AuthType) error {
+func (ns *nodeServer) setSMBVolumePermission(ctx context.Context, sourcePath string, userName string, authType utils.AuthType) error {
 	s := strings.Split(strings.TrimPrefix(sourcePath, "//"), "/")
 	if len(s) != 2 {
 		return fmt.Errorf("Failed to parse dsmIp and shareName from source path")
@@ -379,7 +445,7 @@ func (ns *nodeServer) setSMBVolumePermission(sourcePath string, userName string,
 		Permissions:   permissions,
 	}
 
-	return dsm.SharePermissionSet(spec)
+	return dsm.SharePermissionSet(ctx, spec)
 }
 
 func (ns *nodeServer) nodeStageISCSIVolume(ctx context.Context, spec *models.NodeStageVolumeSpec) (*csi.NodeStageVolumeResponse, error) {
@@ -388,37 +454,87 @@ func (ns *nodeServer) nodeStageISCSIVolume(ctx context.Context, spec *models.Nod
 		return &csi.NodeStageVolumeResponse{}, nil
 	}
 
-	iscsiDevPaths, err := ns.loginTarget(spec.VolumeId)
+	fsType := spec.FsType
+	if fsType == "" {
+		fsType = spec.VolumeCapability.GetMount().GetFsType()
+	}
+	fsType, err := parseFsType(fsType)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
-
-	volumeMountPath := getVolumeMountPath(iscsiDevPaths)
-	if volumeMountPath == "" {
-		return nil, status.Error(codes.Internal, "Can't get volume mount path")
+	formatOptions, err := parseFormatOptions(spec.FormatOptions)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	fsckMode := DefaultFsckMode
+	if spec.FsckMode != "" {
+		if fsckMode, err = ParseFsckMode(spec.FsckMode); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
 	}
 
-	notMount, err := ns.Mounter.Interface.IsLikelyNotMountPoint(spec.StagingTargetPath)
+	staged, err := ns.loginTarget(ctx, spec.VolumeId, spec.Chap)
 	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+		return nil, err
 	}
+	staged.MountPath = spec.StagingTargetPath
+	staged.Trim = spec.SpaceReclamation && !spec.Discard
+	ns.state.put(spec.VolumeId, staged)
+	volumeMountPath := staged.DevicePath
 
-	if !notMount {
+	alreadyStaged, err := checkStagedMount(spec.StagingTargetPath, volumeMountPath, fsType)
+	if err != nil {
+		return nil, err
+	}
+	if alreadyStaged {
+		log.WithContext(ctx).Infof("NodeStageVolume: %s is already mounted at %s", volumeMountPath, spec.StagingTargetPath)
 		return &csi.NodeStageVolumeResponse{}, nil
 	}
 
-	fsType := spec.VolumeCapability.GetMount().GetFsType()
-	options := append([]string{"rw"}, spec.VolumeCapability.GetMount().GetMountFlags()...)
-
-	formatOptions := utils.StringToSlice(spec.FormatOptions)
+	options := append([]string{"rw"}, withoutMountPropagation(spec.VolumeCapability.GetMount().GetMountFlags())...)
+	options = withDiscard(options, spec.Discard)
 
-	if err = ns.Mounter.FormatAndMountSensitiveWithFormatOptions(volumeMountPath, spec.StagingTargetPath, fsType, options, nil, formatOptions); err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+	if err = ns.formatAndMount(volumeMountPath, spec.StagingTargetPath, fsType, options, formatOptions, fsckMode); err != nil {
+		return nil, err
 	}
 
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
+// formatAndMount formats devPath if it has no filesystem yet, and mounts it at targetPath.
+// A device already formatted with another filesystem is never reformatted, one formatted
+// with fsType is checked first as fsckMode tells.
+func (ns *nodeServer) formatAndMount(devPath string, targetPath string, fsType string, options []string, formatOptions []string, fsckMode FsckMode) error {
+	readOnly := utils.SliceContains(options, "ro")
+
+	existingFsType, err := ns.tools.blkid_fstype(devPath)
+	if err != nil {
+		return execError(err, "Failed to get filesystem type of %s", devPath)
+	}
+
+	switch {
+	case existingFsType == "":
+		if readOnly {
+			return status.Error(codes.FailedPrecondition, fmt.Sprintf("Can't format %s when mounting read-only", devPath))
+		}
+		if err := ns.tools.formatDevice(devPath, fsType, formatOptions); err != nil {
+			return execError(err, "Failed to format %s", devPath)
+		}
+	case existingFsType != fsType:
+		return status.Error(codes.FailedPrecondition,
+			fmt.Sprintf("Device %s is already formatted as %s, refusing to use it as %s", devPath, existingFsType, fsType))
+	case !readOnly:
+		if err := ns.tools.checkFilesystem(devPath, fsType, fsckMode); err != nil {
+			return execError(err, "Failed to check the filesystem of %s", devPath)
+		}
+	}
+
+	if err := ns.Mounter.Interface.Mount(devPath, targetPath, fsType, append(options, "defaults")); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
 func (ns *nodeServer) nodeStageSMBVolume(ctx context.Context, spec *models.NodeStageVolumeSpec, secrets map[string]string) (*csi.NodeStageVolumeResponse, error) {
 	if spec.VolumeCapability.GetBlock() != nil {
 		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("SMB protocol only allows 'mount' access type"))
@@ -437,7 +553,7 @@ func (ns *nodeServer) nodeStageSMBVolume(ctx context.Context, spec *models.NodeS
 	domain := strings.TrimSpace(secrets["domain"])
 
 	// set permission to access the share
-	if err := ns.setSMBVolumePermission(spec.Source, username, utils.AuthTypeReadWrite); err != nil {
+	if err := ns.setSMBVolumePermission(ctx, spec.Source, username, utils.AuthTypeReadWrite); err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("Failed to set permission, source: %s, err: %v", spec.Source, err))
 	}
 
@@ -448,27 +564,22 @@ func (ns *nodeServer) nodeStageSMBVolume(ctx context.Context, spec *models.NodeS
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 	if !notMount {
-		log.Infof("NodeStageVolume: %s is already mounted", targetPath)
+		log.WithContext(ctx).Infof("NodeStageVolume: %s is already mounted", targetPath)
 		return &csi.NodeStageVolumeResponse{}, nil // already mount
 	}
 
 	fsType := "cifs"
-	options := spec.VolumeCapability.GetMount().GetMountFlags()
-
-	volumeMountGroup := spec.VolumeCapability.GetMount().GetVolumeMountGroup()
-	gidPresent, err := checkGidPresentInMountFlags(volumeMountGroup, options)
+	credentialsPath := smbCredentialsPath(spec.VolumeId)
+	options, err := smbMountOptions(spec.VolumeCapability.GetMount(), credentialsPath)
 	if err != nil {
 		return nil, err
 	}
-	if !gidPresent && volumeMountGroup != "" {
-		options = append(options, fmt.Sprintf("gid=%s", volumeMountGroup))
-	}
 
-	if domain != "" {
-		options = append(options, fmt.Sprintf("%s=%s", "domain", domain))
+	if err := writeSMBCredentials(credentialsPath, username, password, domain); err != nil {
+		return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Failed to write SMB credentials, err: %v", err))
 	}
-	var sensitiveOptions = []string{fmt.Sprintf("%s=%s,%s=%s", "username", username, "password", password)}
-	if err := ns.mountSensitiveWithRetry(spec.Source, targetPath, fsType, options, sensitiveOptions); err != nil {
+	if err := ns.mountSensitiveWithRetry(spec.Source, targetPath, fsType, options, nil); err != nil {
+		removeSMBCredentials(spec.VolumeId)
 		return nil, status.Error(codes.Internal,
 			fmt.Sprintf("Volume[%s] failed to mount %q on %q. err: %v", spec.VolumeId, spec.Source, targetPath, err))
 	}
@@ -476,12 +587,15 @@ func (ns *nodeServer) nodeStageSMBVolume(ctx context.Context, spec *models.NodeS
 }
 
 func (ns *nodeServer) nodeStageNFSVolume(ctx context.Context, spec *models.NodeStageVolumeSpec) (*csi.NodeStageVolumeResponse, error) {
-	nodeIps, err := getNodeAddress(ctx, ns.Client)
-	if err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("Failed to get node IPs for NFS privilege setting, err: %v", err))
+	var nodeIps []string
+	if spec.NfsExport == nil || len(spec.NfsExport.Clients) == 0 {
+		var err error
+		if nodeIps, err = getNodeAddress(ctx, ns.Client); err != nil {
+			return nil, status.Error(codes.Internal, fmt.Sprintf("Failed to get node IPs for NFS privilege setting, err: %v", err))
+		}
 	}
 
-	if err := ns.setNFSVolumePrivilege(spec.Source, nodeIps, utils.AuthTypeReadWrite); err != nil {
+	if err := ns.setNFSVolumePrivilege(ctx, spec.Source, spec.NfsExport.PrivilegeRules(nodeIps)); err != nil {
 		return nil, status.Error(codes.Internal, fmt.Sprintf("Failed to set NFS privilege rule, source: %s, err: %v", spec.Source, err))
 	}
 	return &csi.NodeStageVolumeResponse{}, nil
@@ -500,6 +614,10 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 		return nil, status.Error(codes.InvalidArgument, "Cannot mix block and mount capabilities")
 	}
 
+	if err := validateAccessModeForProtocol(req.VolumeContext["protocol"], volumeCapability); err != nil {
+		return nil, err
+	}
+
 	spec := &models.NodeStageVolumeSpec{
 		VolumeId:          volumeId,
 		StagingTargetPath: stagingTargetPath,
@@ -507,18 +625,47 @@ func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVol
 		Dsm:               req.VolumeContext["dsm"],
 		Source:            req.VolumeContext["source"], // filled by CreateVolume response
 		FormatOptions:     req.VolumeContext["formatOptions"],
+		FsType:            req.VolumeContext["fsType"],
+		FsckMode:          req.VolumeContext["fsckMode"],
+		SpaceReclamation:  req.VolumeContext["enableSpaceReclamation"] == "true",
+		Discard:           req.VolumeContext["discard"] == "true",
+	}
+
+	if req.VolumeContext["enableChap"] == "true" {
+		chap, err := parseChapSecrets(req.GetSecrets())
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		spec.Chap = chap
+	}
+
+	if req.VolumeContext[shareEncryptionParam] == "true" {
+		if err := ns.checkShareUnlocked(ctx, spec.Source); err != nil {
+			return nil, err
+		}
 	}
 
 	switch req.VolumeContext["protocol"] {
 	case utils.ProtocolSmb:
 		return ns.nodeStageSMBVolume(ctx, spec, req.GetSecrets())
 	case utils.ProtocolNfs:
+		nfsExport, err := parseNfsExportOptions(req.VolumeContext)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		spec.NfsExport = nfsExport
 		return ns.nodeStageNFSVolume(ctx, spec)
 	default:
 		return ns.nodeStageISCSIVolume(ctx, spec)
 	}
 }
 
+// isCorruptedMount tells if path is a mount point whose device or server is gone
+func isCorruptedMount(path string) bool {
+	_, err := statPath(path)
+	return mount.IsCorruptedMnt(err)
+}
+
 func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
 	volumeID, stagingTargetPath := req.GetVolumeId(), req.GetStagingTargetPath()
 
@@ -529,18 +676,28 @@ func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstag
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
 
-	notMount, err := mount.IsNotMountPoint(ns.Mounter.Interface, stagingTargetPath)
-	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
+	// the mount outlives its device if the session was lost, e.g. in a node reboot
+	notMount := false
+	if !isCorruptedMount(stagingTargetPath) {
+		var err error
+		notMount, err = mount.IsNotMountPoint(ns.Mounter.Interface, stagingTargetPath)
+		if os.IsNotExist(err) {
+			// removed by a previous unstage or a node reboot, the session may still be left
+			notMount = true
+		} else if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	} else {
+		log.WithContext(ctx).Warnf("The device of staging path %s is gone, unmounting it.", stagingTargetPath)
 	}
 	if !notMount {
-		err = ns.Mounter.Interface.Unmount(stagingTargetPath)
-		if err != nil {
-			return nil, status.Error(codes.Internal, err.Error())
+		if err := ns.unmountStaging(ctx, stagingTargetPath); err != nil {
+			return nil, status.Errorf(codes.Internal, "Failed to unmount staging path %s: %v", stagingTargetPath, err)
 		}
 	}
 
-	ns.logoutTarget(volumeID)
+	ns.logoutTarget(ctx, volumeID)
+	removeSMBCredentials(volumeID)
 
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
@@ -557,18 +714,40 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 		return nil, status.Error(codes.InvalidArgument, "Volume capability missing in request")
 	}
 
+	if err := validateAccessModeForProtocol(req.VolumeContext["protocol"], req.GetVolumeCapability()); err != nil {
+		return nil, err
+	}
+
 	isBlock := req.GetVolumeCapability().GetBlock() != nil // raw block, only for iscsi protocol
 	fsType := req.GetVolumeCapability().GetMount().GetFsType()
+	readonly := isReadOnlyPublish(req.GetVolumeCapability(), req.GetReadonly())
 	options := []string{}
-	if req.GetReadonly() {
+	if readonly {
 		options = append(options, "ro")
 	}
+	propagation, err := publishMountPropagation(req.GetVolumeCapability(), readonly)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
 
 	// nfs
 	if req.VolumeContext["protocol"] == utils.ProtocolNfs {
-		options = append(options, req.GetVolumeCapability().GetMount().GetMountFlags()...)
+		scOptions, err := parseNfsMountOptions(req.VolumeContext)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		mountFlags := withoutMountPropagation(req.GetVolumeCapability().GetMount().GetMountFlags())
+		if options, err = mergeNfsMountOptions(scOptions, mountFlags); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if readonly {
+			options, _ = mergeNfsMountOptions(options, []string{"ro"})
+		}
+		if propagation != "" {
+			options = append(options, propagation)
+		}
 
-		var server, baseDir string             //NFSTODO: subDir
+		var server, baseDir, subDir string
 		var mountPermissionsUint uint64 = 0750 // default
 		for k, v := range req.GetVolumeContext() {
 			switch k {
@@ -576,6 +755,8 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 				server = v
 			case "baseDir":
 				baseDir = v
+			case subDirContextKey:
+				subDir = v
 			case "mountPermissions":
 				if v != "" {
 					var err error
@@ -587,21 +768,25 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 			}
 		}
 
-		if server == "" || baseDir == "" {
-			return nil, status.Error(codes.InvalidArgument, fmt.Sprintf("Invalid inputs: server(dsm) and baseDir are required."))
+		source, err := nfsMountSource(server, baseDir, subDir)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+
+		if err := ns.recoverStaleMount(volumeId, targetPath); err != nil {
+			return nil, err
 		}
-		source := fmt.Sprintf("%s:%s", server, baseDir)
 
 		notMount, err := createTargetMountPathNFS(ns.Mounter.Interface, targetPath, mountPermissionsUint)
 		if err != nil {
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 		if !notMount {
-			log.Infof("NodePublishVolume: %s is already mounted", targetPath)
+			log.WithContext(ctx).Infof("NodePublishVolume: %s is already mounted", targetPath)
 			return &csi.NodePublishVolumeResponse{}, nil
 		}
 
-		log.Debugf("NodePublishVolume: volumeId(%v) source(%s) targetPath(%s) mountflags(%v)", volumeId, source, targetPath, options)
+		log.WithContext(ctx).Debugf("NodePublishVolume: volumeId(%v) source(%s) targetPath(%s) mountflags(%v)", volumeId, source, targetPath, options)
 		err = ns.Mounter.Mount(source, targetPath, "nfs", options)
 		if err != nil {
 			if os.IsPermission(err) {
@@ -619,7 +804,7 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 			}
 		}
 
-		log.Debugf("NFS volume(%s) mount %s on %s succeeded", volumeId, source, targetPath)
+		log.WithContext(ctx).Debugf("NFS volume(%s) mount %s on %s succeeded", volumeId, source, targetPath)
 		return &csi.NodePublishVolumeResponse{}, nil
 	}
 
@@ -633,6 +818,9 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 	}
 
 	options = append(options, "bind")
+	if propagation != "" {
+		options = append(options, propagation)
+	}
 
 	switch req.VolumeContext["protocol"] {
 	case utils.ProtocolSmb:
@@ -640,22 +828,23 @@ func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublis
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 	default:
-		iscsiDevPaths, err := ns.loginTarget(volumeId)
-		if err != nil {
-			return nil, status.Error(codes.Internal, err.Error())
+		// block volumes skip staging, so they log in here with the node publish secret
+		var chap *models.ChapCredentials
+		if isBlock && req.VolumeContext["enableChap"] == "true" {
+			if chap, err = parseChapSecrets(req.GetSecrets()); err != nil {
+				return nil, status.Error(codes.InvalidArgument, err.Error())
+			}
 		}
 
-		volumeMountPath := getVolumeMountPath(iscsiDevPaths)
-		if volumeMountPath == "" {
-			return nil, status.Error(codes.Internal, "Can't get volume mount path")
+		staged, err := ns.loginTarget(ctx, volumeId, chap)
+		if err != nil {
+			return nil, err
 		}
-
 		if isBlock {
-			err = ns.Mounter.Interface.Mount(volumeMountPath, targetPath, "", options)
-		} else {
-			err = ns.Mounter.Interface.Mount(stagingTargetPath, targetPath, fsType, options)
+			staged.MountPath = targetPath
+			ns.state.put(volumeId, staged)
 		}
-		if err != nil {
+		if err := ns.publishISCSIVolume(staged.DevicePath, stagingTargetPath, targetPath, fsType, options, isBlock, readonly); err != nil {
 			return nil, status.Error(codes.Internal, err.Error())
 		}
 	}
@@ -673,6 +862,13 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 		return nil, status.Error(codes.InvalidArgument, "Target path missing in request")
 	}
 
+	if isStaleMount(targetPath) {
+		// a stale NFS mount can't be inspected, but it can always be unmounted
+		if err := ns.unmountStale(targetPath); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
 	if _, err := os.Stat(targetPath); err != nil {
 		if os.IsNotExist(err) {
 			return &csi.NodeUnpublishVolumeResponse{}, nil
@@ -687,6 +883,12 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 	}
 
 	if notMount {
+		// a raw block target is a file of its own, left behind if the bind mount failed
+		if info, err := os.Stat(targetPath); err == nil && info.Mode().IsRegular() {
+			if err := os.Remove(targetPath); err != nil {
+				return nil, status.Errorf(codes.Internal, "Failed to remove target path.")
+			}
+		}
 		return &csi.NodeUnpublishVolumeResponse{}, nil
 	}
 
@@ -702,10 +904,17 @@ func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpu
 }
 
 func (ns *nodeServer) NodeGetInfo(ctx context.Context, req *csi.NodeGetInfoRequest) (*csi.NodeGetInfoResponse, error) {
-	log.Debugf("Using default NodeGetInfo, ns.Driver.nodeID = [%s]", ns.Driver.nodeID)
+	log.WithContext(ctx).Debugf("Using default NodeGetInfo, ns.Driver.nodeID = [%s]", ns.Driver.nodeID)
+
+	var accessibleTopology *csi.Topology
+	if topology := siteTopology(NodeSite); topology != nil {
+		accessibleTopology = topology[0]
+	}
 
 	return &csi.NodeGetInfoResponse{
-		NodeId: ns.Driver.nodeID,
+		NodeId:             nodeIdWithIqn(ns.Driver.nodeID, InitiatorName),
+		MaxVolumesPerNode:  maxVolumesPerNode(),
+		AccessibleTopology: accessibleTopology,
 	}, nil
 }
 
@@ -721,7 +930,7 @@ func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVo
 		return nil, status.Error(codes.InvalidArgument, "Invalid Argument")
 	}
 
-	k8sVolume := ns.dsmService.GetVolume(volumeId)
+	k8sVolume := ns.dsmService.GetVolume(ctx, volumeId)
 	if k8sVolume == nil {
 		return nil, status.Error(codes.NotFound,
 			fmt.Sprintf("Volume[%s] is not found", volumeId))
@@ -733,7 +942,8 @@ func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVo
 			fmt.Sprintf("Volume[%s] does not exist on the %s", volumeId, volumePath))
 	}
 
-	if k8sVolume.Protocol == utils.ProtocolSmb || k8sVolume.Protocol == utils.ProtocolNfs {
+	// Shares and raw block volumes have no filesystem of their own to inspect
+	if k8sVolume.Protocol == utils.ProtocolSmb || k8sVolume.Protocol == utils.ProtocolNfs || isBlockDevice(volumePath) {
 		return &csi.NodeGetVolumeStatsResponse{
 			Usage: []*csi.VolumeUsage{
 				&csi.VolumeUsage{
@@ -745,11 +955,31 @@ func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVo
 	}
 
 	// If we are dealing with a LUN use statfs
-	statfs := &unix.Statfs_t{}
-	err = unix.Statfs(volumePath, statfs)
+	usage, err := getFsVolumeUsage(volumePath)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to get fs info on path %s: %v", req.VolumePath, err)
 	}
+	ns.warnInodePressure(ctx, volumeId, volumePath, usage)
+
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage: usage,
+	}, nil
+}
+
+func isBlockDevice(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeDevice != 0
+}
+
+// getFsVolumeUsage reports the byte and inode usage of the filesystem at path
+func getFsVolumeUsage(path string) ([]*csi.VolumeUsage, error) {
+	statfs := &unix.Statfs_t{}
+	if err := unix.Statfs(path, statfs); err != nil {
+		return nil, err
+	}
 
 	// Available is blocks available * fragment size
 	available := int64(statfs.Bavail) * int64(statfs.Bsize)
@@ -764,32 +994,38 @@ func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVo
 	inodesFree := int64(statfs.Ffree)
 	inodesUsed := inodes - inodesFree
 
-	return &csi.NodeGetVolumeStatsResponse{
-		Usage: []*csi.VolumeUsage{
-			{
-				Unit:      csi.VolumeUsage_BYTES,
-				Available: available,
-				Total:     capacity,
-				Used:      usage,
-			},
-			{
-				Unit:      csi.VolumeUsage_INODES,
-				Available: inodesFree,
-				Total:     inodes,
-				Used:      inodesUsed,
-			},
+	return []*csi.VolumeUsage{
+		{
+			Unit:      csi.VolumeUsage_BYTES,
+			Available: available,
+			Total:     capacity,
+			Used:      usage,
+		},
+		{
+			Unit:      csi.VolumeUsage_INODES,
+			Available: inodesFree,
+			Total:     inodes,
+			Used:      inodesUsed,
 		},
 	}, nil
 }
 
 func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
+	if !ns.Driver.features.Expand {
+		return nil, status.Error(codes.Unimplemented, "")
+	}
+
 	volumeId, volumePath := req.GetVolumeId(), req.GetVolumePath()
 	sizeInByte, err := getSizeByCapacityRange(req.GetCapacityRange())
 	if volumeId == "" || volumePath == "" {
 		return nil, status.Error(codes.InvalidArgument, "InvalidArgument: Please check volume ID and volume path.")
 	}
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument,
+			"InvalidArgument: Please check CapacityRange[%v]", req.GetCapacityRange())
+	}
 
-	k8sVolume := ns.dsmService.GetVolume(volumeId)
+	k8sVolume := ns.dsmService.GetVolume(ctx, volumeId)
 	if k8sVolume == nil {
 		return nil, status.Error(codes.NotFound, fmt.Sprintf("Volume[%s] is not found", volumeId))
 	}
@@ -800,11 +1036,10 @@ func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandV
 	}
 
 	if err := ns.Initiator.rescan(k8sVolume.Target.Iqn); err != nil {
-		return nil, status.Error(codes.Internal, fmt.Sprintf("Failed to rescan. err: %v", err))
+		return nil, execError(err, "Failed to rescan")
 	}
 
-	// Assume target and lun 1-1 mapping
-	mappingIndex := k8sVolume.Target.MappedLuns[0].MappingIndex
+	mappingIndex := k8sVolume.LunMappingIndex()
 	volumeMountPath := ns.tools.getExistedVolumeMountPath(k8sVolume.Target.Iqn, mappingIndex)
 	if volumeMountPath == "" {
 		return nil, status.Error(codes.Internal, "Can't get volume mount path")
@@ -812,7 +1047,7 @@ func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandV
 
 	if strings.Contains(volumeMountPath, "/dev/mapper") && ns.tools.IsMultipathEnabled() {
 		if err := ns.tools.multipath_resize(filepath.Base(volumeMountPath)); err != nil {
-			return nil, status.Error(codes.Internal, fmt.Sprintf("Failed to resize multipath device in %s. err: %v", volumeMountPath, err))
+			return nil, execError(err, "Failed to resize multipath device in %s", volumeMountPath)
 		}
 	}
 
@@ -822,12 +1057,8 @@ func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandV
 			CapacityBytes: sizeInByte}, nil
 	}
 
-	ok, err := mount.NewResizeFs(ns.Mounter.Exec).Resize(volumeMountPath, volumePath)
-	if err != nil {
-		return nil, status.Error(codes.Internal, err.Error())
-	}
-	if !ok {
-		return nil, status.Error(codes.Internal, "Failed to expand volume filesystem")
+	if err := ns.tools.resizeFs(volumeMountPath, volumePath); err != nil {
+		return nil, execError(err, "Failed to expand volume filesystem")
 	}
 	return &csi.NodeExpandVolumeResponse{
 		CapacityBytes: sizeInByte}, nil
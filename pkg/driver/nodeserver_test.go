@@ -0,0 +1,239 @@
+package driver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/mount-utils"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils/hostexec"
+)
+
+func TestGetFsVolumeUsage(t *testing.T) {
+	dir := t.TempDir()
+
+	usage, err := getFsVolumeUsage(dir)
+	if err != nil {
+		t.Fatalf("getFsVolumeUsage() error = %v", err)
+	}
+	if len(usage) != 2 {
+		t.Fatalf("getFsVolumeUsage() returned %d entries, want 2", len(usage))
+	}
+
+	var statfs unix.Statfs_t
+	if err := unix.Statfs(dir, &statfs); err != nil {
+		t.Fatalf("Statfs() error = %v", err)
+	}
+
+	bytes, inodes := usage[0], usage[1]
+	if bytes.Unit != csi.VolumeUsage_BYTES || inodes.Unit != csi.VolumeUsage_INODES {
+		t.Errorf("getFsVolumeUsage() units = %v, %v", bytes.Unit, inodes.Unit)
+	}
+	if want := int64(statfs.Blocks) * int64(statfs.Bsize); bytes.Total != want {
+		t.Errorf("bytes total = %d, want %d", bytes.Total, want)
+	}
+	if bytes.Used < 0 || bytes.Available > bytes.Total || bytes.Used > bytes.Total {
+		t.Errorf("bytes usage inconsistent: %+v", bytes)
+	}
+	if want := int64(statfs.Files); inodes.Total != want {
+		t.Errorf("inodes total = %d, want %d", inodes.Total, want)
+	}
+	if inodes.Used+inodes.Available != inodes.Total {
+		t.Errorf("inodes used + available = %d, want %d", inodes.Used+inodes.Available, inodes.Total)
+	}
+
+	if isBlockDevice(dir) {
+		t.Errorf("isBlockDevice(%s) = true, want false", dir)
+	}
+	if _, err := getFsVolumeUsage(dir + "/missing"); err == nil {
+		t.Errorf("getFsVolumeUsage() on missing path expected error")
+	}
+}
+
+func TestNodeStageVolume_block(t *testing.T) {
+	fake := hostexec.NewFake(nil, "/host")
+	mounter := mount.NewFakeMounter(nil)
+	ns := &nodeServer{
+		Mounter: &mount.SafeFormatAndMount{Interface: mounter},
+		tools:   NewTools(fake),
+	}
+
+	_, err := ns.NodeStageVolume(context.Background(), &csi.NodeStageVolumeRequest{
+		VolumeId:          "vol-1",
+		StagingTargetPath: t.TempDir(),
+		VolumeCapability: &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+			AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+		},
+		VolumeContext: map[string]string{"protocol": "iscsi"},
+	})
+	if err != nil {
+		t.Fatalf("NodeStageVolume() error = %v", err)
+	}
+	// raw block volumes are neither formatted nor mounted on the staging path
+	assertInvocations(t, fake, nil)
+	if log := mounter.GetLog(); len(log) != 0 {
+		t.Errorf("NodeStageVolume() mount log = %v, want none", log)
+	}
+}
+
+func TestCreateTargetMountPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		isBlock bool
+	}{
+		{name: "block", isBlock: true},
+		{name: "filesystem", isBlock: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targetPath := filepath.Join(t.TempDir(), "target")
+
+			notMount, err := createTargetMountPath(mount.NewFakeMounter(nil), targetPath, tt.isBlock)
+			if err != nil || !notMount {
+				t.Fatalf("createTargetMountPath() = %v, %v, want true, nil", notMount, err)
+			}
+			info, err := os.Stat(targetPath)
+			if err != nil {
+				t.Fatalf("Stat() error = %v", err)
+			}
+			if info.IsDir() == tt.isBlock {
+				t.Errorf("target path is a directory = %v, want %v", info.IsDir(), !tt.isBlock)
+			}
+		})
+	}
+}
+
+func TestNodeUnpublishVolume(t *testing.T) {
+	tests := []struct {
+		name       string
+		isBlock    bool
+		mounted    bool
+		wantRemove bool
+	}{
+		{name: "block", isBlock: true, mounted: true, wantRemove: true},
+		{name: "filesystem", isBlock: false, mounted: true, wantRemove: true},
+		{name: "block left by a failed publish", isBlock: true, mounted: false, wantRemove: true},
+		{name: "filesystem not mounted", isBlock: false, mounted: false, wantRemove: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targetPath := filepath.Join(t.TempDir(), "target")
+			if _, err := createTargetMountPath(mount.NewFakeMounter(nil), targetPath, tt.isBlock); err != nil {
+				t.Fatalf("createTargetMountPath() error = %v", err)
+			}
+
+			var mountPoints []mount.MountPoint
+			if tt.mounted {
+				mountPoints = []mount.MountPoint{{Device: "/dev/sdb", Path: targetPath}}
+			}
+			mounter := mount.NewFakeMounter(mountPoints)
+			ns := &nodeServer{Mounter: &mount.SafeFormatAndMount{Interface: mounter}}
+
+			_, err := ns.NodeUnpublishVolume(context.Background(), &csi.NodeUnpublishVolumeRequest{
+				VolumeId:   "vol-1",
+				TargetPath: targetPath,
+			})
+			if err != nil {
+				t.Fatalf("NodeUnpublishVolume() error = %v", err)
+			}
+
+			if unmounted := len(mounter.GetLog()) == 1; unmounted != tt.mounted {
+				t.Errorf("NodeUnpublishVolume() mount log = %v", mounter.GetLog())
+			}
+			_, err = os.Stat(targetPath)
+			if removed := os.IsNotExist(err); removed != tt.wantRemove {
+				t.Errorf("target path removed = %v, want %v", removed, tt.wantRemove)
+			}
+		})
+	}
+}
+
+func TestNodeUnstageVolume(t *testing.T) {
+	defer func(stat func(string) (os.FileInfo, error)) { statPath = stat }(statPath)
+	defer func(delay time.Duration) { unmountBusyDelay = delay }(unmountBusyDelay)
+	unmountBusyDelay = time.Millisecond
+
+	tests := []struct {
+		name        string
+		mounted     bool
+		missing     bool // the staging path doesn't exist
+		deviceGone  bool
+		unmountErr  error
+		wantCode    codes.Code
+		wantUnmount bool
+	}{
+		{name: "already unmounted", wantCode: codes.OK},
+		{name: "staging path missing", missing: true, wantCode: codes.OK},
+		{name: "mounted", mounted: true, wantCode: codes.OK, wantUnmount: true},
+		{name: "device gone", mounted: true, deviceGone: true, wantCode: codes.OK, wantUnmount: true},
+		{name: "busy", mounted: true, unmountErr: unix.EBUSY, wantCode: codes.Internal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stagingPath := t.TempDir()
+			if tt.missing {
+				stagingPath = filepath.Join(stagingPath, "missing")
+			}
+			statPath = os.Stat
+			if tt.deviceGone {
+				statPath = func(name string) (os.FileInfo, error) {
+					return nil, &os.PathError{Op: "stat", Path: name, Err: unix.EIO}
+				}
+			}
+
+			var mountPoints []mount.MountPoint
+			if tt.mounted {
+				mountPoints = []mount.MountPoint{{Device: "/dev/sdb", Path: stagingPath}}
+			}
+			mounter := mount.NewFakeMounter(mountPoints)
+			mounter.UnmountFunc = func(string) error { return tt.unmountErr }
+
+			// the session was lost along with the device, so there is none to log out of
+			fake := hostexec.NewFake(nil, "/host")
+			tools := NewTools(fake)
+			dataDir := t.TempDir()
+			ns := &nodeServer{
+				Mounter:   &mount.SafeFormatAndMount{Interface: mounter},
+				Initiator: &initiatorDriver{tools: tools},
+				tools:     tools,
+				sessions:  newSessionRefs(filepath.Join(dataDir, "sessions.json")),
+				state:     newNodeState(filepath.Join(dataDir, "volumes.json")),
+			}
+			ns.state.put("vol-1", stagedVolume{DsmIp: "10.0.0.1", TargetIqn: "iqn.2000-01.com.synology:k8s-csi-pvc-1", MountPath: stagingPath})
+
+			_, err := ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+				VolumeId:          "vol-1",
+				StagingTargetPath: stagingPath,
+			})
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("NodeUnstageVolume() code = %v, want %v (err: %v)", code, tt.wantCode, err)
+			}
+
+			unmounted := false
+			for _, action := range mounter.GetLog() {
+				unmounted = unmounted || action.Action == mount.FakeActionUnmount
+			}
+			if unmounted != tt.wantUnmount {
+				t.Errorf("NodeUnstageVolume() mount log = %v, want unmount %v", mounter.GetLog(), tt.wantUnmount)
+			}
+			for _, inv := range fake.Invocations() {
+				for _, arg := range inv.Args {
+					if arg == "--logout" {
+						t.Errorf("NodeUnstageVolume() ran %v without a session", inv)
+					}
+				}
+			}
+			if _, staged := ns.state.get("vol-1"); staged != (err != nil) {
+				t.Errorf("NodeUnstageVolume() left the volume staged = %v", staged)
+			}
+		})
+	}
+}
@@ -0,0 +1,71 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// StateDir holds the state files of the node server, DataDir if it is empty
+var StateDir = ""
+
+// Names of the state files of the node server
+const (
+	sessionsStateFile = "sessions.json"
+	volumesStateFile  = "volumes.json"
+)
+
+// stateFilePath returns where the state file of name is kept
+func stateFilePath(name string) string {
+	dir := StateDir
+	if dir == "" {
+		dir = DataDir
+	}
+	return filepath.Join(dir, name)
+}
+
+// DefaultEndpoint returns the CSI socket in DataDir, for a driver started without endpoint
+func DefaultEndpoint() string {
+	return "unix://" + filepath.Join(DataDir, "csi.sock")
+}
+
+// PrepareDataDirs creates the data and state directories and the one of the socket of a
+// unix endpoint, and checks the driver can write to them, so that a wrong layout fails at
+// startup rather than at the first staged volume
+func PrepareDataDirs(endpoint string) error {
+	dirs := []string{DataDir, filepath.Dir(stateFilePath(sessionsStateFile))}
+	if scheme, addr, err := ParseEndpoint(endpoint); err != nil {
+		return err
+	} else if scheme == "unix" {
+		dirs = append(dirs, filepath.Dir(addr))
+	}
+
+	for _, dir := range dirs {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("Failed to create directory %s: %v", dir, err)
+		}
+		file, err := os.CreateTemp(dir, ".write-test-")
+		if err != nil {
+			return fmt.Errorf("Directory %s isn't writable: %v", dir, err)
+		}
+		file.Close()
+		os.Remove(file.Name())
+	}
+	return nil
+}
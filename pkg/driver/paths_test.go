@@ -0,0 +1,78 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStateFilePath(t *testing.T) {
+	defer func(dataDir, stateDir string) { DataDir, StateDir = dataDir, stateDir }(DataDir, StateDir)
+
+	DataDir, StateDir = "/data", ""
+	if got := stateFilePath(sessionsStateFile); got != "/data/sessions.json" {
+		t.Errorf("stateFilePath() = %s without state dir, want /data/sessions.json", got)
+	}
+	if got := DefaultEndpoint(); got != "unix:///data/csi.sock" {
+		t.Errorf("DefaultEndpoint() = %s, want unix:///data/csi.sock", got)
+	}
+
+	StateDir = "/state"
+	if got := stateFilePath(volumesStateFile); got != "/state/volumes.json" {
+		t.Errorf("stateFilePath() = %s, want /state/volumes.json", got)
+	}
+	if got := DefaultEndpoint(); got != "unix:///data/csi.sock" {
+		t.Errorf("DefaultEndpoint() = %s with state dir, want unix:///data/csi.sock", got)
+	}
+}
+
+func TestPrepareDataDirs(t *testing.T) {
+	defer func(dataDir, stateDir string) { DataDir, StateDir = dataDir, stateDir }(DataDir, StateDir)
+	root := t.TempDir()
+
+	DataDir, StateDir = filepath.Join(root, "data"), filepath.Join(root, "state")
+	socketDir := filepath.Join(root, "sockets")
+	if err := PrepareDataDirs("unix://" + filepath.Join(socketDir, "csi.sock")); err != nil {
+		t.Fatalf("PrepareDataDirs() error = %v", err)
+	}
+	for _, dir := range []string{DataDir, StateDir, socketDir} {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Errorf("%s not created: %v", dir, err)
+		} else if len(entries) != 0 {
+			t.Errorf("%s has %d entries left by the write test", dir, len(entries))
+		}
+	}
+
+	if err := PrepareDataDirs("tcp://127.0.0.1:10000"); err != nil {
+		t.Errorf("PrepareDataDirs() error = %v with a tcp endpoint", err)
+	}
+	if err := PrepareDataDirs("http://127.0.0.1"); err == nil {
+		t.Errorf("PrepareDataDirs() succeeded with an invalid endpoint")
+	}
+
+	file := filepath.Join(root, "file")
+	if err := os.WriteFile(file, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	DataDir, StateDir = filepath.Join(file, "data"), ""
+	if err := PrepareDataDirs(DefaultEndpoint()); err == nil {
+		t.Errorf("PrepareDataDirs() succeeded with a data dir under a file")
+	}
+}
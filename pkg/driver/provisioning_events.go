@@ -0,0 +1,89 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+)
+
+// provisioningEventInterval is the minimum time between two identical provisioning failure
+// events of a PVC. The events in between are dropped, the recorder bumps the count of the
+// event already emitted when it is emitted again.
+const provisioningEventInterval = 10 * time.Minute
+
+const reasonProvisioningFailed = "DsmProvisioningFailed"
+
+// Parameters the external-provisioner passes with --extra-create-metadata
+const (
+	pvcNameParam      = "csi.storage.k8s.io/pvc/name"
+	pvcNamespaceParam = "csi.storage.k8s.io/pvc/namespace"
+)
+
+// terminalProvisioningCodes are the codes of the failures which retrying won't fix without
+// changing the StorageClass, the PVC or DSM, unlike a DSM which is unreachable for a while
+var terminalProvisioningCodes = []codes.Code{
+	codes.InvalidArgument,
+	codes.FailedPrecondition,
+	codes.OutOfRange,
+	codes.ResourceExhausted,
+	codes.AlreadyExists,
+	codes.PermissionDenied,
+	codes.Unimplemented,
+	codes.NotFound,
+}
+
+func isTerminalProvisioningFailure(err error) bool {
+	code := status.Code(err)
+	for _, terminal := range terminalProvisioningCodes {
+		if code == terminal {
+			return true
+		}
+	}
+	return false
+}
+
+// reportProvisioningFailure emits a warning event on the PVC of a volume which failed to
+// be created, unless the failure is worth retrying or the same one was reported lately
+func (cs *controllerServer) reportProvisioningFailure(ctx context.Context, req *csi.CreateVolumeRequest, err error) {
+	if cs.recorder == nil || !isTerminalProvisioningFailure(err) {
+		return
+	}
+	params := req.GetParameters()
+	pvcName, pvcNamespace := params[pvcNameParam], params[pvcNamespaceParam]
+	if pvcName == "" || pvcNamespace == "" {
+		log.WithContext(ctx).Debugf("Volume[%s] has no PVC to report its failure on, is --extra-create-metadata set?", req.GetName())
+		return
+	}
+
+	s := status.Convert(err)
+	key := fmt.Sprintf("%s/%s:%s:%s", pvcNamespace, pvcName, s.Code(), s.Message())
+	if !cs.failureEvents.allow(key) {
+		return
+	}
+
+	ref := &v1.ObjectReference{Kind: "PersistentVolumeClaim", APIVersion: "v1", Namespace: pvcNamespace, Name: pvcName}
+	cs.recorder.Eventf(ref, v1.EventTypeWarning, reasonProvisioningFailed,
+		"Failed to create volume %s (%s): %s", req.GetName(), s.Code(), s.Message())
+}
@@ -0,0 +1,92 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestReportProvisioningFailure(t *testing.T) {
+	now := time.Unix(0, 0)
+	recorder := record.NewFakeRecorder(10)
+	cs := newTestControllerServer(newFakeDsmService())
+	cs.recorder = recorder
+	cs.failureEvents = newEventLimiter(provisioningEventInterval)
+	cs.failureEvents.now = func() time.Time { return now }
+
+	pvc := map[string]string{pvcNameParam: "data", pvcNamespaceParam: "default"}
+	req := newCreateVolumeRequest("pvc-1", pvc)
+	outOfSpace := status.Errorf(codes.ResourceExhausted, "DSM out of space")
+
+	// repeated identical failures are reported once
+	for i := 0; i < 3; i++ {
+		cs.reportProvisioningFailure(context.Background(), req, outOfSpace)
+	}
+	if len(recorder.Events) != 1 {
+		t.Fatalf("recorded %d events for 3 identical failures, want 1", len(recorder.Events))
+	}
+	if event := <-recorder.Events; !strings.HasPrefix(event, "Warning DsmProvisioningFailed Failed to create volume pvc-1 (ResourceExhausted): DSM out of space") {
+		t.Errorf("event = %q", event)
+	}
+
+	// failures worth retrying or without a PVC aren't reported
+	cs.reportProvisioningFailure(context.Background(), req, status.Errorf(codes.Unavailable, "DSM unreachable"))
+	cs.reportProvisioningFailure(context.Background(), newCreateVolumeRequest("pvc-1", nil), status.Errorf(codes.InvalidArgument, "bad"))
+	if len(recorder.Events) != 0 {
+		t.Fatalf("recorded %d events for non-terminal or PVC-less failures, want 0", len(recorder.Events))
+	}
+
+	// another failure of the same PVC is reported right away
+	cs.reportProvisioningFailure(context.Background(), req, status.Errorf(codes.InvalidArgument, "bad"))
+	if len(recorder.Events) != 1 {
+		t.Fatalf("recorded %d events for a different failure, want 1", len(recorder.Events))
+	}
+	<-recorder.Events
+
+	// and the same one again once the interval is over
+	now = now.Add(provisioningEventInterval)
+	cs.reportProvisioningFailure(context.Background(), req, outOfSpace)
+	if len(recorder.Events) != 1 {
+		t.Fatalf("recorded %d events after the interval, want 1", len(recorder.Events))
+	}
+}
+
+func TestCreateVolume_provisioningEvents(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	cs := newTestControllerServer(newFakeDsmService())
+	cs.recorder = recorder
+	cs.failureEvents = newEventLimiter(provisioningEventInterval)
+
+	req := newCreateVolumeRequest("pvc-1", map[string]string{
+		pvcNameParam: "data", pvcNamespaceParam: "default", "protocol": "bogus",
+	})
+	for i := 0; i < 2; i++ {
+		if _, err := cs.CreateVolume(context.Background(), req); status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("CreateVolume() error = %v, want %v", err, codes.InvalidArgument)
+		}
+	}
+	if len(recorder.Events) != 1 {
+		t.Errorf("recorded %d events for 2 identical failures, want 1", len(recorder.Events))
+	}
+}
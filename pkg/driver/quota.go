@@ -0,0 +1,61 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+// checkNamespaceQuota fails with ResourceExhausted if creating a volume of sizeInByte
+// would take the iSCSI volumes of the PVC namespace over its quota. The namespace of
+// a LUN is read from the description CreateVolume gives it.
+func (cs *controllerServer) checkNamespaceQuota(ctx context.Context, protocol string, namespace string, sizeInByte int64) error {
+	if len(NamespaceQuotas) == 0 {
+		return nil
+	}
+	if namespace == "" {
+		log.WithContext(ctx).Warnf("No PVC namespace in CreateVolume parameters, skipping namespace quotas. Is the provisioner run with --extra-create-metadata?")
+		return nil
+	}
+	quota, ok := NamespaceQuotas[namespace]
+	if !ok {
+		return nil
+	}
+	if protocol != utils.ProtocolIscsi {
+		log.WithContext(ctx).Warnf("Shares aren't tagged with their namespace, skipping the quota of namespace %s", namespace)
+		return nil
+	}
+
+	var used int64
+	for _, vol := range cs.dsmService.ListVolumes(ctx) {
+		if vol.Protocol == utils.ProtocolIscsi && models.LunDescriptionNamespace(vol.Lun.Description) == namespace {
+			used += vol.SizeInBytes
+		}
+	}
+	if used+sizeInByte > quota {
+		return status.Errorf(codes.ResourceExhausted,
+			"Namespace %s uses %d of its %d bytes quota, %d more are requested", namespace, used, quota, sizeInByte)
+	}
+	return nil
+}
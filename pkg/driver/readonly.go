@@ -0,0 +1,66 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// isReadOnlyPublish tells if a volume is published read-only, because the publish request
+// says so or because its access mode only allows readers
+func isReadOnlyPublish(volCap *csi.VolumeCapability, readonly bool) bool {
+	switch volCap.GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY:
+		return true
+	}
+	return readonly
+}
+
+// setDeviceReadOnly makes the block device read-only. A read-only bind mount of a device
+// node doesn't prevent writes to the device, only to the filesystem holding the node.
+func (t *tools) setDeviceReadOnly(devPath string) error {
+	out, err := t.executor.Command("blockdev", "--setro", devPath).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("Failed to set device %s read-only: %v, output: %s", devPath, err, string(out))
+	}
+	return nil
+}
+
+// publishISCSIVolume bind mounts the device of a block volume, or the staging path of a
+// filesystem volume, on targetPath. A read-only publish of a volume staged read-write is
+// enforced by options, which have "ro" for the bind mount to be remounted read-only.
+func (ns *nodeServer) publishISCSIVolume(devicePath string, stagingTargetPath string, targetPath string, fsType string, options []string, isBlock bool, readonly bool) error {
+	if !isBlock {
+		return ns.Mounter.Interface.Mount(stagingTargetPath, targetPath, fsType, options)
+	}
+
+	if readonly {
+		if err := ns.tools.setDeviceReadOnly(devicePath); err != nil {
+			os.Remove(targetPath)
+			return err
+		}
+	}
+	if err := ns.Mounter.Interface.Mount(devicePath, targetPath, "", options); err != nil {
+		// drop the file created for the device so a retry starts clean
+		os.Remove(targetPath)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/mount-utils"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils/hostexec"
+)
+
+func TestNodePublishVolume_readOnly(t *testing.T) {
+	nfsContext := map[string]string{"protocol": utils.ProtocolNfs, "dsm": "10.0.0.1", "baseDir": "/volume1/k8s-csi-pvc-1"}
+	smbContext := map[string]string{"protocol": utils.ProtocolSmb}
+
+	tests := []struct {
+		name          string
+		volumeContext map[string]string
+		mode          csi.VolumeCapability_AccessMode_Mode
+		readonly      bool
+		want          []string
+	}{
+		{name: "nfs", volumeContext: nfsContext, mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, want: []string{}},
+		{name: "nfs read-only", volumeContext: nfsContext, mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, readonly: true, want: []string{"ro"}},
+		{name: "nfs reader only", volumeContext: nfsContext, mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, want: []string{"ro"}},
+		{name: "smb", volumeContext: smbContext, mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, want: []string{"bind"}},
+		{name: "smb read-only", volumeContext: smbContext, mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER, readonly: true, want: []string{"ro", "bind"}},
+		{name: "smb reader only", volumeContext: smbContext, mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY, want: []string{"ro", "bind"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targetPath := filepath.Join(t.TempDir(), "target")
+			mounter := mount.NewFakeMounter(nil)
+			ns := &nodeServer{Mounter: &mount.SafeFormatAndMount{Interface: mounter}}
+
+			_, err := ns.NodePublishVolume(context.Background(), &csi.NodePublishVolumeRequest{
+				VolumeId:          "vol-1",
+				StagingTargetPath: "/staging",
+				TargetPath:        targetPath,
+				VolumeCapability:  mountCapability(tt.mode),
+				Readonly:          tt.readonly,
+				VolumeContext:     tt.volumeContext,
+			})
+			if err != nil {
+				t.Fatalf("NodePublishVolume() error = %v", err)
+			}
+			if len(mounter.MountPoints) != 1 || !reflect.DeepEqual(mounter.MountPoints[0].Opts, tt.want) {
+				t.Errorf("NodePublishVolume() mounts = %+v, want options %v", mounter.MountPoints, tt.want)
+			}
+		})
+	}
+}
+
+func TestPublishISCSIVolume(t *testing.T) {
+	tests := []struct {
+		name      string
+		isBlock   bool
+		readonly  bool
+		options   []string
+		wantMount mount.MountPoint
+		wantSetRo bool
+	}{
+		{name: "filesystem", options: []string{"bind"},
+			wantMount: mount.MountPoint{Device: "/staging", Type: "ext4", Opts: []string{"bind"}}},
+		{name: "filesystem read-only", readonly: true, options: []string{"ro", "bind"},
+			wantMount: mount.MountPoint{Device: "/staging", Type: "ext4", Opts: []string{"ro", "bind"}}},
+		{name: "block", isBlock: true, options: []string{"bind"},
+			wantMount: mount.MountPoint{Device: "/dev/sdb", Opts: []string{"bind"}}},
+		{name: "block read-only", isBlock: true, readonly: true, options: []string{"ro", "bind"},
+			wantMount: mount.MountPoint{Device: "/dev/sdb", Opts: []string{"ro", "bind"}}, wantSetRo: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			targetPath := filepath.Join(t.TempDir(), "target")
+			if err := os.WriteFile(targetPath, nil, 0640); err != nil {
+				t.Fatal(err)
+			}
+			mounter := mount.NewFakeMounter(nil)
+			fake := hostexec.NewFake(nil, "/host")
+			ns := &nodeServer{Mounter: &mount.SafeFormatAndMount{Interface: mounter}, tools: NewTools(fake)}
+
+			if err := ns.publishISCSIVolume("/dev/sdb", "/staging", targetPath, "ext4", tt.options, tt.isBlock, tt.readonly); err != nil {
+				t.Fatalf("publishISCSIVolume() error = %v", err)
+			}
+			tt.wantMount.Path = targetPath
+			if len(mounter.MountPoints) != 1 || !reflect.DeepEqual(mounter.MountPoints[0], tt.wantMount) {
+				t.Errorf("publishISCSIVolume() mounts = %+v, want %+v", mounter.MountPoints, tt.wantMount)
+			}
+
+			setRo := false
+			for _, inv := range fake.Invocations() {
+				setRo = setRo || len(inv.Args) >= 2 && reflect.DeepEqual(inv.Args[len(inv.Args)-2:], []string{"--setro", "/dev/sdb"})
+			}
+			if setRo != tt.wantSetRo {
+				t.Errorf("publishISCSIVolume() ran %v, want blockdev --setro %v", fake.Invocations(), tt.wantSetRo)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// resizeFs grows the filesystem on devPath, mounted at mountPath, to the size of the device
+func (t *tools) resizeFs(devPath string, mountPath string) error {
+	fsType, err := t.blkid_fstype(devPath)
+	if err != nil {
+		return fmt.Errorf("Failed to detect filesystem type of %s. err: %w", devPath, err)
+	}
+	if fsType == "" {
+		return fmt.Errorf("No filesystem found on %s", devPath)
+	}
+
+	fs, ok := filesystems[fsType]
+	if !ok {
+		return fmt.Errorf("Resizing filesystem %s on %s is not supported", fsType, devPath)
+	}
+
+	target := devPath
+	if fs.growByMountPath {
+		target = mountPath
+	}
+
+	log.Infof("Resizing %s filesystem on %s with %s", fsType, devPath, fs.grow)
+	out, err := t.executor.Command(fs.grow, append(append([]string{}, fs.growArgs...), target)...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %s (%w)", fs.grow, string(out), err)
+	}
+	return nil
+}
@@ -0,0 +1,155 @@
+package driver
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	utilexec "k8s.io/utils/exec"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils/hostexec"
+)
+
+var blkidArgs = []string{"blkid", "-p", "-s", "TYPE", "-s", "PTTYPE", "-o", "export", "/dev/sdb"}
+
+// assertInvocations checks the fake executor ran exactly the given commands, in order
+func assertInvocations(t *testing.T, fake *hostexec.Fake, want [][]string) {
+	t.Helper()
+
+	invocations := fake.Invocations()
+	if len(invocations) != len(want) {
+		t.Fatalf("ran %d commands, want %d: %+v", len(invocations), len(want), invocations)
+	}
+	for i, w := range want {
+		cmd, args := fake.Resolve(w[0], w[1:]...)
+		if got := invocations[i]; got.Cmd != cmd || !reflect.DeepEqual(got.Args, args) {
+			t.Errorf("command %d = %v %v, want %v %v", i, got.Cmd, got.Args, cmd, args)
+		}
+	}
+}
+
+func TestResizeFs(t *testing.T) {
+	tests := []struct {
+		name    string
+		blkid   hostexec.FakeResult
+		want    [][]string
+		wantErr bool
+	}{
+		{
+			name:  "ext4",
+			blkid: hostexec.FakeResult{Output: []byte("TYPE=ext4\n")},
+			want:  [][]string{blkidArgs, {"resize2fs", "/dev/sdb"}},
+		},
+		{
+			name:  "xfs",
+			blkid: hostexec.FakeResult{Output: []byte("TYPE=xfs\n")},
+			want:  [][]string{blkidArgs, {"xfs_growfs", "/staging"}},
+		},
+		{
+			name:  "btrfs",
+			blkid: hostexec.FakeResult{Output: []byte("TYPE=btrfs\n")},
+			want:  [][]string{blkidArgs, {"btrfs", "filesystem", "resize", "max", "/staging"}},
+		},
+		{
+			name:    "unsupported filesystem",
+			blkid:   hostexec.FakeResult{Output: []byte("TYPE=vfat\n")},
+			want:    [][]string{blkidArgs},
+			wantErr: true,
+		},
+		{
+			name:    "no filesystem",
+			blkid:   hostexec.FakeResult{Err: utilexec.CodeExitError{Err: errors.New("exit status 2"), Code: 2}},
+			want:    [][]string{blkidArgs},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := hostexec.NewFake(nil, "/host")
+			fake.Respond(tt.blkid)
+			tools := NewTools(fake)
+
+			err := tools.resizeFs("/dev/sdb", "/staging")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("resizeFs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			assertInvocations(t, fake, tt.want)
+		})
+	}
+}
+
+func TestNodeExpandVolume(t *testing.T) {
+	defer func(dir string, interval time.Duration) {
+		byPathDir, devicePollInterval = dir, interval
+	}(byPathDir, devicePollInterval)
+	byPathDir, devicePollInterval = t.TempDir(), time.Millisecond
+	iqn := "iqn.2000-01.com.synology:pvc-1"
+	device := filepath.Join(byPathDir, byPathName("10.0.0.1:3260", iqn, 1))
+	if err := os.WriteFile(device, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	session := hostexec.FakeResult{Output: []byte("tcp: [1] 10.0.0.1:3260,1 " + iqn + " (non-flash)\n")}
+	listed := []string{"iscsiadm", "-m", "session"}
+	rescanned := []string{"iscsiadm", "-m", "node", "--targetname", iqn, "-R"}
+	blkid := append(append([]string{}, blkidArgs[:len(blkidArgs)-1]...), device)
+
+	tests := []struct {
+		name    string
+		isBlock bool
+		blkid   hostexec.FakeResult
+		want    [][]string
+	}{
+		{
+			name:  "ext4",
+			blkid: hostexec.FakeResult{Output: []byte("TYPE=ext4\n")},
+			want:  [][]string{listed, rescanned, listed, blkid, {"resize2fs", device}},
+		},
+		{
+			name:  "xfs",
+			blkid: hostexec.FakeResult{Output: []byte("TYPE=xfs\n")},
+			want:  [][]string{listed, rescanned, listed, blkid, {"xfs_growfs", "/publish"}},
+		},
+		{
+			name:    "block",
+			isBlock: true,
+			want:    [][]string{listed, rescanned, listed},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dsmService := newFakeDsmService()
+			dsmService.volumes["lun-1"] = &models.K8sVolumeRespSpec{
+				Protocol: utils.ProtocolIscsi,
+				Lun:      webapi.LunInfo{Uuid: "lun-1"},
+				Target:   webapi.TargetInfo{Iqn: iqn, MappedLuns: []webapi.MappedLun{{LunUuid: "lun-1", MappingIndex: 1}}},
+			}
+			fake := hostexec.NewFake(nil, "/host")
+			fake.Respond(session, hostexec.FakeResult{}, session, tt.blkid)
+			d, _ := NewControllerAndNodeDriver("node", "unix:///tmp/csi.sock", dsmService, NewTools(fake))
+			ns := &nodeServer{Driver: d, dsmService: dsmService, tools: NewTools(fake), Initiator: &initiatorDriver{tools: NewTools(fake)}}
+
+			volCap := &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}}
+			if tt.isBlock {
+				volCap = &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}}
+			}
+			_, err := ns.NodeExpandVolume(context.Background(), &csi.NodeExpandVolumeRequest{
+				VolumeId:         "lun-1",
+				VolumePath:       "/publish",
+				CapacityRange:    &csi.CapacityRange{RequiredBytes: 2 * utils.UNIT_GB},
+				VolumeCapability: volCap,
+			})
+			if err != nil {
+				t.Fatalf("NodeExpandVolume() error = %v", err)
+			}
+			assertInvocations(t, fake, tt.want)
+		})
+	}
+}
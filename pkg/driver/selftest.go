@@ -0,0 +1,272 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+// Stages of the self-test, in the order they run. The stages after "read" undo the
+// earlier ones, and run whenever the stage they undo succeeded.
+const (
+	selfTestCreate              = "create"
+	selfTestControllerPublish   = "controller-publish"
+	selfTestStage               = "stage"
+	selfTestPublish             = "publish"
+	selfTestWrite               = "write"
+	selfTestRead                = "read"
+	selfTestUnpublish           = "unpublish"
+	selfTestUnstage             = "unstage"
+	selfTestControllerUnpublish = "controller-unpublish"
+	selfTestDelete              = "delete"
+)
+
+// selfTestFile is the file written and read back on the published volume
+const selfTestFile = "synology-csi-selftest"
+
+// SelfTestStage is the outcome of a stage of the self-test
+type SelfTestStage struct {
+	Name     string
+	Duration time.Duration
+	Err      error
+}
+
+// SelfTestReport lists the stages of the self-test which ran, the stages after a failure
+// being skipped but for the ones cleaning up
+type SelfTestReport struct {
+	VolumeId string
+	Stages   []SelfTestStage
+}
+
+// Passed tells if every stage which ran succeeded
+func (r *SelfTestReport) Passed() bool {
+	for _, stage := range r.Stages {
+		if stage.Err != nil {
+			return false
+		}
+	}
+	return len(r.Stages) > 0
+}
+
+func (r *SelfTestReport) run(ctx context.Context, name string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	r.Stages = append(r.Stages, SelfTestStage{Name: name, Duration: time.Since(start), Err: err})
+	if err != nil {
+		log.WithContext(ctx).Errorf("Self-test stage %s failed: %v", name, err)
+	}
+	return err
+}
+
+// SelfTest provisions a volume with the StorageClass parameters, mounts it on this node,
+// writes and reads back a file, and tears everything down, through the same controller
+// and node servers as the CSI calls. The volume is mounted under workDir.
+func (d *Driver) SelfTest(ctx context.Context, params map[string]string, workDir string) *SelfTestReport {
+	return runSelfTest(ctx, NewControllerServer(d), NewNodeServer(d), d.nodeID, params, workDir)
+}
+
+func runSelfTest(ctx context.Context, cs csi.ControllerServer, ns csi.NodeServer, nodeId string, params map[string]string, workDir string) *SelfTestReport {
+	report := &SelfTestReport{}
+	// the cleanup still runs once the self-test is cancelled
+	cleanupCtx := context.WithoutCancel(ctx)
+
+	volCap := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: params["fsType"]}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+	}
+	stagingPath := filepath.Join(workDir, "staging")
+	targetPath := filepath.Join(workDir, "target")
+
+	var volume *csi.Volume
+	err := report.run(ctx, selfTestCreate, func() error {
+		resp, err := cs.CreateVolume(ctx, &csi.CreateVolumeRequest{
+			Name:               fmt.Sprintf("selftest-%d", time.Now().UnixNano()),
+			CapacityRange:      &csi.CapacityRange{RequiredBytes: utils.UNIT_GB},
+			VolumeCapabilities: []*csi.VolumeCapability{volCap},
+			Parameters:         params,
+		})
+		if err != nil {
+			return err
+		}
+		volume = resp.GetVolume()
+		return nil
+	})
+	if err != nil {
+		return report
+	}
+	report.VolumeId = volume.GetVolumeId()
+	defer report.run(cleanupCtx, selfTestDelete, func() error {
+		_, err := cs.DeleteVolume(cleanupCtx, &csi.DeleteVolumeRequest{VolumeId: volume.GetVolumeId()})
+		return err
+	})
+
+	// controllers without ControllerPublishVolume leave the volume open to every node
+	var publishContext map[string]string
+	controllerPublished := false
+	err = report.run(ctx, selfTestControllerPublish, func() error {
+		resp, err := cs.ControllerPublishVolume(ctx, &csi.ControllerPublishVolumeRequest{
+			VolumeId:         volume.GetVolumeId(),
+			NodeId:           nodeId,
+			VolumeCapability: volCap,
+			VolumeContext:    volume.GetVolumeContext(),
+		})
+		if status.Code(err) == codes.Unimplemented {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		controllerPublished = true
+		publishContext = resp.GetPublishContext()
+		return nil
+	})
+	if err != nil {
+		return report
+	}
+	if controllerPublished {
+		defer report.run(cleanupCtx, selfTestControllerUnpublish, func() error {
+			_, err := cs.ControllerUnpublishVolume(cleanupCtx, &csi.ControllerUnpublishVolumeRequest{
+				VolumeId: volume.GetVolumeId(),
+				NodeId:   nodeId,
+			})
+			return err
+		})
+	}
+
+	err = report.run(ctx, selfTestStage, func() error {
+		if err := os.MkdirAll(stagingPath, 0750); err != nil {
+			return err
+		}
+		_, err := ns.NodeStageVolume(ctx, &csi.NodeStageVolumeRequest{
+			VolumeId:          volume.GetVolumeId(),
+			PublishContext:    publishContext,
+			StagingTargetPath: stagingPath,
+			VolumeCapability:  volCap,
+			VolumeContext:     volume.GetVolumeContext(),
+		})
+		return err
+	})
+	if err != nil {
+		// a failed stage may have logged in already
+		report.run(cleanupCtx, selfTestUnstage, func() error {
+			return unstageSelfTest(cleanupCtx, ns, volume.GetVolumeId(), stagingPath)
+		})
+		return report
+	}
+	defer report.run(cleanupCtx, selfTestUnstage, func() error {
+		return unstageSelfTest(cleanupCtx, ns, volume.GetVolumeId(), stagingPath)
+	})
+
+	err = report.run(ctx, selfTestPublish, func() error {
+		_, err := ns.NodePublishVolume(ctx, &csi.NodePublishVolumeRequest{
+			VolumeId:          volume.GetVolumeId(),
+			PublishContext:    publishContext,
+			StagingTargetPath: stagingPath,
+			TargetPath:        targetPath,
+			VolumeCapability:  volCap,
+			VolumeContext:     volume.GetVolumeContext(),
+		})
+		return err
+	})
+	// a failed publish may have left its mount behind, which unpublishing removes too
+	defer report.run(cleanupCtx, selfTestUnpublish, func() error {
+		if _, err := ns.NodeUnpublishVolume(cleanupCtx, &csi.NodeUnpublishVolumeRequest{
+			VolumeId:   volume.GetVolumeId(),
+			TargetPath: targetPath,
+		}); err != nil {
+			return err
+		}
+		return removeEmptyDir(targetPath)
+	})
+	if err != nil {
+		return report
+	}
+
+	content := make([]byte, 4096)
+	testFile := filepath.Join(targetPath, selfTestFile)
+	err = report.run(ctx, selfTestWrite, func() error {
+		if _, err := rand.Read(content); err != nil {
+			return err
+		}
+		return writeSyncedFile(testFile, content)
+	})
+	if err != nil {
+		return report
+	}
+	report.run(ctx, selfTestRead, func() error {
+		defer os.Remove(testFile)
+		read, err := os.ReadFile(testFile)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(read, content) {
+			return fmt.Errorf("Read %d bytes from %s which differ from the %d written", len(read), testFile, len(content))
+		}
+		return nil
+	})
+	return report
+}
+
+// unstageSelfTest unstages the volume and removes the staging path, which kubelet would
+func unstageSelfTest(ctx context.Context, ns csi.NodeServer, volumeId string, stagingPath string) error {
+	if _, err := ns.NodeUnstageVolume(ctx, &csi.NodeUnstageVolumeRequest{
+		VolumeId:          volumeId,
+		StagingTargetPath: stagingPath,
+	}); err != nil {
+		return err
+	}
+	return removeEmptyDir(stagingPath)
+}
+
+// removeEmptyDir removes a staging or target path left by the node server, like kubelet.
+// Unlike os.RemoveAll it can't delete the files of a volume still mounted on it.
+func removeEmptyDir(path string) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// writeSyncedFile writes the file through to the volume, not just to the page cache
+func writeSyncedFile(path string, content []byte) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,163 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"k8s.io/mount-utils"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils/hostexec"
+)
+
+// selfTestNode stages and publishes on a fake mounter, as logging into a target needs
+// iscsiadm, and unpublishes and unstages with the node server
+type selfTestNode struct {
+	*nodeServer
+	mounter    *mount.FakeMounter
+	publishErr error
+}
+
+func (n *selfTestNode) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
+	if err := n.mounter.Mount("/dev/sdb", req.GetStagingTargetPath(), "ext4", nil); err != nil {
+		return nil, err
+	}
+	return &csi.NodeStageVolumeResponse{}, nil
+}
+
+func (n *selfTestNode) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	if err := os.MkdirAll(req.GetTargetPath(), 0750); err != nil {
+		return nil, err
+	}
+	if n.publishErr != nil {
+		return nil, n.publishErr
+	}
+	if err := n.mounter.Mount(req.GetStagingTargetPath(), req.GetTargetPath(), "", []string{"bind"}); err != nil {
+		return nil, err
+	}
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+func newSelfTestNode(t *testing.T, dsmService *fakeDsmService) *selfTestNode {
+	mounter := mount.NewFakeMounter(nil)
+	return &selfTestNode{
+		nodeServer: &nodeServer{
+			dsmService: dsmService,
+			Mounter:    &mount.SafeFormatAndMount{Interface: mounter},
+			tools:      NewTools(hostexec.NewFake(nil, "/host")),
+			state:      newNodeState(filepath.Join(t.TempDir(), "volumes.json")),
+		},
+		mounter: mounter,
+	}
+}
+
+func selfTestStageNames(report *SelfTestReport) []string {
+	names := []string{}
+	for _, stage := range report.Stages {
+		names = append(names, stage.Name)
+	}
+	return names
+}
+
+func TestSelfTest(t *testing.T) {
+	dsmService := newFakeDsmService()
+	cs := newTestControllerServer(dsmService)
+	ns := newSelfTestNode(t, dsmService)
+	workDir := t.TempDir()
+
+	report := runSelfTest(context.Background(), cs, ns, "node", map[string]string{"protocol": "iscsi"}, workDir)
+	for _, stage := range report.Stages {
+		if stage.Err != nil {
+			t.Errorf("stage %s error = %v", stage.Name, stage.Err)
+		}
+	}
+	if !report.Passed() {
+		t.Errorf("Passed() = false, want true")
+	}
+	want := []string{selfTestCreate, selfTestControllerPublish, selfTestStage, selfTestPublish,
+		selfTestWrite, selfTestRead, selfTestUnpublish, selfTestUnstage, selfTestDelete}
+	if got := selfTestStageNames(report); !reflect.DeepEqual(got, want) {
+		t.Errorf("stages = %v, want %v", got, want)
+	}
+
+	if len(dsmService.created) != 1 || dsmService.created[0].Size != MinVolumeSize {
+		t.Errorf("created volumes = %+v, want one of %d bytes", dsmService.created, MinVolumeSize)
+	}
+	if len(dsmService.volumes) != 0 {
+		t.Errorf("volumes left = %v, want none", dsmService.volumes)
+	}
+	if len(ns.mounter.MountPoints) != 0 {
+		t.Errorf("mounts left = %v, want none", ns.mounter.MountPoints)
+	}
+	if entries, _ := os.ReadDir(workDir); len(entries) != 0 {
+		t.Errorf("work dir has %d entries left, want none", len(entries))
+	}
+}
+
+func TestSelfTest_cleanupAfterFailure(t *testing.T) {
+	dsmService := newFakeDsmService()
+	cs := newTestControllerServer(dsmService)
+	ns := newSelfTestNode(t, dsmService)
+	ns.publishErr = fmt.Errorf("bind mount failed")
+	workDir := t.TempDir()
+
+	report := runSelfTest(context.Background(), cs, ns, "node", map[string]string{"protocol": "iscsi"}, workDir)
+	if report.Passed() {
+		t.Errorf("Passed() = true after a failed publish, want false")
+	}
+	want := []string{selfTestCreate, selfTestControllerPublish, selfTestStage, selfTestPublish,
+		selfTestUnpublish, selfTestUnstage, selfTestDelete}
+	if got := selfTestStageNames(report); !reflect.DeepEqual(got, want) {
+		t.Fatalf("stages = %v, want %v", got, want)
+	}
+	for _, stage := range report.Stages {
+		if failed := stage.Err != nil; failed != (stage.Name == selfTestPublish) {
+			t.Errorf("stage %s error = %v", stage.Name, stage.Err)
+		}
+	}
+
+	if len(dsmService.volumes) != 0 {
+		t.Errorf("volumes left = %v, want none", dsmService.volumes)
+	}
+	if len(ns.mounter.MountPoints) != 0 {
+		t.Errorf("mounts left = %v, want none", ns.mounter.MountPoints)
+	}
+	if entries, _ := os.ReadDir(workDir); len(entries) != 0 {
+		t.Errorf("work dir has %d entries left, want none", len(entries))
+	}
+}
+
+func TestSelfTest_createFails(t *testing.T) {
+	dsmService := newFakeDsmService()
+	cs := newTestControllerServer(dsmService)
+	ns := newSelfTestNode(t, dsmService)
+
+	// an unknown protocol fails before anything is created
+	report := runSelfTest(context.Background(), cs, ns, "node", map[string]string{"protocol": "ftp"}, t.TempDir())
+	if got := selfTestStageNames(report); !reflect.DeepEqual(got, []string{selfTestCreate}) || report.Passed() {
+		t.Errorf("stages = %v, passed %v, want a failed create alone", got, report.Passed())
+	}
+	if len(dsmService.created) != 0 {
+		t.Errorf("created volumes = %+v, want none", dsmService.created)
+	}
+}
@@ -0,0 +1,126 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+)
+
+// SessionReconcileInterval is how often the node logs out orphaned iSCSI sessions, 0 disables
+var SessionReconcileInterval time.Duration
+
+// maxOrphanLogouts limits the sessions logged out by one pass of the reconciler
+var maxOrphanLogouts = 5
+
+// driverTargetPrefixes start the names of the targets created by the driver, after the
+// hostname of their DSM: the PV name of a target of its own, or a shared target
+var driverTargetPrefixes = []string{"pvc-", strings.ReplaceAll(models.SharedTargetPrefix, "_", "-")}
+
+// isDriverTarget tells if an IQN is the one the controller gives the targets it creates,
+// <IqnPrefix><dsm hostname>.<target name>. Sessions of other targets are never logged out.
+func isDriverTarget(iqn string) bool {
+	if !strings.HasPrefix(iqn, models.IqnPrefix) {
+		return false
+	}
+	name := strings.TrimPrefix(iqn, models.IqnPrefix)
+	i := strings.Index(name, ".")
+	if i < 0 {
+		return false
+	}
+	for _, prefix := range driverTargetPrefixes {
+		if strings.HasPrefix(name[i+1:], prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// orphanSessions returns the IQNs of the sessions to targets of the driver which neither a
+// staged volume nor a session reference uses, once per target even with several portals
+func orphanSessions(sessions []iscsiSession, staged map[string]stagedVolume, referenced func(iqn string) bool) []string {
+	used := map[string]bool{}
+	for _, v := range staged {
+		used[v.TargetIqn] = true
+	}
+
+	orphans := []string{}
+	seen := map[string]bool{}
+	for _, s := range sessions {
+		if seen[s.Iqn] || used[s.Iqn] || !isDriverTarget(s.Iqn) || referenced(s.Iqn) {
+			continue
+		}
+		seen[s.Iqn] = true
+		orphans = append(orphans, s.Iqn)
+	}
+	return orphans
+}
+
+// reconcileSessions logs out the orphaned sessions which were already orphaned in the
+// previous pass, given by suspects, so a volume being staged is never caught between its
+// login and the record of its state. It returns the orphans to check in the next pass.
+func (ns *nodeServer) reconcileSessions(suspects map[string]bool) map[string]bool {
+	orphans := orphanSessions(ns.tools.iscsiadm_session(), ns.state.list(), func(iqn string) bool {
+		return ns.sessions.count(iqn) > 0
+	})
+
+	next := map[string]bool{}
+	loggedOut := 0
+	for _, iqn := range orphans {
+		if !suspects[iqn] || loggedOut >= maxOrphanLogouts {
+			next[iqn] = true
+			continue
+		}
+		if ns.logoutOrphan(iqn) {
+			loggedOut++
+		}
+	}
+	return next
+}
+
+// logoutOrphan logs out the session of iqn unless a volume started using it meanwhile
+func (ns *nodeServer) logoutOrphan(iqn string) bool {
+	defer ns.sessions.lock(iqn)()
+
+	if ns.sessions.count(iqn) > 0 {
+		return false
+	}
+	for _, v := range ns.state.list() {
+		if v.TargetIqn == iqn {
+			return false
+		}
+	}
+	if err := ns.tools.iscsiadm_logout(iqn); err != nil {
+		log.Warnf("Failed to log out orphaned session[%s]: %v", iqn, err)
+		return false
+	}
+	log.Infof("Logged out orphaned session[%s], no staged volume uses it.", iqn)
+	return true
+}
+
+// runSessionReconciler logs out the orphaned iSCSI sessions every interval
+func (ns *nodeServer) runSessionReconciler(interval time.Duration) {
+	log.Infof("Logging out orphaned iSCSI sessions every %v", interval)
+	suspects := map[string]bool{}
+	for range time.Tick(interval) {
+		suspects = ns.reconcileSessions(suspects)
+	}
+}
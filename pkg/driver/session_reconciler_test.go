@@ -0,0 +1,124 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils/hostexec"
+)
+
+const (
+	stagedIqn     = "iqn.2000-01.com.synology:ds.pvc-staged"
+	orphanIqn     = "iqn.2000-01.com.synology:ds.pvc-orphan"
+	sharedIqn     = "iqn.2000-01.com.synology:ds.k8s-csi-shared-1"
+	referencedIqn = "iqn.2000-01.com.synology:ds.pvc-referenced"
+	foreignIqn    = "iqn.2000-01.com.synology:ds.Target-1.abcdef"
+)
+
+func TestIsDriverTarget(t *testing.T) {
+	tests := []struct {
+		iqn  string
+		want bool
+	}{
+		{orphanIqn, true},
+		{sharedIqn, true},
+		{foreignIqn, false},
+		{"iqn.2000-01.com.synology:pvc-no-hostname", false},
+		{"iqn.2003-01.org.linux-iscsi:ds.pvc-other-vendor", false},
+	}
+	for _, tt := range tests {
+		if got := isDriverTarget(tt.iqn); got != tt.want {
+			t.Errorf("isDriverTarget(%s) = %v, want %v", tt.iqn, got, tt.want)
+		}
+	}
+}
+
+func TestOrphanSessions(t *testing.T) {
+	sessions := []iscsiSession{
+		{Id: 1, Portal: "10.0.0.1:3260", Iqn: stagedIqn},
+		{Id: 2, Portal: "10.0.0.1:3260", Iqn: orphanIqn},
+		// another portal of the same target
+		{Id: 3, Portal: "10.0.0.2:3260", Iqn: orphanIqn},
+		{Id: 4, Portal: "10.0.0.1:3260", Iqn: sharedIqn},
+		{Id: 5, Portal: "10.0.0.1:3260", Iqn: referencedIqn},
+		{Id: 6, Portal: "10.0.0.1:3260", Iqn: foreignIqn},
+	}
+	staged := map[string]stagedVolume{"lun-staged": {TargetIqn: stagedIqn}}
+	referenced := func(iqn string) bool { return iqn == referencedIqn }
+
+	got := orphanSessions(sessions, staged, referenced)
+	if want := []string{orphanIqn, sharedIqn}; !reflect.DeepEqual(got, want) {
+		t.Errorf("orphanSessions() = %v, want %v", got, want)
+	}
+	if got := orphanSessions(nil, staged, referenced); len(got) != 0 {
+		t.Errorf("orphanSessions() without sessions = %v, want none", got)
+	}
+}
+
+func TestReconcileSessions(t *testing.T) {
+	defer func(max int) { maxOrphanLogouts = max }(maxOrphanLogouts)
+	maxOrphanLogouts = 1
+
+	fake := hostexec.NewFake(nil, "/host")
+	dir := t.TempDir()
+	ns := &nodeServer{
+		tools:    NewTools(fake),
+		sessions: newSessionRefs(filepath.Join(dir, "sessions.json")),
+		state:    newNodeState(filepath.Join(dir, "volumes.json")),
+	}
+	ns.state.put("lun-staged", stagedVolume{TargetIqn: stagedIqn})
+	listSessions := func(iqns ...string) hostexec.FakeResult {
+		out := ""
+		for i, iqn := range iqns {
+			out += fmt.Sprintf("tcp: [%d] 10.0.0.1:3260,1 %s (non-flash)\n", i+1, iqn)
+		}
+		return hostexec.FakeResult{Output: []byte(out)}
+	}
+	sessions := listSessions(stagedIqn, orphanIqn, sharedIqn, foreignIqn)
+	listed := []string{"iscsiadm", "-m", "session"}
+
+	// orphans are only suspected by the first pass, the sessions may be logins of a stage in progress
+	fake.Respond(sessions)
+	suspects := ns.reconcileSessions(map[string]bool{})
+	assertInvocations(t, fake, [][]string{listed})
+	if want := map[string]bool{orphanIqn: true, sharedIqn: true}; !reflect.DeepEqual(suspects, want) {
+		t.Fatalf("reconcileSessions() suspects = %v, want %v", suspects, want)
+	}
+
+	// one logout per pass, the other orphan waits for the next one
+	fake.Respond(sessions)
+	suspects = ns.reconcileSessions(suspects)
+	assertInvocations(t, fake, [][]string{listed, listed,
+		{"iscsiadm", "-m", "node", "--targetname", orphanIqn, "--logout"}})
+	if want := map[string]bool{sharedIqn: true}; !reflect.DeepEqual(suspects, want) {
+		t.Fatalf("reconcileSessions() suspects = %v, want %v", suspects, want)
+	}
+
+	// a volume staged since then keeps its session
+	ns.state.put("lun-shared", stagedVolume{TargetIqn: sharedIqn})
+	fake.Respond(listSessions(stagedIqn, sharedIqn, foreignIqn))
+	suspects = ns.reconcileSessions(suspects)
+	assertInvocations(t, fake, [][]string{listed, listed,
+		{"iscsiadm", "-m", "node", "--targetname", orphanIqn, "--logout"}, listed})
+	if len(suspects) != 0 {
+		t.Errorf("reconcileSessions() suspects = %v, want none", suspects)
+	}
+}
@@ -0,0 +1,122 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+// sessionRefs counts the volumes using the iSCSI session of each target, so a
+// session shared by several LUNs is only logged out with the last of them.
+// The references are persisted so they survive a restart of the node server.
+type sessionRefs struct {
+	mu    sync.Mutex
+	path  string
+	refs  map[string][]string // target IQN => volume IDs
+	locks map[string]*sync.Mutex
+}
+
+func newSessionRefs(path string) *sessionRefs {
+	r := &sessionRefs{
+		path:  path,
+		refs:  make(map[string][]string),
+		locks: make(map[string]*sync.Mutex),
+	}
+
+	if err := readStateFile(path, &r.refs); err != nil {
+		log.Warnf("Ignoring iSCSI session references in %s: %v", path, err)
+		r.refs = make(map[string][]string)
+	}
+	return r
+}
+
+// lock serializes login and logout of one target
+func (r *sessionRefs) lock(iqn string) func() {
+	r.mu.Lock()
+	l, ok := r.locks[iqn]
+	if !ok {
+		l = &sync.Mutex{}
+		r.locks[iqn] = l
+	}
+	r.mu.Unlock()
+
+	l.Lock()
+	return l.Unlock
+}
+
+// acquire runs login and references the session of iqn for volumeId if it succeeds.
+// login must be a no-op if the session already exists.
+func (r *sessionRefs) acquire(iqn string, volumeId string, login func() error) error {
+	defer r.lock(iqn)()
+
+	if err := login(); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !utils.SliceContains(r.refs[iqn], volumeId) {
+		r.refs[iqn] = append(r.refs[iqn], volumeId)
+		r.save()
+	}
+	return nil
+}
+
+// release drops the reference of volumeId and runs logout if no other volume uses the session
+func (r *sessionRefs) release(iqn string, volumeId string, logout func()) {
+	defer r.lock(iqn)()
+
+	r.mu.Lock()
+	remaining := []string{}
+	for _, id := range r.refs[iqn] {
+		if id != volumeId {
+			remaining = append(remaining, id)
+		}
+	}
+	if len(remaining) > 0 {
+		r.refs[iqn] = remaining
+	} else {
+		delete(r.refs, iqn)
+	}
+	r.save()
+	r.mu.Unlock()
+
+	if len(remaining) > 0 {
+		log.Infof("Session[%s] is still used by volumes %v, skipping logout.", iqn, remaining)
+		return
+	}
+	logout()
+}
+
+// count returns the number of volumes using the session of iqn
+func (r *sessionRefs) count(iqn string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.refs[iqn])
+}
+
+// save writes the references, the caller holds r.mu
+func (r *sessionRefs) save() {
+	if err := writeStateFile(r.path, r.refs); err != nil {
+		log.Errorf("Failed to save iSCSI session references: %v", err)
+	}
+}
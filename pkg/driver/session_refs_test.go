@@ -0,0 +1,95 @@
+package driver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSessionRefs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	refs := newSessionRefs(path)
+
+	var inFlight, maxInFlight, logouts int32
+	login := func() error {
+		n := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		return nil
+	}
+	logout := func() { atomic.AddInt32(&logouts, 1) }
+
+	const volumes = 8
+	var wg sync.WaitGroup
+	for i := 0; i < volumes; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := refs.acquire("iqn.shared", fmt.Sprintf("vol-%d", i), login); err != nil {
+				t.Errorf("acquire() error = %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if maxInFlight != 1 {
+		t.Errorf("%d logins of the same target ran concurrently, want 1", maxInFlight)
+	}
+	if got := refs.count("iqn.shared"); got != volumes {
+		t.Errorf("count() = %d, want %d", got, volumes)
+	}
+
+	// a restarted node server sees the same references
+	if got := newSessionRefs(path).count("iqn.shared"); got != volumes {
+		t.Errorf("count() after reload = %d, want %d", got, volumes)
+	}
+
+	for i := 0; i < volumes-1; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			refs.release("iqn.shared", fmt.Sprintf("vol-%d", i), logout)
+		}(i)
+	}
+	wg.Wait()
+	if logouts != 0 {
+		t.Errorf("logout ran %d times while the session was still used", logouts)
+	}
+
+	refs.release("iqn.shared", fmt.Sprintf("vol-%d", volumes-1), logout)
+	if logouts != 1 || refs.count("iqn.shared") != 0 {
+		t.Errorf("logout ran %d times after the last release, count = %d", logouts, refs.count("iqn.shared"))
+	}
+
+	// unknown volumes, e.g. staged by an older driver, still log out
+	refs.release("iqn.other", "vol-unknown", logout)
+	if logouts != 2 {
+		t.Errorf("logout ran %d times, want 2", logouts)
+	}
+}
+
+func TestSessionRefs_corruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.json")
+	if err := os.WriteFile(path, []byte(`{"iqn.a": ["vol-`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	refs := newSessionRefs(path)
+	if got := refs.count("iqn.a"); got != 0 {
+		t.Errorf("count() of corrupt file = %d, want 0", got)
+	}
+	if err := refs.acquire("iqn.a", "vol-1", func() error { return nil }); err != nil {
+		t.Fatalf("acquire() error = %v", err)
+	}
+	if got := newSessionRefs(path).count("iqn.a"); got != 1 {
+		t.Errorf("count() after rewrite = %d, want 1", got)
+	}
+}
@@ -0,0 +1,68 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+)
+
+const (
+	// shareEncryptionParam is the StorageClass parameter, and VolumeContext key, of encrypted shares
+	shareEncryptionParam = "encryption"
+	// encryptionPassphraseKey is the key of the passphrase in the provisioner secret
+	encryptionPassphraseKey = "encryptionPassphrase"
+)
+
+// parseEncryptionPassphrase reads the passphrase of an encrypted share from the provisioner secret
+func parseEncryptionPassphrase(secrets map[string]string) (webapi.Passphrase, error) {
+	passphrase := secrets[encryptionPassphraseKey]
+	if passphrase == "" {
+		return "", fmt.Errorf("Share encryption is enabled but the secret has no %s", encryptionPassphraseKey)
+	}
+	return webapi.Passphrase(passphrase), nil
+}
+
+// checkShareUnlocked fails the stage of an encrypted share which DSM didn't unlock, e.g.
+// after a reboot when the key isn't mounted at boot by the Key Manager of DSM
+func (ns *nodeServer) checkShareUnlocked(ctx context.Context, sourcePath string) error {
+	s := strings.Split(strings.TrimPrefix(sourcePath, "//"), "/")
+	if len(s) != 2 {
+		return status.Error(codes.InvalidArgument, "Failed to parse dsmIp and shareName from source path")
+	}
+	dsmIp, shareName := s[0], s[1]
+
+	dsm, err := ns.dsmService.GetDsm(dsmIp)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Failed to get DSM[%s]", dsmIp)
+	}
+	info, err := dsm.ShareGet(ctx, shareName)
+	if err != nil {
+		return status.Errorf(codes.Unavailable, "Failed to get share %s of DSM[%s]: %v", shareName, dsmIp, err)
+	}
+	if info.IsLocked() {
+		return status.Errorf(codes.FailedPrecondition,
+			"Share %s is encrypted and locked on DSM[%s], unlock it in Control Panel > Shared Folder or mount its key at boot with the Key Manager", shareName, dsmIp)
+	}
+	return nil
+}
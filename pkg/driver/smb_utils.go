@@ -0,0 +1,91 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	log "github.com/sirupsen/logrus"
+)
+
+// smbCredentialsDir holds the per-volume credentials files handed to mount.cifs,
+// so the password never shows up on the mount command line
+var smbCredentialsDir = "/tmp/synology-csi/smb"
+
+func smbCredentialsPath(volumeId string) string {
+	return filepath.Join(smbCredentialsDir, strings.ReplaceAll(volumeId, "/", "_")+".cred")
+}
+
+// writeSMBCredentials creates a credentials file readable only by the driver
+func writeSMBCredentials(path string, username string, password string, domain string) error {
+	for _, v := range []string{username, password, domain} {
+		if strings.ContainsAny(v, "\r\n") {
+			return fmt.Errorf("SMB credentials must not contain line breaks")
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// O_CREATE doesn't change the mode of a file that already exists
+	if err := f.Chmod(0600); err != nil {
+		return err
+	}
+
+	content := fmt.Sprintf("username=%s\npassword=%s\n", username, password)
+	if domain != "" {
+		content += fmt.Sprintf("domain=%s\n", domain)
+	}
+	if _, err := f.WriteString(content); err != nil {
+		return err
+	}
+
+	return f.Sync()
+}
+
+func removeSMBCredentials(volumeId string) {
+	if err := os.Remove(smbCredentialsPath(volumeId)); err != nil && !os.IsNotExist(err) {
+		log.Warnf("Failed to remove SMB credentials of volume [%s]: %v", volumeId, err)
+	}
+}
+
+// smbMountOptions builds the cifs mount options from the volume capability
+func smbMountOptions(mountCap *csi.VolumeCapability_MountVolume, credentialsPath string) ([]string, error) {
+	options := withoutMountPropagation(mountCap.GetMountFlags())
+
+	volumeMountGroup := mountCap.GetVolumeMountGroup()
+	gidPresent, err := checkGidPresentInMountFlags(volumeMountGroup, options)
+	if err != nil {
+		return nil, err
+	}
+	if !gidPresent && volumeMountGroup != "" {
+		options = append(options, fmt.Sprintf("gid=%s", volumeMountGroup))
+	}
+
+	return append(options, fmt.Sprintf("credentials=%s", credentialsPath)), nil
+}
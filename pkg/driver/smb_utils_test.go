@@ -0,0 +1,78 @@
+package driver
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestSmbMountOptions(t *testing.T) {
+	tests := []struct {
+		name     string
+		mountCap *csi.VolumeCapability_MountVolume
+		want     []string
+		wantErr  bool
+	}{
+		{
+			name:     "no flags",
+			mountCap: &csi.VolumeCapability_MountVolume{},
+			want:     []string{"credentials=/creds"},
+		},
+		{
+			name:     "flags and mount group",
+			mountCap: &csi.VolumeCapability_MountVolume{MountFlags: []string{"vers=3.0"}, VolumeMountGroup: "2000"},
+			want:     []string{"vers=3.0", "gid=2000", "credentials=/creds"},
+		},
+		{
+			name:     "conflicting gid",
+			mountCap: &csi.VolumeCapability_MountVolume{MountFlags: []string{"gid=1000"}, VolumeMountGroup: "2000"},
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := smbMountOptions(tt.mountCap, "/creds")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("smbMountOptions() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("smbMountOptions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteSMBCredentials(t *testing.T) {
+	orig := smbCredentialsDir
+	smbCredentialsDir = filepath.Join(t.TempDir(), "smb")
+	defer func() { smbCredentialsDir = orig }()
+
+	path := smbCredentialsPath("vol-1")
+	if err := writeSMBCredentials(path, "user", "secret", "WORKGROUP"); err != nil {
+		t.Fatalf("writeSMBCredentials() error = %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Stat() error = %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("credentials mode = %o, want 600", perm)
+	}
+	content, _ := os.ReadFile(path)
+	if want := "username=user\npassword=secret\ndomain=WORKGROUP\n"; string(content) != want {
+		t.Errorf("credentials content = %q, want %q", content, want)
+	}
+
+	if err := writeSMBCredentials(path, "user", "bad\npassword", ""); err == nil {
+		t.Errorf("writeSMBCredentials() with line break expected error")
+	}
+
+	removeSMBCredentials("vol-1")
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("removeSMBCredentials() left %s behind", path)
+	}
+}
@@ -0,0 +1,47 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+)
+
+// ReportConsumedSnapshotSize reports the space consumed by the snapshots as their size,
+// when DSM tells it, instead of the size of their source volume. The CO takes the size
+// of a snapshot as the least size of the volumes restored from it, which still have to
+// be as large as the source volume.
+var ReportConsumedSnapshotSize = false
+
+// csiSnapshot returns the CSI snapshot of a snapshot of DSM, ready once DSM completed it
+func csiSnapshot(snapshot *models.K8sSnapshotRespSpec) *csi.Snapshot {
+	size := snapshot.SizeInBytes
+	if ReportConsumedSnapshotSize && snapshot.UsedSizeInBytes > 0 {
+		size = snapshot.UsedSizeInBytes
+	}
+	return &csi.Snapshot{
+		SizeBytes:      size,
+		SnapshotId:     snapshot.Uuid,
+		SourceVolumeId: snapshot.SourceVolumeId(),
+		CreationTime:   timestamppb.New(time.Unix(snapshot.CreateTime, 0)),
+		ReadyToUse:     snapshot.IsReady(),
+	}
+}
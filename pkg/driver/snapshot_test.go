@@ -0,0 +1,78 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+)
+
+func TestCreateSnapshot_readyAndSize(t *testing.T) {
+	defer func(report bool) { ReportConsumedSnapshotSize = report }(ReportConsumedSnapshotSize)
+
+	dsmService := newFakeDsmService()
+	snapshot := &models.K8sSnapshotRespSpec{
+		Name: "snapshot-1", Uuid: "uuid-snapshot-1", ParentUuid: "vol-1", Status: "Creating",
+		SizeInBytes: 1 << 30, UsedSizeInBytes: 1 << 20,
+	}
+	dsmService.snapshots[snapshot.Uuid] = snapshot
+	cs := newTestControllerServer(dsmService)
+	req := &csi.CreateSnapshotRequest{SourceVolumeId: "vol-1", Name: "snapshot-1"}
+
+	tests := []struct {
+		name      string
+		status    string
+		consumed  bool
+		wantSize  int64
+		wantReady bool
+	}{
+		{name: "processing", status: "Creating", wantSize: 1 << 30, wantReady: false},
+		{name: "complete", status: "Healthy", wantSize: 1 << 30, wantReady: true},
+		{name: "consumed size", status: "Healthy", consumed: true, wantSize: 1 << 20, wantReady: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			snapshot.Status = tt.status
+			ReportConsumedSnapshotSize = tt.consumed
+
+			resp, err := cs.CreateSnapshot(context.Background(), req)
+			if err != nil {
+				t.Fatalf("CreateSnapshot() error = %v", err)
+			}
+			if got := resp.Snapshot; got.SizeBytes != tt.wantSize || got.ReadyToUse != tt.wantReady {
+				t.Errorf("CreateSnapshot() size = %d, ready = %v, want %d, %v", got.SizeBytes, got.ReadyToUse, tt.wantSize, tt.wantReady)
+			}
+		})
+	}
+	if len(dsmService.snapSpecs) != 0 {
+		t.Errorf("CreateSnapshot() created %d snapshots, want the existing one returned", len(dsmService.snapSpecs))
+	}
+}
+
+func TestCsiSnapshot_unknownConsumedSize(t *testing.T) {
+	defer func(report bool) { ReportConsumedSnapshotSize = report }(ReportConsumedSnapshotSize)
+	ReportConsumedSnapshotSize = true
+
+	got := csiSnapshot(&models.K8sSnapshotRespSpec{Uuid: "snap", SizeInBytes: 1 << 30, Status: "Healthy"})
+	if got.SizeBytes != 1<<30 {
+		t.Errorf("csiSnapshot() size = %d, want the volume size when DSM doesn't tell the consumed one", got.SizeBytes)
+	}
+}
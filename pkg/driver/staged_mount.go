@@ -0,0 +1,75 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/mount-utils"
+)
+
+// procMountsPath lists the mounts of the mount namespace of the node server
+var procMountsPath = "/proc/mounts"
+
+// samePath tells if two paths are the same once cleaned and their links followed
+func samePath(a string, b string) bool {
+	if filepath.Clean(a) == filepath.Clean(b) {
+		return true
+	}
+	resolvedA, errA := filepath.EvalSymlinks(a)
+	resolvedB, errB := filepath.EvalSymlinks(b)
+	return errA == nil && errB == nil && resolvedA == resolvedB
+}
+
+// findStagedMount returns the mount of stagingPath, the last one as it hides the earlier
+// ones, nil if nothing is mounted there
+func findStagedMount(mounts []mount.MountPoint, stagingPath string) *mount.MountPoint {
+	var found *mount.MountPoint
+	for i := range mounts {
+		if samePath(mounts[i].Path, stagingPath) {
+			found = &mounts[i]
+		}
+	}
+	return found
+}
+
+// checkStagedMount tells if devPath is already mounted at stagingPath with fsType, e.g. by
+// a NodeStageVolume retried by kubelet. Another device or filesystem mounted there fails
+// the stage rather than being mounted over.
+func checkStagedMount(stagingPath string, devPath string, fsType string) (bool, error) {
+	mounts, err := mount.ListProcMounts(procMountsPath)
+	if err != nil {
+		return false, status.Error(codes.Internal, fmt.Sprintf("Failed to list the mounts of %s: %v", procMountsPath, err))
+	}
+
+	staged := findStagedMount(mounts, stagingPath)
+	if staged == nil {
+		return false, nil
+	}
+	if !samePath(staged.Device, devPath) {
+		return false, status.Error(codes.FailedPrecondition,
+			fmt.Sprintf("Staging path %s already has %s mounted instead of %s", stagingPath, staged.Device, devPath))
+	}
+	if staged.Type != fsType {
+		return false, status.Error(codes.FailedPrecondition,
+			fmt.Sprintf("Staging path %s already has %s mounted as %s instead of %s", stagingPath, devPath, staged.Type, fsType))
+	}
+	return true, nil
+}
@@ -0,0 +1,115 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestCheckStagedMount(t *testing.T) {
+	dir := t.TempDir()
+	device := filepath.Join(dir, "sdb")
+	other := filepath.Join(dir, "sdc")
+	byPath := filepath.Join(dir, "ip-10.0.0.1:3260-iscsi-iqn.2000-01.com.synology:pvc-1-lun-1")
+	for _, dev := range []string{device, other} {
+		if err := os.WriteFile(dev, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(device, byPath); err != nil {
+		t.Fatal(err)
+	}
+	staging := "/var/lib/kubelet/plugins/kubernetes.io/csi/csi.san.synology.com/abc/globalmount"
+
+	tests := []struct {
+		name       string
+		mounts     string
+		path       string // the staging path if empty
+		devPath    string
+		fsType     string
+		wantStaged bool
+		wantCode   codes.Code
+	}{
+		{
+			name:    "not staged",
+			mounts:  "/dev/sda1 / ext4 rw,relatime 0 0\nproc /proc proc rw 0 0\n",
+			devPath: byPath, fsType: "ext4",
+		},
+		{
+			name:    "already staged",
+			mounts:  fmt.Sprintf("/dev/sda1 / ext4 rw 0 0\n%s %s ext4 rw,relatime 0 0\n", device, staging),
+			devPath: byPath, fsType: "ext4", wantStaged: true,
+		},
+		{
+			name:    "staged with a trailing slash",
+			mounts:  fmt.Sprintf("%s %s xfs rw 0 0\n", device, staging),
+			path:    staging + "/",
+			devPath: device, fsType: "xfs", wantStaged: true,
+		},
+		{
+			name:    "wrong device",
+			mounts:  fmt.Sprintf("%s %s ext4 rw 0 0\n", other, staging),
+			devPath: byPath, fsType: "ext4", wantCode: codes.FailedPrecondition,
+		},
+		{
+			name:    "wrong filesystem",
+			mounts:  fmt.Sprintf("%s %s xfs rw 0 0\n", device, staging),
+			devPath: byPath, fsType: "ext4", wantCode: codes.FailedPrecondition,
+		},
+		{
+			name:    "hidden by a later mount",
+			mounts:  fmt.Sprintf("%s %s ext4 rw 0 0\n%s %s ext4 rw 0 0\n", device, staging, other, staging),
+			devPath: byPath, fsType: "ext4", wantCode: codes.FailedPrecondition,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func(path string) { procMountsPath = path }(procMountsPath)
+			procMountsPath = filepath.Join(t.TempDir(), "mounts")
+			if err := os.WriteFile(procMountsPath, []byte(tt.mounts), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			path := tt.path
+			if path == "" {
+				path = staging
+			}
+			staged, err := checkStagedMount(path, tt.devPath, tt.fsType)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("checkStagedMount() code = %v, want %v (err: %v)", code, tt.wantCode, err)
+			}
+			if staged != tt.wantStaged {
+				t.Errorf("checkStagedMount() = %v, want %v", staged, tt.wantStaged)
+			}
+		})
+	}
+}
+
+func TestCheckStagedMount_unreadable(t *testing.T) {
+	defer func(path string) { procMountsPath = path }(procMountsPath)
+	procMountsPath = filepath.Join(t.TempDir(), "missing")
+
+	if _, err := checkStagedMount("/staging", "/dev/sdb", "ext4"); status.Code(err) != codes.Internal {
+		t.Errorf("checkStagedMount() error = %v, want Internal", err)
+	}
+}
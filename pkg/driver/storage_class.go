@@ -0,0 +1,200 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+// ParameterError is an invalid parameter of a StorageClass
+type ParameterError struct {
+	Parameter string
+	Err       error
+}
+
+func (e ParameterError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Parameter, e.Err)
+}
+
+func (e ParameterError) Unwrap() error {
+	return e.Err
+}
+
+// ParameterErrors are all the invalid parameters of a StorageClass
+type ParameterErrors []ParameterError
+
+func (errs ParameterErrors) Error() string {
+	msgs := make([]string, 0, len(errs))
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	return "Invalid StorageClass parameters: " + strings.Join(msgs, "; ")
+}
+
+// ValidateStorageClassParameters checks the parameters of a StorageClass of the driver
+// without asking DSM, e.g. whether the location exists, so it can also be run by an
+// admission webhook. The error is a ParameterErrors with every invalid parameter.
+func ValidateStorageClassParameters(params map[string]string) error {
+	var errs ParameterErrors
+	check := func(param string, err error) {
+		if err != nil {
+			errs = append(errs, ParameterError{Parameter: param, Err: err})
+		}
+	}
+
+	// the checks depending on the protocol are skipped if it is unsupported
+	protocol := strings.ToLower(params["protocol"])
+	if protocol == "" {
+		protocol = utils.ProtocolDefault
+	} else if !isProtocolSupport(protocol) {
+		check("protocol", fmt.Errorf("Unsupported volume protocol: %s", params["protocol"]))
+		protocol = ""
+	}
+	isIscsi := protocol == utils.ProtocolIscsi
+
+	isThin := true
+	if params["thin_provisioning"] != "" {
+		isThin = utils.StringToBoolean(params["thin_provisioning"])
+	}
+	snapshots := utils.StringToBoolean(params["requireSnapshots"])
+	if lunType := strings.ToUpper(params["type"]); lunType != "" {
+		if thin, err := models.IsThinLunType(lunType); err != nil {
+			check("type", err)
+		} else if params["thin_provisioning"] != "" && thin != isThin {
+			check("type", fmt.Errorf("LUN type %s contradicts thin_provisioning: %s", lunType, params["thin_provisioning"]))
+		} else {
+			isThin = thin
+		}
+		if snapshots && !models.LunTypeSupportsSnapshots(lunType) {
+			check("requireSnapshots", fmt.Errorf("LUN type %s doesn't support snapshots", lunType))
+		}
+	}
+	if snapshots && protocol != "" && !isIscsi {
+		check("requireSnapshots", fmt.Errorf("requireSnapshots is only supported by the iSCSI protocol"))
+	}
+
+	// whether the DSM has the volume is checked by CreateVolume
+	if location := params["location"]; location != "" && !strings.HasPrefix(location, "/") {
+		check("location", fmt.Errorf("Invalid location %s, must be the path of a DSM volume, e.g. /volume1", location))
+	}
+
+	formatOptions := params["formatOptions"]
+	if mkfsOptions, ok := params["mkfsOptions"]; ok {
+		if formatOptions != "" && formatOptions != mkfsOptions {
+			check("mkfsOptions", fmt.Errorf("formatOptions and mkfsOptions are both set and differ"))
+		}
+		formatOptions = mkfsOptions
+	}
+	if _, err := parseFormatOptions(formatOptions); err != nil {
+		check("formatOptions", err)
+	}
+	if isIscsi {
+		if _, err := parseFsType(params["fsType"]); err != nil {
+			check("fsType", err)
+		}
+		if _, err := ParseFsckMode(params["fsckMode"]); err != nil {
+			check("fsckMode", err)
+		}
+	}
+	if mountPermissions := params["mountPermissions"]; mountPermissions != "" {
+		if _, err := strconv.ParseUint(mountPermissions, 8, 32); err != nil {
+			check("mountPermissions", fmt.Errorf("Invalid mountPermissions %s, must be an octal mode", mountPermissions))
+		}
+	}
+
+	if utils.StringToBoolean(params["enableChap"]) && protocol != "" && !isIscsi {
+		check("enableChap", fmt.Errorf("enableChap is only supported by the iSCSI protocol"))
+	}
+	if utils.StringToBoolean(params[shareEncryptionParam]) && isIscsi {
+		check(shareEncryptionParam, fmt.Errorf("encryption is only supported by the SMB and NFS protocols"))
+	}
+	if protocol != "" {
+		// one at a time to tell which of the limits is invalid
+		for _, key := range []string{"maxIops", "maxThroughputMBps"} {
+			if params[key] != "" {
+				_, err := parseLunQos(map[string]string{key: params[key]}, protocol)
+				check(key, err)
+			}
+		}
+		_, err := parseLunBlockSize(params, protocol)
+		check("blockSize", err)
+	}
+	if params["enableSpaceReclamation"] != "" {
+		spaceReclamation := utils.StringToBoolean(params["enableSpaceReclamation"])
+		if spaceReclamation && !isThin {
+			check("enableSpaceReclamation", fmt.Errorf("Invalid provisioning type: space reclamation only supported for thin LUNs"))
+		}
+	}
+	if utils.StringToBoolean(params["discard"]) && !utils.StringToBoolean(params["enableSpaceReclamation"]) {
+		check("discard", fmt.Errorf("discard needs enableSpaceReclamation"))
+	}
+
+	if tmpl := params["lunNameTemplate"]; tmpl != "" && isIscsi {
+		vars := lunNameVars{PVCName: "pvc", PVCNamespace: "default", PVName: "pvc-0", Suffix: lunNameSuffix("pvc-0")}
+		_, err := renderLunName(tmpl, vars)
+		check("lunNameTemplate", err)
+	}
+
+	if protocol == utils.ProtocolNfs {
+		_, err := parseNfsMountOptions(params)
+		check("mountOptions", err)
+	}
+	for _, key := range []string{nfsRootSquashKey, nfsClientsKey} {
+		if params[key] != "" {
+			_, err := parseNfsExportOptions(map[string]string{key: params[key]})
+			check(key, err)
+		}
+	}
+	if protocol != "" && protocol != utils.ProtocolNfs {
+		for _, key := range nfsExportKeys {
+			if params[key] != "" {
+				check(key, fmt.Errorf("NFS export options are only supported by the NFS protocol"))
+			}
+		}
+	}
+
+	minSize, minErr := parseVolumeSize(params[minVolumeSizeParam])
+	check(minVolumeSizeParam, minErr)
+	maxSize, maxErr := parseVolumeSize(params[maxVolumeSizeParam])
+	check(maxVolumeSizeParam, maxErr)
+	if minErr == nil && maxErr == nil && maxSize > 0 && minSize > maxSize {
+		check(minVolumeSizeParam, fmt.Errorf("%s is larger than %s", params[minVolumeSizeParam], params[maxVolumeSizeParam]))
+	}
+
+	if params[parentShareParam] != "" {
+		if protocol != "" && protocol != utils.ProtocolNfs {
+			check(parentShareParam, fmt.Errorf("Subdirectory volumes are only supported by the NFS protocol"))
+		}
+		if utils.StringToBoolean(params[shareEncryptionParam]) {
+			check(shareEncryptionParam, fmt.Errorf("Subdirectory volumes are encrypted by their parent share"))
+		}
+		_, err := parseSubDirOnDelete(params)
+		check(subDirOnDeleteParam, err)
+	} else if params[subDirOnDeleteParam] != "" {
+		check(subDirOnDeleteParam, fmt.Errorf("%s needs %s", subDirOnDeleteParam, parentShareParam))
+	}
+
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestValidateStorageClassParameters(t *testing.T) {
+	tests := []struct {
+		name      string
+		params    map[string]string
+		wantParam string // empty if valid
+	}{
+		{name: "unset", params: map[string]string{}},
+		{
+			name: "all valid iscsi",
+			params: map[string]string{"protocol": "iscsi", "location": "/volume1", "fsType": "xfs", "fsckMode": "on-dirty",
+				"type": "BLUN", "requireSnapshots": "true", "formatOptions": "-m 0", "mountPermissions": "0750",
+				"enableChap": "true", "maxIops": "500", "maxThroughputMBps": "100", "blockSize": "4096",
+				"enableSpaceReclamation": "true", "discard": "true", "lunNameTemplate": "{{.PVCNamespace}}-{{.PVCName}}"},
+		},
+		{
+			name: "all valid nfs",
+			params: map[string]string{"protocol": "nfs", "location": "/volume2", "mountOptions": "hard, noatime", "nfsvers": "4.1",
+				"nfsClients": "10.0.0.0/24", "nfsRootSquash": "root_to_guest", "mountPermissions": "755"},
+		},
+		{name: "protocol", params: map[string]string{"protocol": "iscsi2"}, wantParam: "protocol"},
+		{name: "location", params: map[string]string{"location": "volume1"}, wantParam: "location"},
+		{name: "fsType", params: map[string]string{"fsType": "zfs"}, wantParam: "fsType"},
+		{name: "fsckMode", params: map[string]string{"fsckMode": "sometimes"}, wantParam: "fsckMode"},
+		{name: "unknown type", params: map[string]string{"type": "FOO"}, wantParam: "type"},
+		{name: "thick type of thin", params: map[string]string{"type": "BLUN_THICK", "thin_provisioning": "true"}, wantParam: "type"},
+		{name: "snapshots of type", params: map[string]string{"type": "THIN", "requireSnapshots": "true"}, wantParam: "requireSnapshots"},
+		{name: "snapshots of share", params: map[string]string{"protocol": "smb", "requireSnapshots": "true"}, wantParam: "requireSnapshots"},
+		{name: "formatOptions", params: map[string]string{"formatOptions": "-E $(reboot)"}, wantParam: "formatOptions"},
+		{name: "mkfsOptions differ", params: map[string]string{"formatOptions": "-m 0", "mkfsOptions": "-m 1"}, wantParam: "mkfsOptions"},
+		{name: "mountPermissions", params: map[string]string{"mountPermissions": "0789"}, wantParam: "mountPermissions"},
+		{name: "chap of share", params: map[string]string{"protocol": "nfs", "enableChap": "true"}, wantParam: "enableChap"},
+		{name: "maxIops", params: map[string]string{"maxIops": "-1"}, wantParam: "maxIops"},
+		{name: "maxThroughputMBps", params: map[string]string{"maxThroughputMBps": "1G"}, wantParam: "maxThroughputMBps"},
+		{name: "qos of share", params: map[string]string{"protocol": "smb", "maxIops": "500"}, wantParam: "maxIops"},
+		{name: "blockSize", params: map[string]string{"blockSize": "1024"}, wantParam: "blockSize"},
+		{name: "space reclamation of thick", params: map[string]string{"thin_provisioning": "false", "enableSpaceReclamation": "true"},
+			wantParam: "enableSpaceReclamation"},
+		{name: "discard", params: map[string]string{"discard": "true"}, wantParam: "discard"},
+		{name: "lunNameTemplate", params: map[string]string{"lunNameTemplate": "{{.Cluster}}"}, wantParam: "lunNameTemplate"},
+		{name: "mountOptions", params: map[string]string{"protocol": "nfs", "mountOptions": "soft,hard"}, wantParam: "mountOptions"},
+		{name: "nfsClients", params: map[string]string{"protocol": "nfs", "nfsClients": "node-1"}, wantParam: "nfsClients"},
+		{name: "nfsRootSquash", params: map[string]string{"protocol": "nfs", "nfsRootSquash": "root"}, wantParam: "nfsRootSquash"},
+		{name: "export of lun", params: map[string]string{"nfsReadOnly": "true"}, wantParam: "nfsReadOnly"},
+		{name: "size limits", params: map[string]string{"minVolumeSize": "5Gi", "maxVolumeSize": "1Ti"}},
+		{name: "minVolumeSize", params: map[string]string{"minVolumeSize": "0"}, wantParam: "minVolumeSize"},
+		{name: "maxVolumeSize", params: map[string]string{"maxVolumeSize": "lots"}, wantParam: "maxVolumeSize"},
+		{name: "min above max", params: map[string]string{"minVolumeSize": "10Gi", "maxVolumeSize": "5Gi"}, wantParam: "minVolumeSize"},
+		{name: "subdir", params: map[string]string{"protocol": "nfs", "parentShare": "k8s", "subDirOnDelete": "retain"}},
+		{name: "subdir of lun", params: map[string]string{"parentShare": "k8s"}, wantParam: "parentShare"},
+		{name: "subDirOnDelete", params: map[string]string{"protocol": "nfs", "parentShare": "k8s", "subDirOnDelete": "archive"}, wantParam: "subDirOnDelete"},
+		{name: "subDirOnDelete without parentShare", params: map[string]string{"protocol": "nfs", "subDirOnDelete": "retain"}, wantParam: "subDirOnDelete"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := ValidateStorageClassParameters(tt.params)
+			if tt.wantParam == "" {
+				if err != nil {
+					t.Fatalf("ValidateStorageClassParameters() error = %v, want nil", err)
+				}
+				return
+			}
+			var errs ParameterErrors
+			if !errors.As(err, &errs) || len(errs) != 1 || errs[0].Parameter != tt.wantParam {
+				t.Fatalf("ValidateStorageClassParameters() error = %v, want an error of %s only", err, tt.wantParam)
+			}
+		})
+	}
+}
+
+func TestValidateStorageClassParameters_aggregated(t *testing.T) {
+	params := map[string]string{"location": "volume1", "fsType": "zfs", "maxIops": "-1", "discard": "true"}
+
+	err := ValidateStorageClassParameters(params)
+	var errs ParameterErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("ValidateStorageClassParameters() error = %v, want ParameterErrors", err)
+	}
+	got := []string{}
+	for _, e := range errs {
+		got = append(got, e.Parameter)
+	}
+	if want := []string{"location", "fsType", "maxIops", "discard"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("ValidateStorageClassParameters() invalid parameters = %v, want %v", got, want)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "fsType: Unsupported fsType: zfs") || !strings.Contains(msg, "; maxIops: ") {
+		t.Errorf("ValidateStorageClassParameters() error = %q, want every invalid parameter", msg)
+	}
+}
+
+func TestValidateStorageClassParameters_unsupportedProtocol(t *testing.T) {
+	// the checks of the protocol are skipped, it is the only error
+	params := map[string]string{"protocol": "fc", "enableChap": "true", "blockSize": "512", "nfsRootSquash": "root_to_admin"}
+
+	var errs ParameterErrors
+	if err := ValidateStorageClassParameters(params); !errors.As(err, &errs) || len(errs) != 1 || errs[0].Parameter != "protocol" {
+		t.Errorf("ValidateStorageClassParameters() error = %v, want an error of protocol only", err)
+	}
+}
+
+func TestCreateVolume_invalidParameters(t *testing.T) {
+	dsmService := newFakeDsmService()
+	cs := newTestControllerServer(dsmService)
+
+	params := map[string]string{"fsType": "zfs", "mountPermissions": "rwx"}
+	_, err := cs.CreateVolume(context.Background(), newCreateVolumeRequest("pvc-invalid", params))
+	if code := status.Code(err); code != codes.InvalidArgument {
+		t.Fatalf("CreateVolume() code = %v, want %v (err: %v)", code, codes.InvalidArgument, err)
+	}
+	if msg := status.Convert(err).Message(); !strings.Contains(msg, "fsType") || !strings.Contains(msg, "mountPermissions") {
+		t.Errorf("CreateVolume() error = %q, want both invalid parameters", msg)
+	}
+	if len(dsmService.created) != 0 {
+		t.Errorf("CreateVolume() created %d volumes with invalid parameters", len(dsmService.created))
+	}
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// TopologyKeySite is the topology segment of the nodes and DSMs of a site
+const TopologyKeySite = "topology.synology.csi/site"
+
+// siteTopology returns the topology of site, nil if it is empty
+func siteTopology(site string) []*csi.Topology {
+	if site == "" {
+		return nil
+	}
+	return []*csi.Topology{{Segments: map[string]string{TopologyKeySite: site}}}
+}
+
+// requirementSites returns the sites of the requirement, the preferred ones first.
+// Topologies without a site don't restrict the DSMs a volume can be placed in.
+func requirementSites(req *csi.TopologyRequirement) []string {
+	sites := []string{}
+	seen := map[string]bool{}
+	for _, topology := range append(append([]*csi.Topology{}, req.GetPreferred()...), req.GetRequisite()...) {
+		site, ok := topology.GetSegments()[TopologyKeySite]
+		if !ok || seen[site] {
+			continue
+		}
+		seen[site] = true
+		sites = append(sites, site)
+	}
+	return sites
+}
+
+// volumeTopology returns the topology of the DSM a volume is on
+func (cs *controllerServer) volumeTopology(ctx context.Context, dsmIp string) []*csi.Topology {
+	dsm, err := cs.dsmService.GetDsm(dsmIp)
+	if err != nil {
+		return nil
+	}
+	return siteTopology(dsm.Site)
+}
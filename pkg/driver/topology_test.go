@@ -0,0 +1,118 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+)
+
+func siteSegment(site string) *csi.Topology {
+	return &csi.Topology{Segments: map[string]string{TopologyKeySite: site}}
+}
+
+func TestRequirementSites(t *testing.T) {
+	tests := []struct {
+		name string
+		req  *csi.TopologyRequirement
+		want []string
+	}{
+		{name: "none", want: []string{}},
+		{
+			name: "requisite",
+			req:  &csi.TopologyRequirement{Requisite: []*csi.Topology{siteSegment("east"), siteSegment("west")}},
+			want: []string{"east", "west"},
+		},
+		{
+			name: "preferred first",
+			req: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{siteSegment("east"), siteSegment("west")},
+				Preferred: []*csi.Topology{siteSegment("west")},
+			},
+			want: []string{"west", "east"},
+		},
+		{
+			name: "nodes without site",
+			req: &csi.TopologyRequirement{
+				Requisite: []*csi.Topology{{Segments: map[string]string{"kubernetes.io/hostname": "node-1"}}},
+			},
+			want: []string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := requirementSites(tt.req); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("requirementSites() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCreateVolume_topology(t *testing.T) {
+	dsmService := newFakeDsmService()
+	dsmService.dsms["10.0.0.1"] = &webapi.DSM{Ip: "10.0.0.1", Site: "west"}
+	cs := newTestControllerServer(dsmService)
+
+	req := newCreateVolumeRequest("pvc-1", map[string]string{"protocol": "iscsi"})
+	req.AccessibilityRequirements = &csi.TopologyRequirement{
+		Requisite: []*csi.Topology{siteSegment("east"), siteSegment("west")},
+		Preferred: []*csi.Topology{siteSegment("west")},
+	}
+
+	resp, err := cs.CreateVolume(context.Background(), req)
+	if err != nil {
+		t.Fatalf("CreateVolume() error = %v", err)
+	}
+	if got := dsmService.created[0].Sites; !reflect.DeepEqual(got, []string{"west", "east"}) {
+		t.Errorf("CreateVolume() sites = %v, want [west east]", got)
+	}
+	if got := resp.Volume.AccessibleTopology; !reflect.DeepEqual(got, []*csi.Topology{siteSegment("west")}) {
+		t.Errorf("CreateVolume() accessible topology = %v", got)
+	}
+
+	// a DSM without site is reachable from every node
+	dsmService.dsms["10.0.0.1"].Site = ""
+	resp, err = cs.CreateVolume(context.Background(), newCreateVolumeRequest("pvc-2", map[string]string{"protocol": "iscsi"}))
+	if err != nil {
+		t.Fatalf("CreateVolume() error = %v", err)
+	}
+	if len(resp.Volume.AccessibleTopology) != 0 {
+		t.Errorf("CreateVolume() accessible topology = %v, want none", resp.Volume.AccessibleTopology)
+	}
+}
+
+func TestNodeGetInfo_topology(t *testing.T) {
+	defer func(site string) { NodeSite = site }(NodeSite)
+	ns := &nodeServer{Driver: &Driver{nodeID: "node-1"}}
+
+	NodeSite = ""
+	resp, _ := ns.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	if resp.AccessibleTopology != nil {
+		t.Errorf("NodeGetInfo() topology = %v, want nil", resp.AccessibleTopology)
+	}
+
+	NodeSite = "east"
+	resp, _ = ns.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+	if !reflect.DeepEqual(resp.AccessibleTopology, siteSegment("east")) {
+		t.Errorf("NodeGetInfo() topology = %v, want site east", resp.AccessibleTopology)
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"google.golang.org/grpc"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/common"
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/service"
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+	"github.com/SynologyOpenSource/synology-csi/pkg/tracing"
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+func TestTraceGRPC_createVolume(t *testing.T) {
+	vol := webapi.VolInfo{Path: "/volume1", Status: "normal", FsType: models.FsTypeBtrfs, Size: "10737418240", Free: "10737418240"}
+	luns := []webapi.LunInfo{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		var data interface{}
+		switch query.Get("api") + "." + query.Get("method") {
+		case "SYNO.API.Auth.login":
+			data = map[string]string{"sid": "sid"}
+		case "SYNO.Core.Storage.Volume.list":
+			data = map[string]interface{}{"volumes": []webapi.VolInfo{vol}}
+		case "SYNO.Core.Storage.Volume.get":
+			data = map[string]interface{}{"volume": vol}
+		case "SYNO.Core.ISCSI.LUN.list":
+			data = map[string]interface{}{"luns": luns}
+		case "SYNO.Core.ISCSI.LUN.create":
+			luns = append(luns, webapi.LunInfo{Name: query.Get("name"), Uuid: "lun-uuid", Location: "/volume1", Size: uint64(utils.UNIT_GB)})
+			data = map[string]string{"uuid": "lun-uuid"}
+		case "SYNO.Core.ISCSI.LUN.get":
+			if len(luns) > 0 {
+				data = map[string]interface{}{"lun": luns[0]}
+			}
+		case "SYNO.Core.ISCSI.Target.create":
+			data = map[string]interface{}{"target_id": 1}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "data": data})
+	}))
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+
+	dsmService := service.NewDsmService()
+	if err := dsmService.AddDsm(common.ClientInfo{Host: host, Port: p}); err != nil {
+		t.Fatalf("AddDsm() error = %v", err)
+	}
+	cs := newTestControllerServer(dsmService)
+
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	previous := otel.GetTracerProvider()
+	tracing.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(previous)
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/CreateVolume"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return cs.CreateVolume(ctx, req.(*csi.CreateVolumeRequest))
+	}
+	if _, err := traceGRPC(context.Background(), newCreateVolumeRequest("pvc-1", nil), info, handler); err != nil {
+		t.Fatalf("CreateVolume() error = %v", err)
+	}
+
+	spans := exporter.GetSpans()
+	var root *tracetest.SpanStub
+	for i := range spans {
+		if spans[i].Name == "csi.v1.Controller/CreateVolume" {
+			root = &spans[i]
+		}
+	}
+	if root == nil {
+		t.Fatalf("no CreateVolume span in %d spans", len(spans))
+	}
+	if root.Parent.IsValid() {
+		t.Errorf("CreateVolume span has parent %v, want a root span", root.Parent)
+	}
+	if !hasAttribute(root.Attributes, tracing.AttrVolumeName.String("pvc-1")) {
+		t.Errorf("CreateVolume span attributes = %v, want the volume name", root.Attributes)
+	}
+
+	created := false
+	for _, span := range spans {
+		if span.Name == root.Name {
+			continue
+		}
+		if span.Parent.SpanID() != root.SpanContext.SpanID() || span.SpanContext.TraceID() != root.SpanContext.TraceID() {
+			t.Errorf("span %s isn't a child of CreateVolume", span.Name)
+		}
+		if !hasAttribute(span.Attributes, tracing.AttrDsmHost.String(host)) {
+			t.Errorf("span %s attributes = %v, want the DSM host", span.Name, span.Attributes)
+		}
+		if span.Name == "SYNO.Core.ISCSI.LUN create" {
+			created = true
+			if !hasAttribute(span.Attributes, tracing.AttrDsmApi.String("SYNO.Core.ISCSI.LUN")) {
+				t.Errorf("span %s attributes = %v, want the API name", span.Name, span.Attributes)
+			}
+		}
+	}
+	if !created {
+		t.Errorf("no span of the LUN creation among %v", spanNames(spans))
+	}
+}
+
+func hasAttribute(attrs []attribute.KeyValue, want attribute.KeyValue) bool {
+	for _, attr := range attrs {
+		if attr == want {
+			return true
+		}
+	}
+	return false
+}
+
+func spanNames(spans tracetest.SpanStubs) []string {
+	names := []string{}
+	for _, span := range spans {
+		names = append(names, span.Name)
+	}
+	return names
+}
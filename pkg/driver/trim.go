@@ -0,0 +1,65 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+// withDiscard adds the discard mount option, so deleted blocks are unmapped on the LUN right away
+func withDiscard(options []string, discard bool) []string {
+	if !discard || utils.SliceContains(options, "discard") || utils.SliceContains(options, "nodiscard") {
+		return options
+	}
+	return append(options, "discard")
+}
+
+// fstrim unmaps the unused blocks of the filesystem mounted at mountPath
+func (t *tools) fstrim(mountPath string) error {
+	out, err := t.executor.Command("fstrim", "-v", mountPath).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("fstrim failed: %s (%w)", strings.TrimSpace(string(out)), err)
+	}
+	log.Infof("%s", strings.TrimSpace(string(out)))
+	return nil
+}
+
+// trimVolumes runs fstrim on the staged volumes with space reclamation and no discard mount option
+func (ns *nodeServer) trimVolumes() {
+	for volumeId, staged := range ns.state.list() {
+		if !staged.Trim || staged.MountPath == "" {
+			continue
+		}
+		if err := ns.tools.fstrim(staged.MountPath); err != nil {
+			log.Warnf("Failed to trim volume[%s] at %s: %v", volumeId, staged.MountPath, err)
+		}
+	}
+}
+
+// runFstrim trims the staged volumes every interval
+func (ns *nodeServer) runFstrim(interval time.Duration) {
+	log.Infof("Trimming volumes with space reclamation every %v", interval)
+	for range time.Tick(interval) {
+		ns.trimVolumes()
+	}
+}
@@ -0,0 +1,59 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils/hostexec"
+)
+
+func TestWithDiscard(t *testing.T) {
+	tests := []struct {
+		name    string
+		options []string
+		discard bool
+		want    []string
+	}{
+		{"disabled", []string{"rw"}, false, []string{"rw"}},
+		{"enabled", []string{"rw"}, true, []string{"rw", "discard"}},
+		{"already set", []string{"rw", "discard"}, true, []string{"rw", "discard"}},
+		{"nodiscard mount flag", []string{"rw", "nodiscard"}, true, []string{"rw", "nodiscard"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := withDiscard(tt.options, tt.discard); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("withDiscard() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTrimVolumes(t *testing.T) {
+	fake := hostexec.NewFake(nil, "/host")
+	ns := &nodeServer{
+		tools: NewTools(fake),
+		state: newNodeState(filepath.Join(t.TempDir(), "volumes.json")),
+	}
+	ns.state.put("trimmed", stagedVolume{MountPath: "/staging/trimmed", Trim: true})
+	ns.state.put("discard", stagedVolume{MountPath: "/staging/discard"})
+
+	ns.trimVolumes()
+	assertInvocations(t, fake, [][]string{{"fstrim", "-v", "/staging/trimmed"}})
+}
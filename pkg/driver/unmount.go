@@ -0,0 +1,83 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// unmountBusyDelay is the wait before the first retry of a busy unmount, doubled for each
+// of the next ones
+var unmountBusyDelay = time.Second
+
+// isBusyUnmount tells if an unmount failed because the mount is still in use, e.g. by a
+// process of the pod flushing its files. umount(8) only reports it in its output.
+func isBusyUnmount(err error) bool {
+	return errors.Is(err, syscall.EBUSY) || strings.Contains(strings.ToLower(err.Error()), "busy")
+}
+
+// lazyUnmount detaches the mount at path right away, the filesystem being unmounted once
+// no process uses it anymore
+func (t *tools) lazyUnmount(path string) error {
+	out, err := t.executor.Command("umount", "-l", path).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("umount -l failed: %s (%w)", strings.TrimSpace(string(out)), err)
+	}
+	return nil
+}
+
+// unmountStaging unmounts a staging path, retrying UnmountBusyRetries times while it is
+// busy. With LazyUnmount a mount still busy afterwards is detached lazily, and the logout
+// which follows waits LogoutGrace for its writes to reach the LUN. Busy mounts are
+// otherwise left mounted, so a process keeping a volume open isn't hidden.
+func (ns *nodeServer) unmountStaging(ctx context.Context, path string) error {
+	err := ns.Mounter.Interface.Unmount(path)
+	delay := unmountBusyDelay
+	for retry := 0; err != nil && isBusyUnmount(err) && retry < UnmountBusyRetries; retry++ {
+		log.WithContext(ctx).Infof("Staging path %s is busy, retrying the unmount in %v", path, delay)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return fmt.Errorf("%v, retries aborted: %w", err, ctx.Err())
+		}
+		delay *= 2
+		err = ns.Mounter.Interface.Unmount(path)
+	}
+	if err == nil || !isBusyUnmount(err) || !LazyUnmount {
+		return err
+	}
+
+	log.WithContext(ctx).Warnf("Staging path %s is still busy after %d retries, unmounting it lazily: %v", path, UnmountBusyRetries, err)
+	if err := ns.tools.lazyUnmount(path); err != nil {
+		return err
+	}
+	if LogoutGrace > 0 {
+		log.WithContext(ctx).Infof("Waiting %v for the writes to the lazily unmounted %s before logging out", LogoutGrace, path)
+		select {
+		case <-time.After(LogoutGrace):
+		case <-ctx.Done():
+		}
+	}
+	return nil
+}
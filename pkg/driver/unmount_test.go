@@ -0,0 +1,150 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/sys/unix"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"k8s.io/mount-utils"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils/hostexec"
+)
+
+func TestIsBusyUnmount(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{err: unix.EBUSY, want: true},
+		{err: errors.New("unmount failed: exit status 32\nOutput: umount: /staging: target is busy.\n"), want: true},
+		{err: unix.EINVAL},
+		{err: errors.New("umount: /staging: not mounted.")},
+	}
+	for _, tt := range tests {
+		if got := isBusyUnmount(tt.err); got != tt.want {
+			t.Errorf("isBusyUnmount(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestNodeUnstageVolume_busyMount(t *testing.T) {
+	defer func(delay, grace time.Duration, retries int, lazy bool) {
+		unmountBusyDelay, LogoutGrace, UnmountBusyRetries, LazyUnmount = delay, grace, retries, lazy
+	}(unmountBusyDelay, LogoutGrace, UnmountBusyRetries, LazyUnmount)
+	unmountBusyDelay, LogoutGrace, UnmountBusyRetries = time.Millisecond, 0, 3
+
+	const iqn = "iqn.2000-01.com.synology:k8s-csi-pvc-1"
+	// the staged device isn't found, then the session is logged out of
+	noSession := hostexec.FakeResult{}
+	session := hostexec.FakeResult{Output: []byte("tcp: [1] 10.0.0.1:3260,1 " + iqn + " (non-flash)\n")}
+	logout := []string{"iscsiadm", "-m", "node", "--targetname", iqn, "--logout"}
+
+	tests := []struct {
+		name      string
+		busy      int // unmounts failing with EBUSY
+		lazy      bool
+		results   []hostexec.FakeResult
+		wantCode  codes.Code
+		wantCmds  [][]string
+		wantLazy  bool
+		wantTries int
+	}{
+		{
+			name: "busy then unmounted", busy: 2,
+			results:  []hostexec.FakeResult{noSession, session, {}},
+			wantCode: codes.OK, wantTries: 3,
+			wantCmds: [][]string{{"iscsiadm", "-m", "session"}, {"iscsiadm", "-m", "session"}, logout},
+		},
+		{
+			// conservative by default, the busy mount stays and the session with it
+			name: "still busy", busy: 10,
+			wantCode: codes.Internal, wantTries: 4,
+		},
+		{
+			name: "lazy fallback", busy: 10, lazy: true,
+			results:  []hostexec.FakeResult{{}, noSession, session, {}},
+			wantCode: codes.OK, wantTries: 4, wantLazy: true,
+		},
+		{
+			name: "lazy unmount fails", busy: 10, lazy: true,
+			results:  []hostexec.FakeResult{{Output: []byte("umount: /staging: not mounted."), Err: errors.New("exit status 32")}},
+			wantCode: codes.Internal, wantTries: 4, wantLazy: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			LazyUnmount = tt.lazy
+			stagingPath := t.TempDir()
+
+			mounter := mount.NewFakeMounter([]mount.MountPoint{{Device: "/dev/sdb", Path: stagingPath}})
+			tries := 0
+			mounter.UnmountFunc = func(string) error {
+				tries++
+				if tries <= tt.busy {
+					return unix.EBUSY
+				}
+				return nil
+			}
+
+			fake := hostexec.NewFake(nil, "/host")
+			fake.Respond(tt.results...)
+			tools := NewTools(fake)
+			dataDir := t.TempDir()
+			ns := &nodeServer{
+				Mounter:   &mount.SafeFormatAndMount{Interface: mounter},
+				Initiator: &initiatorDriver{tools: tools},
+				tools:     tools,
+				sessions:  newSessionRefs(filepath.Join(dataDir, "sessions.json")),
+				state:     newNodeState(filepath.Join(dataDir, "volumes.json")),
+			}
+			ns.state.put("vol-1", stagedVolume{DsmIp: "10.0.0.1", TargetIqn: iqn, MountPath: stagingPath})
+
+			_, err := ns.NodeUnstageVolume(context.Background(), &csi.NodeUnstageVolumeRequest{
+				VolumeId:          "vol-1",
+				StagingTargetPath: stagingPath,
+			})
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("NodeUnstageVolume() code = %v, want %v (err: %v)", code, tt.wantCode, err)
+			}
+			if tries != tt.wantTries {
+				t.Errorf("unmount tried %d times, want %d", tries, tt.wantTries)
+			}
+
+			want := tt.wantCmds
+			if tt.wantLazy {
+				want = [][]string{{"umount", "-l", stagingPath}}
+				if err == nil {
+					// a lazily unmounted volume is still logged out of
+					want = append(want, []string{"iscsiadm", "-m", "session"}, []string{"iscsiadm", "-m", "session"}, logout)
+				}
+			}
+			assertInvocations(t, fake, want)
+
+			if _, staged := ns.state.get("vol-1"); staged != (err != nil) {
+				t.Errorf("NodeUnstageVolume() left the volume staged = %v", staged)
+			}
+		})
+	}
+}
@@ -22,15 +22,21 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/kubernetes-csi/csi-lib-utils/protosanitizer"
 	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
 	clientset "k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/mount-utils"
 	"k8s.io/utils/exec"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/logger"
+	"github.com/SynologyOpenSource/synology-csi/pkg/tracing"
 )
 
 func ParseEndpoint(ep string) (string, string, error) {
@@ -44,10 +50,15 @@ func ParseEndpoint(ep string) (string, string, error) {
 }
 
 func NewControllerServer(d *Driver) *controllerServer {
-	return &controllerServer{
+	cs := &controllerServer{
 		Driver:     d,
 		dsmService: d.DsmService,
 	}
+	if ProvisioningEvents {
+		cs.recorder = newEventRecorder(getK8sClient(), d.nodeID)
+		cs.failureEvents = newEventLimiter(provisioningEventInterval)
+	}
+	return cs
 }
 
 func getK8sClient() clientset.Interface {
@@ -64,7 +75,7 @@ func getK8sClient() clientset.Interface {
 }
 
 func NewNodeServer(d *Driver) *nodeServer {
-	return &nodeServer{
+	ns := &nodeServer{
 		Driver:     d,
 		dsmService: d.DsmService,
 		Mounter: &mount.SafeFormatAndMount{
@@ -76,9 +87,16 @@ func NewNodeServer(d *Driver) *nodeServer {
 			chapPassword: "",
 			tools:        d.tools,
 		},
-		Client: getK8sClient(),
-		tools:  d.tools,
+		Client:   getK8sClient(),
+		tools:    d.tools,
+		sessions: newSessionRefs(stateFilePath(sessionsStateFile)),
+		state:    newNodeState(stateFilePath(volumesStateFile)),
+	}
+	if InodeWarningThreshold > 0 {
+		ns.recorder = newEventRecorder(ns.Client, d.nodeID)
+		ns.inodeEvents = newEventLimiter(inodeEventInterval)
 	}
+	return ns
 }
 
 func NewIdentityServer(d *Driver) *identityServer {
@@ -111,21 +129,61 @@ func NewNodeServiceCapability(cap csi.NodeServiceCapability_RPC_Type) *csi.NodeS
 	}
 }
 
-func RunControllerandNodePublishServer(endpoint string, d *Driver, cs csi.ControllerServer, ns csi.NodeServer) {
+func RunControllerandNodePublishServer(endpoint string, d *Driver, cs csi.ControllerServer, ns csi.NodeServer) NonBlockingGRPCServer {
 	ids := NewIdentityServer(d)
 
 	s := NewNonBlockingGRPCServer()
 	s.Start(endpoint, ids, cs, ns)
+	return s
+}
+
+// requestIdMetadata is the gRPC metadata a caller can pass the correlation ID of a call in
+const requestIdMetadata = "x-request-id"
+
+// requestId returns the correlation ID of an RPC, the one of its metadata or a new one
+func requestId(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get(requestIdMetadata); len(ids) > 0 && ids[0] != "" {
+			return ids[0]
+		}
+	}
+	return logger.NewRequestId()
+}
+
+// traceGRPC wraps the RPCs in a span, a child of the one the caller sent if any
+func traceGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, span := tracing.Start(tracing.ExtractGRPC(ctx), strings.TrimPrefix(info.FullMethod, "/"), rpcAttributes(req)...)
+	resp, err := handler(ctx, req)
+	tracing.End(span, err)
+	return resp, err
+}
+
+// rpcAttributes returns the span attributes of the volume or snapshot a CSI request is for
+func rpcAttributes(req interface{}) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{}
+	if r, ok := req.(interface{ GetVolumeId() string }); ok && r.GetVolumeId() != "" {
+		attrs = append(attrs, tracing.AttrVolumeId.String(r.GetVolumeId()))
+	}
+	if r, ok := req.(*csi.CreateVolumeRequest); ok {
+		attrs = append(attrs, tracing.AttrVolumeName.String(r.GetName()))
+	}
+	if r, ok := req.(interface{ GetSnapshotId() string }); ok && r.GetSnapshotId() != "" {
+		attrs = append(attrs, tracing.AttrSnapshotId.String(r.GetSnapshotId()))
+	}
+	return attrs
 }
 
+// logGRPC logs the RPCs with the correlation ID their context carries down to the DSM requests
 func logGRPC(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
-	log.Infof("GRPC call: %s", info.FullMethod)
-	log.Infof("GRPC request: %s", protosanitizer.StripSecrets(req))
+	ctx = logger.WithRequestId(ctx, requestId(ctx))
+	start := time.Now()
+	log.WithContext(ctx).Infof("GRPC call: %s", info.FullMethod)
+	log.WithContext(ctx).Infof("GRPC request: %s", protosanitizer.StripSecrets(req))
 	resp, err := handler(ctx, req)
 	if err != nil {
-		log.Errorf("GRPC error: %v", err)
+		log.WithContext(ctx).Errorf("GRPC error: %s failed after %v: %v", info.FullMethod, time.Since(start), err)
 	} else {
-		log.Infof("GRPC response: %s", protosanitizer.StripSecrets(resp))
+		log.WithContext(ctx).Infof("GRPC response: %s completed in %v: %s", info.FullMethod, time.Since(start), protosanitizer.StripSecrets(resp))
 	}
 	return resp, err
 }
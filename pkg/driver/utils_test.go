@@ -0,0 +1,119 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	logtest "github.com/sirupsen/logrus/hooks/test"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+	"github.com/SynologyOpenSource/synology-csi/pkg/logger"
+)
+
+func TestLogGRPC_requestId(t *testing.T) {
+	var mu sync.Mutex
+	headers := []string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		headers = append(headers, r.Header.Get(webapi.RequestIdHeader))
+		mu.Unlock()
+		w.Write([]byte(`{"success": true, "data": {"luns": []}}`))
+	}))
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	dsm := &webapi.DSM{Ip: host, Port: p, Sid: "sid"}
+
+	level, hooks := logrus.GetLevel(), logrus.StandardLogger().ReplaceHooks(logrus.LevelHooks{})
+	defer func() {
+		logrus.SetLevel(level)
+		logrus.StandardLogger().ReplaceHooks(hooks)
+	}()
+	logrus.SetLevel(logrus.DebugLevel)
+	logrus.AddHook(&logger.RequestIdHook{})
+	entries := logtest.NewGlobal()
+
+	info := &grpc.UnaryServerInfo{FullMethod: "/csi.v1.Controller/ListVolumes"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		_, err := dsm.LunList(ctx)
+		return nil, err
+	}
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want string
+	}{
+		{name: "generated"},
+		{name: "from metadata", ctx: metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-request-id", "caller-id")), want: "caller-id"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entries.Reset()
+			mu.Lock()
+			headers = headers[:0]
+			mu.Unlock()
+			ctx := tt.ctx
+			if ctx == nil {
+				ctx = context.Background()
+			}
+
+			if _, err := logGRPC(ctx, struct{}{}, info, handler); err != nil {
+				t.Fatalf("logGRPC() error = %v", err)
+			}
+
+			id := ""
+			for _, entry := range entries.AllEntries() {
+				if strings.HasPrefix(entry.Message, "GRPC call") {
+					id, _ = entry.Data[logger.RequestIdField].(string)
+				}
+			}
+			if id == "" || (tt.want != "" && id != tt.want) {
+				t.Fatalf("GRPC call logged with request ID %q, want %q", id, tt.want)
+			}
+
+			logged := false
+			for _, entry := range entries.AllEntries() {
+				if strings.Contains(entry.Message, "SYNO.Core.ISCSI.LUN") {
+					logged = true
+					if entry.Data[logger.RequestIdField] != id {
+						t.Errorf("webapi call logged with request ID %v, want %s", entry.Data[logger.RequestIdField], id)
+					}
+				}
+			}
+			if !logged {
+				t.Errorf("webapi call not logged")
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(headers) != 1 || headers[0] != id {
+				t.Errorf("DSM received request IDs %v, want %s", headers, id)
+			}
+		})
+	}
+}
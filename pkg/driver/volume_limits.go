@@ -0,0 +1,66 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"fmt"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+// DefaultMaxIscsiVolumesPerNode is how many iSCSI volumes a node attaches by default. Each
+// one is a session and a SCSI device of the node, which the initiator and the kernel limit.
+const DefaultMaxIscsiVolumesPerNode = 256
+
+var (
+	// MaxVolumesPerNode are the numbers of volumes of each protocol a node attaches, the
+	// protocols without a positive one are unbounded
+	MaxVolumesPerNode = map[string]int64{utils.ProtocolIscsi: DefaultMaxIscsiVolumesPerNode}
+	// NodeProtocols are the protocols of the volumes the node attaches
+	NodeProtocols = []string{utils.ProtocolIscsi, utils.ProtocolSmb, utils.ProtocolNfs}
+)
+
+// ValidateVolumeLimits checks the protocols of NodeProtocols and MaxVolumesPerNode
+func ValidateVolumeLimits() error {
+	for _, protocol := range NodeProtocols {
+		if !isProtocolSupport(protocol) {
+			return fmt.Errorf("Unknown node protocol: %s", protocol)
+		}
+	}
+	for protocol, limit := range MaxVolumesPerNode {
+		if !isProtocolSupport(protocol) {
+			return fmt.Errorf("Unknown protocol of volume limit: %s", protocol)
+		}
+		if limit < 0 {
+			return fmt.Errorf("Negative volume limit of %s: %d", protocol, limit)
+		}
+	}
+	return nil
+}
+
+// maxVolumesPerNode returns the max_volumes_per_node of NodeGetInfo. The scheduler counts
+// the volumes of all protocols against it, so it is the smallest limit of the protocols of
+// the node, and 0, i.e. unbounded, if none of them has one.
+func maxVolumesPerNode() int64 {
+	max := int64(0)
+	for _, protocol := range NodeProtocols {
+		if limit := MaxVolumesPerNode[protocol]; limit > 0 && (max == 0 || limit < max) {
+			max = limit
+		}
+	}
+	return max
+}
@@ -0,0 +1,83 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+func TestNodeGetInfo_maxVolumesPerNode(t *testing.T) {
+	defer func(limits map[string]int64, protocols []string) {
+		MaxVolumesPerNode, NodeProtocols = limits, protocols
+	}(MaxVolumesPerNode, NodeProtocols)
+	ns := &nodeServer{Driver: &Driver{nodeID: "node-1"}}
+
+	tests := []struct {
+		name      string
+		limits    map[string]int64
+		protocols []string
+		want      int64
+	}{
+		{name: "default iscsi", limits: map[string]int64{utils.ProtocolIscsi: DefaultMaxIscsiVolumesPerNode}, protocols: supportedProtocolList, want: DefaultMaxIscsiVolumesPerNode},
+		{name: "configured iscsi", limits: map[string]int64{utils.ProtocolIscsi: 64}, protocols: []string{utils.ProtocolIscsi}, want: 64},
+		{name: "nfs unbounded", limits: map[string]int64{utils.ProtocolIscsi: 64}, protocols: []string{utils.ProtocolNfs}, want: 0},
+		{name: "nfs limited", limits: map[string]int64{utils.ProtocolIscsi: 64, utils.ProtocolNfs: 500}, protocols: []string{utils.ProtocolNfs}, want: 500},
+		{name: "smallest of the node protocols", limits: map[string]int64{utils.ProtocolIscsi: 64, utils.ProtocolSmb: 32}, protocols: supportedProtocolList, want: 32},
+		{name: "iscsi limit disabled", limits: map[string]int64{utils.ProtocolIscsi: 0}, protocols: supportedProtocolList, want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			MaxVolumesPerNode, NodeProtocols = tt.limits, tt.protocols
+			resp, err := ns.NodeGetInfo(context.Background(), &csi.NodeGetInfoRequest{})
+			if err != nil {
+				t.Fatalf("NodeGetInfo() error = %v", err)
+			}
+			if resp.MaxVolumesPerNode != tt.want {
+				t.Errorf("NodeGetInfo() max volumes per node = %d, want %d", resp.MaxVolumesPerNode, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateVolumeLimits(t *testing.T) {
+	defer func(limits map[string]int64, protocols []string) {
+		MaxVolumesPerNode, NodeProtocols = limits, protocols
+	}(MaxVolumesPerNode, NodeProtocols)
+
+	tests := []struct {
+		name      string
+		limits    map[string]int64
+		protocols []string
+		wantErr   bool
+	}{
+		{name: "valid", limits: map[string]int64{utils.ProtocolIscsi: 16, utils.ProtocolNfs: 0}, protocols: []string{utils.ProtocolIscsi}},
+		{name: "unknown node protocol", limits: map[string]int64{}, protocols: []string{"fc"}, wantErr: true},
+		{name: "unknown limit protocol", limits: map[string]int64{"fc": 16}, protocols: supportedProtocolList, wantErr: true},
+		{name: "negative limit", limits: map[string]int64{utils.ProtocolIscsi: -1}, protocols: supportedProtocolList, wantErr: true},
+	}
+	for _, tt := range tests {
+		MaxVolumesPerNode, NodeProtocols = tt.limits, tt.protocols
+		if err := ValidateVolumeLimits(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: ValidateVolumeLimits() error = %v, wantErr %v", tt.name, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// volumeLocks serializes the operations on each volume, as the CSI spec asks of a plugin
+// given concurrent calls for the same volume, while those of different volumes run in
+// parallel. The zero value is ready to use.
+type volumeLocks struct {
+	mu    sync.Mutex
+	locks map[string]*volumeLock
+}
+
+// volumeLock is held by one operation, others on the same volume wait for it on the channel
+type volumeLock struct {
+	held chan struct{}
+	refs int // operations holding or waiting for the lock
+}
+
+// lock waits for the operations running on key and returns the func releasing the lock.
+// It fails with Aborted if ctx is done first, the CO retries the call later.
+func (l *volumeLocks) lock(ctx context.Context, key string) (func(), error) {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[string]*volumeLock)
+	}
+	vl, ok := l.locks[key]
+	if !ok {
+		vl = &volumeLock{held: make(chan struct{}, 1)}
+		l.locks[key] = vl
+	}
+	vl.refs++
+	l.mu.Unlock()
+
+	select {
+	case vl.held <- struct{}{}:
+		return func() {
+			<-vl.held
+			l.release(key, vl)
+		}, nil
+	case <-ctx.Done():
+		l.release(key, vl)
+		return nil, status.Errorf(codes.Aborted, "An operation on volume %s is already in progress: %v", key, ctx.Err())
+	}
+}
+
+// release drops a reference to the lock of key, forgetting it once unused
+func (l *volumeLocks) release(key string, vl *volumeLock) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	vl.refs--
+	if vl.refs == 0 {
+		delete(l.locks, key)
+	}
+}
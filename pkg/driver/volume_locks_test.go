@@ -0,0 +1,168 @@
+/*
+Copyright 2021 Synology Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package driver
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+)
+
+func TestVolumeLocks(t *testing.T) {
+	var locks volumeLocks
+	ctx := context.Background()
+
+	unlock, err := locks.lock(ctx, "vol-1")
+	if err != nil {
+		t.Fatalf("lock(vol-1) error = %v", err)
+	}
+
+	// another volume isn't blocked
+	unlock2, err := locks.lock(ctx, "vol-2")
+	if err != nil {
+		t.Fatalf("lock(vol-2) error = %v", err)
+	}
+	unlock2()
+
+	// the same volume waits for the release
+	acquired := make(chan func())
+	go func() {
+		next, _ := locks.lock(ctx, "vol-1")
+		acquired <- next
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("lock(vol-1) acquired while held")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// a caller giving up while waiting is aborted
+	timeoutCtx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := locks.lock(timeoutCtx, "vol-1"); status.Code(err) != codes.Aborted {
+		t.Errorf("lock(vol-1) error = %v while held, want Aborted", err)
+	}
+
+	unlock()
+	select {
+	case next := <-acquired:
+		next()
+	case <-time.After(time.Second):
+		t.Fatal("lock(vol-1) not acquired after the release")
+	}
+
+	// a panicking operation releases its lock
+	func() {
+		defer func() { recover() }()
+		release, _ := locks.lock(ctx, "vol-1")
+		defer release()
+		panic("operation failed")
+	}()
+	panicCtx, cancelPanic := context.WithTimeout(ctx, time.Second)
+	defer cancelPanic()
+	relock, err := locks.lock(panicCtx, "vol-1")
+	if err != nil {
+		t.Fatalf("lock(vol-1) error = %v after a panic", err)
+	}
+	relock()
+}
+
+func TestVolumeLocks_forgetsReleased(t *testing.T) {
+	var locks volumeLocks
+	for _, key := range []string{"vol-1", "vol-2", "vol-1"} {
+		unlock, err := locks.lock(context.Background(), key)
+		if err != nil {
+			t.Fatalf("lock(%s) error = %v", key, err)
+		}
+		unlock()
+	}
+	if len(locks.locks) != 0 {
+		t.Errorf("%d locks kept after their release, want 0", len(locks.locks))
+	}
+}
+
+// concurrentDsmService records the creations running at once, with a delay to let them overlap
+type concurrentDsmService struct {
+	*fakeDsmService
+	mu        sync.Mutex
+	running   map[string]int // volume name => creations in progress
+	maxByName int
+	maxTotal  int
+}
+
+func (f *concurrentDsmService) GetVolumeByName(ctx context.Context, volName string) *models.K8sVolumeRespSpec {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.fakeDsmService.GetVolumeByName(ctx, volName)
+}
+
+func (f *concurrentDsmService) CreateVolume(ctx context.Context, spec *models.CreateK8sVolumeSpec) (*models.K8sVolumeRespSpec, error) {
+	f.mu.Lock()
+	f.running[spec.K8sVolumeName]++
+	total := 0
+	for _, n := range f.running {
+		total += n
+	}
+	if f.running[spec.K8sVolumeName] > f.maxByName {
+		f.maxByName = f.running[spec.K8sVolumeName]
+	}
+	if total > f.maxTotal {
+		f.maxTotal = total
+	}
+	f.mu.Unlock()
+
+	time.Sleep(50 * time.Millisecond)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.running[spec.K8sVolumeName]--
+	return f.fakeDsmService.CreateVolume(ctx, spec)
+}
+
+func TestCreateVolume_serializedByName(t *testing.T) {
+	dsmService := &concurrentDsmService{fakeDsmService: newFakeDsmService(), running: map[string]int{}}
+	cs := newTestControllerServer(dsmService)
+
+	var wg sync.WaitGroup
+	for _, name := range []string{"pvc-1", "pvc-1", "pvc-1", "pvc-2", "pvc-3"} {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			if _, err := cs.CreateVolume(context.Background(), newCreateVolumeRequest(name, map[string]string{})); err != nil {
+				t.Errorf("CreateVolume(%s) error = %v", name, err)
+			}
+		}(name)
+	}
+	wg.Wait()
+
+	if dsmService.maxByName != 1 {
+		t.Errorf("%d creations of the same volume ran at once, want 1", dsmService.maxByName)
+	}
+	if dsmService.maxTotal < 2 {
+		t.Errorf("%d creations of different volumes ran at once, want them in parallel", dsmService.maxTotal)
+	}
+	// the calls after the first find the volume it created
+	if len(dsmService.created) != 3 {
+		t.Errorf("%d volumes created for 3 names, want 3", len(dsmService.created))
+	}
+}
@@ -5,9 +5,11 @@
 package common
 
 import (
+	"fmt"
 	"io/ioutil"
 	"gopkg.in/yaml.v2"
 	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/api/resource"
 )
 
 type ClientInfo struct {
@@ -16,10 +18,55 @@ type ClientInfo struct {
 	Https           bool   `yaml:"https"`
 	Username        string `yaml:"username"`
 	Password        string `yaml:"password"`
+	// OtpCode logs in an account with 2-factor authentication once, the device
+	// token DSM returns for it is kept in DeviceIdFile for the following logins
+	OtpCode         string `yaml:"otpCode"`
+	DeviceId        string `yaml:"deviceId"`
+	DeviceIdFile    string `yaml:"deviceIdFile"`
+	// CaFile and Ca are PEM CA bundles trusted for the DSM certificate,
+	// CertFingerprint pins its SHA-256
+	CaFile             string `yaml:"caFile"`
+	Ca                 string `yaml:"ca"`
+	CertFingerprint    string `yaml:"certFingerprint"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+	// Proxy is the URL of the proxy DSM is reached through, HTTP_PROXY and HTTPS_PROXY
+	// are used if it isn't set. ProxyCaFile and ProxyCa are trusted for an HTTPS proxy.
+	Proxy              string `yaml:"proxy"`
+	NoProxy            string `yaml:"noProxy"`
+	ProxyCaFile        string `yaml:"proxyCaFile"`
+	ProxyCa            string `yaml:"proxyCa"`
+	// Transport is tcp, the default, or unix. DialAddress is the host:port, e.g. of an SSH
+	// local forward, or the Unix socket the connections to the DSM are opened to instead.
+	Transport          string `yaml:"transport"`
+	DialAddress        string `yaml:"dialAddress"`
+	// Site is the topology segment of the DSM, only nodes of the same site can reach it
+	Site               string `yaml:"site"`
+	// Profile names the credential set of the DSM, picked by the credentialRef parameter of
+	// StorageClasses. The DSMs without profile get the volumes of the other StorageClasses.
+	Profile            string `yaml:"profile"`
+	// MaxConcurrentRequests caps the requests in flight to the DSM, 8 if it isn't set
+	MaxConcurrentRequests int `yaml:"maxConcurrentRequests"`
+	// Headers are sent with every request to the DSM, e.g. the bearer token of a reverse proxy
+	Headers map[string]string `yaml:"headers"`
 }
 
 type SynoInfo struct {
 	Clients []ClientInfo `yaml:"clients"`
+	// NamespaceQuotas caps the capacity of the iSCSI volumes of each namespace, e.g. "500Gi"
+	NamespaceQuotas map[string]string `yaml:"namespaceQuotas"`
+}
+
+// NamespaceQuotaBytes parses NamespaceQuotas into bytes
+func (info *SynoInfo) NamespaceQuotaBytes() (map[string]int64, error) {
+	quotas := make(map[string]int64, len(info.NamespaceQuotas))
+	for namespace, value := range info.NamespaceQuotas {
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid quota %q of namespace %s: %v", value, namespace, err)
+		}
+		quotas[namespace] = quantity.Value()
+	}
+	return quotas, nil
 }
 
 func LoadConfig(configPath string) (*SynoInfo, error) {
@@ -0,0 +1,81 @@
+/*
+ * Copyright 2021 Synology Inc.
+ */
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+)
+
+// SetThinOvercommitRatio caps the capacity of the LUNs of a location to ratio times its
+// size when a thin LUN is created, 0 doesn't check thin LUNs since DSM allocates their
+// space as they are written
+func (service *DsmService) SetThinOvercommitRatio(ratio float64) {
+	service.thinOvercommitRatio = ratio
+}
+
+// isThinSpec tells if the LUN of spec is thin provisioned, before its location is known
+func isThinSpec(spec *models.CreateK8sVolumeSpec) bool {
+	if spec.Type != "" {
+		thin, _ := models.IsThinLunType(spec.Type)
+		return thin
+	}
+	return spec.ThinProvisioning
+}
+
+// provisionedSize returns the capacity of the LUNs of luns on location
+func provisionedSize(luns []webapi.LunInfo, location string) int64 {
+	var size int64
+	for _, lun := range luns {
+		if lun.Location == location {
+			size += int64(lun.Size)
+		}
+	}
+	return size
+}
+
+// checkThinCapacity fails if a thin LUN of size bytes would overcommit volInfo, that is if
+// the LUNs of luns on it would have more than thinOvercommitRatio times its size
+func (service *DsmService) checkThinCapacity(volInfo webapi.VolInfo, luns []webapi.LunInfo, size int64) error {
+	if service.thinOvercommitRatio <= 0 {
+		return nil
+	}
+	total, err := strconv.ParseInt(volInfo.Size, 10, 64)
+	if err != nil {
+		return status.Errorf(codes.Internal, fmt.Sprintf("Invalid size of location %s: %v", volInfo.Path, err))
+	}
+
+	provisioned := provisionedSize(luns, volInfo.Path)
+	if limit := int64(service.thinOvercommitRatio * float64(total)); provisioned+size > limit {
+		return status.Errorf(codes.ResourceExhausted,
+			fmt.Sprintf("Location %s has %d bytes of LUNs for %d bytes, %d more would exceed the thin overcommit ratio %g",
+				volInfo.Path, provisioned, total, size, service.thinOvercommitRatio))
+	}
+	return nil
+}
+
+// checkCapacity fails with ResourceExhausted if a LUN of size bytes doesn't fit on volInfo:
+// a thick LUN needs as much free space, a thin one must not overcommit it
+func (service *DsmService) checkCapacity(ctx context.Context, dsm *webapi.DSM, volInfo webapi.VolInfo, size int64, thin bool) error {
+	if !thin {
+		return checkFreeSpace(volInfo, size)
+	}
+	if service.thinOvercommitRatio <= 0 {
+		return nil
+	}
+
+	luns, err := dsm.LunList(ctx)
+	if err != nil {
+		return dsmError(err, "Failed to list LUNs")
+	}
+	return service.checkThinCapacity(volInfo, luns, size)
+}
@@ -0,0 +1,90 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+func TestCreateVolume_capacityCheck(t *testing.T) {
+	// a 10 GB location with 2 GB free, holding 12 GB of LUNs
+	vol := webapi.VolInfo{
+		Path: "/volume1", Status: "normal", FsType: models.FsTypeBtrfs,
+		Size: strconv.FormatInt(10*utils.UNIT_GB, 10), Free: strconv.FormatInt(2*utils.UNIT_GB, 10),
+	}
+	luns := []webapi.LunInfo{
+		{Name: "k8s-csi-pvc-a", Location: "/volume1", Size: uint64(8 * utils.UNIT_GB)},
+		{Name: "k8s-csi-pvc-b", Location: "/volume1", Size: uint64(4 * utils.UNIT_GB)},
+		{Name: "k8s-csi-pvc-c", Location: "/volume2", Size: uint64(100 * utils.UNIT_GB)},
+	}
+	var created bool
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		var data interface{}
+		switch query.Get("api") + "." + query.Get("method") {
+		case "SYNO.Core.Storage.Volume.get":
+			data = map[string]interface{}{"volume": vol}
+		case "SYNO.Core.Storage.Volume.list":
+			data = map[string]interface{}{"volumes": []webapi.VolInfo{vol}}
+		case "SYNO.Core.ISCSI.LUN.list":
+			data = map[string]interface{}{"luns": luns}
+		case "SYNO.Core.ISCSI.LUN.create":
+			created = true
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "data": data})
+	}))
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+
+	tests := []struct {
+		name        string
+		thin        bool
+		size        int64
+		location    string
+		ratio       float64
+		wantCode    codes.Code
+		wantCreated bool
+	}{
+		{name: "thick lun fits", size: utils.UNIT_GB, location: "/volume1", wantCreated: true},
+		{name: "thick lun on a full location", size: 3 * utils.UNIT_GB, location: "/volume1", wantCode: codes.ResourceExhausted},
+		{name: "thin lun without overcommit ratio", thin: true, size: 5 * utils.UNIT_GB, location: "/volume1", wantCreated: true},
+		{name: "thin lun within overcommit ratio", thin: true, size: 5 * utils.UNIT_GB, location: "/volume1", ratio: 2, wantCreated: true},
+		{name: "thin lun overcommitting", thin: true, size: 9 * utils.UNIT_GB, location: "/volume1", ratio: 2, wantCode: codes.ResourceExhausted},
+		{name: "thin lun placed within overcommit ratio", thin: true, size: 5 * utils.UNIT_GB, ratio: 2, wantCreated: true},
+		{name: "thin lun placed nowhere", thin: true, size: 9 * utils.UNIT_GB, ratio: 2, wantCode: codes.ResourceExhausted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			created = false
+			service := NewDsmService()
+			service.SetThinOvercommitRatio(tt.ratio)
+			service.dsms[host] = &webapi.DSM{Ip: host, Port: p}
+
+			spec := models.CreateK8sVolumeSpec{
+				K8sVolumeName: "pvc-1", LunName: "k8s-csi-pvc-1", TargetName: "k8s-csi-pvc-1", Location: tt.location,
+				Protocol: utils.ProtocolIscsi, Size: tt.size, ThinProvisioning: tt.thin,
+			}
+			_, err := service.CreateVolume(context.Background(), &spec)
+			if tt.wantCode != codes.OK {
+				if code := status.Code(err); code != tt.wantCode {
+					t.Fatalf("CreateVolume() code = %v, want %v (err: %v)", code, tt.wantCode, err)
+				}
+			}
+			if created != tt.wantCreated {
+				t.Errorf("CreateVolume() created a LUN: %v, want %v (err: %v)", created, tt.wantCreated, err)
+			}
+		})
+	}
+}
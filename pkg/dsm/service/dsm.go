@@ -5,8 +5,11 @@
 package service
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"os"
+	"sync"
 
 	"github.com/cenkalti/backoff/v4"
 	log "github.com/sirupsen/logrus"
@@ -22,7 +25,19 @@ import (
 )
 
 type DsmService struct {
-	dsms map[string]*webapi.DSM
+	dsms      map[string]*webapi.DSM
+	placement placement
+	health    health
+	// unlockSnapshots allows DeleteSnapshot to unlock locked snapshots
+	unlockSnapshots bool
+	// thinOvercommitRatio caps the LUNs of a location when a thin LUN is created, 0 disables it
+	thinOvercommitRatio float64
+	// lunsPerTarget is the number of LUNs mapped to each shared target, sharedTargetMu
+	// serializes their mappings and deletions
+	lunsPerTarget  int
+	sharedTargetMu sync.Mutex
+	// targetAclMu serializes the updates of the ACLs of targets
+	targetAclMu sync.Mutex
 }
 
 func NewDsmService() *DsmService {
@@ -33,33 +48,123 @@ func NewDsmService() *DsmService {
 
 func (service *DsmService) AddDsm(client common.ClientInfo) error {
 	// TODO: use sn or other identifiers as key
-	if _, ok := service.dsms[client.Host]; ok {
+	if dsm, ok := service.dsms[client.Host]; ok {
+		if dsm.Profile != client.Profile {
+			return fmt.Errorf("DSM [%s] is already added with credential profile %q, a DSM can only have one", client.Host, dsm.Profile)
+		}
 		log.Infof("Adding DSM [%s] already present.", client.Host)
 		return nil
 	}
 
+	tlsOptions, err := LoadTLSOptions(client)
+	if err != nil {
+		return fmt.Errorf("Invalid TLS options for DSM: [%s]. err: %v", client.Host, err)
+	}
+	proxyOptions, err := LoadProxyOptions(client)
+	if err != nil {
+		return fmt.Errorf("Invalid proxy options for DSM: [%s]. err: %v", client.Host, err)
+	}
+	transportOptions, err := LoadTransportOptions(client)
+	if err != nil {
+		return fmt.Errorf("Invalid transport options for DSM: [%s]. err: %v", client.Host, err)
+	}
+	if err := webapi.ValidateHeaders(client.Headers); err != nil {
+		return fmt.Errorf("Invalid headers for DSM: [%s]. err: %v", client.Host, err)
+	}
+
 	dsm := &webapi.DSM{
 		Ip:       client.Host,
 		Port:     client.Port,
 		Username: client.Username,
 		Password: client.Password,
 		Https:    client.Https,
+		OtpCode:  client.OtpCode,
+		DeviceId: client.DeviceId,
+		TLS:      tlsOptions,
+		Proxy:    proxyOptions,
+		Site:     client.Site,
+		Profile:  client.Profile,
+
+		MaxConcurrentRequests: client.MaxConcurrentRequests,
+		Headers:               client.Headers,
+		Transport:             transportOptions,
+	}
+	if client.DeviceIdFile != "" {
+		if data, err := os.ReadFile(client.DeviceIdFile); err == nil && len(data) > 0 {
+			dsm.DeviceId = strings.TrimSpace(string(data))
+		}
 	}
-	err := dsm.Login()
+	deviceId := dsm.DeviceId
+
+	err = dsm.Login(context.Background())
 	if err != nil {
 		return fmt.Errorf("Failed to login to DSM: [%s]. err: %v", dsm.Ip, err)
 	}
+	if client.DeviceIdFile != "" && dsm.DeviceId != deviceId {
+		if err := os.WriteFile(client.DeviceIdFile, []byte(dsm.DeviceId), 0600); err != nil {
+			log.Errorf("Failed to save the device token of DSM [%s]: %v", dsm.Ip, err)
+		}
+	}
 	service.dsms[dsm.Ip] = dsm
 	log.Infof("Add DSM [%s].", dsm.Ip)
 	return nil
 }
 
+// LoadTLSOptions reads the CA bundles of a client, from its file and inline
+func LoadTLSOptions(client common.ClientInfo) (webapi.TLSOptions, error) {
+	opts := webapi.TLSOptions{
+		CaPEM:              []byte(client.Ca),
+		Fingerprint:        client.CertFingerprint,
+		InsecureSkipVerify: client.InsecureSkipVerify,
+	}
+	if client.CaFile != "" {
+		data, err := os.ReadFile(client.CaFile)
+		if err != nil {
+			return opts, err
+		}
+		opts.CaPEM = append(append(opts.CaPEM, '\n'), data...)
+	}
+	return opts, nil
+}
+
+// LoadProxyOptions reads the proxy of a client and the CA bundles of the proxy, from its file and inline
+func LoadProxyOptions(client common.ClientInfo) (webapi.ProxyOptions, error) {
+	opts := webapi.ProxyOptions{
+		URL:     client.Proxy,
+		NoProxy: client.NoProxy,
+		CaPEM:   []byte(client.ProxyCa),
+	}
+	if client.ProxyCaFile != "" {
+		data, err := os.ReadFile(client.ProxyCaFile)
+		if err != nil {
+			return opts, err
+		}
+		opts.CaPEM = append(append(opts.CaPEM, '\n'), data...)
+	}
+	return opts, nil
+}
+
+// LoadTransportOptions reads where the connections to the DSM of a client are opened
+func LoadTransportOptions(client common.ClientInfo) (webapi.TransportOptions, error) {
+	opts := webapi.TransportOptions{
+		Type:        client.Transport,
+		DialAddress: client.DialAddress,
+	}
+	if err := opts.Validate(); err != nil {
+		return opts, err
+	}
+	if opts.DialAddress != "" && client.Proxy != "" {
+		return opts, fmt.Errorf("a client with a dialAddress can't have a proxy")
+	}
+	return opts, nil
+}
+
 func (service *DsmService) RemoveAllDsms() {
 	for _, dsm := range service.dsms {
 		log.Infof("Going to logout DSM [%s]", dsm.Ip)
 
 		for i := 0; i < 3; i++ {
-			err := dsm.Logout()
+			err := dsm.Logout(context.Background())
 			if err == nil {
 				break
 			}
@@ -81,7 +186,7 @@ func (service *DsmService) GetDsmsCount() int {
 	return len(service.dsms)
 }
 
-func (service *DsmService) ListDsmVolumes(ip string) ([]webapi.VolInfo, error) {
+func (service *DsmService) ListDsmVolumes(ctx context.Context, ip string) ([]webapi.VolInfo, error) {
 	var allVolInfos []webapi.VolInfo
 
 	for _, dsm := range service.dsms {
@@ -89,7 +194,7 @@ func (service *DsmService) ListDsmVolumes(ip string) ([]webapi.VolInfo, error) {
 			continue
 		}
 
-		volInfos, err := dsm.VolumeList()
+		volInfos, err := dsm.VolumeList(ctx)
 		if err != nil {
 			continue
 		}
@@ -100,12 +205,21 @@ func (service *DsmService) ListDsmVolumes(ip string) ([]webapi.VolInfo, error) {
 	return allVolInfos, nil
 }
 
-func (service *DsmService) getFirstAvailableVolume(dsm *webapi.DSM, sizeInBytes int64, protocol string) (webapi.VolInfo, error) {
-	volInfos, err := dsm.VolumeList()
+// getFirstAvailableVolume returns the first volume with room for sizeInBytes. A thin LUN
+// doesn't need as much free space, only not to overcommit the volume.
+func (service *DsmService) getFirstAvailableVolume(ctx context.Context, dsm *webapi.DSM, sizeInBytes int64, protocol string, thin bool) (webapi.VolInfo, error) {
+	volInfos, err := dsm.VolumeList(ctx)
 	if err != nil {
 		return webapi.VolInfo{}, err
 	}
 
+	var luns []webapi.LunInfo
+	if thin && service.thinOvercommitRatio > 0 {
+		if luns, err = dsm.LunList(ctx); err != nil {
+			return webapi.VolInfo{}, err
+		}
+	}
+
 	for _, volInfo := range volInfos {
 		free, err := strconv.ParseInt(volInfo.Free, 10, 64)
 		if err != nil {
@@ -114,7 +228,14 @@ func (service *DsmService) getFirstAvailableVolume(dsm *webapi.DSM, sizeInBytes
 		if free < utils.UNIT_GB {
 			continue
 		}
-		if volInfo.Status == "crashed" || volInfo.Status == "read_only" || volInfo.Status == "deleting" || free <= sizeInBytes {
+		if volInfo.Status == "crashed" || volInfo.Status == "read_only" || volInfo.Status == "deleting" {
+			continue
+		}
+		if thin {
+			if service.checkThinCapacity(volInfo, luns, sizeInBytes) != nil {
+				continue
+			}
+		} else if free <= sizeInBytes {
 			continue
 		}
 		// ignore esata disk
@@ -127,18 +248,26 @@ func (service *DsmService) getFirstAvailableVolume(dsm *webapi.DSM, sizeInBytes
 		}
 		return volInfo, nil
 	}
-	return webapi.VolInfo{}, fmt.Errorf("Cannot find any available volume")
+	return webapi.VolInfo{}, status.Errorf(codes.ResourceExhausted, "Cannot find any available volume with room for %d bytes", sizeInBytes)
 }
 
-func getLunTypeByInputParams(lunType string, isThin bool, locationFsType string) (string, error) {
-	log.Debugf("Input lunType: %v, isThin: %v, locationFsType: %v", lunType, isThin, locationFsType)
+func getLunTypeByInputParams(lunType string, isThin bool, snapshots bool, locationFsType string) (string, error) {
+	log.Debugf("Input lunType: %v, isThin: %v, snapshots: %v, locationFsType: %v", lunType, isThin, snapshots, locationFsType)
 	if lunType != "" {
+		if !models.IsLunTypeSupported(lunType, locationFsType) {
+			return "", fmt.Errorf("LUN type %s can't be created on a %s volume", lunType, locationFsType)
+		}
+		if snapshots && !models.LunTypeSupportsSnapshots(lunType) {
+			return "", fmt.Errorf("LUN type %s doesn't support snapshots", lunType)
+		}
 		return lunType, nil
 	}
 
 	if locationFsType == models.FsTypeExt4 {
 		if isThin {
 			return models.LunTypeAdv, nil // ADV
+		} else if snapshots {
+			return "", fmt.Errorf("Thick provisioned LUNs on a %s volume don't support snapshots", locationFsType)
 		} else {
 			return models.LunTypeFile, nil // FILE
 		}
@@ -153,77 +282,118 @@ func getLunTypeByInputParams(lunType string, isThin bool, locationFsType string)
 	return "", fmt.Errorf("Unknown volume fs type: %s", locationFsType)
 }
 
-func (service *DsmService) createMappingTarget(dsm *webapi.DSM, spec *models.CreateK8sVolumeSpec, lunUuid string) (webapi.TargetInfo, error) {
-	dsmInfo, err := dsm.DsmInfoGet()
+func (service *DsmService) createMappingTarget(ctx context.Context, dsm *webapi.DSM, spec *models.CreateK8sVolumeSpec, lunUuid string) (webapi.TargetInfo, error) {
+	if service.sharesTarget(spec) {
+		return service.mapSharedTarget(ctx, dsm, lunUuid)
+	}
+
+	dsmInfo, err := dsm.DsmInfoGet(ctx)
 
 	if err != nil {
 		return webapi.TargetInfo{}, status.Errorf(codes.Internal, fmt.Sprintf("Failed to get DSM[%s] info", dsm.Ip));
 	}
 
-	genTargetIqn := func() string {
-		iqn := models.IqnPrefix + fmt.Sprintf("%s.%s", dsmInfo.Hostname, spec.K8sVolumeName)
-		iqn = strings.ReplaceAll(iqn, "_", "-")
-		iqn = strings.ReplaceAll(iqn, "+", "p")
-
-		if len(iqn) > models.MaxIqnLen {
-			return iqn[:models.MaxIqnLen]
-		}
-		return iqn
-	}
 	targetSpec := webapi.TargetCreateSpec{
 		Name: spec.TargetName,
-		Iqn:  genTargetIqn(),
+		Iqn:  genTargetIqn(dsmInfo.Hostname, spec.K8sVolumeName),
+	}
+	if spec.Chap != nil {
+		targetSpec.AuthType = webapi.TargetAuthChap
+		targetSpec.User, targetSpec.Password = spec.Chap.User, spec.Chap.Password
+		if spec.Chap.Mutual() {
+			targetSpec.AuthType = webapi.TargetAuthMutualChap
+			targetSpec.MutualUser, targetSpec.MutualPassword = spec.Chap.MutualUser, spec.Chap.MutualPassword
+		}
 	}
 
-	log.Debugf("TargetCreate spec: %v", targetSpec)
-	targetId, err := dsm.TargetCreate(targetSpec)
+	targetInfo, err := createTarget(ctx, dsm, targetSpec, spec.MultipleSession)
+	if err != nil {
+		return webapi.TargetInfo{}, err
+	}
+	targetId := strconv.Itoa(targetInfo.TargetId)
+
+	if err := dsm.LunMapTarget(ctx, []string{targetId}, lunUuid); err != nil {
+		return webapi.TargetInfo{}, dsmError(err, "Failed to map target [%s] to lun [%s]", spec.TargetName, lunUuid)
+	}
+
+	return targetInfo, nil
+}
+
+func genTargetIqn(hostname string, name string) string {
+	iqn := models.IqnPrefix + fmt.Sprintf("%s.%s", hostname, name)
+	iqn = strings.ReplaceAll(iqn, "_", "-")
+	iqn = strings.ReplaceAll(iqn, "+", "p")
+
+	if len(iqn) > models.MaxIqnLen {
+		return iqn[:models.MaxIqnLen]
+	}
+	return iqn
+}
+
+// createTarget creates the target of targetSpec, or gets it if it already exists
+func createTarget(ctx context.Context, dsm *webapi.DSM, targetSpec webapi.TargetCreateSpec, multipleSession bool) (webapi.TargetInfo, error) {
+	log.WithContext(ctx).Debugf("TargetCreate spec: %v", targetSpec)
+	_, err := dsm.TargetCreate(ctx, targetSpec)
 
 	if err != nil && !errors.Is(err, utils.AlreadyExistError("")) {
-		return webapi.TargetInfo{}, status.Errorf(codes.Internal, fmt.Sprintf("Failed to create target with spec: %v, err: %v", targetSpec, err))
+		return webapi.TargetInfo{}, dsmError(err, "Failed to create target with spec: %v", targetSpec)
 	}
 
-	targetInfo, err := dsm.TargetGet(targetSpec.Name)
+	targetInfo, err := dsm.TargetGet(ctx, targetSpec.Name)
 	if err != nil {
-		return webapi.TargetInfo{}, status.Errorf(codes.Internal, fmt.Sprintf("Failed to get target with spec: %v, err: %v", targetSpec, err))
-	} else {
-		targetId = strconv.Itoa(targetInfo.TargetId);
+		return webapi.TargetInfo{}, dsmError(err, "Failed to get target with spec: %v", targetSpec)
 	}
+	targetId := strconv.Itoa(targetInfo.TargetId)
 
-	if spec.MultipleSession == true {
-		if err := dsm.TargetSet(targetId, 0); err != nil {
-			return webapi.TargetInfo{}, status.Errorf(codes.Internal, fmt.Sprintf("Failed to set target [%s] max session, err: %v", spec.TargetName, err))
+	if multipleSession == true {
+		if err := dsm.TargetSet(ctx, targetId, 0); err != nil {
+			return webapi.TargetInfo{}, dsmError(err, "Failed to set target [%s] max session", targetSpec.Name)
 		}
 	}
 
-	if err := dsm.LunMapTarget([]string{targetId}, lunUuid); err != nil {
-		return webapi.TargetInfo{}, status.Errorf(codes.Internal, fmt.Sprintf("Failed to map target [%s] to lun [%s], err: %v", spec.TargetName, lunUuid, err))
-	}
-
 	return targetInfo, nil
 }
 
-func (service *DsmService) createVolumeByDsm(dsm *webapi.DSM, spec *models.CreateK8sVolumeSpec) (*models.K8sVolumeRespSpec, error) {
+func (service *DsmService) createVolumeByDsm(ctx context.Context, dsm *webapi.DSM, spec *models.CreateK8sVolumeSpec) (*models.K8sVolumeRespSpec, error) {
 	// 1. Find a available location
 	if spec.Location == "" {
-		vol, err := service.getFirstAvailableVolume(dsm, spec.Size, spec.Protocol)
+		vol, err := service.getFirstAvailableVolume(ctx, dsm, spec.Size, spec.Protocol, isThinSpec(spec))
 		if err != nil {
 			return nil,
-				status.Errorf(codes.Internal, fmt.Sprintf("Failed to get available location, err: %v", err))
+				dsmError(err, "Failed to get available location")
 		}
 		spec.Location = vol.Path
 	}
 
 	// 2. Check if location exists
-	dsmVolInfo, err := dsm.VolumeGet(spec.Location)
+	dsmVolInfo, err := dsm.VolumeGet(ctx, spec.Location)
 	if err != nil {
 		return nil,
 			status.Errorf(codes.InvalidArgument, fmt.Sprintf("Unable to find location %s", spec.Location))
 	}
 
-	lunType, err := getLunTypeByInputParams(spec.Type, spec.ThinProvisioning, dsmVolInfo.FsType)
+	lunType, err := getLunTypeByInputParams(spec.Type, spec.ThinProvisioning, spec.Snapshots, dsmVolInfo.FsType)
 	if err != nil {
 		return nil,
-			status.Errorf(codes.InvalidArgument, fmt.Sprintf("Unknown volume fs type: %s, location: %s", dsmVolInfo.FsType, spec.Location))
+			status.Errorf(codes.InvalidArgument, fmt.Sprintf("Invalid LUN type for location %s: %v", spec.Location, err))
+	}
+
+	if err := checkLunQos(ctx, dsm, spec.Qos); err != nil {
+		return nil, err
+	}
+
+	if err := checkLunBlockSize(ctx, dsm, spec.BlockSize); err != nil {
+		return nil, err
+	}
+
+	// fail before creating anything if the LUN doesn't fit
+	thin, _ := models.IsThinLunType(lunType)
+	if err := service.checkCapacity(ctx, dsm, dsmVolInfo, spec.Size, thin); err != nil {
+		return nil, err
+	}
+
+	if spec.DryRun {
+		return dryRunK8sVolume(dsm.Ip, spec), nil
 	}
 
 	devAttribs := []webapi.LunDevAttrib{}
@@ -242,38 +412,69 @@ func (service *DsmService) createVolumeByDsm(dsm *webapi.DSM, spec *models.Creat
 		Size:        spec.Size,
 		Type:        lunType,
 		DevAttribs:  devAttribs,
+		Qos:         spec.Qos,
+		BlockSize:   spec.BlockSize,
 	}
 
-	log.Debugf("LunCreate spec: %v", lunSpec)
-	_, err = dsm.LunCreate(lunSpec)
+	log.WithContext(ctx).Debugf("LunCreate spec: %v", lunSpec)
+	_, err = dsm.LunCreate(ctx, lunSpec)
 
 	if err != nil && !errors.Is(err, utils.AlreadyExistError("")) {
 		return nil,
-			status.Errorf(codes.Internal, fmt.Sprintf("Failed to create LUN, err: %v", err))
+			dsmError(err, "Failed to create LUN")
 	}
 
 	// No matter lun existed or not, Get Lun by name
-	lunInfo, err := dsm.LunGet(spec.LunName)
+	lunInfo, err := dsm.LunGet(ctx, spec.LunName)
 	if err != nil {
 		return nil,
 			// discussion with log
-			status.Errorf(codes.Internal, fmt.Sprintf("Failed to get existed LUN with name: %s, err: %v", spec.LunName, err))
+			dsmError(err, "Failed to get existed LUN with name: %s", spec.LunName)
 	}
 
 	// 4. Create Target and Map to Lun
-	targetInfo, err := service.createMappingTarget(dsm, spec, lunInfo.Uuid)
+	targetInfo, err := service.createMappingTarget(ctx, dsm, spec, lunInfo.Uuid)
 	if err != nil {
 		// FIXME need to delete lun and target
 		return nil,
-			status.Errorf(codes.Internal, fmt.Sprintf("Failed to create and map target, err: %v", err))
+			dsmError(err, "Failed to create and map target")
 	}
 
-	log.Debugf("[%s] CreateVolume Successfully. VolumeId: %s", dsm.Ip, lunInfo.Uuid)
+	log.WithContext(ctx).Debugf("[%s] CreateVolume Successfully. VolumeId: %s", dsm.Ip, lunInfo.Uuid)
 
 	return DsmLunToK8sVolume(dsm.Ip, lunInfo, targetInfo), nil
 }
 
-func waitCloneFinished(dsm *webapi.DSM, lunName string) error {
+// checkFreeSpace fails if volInfo has less than size bytes free
+func checkFreeSpace(volInfo webapi.VolInfo, size int64) error {
+	free, err := strconv.ParseInt(volInfo.Free, 10, 64)
+	if err != nil {
+		return status.Errorf(codes.Internal, fmt.Sprintf("Invalid free size of location %s: %v", volInfo.Path, err))
+	}
+	if free < size {
+		return status.Errorf(codes.ResourceExhausted,
+			fmt.Sprintf("Location %s has %d bytes free, %d are required", volInfo.Path, free, size))
+	}
+	return nil
+}
+
+// dryRunK8sVolume returns the volume a dry run of spec would have created on dsmIp
+func dryRunK8sVolume(dsmIp string, spec *models.CreateK8sVolumeSpec) *models.K8sVolumeRespSpec {
+	name := spec.LunName
+	if spec.Protocol != utils.ProtocolIscsi {
+		name = spec.ShareName
+	}
+	return &models.K8sVolumeRespSpec{
+		DsmIp:       dsmIp,
+		VolumeId:    models.DryRunVolumePrefix + spec.K8sVolumeName,
+		SizeInBytes: spec.Size,
+		Location:    spec.Location,
+		Name:        name,
+		Protocol:    spec.Protocol,
+	}
+}
+
+func waitCloneFinished(ctx context.Context, dsm *webapi.DSM, lunName string) error {
 	cloneBackoff := backoff.NewExponentialBackOff()
 	cloneBackoff.InitialInterval = 1 * time.Second
 	cloneBackoff.Multiplier = 2
@@ -281,7 +482,7 @@ func waitCloneFinished(dsm *webapi.DSM, lunName string) error {
 	cloneBackoff.MaxElapsedTime = 20 * time.Second
 
 	checkFinished := func() error {
-		lunInfo, err := dsm.LunGet(lunName)
+		lunInfo, err := dsm.LunGet(ctx, lunName)
 		if err != nil {
 			return backoff.Permanent(fmt.Errorf("Failed to get existed LUN with name: %s, err: %v", lunName, err))
 		}
@@ -293,61 +494,155 @@ func waitCloneFinished(dsm *webapi.DSM, lunName string) error {
 	}
 
 	cloneNotify := func(err error, duration time.Duration) {
-		log.Infof("Lun is being locked for lun clone, waiting %3.2f seconds .....", float64(duration.Seconds()))
+		log.WithContext(ctx).Infof("Lun is being locked for lun clone, waiting %3.2f seconds .....", float64(duration.Seconds()))
 	}
 
-	if err := backoff.RetryNotify(checkFinished, cloneBackoff, cloneNotify); err != nil {
-		log.Errorf("Could not finish clone after %3.2f seconds. err: %v", float64(cloneBackoff.MaxElapsedTime.Seconds()), err)
+	if err := backoff.RetryNotify(checkFinished, backoff.WithContext(cloneBackoff, ctx), cloneNotify); err != nil {
+		log.WithContext(ctx).Errorf("Could not finish clone after %3.2f seconds. err: %v", float64(cloneBackoff.MaxElapsedTime.Seconds()), err)
 		return err
 	}
 
-	log.Debugf("Clone successfully. Lun: %v", lunName)
+	log.WithContext(ctx).Debugf("Clone successfully. Lun: %v", lunName)
 	return nil
 }
 
-func (service *DsmService) createVolumeBySnapshot(dsm *webapi.DSM, spec *models.CreateK8sVolumeSpec, srcSnapshot *models.K8sSnapshotRespSpec) (*models.K8sVolumeRespSpec, error) {
-	if spec.Size != 0 && spec.Size != srcSnapshot.SizeInBytes {
-		return nil, status.Errorf(codes.OutOfRange, "Requested lun size [%d] is not equal to snapshot size [%d]", spec.Size, srcSnapshot.SizeInBytes)
-	}
-
+func (service *DsmService) createVolumeBySnapshot(ctx context.Context, dsm *webapi.DSM, spec *models.CreateK8sVolumeSpec, srcSnapshot *models.K8sSnapshotRespSpec) (*models.K8sVolumeRespSpec, error) {
 	snapshotCloneSpec := webapi.SnapshotCloneSpec{
 		Name:            spec.LunName,
 		SrcLunUuid:      srcSnapshot.ParentUuid,
 		SrcSnapshotUuid: srcSnapshot.Uuid,
 	}
 
-	if _, err := dsm.SnapshotClone(snapshotCloneSpec); err != nil && !errors.Is(err, utils.AlreadyExistError("")) {
+	if _, err := dsm.SnapshotClone(ctx, snapshotCloneSpec); err != nil && !errors.Is(err, utils.AlreadyExistError("")) {
 		return nil,
-			status.Errorf(codes.Internal, fmt.Sprintf("Failed to create volume with source snapshot ID: %s, err: %v", srcSnapshot.Uuid, err))
+			dsmError(err, "Failed to create volume with source snapshot ID: %s", srcSnapshot.Uuid)
 	}
 
-	if err := waitCloneFinished(dsm, spec.LunName); err != nil {
+	if err := waitCloneFinished(ctx, dsm, spec.LunName); err != nil {
 		return nil, status.Errorf(codes.Internal, err.Error())
 	}
 
-	lunInfo, err := dsm.LunGet(spec.LunName)
+	lunInfo, err := dsm.LunGet(ctx, spec.LunName)
 	if err != nil {
 		return nil,
-			status.Errorf(codes.Internal, fmt.Sprintf("Failed to get existed LUN with name: %s, err: %v", spec.LunName, err))
+			dsmError(err, "Failed to get existed LUN with name: %s", spec.LunName)
+	}
+
+	if err := growClonedLun(ctx, dsm, &lunInfo, spec.Size); err != nil {
+		return nil, err
+	}
+
+	if err := setLunQos(ctx, dsm, &lunInfo, spec.Qos); err != nil {
+		return nil, err
 	}
 
-	targetInfo, err := service.createMappingTarget(dsm, spec, lunInfo.Uuid)
+	targetInfo, err := service.createMappingTarget(ctx, dsm, spec, lunInfo.Uuid)
 	if err != nil {
 		// FIXME need to delete lun and target
 		return nil,
-			status.Errorf(codes.Internal, fmt.Sprintf("Failed to create and map target, err: %v", err))
+			dsmError(err, "Failed to create and map target")
 	}
 
-	log.Debugf("[%s] createVolumeBySnapshot Successfully. VolumeId: %s", dsm.Ip, lunInfo.Uuid)
+	log.WithContext(ctx).Debugf("[%s] createVolumeBySnapshot Successfully. VolumeId: %s", dsm.Ip, lunInfo.Uuid)
 
 	return DsmLunToK8sVolume(dsm.Ip, lunInfo, targetInfo), nil
 }
 
-func (service *DsmService) createVolumeByVolume(dsm *webapi.DSM, spec *models.CreateK8sVolumeSpec, srcLunInfo webapi.LunInfo) (*models.K8sVolumeRespSpec, error) {
-	if spec.Size != 0 && spec.Size != int64(srcLunInfo.Size) {
-		return nil, status.Errorf(codes.OutOfRange, "Requested lun size [%d] is not equal to src lun size [%d]", spec.Size, srcLunInfo.Size)
+// growClonedLun expands a LUN cloned with the size of its source to the requested size
+func growClonedLun(ctx context.Context, dsm *webapi.DSM, lunInfo *webapi.LunInfo, size int64) error {
+	if size <= int64(lunInfo.Size) {
+		return nil
+	}
+	if err := dsm.LunUpdate(ctx, webapi.LunUpdateSpec{Uuid: lunInfo.Uuid, NewSize: uint64(size)}); err != nil {
+		return dsmError(err, "Failed to expand cloned LUN [%s] to %d bytes", lunInfo.Name, size)
 	}
+	lunInfo.Size = uint64(size)
+	return nil
+}
 
+// checkLunQos fails with FailedPrecondition if qos is set and the DSM can't enforce it
+func checkLunQos(ctx context.Context, dsm *webapi.DSM, qos webapi.LunQos) error {
+	if !qos.IsSet() {
+		return nil
+	}
+	supported, version, err := dsm.SupportsLunQos(ctx)
+	if err != nil {
+		return dsmError(err, "[%s] Failed to check LUN QoS support", dsm.Ip)
+	}
+	if !supported {
+		return status.Errorf(codes.FailedPrecondition, fmt.Sprintf("[%s] %s doesn't support LUN QoS", dsm.Ip, version))
+	}
+	return nil
+}
+
+// checkLunBlockSize fails with FailedPrecondition if the DSM can't create LUNs of blockSize
+func checkLunBlockSize(ctx context.Context, dsm *webapi.DSM, blockSize int) error {
+	if blockSize != models.LunBlockSize4Kn {
+		return nil
+	}
+	supported, version, err := dsm.SupportsLun4Kn(ctx)
+	if err != nil {
+		return dsmError(err, "[%s] Failed to check 4Kn LUN support", dsm.Ip)
+	}
+	if !supported {
+		return status.Errorf(codes.FailedPrecondition, fmt.Sprintf("[%s] %s doesn't support 4Kn LUNs", dsm.Ip, version))
+	}
+	return nil
+}
+
+// setLunQos applies qos to a cloned LUN, which keeps the limits of its source otherwise
+func setLunQos(ctx context.Context, dsm *webapi.DSM, lunInfo *webapi.LunInfo, qos webapi.LunQos) error {
+	if !qos.IsSet() || qos == lunInfo.LunQos {
+		return nil
+	}
+	if err := dsm.LunUpdate(ctx, webapi.LunUpdateSpec{Uuid: lunInfo.Uuid, Qos: qos}); err != nil {
+		return dsmError(err, "Failed to set QoS of cloned LUN [%s]", lunInfo.Name)
+	}
+	lunInfo.LunQos = qos
+	return nil
+}
+
+// validateCloneSource checks that the volume requested by spec can be cloned from src
+func validateCloneSource(spec *models.CreateK8sVolumeSpec, src *models.K8sVolumeRespSpec) error {
+	if src.SubDir != "" {
+		return status.Errorf(codes.InvalidArgument, "The source PVC is the subdirectory %s of share %s, which can't be cloned", src.SubDir, src.Share.Name)
+	}
+
+	if spec.DsmIp != "" && spec.DsmIp != src.DsmIp {
+		return status.Errorf(codes.InvalidArgument, "The source PVC and destination PVCs must be on the same DSM for cloning. Source is on %s, but new PVC is on %s",
+			src.DsmIp, spec.DsmIp)
+	}
+
+	if (spec.Protocol == utils.ProtocolIscsi || src.Protocol == utils.ProtocolIscsi) && spec.Protocol != src.Protocol {
+		return status.Errorf(codes.InvalidArgument, "The source PVC and destination PVCs shouldn't have different protocols. Source is %s, but new PVC is %s",
+			src.Protocol, spec.Protocol)
+	}
+
+	// a clone keeps the block size of its source
+	if spec.BlockSize != 0 && src.Lun.BlockSize != 0 && spec.BlockSize != src.Lun.BlockSize {
+		return status.Errorf(codes.InvalidArgument, "The block size [%d] of the new PVC differs from the block size [%d] of the source PVC",
+			spec.BlockSize, src.Lun.BlockSize)
+	}
+
+	return validateCloneSize(spec, src.SizeInBytes, "src")
+}
+
+// validateCloneSize checks that the volume requested by spec can hold its source of srcSize bytes
+func validateCloneSize(spec *models.CreateK8sVolumeSpec, srcSize int64, srcKind string) error {
+	if spec.Size == 0 {
+		return nil
+	}
+	if spec.Protocol == utils.ProtocolIscsi && spec.Size < srcSize {
+		return status.Errorf(codes.OutOfRange, "Requested lun size [%d] is smaller than %s lun size [%d]", spec.Size, srcKind, srcSize)
+	}
+	if spec.Protocol != utils.ProtocolIscsi && utils.BytesToMBCeil(spec.Size) < utils.BytesToMB(srcSize) {
+		return status.Errorf(codes.OutOfRange, "Requested share quotaMB [%d] is smaller than %s share quotaMB [%d]",
+			utils.BytesToMBCeil(spec.Size), srcKind, utils.BytesToMB(srcSize))
+	}
+	return nil
+}
+
+func (service *DsmService) createVolumeByVolume(ctx context.Context, dsm *webapi.DSM, spec *models.CreateK8sVolumeSpec, srcLunInfo webapi.LunInfo) (*models.K8sVolumeRespSpec, error) {
 	if spec.Location == "" {
 		spec.Location = srcLunInfo.Location
 	}
@@ -358,29 +653,37 @@ func (service *DsmService) createVolumeByVolume(dsm *webapi.DSM, spec *models.Cr
 		Location:        spec.Location,
 	}
 
-	if _, err := dsm.LunClone(lunCloneSpec); err != nil && !errors.Is(err, utils.AlreadyExistError("")) {
+	if _, err := dsm.LunClone(ctx, lunCloneSpec); err != nil && !errors.Is(err, utils.AlreadyExistError("")) {
 		return nil,
-			status.Errorf(codes.Internal, fmt.Sprintf("Failed to create volume with source volume ID: %s, err: %v", srcLunInfo.Uuid, err))
+			dsmError(err, "Failed to create volume with source volume ID: %s", srcLunInfo.Uuid)
 	}
 
-	if err := waitCloneFinished(dsm, spec.LunName); err != nil {
+	if err := waitCloneFinished(ctx, dsm, spec.LunName); err != nil {
 		return nil, status.Errorf(codes.Internal, err.Error())
 	}
 
-	lunInfo, err := dsm.LunGet(spec.LunName)
+	lunInfo, err := dsm.LunGet(ctx, spec.LunName)
 	if err != nil {
 		return nil,
-			status.Errorf(codes.Internal, fmt.Sprintf("Failed to get existed LUN with name: %s, err: %v", spec.LunName, err))
+			dsmError(err, "Failed to get existed LUN with name: %s", spec.LunName)
+	}
+
+	if err := growClonedLun(ctx, dsm, &lunInfo, spec.Size); err != nil {
+		return nil, err
+	}
+
+	if err := setLunQos(ctx, dsm, &lunInfo, spec.Qos); err != nil {
+		return nil, err
 	}
 
-	targetInfo, err := service.createMappingTarget(dsm, spec, lunInfo.Uuid)
+	targetInfo, err := service.createMappingTarget(ctx, dsm, spec, lunInfo.Uuid)
 	if err != nil {
 		// FIXME need to delete lun and target
 		return nil,
-			status.Errorf(codes.Internal, fmt.Sprintf("Failed to create and map target, err: %v", err))
+			dsmError(err, "Failed to create and map target")
 	}
 
-	log.Debugf("[%s] createVolumeByVolume Successfully. VolumeId: %s", dsm.Ip, lunInfo.Uuid)
+	log.WithContext(ctx).Debugf("[%s] createVolumeByVolume Successfully. VolumeId: %s", dsm.Ip, lunInfo.Uuid)
 
 	return DsmLunToK8sVolume(dsm.Ip, lunInfo, targetInfo), nil
 }
@@ -396,7 +699,7 @@ func DsmShareToK8sVolume(dsmIp string, info webapi.ShareInfo, protocol string) *
 
 	return &models.K8sVolumeRespSpec{
 		DsmIp: dsmIp,
-		VolumeId: info.Uuid,
+		VolumeId: k8sVolumeId(dsmIp, protocol, info.Uuid),
 		SizeInBytes: utils.MBToBytes(info.QuotaValueInMB),
 		Location: info.VolPath,
 		Name: info.Name,
@@ -410,7 +713,7 @@ func DsmShareToK8sVolume(dsmIp string, info webapi.ShareInfo, protocol string) *
 func DsmLunToK8sVolume(dsmIp string, info webapi.LunInfo, targetInfo webapi.TargetInfo) *models.K8sVolumeRespSpec {
 	return &models.K8sVolumeRespSpec{
 		DsmIp: dsmIp,
-		VolumeId: info.Uuid,
+		VolumeId: k8sVolumeId(dsmIp, utils.ProtocolIscsi, info.Uuid),
 		SizeInBytes: int64(info.Size),
 		Location: info.Location,
 		Name: info.Name,
@@ -421,11 +724,12 @@ func DsmLunToK8sVolume(dsmIp string, info webapi.LunInfo, targetInfo webapi.Targ
 	}
 }
 
-func isNfsVersionSupport(dsm *webapi.DSM, nfsVersion string) bool {
+// isNfsVersionSupport tells if dsm supports nfsVersion, and with enable set, turns NFS on
+func isNfsVersionSupport(ctx context.Context, dsm *webapi.DSM, nfsVersion string, enable bool) bool {
 	major := 0
 	minor := 0
 
-	info, err := dsm.NfsGet()
+	info, err := dsm.NfsGet(ctx)
 	if err != nil {
 		return false
 	}
@@ -441,18 +745,22 @@ func isNfsVersionSupport(dsm *webapi.DSM, nfsVersion string) bool {
 			minor = 1
 		}
 	} else {
-		log.Infof("Input nfsVersion = %s, not supported!", nfsVersion)
+		log.WithContext(ctx).Infof("Input nfsVersion = %s, not supported!", nfsVersion)
 		return false
 	}
 
 	if major > info.SupportMajorVer || (major == info.SupportMajorVer && minor > info.SupportMinorVer) {
-		log.Infof("Dsm NFS version not supported")
+		log.WithContext(ctx).Infof("Dsm NFS version not supported")
 		return false
 	}
 
+	if !enable {
+		return true
+	}
+
 	// enable the highest NFS version the DSM supports
-	if err := dsm.NfsSet(true, (info.SupportMajorVer == 4), info.SupportMinorVer); err != nil {
-		log.Errorf("[%s] Failed to enable nfs: %v\n", dsm.Ip, err)
+	if err := dsm.NfsSet(ctx, true, (info.SupportMajorVer == 4), info.SupportMinorVer); err != nil {
+		log.WithContext(ctx).Errorf("[%s] Failed to enable nfs: %v\n", dsm.Ip, err)
 		return false
 	}
 
@@ -460,30 +768,79 @@ func isNfsVersionSupport(dsm *webapi.DSM, nfsVersion string) bool {
 }
 
 
-func (service *DsmService) CreateVolume(spec *models.CreateK8sVolumeSpec) (*models.K8sVolumeRespSpec, error) {
+// candidateDsms returns the DSMs a new volume of spec may be created on, in the order of placement
+func (service *DsmService) candidateDsms(ctx context.Context, spec *models.CreateK8sVolumeSpec) ([]*webapi.DSM, error) {
+	candidates := byProfile(service.placement.order(ctx, service.dsms), spec.Profile)
+	if len(candidates) == 0 && len(service.dsms) > 0 {
+		return nil, status.Error(codes.InvalidArgument, "Every DSM has a credential profile, the StorageClass must pick one with credentialRef")
+	}
+	if len(spec.Sites) > 0 {
+		if candidates = bySites(candidates, spec.Sites); len(candidates) == 0 {
+			return nil, status.Errorf(codes.ResourceExhausted, "No DSM is accessible from the topology sites %v", spec.Sites)
+		}
+	}
+	if len(candidates) > 0 {
+		if candidates = service.health.healthy(candidates); len(candidates) == 0 {
+			return nil, status.Errorf(codes.Unavailable, "All DSMs are unreachable: %v", service.UnhealthyDsms())
+		}
+	}
+	return candidates, nil
+}
+
+func (service *DsmService) CreateVolume(ctx context.Context, spec *models.CreateK8sVolumeSpec) (*models.K8sVolumeRespSpec, error) {
+	if err := service.checkSpecProfile(spec); err != nil {
+		return nil, err
+	}
+
 	if spec.SourceVolumeId != "" {
 		/* Create volume by exists volume (Clone) */
-		k8sVolume := service.GetVolume(spec.SourceVolumeId)
+		k8sVolume := service.GetVolume(ctx, spec.SourceVolumeId)
 		if k8sVolume == nil {
 			return nil, status.Errorf(codes.NotFound, fmt.Sprintf("No such volume id: %s", spec.SourceVolumeId))
 		}
 
+		if err := validateCloneSource(spec, k8sVolume); err != nil {
+			return nil, err
+		}
+
 		dsm, err := service.GetDsm(k8sVolume.DsmIp)
 		if err != nil {
 			return nil, status.Errorf(codes.Internal, fmt.Sprintf("Failed to get DSM[%s]", k8sVolume.DsmIp))
 		}
 
+		if err := checkSite(spec, dsm); err != nil {
+			return nil, err
+		}
+
+		if err := checkProfile(spec, dsm); err != nil {
+			return nil, err
+		}
+
+		if err := checkLunQos(ctx, dsm, spec.Qos); err != nil {
+			return nil, err
+		}
+
+		if k8sVolume.Protocol != utils.ProtocolIscsi {
+			if err := checkShareSnapshot(k8sVolume.Share); err != nil {
+				return nil, err
+			}
+		}
+
+		if spec.DryRun {
+			return dryRunK8sVolume(dsm.Ip, spec), nil
+		}
+
 		if spec.Protocol == utils.ProtocolIscsi {
-			return service.createVolumeByVolume(dsm, spec, k8sVolume.Lun)
+			return service.createVolumeByVolume(ctx, dsm, spec, k8sVolume.Lun)
 		} else if spec.Protocol == utils.ProtocolSmb || spec.Protocol == utils.ProtocolNfs {
-			return service.createSMBorNFSVolumeByVolume(dsm, spec, k8sVolume.Share)
+			return service.createSMBorNFSVolumeByVolume(ctx, dsm, spec, k8sVolume.Share)
 		}
 		return nil, status.Error(codes.InvalidArgument, "Unknown protocol")
 	}
 
 	if spec.SourceSnapshotId != "" {
 		/* Create volume by snapshot */
-		snapshot := service.GetSnapshotByUuid(spec.SourceSnapshotId)
+		snapshot := service.GetSnapshotByUuid(ctx, spec.SourceSnapshotId)
 		if snapshot == nil {
 			return nil, status.Errorf(codes.NotFound, fmt.Sprintf("No such snapshot id: %s", spec.SourceSnapshotId))
 		}
@@ -500,7 +857,7 @@ func (service *DsmService) CreateVolume(spec *models.CreateK8sVolumeSpec) (*mode
 			return nil, status.Errorf(codes.InvalidArgument, msg)
 		}
 
-		log.Debugf("The source PVC protocol [%s] and the destination PVC protocol [%s]", snapshot.Protocol, spec.Protocol)
+		log.WithContext(ctx).Debugf("The source PVC protocol [%s] and the destination PVC protocol [%s]", snapshot.Protocol, spec.Protocol)
 		if (spec.Protocol == utils.ProtocolIscsi || snapshot.Protocol == utils.ProtocolIscsi) &&
 			spec.Protocol != snapshot.Protocol {
 			msg := fmt.Sprintf("The source PVC and destination PVCs shouldn't have different protocols. Source is %s, but new PVC is %s",
@@ -508,21 +865,51 @@ func (service *DsmService) CreateVolume(spec *models.CreateK8sVolumeSpec) (*mode
 			return nil, status.Errorf(codes.InvalidArgument, msg)
 		}
 
+		if err := validateCloneSize(spec, snapshot.SizeInBytes, "snapshot"); err != nil {
+			return nil, err
+		}
+
 		dsm, err := service.GetDsm(snapshot.DsmIp)
 		if err != nil {
 			return nil, status.Errorf(codes.Internal, fmt.Sprintf("Failed to get DSM[%s]", snapshot.DsmIp))
 		}
 
+		if err := checkSite(spec, dsm); err != nil {
+			return nil, err
+		}
+
+		if err := checkProfile(spec, dsm); err != nil {
+			return nil, err
+		}
+
+		if err := checkLunQos(ctx, dsm, spec.Qos); err != nil {
+			return nil, err
+		}
+
+		if spec.DryRun {
+			return dryRunK8sVolume(dsm.Ip, spec), nil
+		}
+
 		if spec.Protocol == utils.ProtocolIscsi {
-			return service.createVolumeBySnapshot(dsm, spec, snapshot)
+			return service.createVolumeBySnapshot(ctx, dsm, spec, snapshot)
 		} else if spec.Protocol == utils.ProtocolSmb || spec.Protocol == utils.ProtocolNfs {
-			return service.createSMBorNFSVolumeBySnapshot(dsm, spec, snapshot)
+			return service.createSMBorNFSVolumeBySnapshot(ctx, dsm, spec, snapshot)
 		}
 		return nil, status.Error(codes.InvalidArgument, "Unknown protocol")
 	}
 
 	/* Find appropriate dsm to create volume */
-	for _, dsm := range service.dsms {
+	candidates, err := service.candidateDsms(ctx, spec)
+	if err != nil {
+		return nil, err
+	}
+
+	if spec.ParentShare != "" {
+		return service.createSubDirVolume(ctx, candidates, spec)
+	}
+
+	var lastErr error
+	for _, dsm := range candidates {
 		if spec.DsmIp != "" && spec.DsmIp != dsm.Ip {
 			continue
 		}
@@ -530,32 +917,38 @@ func (service *DsmService) CreateVolume(spec *models.CreateK8sVolumeSpec) (*mode
 		var k8sVolume *models.K8sVolumeRespSpec
 		var err error
 		if spec.Protocol == utils.ProtocolIscsi {
-			k8sVolume, err = service.createVolumeByDsm(dsm, spec)
+			k8sVolume, err = service.createVolumeByDsm(ctx, dsm, spec)
 		} else if spec.Protocol == utils.ProtocolSmb {
-			k8sVolume, err = service.createSMBorNFSVolumeByDsm(dsm, spec)
+			k8sVolume, err = service.createSMBorNFSVolumeByDsm(ctx, dsm, spec)
 		} else if spec.Protocol == utils.ProtocolNfs {
-			if !isNfsVersionSupport(dsm, spec.NfsVersion) {
+			if !isNfsVersionSupport(ctx, dsm, spec.NfsVersion, !spec.DryRun) {
 				continue
 			}
-			k8sVolume, err = service.createSMBorNFSVolumeByDsm(dsm, spec)
+			k8sVolume, err = service.createSMBorNFSVolumeByDsm(ctx, dsm, spec)
 		}
 
 		if err != nil {
-			log.Errorf("[%s] Failed to create Volume: %v", dsm.Ip, err)
+			log.WithContext(ctx).Errorf("[%s] Failed to create Volume: %v", dsm.Ip, err)
+			lastErr = err
 			continue
 		}
 
 		return k8sVolume, nil
 	}
 
+	// a dry run tells why it would fail, and so does an error with a code telling the
+	// provisioner if a retry helps, e.g. a DSM too old for the spec or out of space
+	if lastErr != nil && (spec.DryRun || status.Code(lastErr) != codes.Internal) {
+		return nil, lastErr
+	}
 	return nil, status.Errorf(codes.Internal, fmt.Sprintf("Couldn't find any host available to create Volume"))
 }
 
-func (service *DsmService) DeleteVolume(volId string) error {
-	k8sVolume := service.GetVolume(volId)
+func (service *DsmService) DeleteVolume(ctx context.Context, volId string) error {
+	k8sVolume := service.GetVolume(ctx, volId)
 	if k8sVolume == nil {
-		log.Infof("Skip delete volume[%s] that is no exist", volId)
-		return nil
+		// an earlier attempt may have unmapped the LUN before failing to delete it
+		return service.deleteUnmappedLun(ctx, volId)
 	}
 
 	dsm, err := service.GetDsm(k8sVolume.DsmIp)
@@ -563,32 +956,55 @@ func (service *DsmService) DeleteVolume(volId string) error {
 		return status.Errorf(codes.Internal, fmt.Sprintf("Failed to get DSM[%s]", k8sVolume.DsmIp))
 	}
 
+	if k8sVolume.SubDir != "" {
+		return deleteSubDirVolume(ctx, dsm, k8sVolume)
+	}
+
 	if k8sVolume.Protocol == utils.ProtocolSmb || k8sVolume.Protocol == utils.ProtocolNfs {
-		if err := dsm.ShareDelete(k8sVolume.Share.Name); err != nil {
-			log.Errorf("[%s] Failed to delete Share(%s): %v", dsm.Ip, k8sVolume.Share.Name, err)
+		if k8sVolume.Protocol == utils.ProtocolNfs {
+			// remove the export rules along with the share
+			priv := webapi.SharePrivilege{ShareName: k8sVolume.Share.Name, Rule: []webapi.PrivilegeRule{}}
+			if err := dsm.ShareNfsPrivilegeSave(ctx, priv); err != nil {
+				log.WithContext(ctx).Warnf("[%s] Failed to remove NFS privilege of Share(%s): %v", dsm.Ip, k8sVolume.Share.Name, err)
+			}
+		}
+		if err := dsm.ShareDelete(ctx, k8sVolume.Share.Name); err != nil {
+			log.WithContext(ctx).Errorf("[%s] Failed to delete Share(%s): %v", dsm.Ip, k8sVolume.Share.Name, err)
 			return err
 		}
 	} else {
 		lun, target := k8sVolume.Lun, k8sVolume.Target
+		targetId := strconv.Itoa(target.TargetId)
+		onlyLun := len(target.MappedLuns) == 1
 
-		if err := dsm.LunDelete(lun.Uuid); err != nil {
-			if  _, err := dsm.LunGet(lun.Uuid); err != nil && errors.Is(err, utils.NoSuchLunError("")) {
-				return nil
+		if onlyLun && len(target.ConnectedSessions) > 0 {
+			return status.Errorf(codes.FailedPrecondition,
+				fmt.Sprintf("LUN(%s) is still used by %d sessions of target[%s]", lun.Uuid, len(target.ConnectedSessions), target.Name))
+		}
+
+		if err := retryLunOperation(ctx, func() error { return dsm.LunUnmapTarget(ctx, []string{targetId}, lun.Uuid) }); err != nil {
+			if !errors.Is(err, utils.NoSuchLunError("")) {
+				log.WithContext(ctx).Errorf("[%s] Failed to unmap LUN(%s) from target(%d): %v", dsm.Ip, lun.Uuid, target.TargetId, err)
+				return status.Errorf(codes.Unavailable, fmt.Sprintf("Failed to unmap LUN(%s) from target(%d): %v", lun.Uuid, target.TargetId, err))
 			}
-			log.Errorf("[%s] Failed to delete LUN(%s): %v", dsm.Ip, lun.Uuid, err)
+			// deleted by an earlier attempt, its target still has to be
+			log.WithContext(ctx).Infof("[%s] LUN(%s) is already gone, deleting what is left of it", dsm.Ip, lun.Uuid)
+		}
+
+		if err := deleteLun(ctx, dsm, lun.Uuid); err != nil {
 			return err
 		}
 
-		if len(target.MappedLuns) != 1 {
-			log.Infof("Skip deletes target[%s] that was mapped with lun. DSM[%s]", target.Name, dsm.Ip)
-			return nil
+		if !onlyLun {
+			// the other LUNs may have been unmapped in the meantime
+			return service.deleteTargetIfUnmapped(ctx, dsm, target)
 		}
 
-		if err := dsm.TargetDelete(strconv.Itoa(target.TargetId)); err != nil {
-			if  _, err := dsm.TargetGet(strconv.Itoa(target.TargetId)); err != nil {
+		if err := dsm.TargetDelete(ctx, targetId); err != nil {
+			if  _, err := dsm.TargetGet(ctx, targetId); err != nil {
 				return nil
 			}
-			log.Errorf("[%s] Failed to delete target(%d): %v", dsm.Ip, target.TargetId, err)
+			log.WithContext(ctx).Errorf("[%s] Failed to delete target(%d): %v", dsm.Ip, target.TargetId, err)
 			return err
 		}
 	}
@@ -596,27 +1012,78 @@ func (service *DsmService) DeleteVolume(volId string) error {
 	return nil
 }
 
-func (service *DsmService) listISCSIVolumes(dsmIp string) (infos []*models.K8sVolumeRespSpec) {
+// lunRetryTimeout bounds the retries of LUN operations failing while DSM is busy
+var lunRetryTimeout = 10 * time.Second
+
+// retryLunOperation retries op with backoff until it succeeds, the LUN is gone or lunRetryTimeout passes
+func retryLunOperation(ctx context.Context, op func() error) error {
+	retryBackoff := backoff.NewExponentialBackOff()
+	retryBackoff.InitialInterval = lunRetryTimeout / 20
+	retryBackoff.MaxElapsedTime = lunRetryTimeout
+
+	return backoff.Retry(func() error {
+		err := op()
+		if errors.Is(err, utils.NoSuchLunError("")) {
+			return backoff.Permanent(err)
+		}
+		return err
+	}, backoff.WithContext(retryBackoff, ctx))
+}
+
+// deleteLun deletes the LUN of lunUuid, succeeding if it is already gone
+func deleteLun(ctx context.Context, dsm *webapi.DSM, lunUuid string) error {
+	err := retryLunOperation(ctx, func() error { return dsm.LunDelete(ctx, lunUuid) })
+	if err == nil || errors.Is(err, utils.NoSuchLunError("")) {
+		return nil
+	}
+	log.WithContext(ctx).Errorf("[%s] Failed to delete LUN(%s): %v", dsm.Ip, lunUuid, err)
+	return status.Errorf(codes.Unavailable, fmt.Sprintf("Failed to delete LUN(%s): %v", lunUuid, err))
+}
+
+// deleteUnmappedLun deletes the LUN of volId if it exists without target
+func (service *DsmService) deleteUnmappedLun(ctx context.Context, volId string) error {
+	spec, err := models.DecodeVolumeID(volId)
+	if err != nil || (spec.Type != "" && spec.Type != models.VolumeIdTypeLun) {
+		log.WithContext(ctx).Infof("Skip delete volume[%s] that is no exist", volId)
+		return nil
+	}
+	for _, dsm := range service.dsms {
+		if spec.DsmIp != "" && spec.DsmIp != dsm.Ip {
+			continue
+		}
+		lun, err := dsm.LunGet(ctx, spec.Uuid)
+		if err != nil || lun.Uuid != spec.Uuid {
+			continue
+		}
+		log.WithContext(ctx).Infof("[%s] Deleting LUN(%s) mapped to no target", dsm.Ip, spec.Uuid)
+		return deleteLun(ctx, dsm, spec.Uuid)
+	}
+
+	log.WithContext(ctx).Infof("Skip delete volume[%s] that is no exist", volId)
+	return nil
+}
+
+func (service *DsmService) listISCSIVolumes(ctx context.Context, dsmIp string) (infos []*models.K8sVolumeRespSpec) {
 	for _, dsm := range service.dsms {
 		if dsmIp != "" && dsmIp != dsm.Ip {
 			continue
 		}
 
-		targetInfos, err := dsm.TargetList()
+		targetInfos, err := dsm.TargetList(ctx)
 		if err != nil {
-			log.Errorf("[%s] Failed to list targets: %v", dsm.Ip, err)
+			log.WithContext(ctx).Errorf("[%s] Failed to list targets: %v", dsm.Ip, err)
 			continue
 		}
 
 		for _, target := range targetInfos {
 			// TODO: use target.ConnectedSessions to filter targets
 			for _, mapping := range target.MappedLuns {
-				lun, err := dsm.LunGet(mapping.LunUuid)
+				lun, err := dsm.LunGet(ctx, mapping.LunUuid)
 				if err != nil {
-					log.Errorf("[%s] Failed to get LUN(%s): %v", dsm.Ip, mapping.LunUuid, err)
+					log.WithContext(ctx).Errorf("[%s] Failed to get LUN(%s): %v", dsm.Ip, mapping.LunUuid, err)
 				}
 
-				if !strings.HasPrefix(lun.Name, models.LunPrefix) {
+				if !strings.HasPrefix(lun.Name, models.LunPrefix) && !strings.HasPrefix(target.Name, models.TargetPrefix) {
 					continue
 				}
 
@@ -628,17 +1095,35 @@ func (service *DsmService) listISCSIVolumes(dsmIp string) (infos []*models.K8sVo
 	return infos
 }
 
-func (service *DsmService) ListVolumes() (infos []*models.K8sVolumeRespSpec) {
-	infos = append(infos, service.listISCSIVolumes("")...)
-	infos = append(infos, service.listSMBorNFSVolumes("")...)
+func (service *DsmService) ListVolumes(ctx context.Context) (infos []*models.K8sVolumeRespSpec) {
+	infos = append(infos, service.listISCSIVolumes(ctx, "")...)
+	infos = append(infos, service.listSMBorNFSVolumes(ctx, "")...)
 
 	return infos
 }
 
-func (service *DsmService) GetVolume(volId string) *models.K8sVolumeRespSpec {
-	volumes := service.ListVolumes()
+// GetVolume returns the volume of an ID of any version, nil if there is none
+func (service *DsmService) GetVolume(ctx context.Context, volId string) *models.K8sVolumeRespSpec {
+	spec, err := models.DecodeVolumeID(volId)
+	if err != nil {
+		log.WithContext(ctx).Warnf("Invalid volume ID: %v", err)
+		return nil
+	}
+
+	if spec.Type == models.VolumeIdTypeSubDir {
+		return service.getSubDirVolume(ctx, spec)
+	}
+
+	// the DSM and type of the versioned IDs save listing the others
+	var volumes []*models.K8sVolumeRespSpec
+	if spec.Type != models.VolumeIdTypeShare {
+		volumes = append(volumes, service.listISCSIVolumes(ctx, spec.DsmIp)...)
+	}
+	if spec.Type != models.VolumeIdTypeLun {
+		volumes = append(volumes, service.listSMBorNFSVolumes(ctx, spec.DsmIp)...)
+	}
 	for _, volume := range volumes {
-		if volume.VolumeId == volId {
+		if volume.VolumeId == volId || volumeIdSpec(volume).Matches(spec) {
 			return volume
 		}
 	}
@@ -646,11 +1131,13 @@ func (service *DsmService) GetVolume(volId string) *models.K8sVolumeRespSpec {
 	return nil
 }
 
-func (service *DsmService) GetVolumeByName(volName string) *models.K8sVolumeRespSpec {
-	volumes := service.ListVolumes()
+func (service *DsmService) GetVolumeByName(ctx context.Context, volName string) *models.K8sVolumeRespSpec {
+	volumes := service.ListVolumes(ctx)
 	for _, volume := range volumes {
+		// a LUN named by a lunNameTemplate is found by its target
 		if volume.Name == models.GenLunName(volName) ||
-			volume.Name == models.GenShareName(volName) {
+			volume.Name == models.GenShareName(volName) ||
+			(volume.Protocol == utils.ProtocolIscsi && volume.Target.Name == models.GenTargetName(volName)) {
 			return volume
 		}
 	}
@@ -658,8 +1145,8 @@ func (service *DsmService) GetVolumeByName(volName string) *models.K8sVolumeResp
 	return nil
 }
 
-func (service *DsmService) GetSnapshotByName(snapshotName string) *models.K8sSnapshotRespSpec {
-	snaps := service.ListAllSnapshots()
+func (service *DsmService) GetSnapshotByName(ctx context.Context, snapshotName string) *models.K8sSnapshotRespSpec {
+	snaps := service.ListAllSnapshots(ctx)
 	for _, snap := range snaps {
 		if snap.Name == snapshotName {
 			return snap
@@ -668,8 +1155,8 @@ func (service *DsmService) GetSnapshotByName(snapshotName string) *models.K8sSna
 	return nil
 }
 
-func (service *DsmService) ExpandVolume(volId string, newSize int64) (*models.K8sVolumeRespSpec, error) {
-	k8sVolume := service.GetVolume(volId);
+func (service *DsmService) ExpandVolume(ctx context.Context, volId string, newSize int64) (*models.K8sVolumeRespSpec, error) {
+	k8sVolume := service.GetVolume(ctx, volId);
 	if k8sVolume == nil {
 		return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("Can't find volume[%s].", volId))
 	}
@@ -680,27 +1167,43 @@ func (service *DsmService) ExpandVolume(volId string, newSize int64) (*models.K8
 				volId, newSize, k8sVolume.SizeInBytes))
 	}
 
+	// the volume already has the size, e.g. a retry of an expansion which succeeded
+	if k8sVolume.SizeInBytes == newSize {
+		return k8sVolume, nil
+	}
+
+	// subdirectories share the quota of their share, their capacity isn't enforced
+	if k8sVolume.SubDir != "" {
+		k8sVolume.SizeInBytes = newSize
+		return k8sVolume, nil
+	}
+
 	dsm, err := service.GetDsm(k8sVolume.DsmIp)
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, fmt.Sprintf("Failed to get DSM[%s]", k8sVolume.DsmIp))
 	}
 
 	if k8sVolume.Protocol == utils.ProtocolSmb || k8sVolume.Protocol == utils.ProtocolNfs {
+		if err := checkShareQuotaSupport(ctx, dsm, k8sVolume.Share); err != nil {
+			return nil, err
+		}
 		newSizeInMB := utils.BytesToMBCeil(newSize) // round up to MB
-		if err := dsm.SetShareQuota(k8sVolume.Share, newSizeInMB); err != nil {
-			log.Errorf("[%s] Failed to set quota [%d (MB)] to Share [%s]: %v",
+		if err := dsm.SetShareQuota(ctx, k8sVolume.Share, newSizeInMB); err != nil {
+			log.WithContext(ctx).Errorf("[%s] Failed to set quota [%d (MB)] to Share [%s]: %v",
 				dsm.Ip, newSizeInMB, k8sVolume.Share.Name, err)
-			return nil, status.Errorf(codes.Internal, fmt.Sprintf("Failed to expand volume[%s]. err: %v", volId, err))
+			return nil, dsmError(err, "Failed to expand volume[%s]", volId)
 		}
 		// convert MB to bytes, may be diff from the input newSize
 		k8sVolume.SizeInBytes = utils.MBToBytes(newSizeInMB)
 	} else {
 		spec := webapi.LunUpdateSpec{
-			Uuid: volId,
+			Uuid: k8sVolume.Lun.Uuid,
 			NewSize: uint64(newSize),
+			// keep the QoS limits of the LUN across the resize
+			Qos: k8sVolume.Lun.LunQos,
 		}
-		if err := dsm.LunUpdate(spec); err != nil {
-			return nil, status.Errorf(codes.Internal, fmt.Sprintf("Failed to expand volume[%s]. err: %v", volId, err))
+		if err := dsm.LunUpdate(ctx, spec); err != nil {
+			return nil, dsmError(err, "Failed to expand volume[%s]", volId)
 		}
 		k8sVolume.SizeInBytes = newSize
 	}
@@ -708,10 +1211,10 @@ func (service *DsmService) ExpandVolume(volId string, newSize int64) (*models.K8
 	return k8sVolume, nil
 }
 
-func (service *DsmService) CreateSnapshot(spec *models.CreateK8sVolumeSnapshotSpec) (*models.K8sSnapshotRespSpec, error) {
+func (service *DsmService) CreateSnapshot(ctx context.Context, spec *models.CreateK8sVolumeSnapshotSpec) (*models.K8sSnapshotRespSpec, error) {
 	srcVolId := spec.K8sVolumeId
 
-	k8sVolume := service.GetVolume(srcVolId);
+	k8sVolume := service.GetVolume(ctx, srcVolId);
 	if k8sVolume == nil {
 		return nil, status.Errorf(codes.NotFound, fmt.Sprintf("Can't find volume[%s].", srcVolId))
 	}
@@ -724,40 +1227,46 @@ func (service *DsmService) CreateSnapshot(spec *models.CreateK8sVolumeSnapshotSp
 	if k8sVolume.Protocol == utils.ProtocolIscsi {
 		snapshotSpec := webapi.SnapshotCreateSpec{
 			Name:    spec.SnapshotName,
-			LunUuid: srcVolId,
+			LunUuid: k8sVolume.Lun.Uuid,
 			Description: spec.Description,
 			TakenBy: spec.TakenBy,
 			IsLocked: spec.IsLocked,
 		}
 
-		snapshotUuid, err := dsm.SnapshotCreate(snapshotSpec)
+		snapshotUuid, err := dsm.SnapshotCreate(ctx, snapshotSpec)
 		if err != nil {
-			if err == utils.OutOfFreeSpaceError("") || err == utils.SnapshotReachMaxCountError("") {
-				return nil,status.Errorf(codes.ResourceExhausted, fmt.Sprintf("Failed to SnapshotCreate(%s), err: %v", srcVolId, err))
-			}
-			return nil, status.Errorf(codes.Internal, fmt.Sprintf("Failed to SnapshotCreate(%s), err: %v", srcVolId, err))
+			return nil, dsmError(err, "Failed to SnapshotCreate(%s)", srcVolId)
 		}
 
-		if snapshot := service.getISCSISnapshot(snapshotUuid); snapshot != nil {
+		if snapshot := service.waitISCSISnapshot(ctx, snapshotUuid); snapshot != nil {
 			return snapshot, nil
 		}
 
 		return nil, status.Errorf(codes.NotFound, fmt.Sprintf("Failed to get iscsi snapshot (%s). Not found", snapshotUuid))
 	} else if k8sVolume.Protocol == utils.ProtocolSmb || k8sVolume.Protocol == utils.ProtocolNfs {
+		if k8sVolume.SubDir != "" {
+			return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("Volume[%s] is a subdirectory of share [%s], whose snapshots would hold the other subdirectories",
+				srcVolId, k8sVolume.Share.Name))
+		}
+
+		if err := checkShareSnapshot(k8sVolume.Share); err != nil {
+			return nil, err
+		}
+
 		snapshotSpec := webapi.ShareSnapshotCreateSpec{
 			ShareName: k8sVolume.Share.Name,
 			Desc:      models.ShareSnapshotDescPrefix + spec.SnapshotName, // limitations: don't change the desc by DSM
 			IsLocked:  spec.IsLocked,
 		}
 
-		snapshotTime, err := dsm.ShareSnapshotCreate(snapshotSpec)
+		snapshotTime, err := dsm.ShareSnapshotCreate(ctx, snapshotSpec)
 		if err != nil {
-			return nil, status.Errorf(codes.Internal, fmt.Sprintf("Failed to ShareSnapshotCreate(%s), err: %v", srcVolId, err))
+			return nil, dsmError(err, "Failed to ShareSnapshotCreate(%s)", srcVolId)
 		}
 
-		snapshots := service.listSMBorNFSSnapshotsByDsm(dsm)
+		snapshots := service.listSMBorNFSSnapshotsByDsm(ctx, dsm)
 		for _, snapshot := range snapshots {
-			if snapshot.Time == snapshotTime && snapshot.ParentUuid == srcVolId {
+			if snapshot.Time == snapshotTime && snapshot.ParentUuid == k8sVolume.Share.Uuid {
 				return snapshot, nil
 			}
 		}
@@ -768,18 +1277,45 @@ func (service *DsmService) CreateSnapshot(spec *models.CreateK8sVolumeSnapshotSp
 	return nil, status.Error(codes.InvalidArgument, "Unsupported volume protocol")
 }
 
-func (service *DsmService) GetSnapshotByUuid(snapshotUuid string) *models.K8sSnapshotRespSpec {
-	snaps := service.ListAllSnapshots()
-	for _, snap := range snaps {
-		if snap.Uuid == snapshotUuid {
-			return snap
+// GetSnapshotByUuid queries the iSCSI snapshot by its uuid, share snapshots can only be found by listing them
+func (service *DsmService) GetSnapshotByUuid(ctx context.Context, snapshotUuid string) *models.K8sSnapshotRespSpec {
+	for _, dsm := range service.dsms {
+		info, err := dsm.SnapshotGet(ctx, snapshotUuid)
+		if err != nil || info.Uuid == "" {
+			continue
 		}
+
+		// the LUN only names the parent of the snapshot
+		lunInfo, err := dsm.LunGet(ctx, info.ParentUuid)
+		if err != nil {
+			log.WithContext(ctx).Warnf("[%s] Failed to get LUN[%s] of snapshot[%s]: %v", dsm.Ip, info.ParentUuid, snapshotUuid, err)
+		}
+		return DsmLunSnapshotToK8sSnapshot(dsm.Ip, info, lunInfo)
 	}
-	return nil
+
+	return service.getSMBorNFSSnapshot(ctx, snapshotUuid)
+}
+
+// SetUnlockSnapshotsOnDelete controls whether DeleteSnapshot unlocks locked
+// snapshots or refuses to delete them
+func (service *DsmService) SetUnlockSnapshotsOnDelete(unlock bool) {
+	service.unlockSnapshots = unlock
 }
 
-func (service *DsmService) DeleteSnapshot(snapshotUuid string) error {
-	snapshot := service.GetSnapshotByUuid(snapshotUuid)
+func (service *DsmService) unlockSnapshot(ctx context.Context, dsm *webapi.DSM, snapshot *models.K8sSnapshotRespSpec) error {
+	if !service.unlockSnapshots {
+		return status.Errorf(codes.FailedPrecondition, "Snapshot [%s] is locked on DSM [%s], unlock it before deleting", snapshot.Uuid, dsm.Ip)
+	}
+
+	log.WithContext(ctx).Infof("[%s] Unlocking snapshot [%s] before deletion", dsm.Ip, snapshot.Uuid)
+	if snapshot.Protocol == utils.ProtocolIscsi {
+		return dsm.SnapshotLockSet(ctx, snapshot.Uuid, false)
+	}
+	return dsm.ShareSnapshotLockSet(ctx, snapshot.Time, snapshot.ParentName, false)
+}
+
+func (service *DsmService) DeleteSnapshot(ctx context.Context, snapshotUuid string) error {
+	snapshot := service.GetSnapshotByUuid(ctx, snapshotUuid)
 	if snapshot == nil {
 		return nil
 	}
@@ -788,22 +1324,28 @@ func (service *DsmService) DeleteSnapshot(snapshotUuid string) error {
 		return err
 	}
 
+	if snapshot.IsLocked {
+		if err := service.unlockSnapshot(ctx, dsm, snapshot); err != nil {
+			return err
+		}
+	}
+
 	if snapshot.Protocol == utils.ProtocolSmb || snapshot.Protocol == utils.ProtocolNfs {
-		if err := dsm.ShareSnapshotDelete(snapshot.Time, snapshot.ParentName); err != nil {
-			if snapshot := service.getSMBorNFSSnapshot(snapshotUuid); snapshot == nil { // idempotency
+		if err := dsm.ShareSnapshotDelete(ctx, snapshot.Time, snapshot.ParentName); err != nil {
+			if snapshot := service.getSMBorNFSSnapshot(ctx, snapshotUuid); snapshot == nil { // idempotency
 				return nil
 			}
 
-			log.Errorf("Failed to delete Share snapshot [%s]. err: %v", snapshotUuid, err)
+			log.WithContext(ctx).Errorf("Failed to delete Share snapshot [%s]. err: %v", snapshotUuid, err)
 			return err
 		}
 	} else if snapshot.Protocol == utils.ProtocolIscsi {
-		if err := dsm.SnapshotDelete(snapshotUuid); err != nil {
-			if _, err := dsm.SnapshotGet(snapshotUuid); err != nil { // idempotency
+		if err := dsm.SnapshotDelete(ctx, snapshotUuid); err != nil {
+			if _, err := dsm.SnapshotGet(ctx, snapshotUuid); err != nil { // idempotency
 				return nil
 			}
 
-			log.Errorf("Failed to delete LUN snapshot [%s]. err: %v", snapshotUuid, err)
+			log.WithContext(ctx).Errorf("Failed to delete LUN snapshot [%s]. err: %v", snapshotUuid, err)
 			return err
 		}
 	}
@@ -811,13 +1353,13 @@ func (service *DsmService) DeleteSnapshot(snapshotUuid string) error {
 	return nil
 }
 
-func (service *DsmService) listISCSISnapshotsByDsm(dsm *webapi.DSM) (infos []*models.K8sSnapshotRespSpec) {
-	volumes := service.listISCSIVolumes(dsm.Ip)
+func (service *DsmService) listISCSISnapshotsByDsm(ctx context.Context, dsm *webapi.DSM) (infos []*models.K8sSnapshotRespSpec) {
+	volumes := service.listISCSIVolumes(ctx, dsm.Ip)
 	for _, volume := range volumes {
 		lunInfo := volume.Lun
-		lunSnaps, err := dsm.SnapshotList(lunInfo.Uuid)
+		lunSnaps, err := dsm.SnapshotList(ctx, lunInfo.Uuid)
 		if err != nil {
-			log.Errorf("[%s] Failed to list LUN[%s] snapshots: %v", dsm.Ip, lunInfo.Uuid, err)
+			log.WithContext(ctx).Errorf("[%s] Failed to list LUN[%s] snapshots: %v", dsm.Ip, lunInfo.Uuid, err)
 			continue
 		}
 
@@ -828,44 +1370,45 @@ func (service *DsmService) listISCSISnapshotsByDsm(dsm *webapi.DSM) (infos []*mo
 	return
 }
 
-func (service *DsmService) ListAllSnapshots() []*models.K8sSnapshotRespSpec {
+func (service *DsmService) ListAllSnapshots(ctx context.Context) []*models.K8sSnapshotRespSpec {
 	var allInfos []*models.K8sSnapshotRespSpec
 
 	for _, dsm := range service.dsms {
-		allInfos = append(allInfos, service.listISCSISnapshotsByDsm(dsm)...)
-		allInfos = append(allInfos, service.listSMBorNFSSnapshotsByDsm(dsm)...)
+		allInfos = append(allInfos, service.listISCSISnapshotsByDsm(ctx, dsm)...)
+		allInfos = append(allInfos, service.listSMBorNFSSnapshotsByDsm(ctx, dsm)...)
 	}
 
 	return allInfos
 }
 
-func (service *DsmService) ListSnapshots(volId string) []*models.K8sSnapshotRespSpec {
+func (service *DsmService) ListSnapshots(ctx context.Context, volId string) []*models.K8sSnapshotRespSpec {
 	var allInfos []*models.K8sSnapshotRespSpec
 
-	k8sVolume := service.GetVolume(volId);
-	if k8sVolume == nil {
+	k8sVolume := service.GetVolume(ctx, volId);
+	// the snapshots of the share of a subdirectory aren't of the subdirectory
+	if k8sVolume == nil || k8sVolume.SubDir != "" {
 		return nil
 	}
 
 	dsm, err := service.GetDsm(k8sVolume.DsmIp)
 	if err != nil {
-		log.Errorf("Failed to get DSM[%s]", k8sVolume.DsmIp)
+		log.WithContext(ctx).Errorf("Failed to get DSM[%s]", k8sVolume.DsmIp)
 		return nil
 	}
 
 	if k8sVolume.Protocol == utils.ProtocolIscsi {
-		infos, err := dsm.SnapshotList(volId)
+		infos, err := dsm.SnapshotList(ctx, k8sVolume.Lun.Uuid)
 		if err != nil {
-			log.Errorf("Failed to SnapshotList[%s]", volId)
+			log.WithContext(ctx).Errorf("Failed to SnapshotList[%s]", volId)
 			return nil
 		}
 		for _, info := range infos {
 			allInfos = append(allInfos, DsmLunSnapshotToK8sSnapshot(dsm.Ip, info, k8sVolume.Lun))
 		}
 	} else {
-		infos, err := dsm.ShareSnapshotList(k8sVolume.Share.Name)
+		infos, err := dsm.ShareSnapshotList(ctx, k8sVolume.Share.Name)
 		if err != nil {
-			log.Errorf("Failed to ShareSnapshotList[%s]", k8sVolume.Share.Name)
+			log.WithContext(ctx).Errorf("Failed to ShareSnapshotList[%s]", k8sVolume.Share.Name)
 			return nil
 		}
 		for _, info := range infos {
@@ -883,12 +1426,15 @@ func DsmShareSnapshotToK8sSnapshot(dsmIp string, info webapi.ShareSnapshotInfo,
 		Uuid: info.Uuid,
 		ParentName: shareInfo.Name,
 		ParentUuid: shareInfo.Uuid,
+		ParentVolumeId: k8sVolumeId(dsmIp, protocol, shareInfo.Uuid),
 		Status: "Healthy", // share snapshot always Healthy
 		SizeInBytes: utils.MBToBytes(shareInfo.QuotaValueInMB), // unable to get snapshot quota, return parent quota instead
+		UsedSizeInBytes: shareSnapshotSize(info),
 		CreateTime: GMTToUnixSecond(info.Time),
 		Time: info.Time,
 		RootPath: shareInfo.VolPath,
 		Protocol: protocol,
+		IsLocked: info.Lock,
 	}
 }
 
@@ -899,18 +1445,21 @@ func DsmLunSnapshotToK8sSnapshot(dsmIp string, info webapi.SnapshotInfo, lunInfo
 		Uuid: info.Uuid,
 		ParentName: lunInfo.Name, // it can be empty for iscsi
 		ParentUuid: info.ParentUuid,
+		ParentVolumeId: k8sVolumeId(dsmIp, utils.ProtocolIscsi, info.ParentUuid),
 		Status: info.Status,
 		SizeInBytes: info.TotalSize,
+		UsedSizeInBytes: info.UsedSize,
 		CreateTime: info.CreateTime,
 		Time: "",
 		RootPath: info.RootPath,
 		Protocol: utils.ProtocolIscsi,
+		IsLocked: info.IsLocked,
 	}
 }
 
-func (service *DsmService) getISCSISnapshot(snapshotUuid string) *models.K8sSnapshotRespSpec {
+func (service *DsmService) getISCSISnapshot(ctx context.Context, snapshotUuid string) *models.K8sSnapshotRespSpec {
 	for _, dsm := range service.dsms {
-		snapshots := service.listISCSISnapshotsByDsm(dsm)
+		snapshots := service.listISCSISnapshotsByDsm(ctx, dsm)
 		for _, snap := range snapshots {
 			if snap.Uuid == snapshotUuid {
 				return snap
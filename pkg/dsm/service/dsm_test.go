@@ -0,0 +1,609 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+func TestValidateCloneSource(t *testing.T) {
+	lun := &models.K8sVolumeRespSpec{DsmIp: "10.0.0.1", Protocol: utils.ProtocolIscsi, SizeInBytes: 2 * utils.UNIT_GB}
+	share := &models.K8sVolumeRespSpec{DsmIp: "10.0.0.1", Protocol: utils.ProtocolNfs, SizeInBytes: 2 * utils.UNIT_GB}
+
+	tests := []struct {
+		name     string
+		spec     models.CreateK8sVolumeSpec
+		src      *models.K8sVolumeRespSpec
+		wantCode codes.Code
+	}{
+		{name: "same size", spec: models.CreateK8sVolumeSpec{Protocol: utils.ProtocolIscsi, Size: 2 * utils.UNIT_GB}, src: lun, wantCode: codes.OK},
+		{name: "larger", spec: models.CreateK8sVolumeSpec{Protocol: utils.ProtocolIscsi, Size: 3 * utils.UNIT_GB}, src: lun, wantCode: codes.OK},
+		{name: "source size", spec: models.CreateK8sVolumeSpec{Protocol: utils.ProtocolIscsi}, src: lun, wantCode: codes.OK},
+		{name: "too small", spec: models.CreateK8sVolumeSpec{Protocol: utils.ProtocolIscsi, Size: utils.UNIT_GB}, src: lun, wantCode: codes.OutOfRange},
+		{name: "same DSM", spec: models.CreateK8sVolumeSpec{DsmIp: "10.0.0.1", Protocol: utils.ProtocolIscsi}, src: lun, wantCode: codes.OK},
+		{name: "other DSM", spec: models.CreateK8sVolumeSpec{DsmIp: "10.0.0.2", Protocol: utils.ProtocolIscsi}, src: lun, wantCode: codes.InvalidArgument},
+		{name: "lun to share", spec: models.CreateK8sVolumeSpec{Protocol: utils.ProtocolNfs}, src: lun, wantCode: codes.InvalidArgument},
+		{name: "share to share", spec: models.CreateK8sVolumeSpec{Protocol: utils.ProtocolSmb, Size: 2 * utils.UNIT_GB}, src: share, wantCode: codes.OK},
+		{name: "share too small", spec: models.CreateK8sVolumeSpec{Protocol: utils.ProtocolNfs, Size: utils.UNIT_GB}, src: share, wantCode: codes.OutOfRange},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateCloneSource(&tt.spec, tt.src)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Errorf("validateCloneSource() code = %v, want %v (err: %v)", code, tt.wantCode, err)
+			}
+		})
+	}
+}
+
+func TestValidateCloneSize_snapshot(t *testing.T) {
+	tests := []struct {
+		name     string
+		spec     models.CreateK8sVolumeSpec
+		wantCode codes.Code
+	}{
+		{name: "restore", spec: models.CreateK8sVolumeSpec{Protocol: utils.ProtocolIscsi, Size: 2 * utils.UNIT_GB}, wantCode: codes.OK},
+		{name: "restore larger", spec: models.CreateK8sVolumeSpec{Protocol: utils.ProtocolIscsi, Size: 4 * utils.UNIT_GB}, wantCode: codes.OK},
+		{name: "undersized", spec: models.CreateK8sVolumeSpec{Protocol: utils.ProtocolIscsi, Size: utils.UNIT_GB}, wantCode: codes.OutOfRange},
+		{name: "undersized share", spec: models.CreateK8sVolumeSpec{Protocol: utils.ProtocolSmb, Size: utils.UNIT_GB}, wantCode: codes.OutOfRange},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateCloneSize(&tt.spec, 2*utils.UNIT_GB, "snapshot")
+			if code := status.Code(err); code != tt.wantCode {
+				t.Errorf("validateCloneSize() code = %v, want %v (err: %v)", code, tt.wantCode, err)
+			}
+		})
+	}
+}
+
+func TestGrowClonedLun(t *testing.T) {
+	var requests []url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.URL.Query())
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true})
+	}))
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	dsm := &webapi.DSM{Ip: host, Port: p}
+
+	lunInfo := webapi.LunInfo{Name: "k8s-csi-pvc-restored", Uuid: "lun-uuid", Size: uint64(2 * utils.UNIT_GB)}
+	if err := growClonedLun(context.Background(), dsm, &lunInfo, 2*utils.UNIT_GB); err != nil || len(requests) != 0 {
+		t.Fatalf("growClonedLun() of same size sent %d requests, err: %v", len(requests), err)
+	}
+
+	if err := growClonedLun(context.Background(), dsm, &lunInfo, 3*utils.UNIT_GB); err != nil {
+		t.Fatalf("growClonedLun() error = %v", err)
+	}
+	if len(requests) != 1 || requests[0].Get("method") != "set" || requests[0].Get("new_size") != strconv.FormatInt(3*utils.UNIT_GB, 10) {
+		t.Errorf("growClonedLun() requests = %v", requests)
+	}
+	if lunInfo.Size != uint64(3*utils.UNIT_GB) {
+		t.Errorf("growClonedLun() size = %d, want %d", lunInfo.Size, 3*utils.UNIT_GB)
+	}
+}
+
+func TestGetLunTypeByInputParams(t *testing.T) {
+	tests := []struct {
+		lunType   string
+		isThin    bool
+		snapshots bool
+		fsType    string
+		want      string
+		wantErr   bool
+	}{
+		{isThin: true, fsType: models.FsTypeBtrfs, want: models.LunTypeBlun},
+		{isThin: false, fsType: models.FsTypeBtrfs, want: models.LunTypeBlunThick},
+		{isThin: true, fsType: models.FsTypeExt4, want: models.LunTypeAdv},
+		{isThin: false, fsType: models.FsTypeExt4, want: models.LunTypeFile},
+		{lunType: models.LunTypeThin, fsType: models.FsTypeExt4, want: models.LunTypeThin},
+		{lunType: models.LunTypeBlunThick, fsType: models.FsTypeBtrfs, want: models.LunTypeBlunThick},
+		{lunType: models.LunTypeBlunThick, fsType: models.FsTypeExt4, wantErr: true},
+		{lunType: models.LunTypeFile, fsType: models.FsTypeBtrfs, wantErr: true},
+		{isThin: true, fsType: "xfs", wantErr: true},
+		// snapshots need an advanced LUN
+		{isThin: true, snapshots: true, fsType: models.FsTypeBtrfs, want: models.LunTypeBlun},
+		{isThin: false, snapshots: true, fsType: models.FsTypeBtrfs, want: models.LunTypeBlunThick},
+		{isThin: true, snapshots: true, fsType: models.FsTypeExt4, want: models.LunTypeAdv},
+		{isThin: false, snapshots: true, fsType: models.FsTypeExt4, wantErr: true},
+		{lunType: models.LunTypeAdv, snapshots: true, fsType: models.FsTypeExt4, want: models.LunTypeAdv},
+		{lunType: models.LunTypeThin, snapshots: true, fsType: models.FsTypeExt4, wantErr: true},
+		{lunType: models.LunTypeFile, snapshots: true, fsType: models.FsTypeExt4, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := getLunTypeByInputParams(tt.lunType, tt.isThin, tt.snapshots, tt.fsType)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("getLunTypeByInputParams(%q, %v, %v, %q) = %q, %v, want %q, error: %v",
+				tt.lunType, tt.isThin, tt.snapshots, tt.fsType, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestCreateVolume_dryRun(t *testing.T) {
+	var methods []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		methods = append(methods, query.Get("api")+"."+query.Get("method"))
+		var data interface{}
+		if query.Get("api") == "SYNO.Core.Storage.Volume" {
+			data = map[string]interface{}{"volume": webapi.VolInfo{
+				Path: "/volume1", Status: "normal", FsType: models.FsTypeBtrfs,
+				Size: strconv.FormatInt(10*utils.UNIT_GB, 10), Free: strconv.FormatInt(2*utils.UNIT_GB, 10),
+			}}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "data": data})
+	}))
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	service := NewDsmService()
+	service.dsms[host] = &webapi.DSM{Ip: host, Port: p}
+
+	tests := []struct {
+		name     string
+		spec     models.CreateK8sVolumeSpec
+		wantCode codes.Code
+	}{
+		{name: "thin lun", spec: models.CreateK8sVolumeSpec{Protocol: utils.ProtocolIscsi, Size: 5 * utils.UNIT_GB, ThinProvisioning: true}, wantCode: codes.OK},
+		{name: "thick lun", spec: models.CreateK8sVolumeSpec{Protocol: utils.ProtocolIscsi, Size: utils.UNIT_GB}, wantCode: codes.OK},
+		{name: "thick lun without space", spec: models.CreateK8sVolumeSpec{Protocol: utils.ProtocolIscsi, Size: 5 * utils.UNIT_GB}, wantCode: codes.ResourceExhausted},
+		{name: "lun type", spec: models.CreateK8sVolumeSpec{Protocol: utils.ProtocolIscsi, Size: utils.UNIT_GB, Type: models.LunTypeFile}, wantCode: codes.InvalidArgument},
+		{name: "share", spec: models.CreateK8sVolumeSpec{Protocol: utils.ProtocolSmb, Size: 5 * utils.UNIT_GB}, wantCode: codes.OK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			methods = nil
+			spec := tt.spec
+			spec.K8sVolumeName, spec.LunName, spec.ShareName = "pvc-1", "k8s-csi-pvc-1", "k8s-csi-pvc-1"
+			spec.Location, spec.DryRun = "/volume1", true
+
+			vol, err := service.CreateVolume(context.Background(), &spec)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("CreateVolume() code = %v, want %v (err: %v)", code, tt.wantCode, err)
+			}
+			if err == nil && vol.VolumeId != models.DryRunVolumePrefix+"pvc-1" {
+				t.Errorf("CreateVolume() volume ID = %q", vol.VolumeId)
+			}
+			for _, method := range methods {
+				if method != "SYNO.Core.Storage.Volume.get" {
+					t.Errorf("CreateVolume() sent %s in a dry run", method)
+				}
+			}
+		})
+	}
+}
+
+// fakeIscsiDsm serves the iSCSI APIs used by DeleteVolume for one LUN mapped to one target,
+// recording the iSCSI methods called
+type fakeIscsiDsm struct {
+	lunExists   bool
+	mapped      bool
+	sessions    []webapi.ConncetedSession
+	busyDeletes int
+	unmapGone   bool // the LUN is deleted by someone else while being unmapped
+	methods     []string
+}
+
+func (f *fakeIscsiDsm) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	method := query.Get("api") + "." + query.Get("method")
+	if strings.HasPrefix(method, "SYNO.Core.ISCSI.") {
+		f.methods = append(f.methods, method)
+	}
+
+	resp := map[string]interface{}{"success": true}
+	fail := func(code int) { resp = map[string]interface{}{"success": false, "error": map[string]int{"code": code}} }
+	lun := webapi.LunInfo{Name: "k8s-csi-pvc-1", Uuid: "lun-uuid"}
+
+	switch method {
+	case "SYNO.Core.ISCSI.Target.list":
+		target := webapi.TargetInfo{Name: "k8s-csi-pvc-1", TargetId: 1, ConnectedSessions: f.sessions}
+		if f.mapped {
+			target.MappedLuns = []webapi.MappedLun{{LunUuid: lun.Uuid}}
+		}
+		resp["data"] = map[string]interface{}{"targets": []webapi.TargetInfo{target}}
+	case "SYNO.Core.ISCSI.LUN.get":
+		if !f.lunExists {
+			fail(18990531)
+		} else {
+			resp["data"] = map[string]interface{}{"lun": lun}
+		}
+	case "SYNO.Core.ISCSI.LUN.unmap_target":
+		f.mapped = false
+		if f.unmapGone {
+			f.lunExists = false
+			fail(18990531)
+		}
+	case "SYNO.Core.ISCSI.LUN.delete":
+		if !f.lunExists {
+			fail(18990531)
+		} else if f.busyDeletes > 0 {
+			f.busyDeletes--
+			fail(18990999)
+		} else {
+			f.lunExists = false
+		}
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func TestDeleteVolume(t *testing.T) {
+	defer func(timeout time.Duration) { lunRetryTimeout = timeout }(lunRetryTimeout)
+	lunRetryTimeout = 200 * time.Millisecond
+
+	tests := []struct {
+		name        string
+		dsm         fakeIscsiDsm
+		wantCode    codes.Code
+		wantMethods []string
+	}{
+		{
+			name:        "already deleted",
+			dsm:         fakeIscsiDsm{},
+			wantCode:    codes.OK,
+			wantMethods: []string{"SYNO.Core.ISCSI.Target.list", "SYNO.Core.ISCSI.LUN.get"},
+		},
+		{
+			name:     "unmap then delete",
+			dsm:      fakeIscsiDsm{lunExists: true, mapped: true, busyDeletes: 1},
+			wantCode: codes.OK,
+			wantMethods: []string{"SYNO.Core.ISCSI.Target.list", "SYNO.Core.ISCSI.LUN.get", "SYNO.Core.ISCSI.LUN.unmap_target",
+				"SYNO.Core.ISCSI.LUN.delete", "SYNO.Core.ISCSI.LUN.delete", "SYNO.Core.ISCSI.Target.delete"},
+		},
+		{
+			// the target is still deleted, or it would leak at every retry
+			name:     "LUN gone while unmapped",
+			dsm:      fakeIscsiDsm{lunExists: true, mapped: true, unmapGone: true},
+			wantCode: codes.OK,
+			wantMethods: []string{"SYNO.Core.ISCSI.Target.list", "SYNO.Core.ISCSI.LUN.get", "SYNO.Core.ISCSI.LUN.unmap_target",
+				"SYNO.Core.ISCSI.LUN.delete", "SYNO.Core.ISCSI.Target.delete"},
+		},
+		{
+			name:        "unmapped by an earlier attempt",
+			dsm:         fakeIscsiDsm{lunExists: true},
+			wantCode:    codes.OK,
+			wantMethods: []string{"SYNO.Core.ISCSI.Target.list", "SYNO.Core.ISCSI.LUN.get", "SYNO.Core.ISCSI.LUN.delete"},
+		},
+		{
+			name:        "active session",
+			dsm:         fakeIscsiDsm{lunExists: true, mapped: true, sessions: []webapi.ConncetedSession{{Iqn: "iqn.node"}}},
+			wantCode:    codes.FailedPrecondition,
+			wantMethods: []string{"SYNO.Core.ISCSI.Target.list", "SYNO.Core.ISCSI.LUN.get"},
+		},
+		{
+			name:     "busy",
+			dsm:      fakeIscsiDsm{lunExists: true, mapped: true, busyDeletes: 1000},
+			wantCode: codes.Unavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := tt.dsm
+			server := httptest.NewServer(&fake)
+			defer server.Close()
+			host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+			p, _ := strconv.Atoi(port)
+			service := NewDsmService()
+			service.dsms[host] = &webapi.DSM{Ip: host, Port: p}
+
+			err := service.DeleteVolume(context.Background(), "lun-uuid")
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("DeleteVolume() code = %v, want %v (err: %v)", code, tt.wantCode, err)
+			}
+			if tt.wantMethods != nil && !reflect.DeepEqual(fake.methods, tt.wantMethods) {
+				t.Errorf("DeleteVolume() sent %v, want %v", fake.methods, tt.wantMethods)
+			}
+		})
+	}
+}
+
+func TestCreateVolume_unsupportedByDsm(t *testing.T) {
+	var methods []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		methods = append(methods, query.Get("api")+"."+query.Get("method"))
+		var data interface{}
+		switch query.Get("api") {
+		case "SYNO.Core.Storage.Volume":
+			data = map[string]interface{}{"volume": webapi.VolInfo{
+				Path: "/volume1", Status: "normal", FsType: models.FsTypeBtrfs,
+				Size: strconv.FormatInt(10*utils.UNIT_GB, 10), Free: strconv.FormatInt(10*utils.UNIT_GB, 10),
+			}}
+		case "SYNO.Core.System":
+			data = webapi.DsmSysInfo{FirmwareVer: "DSM 6.2.4-25556"}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "data": data})
+	}))
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	service := NewDsmService()
+	service.dsms[host] = &webapi.DSM{Ip: host, Port: p}
+
+	tests := []struct {
+		name      string
+		qos       webapi.LunQos
+		blockSize int
+		wantCode  codes.Code
+	}{
+		{name: "qos", qos: webapi.LunQos{MaxIops: 500}, wantCode: codes.FailedPrecondition},
+		{name: "4Kn", blockSize: models.LunBlockSize4Kn, wantCode: codes.FailedPrecondition},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			methods = nil
+			spec := models.CreateK8sVolumeSpec{
+				K8sVolumeName: "pvc-1", LunName: "k8s-csi-pvc-1", Location: "/volume1",
+				Protocol: utils.ProtocolIscsi, Size: utils.UNIT_GB, ThinProvisioning: true,
+				Qos: tt.qos, BlockSize: tt.blockSize,
+			}
+			_, err := service.CreateVolume(context.Background(), &spec)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("CreateVolume() code = %v, want %v (err: %v)", code, tt.wantCode, err)
+			}
+			for _, method := range methods {
+				if method == "SYNO.Core.ISCSI.LUN.create" {
+					t.Errorf("CreateVolume() created a LUN on a DSM without %s support", tt.name)
+				}
+			}
+		})
+	}
+}
+
+// fakeSnapshotDsm serves one LUN and one NFS share, recording the snapshot methods called
+type fakeSnapshotDsm struct {
+	shareSupportsSnapshot bool
+	// lunSnapshotStatuses are the statuses of the LUN snapshot in the next lists, the last one stays
+	lunSnapshotStatuses []string
+	methods             []string
+}
+
+func (f *fakeSnapshotDsm) lunSnapshotStatus() string {
+	if len(f.lunSnapshotStatuses) == 0 {
+		return "Healthy"
+	}
+	status := f.lunSnapshotStatuses[0]
+	if len(f.lunSnapshotStatuses) > 1 {
+		f.lunSnapshotStatuses = f.lunSnapshotStatuses[1:]
+	}
+	return status
+}
+
+func (f *fakeSnapshotDsm) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	method := query.Get("api") + "." + query.Get("method")
+	if strings.Contains(method, "napshot") {
+		f.methods = append(f.methods, method)
+	}
+
+	const snapTime = "GMT+08-2022.01.14-19.18.29"
+	lun := webapi.LunInfo{Name: "k8s-csi-pvc-lun", Uuid: "lun-uuid"}
+	var data interface{}
+	switch method {
+	case "SYNO.Core.System.info":
+		data = webapi.DsmSysInfo{FirmwareVer: "DSM 7.1.1-42962"}
+	case "SYNO.Core.ISCSI.Target.list":
+		data = map[string]interface{}{"targets": []webapi.TargetInfo{
+			{Name: "k8s-csi-pvc-lun", TargetId: 1, MappedLuns: []webapi.MappedLun{{LunUuid: lun.Uuid}}},
+		}}
+	case "SYNO.Core.ISCSI.LUN.get":
+		data = map[string]interface{}{"lun": lun}
+	case "SYNO.Core.ISCSI.LUN.take_snapshot":
+		data = map[string]string{"snapshot_uuid": "lun-snap-uuid"}
+	case "SYNO.Core.ISCSI.LUN.list_snapshot":
+		data = map[string]interface{}{"snapshots": []webapi.SnapshotInfo{
+			{Uuid: "lun-snap-uuid", ParentUuid: lun.Uuid, Status: f.lunSnapshotStatus(), TotalSize: 1 << 30, UsedSize: 1 << 20},
+		}}
+	case "SYNO.Core.Share.list":
+		data = map[string]interface{}{"shares": []webapi.ShareInfo{
+			{Name: "k8s-csi-pvc-nfs", Uuid: "share-uuid", VolPath: "/volume1", SupportSnapshot: f.shareSupportsSnapshot},
+		}}
+	case "SYNO.Core.FileServ.NFS.SharePrivilege.load":
+		data = webapi.SharePrivilege{ShareName: "k8s-csi-pvc-nfs", Rule: []webapi.PrivilegeRule{{Client: "10.0.0.0/24"}}}
+	case "SYNO.Core.Share.Snapshot.create":
+		data = snapTime
+	case "SYNO.Core.Share.Snapshot.list":
+		data = map[string]interface{}{"snapshots": []webapi.ShareSnapshotInfo{{Uuid: "share-snap-uuid", Time: snapTime, SnapSize: "4096"}}}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "data": data})
+}
+
+func TestCreateSnapshot_protocol(t *testing.T) {
+	tests := []struct {
+		name       string
+		volumeId   string
+		dsm        fakeSnapshotDsm
+		wantCode   codes.Code
+		wantUuid   string
+		wantMethod string
+	}{
+		{name: "lun", volumeId: "lun-uuid", wantCode: codes.OK, wantUuid: "lun-snap-uuid", wantMethod: "SYNO.Core.ISCSI.LUN.take_snapshot"},
+		{name: "nfs share", volumeId: "share-uuid", dsm: fakeSnapshotDsm{shareSupportsSnapshot: true}, wantCode: codes.OK,
+			wantUuid: "share-snap-uuid", wantMethod: "SYNO.Core.Share.Snapshot.create"},
+		{name: "snapshots disabled", volumeId: "share-uuid", wantCode: codes.FailedPrecondition},
+		{name: "missing volume", volumeId: "missing", wantCode: codes.NotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := tt.dsm
+			server := httptest.NewServer(&fake)
+			defer server.Close()
+			host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+			p, _ := strconv.Atoi(port)
+			service := NewDsmService()
+			service.dsms[host] = &webapi.DSM{Ip: host, Port: p}
+
+			snapshot, err := service.CreateSnapshot(context.Background(), &models.CreateK8sVolumeSnapshotSpec{
+				K8sVolumeId: tt.volumeId, SnapshotName: "snapshot-1",
+			})
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("CreateSnapshot() code = %v, want %v (err: %v)", code, tt.wantCode, err)
+			}
+
+			creates := []string{}
+			for _, method := range fake.methods {
+				if strings.HasSuffix(method, ".take_snapshot") || strings.HasSuffix(method, "Snapshot.create") {
+					creates = append(creates, method)
+				}
+			}
+			if err != nil {
+				if len(creates) != 0 {
+					t.Errorf("CreateSnapshot() failed but sent %v", creates)
+				}
+				return
+			}
+			if !reflect.DeepEqual(creates, []string{tt.wantMethod}) {
+				t.Errorf("CreateSnapshot() sent %v, want %s", creates, tt.wantMethod)
+			}
+			if snapshot.Uuid != tt.wantUuid || snapshot.ParentUuid != tt.volumeId {
+				t.Errorf("CreateSnapshot() = %+v, want uuid %s of %s", snapshot, tt.wantUuid, tt.volumeId)
+			}
+		})
+	}
+}
+
+func TestCreateSnapshot_waitReady(t *testing.T) {
+	defer func(timeout time.Duration) { snapshotReadyTimeout = timeout }(snapshotReadyTimeout)
+	snapshotReadyTimeout = 200 * time.Millisecond
+
+	tests := []struct {
+		name      string
+		statuses  []string
+		wantReady bool
+		wantLists int
+	}{
+		{name: "complete", wantReady: true, wantLists: 1},
+		{name: "completed while polling", statuses: []string{"Creating", "Creating", "Healthy"}, wantReady: true, wantLists: 3},
+		{name: "still processing", statuses: []string{"Creating"}, wantReady: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := fakeSnapshotDsm{lunSnapshotStatuses: tt.statuses}
+			server := httptest.NewServer(&fake)
+			defer server.Close()
+			host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+			p, _ := strconv.Atoi(port)
+			service := NewDsmService()
+			service.dsms[host] = &webapi.DSM{Ip: host, Port: p}
+
+			snapshot, err := service.CreateSnapshot(context.Background(), &models.CreateK8sVolumeSnapshotSpec{
+				K8sVolumeId: "lun-uuid", SnapshotName: "snapshot-1",
+			})
+			if err != nil {
+				t.Fatalf("CreateSnapshot() error = %v", err)
+			}
+			if snapshot.IsReady() != tt.wantReady {
+				t.Errorf("CreateSnapshot() status = %s, want ready %v", snapshot.Status, tt.wantReady)
+			}
+			if snapshot.SizeInBytes != 1<<30 || snapshot.UsedSizeInBytes != 1<<20 {
+				t.Errorf("CreateSnapshot() sizes = %d, %d, want the LUN size and the consumed size", snapshot.SizeInBytes, snapshot.UsedSizeInBytes)
+			}
+
+			lists := 0
+			for _, method := range fake.methods {
+				if method == "SYNO.Core.ISCSI.LUN.list_snapshot" {
+					lists++
+				}
+			}
+			if tt.wantLists > 0 && lists != tt.wantLists {
+				t.Errorf("CreateSnapshot() listed the snapshots %d times, want %d", lists, tt.wantLists)
+			} else if tt.wantLists == 0 && lists < 2 {
+				t.Errorf("CreateSnapshot() listed the snapshots %d times, want polling until the timeout", lists)
+			}
+		})
+	}
+}
+
+func TestShareSnapshotSize(t *testing.T) {
+	for size, want := range map[string]int64{"4096": 4096, "": 0, "-1": 0, "1.5 GB": 0} {
+		if got := shareSnapshotSize(webapi.ShareSnapshotInfo{SnapSize: size}); got != want {
+			t.Errorf("shareSnapshotSize(%q) = %d, want %d", size, got, want)
+		}
+	}
+}
+
+// fakeQuotaDsm serves one NFS share of 1GB, recording the share info of its updates
+type fakeQuotaDsm struct {
+	fsType  string
+	updates []webapi.ShareUpdateInfo
+}
+
+func (f *fakeQuotaDsm) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	var data interface{}
+	switch query.Get("api") + "." + query.Get("method") {
+	case "SYNO.Core.Share.list":
+		data = map[string]interface{}{"shares": []webapi.ShareInfo{
+			{Name: "k8s-csi-pvc-nfs", Uuid: "share-uuid", VolPath: "/volume1", QuotaValueInMB: 1024},
+		}}
+	case "SYNO.Core.FileServ.NFS.SharePrivilege.load":
+		data = webapi.SharePrivilege{ShareName: "k8s-csi-pvc-nfs", Rule: []webapi.PrivilegeRule{{Client: "10.0.0.0/24"}}}
+	case "SYNO.Core.Storage.Volume.get":
+		data = map[string]interface{}{"volume": webapi.VolInfo{Path: "/volume1", Status: "normal", FsType: f.fsType}}
+	case "SYNO.Core.Share.set":
+		update := webapi.ShareUpdateInfo{}
+		json.Unmarshal([]byte(query.Get("shareinfo")), &update)
+		f.updates = append(f.updates, update)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "data": data})
+}
+
+func TestExpandVolume_shareQuota(t *testing.T) {
+	tests := []struct {
+		name      string
+		fsType    string
+		newSize   int64
+		wantCode  codes.Code
+		wantQuota int64 // MB, 0 if the quota isn't updated
+	}{
+		{name: "expand", fsType: models.FsTypeBtrfs, newSize: 2 * utils.UNIT_GB, wantQuota: 2048},
+		{name: "rounded up to MB", fsType: models.FsTypeBtrfs, newSize: 2*utils.UNIT_GB + 1, wantQuota: 2049},
+		{name: "same size", fsType: models.FsTypeBtrfs, newSize: utils.UNIT_GB},
+		{name: "shrink", fsType: models.FsTypeBtrfs, newSize: utils.UNIT_GB / 2, wantCode: codes.InvalidArgument},
+		{name: "no share quota on ext4", fsType: models.FsTypeExt4, newSize: 2 * utils.UNIT_GB, wantCode: codes.FailedPrecondition},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeQuotaDsm{fsType: tt.fsType}
+			server := httptest.NewServer(fake)
+			defer server.Close()
+			host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+			p, _ := strconv.Atoi(port)
+			service := NewDsmService()
+			service.dsms[host] = &webapi.DSM{Ip: host, Port: p}
+
+			volume, err := service.ExpandVolume(context.Background(), "share-uuid", tt.newSize)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("ExpandVolume() code = %v, want %v (err: %v)", code, tt.wantCode, err)
+			}
+			if tt.wantQuota == 0 {
+				if len(fake.updates) != 0 {
+					t.Errorf("ExpandVolume() updated the share with %+v, want no update", fake.updates)
+				}
+				return
+			}
+			if len(fake.updates) != 1 || fake.updates[0].QuotaForCreate == nil || *fake.updates[0].QuotaForCreate != tt.wantQuota {
+				t.Fatalf("ExpandVolume() updated the share with %+v, want quota %d MB", fake.updates, tt.wantQuota)
+			}
+			if volume.SizeInBytes != utils.MBToBytes(tt.wantQuota) {
+				t.Errorf("ExpandVolume() size = %d, want %d", volume.SizeInBytes, utils.MBToBytes(tt.wantQuota))
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+/*
+ * Copyright 2021 Synology Inc.
+ */
+
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+// dsmErrorCodes are the gRPC codes of the errors webapi maps the DSM error codes of the
+// LUN, target, snapshot, share and File Station APIs to, so the CSI sidecars can tell a DSM out of space
+// or a volume which already exists from a failure worth retrying
+var dsmErrorCodes = []struct {
+	err  error
+	code codes.Code
+}{
+	{utils.OutOfFreeSpaceError(""), codes.ResourceExhausted},
+	{utils.LunReachMaxCountError(""), codes.ResourceExhausted},
+	{utils.TargetReachMaxCountError(""), codes.ResourceExhausted},
+	{utils.SnapshotReachMaxCountError(""), codes.ResourceExhausted},
+	{utils.ShareReachMaxCountError(""), codes.ResourceExhausted},
+	{utils.AlreadyExistError(""), codes.AlreadyExists},
+	{utils.NoSuchLunError(""), codes.NotFound},
+	{utils.NoSuchSnapshotError(""), codes.NotFound},
+	{utils.NoSuchShareError(""), codes.NotFound},
+	{utils.NoSuchFileError(""), codes.NotFound},
+	{utils.BadParametersError(""), codes.InvalidArgument},
+	{utils.BadLunTypeError(""), codes.InvalidArgument},
+	{utils.ShareSystemBusyError(""), codes.Unavailable},
+}
+
+// dsmApiErrorCodes are the gRPC codes of the error codes common to all the DSM APIs
+var dsmApiErrorCodes = map[int]codes.Code{
+	101: codes.InvalidArgument,    // invalid parameter
+	102: codes.Unimplemented,      // API doesn't exist
+	103: codes.Unimplemented,      // method doesn't exist
+	104: codes.FailedPrecondition, // version not supported
+	105: codes.PermissionDenied,   // the DSM account has no permission
+	106: codes.Unauthenticated,    // session timeout
+	107: codes.Unauthenticated,    // session interrupted by a duplicated login
+	119: codes.Unauthenticated,    // SID not found
+}
+
+// dsmErrorCode returns the gRPC code of an error of a DSM request, Internal if it isn't known
+func dsmErrorCode(err error) codes.Code {
+	// errors which are already statuses, e.g. an unsupported API version
+	if s, ok := status.FromError(err); ok && s.Code() != codes.Unknown {
+		return s.Code()
+	}
+	for _, known := range dsmErrorCodes {
+		if errors.Is(err, known.err) {
+			return known.code
+		}
+	}
+	var dsmErr utils.DsmError
+	if errors.As(err, &dsmErr) {
+		if code, ok := dsmApiErrorCodes[dsmErr.Code]; ok {
+			return code
+		}
+	}
+	// e.g. a request still waiting for the concurrency limit of its DSM
+	if errors.Is(err, context.DeadlineExceeded) {
+		return codes.DeadlineExceeded
+	}
+	if errors.Is(err, context.Canceled) {
+		return codes.Canceled
+	}
+	var netErr net.Error
+	var urlErr *url.Error
+	if errors.As(err, &netErr) || errors.As(err, &urlErr) {
+		return codes.Unavailable
+	}
+	return codes.Internal
+}
+
+// dsmError wraps the error of a DSM request in a status with the code matching it. The
+// message is the formatted description followed by the error, which has the DSM error code.
+func dsmError(err error, format string, args ...interface{}) error {
+	// the message of a status, without the code which is kept
+	return status.Errorf(dsmErrorCode(err), "%s, err: %s", fmt.Sprintf(format, args...), status.Convert(err).Message())
+}
@@ -0,0 +1,54 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+func TestDsmErrorCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want codes.Code
+	}{
+		{"out of free space", utils.DsmError{Code: 18990002, Err: utils.OutOfFreeSpaceError("")}, codes.ResourceExhausted},
+		{"LUN already exists", utils.DsmError{Code: 18990538, Err: utils.AlreadyExistError("")}, codes.AlreadyExists},
+		{"no such LUN", utils.DsmError{Code: 18990531, Err: utils.NoSuchLunError("")}, codes.NotFound},
+		{"share reaches max count", utils.DsmError{Code: 3309, Err: utils.ShareReachMaxCountError("")}, codes.ResourceExhausted},
+		{"wrapped", fmt.Errorf("create LUN: %w", utils.DsmError{Code: 18990542, Err: utils.LunReachMaxCountError("")}), codes.ResourceExhausted},
+		{"permission denied", utils.DsmError{Code: 105}, codes.PermissionDenied},
+		{"session timeout", utils.DsmError{Code: 106}, codes.Unauthenticated},
+		{"unknown DSM code", utils.DsmError{Code: 18990999}, codes.Internal},
+		{"unsupported API version", utils.ApiVersionError{Api: "SYNO.Core.Share", Versions: []int{1}, MinVersion: 2, MaxVersion: 3}, codes.FailedPrecondition},
+		{"connection error", &url.Error{Op: "Post", URL: "https://10.0.0.1:5001", Err: fmt.Errorf("connection refused")}, codes.Unavailable},
+		{"queued until the deadline", fmt.Errorf("aborted while queued: %w", context.DeadlineExceeded), codes.DeadlineExceeded},
+		{"other error", fmt.Errorf("Failed to assert response"), codes.Internal},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dsmErrorCode(tt.err); got != tt.want {
+				t.Errorf("dsmErrorCode(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDsmError(t *testing.T) {
+	err := dsmError(utils.DsmError{Code: 18990002, Err: utils.OutOfFreeSpaceError("")}, "Failed to create LUN[%s]", "k8s-csi-pvc-1")
+
+	if code := status.Code(err); code != codes.ResourceExhausted {
+		t.Errorf("dsmError() code = %v, want %v", code, codes.ResourceExhausted)
+	}
+	msg := status.Convert(err).Message()
+	if !strings.Contains(msg, "Failed to create LUN[k8s-csi-pvc-1]") || !strings.Contains(msg, "DSM error code 18990002") {
+		t.Errorf("dsmError() message = %q, want the description and the DSM error code", msg)
+	}
+}
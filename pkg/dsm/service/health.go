@@ -0,0 +1,132 @@
+/*
+ * Copyright 2021 Synology Inc.
+ */
+
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+)
+
+var dsmUp = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Namespace: "synology_csi",
+	Subsystem: "dsm",
+	Name:      "up",
+	Help:      "Whether the last health probe of the DSM succeeded.",
+}, []string{"dsm"})
+
+func init() {
+	prometheus.MustRegister(dsmUp)
+}
+
+// health remembers which DSMs failed their last probe. DSMs not probed yet count as healthy.
+type health struct {
+	mu        sync.RWMutex
+	unhealthy map[string]error // DSM address => error of the last probe
+	// probe is dsmProbe, replaced by the tests
+	probe func(ctx context.Context, dsm *webapi.DSM) error
+}
+
+// dsmProbe sends DSM a lightweight request, answered without touching the storage
+func dsmProbe(ctx context.Context, dsm *webapi.DSM) error {
+	_, err := dsm.DsmInfoGet(ctx)
+	return err
+}
+
+// set records the result of a probe of dsmIp and logs state transitions
+func (h *health) set(dsmIp string, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.unhealthy == nil {
+		h.unhealthy = make(map[string]error)
+	}
+	_, wasUnhealthy := h.unhealthy[dsmIp]
+	if err != nil {
+		if !wasUnhealthy {
+			log.Warnf("[%s] DSM is unreachable: %v", dsmIp, err)
+		}
+		h.unhealthy[dsmIp] = err
+		dsmUp.WithLabelValues(dsmIp).Set(0)
+		return
+	}
+
+	if wasUnhealthy {
+		log.Infof("[%s] DSM is reachable again", dsmIp)
+	}
+	delete(h.unhealthy, dsmIp)
+	dsmUp.WithLabelValues(dsmIp).Set(1)
+}
+
+func (h *health) isHealthy(dsmIp string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	_, unhealthy := h.unhealthy[dsmIp]
+	return !unhealthy
+}
+
+// healthy keeps the DSMs not known to be unreachable
+func (h *health) healthy(dsms []*webapi.DSM) []*webapi.DSM {
+	matched := []*webapi.DSM{}
+	for _, dsm := range dsms {
+		if h.isHealthy(dsm.Ip) {
+			matched = append(matched, dsm)
+		}
+	}
+	return matched
+}
+
+// CheckHealth probes every DSM once, waiting at most timeout for each
+func (service *DsmService) CheckHealth(ctx context.Context, timeout time.Duration) {
+	probe := service.health.probe
+	if probe == nil {
+		probe = dsmProbe
+	}
+
+	var wg sync.WaitGroup
+	for _, dsm := range service.dsms {
+		wg.Add(1)
+		go func(dsm *webapi.DSM) {
+			defer wg.Done()
+			probeCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			service.health.set(dsm.Ip, probe(probeCtx, dsm))
+		}(dsm)
+	}
+	wg.Wait()
+}
+
+// RunHealthCheck probes the DSMs every interval until ctx is done
+func (service *DsmService) RunHealthCheck(ctx context.Context, interval time.Duration, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		service.CheckHealth(ctx, timeout)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// UnhealthyDsms returns the DSMs whose last probe failed and why
+func (service *DsmService) UnhealthyDsms() map[string]error {
+	service.health.mu.RLock()
+	defer service.health.mu.RUnlock()
+
+	unhealthy := make(map[string]error, len(service.health.unhealthy))
+	for ip, err := range service.health.unhealthy {
+		unhealthy[ip] = err
+	}
+	return unhealthy
+}
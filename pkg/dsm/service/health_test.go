@@ -0,0 +1,95 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+func TestCheckHealth_transitions(t *testing.T) {
+	service := NewDsmService()
+	service.dsms["10.0.0.1"] = &webapi.DSM{Ip: "10.0.0.1"}
+	service.dsms["10.0.0.2"] = &webapi.DSM{Ip: "10.0.0.2"}
+
+	down := map[string]bool{}
+	service.health.probe = func(ctx context.Context, dsm *webapi.DSM) error {
+		if down[dsm.Ip] {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+
+	steps := []struct {
+		name string
+		down bool
+	}{
+		{name: "healthy", down: false},
+		{name: "unhealthy", down: true},
+		{name: "unhealthy again", down: true},
+		{name: "healthy again", down: false},
+	}
+	for _, step := range steps {
+		down["10.0.0.2"] = step.down
+		service.CheckHealth(context.Background(), time.Second)
+
+		if got := service.health.isHealthy("10.0.0.2"); got == step.down {
+			t.Errorf("%s: isHealthy() = %v, want %v", step.name, got, !step.down)
+		}
+		if !service.health.isHealthy("10.0.0.1") {
+			t.Errorf("%s: isHealthy() of the other DSM = false", step.name)
+		}
+		if _, unhealthy := service.UnhealthyDsms()["10.0.0.2"]; unhealthy != step.down {
+			t.Errorf("%s: UnhealthyDsms() = %v", step.name, service.UnhealthyDsms())
+		}
+
+		want := 1.0
+		if step.down {
+			want = 0
+		}
+		if got := testutil.ToFloat64(dsmUp.WithLabelValues("10.0.0.2")); got != want {
+			t.Errorf("%s: dsm up metric = %v, want %v", step.name, got, want)
+		}
+	}
+}
+
+func TestCheckHealth_timeout(t *testing.T) {
+	service := NewDsmService()
+	service.dsms["10.0.0.1"] = &webapi.DSM{Ip: "10.0.0.1"}
+	service.health.probe = func(ctx context.Context, dsm *webapi.DSM) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	service.CheckHealth(context.Background(), 10*time.Millisecond)
+	if service.health.isHealthy("10.0.0.1") {
+		t.Errorf("isHealthy() after a timed out probe = true, want false")
+	}
+}
+
+func TestCreateVolume_unhealthyDsms(t *testing.T) {
+	service := NewDsmService()
+	service.dsms["10.0.0.1"] = &webapi.DSM{Ip: "10.0.0.1"}
+	service.health.set("10.0.0.1", errors.New("connection refused"))
+
+	_, err := service.CreateVolume(context.Background(), &models.CreateK8sVolumeSpec{
+		K8sVolumeName: "pvc-1",
+		Protocol:      utils.ProtocolIscsi,
+	})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("CreateVolume() code = %v, want %v (err: %v)", status.Code(err), codes.Unavailable, err)
+	}
+
+	ordered := []*webapi.DSM{{Ip: "10.0.0.1"}, {Ip: "10.0.0.2"}}
+	if got := dsmIps(service.health.healthy(ordered)); len(got) != 1 || got[0] != "10.0.0.2" {
+		t.Errorf("healthy() = %v, want [10.0.0.2]", got)
+	}
+}
@@ -0,0 +1,95 @@
+/*
+ * Copyright 2021 Synology Inc.
+ */
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+)
+
+// OrphanLun is a LUN created by the driver which backs none of the known volumes
+type OrphanLun struct {
+	DsmIp string
+	Lun   webapi.LunInfo
+	// Target is the driver target the LUN is mapped to, if any
+	Target *webapi.TargetInfo
+}
+
+// isDriverTarget tells if target was created by the driver
+func isDriverTarget(target webapi.TargetInfo) bool {
+	return strings.HasPrefix(target.Name, models.TargetPrefix)
+}
+
+// FindOrphanLuns returns the LUNs of a DSM created by the driver which back none of
+// volumeIds, whatever their version. A LUN is the driver's if its name has the driver prefix, or if it is mapped to
+// a target which has it, e.g. a LUN named by a lunNameTemplate.
+func FindOrphanLuns(dsmIp string, luns []webapi.LunInfo, targets []webapi.TargetInfo, volumeIds []string) []OrphanLun {
+	targetOfLun := make(map[string]*webapi.TargetInfo)
+	for i := range targets {
+		if !isDriverTarget(targets[i]) {
+			continue
+		}
+		for _, mapping := range targets[i].MappedLuns {
+			targetOfLun[mapping.LunUuid] = &targets[i]
+		}
+	}
+
+	orphans := []OrphanLun{}
+	for _, lun := range luns {
+		target := targetOfLun[lun.Uuid]
+		if !strings.HasPrefix(lun.Name, models.LunPrefix) && target == nil {
+			continue
+		}
+		if backsVolume(volumeIds, dsmIp, lun.Uuid) {
+			continue
+		}
+		orphans = append(orphans, OrphanLun{DsmIp: dsmIp, Lun: lun, Target: target})
+	}
+	return orphans
+}
+
+// backsVolume tells if the LUN of lunUuid is the one of one of volumeIds
+func backsVolume(volumeIds []string, dsmIp string, lunUuid string) bool {
+	lun := models.VolumeIdSpec{Type: models.VolumeIdTypeLun, Uuid: lunUuid, DsmIp: dsmIp}
+	for _, id := range volumeIds {
+		if id == lunUuid {
+			return true
+		}
+		if spec, err := models.DecodeVolumeID(id); err == nil && spec.Matches(lun) {
+			return true
+		}
+	}
+	return false
+}
+
+// ListOrphanLuns returns the orphaned LUNs of every DSM, volumeIds being the IDs of all the PVs of the driver
+func (service *DsmService) ListOrphanLuns(ctx context.Context, volumeIds []string) ([]OrphanLun, error) {
+	orphans := []OrphanLun{}
+	for _, dsm := range service.dsms {
+		luns, err := dsm.LunList(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("[%s] Failed to list LUNs: %v", dsm.Ip, err)
+		}
+		targets, err := dsm.TargetList(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("[%s] Failed to list targets: %v", dsm.Ip, err)
+		}
+		orphans = append(orphans, FindOrphanLuns(dsm.Ip, luns, targets, volumeIds)...)
+	}
+	return orphans, nil
+}
+
+// DeleteOrphanLun deletes an orphaned LUN and its target like DeleteVolume does, so a LUN
+// still used by an iSCSI session is refused
+func (service *DsmService) DeleteOrphanLun(ctx context.Context, orphan OrphanLun) error {
+	log.WithContext(ctx).Infof("[%s] Deleting orphaned LUN %s(%s)", orphan.DsmIp, orphan.Lun.Name, orphan.Lun.Uuid)
+	return service.DeleteVolume(ctx, orphan.Lun.Uuid)
+}
@@ -0,0 +1,65 @@
+package service
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+)
+
+func TestFindOrphanLuns(t *testing.T) {
+	luns := []webapi.LunInfo{
+		{Name: "k8s-csi-pvc-bound", Uuid: "bound"},
+		{Name: "k8s-csi-pvc-orphan", Uuid: "orphan"},
+		{Name: "k8s-csi-pvc-unmapped", Uuid: "unmapped"},
+		{Name: "db-data-1a2b3c4d", Uuid: "templated"},
+		{Name: "db-data-bound", Uuid: "templated-bound"},
+		{Name: "vmware-datastore", Uuid: "foreign"},
+		{Name: "backup", Uuid: "foreign-mapped"},
+	}
+	targets := []webapi.TargetInfo{
+		{Name: "k8s-csi-pvc-bound", MappedLuns: []webapi.MappedLun{{LunUuid: "bound"}}},
+		{Name: "k8s-csi-pvc-orphan", MappedLuns: []webapi.MappedLun{{LunUuid: "orphan"}}},
+		{Name: "k8s-csi-pvc-templated", MappedLuns: []webapi.MappedLun{{LunUuid: "templated"}}},
+		{Name: "k8s-csi-pvc-templated-bound", MappedLuns: []webapi.MappedLun{{LunUuid: "templated-bound"}}},
+		{Name: "esxi", MappedLuns: []webapi.MappedLun{{LunUuid: "foreign-mapped"}}},
+	}
+
+	tests := []struct {
+		name      string
+		volumeIds []string
+		want      []string
+	}{
+		{name: "some bound", volumeIds: []string{"bound", "templated-bound"}, want: []string{"orphan", "unmapped", "templated"}},
+		{name: "all bound", volumeIds: []string{"bound", "orphan", "unmapped", "templated", "templated-bound"}, want: []string{}},
+		{name: "no volume", volumeIds: nil, want: []string{"bound", "orphan", "unmapped", "templated", "templated-bound"}},
+		{name: "unknown ids", volumeIds: []string{"foreign", "gone"}, want: []string{"bound", "orphan", "unmapped", "templated", "templated-bound"}},
+		{
+			name:      "versioned ids",
+			volumeIds: []string{"v1:lun:bound:10.0.0.1", "v1:lun:orphan:10.0.0.2", "v1:share:unmapped:10.0.0.1", "templated", "templated-bound"},
+			want:      []string{"orphan", "unmapped"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := []string{}
+			for _, orphan := range FindOrphanLuns("10.0.0.1", luns, targets, tt.volumeIds) {
+				if orphan.DsmIp != "10.0.0.1" {
+					t.Errorf("FindOrphanLuns() DsmIp = %q, want 10.0.0.1", orphan.DsmIp)
+				}
+				got = append(got, orphan.Lun.Uuid)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("FindOrphanLuns() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	orphans := FindOrphanLuns("10.0.0.1", luns, targets, []string{"bound"})
+	if orphans[0].Target == nil || orphans[0].Target.Name != "k8s-csi-pvc-orphan" {
+		t.Errorf("FindOrphanLuns() target of %s = %v, want k8s-csi-pvc-orphan", orphans[0].Lun.Name, orphans[0].Target)
+	}
+	if orphans[1].Target != nil {
+		t.Errorf("FindOrphanLuns() target of %s = %v, want none", orphans[1].Lun.Name, orphans[1].Target)
+	}
+}
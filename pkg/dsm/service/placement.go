@@ -0,0 +1,149 @@
+/*
+ * Copyright 2021 Synology Inc.
+ */
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+// PlacementStrategy decides in which order DSMs are tried when a new volume
+// isn't pinned to a DSM by the "dsm" parameter
+type PlacementStrategy string
+
+const (
+	// PlacementFirst tries the DSMs ordered by address
+	PlacementFirst PlacementStrategy = "first"
+	// PlacementMostFree tries the DSM with the largest free volume first
+	PlacementMostFree PlacementStrategy = "most-free"
+	// PlacementRoundRobin rotates the first DSM tried on every volume creation
+	PlacementRoundRobin PlacementStrategy = "round-robin"
+)
+
+func ParsePlacementStrategy(name string) (PlacementStrategy, error) {
+	switch strategy := PlacementStrategy(name); strategy {
+	case "":
+		return PlacementFirst, nil
+	case PlacementFirst, PlacementMostFree, PlacementRoundRobin:
+		return strategy, nil
+	}
+	return "", fmt.Errorf("Unknown placement strategy: %s", name)
+}
+
+type placement struct {
+	mu       sync.Mutex
+	strategy PlacementStrategy
+	next     int
+	// freeBytes returns the largest free space of a single volume on the DSM
+	freeBytes func(ctx context.Context, dsm *webapi.DSM) (int64, error)
+}
+
+func (service *DsmService) SetPlacementStrategy(strategy PlacementStrategy) {
+	service.placement.mu.Lock()
+	defer service.placement.mu.Unlock()
+
+	service.placement.strategy = strategy
+}
+
+func dsmMaxVolumeFree(ctx context.Context, dsm *webapi.DSM) (int64, error) {
+	volInfos, err := dsm.VolumeList(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var maxFree int64
+	for _, volInfo := range volInfos {
+		if volInfo.Status == "crashed" || volInfo.Status == "read_only" || volInfo.Status == "deleting" {
+			continue
+		}
+		free, err := strconv.ParseInt(volInfo.Free, 10, 64)
+		if err != nil {
+			continue
+		}
+		if free > maxFree {
+			maxFree = free
+		}
+	}
+	return maxFree, nil
+}
+
+// bySites keeps the DSMs of the given sites, ordered by the preference of their site
+func bySites(ordered []*webapi.DSM, sites []string) []*webapi.DSM {
+	rank := make(map[string]int, len(sites))
+	for i, site := range sites {
+		if _, ok := rank[site]; !ok {
+			rank[site] = i
+		}
+	}
+
+	matched := []*webapi.DSM{}
+	for _, dsm := range ordered {
+		if _, ok := rank[dsm.Site]; ok {
+			matched = append(matched, dsm)
+		}
+	}
+	sort.SliceStable(matched, func(i, j int) bool { return rank[matched[i].Site] < rank[matched[j].Site] })
+	return matched
+}
+
+// checkSite fails if a clone must be created on a DSM outside the sites of spec
+func checkSite(spec *models.CreateK8sVolumeSpec, dsm *webapi.DSM) error {
+	if len(spec.Sites) > 0 && !utils.SliceContains(spec.Sites, dsm.Site) {
+		return status.Errorf(codes.ResourceExhausted, "The source of the volume is on DSM [%s], which is not accessible from the topology sites %v", dsm.Ip, spec.Sites)
+	}
+	return nil
+}
+
+// order returns the DSMs in the order volume creation should try them
+func (p *placement) order(ctx context.Context, dsms map[string]*webapi.DSM) []*webapi.DSM {
+	ordered := make([]*webapi.DSM, 0, len(dsms))
+	for _, dsm := range dsms {
+		ordered = append(ordered, dsm)
+	}
+	sort.Slice(ordered, func(i, j int) bool { return ordered[i].Ip < ordered[j].Ip })
+
+	if len(ordered) < 2 {
+		return ordered
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	switch p.strategy {
+	case PlacementRoundRobin:
+		start := p.next % len(ordered)
+		p.next = start + 1
+		return append(ordered[start:], ordered[:start]...)
+	case PlacementMostFree:
+		freeBytes := p.freeBytes
+		if freeBytes == nil {
+			freeBytes = dsmMaxVolumeFree
+		}
+
+		free := make(map[string]int64, len(ordered))
+		for _, dsm := range ordered {
+			f, err := freeBytes(ctx, dsm)
+			if err != nil {
+				log.WithContext(ctx).Warnf("[%s] Failed to get free space for placement: %v", dsm.Ip, err)
+				f = -1
+			}
+			free[dsm.Ip] = f
+		}
+		sort.SliceStable(ordered, func(i, j int) bool { return free[ordered[i].Ip] > free[ordered[j].Ip] })
+	}
+
+	return ordered
+}
@@ -0,0 +1,143 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+func dsmIps(dsms []*webapi.DSM) []string {
+	ips := []string{}
+	for _, dsm := range dsms {
+		ips = append(ips, dsm.Ip)
+	}
+	return ips
+}
+
+func TestPlacementOrder(t *testing.T) {
+	dsms := map[string]*webapi.DSM{
+		"10.0.0.1": {Ip: "10.0.0.1"},
+		"10.0.0.2": {Ip: "10.0.0.2"},
+		"10.0.0.3": {Ip: "10.0.0.3"},
+		"10.0.0.4": {Ip: "10.0.0.4"},
+	}
+	free := map[string]int64{
+		"10.0.0.1": 10 << 30,
+		"10.0.0.2": 500 << 30,
+		"10.0.0.3": 80 << 30,
+	}
+	freeBytes := func(ctx context.Context, dsm *webapi.DSM) (int64, error) {
+		f, ok := free[dsm.Ip]
+		if !ok {
+			return 0, errors.New("unreachable")
+		}
+		return f, nil
+	}
+
+	tests := []struct {
+		name     string
+		strategy PlacementStrategy
+		want     [][]string
+	}{
+		{
+			name:     "first",
+			strategy: PlacementFirst,
+			want: [][]string{
+				{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"},
+				{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"},
+			},
+		},
+		{
+			name:     "most-free",
+			strategy: PlacementMostFree,
+			want: [][]string{
+				{"10.0.0.2", "10.0.0.3", "10.0.0.1", "10.0.0.4"},
+			},
+		},
+		{
+			name:     "round-robin",
+			strategy: PlacementRoundRobin,
+			want: [][]string{
+				{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"},
+				{"10.0.0.2", "10.0.0.3", "10.0.0.4", "10.0.0.1"},
+				{"10.0.0.3", "10.0.0.4", "10.0.0.1", "10.0.0.2"},
+				{"10.0.0.4", "10.0.0.1", "10.0.0.2", "10.0.0.3"},
+				{"10.0.0.1", "10.0.0.2", "10.0.0.3", "10.0.0.4"},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &placement{strategy: tt.strategy, freeBytes: freeBytes}
+			for i, want := range tt.want {
+				if got := dsmIps(p.order(context.Background(), dsms)); !reflect.DeepEqual(got, want) {
+					t.Errorf("order() #%d = %v, want %v", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestParsePlacementStrategy(t *testing.T) {
+	for _, name := range []string{"", "first", "most-free", "round-robin"} {
+		if _, err := ParsePlacementStrategy(name); err != nil {
+			t.Errorf("ParsePlacementStrategy(%q) error = %v", name, err)
+		}
+	}
+	if _, err := ParsePlacementStrategy("random"); err == nil {
+		t.Errorf("ParsePlacementStrategy(%q) expected error", "random")
+	}
+}
+
+func TestBySites(t *testing.T) {
+	ordered := []*webapi.DSM{
+		{Ip: "10.0.0.1", Site: "east"},
+		{Ip: "10.0.0.2", Site: "west"},
+		{Ip: "10.0.0.3"},
+		{Ip: "10.0.0.4", Site: "east"},
+	}
+
+	tests := []struct {
+		sites []string
+		want  []string
+	}{
+		{sites: []string{"east"}, want: []string{"10.0.0.1", "10.0.0.4"}},
+		{sites: []string{"west", "east"}, want: []string{"10.0.0.2", "10.0.0.1", "10.0.0.4"}},
+		{sites: []string{"east", "west", "east"}, want: []string{"10.0.0.1", "10.0.0.4", "10.0.0.2"}},
+		{sites: []string{"north"}, want: []string{}},
+	}
+	for _, tt := range tests {
+		if got := dsmIps(bySites(ordered, tt.sites)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("bySites(%v) = %v, want %v", tt.sites, got, tt.want)
+		}
+	}
+}
+
+func TestCreateVolume_noDsmInSites(t *testing.T) {
+	service := NewDsmService()
+	service.dsms["10.0.0.1"] = &webapi.DSM{Ip: "10.0.0.1", Site: "east"}
+
+	_, err := service.CreateVolume(context.Background(), &models.CreateK8sVolumeSpec{
+		K8sVolumeName: "pvc-1",
+		Protocol:      utils.ProtocolIscsi,
+		Sites:         []string{"west"},
+	})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("CreateVolume() code = %v, want %v (err: %v)", status.Code(err), codes.ResourceExhausted, err)
+	}
+
+	if err := checkSite(&models.CreateK8sVolumeSpec{Sites: []string{"west"}}, service.dsms["10.0.0.1"]); status.Code(err) != codes.ResourceExhausted {
+		t.Errorf("checkSite() code = %v, want %v", status.Code(err), codes.ResourceExhausted)
+	}
+	if err := checkSite(&models.CreateK8sVolumeSpec{}, service.dsms["10.0.0.1"]); err != nil {
+		t.Errorf("checkSite() without sites error = %v", err)
+	}
+}
@@ -0,0 +1,56 @@
+/*
+ * Copyright 2021 Synology Inc.
+ */
+
+package service
+
+import (
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+)
+
+// hasProfile tells if one of the DSMs at least is logged into with the credential profile
+func (service *DsmService) hasProfile(profile string) bool {
+	for _, dsm := range service.dsms {
+		if dsm.Profile == profile {
+			return true
+		}
+	}
+	return false
+}
+
+// byProfile keeps the DSMs of the credential profile, the ones without profile for ""
+func byProfile(dsms []*webapi.DSM, profile string) []*webapi.DSM {
+	matched := []*webapi.DSM{}
+	for _, dsm := range dsms {
+		if dsm.Profile == profile {
+			matched = append(matched, dsm)
+		}
+	}
+	return matched
+}
+
+// checkProfile fails if the volume of spec would be created on a DSM of another credential profile
+func checkProfile(spec *models.CreateK8sVolumeSpec, dsm *webapi.DSM) error {
+	if dsm.Profile == spec.Profile {
+		return nil
+	}
+	if dsm.Profile == "" {
+		return status.Errorf(codes.InvalidArgument, "DSM [%s] has no credential profile, but the volume asks for credential profile %q", dsm.Ip, spec.Profile)
+	}
+	return status.Errorf(codes.InvalidArgument, "DSM [%s] has credential profile %q, but the volume asks for %q", dsm.Ip, dsm.Profile, spec.Profile)
+}
+
+// checkSpecProfile fails if the credential profile of spec is unknown, or doesn't have the DSM spec asks for
+func (service *DsmService) checkSpecProfile(spec *models.CreateK8sVolumeSpec) error {
+	if spec.Profile != "" && !service.hasProfile(spec.Profile) {
+		return status.Errorf(codes.InvalidArgument, "Unknown credential profile %q, no DSM of the client config has it", spec.Profile)
+	}
+	if dsm, ok := service.dsms[spec.DsmIp]; ok {
+		return checkProfile(spec, dsm)
+	}
+	return nil
+}
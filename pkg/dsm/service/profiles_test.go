@@ -0,0 +1,93 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+// newProfileDsm returns a DSM of the credential profile listening on ip, counting the requests it got
+func newProfileDsm(t *testing.T, ip string, profile string, requests *int) *webapi.DSM {
+	t.Helper()
+	listener, err := net.Listen("tcp", ip+":0")
+	if err != nil {
+		t.Skipf("Can't listen on %s: %v", ip, err)
+	}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		*requests++
+		data := map[string]interface{}{"volume": webapi.VolInfo{
+			Path: "/volume1", Status: "normal", FsType: models.FsTypeBtrfs,
+			Size: strconv.FormatInt(10*utils.UNIT_GB, 10), Free: strconv.FormatInt(10*utils.UNIT_GB, 10),
+		}}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "data": data})
+	}))
+	server.Listener.Close()
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return &webapi.DSM{Ip: ip, Port: p, Profile: profile}
+}
+
+func TestCreateVolume_credentialProfiles(t *testing.T) {
+	requests := map[string]*int{"127.0.0.1": new(int), "127.0.0.2": new(int), "127.0.0.3": new(int)}
+	service := NewDsmService()
+	service.dsms["127.0.0.1"] = newProfileDsm(t, "127.0.0.1", "", requests["127.0.0.1"])
+	service.dsms["127.0.0.2"] = newProfileDsm(t, "127.0.0.2", "team-a", requests["127.0.0.2"])
+	service.dsms["127.0.0.3"] = newProfileDsm(t, "127.0.0.3", "team-b", requests["127.0.0.3"])
+
+	tests := []struct {
+		name     string
+		profile  string
+		dsmIp    string
+		wantDsm  string
+		wantCode codes.Code
+	}{
+		{name: "default", wantDsm: "127.0.0.1"},
+		{name: "team-a", profile: "team-a", wantDsm: "127.0.0.2"},
+		{name: "team-b", profile: "team-b", wantDsm: "127.0.0.3"},
+		{name: "team-b on its dsm", profile: "team-b", dsmIp: "127.0.0.3", wantDsm: "127.0.0.3"},
+		{name: "unknown profile", profile: "team-c", wantCode: codes.InvalidArgument},
+		{name: "dsm of another profile", profile: "team-a", dsmIp: "127.0.0.3", wantCode: codes.InvalidArgument},
+		{name: "dsm with a profile", dsmIp: "127.0.0.2", wantCode: codes.InvalidArgument},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, n := range requests {
+				*n = 0
+			}
+			spec := models.CreateK8sVolumeSpec{
+				K8sVolumeName: "pvc-1", LunName: "k8s-csi-pvc-1", Protocol: utils.ProtocolIscsi,
+				Size: utils.UNIT_GB, Location: "/volume1", DryRun: true,
+				Profile: tt.profile, DsmIp: tt.dsmIp,
+			}
+
+			vol, err := service.CreateVolume(context.Background(), &spec)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("CreateVolume() code = %v, want %v (err: %v)", code, tt.wantCode, err)
+			}
+			if err == nil && vol.DsmIp != tt.wantDsm {
+				t.Errorf("CreateVolume() on DSM %s, want %s", vol.DsmIp, tt.wantDsm)
+			}
+			// the other profiles' sessions are never used
+			for ip, n := range requests {
+				if ip != tt.wantDsm && *n > 0 {
+					t.Errorf("CreateVolume() sent %d requests to DSM %s", *n, ip)
+				}
+			}
+		})
+	}
+}
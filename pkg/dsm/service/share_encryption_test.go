@@ -0,0 +1,35 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+)
+
+func TestCheckNfsEncryptionSupport(t *testing.T) {
+	for support, wantCode := range map[int]codes.Code{0: codes.FailedPrecondition, 1: codes.OK} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"success": true,
+				"data":    webapi.NfsInfo{SupportEncryptShare: support},
+			})
+		}))
+		host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+		p, _ := strconv.Atoi(port)
+		dsm := &webapi.DSM{Ip: host, Port: p}
+
+		if code := status.Code(checkNfsEncryptionSupport(context.Background(), dsm)); code != wantCode {
+			t.Errorf("checkNfsEncryptionSupport() with support_encrypt_share %d code = %v, want %v", support, code, wantCode)
+		}
+		server.Close()
+	}
+}
@@ -5,6 +5,7 @@
 package service
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	log "github.com/sirupsen/logrus"
@@ -27,10 +28,10 @@ func GMTToUnixSecond(timeStr string) (int64) {
 	return t.Unix()
 }
 
-func (service *DsmService) createSMBorNFSVolumeBySnapshot(dsm *webapi.DSM, spec *models.CreateK8sVolumeSpec, srcSnapshot *models.K8sSnapshotRespSpec) (*models.K8sVolumeRespSpec, error) {
-	srcShareInfo, err := dsm.ShareGet(srcSnapshot.ParentName)
+func (service *DsmService) createSMBorNFSVolumeBySnapshot(ctx context.Context, dsm *webapi.DSM, spec *models.CreateK8sVolumeSpec, srcSnapshot *models.K8sSnapshotRespSpec) (*models.K8sVolumeRespSpec, error) {
+	srcShareInfo, err := dsm.ShareGet(ctx, srcSnapshot.ParentName)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, fmt.Sprintf("Failed to get share: %s, err: %v", srcSnapshot.ParentName, err))
+		return nil, dsmError(err, "Failed to get share: %s", srcSnapshot.ParentName)
 	}
 
 	shareCloneSpec := webapi.ShareCloneSpec{
@@ -46,23 +47,24 @@ func (service *DsmService) createSMBorNFSVolumeBySnapshot(dsm *webapi.DSM, spec
 		},
 	}
 
-	if _, err := dsm.ShareClone(shareCloneSpec); err != nil && !errors.Is(err, utils.AlreadyExistError("")) {
+	if _, err := dsm.ShareClone(ctx, shareCloneSpec); err != nil && !errors.Is(err, utils.AlreadyExistError("")) {
 		return nil,
-			status.Errorf(codes.Internal, fmt.Sprintf("Failed to create volume with source volume ID: %s, err: %v", srcShareInfo.Uuid, err))
+			dsmError(err, "Failed to create volume with source volume ID: %s", srcShareInfo.Uuid)
 	}
 
-	shareInfo, err := dsm.ShareGet(spec.ShareName)
+	shareInfo, err := dsm.ShareGet(ctx, spec.ShareName)
 	if err != nil {
 		return nil,
-			status.Errorf(codes.Internal, fmt.Sprintf("Failed to get existed Share with name: [%s], err: %v", spec.ShareName, err))
+			dsmError(err, "Failed to get existed Share with name: [%s]", spec.ShareName)
 	}
 
 	newSizeInMB := utils.BytesToMBCeil(spec.Size)
-	if shareInfo.QuotaValueInMB == 0 {
-		// known issue for some DS, manually set quota to the new share
-		if err := dsm.SetShareQuota(shareInfo, newSizeInMB); err != nil {
+	if shareInfo.QuotaValueInMB != newSizeInMB {
+		// known issue for some DS, manually set quota to the new share. A clone
+		// also keeps the quota of its source, which may be smaller than requested.
+		if err := dsm.SetShareQuota(ctx, shareInfo, newSizeInMB); err != nil {
 			msg := fmt.Sprintf("Failed to set quota [%d] to Share [%s], err: %v", newSizeInMB, shareInfo.Name, err)
-			log.Error(msg)
+			log.WithContext(ctx).Error(msg)
 			return nil, status.Errorf(codes.Internal, msg)
 		}
 
@@ -75,16 +77,29 @@ func (service *DsmService) createSMBorNFSVolumeBySnapshot(dsm *webapi.DSM, spec
 			status.Errorf(codes.OutOfRange, "Requested share quotaMB [%d] is not equal to snapshot restore quotaMB [%d]", newSizeInMB, shareInfo.QuotaValueInMB)
 	}
 
-	log.Debugf("[%s] createSMBorNFSVolumeBySnapshot Successfully. VolumeId: %s", dsm.Ip, shareInfo.Uuid);
+	if err := saveNfsExport(ctx, dsm, spec, shareInfo.Name); err != nil {
+		return nil, err
+	}
+
+	log.WithContext(ctx).Debugf("[%s] createSMBorNFSVolumeBySnapshot Successfully. VolumeId: %s", dsm.Ip, shareInfo.Uuid);
 
 	return DsmShareToK8sVolume(dsm.Ip, shareInfo, spec.Protocol), nil
 }
 
-func (service *DsmService) createSMBorNFSVolumeByVolume(dsm *webapi.DSM, spec *models.CreateK8sVolumeSpec, srcShareInfo webapi.ShareInfo) (*models.K8sVolumeRespSpec, error) {
+// checkShareSnapshot fails with FailedPrecondition if the volume of the share can't take
+// snapshots, which share clones are also made of
+func checkShareSnapshot(shareInfo webapi.ShareInfo) error {
+	if !shareInfo.SupportSnapshot {
+		return status.Errorf(codes.FailedPrecondition,
+			fmt.Sprintf("Share [%s] doesn't support snapshots, its location %s must be a Btrfs volume", shareInfo.Name, shareInfo.VolPath))
+	}
+	return nil
+}
+
+func (service *DsmService) createSMBorNFSVolumeByVolume(ctx context.Context, dsm *webapi.DSM, spec *models.CreateK8sVolumeSpec, srcShareInfo webapi.ShareInfo) (*models.K8sVolumeRespSpec, error) {
 	newSizeInMB := utils.BytesToMBCeil(spec.Size)
-	if spec.Size != 0 && newSizeInMB != srcShareInfo.QuotaValueInMB {
-		return nil,
-			status.Errorf(codes.OutOfRange, "Requested share quotaMB [%d] is not equal to src share quotaMB [%d]", newSizeInMB, srcShareInfo.QuotaValueInMB)
+	if spec.Size == 0 {
+		newSizeInMB = srcShareInfo.QuotaValueInMB
 	}
 
 	shareCloneSpec := webapi.ShareCloneSpec{
@@ -100,47 +115,52 @@ func (service *DsmService) createSMBorNFSVolumeByVolume(dsm *webapi.DSM, spec *m
 		},
 	}
 
-	if _, err := dsm.ShareClone(shareCloneSpec); err != nil && !errors.Is(err, utils.AlreadyExistError("")) {
+	if _, err := dsm.ShareClone(ctx, shareCloneSpec); err != nil && !errors.Is(err, utils.AlreadyExistError("")) {
 		return nil,
-			status.Errorf(codes.Internal, fmt.Sprintf("Failed to create volume with source volume ID: %s, err: %v", srcShareInfo.Uuid, err))
+			dsmError(err, "Failed to create volume with source volume ID: %s", srcShareInfo.Uuid)
 	}
 
-	shareInfo, err := dsm.ShareGet(spec.ShareName)
+	shareInfo, err := dsm.ShareGet(ctx, spec.ShareName)
 	if err != nil {
 		return nil,
-			status.Errorf(codes.Internal, fmt.Sprintf("Failed to get existed Share with name: [%s], err: %v", spec.ShareName, err))
+			dsmError(err, "Failed to get existed Share with name: [%s]", spec.ShareName)
 	}
 
-	if shareInfo.QuotaValueInMB == 0 {
-		// known issue for some DS, manually set quota to the new share
-		if err := dsm.SetShareQuota(shareInfo, newSizeInMB); err != nil {
+	if shareInfo.QuotaValueInMB != newSizeInMB {
+		// known issue for some DS, manually set quota to the new share. A clone
+		// also keeps the quota of its source, which may be smaller than requested.
+		if err := dsm.SetShareQuota(ctx, shareInfo, newSizeInMB); err != nil {
 			msg := fmt.Sprintf("Failed to set quota [%d] to Share [%s], err: %v", newSizeInMB, shareInfo.Name, err)
-			log.Error(msg)
+			log.WithContext(ctx).Error(msg)
 			return nil, status.Errorf(codes.Internal, msg)
 		}
 
 		shareInfo.QuotaValueInMB = newSizeInMB
 	}
 
-	log.Debugf("[%s] createSMBorNFSVolumeByVolume Successfully. VolumeId: %s", dsm.Ip, shareInfo.Uuid);
+	if err := saveNfsExport(ctx, dsm, spec, shareInfo.Name); err != nil {
+		return nil, err
+	}
+
+	log.WithContext(ctx).Debugf("[%s] createSMBorNFSVolumeByVolume Successfully. VolumeId: %s", dsm.Ip, shareInfo.Uuid);
 
 	return DsmShareToK8sVolume(dsm.Ip, shareInfo, spec.Protocol), nil
 }
 
-func (service *DsmService) createSMBorNFSVolumeByDsm(dsm *webapi.DSM, spec *models.CreateK8sVolumeSpec) (*models.K8sVolumeRespSpec, error) {
+func (service *DsmService) createSMBorNFSVolumeByDsm(ctx context.Context, dsm *webapi.DSM, spec *models.CreateK8sVolumeSpec) (*models.K8sVolumeRespSpec, error) {
 	// TODO: Check if share name is allowable
 
 	// 1. Find a available location
 	if spec.Location == "" {
-		vol, err := service.getFirstAvailableVolume(dsm, spec.Size, spec.Protocol)
+		vol, err := service.getFirstAvailableVolume(ctx, dsm, spec.Size, spec.Protocol, false)
 		if err != nil {
-			return nil, status.Errorf(codes.Internal, fmt.Sprintf("Failed to get available location, err: %v", err))
+			return nil, dsmError(err, "Failed to get available location")
 		}
 		spec.Location = vol.Path
 	}
 
 	// 2. Check if location exists
-	dsmVolInfo, err := dsm.VolumeGet(spec.Location)
+	dsmVolInfo, err := dsm.VolumeGet(ctx, spec.Location)
 	if err != nil {
 		return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("Unable to find location %s", spec.Location))
 	}
@@ -149,6 +169,17 @@ func (service *DsmService) createSMBorNFSVolumeByDsm(dsm *webapi.DSM, spec *mode
 		return nil, status.Errorf(codes.InvalidArgument, fmt.Sprintf("Location: %s with ext4 fstype was not supported for creating smb/nfs protocol's K8s volume", spec.Location))
 	}
 
+	encrypted := spec.EncryptionPassphrase != ""
+	if encrypted && spec.Protocol == utils.ProtocolNfs {
+		if err := checkNfsEncryptionSupport(ctx, dsm); err != nil {
+			return nil, err
+		}
+	}
+
+	if spec.DryRun {
+		return dryRunK8sVolume(dsm.Ip, spec), nil
+	}
+
 	// 3. Create Share
 	sizeInMB := utils.BytesToMBCeil(spec.Size)
 	shareSpec := webapi.ShareCreateSpec{
@@ -164,37 +195,70 @@ func (service *DsmService) createSMBorNFSVolumeByDsm(dsm *webapi.DSM, spec *mode
 			QuotaForCreate:      &sizeInMB,
 		},
 	}
+	if encrypted {
+		shareSpec.ShareInfo.Encryption = 1
+		shareSpec.ShareInfo.EncPassphrase = spec.EncryptionPassphrase
+	}
 
-	log.Debugf("ShareCreate spec: %v", shareSpec)
-	err = dsm.ShareCreate(shareSpec)
+	log.WithContext(ctx).Debugf("ShareCreate spec: %v", shareSpec)
+	err = dsm.ShareCreate(ctx, shareSpec)
 	if err != nil && !errors.Is(err, utils.AlreadyExistError("")) {
-		return nil, status.Errorf(codes.Internal, fmt.Sprintf("Failed to create share, err: %v", err))
+		return nil, dsmError(err, "Failed to create share")
 	}
 
-	shareInfo, err := dsm.ShareGet(spec.ShareName)
+	shareInfo, err := dsm.ShareGet(ctx, spec.ShareName)
 	if err != nil {
 		return nil,
-			status.Errorf(codes.Internal, fmt.Sprintf("Failed to get existed Share with name: %s, err: %v", spec.ShareName, err))
+			dsmError(err, "Failed to get existed Share with name: %s", spec.ShareName)
+	}
+
+	if err := saveNfsExport(ctx, dsm, spec, shareInfo.Name); err != nil {
+		return nil, err
 	}
 
-	log.Debugf("[%s] createSMBorNFSVolumeByDsm Successfully. VolumeId: %s", dsm.Ip, shareInfo.Uuid)
+	log.WithContext(ctx).Debugf("[%s] createSMBorNFSVolumeByDsm Successfully. VolumeId: %s", dsm.Ip, shareInfo.Uuid)
 
 	return DsmShareToK8sVolume(dsm.Ip, shareInfo, spec.Protocol), nil
 }
 
-func (service *DsmService) listSMBorNFSVolumes(dsmIp string) (infos []*models.K8sVolumeRespSpec) {
+// checkNfsEncryptionSupport refuses to create an encrypted NFS share on a DSM which can't export them
+func checkNfsEncryptionSupport(ctx context.Context, dsm *webapi.DSM) error {
+	info, err := dsm.NfsGet(ctx)
+	if err != nil {
+		return dsmError(err, "Failed to get the NFS settings of DSM [%s]", dsm.Ip)
+	}
+	if info.SupportEncryptShare == 0 {
+		return status.Errorf(codes.FailedPrecondition, "DSM [%s] can't export encrypted shares over NFS", dsm.Ip)
+	}
+	return nil
+}
+
+// saveNfsExport saves the privilege rules of an NFS share restricted to the clients of
+// spec. Shares open to the nodes get their rules in NodeStageVolume, once the nodes are known.
+func saveNfsExport(ctx context.Context, dsm *webapi.DSM, spec *models.CreateK8sVolumeSpec, shareName string) error {
+	if spec.Protocol != utils.ProtocolNfs || spec.NfsExport == nil || len(spec.NfsExport.Clients) == 0 {
+		return nil
+	}
+	priv := webapi.SharePrivilege{ShareName: shareName, Rule: spec.NfsExport.PrivilegeRules(nil)}
+	if err := dsm.ShareNfsPrivilegeSave(ctx, priv); err != nil {
+		return dsmError(err, "Failed to save NFS privilege of Share [%s]", shareName)
+	}
+	return nil
+}
+
+func (service *DsmService) listSMBorNFSVolumes(ctx context.Context, dsmIp string) (infos []*models.K8sVolumeRespSpec) {
 	for _, dsm := range service.dsms {
 		if dsmIp != "" && dsmIp != dsm.Ip {
 			continue
 		}
 
-		if dsm.IsUC() {
+		if dsm.IsUC(ctx) {
 			continue
 		}
 
-		shares, err := dsm.ShareList()
+		shares, err := dsm.ShareList(ctx)
 		if err != nil {
-			log.Errorf("[%s] Failed to list shares: %v", dsm.Ip, err)
+			log.WithContext(ctx).Errorf("[%s] Failed to list shares: %v", dsm.Ip, err)
 			continue
 		}
 
@@ -203,9 +267,9 @@ func (service *DsmService) listSMBorNFSVolumes(dsmIp string) (infos []*models.K8
 				continue
 			}
 			// if share has set nfs rule, deal it as NFS
-			sharePrivilege, err := dsm.ShareNfsPrivilegeLoad(share.Name)
+			sharePrivilege, err := dsm.ShareNfsPrivilegeLoad(ctx, share.Name)
 			if err != nil {
-				log.Errorf("[%s] Failed to load share nfs privilege: %v", dsm.Ip, err)
+				log.WithContext(ctx).Errorf("[%s] Failed to load share nfs privilege: %v", dsm.Ip, err)
 				continue
 			}
 			if len(sharePrivilege.Rule) > 0 {
@@ -219,13 +283,13 @@ func (service *DsmService) listSMBorNFSVolumes(dsmIp string) (infos []*models.K8
 	return infos
 }
 
-func (service *DsmService) listSMBorNFSSnapshotsByDsm(dsm *webapi.DSM) (infos []*models.K8sSnapshotRespSpec) {
-	volumes := service.listSMBorNFSVolumes(dsm.Ip)
+func (service *DsmService) listSMBorNFSSnapshotsByDsm(ctx context.Context, dsm *webapi.DSM) (infos []*models.K8sSnapshotRespSpec) {
+	volumes := service.listSMBorNFSVolumes(ctx, dsm.Ip)
 	for _, volume := range volumes {
 		shareInfo := volume.Share
-		shareSnaps, err := dsm.ShareSnapshotList(shareInfo.Name)
+		shareSnaps, err := dsm.ShareSnapshotList(ctx, shareInfo.Name)
 		if err != nil {
-			log.Errorf("[%s] Failed to list share snapshots: %v", dsm.Ip, err)
+			log.WithContext(ctx).Errorf("[%s] Failed to list share snapshots: %v", dsm.Ip, err)
 			continue
 		}
 		for _, info := range shareSnaps {
@@ -235,9 +299,9 @@ func (service *DsmService) listSMBorNFSSnapshotsByDsm(dsm *webapi.DSM) (infos []
 	return infos
 }
 
-func (service *DsmService) getSMBorNFSSnapshot(snapshotUuid string) *models.K8sSnapshotRespSpec {
+func (service *DsmService) getSMBorNFSSnapshot(ctx context.Context, snapshotUuid string) *models.K8sSnapshotRespSpec {
 	for _, dsm := range service.dsms {
-		snapshots := service.listSMBorNFSSnapshotsByDsm(dsm)
+		snapshots := service.listSMBorNFSSnapshotsByDsm(ctx, dsm)
 		for _, snap := range snapshots {
 			if snap.Uuid == snapshotUuid {
 				return snap
@@ -247,3 +311,18 @@ func (service *DsmService) getSMBorNFSSnapshot(snapshotUuid string) *models.K8sS
 
 	return nil
 }
+
+// checkShareQuotaSupport tells if the size of a share can be set by its quota. Shares on ext4
+// volumes, e.g. ones created outside the driver, have no share quota and keep growing with
+// their volume instead.
+func checkShareQuotaSupport(ctx context.Context, dsm *webapi.DSM, share webapi.ShareInfo) error {
+	volInfo, err := dsm.VolumeGet(ctx, share.VolPath)
+	if err != nil {
+		return dsmError(err, "Failed to get location %s of Share [%s]", share.VolPath, share.Name)
+	}
+	if volInfo.FsType == models.FsTypeExt4 {
+		return status.Errorf(codes.FailedPrecondition,
+			"Share [%s] is on location %s with ext4 fstype, which doesn't support share quotas", share.Name, share.VolPath)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+/*
+ * Copyright 2021 Synology Inc.
+ */
+
+package service
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+)
+
+// SetLunsPerTarget sets how many LUNs are mapped to each shared target, 1 maps every LUN
+// to a target of its own
+func (service *DsmService) SetLunsPerTarget(n int) {
+	service.lunsPerTarget = n
+}
+
+// sharesTarget tells if the LUN of spec is mapped to a shared target. A volume with CHAP
+// credentials or a LUN named by a lunNameTemplate, which is found by its target, keeps a
+// target of its own.
+func (service *DsmService) sharesTarget(spec *models.CreateK8sVolumeSpec) bool {
+	return service.lunsPerTarget > 1 && spec.Chap == nil && spec.LunName == models.GenLunName(spec.K8sVolumeName)
+}
+
+// sharedTargetIndex returns the index of a shared target name, false if name isn't one
+func sharedTargetIndex(name string) (int, bool) {
+	if !strings.HasPrefix(name, models.SharedTargetPrefix) {
+		return 0, false
+	}
+	index, err := strconv.Atoi(strings.TrimPrefix(name, models.SharedTargetPrefix))
+	return index, err == nil && index > 0
+}
+
+// pickSharedTarget returns the shared target lunUuid is mapped to, else the first shared
+// target with fewer than lunsPerTarget LUNs. If all are full, it returns the name of a new one.
+func pickSharedTarget(targets []webapi.TargetInfo, lunUuid string, lunsPerTarget int) (string, *webapi.TargetInfo) {
+	var free *webapi.TargetInfo
+	freeIndex := 0
+	used := map[int]bool{}
+	for i := range targets {
+		index, ok := sharedTargetIndex(targets[i].Name)
+		if !ok {
+			continue
+		}
+		used[index] = true
+		for _, mapping := range targets[i].MappedLuns {
+			if mapping.LunUuid == lunUuid {
+				return targets[i].Name, &targets[i]
+			}
+		}
+		if len(targets[i].MappedLuns) < lunsPerTarget && (free == nil || index < freeIndex) {
+			free, freeIndex = &targets[i], index
+		}
+	}
+	if free != nil {
+		return free.Name, free
+	}
+
+	index := 1
+	for used[index] {
+		index++
+	}
+	return models.GenSharedTargetName(index), nil
+}
+
+// mapSharedTarget maps the LUN of lunUuid to a shared target, creating one when all are full
+func (service *DsmService) mapSharedTarget(ctx context.Context, dsm *webapi.DSM, lunUuid string) (webapi.TargetInfo, error) {
+	service.sharedTargetMu.Lock()
+	defer service.sharedTargetMu.Unlock()
+
+	targets, err := dsm.TargetList(ctx)
+	if err != nil {
+		return webapi.TargetInfo{}, dsmError(err, "Failed to list targets")
+	}
+
+	name, target := pickSharedTarget(targets, lunUuid, service.lunsPerTarget)
+	if target != nil {
+		for _, mapping := range target.MappedLuns {
+			if mapping.LunUuid == lunUuid {
+				return *target, nil
+			}
+		}
+	} else {
+		dsmInfo, err := dsm.DsmInfoGet(ctx)
+		if err != nil {
+			return webapi.TargetInfo{}, status.Errorf(codes.Internal, fmt.Sprintf("Failed to get DSM[%s] info", dsm.Ip))
+		}
+		// every node staging one of its LUNs logs into the target
+		info, err := createTarget(ctx, dsm, webapi.TargetCreateSpec{Name: name, Iqn: genTargetIqn(dsmInfo.Hostname, name)}, true)
+		if err != nil {
+			return webapi.TargetInfo{}, err
+		}
+		target = &info
+		log.WithContext(ctx).Infof("[%s] Created shared target [%s]", dsm.Ip, name)
+	}
+
+	targetId := strconv.Itoa(target.TargetId)
+	if err := dsm.LunMapTarget(ctx, []string{targetId}, lunUuid); err != nil {
+		return webapi.TargetInfo{}, dsmError(err, "Failed to map target [%s] to lun [%s]", name, lunUuid)
+	}
+
+	// the mapping index of the LUN is only known once it is mapped
+	info, err := dsm.TargetGet(ctx, targetId)
+	if err != nil {
+		return webapi.TargetInfo{}, dsmError(err, "Failed to get target [%s]", name)
+	}
+	return info, nil
+}
+
+// deleteTargetIfUnmapped deletes a target mapped to other LUNs when the volume was listed,
+// if they were unmapped since. A shared target is kept until its last LUN is deleted.
+func (service *DsmService) deleteTargetIfUnmapped(ctx context.Context, dsm *webapi.DSM, target webapi.TargetInfo) error {
+	service.sharedTargetMu.Lock()
+	defer service.sharedTargetMu.Unlock()
+
+	targetId := strconv.Itoa(target.TargetId)
+	info, err := dsm.TargetGet(ctx, targetId)
+	if err != nil {
+		// gone, or checked by the next deletion of one of its LUNs
+		log.WithContext(ctx).Warnf("[%s] Failed to get target[%s]: %v", dsm.Ip, target.Name, err)
+		return nil
+	}
+	if len(info.MappedLuns) > 0 {
+		log.WithContext(ctx).Infof("Skip deletes target[%s] that is still mapped to %d LUNs. DSM[%s]", target.Name, len(info.MappedLuns), dsm.Ip)
+		return nil
+	}
+
+	if err := dsm.TargetDelete(ctx, targetId); err != nil {
+		log.WithContext(ctx).Errorf("[%s] Failed to delete target(%d): %v", dsm.Ip, target.TargetId, err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,216 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+)
+
+func TestPickSharedTarget(t *testing.T) {
+	shared := func(index int, luns ...string) webapi.TargetInfo {
+		target := webapi.TargetInfo{Name: models.GenSharedTargetName(index), TargetId: index}
+		for i, lun := range luns {
+			target.MappedLuns = append(target.MappedLuns, webapi.MappedLun{LunUuid: lun, MappingIndex: i})
+		}
+		return target
+	}
+	own := webapi.TargetInfo{Name: "k8s-csi-shared-1", MappedLuns: []webapi.MappedLun{{LunUuid: "own"}}}
+
+	tests := []struct {
+		name     string
+		targets  []webapi.TargetInfo
+		lunUuid  string
+		wantName string
+		wantNew  bool
+	}{
+		{name: "no target", targets: []webapi.TargetInfo{own}, lunUuid: "new", wantName: "k8s-csi_shared-1", wantNew: true},
+		{name: "free target", targets: []webapi.TargetInfo{shared(2, "a"), shared(1, "b", "c")}, lunUuid: "new", wantName: "k8s-csi_shared-2"},
+		{name: "lowest free target", targets: []webapi.TargetInfo{shared(3), shared(2, "a")}, lunUuid: "new", wantName: "k8s-csi_shared-2"},
+		{name: "already mapped", targets: []webapi.TargetInfo{shared(1, "a"), shared(2, "b", "c")}, lunUuid: "c", wantName: "k8s-csi_shared-2"},
+		{name: "all full", targets: []webapi.TargetInfo{shared(1, "a", "b"), shared(3, "c", "d")}, lunUuid: "new", wantName: "k8s-csi_shared-2", wantNew: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			name, target := pickSharedTarget(tt.targets, tt.lunUuid, 2)
+			if name != tt.wantName || (target == nil) != tt.wantNew {
+				t.Errorf("pickSharedTarget() = %s, %v, want %s (new: %v)", name, target, tt.wantName, tt.wantNew)
+			}
+		})
+	}
+}
+
+// fakeTargetDsm serves the iSCSI targets and LUNs of a DSM, recording the target methods called
+type fakeTargetDsm struct {
+	mu      sync.Mutex
+	targets []*webapi.TargetInfo
+	luns    []webapi.LunInfo
+	methods []string
+}
+
+func (f *fakeTargetDsm) target(id string) *webapi.TargetInfo {
+	for _, target := range f.targets {
+		if strconv.Itoa(target.TargetId) == id || target.Name == id {
+			return target
+		}
+	}
+	return nil
+}
+
+func (f *fakeTargetDsm) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	query := r.URL.Query()
+	method := query.Get("api") + "." + query.Get("method")
+	if strings.HasPrefix(method, "SYNO.Core.ISCSI.Target.") || strings.HasSuffix(method, "_target") {
+		f.methods = append(f.methods, method)
+	}
+	unquote := func(key string) string { s, _ := strconv.Unquote(query.Get(key)); return s }
+	targetIds := func() []string { return strings.Split(strings.Trim(query.Get("target_ids"), "[]"), ",") }
+
+	var data interface{}
+	switch method {
+	case "SYNO.Core.System.info":
+		data = webapi.DsmInfo{Hostname: "nas"}
+	case "SYNO.Core.ISCSI.Target.list":
+		targets := []webapi.TargetInfo{}
+		for _, target := range f.targets {
+			targets = append(targets, *target)
+		}
+		data = map[string]interface{}{"targets": targets}
+	case "SYNO.Core.ISCSI.Target.create":
+		target := &webapi.TargetInfo{Name: query.Get("name"), Iqn: query.Get("iqn"), TargetId: len(f.targets) + 1}
+		f.targets = append(f.targets, target)
+		data = map[string]int{"target_id": target.TargetId}
+	case "SYNO.Core.ISCSI.Target.get":
+		if target := f.target(unquote("target_id")); target != nil {
+			data = map[string]interface{}{"target": target}
+		}
+	case "SYNO.Core.ISCSI.Target.set":
+		if target := f.target(unquote("target_id")); target != nil && query.Has("acls") {
+			target.Acls = nil
+			json.Unmarshal([]byte(query.Get("acls")), &target.Acls)
+		}
+	case "SYNO.Core.ISCSI.Target.delete":
+		for i, target := range f.targets {
+			if strconv.Itoa(target.TargetId) == unquote("target_id") {
+				f.targets = append(f.targets[:i], f.targets[i+1:]...)
+				break
+			}
+		}
+	case "SYNO.Core.ISCSI.LUN.map_target":
+		target := f.target(targetIds()[0])
+		target.MappedLuns = append(target.MappedLuns, webapi.MappedLun{LunUuid: unquote("uuid"), MappingIndex: len(target.MappedLuns)})
+	case "SYNO.Core.ISCSI.LUN.unmap_target":
+		target := f.target(targetIds()[0])
+		for i, mapping := range target.MappedLuns {
+			if mapping.LunUuid == unquote("uuid") {
+				target.MappedLuns = append(target.MappedLuns[:i], target.MappedLuns[i+1:]...)
+				break
+			}
+		}
+	case "SYNO.Core.ISCSI.LUN.get":
+		for _, lun := range f.luns {
+			if lun.Uuid == unquote("uuid") {
+				data = map[string]interface{}{"lun": lun}
+			}
+		}
+	case "SYNO.Core.ISCSI.LUN.delete":
+		for i, lun := range f.luns {
+			if lun.Uuid == unquote("uuid") {
+				f.luns = append(f.luns[:i], f.luns[i+1:]...)
+				break
+			}
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "data": data})
+}
+
+func newFakeTargetService(t *testing.T, fake *fakeTargetDsm, lunsPerTarget int) (*DsmService, *webapi.DSM) {
+	t.Helper()
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+
+	service := NewDsmService()
+	service.SetLunsPerTarget(lunsPerTarget)
+	dsm := &webapi.DSM{Ip: host, Port: p}
+	service.dsms[host] = dsm
+	return service, dsm
+}
+
+func TestCreateMappingTarget_shared(t *testing.T) {
+	fake := &fakeTargetDsm{}
+	service, dsm := newFakeTargetService(t, fake, 2)
+
+	mappingIndexes := map[string]int{}
+	for _, volName := range []string{"pvc-1", "pvc-2", "pvc-3"} {
+		spec := &models.CreateK8sVolumeSpec{K8sVolumeName: volName, LunName: models.GenLunName(volName), TargetName: models.GenTargetName(volName)}
+		target, err := service.createMappingTarget(context.Background(), dsm, spec, volName+"-uuid")
+		if err != nil {
+			t.Fatalf("createMappingTarget(%s) error = %v", volName, err)
+		}
+		volume := DsmLunToK8sVolume(dsm.Ip, webapi.LunInfo{Uuid: volName + "-uuid"}, target)
+		mappingIndexes[target.Name+"/"+volName] = volume.LunMappingIndex()
+	}
+
+	want := map[string]int{"k8s-csi_shared-1/pvc-1": 0, "k8s-csi_shared-1/pvc-2": 1, "k8s-csi_shared-2/pvc-3": 0}
+	if !reflect.DeepEqual(mappingIndexes, want) {
+		t.Errorf("LUNs mapped at %v, want %v", mappingIndexes, want)
+	}
+	if strings.Contains(fake.targets[0].Iqn, "_") {
+		t.Errorf("shared target IQN %q has an underscore", fake.targets[0].Iqn)
+	}
+
+	// CHAP credentials are set on the target, which can't be shared
+	spec := &models.CreateK8sVolumeSpec{K8sVolumeName: "pvc-chap", LunName: models.GenLunName("pvc-chap"), TargetName: models.GenTargetName("pvc-chap"),
+		Chap: &models.ChapCredentials{User: "user", Password: "password"}}
+	target, err := service.createMappingTarget(context.Background(), dsm, spec, "pvc-chap-uuid")
+	if err != nil || target.Name != "k8s-csi-pvc-chap" {
+		t.Errorf("createMappingTarget() = %s, %v for a CHAP volume, want a target of its own", target.Name, err)
+	}
+}
+
+func TestDeleteVolume_sharedTarget(t *testing.T) {
+	fake := &fakeTargetDsm{
+		targets: []*webapi.TargetInfo{{Name: models.GenSharedTargetName(1), TargetId: 1, MappedLuns: []webapi.MappedLun{
+			{LunUuid: "lun-1", MappingIndex: 0}, {LunUuid: "lun-2", MappingIndex: 1},
+		}}},
+		luns: []webapi.LunInfo{{Name: "k8s-csi-pvc-1", Uuid: "lun-1"}, {Name: "k8s-csi-pvc-2", Uuid: "lun-2"}},
+	}
+	service, _ := newFakeTargetService(t, fake, 2)
+
+	if err := service.DeleteVolume(context.Background(), "lun-1"); err != nil {
+		t.Fatalf("DeleteVolume(lun-1) error = %v", err)
+	}
+	if len(fake.targets) != 1 || len(fake.targets[0].MappedLuns) != 1 || fake.targets[0].MappedLuns[0].LunUuid != "lun-2" {
+		t.Fatalf("targets = %+v after deleting lun-1, want the shared target mapped to lun-2", fake.targets)
+	}
+	want := []string{"SYNO.Core.ISCSI.Target.list", "SYNO.Core.ISCSI.LUN.unmap_target", "SYNO.Core.ISCSI.Target.get"}
+	if !reflect.DeepEqual(fake.methods, want) {
+		t.Errorf("DeleteVolume(lun-1) sent %v, want %v", fake.methods, want)
+	}
+
+	fake.methods = nil
+	if err := service.DeleteVolume(context.Background(), "lun-2"); err != nil {
+		t.Fatalf("DeleteVolume(lun-2) error = %v", err)
+	}
+	if len(fake.targets) != 0 {
+		t.Errorf("targets = %+v after deleting the last LUN, want none", fake.targets)
+	}
+	want = []string{"SYNO.Core.ISCSI.Target.list", "SYNO.Core.ISCSI.LUN.unmap_target", "SYNO.Core.ISCSI.Target.delete"}
+	if !reflect.DeepEqual(fake.methods, want) {
+		t.Errorf("DeleteVolume(lun-2) sent %v, want %v", fake.methods, want)
+	}
+}
@@ -0,0 +1,102 @@
+/*
+ * Copyright 2021 Synology Inc.
+ */
+
+package service
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+// ShrinkLunSpec asks for a LUN to be shrunk, which is never done by the CSI calls. The
+// filesystem on the LUN must have been shrunk first, to FilesystemSize.
+type ShrinkLunSpec struct {
+	VolumeId       string
+	NewSize        int64
+	FilesystemSize int64
+	// DryRun only checks the preconditions
+	DryRun bool
+}
+
+// checkLunShrink refuses to shrink the LUN of a volume unless its type can be shrunk, the
+// new size is smaller and still holds the shrunk filesystem, and no initiator uses the LUN
+func checkLunShrink(k8sVolume *models.K8sVolumeRespSpec, spec ShrinkLunSpec) error {
+	if k8sVolume.Protocol != utils.ProtocolIscsi {
+		return status.Errorf(codes.InvalidArgument, "Volume[%s] is a %s share, only LUNs can be shrunk", spec.VolumeId, k8sVolume.Protocol)
+	}
+
+	lun := k8sVolume.Lun
+	lunType := models.LunTypeName(lun.LunType)
+	if !models.LunTypeSupportsShrink(lunType) {
+		return status.Errorf(codes.FailedPrecondition, "LUN(%s) of type %d can't be shrunk, only thin Btrfs LUNs can", lun.Uuid, lun.LunType)
+	}
+	if spec.NewSize <= 0 || uint64(spec.NewSize) >= lun.Size {
+		return status.Errorf(codes.InvalidArgument, "New size %d of LUN(%s) must be smaller than its size %d", spec.NewSize, lun.Uuid, lun.Size)
+	}
+	if spec.NewSize%utils.UNIT_MB != 0 {
+		return status.Errorf(codes.InvalidArgument, "New size %d of LUN(%s) must be a multiple of 1 MiB", spec.NewSize, lun.Uuid)
+	}
+	// the blocks past the new size are dropped, they must not belong to the filesystem
+	if spec.FilesystemSize <= 0 {
+		return status.Errorf(codes.FailedPrecondition, "The size of the shrunk filesystem on LUN(%s) is needed", lun.Uuid)
+	}
+	if spec.FilesystemSize > spec.NewSize {
+		return status.Errorf(codes.FailedPrecondition, "Filesystem of %d bytes on LUN(%s) doesn't fit in %d bytes, shrink it first", spec.FilesystemSize, lun.Uuid, spec.NewSize)
+	}
+	if sessions := len(k8sVolume.Target.ConnectedSessions); sessions > 0 {
+		return status.Errorf(codes.FailedPrecondition, "LUN(%s) is still used by %d sessions of target[%s]", lun.Uuid, sessions, k8sVolume.Target.Name)
+	}
+	return nil
+}
+
+// lunShrinkUpdateSpec is the request shrinking the LUN of a volume, which keeps its QoS limits
+func lunShrinkUpdateSpec(k8sVolume *models.K8sVolumeRespSpec, spec ShrinkLunSpec) webapi.LunUpdateSpec {
+	return webapi.LunUpdateSpec{
+		Uuid:    k8sVolume.Lun.Uuid,
+		NewSize: uint64(spec.NewSize),
+		Qos:     k8sVolume.Lun.LunQos,
+	}
+}
+
+// ShrinkLun reduces the size of the LUN of a volume once the preconditions of checkLunShrink
+// are met and its DSM supports it. The PV keeps its capacity in Kubernetes.
+func (service *DsmService) ShrinkLun(ctx context.Context, spec ShrinkLunSpec) (*models.K8sVolumeRespSpec, error) {
+	k8sVolume := service.GetVolume(ctx, spec.VolumeId)
+	if k8sVolume == nil {
+		return nil, status.Errorf(codes.NotFound, "Can't find volume[%s]", spec.VolumeId)
+	}
+	if err := checkLunShrink(k8sVolume, spec); err != nil {
+		return nil, err
+	}
+
+	dsm, err := service.GetDsm(k8sVolume.DsmIp)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "Failed to get DSM[%s]", k8sVolume.DsmIp)
+	}
+	supported, firmware, err := dsm.SupportsLunShrink(ctx)
+	if err != nil {
+		return nil, dsmError(err, "Failed to get the firmware version of DSM[%s]", dsm.Ip)
+	}
+	if !supported {
+		return nil, status.Errorf(codes.FailedPrecondition, "DSM[%s] with firmware %q can't shrink LUNs", dsm.Ip, firmware)
+	}
+	if spec.DryRun {
+		return k8sVolume, nil
+	}
+
+	log.WithContext(ctx).Infof("[%s] Shrinking LUN %s(%s) from %d to %d bytes", dsm.Ip, k8sVolume.Lun.Name, k8sVolume.Lun.Uuid, k8sVolume.Lun.Size, spec.NewSize)
+	if err := dsm.LunUpdate(ctx, lunShrinkUpdateSpec(k8sVolume, spec)); err != nil {
+		return nil, dsmError(err, "Failed to shrink volume[%s]", spec.VolumeId)
+	}
+	k8sVolume.SizeInBytes = spec.NewSize
+	k8sVolume.Lun.Size = uint64(spec.NewSize)
+	return k8sVolume, nil
+}
@@ -0,0 +1,173 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+const (
+	lunTypeBlunId      = 263
+	lunTypeBlunThickId = 259
+)
+
+func shrinkableVolume() *models.K8sVolumeRespSpec {
+	return &models.K8sVolumeRespSpec{
+		Protocol: utils.ProtocolIscsi,
+		Lun:      webapi.LunInfo{Uuid: "lun-uuid", LunType: lunTypeBlunId, Size: 10 * utils.UNIT_GB},
+		Target:   webapi.TargetInfo{Name: "k8s-csi-pvc-1"},
+	}
+}
+
+func TestCheckLunShrink(t *testing.T) {
+	valid := ShrinkLunSpec{VolumeId: "lun-uuid", NewSize: 6 * utils.UNIT_GB, FilesystemSize: 5 * utils.UNIT_GB}
+
+	tests := []struct {
+		name     string
+		volume   func(v *models.K8sVolumeRespSpec)
+		spec     func(s *ShrinkLunSpec)
+		wantCode codes.Code
+	}{
+		{name: "valid", wantCode: codes.OK},
+		{name: "filesystem of the new size", spec: func(s *ShrinkLunSpec) { s.FilesystemSize = s.NewSize }, wantCode: codes.OK},
+		{name: "share", volume: func(v *models.K8sVolumeRespSpec) { v.Protocol = utils.ProtocolNfs }, wantCode: codes.InvalidArgument},
+		{name: "thick lun", volume: func(v *models.K8sVolumeRespSpec) { v.Lun.LunType = lunTypeBlunThickId }, wantCode: codes.FailedPrecondition},
+		{name: "unknown lun type", volume: func(v *models.K8sVolumeRespSpec) { v.Lun.LunType = 3 }, wantCode: codes.FailedPrecondition},
+		{name: "same size", spec: func(s *ShrinkLunSpec) { s.NewSize = 10 * utils.UNIT_GB }, wantCode: codes.InvalidArgument},
+		{name: "larger", spec: func(s *ShrinkLunSpec) { s.NewSize = 20 * utils.UNIT_GB }, wantCode: codes.InvalidArgument},
+		{name: "zero", spec: func(s *ShrinkLunSpec) { s.NewSize = 0 }, wantCode: codes.InvalidArgument},
+		{name: "unaligned", spec: func(s *ShrinkLunSpec) { s.NewSize += 512 }, wantCode: codes.InvalidArgument},
+		{name: "filesystem not shrunk", spec: func(s *ShrinkLunSpec) { s.FilesystemSize = 7 * utils.UNIT_GB }, wantCode: codes.FailedPrecondition},
+		{name: "filesystem size unknown", spec: func(s *ShrinkLunSpec) { s.FilesystemSize = 0 }, wantCode: codes.FailedPrecondition},
+		{
+			name: "in use",
+			volume: func(v *models.K8sVolumeRespSpec) {
+				v.Target.ConnectedSessions = []webapi.ConncetedSession{{Iqn: "iqn.node"}}
+			},
+			wantCode: codes.FailedPrecondition,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			volume, spec := shrinkableVolume(), valid
+			if tt.volume != nil {
+				tt.volume(volume)
+			}
+			if tt.spec != nil {
+				tt.spec(&spec)
+			}
+			if code := status.Code(checkLunShrink(volume, spec)); code != tt.wantCode {
+				t.Errorf("checkLunShrink() code = %v, want %v", code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestLunShrinkUpdateSpec(t *testing.T) {
+	volume := shrinkableVolume()
+	volume.Lun.LunQos = webapi.LunQos{MaxIops: 500}
+
+	got := lunShrinkUpdateSpec(volume, ShrinkLunSpec{NewSize: 6 * utils.UNIT_GB, FilesystemSize: 5 * utils.UNIT_GB})
+	want := webapi.LunUpdateSpec{Uuid: "lun-uuid", NewSize: 6 * utils.UNIT_GB, Qos: webapi.LunQos{MaxIops: 500}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("lunShrinkUpdateSpec() = %+v, want %+v", got, want)
+	}
+}
+
+// fakeShrinkDsm serves one LUN mapped to one target, recording the sizes it is set to
+type fakeShrinkDsm struct {
+	firmware string
+	lunType  int
+	newSizes []string
+}
+
+func (f *fakeShrinkDsm) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	resp := map[string]interface{}{"success": true}
+	lun := webapi.LunInfo{Name: "k8s-csi-pvc-1", Uuid: "lun-uuid", LunType: f.lunType, Size: 10 * utils.UNIT_GB}
+
+	switch query.Get("api") + "." + query.Get("method") {
+	case "SYNO.Core.ISCSI.Target.list":
+		target := webapi.TargetInfo{Name: "k8s-csi-pvc-1", TargetId: 1, MappedLuns: []webapi.MappedLun{{LunUuid: lun.Uuid}}}
+		resp["data"] = map[string]interface{}{"targets": []webapi.TargetInfo{target}}
+	case "SYNO.Core.ISCSI.LUN.get":
+		resp["data"] = map[string]interface{}{"lun": lun}
+	case "SYNO.Core.System.info":
+		resp["data"] = webapi.DsmSysInfo{FirmwareVer: f.firmware}
+	case "SYNO.Core.ISCSI.LUN.set":
+		f.newSizes = append(f.newSizes, query.Get("new_size"))
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func TestShrinkLun(t *testing.T) {
+	spec := ShrinkLunSpec{VolumeId: "lun-uuid", NewSize: 6 * utils.UNIT_GB, FilesystemSize: 5 * utils.UNIT_GB}
+
+	tests := []struct {
+		name      string
+		dsm       fakeShrinkDsm
+		dryRun    bool
+		wantCode  codes.Code
+		wantSizes []string
+	}{
+		{name: "shrunk", dsm: fakeShrinkDsm{firmware: "DSM 7.2-64570", lunType: lunTypeBlunId}, wantSizes: []string{strconv.Itoa(6 * utils.UNIT_GB)}},
+		{name: "dry run", dsm: fakeShrinkDsm{firmware: "DSM 7.2-64570", lunType: lunTypeBlunId}, dryRun: true},
+		{name: "old dsm", dsm: fakeShrinkDsm{firmware: "DSM 6.2.4-25556", lunType: lunTypeBlunId}, wantCode: codes.FailedPrecondition},
+		{name: "thick lun", dsm: fakeShrinkDsm{firmware: "DSM 7.2-64570", lunType: lunTypeBlunThickId}, wantCode: codes.FailedPrecondition},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := tt.dsm
+			server := httptest.NewServer(&fake)
+			defer server.Close()
+			host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+			p, _ := strconv.Atoi(port)
+			service := NewDsmService()
+			service.dsms[host] = &webapi.DSM{Ip: host, Port: p}
+
+			spec := spec
+			spec.DryRun = tt.dryRun
+			volume, err := service.ShrinkLun(context.Background(), spec)
+			if code := status.Code(err); code != tt.wantCode {
+				t.Fatalf("ShrinkLun() code = %v, want %v (err: %v)", code, tt.wantCode, err)
+			}
+			if !reflect.DeepEqual(fake.newSizes, tt.wantSizes) {
+				t.Errorf("ShrinkLun() set the sizes %v, want %v", fake.newSizes, tt.wantSizes)
+			}
+			if err == nil && !tt.dryRun && volume.SizeInBytes != spec.NewSize {
+				t.Errorf("ShrinkLun() size = %d, want %d", volume.SizeInBytes, spec.NewSize)
+			}
+		})
+	}
+}
+
+func TestExpandVolume_shrinkRefused(t *testing.T) {
+	fake := fakeShrinkDsm{firmware: "DSM 7.2-64570", lunType: lunTypeBlunId}
+	server := httptest.NewServer(&fake)
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	service := NewDsmService()
+	service.dsms[host] = &webapi.DSM{Ip: host, Port: p}
+
+	// only ShrinkLun shrinks a LUN, never ControllerExpandVolume
+	_, err := service.ExpandVolume(context.Background(), "lun-uuid", 6*utils.UNIT_GB)
+	if code := status.Code(err); code != codes.InvalidArgument {
+		t.Fatalf("ExpandVolume() code = %v, want %v (err: %v)", code, codes.InvalidArgument, err)
+	}
+	if len(fake.newSizes) != 0 {
+		t.Errorf("ExpandVolume() set the sizes %v, want none", fake.newSizes)
+	}
+}
@@ -0,0 +1,59 @@
+/*
+ * Copyright 2021 Synology Inc.
+ */
+
+package service
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+)
+
+// snapshotReadyTimeout bounds how long CreateSnapshot waits for a new LUN snapshot to
+// complete. A snapshot still processing is returned as it is, the sidecar polls again.
+var snapshotReadyTimeout = 10 * time.Second
+
+var errSnapshotNotReady = errors.New("snapshot not ready")
+
+// waitISCSISnapshot returns the LUN snapshot of snapshotUuid once DSM reports it is
+// complete, or the last state seen when snapshotReadyTimeout passes. It is nil if the
+// snapshot can't be found.
+func (service *DsmService) waitISCSISnapshot(ctx context.Context, snapshotUuid string) *models.K8sSnapshotRespSpec {
+	readyBackoff := backoff.NewExponentialBackOff()
+	readyBackoff.InitialInterval = snapshotReadyTimeout / 20
+	readyBackoff.MaxElapsedTime = snapshotReadyTimeout
+
+	var snapshot *models.K8sSnapshotRespSpec
+	backoff.Retry(func() error {
+		snapshot = service.getISCSISnapshot(ctx, snapshotUuid)
+		if snapshot == nil {
+			return nil // nothing to wait for
+		}
+		if !snapshot.IsReady() {
+			return errSnapshotNotReady
+		}
+		return nil
+	}, backoff.WithContext(readyBackoff, ctx))
+
+	if snapshot != nil && !snapshot.IsReady() {
+		log.WithContext(ctx).Infof("[%s] Snapshot [%s] is still %s", snapshot.DsmIp, snapshotUuid, snapshot.Status)
+	}
+	return snapshot
+}
+
+// shareSnapshotSize returns the bytes consumed by a share snapshot, 0 if DSM didn't tell them
+func shareSnapshotSize(info webapi.ShareSnapshotInfo) int64 {
+	size, err := strconv.ParseInt(info.SnapSize, 10, 64)
+	if err != nil || size < 0 {
+		return 0
+	}
+	return size
+}
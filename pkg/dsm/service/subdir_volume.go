@@ -0,0 +1,138 @@
+/*
+ * Copyright 2021 Synology Inc.
+ */
+
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+// DsmSubDirToK8sVolume returns the volume of the subdirectory of an NFS share. Its ID is
+// always versioned, version 0 can't tell the subdirectory.
+func DsmSubDirToK8sVolume(dsmIp string, share webapi.ShareInfo, subDir string, onDelete string, size int64) (*models.K8sVolumeRespSpec, error) {
+	id, err := models.EncodeVolumeID(models.VolumeIdSpec{
+		Version:  models.VolumeIdLatest,
+		Type:     models.VolumeIdTypeSubDir,
+		Uuid:     share.Uuid,
+		DsmIp:    dsmIp,
+		SubDir:   subDir,
+		OnDelete: onDelete,
+	})
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	volume := DsmShareToK8sVolume(dsmIp, share, utils.ProtocolNfs)
+	volume.VolumeId = id
+	volume.Name = subDir
+	volume.SizeInBytes = size
+	volume.SubDir = subDir
+	return volume, nil
+}
+
+// createSubDirVolume creates the subdirectory of spec in its parent share, on the first
+// of the candidates which has the share
+func (service *DsmService) createSubDirVolume(ctx context.Context, candidates []*webapi.DSM, spec *models.CreateK8sVolumeSpec) (*models.K8sVolumeRespSpec, error) {
+	if spec.Protocol != utils.ProtocolNfs {
+		return nil, status.Errorf(codes.InvalidArgument, "Subdirectory volumes are only supported by the NFS protocol")
+	}
+
+	var lastErr error
+	for _, dsm := range candidates {
+		if spec.DsmIp != "" && spec.DsmIp != dsm.Ip {
+			continue
+		}
+
+		share, err := dsm.ShareGet(ctx, spec.ParentShare)
+		if err != nil {
+			if !errors.Is(err, utils.NoSuchShareError("")) {
+				log.WithContext(ctx).Errorf("[%s] Failed to get share [%s]: %v", dsm.Ip, spec.ParentShare, err)
+				lastErr = dsmError(err, "Failed to get share [%s]", spec.ParentShare)
+			}
+			continue
+		}
+		if !isNfsVersionSupport(ctx, dsm, spec.NfsVersion, !spec.DryRun) {
+			continue
+		}
+
+		volume, err := DsmSubDirToK8sVolume(dsm.Ip, share, spec.SubDir, spec.SubDirOnDelete, spec.Size)
+		if err != nil || spec.DryRun {
+			return volume, err
+		}
+
+		if err := dsm.FolderCreate(ctx, share.Name, spec.SubDir); err != nil && !errors.Is(err, utils.AlreadyExistError("")) {
+			return nil, dsmError(err, "Failed to create subdirectory [%s] of share [%s]", spec.SubDir, share.Name)
+		}
+		// the rules are the share's, the same for all its subdirectories
+		if err := saveNfsExport(ctx, dsm, spec, share.Name); err != nil {
+			return nil, err
+		}
+
+		log.WithContext(ctx).Debugf("[%s] createSubDirVolume Successfully. VolumeId: %s", dsm.Ip, volume.VolumeId)
+		return volume, nil
+	}
+
+	if lastErr != nil {
+		return nil, lastErr
+	}
+	return nil, status.Errorf(codes.FailedPrecondition, "No DSM has the NFS share [%s] to create the subdirectory [%s] in", spec.ParentShare, spec.SubDir)
+}
+
+// getSubDirVolume returns the volume of the subdirectory of spec, nil if its share is gone
+func (service *DsmService) getSubDirVolume(ctx context.Context, spec models.VolumeIdSpec) *models.K8sVolumeRespSpec {
+	dsm, err := service.GetDsm(spec.DsmIp)
+	if err != nil {
+		log.WithContext(ctx).Warnf("Subdirectory [%s] is on an unknown DSM [%s]", spec.SubDir, spec.DsmIp)
+		return nil
+	}
+	shares, err := dsm.ShareList(ctx)
+	if err != nil {
+		log.WithContext(ctx).Errorf("[%s] Failed to list shares: %v", dsm.Ip, err)
+		return nil
+	}
+
+	for _, share := range shares {
+		if share.Uuid != spec.Uuid {
+			continue
+		}
+		// the capacity isn't known, subdirectories have no quota
+		volume, err := DsmSubDirToK8sVolume(dsm.Ip, share, spec.SubDir, spec.OnDelete, 0)
+		if err != nil {
+			log.WithContext(ctx).Errorf("[%s] Invalid subdirectory [%s] of share [%s]: %v", dsm.Ip, spec.SubDir, share.Name, err)
+			return nil
+		}
+		return volume
+	}
+	return nil
+}
+
+// deleteSubDirVolume deletes the subdirectory of a volume with its contents, unless the
+// StorageClass asked to retain them. The share and its NFS rules are left to the others.
+func deleteSubDirVolume(ctx context.Context, dsm *webapi.DSM, volume *models.K8sVolumeRespSpec) error {
+	spec, err := models.DecodeVolumeID(volume.VolumeId)
+	if err != nil {
+		return status.Errorf(codes.Internal, fmt.Sprintf("Invalid ID of subdirectory volume: %v", err))
+	}
+	if spec.OnDelete == models.SubDirRetain {
+		log.WithContext(ctx).Infof("[%s] Retaining subdirectory [%s] of share [%s]", dsm.Ip, volume.SubDir, volume.Share.Name)
+		return nil
+	}
+
+	err = dsm.FolderDelete(ctx, volume.Share.Name, volume.SubDir)
+	if err != nil && !errors.Is(err, utils.NoSuchFileError("")) {
+		log.WithContext(ctx).Errorf("[%s] Failed to delete subdirectory [%s] of share [%s]: %v", dsm.Ip, volume.SubDir, volume.Share.Name, err)
+		return dsmError(err, "Failed to delete subdirectory [%s] of share [%s]", volume.SubDir, volume.Share.Name)
+	}
+	return nil
+}
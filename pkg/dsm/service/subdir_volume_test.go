@@ -0,0 +1,113 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+// newSubDirService returns a service of a DSM with the share "shared", recording the
+// File Station requests it got
+func newSubDirService(t *testing.T, fileRequests *[]string) *DsmService {
+	t.Helper()
+	share := webapi.ShareInfo{Name: "shared", Uuid: "share-uuid", VolPath: "/volume1"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var data interface{} = map[string]interface{}{}
+		switch api := r.URL.Query().Get("api"); api {
+		case "SYNO.Core.Share":
+			if r.URL.Query().Get("method") == "list" {
+				data = map[string]interface{}{"shares": []webapi.ShareInfo{share}}
+			} else if r.URL.Query().Get("name") != strconv.Quote(share.Name) {
+				json.NewEncoder(w).Encode(map[string]interface{}{"success": false, "error": map[string]int{"code": 402}})
+				return
+			} else {
+				data = share
+			}
+		case "SYNO.Core.FileServ.NFS":
+			data = webapi.NfsInfo{EnableNfs: true, SupportMajorVer: 4, SupportMinorVer: 1}
+		case "SYNO.FileStation.CreateFolder":
+			*fileRequests = append(*fileRequests, "create "+r.URL.Query().Get("folder_path")+" "+r.URL.Query().Get("name"))
+		case "SYNO.FileStation.Delete":
+			*fileRequests = append(*fileRequests, "delete "+r.URL.Query().Get("path"))
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "data": data})
+	}))
+	t.Cleanup(server.Close)
+
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	service := NewDsmService()
+	service.dsms[host] = &webapi.DSM{Ip: host, Port: p}
+	return service
+}
+
+func TestSubDirVolume(t *testing.T) {
+	for _, onDelete := range []string{models.SubDirDelete, models.SubDirRetain} {
+		t.Run(onDelete, func(t *testing.T) {
+			var fileRequests []string
+			service := newSubDirService(t, &fileRequests)
+
+			spec := models.CreateK8sVolumeSpec{
+				K8sVolumeName: "pvc-1", Protocol: utils.ProtocolNfs, Size: utils.UNIT_GB,
+				ParentShare: "shared", SubDir: "pvc-1", SubDirOnDelete: onDelete,
+			}
+			volume, err := service.CreateVolume(context.Background(), &spec)
+			if err != nil {
+				t.Fatalf("CreateVolume() error = %v", err)
+			}
+			if volume.SubDir != "pvc-1" || volume.BaseDir != "/volume1/shared" || volume.SizeInBytes != utils.UNIT_GB {
+				t.Errorf("CreateVolume() = %+v, want subdirectory pvc-1 of /volume1/shared", volume)
+			}
+			id, err := models.DecodeVolumeID(volume.VolumeId)
+			if err != nil || id.Type != models.VolumeIdTypeSubDir || id.Uuid != "share-uuid" || id.SubDir != "pvc-1" || id.OnDelete != onDelete {
+				t.Errorf("CreateVolume() ID %s decodes to %+v, %v", volume.VolumeId, id, err)
+			}
+
+			got := service.GetVolume(context.Background(), volume.VolumeId)
+			if got == nil || got.SubDir != "pvc-1" || got.Share.Name != "shared" {
+				t.Fatalf("GetVolume(%s) = %+v, want the subdirectory", volume.VolumeId, got)
+			}
+			if _, err := service.CreateSnapshot(context.Background(), &models.CreateK8sVolumeSnapshotSpec{K8sVolumeId: volume.VolumeId}); status.Code(err) != codes.InvalidArgument {
+				t.Errorf("CreateSnapshot() of a subdirectory error = %v, want %v", err, codes.InvalidArgument)
+			}
+
+			if err := service.DeleteVolume(context.Background(), volume.VolumeId); err != nil {
+				t.Fatalf("DeleteVolume() error = %v", err)
+			}
+			want := []string{`create ["/shared"] ["pvc-1"]`}
+			if onDelete == models.SubDirDelete {
+				want = append(want, `delete ["/shared/pvc-1"]`)
+			}
+			if len(fileRequests) != len(want) || fileRequests[0] != want[0] || fileRequests[len(fileRequests)-1] != want[len(want)-1] {
+				t.Errorf("File Station requests = %q, want %q", fileRequests, want)
+			}
+		})
+	}
+}
+
+func TestSubDirVolume_noParentShare(t *testing.T) {
+	var fileRequests []string
+	service := newSubDirService(t, &fileRequests)
+
+	spec := models.CreateK8sVolumeSpec{
+		K8sVolumeName: "pvc-1", Protocol: utils.ProtocolNfs, Size: utils.UNIT_GB,
+		ParentShare: "missing", SubDir: "pvc-1", SubDirOnDelete: models.SubDirDelete,
+	}
+	if _, err := service.CreateVolume(context.Background(), &spec); status.Code(err) != codes.FailedPrecondition {
+		t.Errorf("CreateVolume() error = %v, want %v", err, codes.FailedPrecondition)
+	}
+	if len(fileRequests) != 0 {
+		t.Errorf("File Station requests = %q, want none", fileRequests)
+	}
+}
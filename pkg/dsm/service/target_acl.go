@@ -0,0 +1,121 @@
+/*
+ * Copyright 2021 Synology Inc.
+ */
+
+package service
+
+import (
+	"context"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+// withAcl returns the ACLs with the one of iqn set to permission, and if they changed
+func withAcl(acls []webapi.TargetAcl, iqn string, permission string) ([]webapi.TargetAcl, bool) {
+	updated := []webapi.TargetAcl{}
+	for _, acl := range acls {
+		if acl.Iqn == iqn {
+			if acl.Permission == permission {
+				return acls, false
+			}
+			continue
+		}
+		updated = append(updated, acl)
+	}
+	return append(updated, webapi.TargetAcl{Iqn: iqn, Permission: permission}), true
+}
+
+// withoutAcl returns the ACLs without the one of iqn, or without any if iqn is empty, and if they changed
+func withoutAcl(acls []webapi.TargetAcl, iqn string) ([]webapi.TargetAcl, bool) {
+	updated := []webapi.TargetAcl{}
+	for _, acl := range acls {
+		if iqn != "" && acl.Iqn != iqn {
+			updated = append(updated, acl)
+		}
+	}
+	return updated, len(updated) != len(acls)
+}
+
+// updateTargetAcls applies update to the ACLs of the target of an iSCSI volume
+func (service *DsmService) updateTargetAcls(ctx context.Context, k8sVolume *models.K8sVolumeRespSpec,
+	update func([]webapi.TargetAcl) ([]webapi.TargetAcl, bool)) error {
+	if k8sVolume.Target.TargetId == 0 {
+		return status.Errorf(codes.FailedPrecondition, "Volume[%s] isn't mapped to a target", k8sVolume.VolumeId)
+	}
+	dsm, err := service.GetDsm(k8sVolume.DsmIp)
+	if err != nil {
+		return status.Errorf(codes.Internal, "Failed to get DSM[%s]", k8sVolume.DsmIp)
+	}
+
+	// the ACLs of a target are replaced as a whole, and a shared target has several volumes
+	service.targetAclMu.Lock()
+	defer service.targetAclMu.Unlock()
+
+	targetId := strconv.Itoa(k8sVolume.Target.TargetId)
+	target, err := dsm.TargetGet(ctx, targetId)
+	if err != nil {
+		return dsmError(err, "Failed to get target(%s) of volume[%s]", targetId, k8sVolume.VolumeId)
+	}
+	acls, changed := update(target.Acls)
+	if !changed {
+		return nil
+	}
+	if err := dsm.TargetSetAcls(ctx, targetId, acls); err != nil {
+		return dsmError(err, "Failed to set the ACLs of target(%s) of volume[%s]", targetId, k8sVolume.VolumeId)
+	}
+	return nil
+}
+
+// PublishVolume allows the initiator iqn to log into the target of an iSCSI volume, read-only
+// if readonly is set. Shares have no target and are left unchanged.
+func (service *DsmService) PublishVolume(ctx context.Context, volId string, iqn string, readonly bool) error {
+	k8sVolume := service.GetVolume(ctx, volId)
+	if k8sVolume == nil {
+		return status.Errorf(codes.NotFound, "Volume[%s] does not exist", volId)
+	}
+	if k8sVolume.Protocol != utils.ProtocolIscsi {
+		return nil
+	}
+
+	// the other LUNs of a shared target may be published read-write to the same node
+	permission := webapi.TargetPermissionRw
+	if _, shared := sharedTargetIndex(k8sVolume.Target.Name); readonly && !shared {
+		permission = webapi.TargetPermissionRo
+	}
+	if err := service.updateTargetAcls(ctx, k8sVolume, func(acls []webapi.TargetAcl) ([]webapi.TargetAcl, bool) {
+		return withAcl(acls, iqn, permission)
+	}); err != nil {
+		return err
+	}
+	log.WithContext(ctx).Infof("[%s] Allowed initiator %s to log into target %s (%s)", k8sVolume.DsmIp, iqn, k8sVolume.Target.Name, permission)
+	return nil
+}
+
+// UnpublishVolume removes the initiator iqn from the ACLs of the target of an iSCSI volume,
+// or every initiator if iqn is empty. A volume which no longer exists is unpublished already.
+func (service *DsmService) UnpublishVolume(ctx context.Context, volId string, iqn string) error {
+	k8sVolume := service.GetVolume(ctx, volId)
+	if k8sVolume == nil || k8sVolume.Protocol != utils.ProtocolIscsi || k8sVolume.Target.TargetId == 0 {
+		return nil
+	}
+	// the initiators of a shared target may use its other LUNs
+	if _, shared := sharedTargetIndex(k8sVolume.Target.Name); shared && iqn == "" {
+		log.WithContext(ctx).Warnf("[%s] Keeping the ACLs of shared target %s, unpublishing volume[%s] from any node", k8sVolume.DsmIp, k8sVolume.Target.Name, volId)
+		return nil
+	}
+
+	if err := service.updateTargetAcls(ctx, k8sVolume, func(acls []webapi.TargetAcl) ([]webapi.TargetAcl, bool) {
+		return withoutAcl(acls, iqn)
+	}); err != nil {
+		return err
+	}
+	log.WithContext(ctx).Infof("[%s] Removed initiator %s from target %s", k8sVolume.DsmIp, iqn, k8sVolume.Target.Name)
+	return nil
+}
@@ -0,0 +1,127 @@
+package service
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+)
+
+const (
+	node1Iqn = "iqn.1993-08.org.debian:01:node1"
+	node2Iqn = "iqn.1993-08.org.debian:01:node2"
+)
+
+func TestPublishVolume_targetAcls(t *testing.T) {
+	fake := &fakeTargetDsm{
+		targets: []*webapi.TargetInfo{
+			{Name: "k8s-csi-pvc-1", TargetId: 1, MappedLuns: []webapi.MappedLun{{LunUuid: "lun-1"}}},
+			{Name: "k8s-csi_shared-1", TargetId: 2, MappedLuns: []webapi.MappedLun{{LunUuid: "lun-2"}, {LunUuid: "lun-3"}}},
+		},
+		luns: []webapi.LunInfo{{Name: "k8s-csi-pvc-1", Uuid: "lun-1"}, {Name: "k8s-csi-pvc-2", Uuid: "lun-2"}, {Name: "k8s-csi-pvc-3", Uuid: "lun-3"}},
+	}
+	service, _ := newFakeTargetService(t, fake, 2)
+	ctx := context.Background()
+
+	steps := []struct {
+		name      string
+		do        func() error
+		target    string
+		wantAcls  []webapi.TargetAcl
+		wantSets  int // Target.set requests sent so far
+		wantError codes.Code
+	}{
+		{
+			name:     "publish",
+			do:       func() error { return service.PublishVolume(ctx, "lun-1", node1Iqn, false) },
+			target:   "1",
+			wantAcls: []webapi.TargetAcl{{Iqn: node1Iqn, Permission: "rw"}},
+			wantSets: 1,
+		},
+		{
+			name:     "already published",
+			do:       func() error { return service.PublishVolume(ctx, "lun-1", node1Iqn, false) },
+			target:   "1",
+			wantAcls: []webapi.TargetAcl{{Iqn: node1Iqn, Permission: "rw"}},
+			wantSets: 1,
+		},
+		{
+			name:     "another node, read-only",
+			do:       func() error { return service.PublishVolume(ctx, "lun-1", node2Iqn, true) },
+			target:   "1",
+			wantAcls: []webapi.TargetAcl{{Iqn: node1Iqn, Permission: "rw"}, {Iqn: node2Iqn, Permission: "ro"}},
+			wantSets: 2,
+		},
+		{
+			name:     "unpublish",
+			do:       func() error { return service.UnpublishVolume(ctx, "lun-1", node1Iqn) },
+			target:   "1",
+			wantAcls: []webapi.TargetAcl{{Iqn: node2Iqn, Permission: "ro"}},
+			wantSets: 3,
+		},
+		{
+			name:     "already unpublished",
+			do:       func() error { return service.UnpublishVolume(ctx, "lun-1", node1Iqn) },
+			target:   "1",
+			wantAcls: []webapi.TargetAcl{{Iqn: node2Iqn, Permission: "ro"}},
+			wantSets: 3,
+		},
+		{
+			name:     "unpublish a deleted volume",
+			do:       func() error { return service.UnpublishVolume(ctx, "lun-gone", node1Iqn) },
+			target:   "1",
+			wantAcls: []webapi.TargetAcl{{Iqn: node2Iqn, Permission: "ro"}},
+			wantSets: 3,
+		},
+		{
+			name:     "shared target stays read-write",
+			do:       func() error { return service.PublishVolume(ctx, "lun-2", node1Iqn, true) },
+			target:   "2",
+			wantAcls: []webapi.TargetAcl{{Iqn: node1Iqn, Permission: "rw"}},
+			wantSets: 4,
+		},
+		{
+			name:     "shared target kept when unpublished from any node",
+			do:       func() error { return service.UnpublishVolume(ctx, "lun-2", "") },
+			target:   "2",
+			wantAcls: []webapi.TargetAcl{{Iqn: node1Iqn, Permission: "rw"}},
+			wantSets: 4,
+		},
+		{
+			name:     "unpublish from any node",
+			do:       func() error { return service.UnpublishVolume(ctx, "lun-1", "") },
+			target:   "1",
+			wantAcls: nil,
+			wantSets: 5,
+		},
+		{
+			name:      "publish a deleted volume",
+			do:        func() error { return service.PublishVolume(ctx, "lun-gone", node1Iqn, false) },
+			target:    "1",
+			wantSets:  5,
+			wantError: codes.NotFound,
+		},
+	}
+	for _, step := range steps {
+		if code := status.Code(step.do()); code != step.wantError {
+			t.Fatalf("%s: code = %v, want %v", step.name, code, step.wantError)
+		}
+		if got := fake.target(step.target).Acls; len(got)+len(step.wantAcls) > 0 && !reflect.DeepEqual(got, step.wantAcls) {
+			t.Errorf("%s: ACLs of target %s = %v, want %v", step.name, step.target, got, step.wantAcls)
+		}
+		sets := 0
+		for _, method := range fake.methods {
+			if strings.HasSuffix(method, "Target.set") {
+				sets++
+			}
+		}
+		if sets != step.wantSets {
+			t.Errorf("%s: sent %d Target.set, want %d", step.name, sets, step.wantSets)
+		}
+	}
+}
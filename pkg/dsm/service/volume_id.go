@@ -0,0 +1,47 @@
+/*
+ * Copyright 2021 Synology Inc.
+ */
+
+package service
+
+import (
+	log "github.com/sirupsen/logrus"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+// VolumeIdVersion is the version of the IDs given to the volumes. Volumes are found by
+// the IDs of every version, so it can be changed without stranding the existing volumes.
+var VolumeIdVersion = models.VolumeIdV0
+
+// k8sVolumeId returns the ID of the LUN or share of uuid in VolumeIdVersion
+func k8sVolumeId(dsmIp string, protocol string, uuid string) string {
+	spec := models.VolumeIdSpec{Version: VolumeIdVersion, Type: volumeIdType(protocol), Uuid: uuid, DsmIp: dsmIp}
+	id, err := models.EncodeVolumeID(spec)
+	if err != nil {
+		log.Errorf("Failed to encode the ID of volume %s, using its UUID: %v", uuid, err)
+		return uuid
+	}
+	return id
+}
+
+func volumeIdType(protocol string) string {
+	if protocol == utils.ProtocolIscsi {
+		return models.VolumeIdTypeLun
+	}
+	return models.VolumeIdTypeShare
+}
+
+// volumeUuid returns the UUID of the LUN or share of a volume
+func volumeUuid(volume *models.K8sVolumeRespSpec) string {
+	if volume.Protocol == utils.ProtocolIscsi {
+		return volume.Lun.Uuid
+	}
+	return volume.Share.Uuid
+}
+
+// volumeIdSpec returns what the volume is known by in its IDs
+func volumeIdSpec(volume *models.K8sVolumeRespSpec) models.VolumeIdSpec {
+	return models.VolumeIdSpec{Type: volumeIdType(volume.Protocol), Uuid: volumeUuid(volume), DsmIp: volume.DsmIp}
+}
@@ -0,0 +1,46 @@
+package service
+
+import (
+	"context"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+	"github.com/SynologyOpenSource/synology-csi/pkg/models"
+)
+
+func TestGetVolume_versionedIds(t *testing.T) {
+	defer func(version int) { VolumeIdVersion = version }(VolumeIdVersion)
+
+	fake := &fakeIscsiDsm{lunExists: true, mapped: true}
+	server := httptest.NewServer(fake)
+	defer server.Close()
+	host, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	p, _ := strconv.Atoi(port)
+	service := NewDsmService()
+	service.dsms[host] = &webapi.DSM{Ip: host, Port: p}
+
+	v1Id := "v1:lun:lun-uuid:" + host
+	for _, version := range []int{models.VolumeIdV0, models.VolumeIdV1} {
+		VolumeIdVersion = version
+		wantId := map[int]string{models.VolumeIdV0: "lun-uuid", models.VolumeIdV1: v1Id}[version]
+
+		// the volumes created by the older drivers keep being found
+		for _, id := range []string{"lun-uuid", v1Id} {
+			volume := service.GetVolume(context.Background(), id)
+			if volume == nil {
+				t.Fatalf("GetVolume(%q) with IDs v%d = nil", id, version)
+			}
+			if volume.VolumeId != wantId {
+				t.Errorf("GetVolume(%q) with IDs v%d has ID %q, want %q", id, version, volume.VolumeId, wantId)
+			}
+		}
+		for _, id := range []string{"v1:lun:lun-uuid:10.0.0.99", "v1:share:lun-uuid:" + host, "v9:lun:lun-uuid:" + host} {
+			if volume := service.GetVolume(context.Background(), id); volume != nil {
+				t.Errorf("GetVolume(%q) with IDs v%d = %+v, want nil", id, version, volume)
+			}
+		}
+	}
+}
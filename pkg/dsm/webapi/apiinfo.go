@@ -0,0 +1,110 @@
+/*
+ * Copyright 2021 Synology Inc.
+ */
+
+package webapi
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+// ApiInfo is the range of versions DSM supports for an API
+type ApiInfo struct {
+	MinVersion int    `json:"minVersion"`
+	MaxVersion int    `json:"maxVersion"`
+	Path       string `json:"path"`
+}
+
+// compatibleVersions are the versions of an API the requests of the driver also work with.
+// A request is sent with the version it asks for if DSM supports it, or else with the
+// highest newer compatible version DSM supports.
+var compatibleVersions = map[string][]int{
+	"SYNO.API.Auth": {3, 6, 7},
+}
+
+// ApiInfoQuery returns the versions DSM supports for each of its APIs
+func (dsm *DSM) ApiInfoQuery(ctx context.Context) (map[string]ApiInfo, error) {
+	params := url.Values{}
+	params.Add("api", "SYNO.API.Info")
+	params.Add("method", "query")
+	params.Add("version", "1")
+	params.Add("query", "all")
+
+	infos := map[string]ApiInfo{}
+	resp, err := dsm.sendRequestWithoutConnectionCheck(ctx, "", &infos, params, "webapi/query.cgi")
+	if err != nil {
+		return nil, err
+	}
+
+	apiInfos, ok := resp.Data.(*map[string]ApiInfo)
+	if !ok {
+		return nil, fmt.Errorf("Failed to assert response to %T", &infos)
+	}
+	return *apiInfos, nil
+}
+
+// loadApiInfo caches the versions of the APIs of DSM, requests are sent unchanged if it fails
+func (dsm *DSM) loadApiInfo(ctx context.Context) {
+	infos, err := dsm.ApiInfoQuery(ctx)
+	if err != nil {
+		log.WithContext(ctx).Warnf("[%s] Failed to query the API versions of DSM, sending the default ones: %v", dsm.Ip, err)
+		return
+	}
+
+	dsm.apiInfoMu.Lock()
+	defer dsm.apiInfoMu.Unlock()
+	dsm.apiInfo = infos
+}
+
+func (dsm *DSM) hasApiInfo() bool {
+	dsm.apiInfoMu.RLock()
+	defer dsm.apiInfoMu.RUnlock()
+	return dsm.apiInfo != nil
+}
+
+// negotiateVersion returns params with a version of the API DSM supports. APIs DSM didn't
+// tell about are sent as they are.
+func (dsm *DSM) negotiateVersion(params url.Values) (url.Values, error) {
+	api := params.Get("api")
+	version, err := strconv.Atoi(params.Get("version"))
+	if err != nil {
+		return params, nil
+	}
+
+	dsm.apiInfoMu.RLock()
+	info, ok := dsm.apiInfo[api]
+	dsm.apiInfoMu.RUnlock()
+	if !ok || (version >= info.MinVersion && version <= info.MaxVersion) {
+		return params, nil
+	}
+
+	candidates := []int{version}
+	chosen := 0
+	for _, v := range compatibleVersions[api] {
+		if v <= version {
+			continue
+		}
+		candidates = append(candidates, v)
+		if v >= info.MinVersion && v <= info.MaxVersion && v > chosen {
+			chosen = v
+		}
+	}
+	if chosen == 0 {
+		return nil, utils.ApiVersionError{Api: api, Versions: candidates, MinVersion: info.MinVersion, MaxVersion: info.MaxVersion}
+	}
+
+	negotiated := url.Values{}
+	for key, values := range params {
+		negotiated[key] = values
+	}
+	negotiated.Set("version", strconv.Itoa(chosen))
+	log.Debugf("[%s] Sending version %d of %s instead of %d", dsm.Ip, chosen, api, version)
+	return negotiated, nil
+}
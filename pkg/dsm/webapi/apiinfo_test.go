@@ -0,0 +1,93 @@
+package webapi
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"sync"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+func TestNegotiateVersion(t *testing.T) {
+	var mu sync.Mutex
+	sent := map[string][]string{} // API => versions sent
+	queries := 0
+	dsm := newTestDSM(t, func(params url.Values) (interface{}, int) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		api := params.Get("api")
+		sent[api] = append(sent[api], params.Get("version"))
+		switch api {
+		case "SYNO.API.Info":
+			queries++
+			return map[string]ApiInfo{
+				"SYNO.API.Auth":       {MinVersion: 6, MaxVersion: 7, Path: "auth.cgi"},
+				"SYNO.Core.ISCSI.LUN": {MinVersion: 1, MaxVersion: 1, Path: "entry.cgi"},
+				"SYNO.Core.Share":     {MinVersion: 2, MaxVersion: 3, Path: "entry.cgi"},
+			}, 0
+		case "SYNO.API.Auth":
+			return map[string]string{"sid": "sid"}, 0
+		case "SYNO.Core.Network.Interface":
+			return []NetworkInterface{}, 0
+		}
+		return map[string]interface{}{}, 0
+	})
+
+	for i := 0; i < 2; i++ {
+		if err := dsm.Login(context.Background()); err != nil {
+			t.Fatalf("Login() error = %v", err)
+		}
+	}
+	if queries != 1 {
+		t.Errorf("SYNO.API.Info queried %d times for 2 logins, want 1", queries)
+	}
+
+	if _, err := dsm.LunList(context.Background()); err != nil {
+		t.Fatalf("LunList() error = %v", err)
+	}
+	if _, err := dsm.NetworkInterfaceList(context.Background(), ""); err != nil {
+		t.Fatalf("NetworkInterfaceList() error = %v", err)
+	}
+
+	_, err := dsm.ShareList(context.Background())
+	var versionErr utils.ApiVersionError
+	if !errors.As(err, &versionErr) || versionErr.Api != "SYNO.Core.Share" || versionErr.MinVersion != 2 || versionErr.MaxVersion != 3 {
+		t.Errorf("ShareList() error = %v, want the unsupported versions of SYNO.Core.Share", err)
+	}
+	if code := status.Code(err); code != codes.FailedPrecondition {
+		t.Errorf("ShareList() code = %v, want %v", code, codes.FailedPrecondition)
+	}
+
+	want := map[string][]string{
+		"SYNO.API.Info": {"1"},
+		// no longer supported version 3 is upgraded to the highest compatible one
+		"SYNO.API.Auth":       {"7", "7"},
+		"SYNO.Core.ISCSI.LUN": {"1"},
+		// APIs missing from SYNO.API.Info are sent as they are
+		"SYNO.Core.Network.Interface": {"1"},
+	}
+	for api, versions := range want {
+		if got := sent[api]; len(got) != len(versions) || (len(got) > 0 && got[0] != versions[0]) {
+			t.Errorf("%s sent with versions %v, want %v", api, got, versions)
+		}
+	}
+	if got := sent["SYNO.Core.Share"]; len(got) != 0 {
+		t.Errorf("SYNO.Core.Share sent with versions %v, want no request", got)
+	}
+}
+
+func TestNegotiateVersion_unknownApis(t *testing.T) {
+	dsm := &DSM{Ip: "10.0.0.1"}
+	params := url.Values{"api": {"SYNO.Core.Share"}, "version": {"1"}}
+
+	got, err := dsm.negotiateVersion(params)
+	if err != nil || got.Get("version") != "1" {
+		t.Errorf("negotiateVersion() = %v, %v without API info, want version 1", got, err)
+	}
+}
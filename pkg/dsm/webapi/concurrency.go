@@ -0,0 +1,55 @@
+/*
+ * Copyright 2021 Synology Inc.
+ */
+
+package webapi
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+// DefaultMaxConcurrentRequests caps the requests in flight to a DSM whose MaxConcurrentRequests isn't set
+var DefaultMaxConcurrentRequests = 8
+
+// maxConcurrentRequests returns the number of requests that can be in flight to the DSM at once
+func (dsm *DSM) maxConcurrentRequests() int {
+	if dsm.MaxConcurrentRequests > 0 {
+		return dsm.MaxConcurrentRequests
+	}
+	return DefaultMaxConcurrentRequests
+}
+
+// acquireSlot waits until fewer than maxConcurrentRequests requests are in flight to the
+// DSM, or until ctx is done. The returned func releases the slot.
+func (dsm *DSM) acquireSlot(ctx context.Context, params url.Values) (func(), error) {
+	api, method := params.Get("api"), params.Get("method")
+	dsm.slotsOnce.Do(func() {
+		dsm.slots = make(chan struct{}, dsm.maxConcurrentRequests())
+	})
+
+	select {
+	case dsm.slots <- struct{}{}:
+		return func() { <-dsm.slots }, nil
+	default:
+	}
+
+	requestsQueued.WithLabelValues(api, method).Inc()
+	defer requestsQueued.WithLabelValues(api, method).Dec()
+	select {
+	case dsm.slots <- struct{}{}:
+		return func() { <-dsm.slots }, nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("Request %s of %s to DSM [%s] aborted while queued: %w", method, api, dsm.Ip, ctx.Err())
+	}
+}
+
+// newTransport returns the transport of the DSM, keeping as many idle connections as
+// requests can be in flight so that they are reused rather than reopened
+func (dsm *DSM) newTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = dsm.maxConcurrentRequests()
+	return transport
+}
@@ -0,0 +1,91 @@
+package webapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSendRequest_maxConcurrentRequests(t *testing.T) {
+	const limit, requests = 2, 6
+
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	arrived := make(chan struct{}, requests)
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		arrived <- struct{}{}
+
+		<-unblock
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "data": map[string]interface{}{"luns": []LunInfo{}}})
+	}))
+	dsm := newServerDSM(t, server)
+	dsm.MaxConcurrentRequests = limit
+
+	var wg sync.WaitGroup
+	errs := make(chan error, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := dsm.LunList(context.Background())
+			errs <- err
+		}()
+	}
+
+	// the server holds the first requests, the others have to be queued
+	for i := 0; i < limit; i++ {
+		<-arrived
+	}
+	select {
+	case <-arrived:
+		t.Fatalf("more than %d requests reached the server at once", limit)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	close(unblock)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Errorf("LunList() error = %v", err)
+		}
+	}
+	if maxInFlight != limit {
+		t.Errorf("%d requests in flight at most, want %d", maxInFlight, limit)
+	}
+}
+
+func TestSendRequest_queuedRequestCanceled(t *testing.T) {
+	unblock := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "data": map[string]interface{}{"luns": []LunInfo{}}})
+	}))
+	defer close(unblock)
+	dsm := newServerDSM(t, server)
+	dsm.MaxConcurrentRequests = 1
+
+	go dsm.LunList(context.Background())
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := dsm.LunList(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("LunList() error = %v, want %v while queued", err, context.DeadlineExceeded)
+	}
+}
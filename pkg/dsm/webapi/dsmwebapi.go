@@ -5,15 +5,20 @@
 package webapi
 
 import (
-	"crypto/tls"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"regexp"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/SynologyOpenSource/synology-csi/pkg/logger"
+	"github.com/SynologyOpenSource/synology-csi/pkg/tracing"
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -25,8 +30,46 @@ type DSM struct {
 	Sid        string
 	Https      bool
 	Controller string //new
+	// OtpCode and DeviceId authenticate accounts with 2-factor authentication,
+	// Login replaces an OTP code by the device token DSM returns for it
+	OtpCode  string
+	DeviceId string
+	TLS      TLSOptions
+	Proxy    ProxyOptions
+	// Site is the topology segment of the DSM, empty if it is reachable from every node
+	Site string
+	// Profile is the credential profile the DSM is logged into with, chosen by StorageClasses
+	Profile string
+	// MaxConcurrentRequests caps the requests in flight to the DSM, the others wait for
+	// their turn. DefaultMaxConcurrentRequests is used if it isn't set.
+	MaxConcurrentRequests int
+	// Headers are sent with every request, e.g. for a reverse proxy in front of the DSM
+	Headers map[string]string
+	// Transport tells where the connections to DSM are opened, Dialer opens them instead
+	// if it is set
+	Transport TransportOptions
+	Dialer    Dialer
+
+	client     *http.Client
+	clientErr  error
+	clientOnce sync.Once
+
+	// slots holds a token for each request in flight
+	slots     chan struct{}
+	slotsOnce sync.Once
+
+	// sidMu guards Sid, loginMu serializes re-logins after the session expired
+	sidMu   sync.RWMutex
+	loginMu sync.Mutex
+
+	// apiInfo caches the versions of the APIs of DSM, queried at the first login
+	apiInfo   map[string]ApiInfo
+	apiInfoMu sync.RWMutex
 }
 
+// RequestIdHeader carries the correlation ID of the CSI call a request to DSM is sent for
+const RequestIdHeader = "X-Request-Id"
+
 type errData struct {
 	Code int `json:"code"`
 }
@@ -43,34 +86,116 @@ type Response struct {
 	Data       interface{}
 }
 
-func (dsm *DSM) sendRequest(data string, apiTemplate interface{}, params url.Values, cgiPath string) (Response, error) {
-	resp, err := dsm.sendRequestWithoutConnectionCheck(data, apiTemplate, params, cgiPath)
-	if err != nil && (resp.ErrorCode == 105 || resp.ErrorCode == 106 || resp.ErrorCode == 119) { // 105: WEBAPI_ERR_NO_PERMISSION, 106: session timeout, 119: WEBAPI_ERR_SID_NOT_FOUND
-		// Re-login
-		if err := dsm.Login(); err != nil {
+func (dsm *DSM) sendRequest(ctx context.Context, data string, apiTemplate interface{}, params url.Values, cgiPath string) (Response, error) {
+	sid := dsm.sid()
+	resp, err := dsm.sendRequestWithoutConnectionCheck(ctx, data, apiTemplate, params, cgiPath)
+	if err != nil && isSessionError(resp.ErrorCode) {
+		if err := dsm.relogin(ctx, sid); err != nil {
 			return Response{}, fmt.Errorf("Failed to re-login to DSM: [%s]. err: %v", dsm.Ip, err)
 		}
-		log.Info("Re-login succeeded.")
-		return dsm.sendRequestWithoutConnectionCheck(data, apiTemplate, params, cgiPath)
+		return dsm.sendRequestWithoutConnectionCheck(ctx, data, apiTemplate, params, cgiPath)
 	}
 
 	return resp, err
 }
 
-func (dsm *DSM) sendRequestWithoutConnectionCheck(data string, apiTemplate interface{}, params url.Values, cgiPath string) (Response, error) {
-	client := &http.Client{}
+// isSessionError tells if the DSM error code means the session has to be renewed
+func isSessionError(code int) bool {
+	// 105: WEBAPI_ERR_NO_PERMISSION, 106: session timeout, 119: WEBAPI_ERR_SID_NOT_FOUND
+	return code == 105 || code == 106 || code == 119
+}
+
+func (dsm *DSM) sid() string {
+	dsm.sidMu.RLock()
+	defer dsm.sidMu.RUnlock()
+	return dsm.Sid
+}
+
+func (dsm *DSM) setSid(sid string) {
+	dsm.sidMu.Lock()
+	defer dsm.sidMu.Unlock()
+	dsm.Sid = sid
+}
+
+// relogin renews the session that failed with staleSid. Requests failing together
+// wait for a single login, the ones arriving after it reuse the new session.
+func (dsm *DSM) relogin(ctx context.Context, staleSid string) error {
+	dsm.loginMu.Lock()
+	defer dsm.loginMu.Unlock()
+
+	if dsm.sid() != staleSid {
+		return nil
+	}
+	if err := dsm.Login(ctx); err != nil {
+		return err
+	}
+	log.WithContext(ctx).Info("Re-login succeeded.")
+	return nil
+}
+
+// jsonPasswordRe matches the password fields of the JSON values of params, e.g. the
+// passphrase of an encrypted share in shareinfo
+var jsonPasswordRe = regexp.MustCompile(`("[a-z_]*passw[a-z_]*"\s*:\s*)"(?:[^"\\]|\\.)*"`)
+
+// redactedQuery encodes params for logging with the values of passwords and tokens masked
+func redactedQuery(params url.Values) string {
+	redacted := url.Values{}
+	for key, values := range params {
+		if strings.Contains(strings.ToLower(key), "passw") || key == "otp_code" || key == "device_id" {
+			values = []string{"***"}
+		} else {
+			masked := make([]string, 0, len(values))
+			for _, value := range values {
+				masked = append(masked, jsonPasswordRe.ReplaceAllString(value, `$1"***"`))
+			}
+			values = masked
+		}
+		redacted[key] = values
+	}
+	return redacted.Encode()
+}
+
+func (dsm *DSM) sendRequestWithoutConnectionCheck(ctx context.Context, data string, apiTemplate interface{}, params url.Values, cgiPath string) (resp Response, err error) {
+	ctx, span := tracing.Start(ctx, params.Get("api")+" "+params.Get("method"),
+		tracing.AttrDsmHost.String(dsm.Ip), tracing.AttrDsmApi.String(params.Get("api")), tracing.AttrDsmMethod.String(params.Get("method")))
+	defer func() {
+		if resp.ErrorCode != 0 {
+			span.SetAttributes(tracing.AttrDsmError.Int(resp.ErrorCode))
+		}
+		tracing.End(span, err)
+	}()
+
+	params, err = dsm.negotiateVersion(params)
+	if err != nil {
+		return Response{}, err
+	}
+
+	return Retry.do(ctx, params, func() (Response, error) {
+		release, err := dsm.acquireSlot(ctx, params)
+		if err != nil {
+			return Response{}, err
+		}
+		defer release()
+
+		start := time.Now()
+		resp, err := dsm.doRequest(ctx, data, apiTemplate, params, cgiPath)
+		observeRequest(params, time.Since(start), resp, err)
+		log.WithContext(ctx).Debugf("Request %s of %s to DSM [%s] took %v", params.Get("method"), params.Get("api"), dsm.Ip, time.Since(start))
+		return resp, err
+	})
+}
+
+func (dsm *DSM) doRequest(ctx context.Context, data string, apiTemplate interface{}, params url.Values, cgiPath string) (Response, error) {
 	var req *http.Request
-	var err error
 	var cgiUrl string
 
+	client, err := dsm.httpClient()
+	if err != nil {
+		return Response{}, err
+	}
+
 	// Ex: http://10.12.12.14:5000/webapi/auth.cgi
 	if dsm.Https {
-		// TODO: input CA certificate and fill in tls config
-		// Skip Verify when https
-		tr := &http.Transport{
-			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
-		}
-		client = &http.Client{Transport: tr}
 		cgiUrl = fmt.Sprintf("https://%s:%d/%s", dsm.Ip, dsm.Port, cgiPath)
 	} else {
 		cgiUrl = fmt.Sprintf("http://%s:%d/%s", dsm.Ip, dsm.Port, cgiPath)
@@ -84,22 +209,39 @@ func (dsm *DSM) sendRequestWithoutConnectionCheck(data string, apiTemplate inter
 	baseUrl.RawQuery = params.Encode()
 
 	if logger.WebapiDebug {
-		log.Debugln(baseUrl.RawQuery)
+		log.WithContext(ctx).Debugln(redactedQuery(params))
 	}
 
 	if data != "" {
-		req, err = http.NewRequest("POST", baseUrl.String(), nil)
+		req, err = http.NewRequestWithContext(ctx, "POST", baseUrl.String(), nil)
 	} else {
-		req, err = http.NewRequest("GET", baseUrl.String(), nil)
+		req, err = http.NewRequestWithContext(ctx, "GET", baseUrl.String(), nil)
+	}
+	if err != nil {
+		return Response{}, err
 	}
 
-	if dsm.Sid != "" {
-		cookie := http.Cookie{Name: "id", Value: dsm.Sid}
+	dsm.setHeaders(req)
+	if sid := dsm.sid(); sid != "" {
+		cookie := http.Cookie{Name: "id", Value: sid}
 		req.AddCookie(&cookie)
 	}
+	// DSM ignores it, but proxies in front of it can log it
+	if id := logger.RequestId(ctx); id != "" {
+		req.Header.Set(RequestIdHeader, id)
+	}
+	if logger.WebapiDebug && len(req.Header) > 0 {
+		log.WithContext(ctx).Debugln(redactedHeaders(req.Header))
+	}
 
 	resp, err := client.Do(req)
 	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return Response{}, fmt.Errorf("Request %s of %s to DSM [%s] aborted: %w", params.Get("method"), params.Get("api"), dsm.Ip, ctxErr)
+		}
+		if urlErr, ok := err.(*url.Error); ok {
+			urlErr.URL = cgiUrl + "?" + redactedQuery(params)
+		}
 		return Response{}, err
 	}
 	defer resp.Body.Close()
@@ -112,11 +254,11 @@ func (dsm *DSM) sendRequestWithoutConnectionCheck(data string, apiTemplate inter
 			return Response{}, err
 		}
 		s := string(bodyText)
-		log.Debugln(s)
+		log.WithContext(ctx).Debugln(s)
 	}
 
 	if resp.StatusCode != 200 && resp.StatusCode != 302 {
-		return Response{}, fmt.Errorf("Bad response status code: %d", resp.StatusCode)
+		return Response{StatusCode: resp.StatusCode}, fmt.Errorf("Bad response status code: %d", resp.StatusCode)
 	}
 
 	// Strip data json data from response
@@ -144,7 +286,7 @@ func (dsm *DSM) sendRequestWithoutConnectionCheck(data string, apiTemplate inter
 	outResp.StatusCode = resp.StatusCode
 
 	if !e.Success {
-		return outResp, fmt.Errorf("DSM Api error. Error code:%d", outResp.ErrorCode)
+		return outResp, utils.DsmError{Code: outResp.ErrorCode}
 	}
 
 	if e.Data != nil {
@@ -162,8 +304,17 @@ func (dsm *DSM) sendRequestWithoutConnectionCheck(data string, apiTemplate inter
 	return outResp, nil
 }
 
-// Login by given user name and password
-func (dsm *DSM) Login() error {
+// DSM error codes of SYNO.API.Auth for accounts with 2-factor authentication
+const (
+	authErrOtpRequired = 403
+	authErrOtpInvalid  = 404
+	authErrOtpEnforced = 406
+)
+
+// deviceName identifies the driver in the trusted devices of the DSM account
+const deviceName = "synology-csi"
+
+func (dsm *DSM) loginParams() url.Values {
 	params := url.Values{}
 	params.Add("api", "SYNO.API.Auth")
 	params.Add("method", "login")
@@ -172,12 +323,44 @@ func (dsm *DSM) Login() error {
 	params.Add("passwd", dsm.Password)
 	params.Add("format", "sid")
 
+	// device tokens need version 6 of SYNO.API.Auth
+	if dsm.DeviceId != "" || dsm.OtpCode != "" {
+		params.Set("version", "6")
+	}
+	if dsm.DeviceId != "" {
+		params.Add("device_id", dsm.DeviceId)
+		params.Add("device_name", deviceName)
+	} else if dsm.OtpCode != "" {
+		params.Add("otp_code", dsm.OtpCode)
+		params.Add("enable_device_token", "yes")
+		params.Add("device_name", deviceName)
+	}
+	return params
+}
+
+// Login by given user name and password
+func (dsm *DSM) Login(ctx context.Context) error {
 	type LoginResp struct {
 		Sid string `json:"sid"`
+		Did string `json:"did"`
+	}
+
+	if !dsm.hasApiInfo() {
+		dsm.loadApiInfo(ctx)
 	}
 
-	resp, err := dsm.sendRequestWithoutConnectionCheck("", &LoginResp{}, params, "webapi/auth.cgi")
+	resp, err := dsm.sendRequestWithoutConnectionCheck(ctx, "", &LoginResp{}, dsm.loginParams(), "webapi/auth.cgi")
 	if err != nil {
+		switch resp.ErrorCode {
+		case authErrOtpRequired, authErrOtpEnforced:
+			if dsm.OtpCode == "" && dsm.DeviceId == "" {
+				return fmt.Errorf("DSM account %s requires 2-factor authentication, but no OTP code is configured", dsm.Username)
+			}
+			return fmt.Errorf("DSM rejected the device token of account %s, a new OTP code is required", dsm.Username)
+		case authErrOtpInvalid:
+			return fmt.Errorf("DSM rejected the OTP code of account %s", dsm.Username)
+		}
+
 		r, _ := regexp.Compile("passwd=.*&")
 		temp := r.ReplaceAllString(err.Error(), "")
 
@@ -188,23 +371,29 @@ func (dsm *DSM) Login() error {
 	if !ok {
 		return fmt.Errorf("Failed to assert response to %T", &LoginResp{})
 	}
-	dsm.Sid = loginResp.Sid
+	dsm.setSid(loginResp.Sid)
+
+	if loginResp.Did != "" {
+		// an OTP code is only valid once, re-login with the trusted device instead
+		dsm.DeviceId = loginResp.Did
+		dsm.OtpCode = ""
+	}
 
 	return nil
 }
 
 // Logout on current IP and reset the synoToken
-func (dsm *DSM) Logout() error {
+func (dsm *DSM) Logout(ctx context.Context) error {
 	params := url.Values{}
 	params.Add("api", "SYNO.API.Auth")
 	params.Add("method", "logout")
 	params.Add("version", "1")
 
-	_, err := dsm.sendRequestWithoutConnectionCheck("", &struct{}{}, params, "webapi/entry.cgi")
+	_, err := dsm.sendRequestWithoutConnectionCheck(ctx, "", &struct{}{}, params, "webapi/entry.cgi")
 	if err != nil {
 		return err
 	}
-	dsm.Sid = ""
+	dsm.setSid("")
 
 	return nil
 }
@@ -0,0 +1,373 @@
+package webapi
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestDSM returns a DSM backed by an HTTP server that answers every request
+// with handler's data. A nil data with a non-zero code produces an API error.
+func newTestDSM(t *testing.T, handler func(params url.Values) (data interface{}, code int)) *DSM {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, code := handler(r.URL.Query())
+		resp := map[string]interface{}{"success": code == 0}
+		if code != 0 {
+			resp["error"] = map[string]int{"code": code}
+		} else if data != nil {
+			resp["data"] = data
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	return newServerDSM(t, server)
+}
+
+// newServerDSM returns a DSM sending its requests to server
+func newServerDSM(t *testing.T, server *httptest.Server) *DSM {
+	t.Helper()
+	t.Cleanup(server.Close)
+
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to parse test server address: %v", err)
+	}
+	p, _ := strconv.Atoi(port)
+
+	return &DSM{Ip: host, Port: p, Sid: "test-sid"}
+}
+
+func TestSnapshotLockSet(t *testing.T) {
+	var got url.Values
+	dsm := newTestDSM(t, func(params url.Values) (interface{}, int) {
+		got = params
+		return nil, 0
+	})
+
+	if err := dsm.SnapshotLockSet(context.Background(), "snap-uuid", false); err != nil {
+		t.Fatalf("SnapshotLockSet() error = %v", err)
+	}
+	if got.Get("method") != "set_snapshot" || got.Get("snapshot_uuid") != `"snap-uuid"` || got.Get("is_locked") != "false" {
+		t.Errorf("SnapshotLockSet() params = %v", got)
+	}
+
+	if err := dsm.ShareSnapshotLockSet(context.Background(), "GMT+08-2022.01.14-19.18.29", "k8s-csi-pvc", false); err != nil {
+		t.Fatalf("ShareSnapshotLockSet() error = %v", err)
+	}
+	if got.Get("api") != "SYNO.Core.Share.Snapshot" || got.Get("method") != "set" ||
+		got.Get("name") != `"k8s-csi-pvc"` || got.Get("snapinfo") != `{"lock":false}` {
+		t.Errorf("ShareSnapshotLockSet() params = %v", got)
+	}
+}
+
+func TestSnapshotGet_locked(t *testing.T) {
+	dsm := newTestDSM(t, func(params url.Values) (interface{}, int) {
+		return map[string]interface{}{
+			"snapshot": map[string]interface{}{"uuid": "snap-uuid", "is_locked": true},
+		}, 0
+	})
+
+	info, err := dsm.SnapshotGet(context.Background(), "snap-uuid")
+	if err != nil {
+		t.Fatalf("SnapshotGet() error = %v", err)
+	}
+	if !info.IsLocked {
+		t.Errorf("SnapshotGet() IsLocked = false, want true")
+	}
+}
+
+func TestTargetCreate_chap(t *testing.T) {
+	var got url.Values
+	dsm := newTestDSM(t, func(params url.Values) (interface{}, int) {
+		got = params
+		return map[string]int{"target_id": 3}, 0
+	})
+
+	spec := TargetCreateSpec{
+		Name: "k8s-csi-pvc", Iqn: "iqn.2000-01.com.synology:k8s",
+		AuthType: TargetAuthMutualChap,
+		User:     "initiator", Password: "secret1",
+		MutualUser: "target", MutualPassword: "secret2",
+	}
+	if _, err := dsm.TargetCreate(context.Background(), spec); err != nil {
+		t.Fatalf("TargetCreate() error = %v", err)
+	}
+	if got.Get("auth_type") != "2" || got.Get("user") != "initiator" || got.Get("password") != "secret1" ||
+		got.Get("mutual_user") != "target" || got.Get("mutual_password") != "secret2" {
+		t.Errorf("TargetCreate() params = %v", got)
+	}
+
+	if s := fmt.Sprintf("%v", spec); strings.Contains(s, "secret") {
+		t.Errorf("TargetCreateSpec formats as %q, want no secrets", s)
+	}
+	if q := redactedQuery(got); strings.Contains(q, "secret") {
+		t.Errorf("redactedQuery() = %q, want no secrets", q)
+	}
+}
+
+func TestSendRequest_relogin(t *testing.T) {
+	var logins, requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp := map[string]interface{}{"success": true}
+		if r.URL.Query().Get("method") == "login" {
+			atomic.AddInt32(&logins, 1)
+			resp["data"] = map[string]string{"sid": "renewed-sid"}
+		} else if r.URL.Query().Get("api") == "SYNO.API.Info" {
+			resp["data"] = map[string]interface{}{}
+		} else {
+			atomic.AddInt32(&requests, 1)
+			if cookie, err := r.Cookie("id"); err != nil || cookie.Value != "renewed-sid" {
+				resp = map[string]interface{}{"success": false, "error": map[string]int{"code": 119}}
+			} else {
+				resp["data"] = map[string]interface{}{"snapshot": map[string]interface{}{"uuid": "snap-uuid"}}
+			}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	dsm := newServerDSM(t, server)
+	dsm.Sid = "expired-sid"
+
+	const callers = 10
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := dsm.SnapshotGet(context.Background(), "snap-uuid"); err != nil {
+				t.Errorf("SnapshotGet() error = %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if logins != 1 {
+		t.Errorf("%d callers with an expired session logged in %d times, want 1", callers, logins)
+	}
+	if dsm.Sid != "renewed-sid" {
+		t.Errorf("Sid = %q, want %q", dsm.Sid, "renewed-sid")
+	}
+	if requests > 2*callers {
+		t.Errorf("%d requests sent for %d callers, want at most one retry each", requests, callers)
+	}
+}
+
+func TestLogin_otp(t *testing.T) {
+	tests := []struct {
+		name         string
+		otpCode      string
+		deviceId     string
+		wantParams   map[string]string
+		wantDeviceId string
+	}{
+		{
+			name:       "password only",
+			wantParams: map[string]string{"version": "3", "otp_code": "", "device_id": "", "enable_device_token": ""},
+		},
+		{
+			name:         "otp code",
+			otpCode:      "123456",
+			wantParams:   map[string]string{"version": "6", "otp_code": "123456", "enable_device_token": "yes", "device_name": deviceName, "device_id": ""},
+			wantDeviceId: "new-did",
+		},
+		{
+			name:         "remembered device",
+			otpCode:      "123456",
+			deviceId:     "saved-did",
+			wantParams:   map[string]string{"version": "6", "device_id": "saved-did", "device_name": deviceName, "otp_code": ""},
+			wantDeviceId: "saved-did",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got url.Values
+			dsm := newTestDSM(t, func(params url.Values) (interface{}, int) {
+				got = params
+				data := map[string]string{"sid": "new-sid"}
+				if params.Get("enable_device_token") == "yes" {
+					data["did"] = "new-did"
+				}
+				return data, 0
+			})
+			dsm.Username, dsm.Password = "admin", "secret"
+			dsm.OtpCode, dsm.DeviceId = tt.otpCode, tt.deviceId
+
+			if err := dsm.Login(context.Background()); err != nil {
+				t.Fatalf("Login() error = %v", err)
+			}
+			for key, want := range tt.wantParams {
+				if got.Get(key) != want {
+					t.Errorf("Login() param %s = %q, want %q", key, got.Get(key), want)
+				}
+			}
+			if dsm.DeviceId != tt.wantDeviceId {
+				t.Errorf("Login() DeviceId = %q, want %q", dsm.DeviceId, tt.wantDeviceId)
+			}
+			if q := redactedQuery(got); strings.Contains(q, "secret") || strings.Contains(q, "123456") || strings.Contains(q, "saved-did") {
+				t.Errorf("redactedQuery() = %q, want no credentials", q)
+			}
+		})
+	}
+}
+
+func TestLogin_otpRequired(t *testing.T) {
+	dsm := newTestDSM(t, func(params url.Values) (interface{}, int) {
+		return nil, authErrOtpRequired
+	})
+	dsm.Username = "admin"
+
+	err := dsm.Login(context.Background())
+	if err == nil || !strings.Contains(err.Error(), "no OTP code is configured") {
+		t.Errorf("Login() error = %v, want 2-factor authentication required", err)
+	}
+}
+
+func TestSendRequest_cancel(t *testing.T) {
+	started, aborted := make(chan struct{}), make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-r.Context().Done():
+			close(aborted)
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	dsm := newServerDSM(t, server)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-started
+		cancel()
+	}()
+
+	start := time.Now()
+	_, err := dsm.LunClone(ctx, LunCloneSpec{Name: "k8s-csi-pvc-clone", SrcLunUuid: "src-uuid", Location: "/volume1"})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("LunClone() error = %v, want %v", err, context.Canceled)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("LunClone() returned %v after the context was cancelled", elapsed)
+	}
+
+	select {
+	case <-aborted:
+	case <-time.After(5 * time.Second):
+		t.Errorf("DSM request was not torn down after the context was cancelled")
+	}
+}
+
+func TestLunCreate_qos(t *testing.T) {
+	var got url.Values
+	dsm := newTestDSM(t, func(params url.Values) (interface{}, int) {
+		got = params
+		return map[string]string{"uuid": "lun-uuid"}, 0
+	})
+
+	spec := LunCreateSpec{Name: "k8s-csi-pvc", Location: "/volume1", Size: 1 << 30, Type: "BLUN",
+		Qos: LunQos{MaxIops: 500, MaxThroughput: 100}}
+	if _, err := dsm.LunCreate(context.Background(), spec); err != nil {
+		t.Fatalf("LunCreate() error = %v", err)
+	}
+	if got.Get("max_iops") != "500" || got.Get("max_throughput") != "100" {
+		t.Errorf("LunCreate() params = %v", got)
+	}
+
+	spec.Qos = LunQos{}
+	if _, err := dsm.LunCreate(context.Background(), spec); err != nil {
+		t.Fatalf("LunCreate() error = %v", err)
+	}
+	if got.Has("max_iops") || got.Has("max_throughput") {
+		t.Errorf("LunCreate() without QoS params = %v", got)
+	}
+
+	if err := dsm.LunUpdate(context.Background(), LunUpdateSpec{Uuid: "lun-uuid", Qos: LunQos{MaxIops: 500}}); err != nil {
+		t.Fatalf("LunUpdate() error = %v", err)
+	}
+	if got.Has("new_size") || got.Get("max_iops") != "500" || got.Get("max_throughput") != "0" {
+		t.Errorf("LunUpdate() params = %v", got)
+	}
+}
+
+func TestLunCreate_blockSize(t *testing.T) {
+	var got url.Values
+	dsm := newTestDSM(t, func(params url.Values) (interface{}, int) {
+		got = params
+		return map[string]string{"uuid": "lun-uuid"}, 0
+	})
+
+	spec := LunCreateSpec{Name: "k8s-csi-pvc", Location: "/volume1", Size: 1 << 30, Type: "BLUN", BlockSize: 4096}
+	if _, err := dsm.LunCreate(context.Background(), spec); err != nil {
+		t.Fatalf("LunCreate() error = %v", err)
+	}
+	if got.Get("block_size") != "4096" {
+		t.Errorf("LunCreate() params = %v", got)
+	}
+
+	spec.BlockSize = 0
+	if _, err := dsm.LunCreate(context.Background(), spec); err != nil {
+		t.Fatalf("LunCreate() error = %v", err)
+	}
+	if got.Has("block_size") {
+		t.Errorf("LunCreate() with the default block size params = %v", got)
+	}
+}
+
+func TestDsmMajorVersion(t *testing.T) {
+	tests := []struct {
+		firmwareVer string
+		want        int
+		wantErr     bool
+	}{
+		{firmwareVer: "DSM 7.1.1-42962", want: 7},
+		{firmwareVer: "DSM 6.2.4-25556 Update 7", want: 6},
+		{firmwareVer: "DSM UC 3.1.0-0326", wantErr: true},
+		{firmwareVer: "", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := dsmMajorVersion(tt.firmwareVer)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("dsmMajorVersion(%q) = %d, %v, want %d, error: %v", tt.firmwareVer, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestShareCreate_encryption(t *testing.T) {
+	var got url.Values
+	dsm := newTestDSM(t, func(params url.Values) (interface{}, int) {
+		got = params
+		return nil, 0
+	})
+
+	spec := ShareCreateSpec{
+		Name:      "k8s-csi-pvc",
+		ShareInfo: ShareInfo{Name: "k8s-csi-pvc", VolPath: "/volume1", Encryption: 1, EncPassphrase: "secret"},
+	}
+	if err := dsm.ShareCreate(context.Background(), spec); err != nil {
+		t.Fatalf("ShareCreate() error = %v", err)
+	}
+	info := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(got.Get("shareinfo")), &info); err != nil {
+		t.Fatalf("ShareCreate() shareinfo %q: %v", got.Get("shareinfo"), err)
+	}
+	if info["encryption"] != float64(1) || info["enc_passwd"] != "secret" {
+		t.Errorf("ShareCreate() shareinfo = %v", info)
+	}
+
+	if s := fmt.Sprintf("%v %+v %#v", spec, spec, spec); strings.Contains(s, "secret") {
+		t.Errorf("ShareCreateSpec formats as %q, want no secrets", s)
+	}
+	if q := redactedQuery(got); strings.Contains(q, "secret") {
+		t.Errorf("redactedQuery() = %q, want no secrets", q)
+	}
+}
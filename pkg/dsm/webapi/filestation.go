@@ -0,0 +1,60 @@
+/*
+ * Copyright 2021 Synology Inc.
+ */
+
+package webapi
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+func fileStationErrCodeMapping(errCode int, oriErr error) error {
+	switch errCode {
+	case 408: // No such file or directory
+		return utils.DsmError{Code: errCode, Err: utils.NoSuchFileError("")}
+	case 414: // File already exists
+		return utils.DsmError{Code: errCode, Err: utils.AlreadyExistError("")}
+	}
+	return oriErr
+}
+
+// folderPath is the File Station path of a folder of a share, "/<share>/<folder>"
+func folderPath(shareName string, folder string) string {
+	return "/" + strings.Trim(shareName, "/") + "/" + strings.Trim(folder, "/")
+}
+
+// FolderCreate creates the folder in the share, succeeding if it already exists
+func (dsm *DSM) FolderCreate(ctx context.Context, shareName string, folder string) error {
+	params := url.Values{}
+	params.Add("api", "SYNO.FileStation.CreateFolder")
+	params.Add("method", "create")
+	params.Add("version", "2")
+	params.Add("folder_path", "["+strconv.Quote("/"+strings.Trim(shareName, "/"))+"]")
+	params.Add("name", "["+strconv.Quote(folder)+"]")
+	// no error if the folder exists
+	params.Add("force_parent", "true")
+
+	resp, err := dsm.sendRequest(ctx, "", &struct{}{}, params, "webapi/entry.cgi")
+
+	return fileStationErrCodeMapping(resp.ErrorCode, err)
+}
+
+// FolderDelete deletes the folder of the share with all its contents, the call blocks until
+// it is done
+func (dsm *DSM) FolderDelete(ctx context.Context, shareName string, folder string) error {
+	params := url.Values{}
+	params.Add("api", "SYNO.FileStation.Delete")
+	params.Add("method", "delete")
+	params.Add("version", "2")
+	params.Add("path", "["+strconv.Quote(folderPath(shareName, folder))+"]")
+	params.Add("recursive", "true")
+
+	resp, err := dsm.sendRequest(ctx, "", &struct{}{}, params, "webapi/entry.cgi")
+
+	return fileStationErrCodeMapping(resp.ErrorCode, err)
+}
@@ -0,0 +1,54 @@
+package webapi
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"testing"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+func TestFolderCreate(t *testing.T) {
+	var got url.Values
+	dsm := newTestDSM(t, func(params url.Values) (interface{}, int) {
+		got = params
+		return map[string]interface{}{}, 0
+	})
+
+	if err := dsm.FolderCreate(context.Background(), "k8s", "pvc-1"); err != nil {
+		t.Fatalf("FolderCreate() error = %v", err)
+	}
+	want := map[string]string{
+		"api":          "SYNO.FileStation.CreateFolder",
+		"folder_path":  `["/k8s"]`,
+		"name":         `["pvc-1"]`,
+		"force_parent": "true",
+	}
+	for key, value := range want {
+		if got.Get(key) != value {
+			t.Errorf("FolderCreate() sent %s=%q, want %q", key, got.Get(key), value)
+		}
+	}
+}
+
+func TestFolderDelete(t *testing.T) {
+	var got url.Values
+	code := 0
+	dsm := newTestDSM(t, func(params url.Values) (interface{}, int) {
+		got = params
+		return map[string]interface{}{}, code
+	})
+
+	if err := dsm.FolderDelete(context.Background(), "k8s", "pvc-1"); err != nil {
+		t.Fatalf("FolderDelete() error = %v", err)
+	}
+	if got.Get("path") != `["/k8s/pvc-1"]` || got.Get("recursive") != "true" {
+		t.Errorf("FolderDelete() sent path=%q recursive=%q", got.Get("path"), got.Get("recursive"))
+	}
+
+	code = 408
+	if err := dsm.FolderDelete(context.Background(), "k8s", "pvc-1"); !errors.Is(err, utils.NoSuchFileError("")) {
+		t.Errorf("FolderDelete() error = %v for a missing folder, want %v", err, utils.NoSuchFileError(""))
+	}
+}
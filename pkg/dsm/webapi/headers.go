@@ -0,0 +1,74 @@
+/*
+ * Copyright 2021 Synology Inc.
+ */
+
+package webapi
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// reservedHeaders are set by the client itself and can't be extra headers
+var reservedHeaders = []string{"Content-Type", "Content-Length", "Cookie", "Host", RequestIdHeader}
+
+// sensitiveHeaderWords mark the headers whose values are masked in logs, e.g. Authorization
+var sensitiveHeaderWords = []string{"auth", "token", "secret", "key", "pass", "session", "cookie", "signature"}
+
+// ValidateHeaders checks the extra headers sent with every request to DSM
+func ValidateHeaders(headers map[string]string) error {
+	for name, value := range headers {
+		canonical := http.CanonicalHeaderKey(name)
+		for _, reserved := range reservedHeaders {
+			if canonical == http.CanonicalHeaderKey(reserved) {
+				return fmt.Errorf("header %s is set by the client and can't be overridden", name)
+			}
+		}
+		if name == "" || strings.ContainsAny(name, " :\r\n") {
+			return fmt.Errorf("invalid header name %q", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return fmt.Errorf("invalid value of header %s", name)
+		}
+	}
+	return nil
+}
+
+// isSensitiveHeader tells if the value of the header is a credential
+func isSensitiveHeader(name string) bool {
+	name = strings.ToLower(name)
+	for _, word := range sensitiveHeaderWords {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// setHeaders adds the extra headers of the DSM to a request, before the client sets its own
+func (dsm *DSM) setHeaders(req *http.Request) {
+	for name, value := range dsm.Headers {
+		req.Header.Set(name, value)
+	}
+}
+
+// redactedHeaders formats the headers of a request for logging with the credentials masked
+func redactedHeaders(header http.Header) string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fields := make([]string, 0, len(names))
+	for _, name := range names {
+		value := strings.Join(header[name], ", ")
+		if isSensitiveHeader(name) {
+			value = "***"
+		}
+		fields = append(fields, name+": "+value)
+	}
+	return strings.Join(fields, "; ")
+}
@@ -0,0 +1,85 @@
+package webapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/logger"
+)
+
+func TestValidateHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		wantErr bool
+	}{
+		{name: "none", headers: nil},
+		{name: "bearer", headers: map[string]string{"Authorization": "Bearer token", "X-Tenant": "k8s"}},
+		{name: "cookie", headers: map[string]string{"cookie": "id=other"}, wantErr: true},
+		{name: "content type", headers: map[string]string{"Content-Type": "text/plain"}, wantErr: true},
+		{name: "request id", headers: map[string]string{"x-request-id": "1"}, wantErr: true},
+		{name: "name with colon", headers: map[string]string{"X-A:": "1"}, wantErr: true},
+		{name: "value with newline", headers: map[string]string{"X-A": "1\r\nX-B: 2"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := ValidateHeaders(tt.headers); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateHeaders() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDoRequest_headers(t *testing.T) {
+	var got http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Clone()
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "data": map[string]interface{}{}})
+	}))
+	dsm := newServerDSM(t, server)
+	dsm.Headers = map[string]string{"Authorization": "Bearer proxy-token", "X-Tenant": "k8s"}
+
+	var buf bytes.Buffer
+	defer func(debug bool, level log.Level, out io.Writer) {
+		logger.WebapiDebug = debug
+		log.SetLevel(level)
+		log.SetOutput(out)
+	}(logger.WebapiDebug, log.GetLevel(), log.StandardLogger().Out)
+	logger.WebapiDebug = true
+	log.SetLevel(log.DebugLevel)
+	log.SetOutput(&buf)
+
+	ctx := logger.WithRequestId(context.Background(), "req-1")
+	if _, err := dsm.LunList(ctx); err != nil {
+		t.Fatalf("LunList() error = %v", err)
+	}
+
+	if v := got.Get("Authorization"); v != "Bearer proxy-token" {
+		t.Errorf("Authorization header = %q, want the extra header", v)
+	}
+	if v := got.Get("X-Tenant"); v != "k8s" {
+		t.Errorf("X-Tenant header = %q, want the extra header", v)
+	}
+	if v := got.Get("Cookie"); v != "id=test-sid" {
+		t.Errorf("Cookie header = %q, want the session", v)
+	}
+	if v := got.Get(RequestIdHeader); v != "req-1" {
+		t.Errorf("%s header = %q, want req-1", RequestIdHeader, v)
+	}
+
+	logs := buf.String()
+	if strings.Contains(logs, "proxy-token") || strings.Contains(logs, "test-sid") {
+		t.Errorf("debug logs have the credentials of the headers: %s", logs)
+	}
+	if !strings.Contains(logs, "Authorization: ***") || !strings.Contains(logs, "X-Tenant: k8s") {
+		t.Errorf("debug logs = %s, want the headers with the credentials masked", logs)
+	}
+}
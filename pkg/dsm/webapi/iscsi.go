@@ -3,6 +3,7 @@
 package webapi
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/url"
@@ -16,6 +17,7 @@ import (
 type LunInfo struct {
 	Name             string         `json:"name"`
 	Uuid             string         `json:"uuid"`
+	Description      string         `json:"description"`
 	LunType          int            `json:"type"`
 	Location         string         `json:"location"`
 	Size             uint64         `json:"size"`
@@ -24,6 +26,26 @@ type LunInfo struct {
 	FlashcacheStatus string         `json:"flashcache_status"`
 	IsActionLocked   bool           `json:"is_action_locked"`
 	DevAttribs       []LunDevAttrib `json:"dev_attribs"`
+	BlockSize        int            `json:"block_size"`
+	LunQos
+}
+
+// LunQos limits the IOPS and the throughput of a LUN, 0 means unlimited
+type LunQos struct {
+	MaxIops       int `json:"max_iops"`
+	MaxThroughput int `json:"max_throughput"` // MB/s
+}
+
+func (qos LunQos) IsSet() bool {
+	return qos.MaxIops > 0 || qos.MaxThroughput > 0
+}
+
+func (qos LunQos) addParams(params url.Values) {
+	if !qos.IsSet() {
+		return
+	}
+	params.Add("max_iops", strconv.Itoa(qos.MaxIops))
+	params.Add("max_throughput", strconv.Itoa(qos.MaxThroughput))
 }
 
 type MappedLun struct {
@@ -50,6 +72,19 @@ type TargetInfo struct {
 	ConnectedSessions []ConncetedSession `json:"connected_sessions"`
 	NetworkPortals    []NetworkPortal    `json:"network_portals"`
 	TargetId          int                `json:"target_id"`
+	Acls              []TargetAcl        `json:"acls"`
+}
+
+const (
+	TargetPermissionRw = "rw"
+	TargetPermissionRo = "ro"
+)
+
+// TargetAcl allows an initiator to log into a target, which only accepts the initiators of
+// its ACLs once they are set
+type TargetAcl struct {
+	Iqn        string `json:"iqn"`
+	Permission string `json:"permission"`
 }
 
 type SnapshotInfo struct {
@@ -60,6 +95,8 @@ type SnapshotInfo struct {
 	TotalSize         int64              `json:"total_size"`
 	CreateTime        int64              `json:"create_time"`
 	RootPath          string             `json:"root_path"`
+	IsLocked          bool               `json:"is_locked"`
+	UsedSize          int64              `json:"used_size"` // space consumed by the snapshot
 }
 
 type LunDevAttrib struct {
@@ -74,11 +111,14 @@ type LunCreateSpec struct {
 	Size        int64
 	Type        string
 	DevAttribs  []LunDevAttrib
+	Qos         LunQos
+	BlockSize   int // logical block size in bytes, 0 is the DSM default
 }
 
 type LunUpdateSpec struct {
 	Uuid    string
-	NewSize uint64
+	NewSize uint64 // 0 keeps the size
+	Qos     LunQos // unset keeps the limits
 }
 
 type LunCloneSpec struct {
@@ -87,9 +127,25 @@ type LunCloneSpec struct {
 	Location        string
 }
 
+const (
+	TargetAuthNone = iota
+	TargetAuthChap
+	TargetAuthMutualChap
+)
+
 type TargetCreateSpec struct {
-	Name string
-	Iqn  string
+	Name           string
+	Iqn            string
+	AuthType       int
+	User           string
+	Password       string
+	MutualUser     string
+	MutualPassword string
+}
+
+// String keeps the CHAP secrets out of logs and error messages
+func (spec TargetCreateSpec) String() string {
+	return fmt.Sprintf("{Name:%s Iqn:%s AuthType:%d}", spec.Name, spec.Iqn, spec.AuthType)
 }
 
 type SnapshotCreateSpec struct {
@@ -109,32 +165,32 @@ type SnapshotCloneSpec struct {
 func errCodeMapping(errCode int, oriErr error) error {
 	switch errCode {
 	case 18990002: // Out of free space
-		return utils.OutOfFreeSpaceError("")
+		return utils.DsmError{Code: errCode, Err: utils.OutOfFreeSpaceError("")}
 	case 18990531: // No such LUN
-		return utils.NoSuchLunError("")
+		return utils.DsmError{Code: errCode, Err: utils.NoSuchLunError("")}
 	case 18990538: // Duplicated LUN name
-		return utils.AlreadyExistError("")
+		return utils.DsmError{Code: errCode, Err: utils.AlreadyExistError("")}
 	case 18990541:
-		return utils.LunReachMaxCountError("")
+		return utils.DsmError{Code: errCode, Err: utils.LunReachMaxCountError("")}
 	case 18990542:
-		return utils.TargetReachMaxCountError("")
+		return utils.DsmError{Code: errCode, Err: utils.TargetReachMaxCountError("")}
 	case 18990744: // Duplicated Target name
-		return utils.AlreadyExistError("")
+		return utils.DsmError{Code: errCode, Err: utils.AlreadyExistError("")}
 	case 18990532:
-		return utils.NoSuchSnapshotError("")
+		return utils.DsmError{Code: errCode, Err: utils.NoSuchSnapshotError("")}
 	case 18990500:
-		return utils.BadLunTypeError("")
+		return utils.DsmError{Code: errCode, Err: utils.BadLunTypeError("")}
 	case 18990543:
-		return utils.SnapshotReachMaxCountError("")
+		return utils.DsmError{Code: errCode, Err: utils.SnapshotReachMaxCountError("")}
 	}
 
 	if errCode > 18990000 {
-		return utils.IscsiDefaultError{errCode}
+		return utils.IscsiDefaultError{ErrCode: errCode}
 	}
 	return oriErr
 }
 
-func (dsm *DSM) LunList() ([]LunInfo, error) {
+func (dsm *DSM) LunList(ctx context.Context) ([]LunInfo, error) {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.ISCSI.LUN")
 	params.Add("method", "list")
@@ -146,7 +202,7 @@ func (dsm *DSM) LunList() ([]LunInfo, error) {
 		Luns []LunInfo `json:"luns"`
 	}
 
-	resp, err := dsm.sendRequest("", &LunInfos{}, params, "webapi/entry.cgi")
+	resp, err := dsm.sendRequest(ctx, "", &LunInfos{}, params, "webapi/entry.cgi")
 	if err != nil {
 		return nil, errCodeMapping(resp.ErrorCode, err)
 	}
@@ -158,7 +214,7 @@ func (dsm *DSM) LunList() ([]LunInfo, error) {
 	return lunInfos.Luns, nil
 }
 
-func (dsm *DSM) LunCreate(spec LunCreateSpec) (string, error) {
+func (dsm *DSM) LunCreate(ctx context.Context, spec LunCreateSpec) (string, error) {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.ISCSI.LUN")
 	params.Add("method", "create")
@@ -174,12 +230,16 @@ func (dsm *DSM) LunCreate(spec LunCreateSpec) (string, error) {
 		return "", err
 	}
 	params.Add("dev_attribs", string(js))
+	spec.Qos.addParams(params)
+	if spec.BlockSize > 0 {
+		params.Add("block_size", strconv.Itoa(spec.BlockSize))
+	}
 
 	type LunCreateResp struct {
 		Uuid string `json:"uuid"`
 	}
 
-	resp, err := dsm.sendRequest("", &LunCreateResp{}, params, "webapi/entry.cgi")
+	resp, err := dsm.sendRequest(ctx, "", &LunCreateResp{}, params, "webapi/entry.cgi")
 	if err != nil {
 		return "", errCodeMapping(resp.ErrorCode, err)
 	}
@@ -192,15 +252,18 @@ func (dsm *DSM) LunCreate(spec LunCreateSpec) (string, error) {
 	return lunResp.Uuid, nil
 }
 
-func (dsm *DSM) LunUpdate(spec LunUpdateSpec) error {
+func (dsm *DSM) LunUpdate(ctx context.Context, spec LunUpdateSpec) error {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.ISCSI.LUN")
 	params.Add("method", "set")
 	params.Add("version", "1")
 	params.Add("uuid", strconv.Quote(spec.Uuid))
-	params.Add("new_size", strconv.FormatInt(int64(spec.NewSize), 10))
+	if spec.NewSize > 0 {
+		params.Add("new_size", strconv.FormatInt(int64(spec.NewSize), 10))
+	}
+	spec.Qos.addParams(params)
 
-	resp, err := dsm.sendRequest("", &struct{}{}, params, "webapi/entry.cgi")
+	resp, err := dsm.sendRequest(ctx, "", &struct{}{}, params, "webapi/entry.cgi")
 	if err != nil {
 		return errCodeMapping(resp.ErrorCode, err)
 	}
@@ -208,7 +271,7 @@ func (dsm *DSM) LunUpdate(spec LunUpdateSpec) error {
 	return nil
 }
 
-func (dsm *DSM) LunGet(uuid string) (LunInfo, error) {
+func (dsm *DSM) LunGet(ctx context.Context, uuid string) (LunInfo, error) {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.ISCSI.LUN")
 	params.Add("method", "get")
@@ -221,7 +284,7 @@ func (dsm *DSM) LunGet(uuid string) (LunInfo, error) {
 	}
 	info := Info{}
 
-	resp, err := dsm.sendRequest("", &info, params, "webapi/entry.cgi")
+	resp, err := dsm.sendRequest(ctx, "", &info, params, "webapi/entry.cgi")
 	if err != nil {
 		return LunInfo{}, errCodeMapping(resp.ErrorCode, err)
 	}
@@ -229,7 +292,7 @@ func (dsm *DSM) LunGet(uuid string) (LunInfo, error) {
 	return info.Lun, nil
 }
 
-func (dsm *DSM) LunClone(spec LunCloneSpec) (string, error) {
+func (dsm *DSM) LunClone(ctx context.Context, spec LunCloneSpec) (string, error) {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.ISCSI.LUN")
 	params.Add("method", "clone")
@@ -242,7 +305,7 @@ func (dsm *DSM) LunClone(spec LunCloneSpec) (string, error) {
 		Uuid string `json:"dst_lun_uuid"`
 	}
 
-	resp, err := dsm.sendRequest("", &LunCloneResp{}, params, "webapi/entry.cgi")
+	resp, err := dsm.sendRequest(ctx, "", &LunCloneResp{}, params, "webapi/entry.cgi")
 	if err != nil {
 		return "", errCodeMapping(resp.ErrorCode, err)
 	}
@@ -255,7 +318,7 @@ func (dsm *DSM) LunClone(spec LunCloneSpec) (string, error) {
 	return cloneLunResp.Uuid, nil
 }
 
-func (dsm *DSM) TargetList() ([]TargetInfo, error) {
+func (dsm *DSM) TargetList(ctx context.Context) ([]TargetInfo, error) {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.ISCSI.Target")
 	params.Add("method", "list")
@@ -266,7 +329,7 @@ func (dsm *DSM) TargetList() ([]TargetInfo, error) {
 		Targets []TargetInfo `json:"targets"`
 	}
 
-	resp, err := dsm.sendRequest("", &TargetInfos{}, params, "webapi/entry.cgi")
+	resp, err := dsm.sendRequest(ctx, "", &TargetInfos{}, params, "webapi/entry.cgi")
 	if err != nil {
 		return nil, errCodeMapping(resp.ErrorCode, err)
 	}
@@ -278,20 +341,20 @@ func (dsm *DSM) TargetList() ([]TargetInfo, error) {
 	return trgInfos.Targets, nil
 }
 
-func (dsm *DSM) TargetGet(targetId string) (TargetInfo, error) {
+func (dsm *DSM) TargetGet(ctx context.Context, targetId string) (TargetInfo, error) {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.ISCSI.Target")
 	params.Add("method", "get")
 	params.Add("version", "1")
 	params.Add("target_id", strconv.Quote(targetId))
-	params.Add("additional", "[\"mapped_lun\", \"connected_sessions\"]")
+	params.Add("additional", "[\"mapped_lun\", \"connected_sessions\", \"acls\"]")
 
 	type Info struct {
 		Target TargetInfo `json:"target"`
 	}
 	info := Info{}
 
-	resp, err := dsm.sendRequest("", &info, params, "webapi/entry.cgi")
+	resp, err := dsm.sendRequest(ctx, "", &info, params, "webapi/entry.cgi")
 	if err != nil {
 		return TargetInfo{}, errCodeMapping(resp.ErrorCode, err)
 	}
@@ -300,7 +363,7 @@ func (dsm *DSM) TargetGet(targetId string) (TargetInfo, error) {
 }
 
 // Enable muti session
-func (dsm *DSM) TargetSet(targetId string, maxSession int) error {
+func (dsm *DSM) TargetSet(ctx context.Context, targetId string, maxSession int) error {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.ISCSI.Target")
 	params.Add("method", "set")
@@ -308,7 +371,7 @@ func (dsm *DSM) TargetSet(targetId string, maxSession int) error {
 	params.Add("target_id", strconv.Quote(targetId))
 	params.Add("max_sessions", strconv.Itoa(maxSession))
 
-	resp, err := dsm.sendRequest("", &struct{}{}, params, "webapi/entry.cgi")
+	resp, err := dsm.sendRequest(ctx, "", &struct{}{}, params, "webapi/entry.cgi")
 	if err != nil {
 		return errCodeMapping(resp.ErrorCode, err)
 	}
@@ -316,20 +379,56 @@ func (dsm *DSM) TargetSet(targetId string, maxSession int) error {
 	return nil
 }
 
-func (dsm *DSM) TargetCreate(spec TargetCreateSpec) (string, error) {
+// TargetSetAcls replaces the initiators allowed to log into a target
+func (dsm *DSM) TargetSetAcls(ctx context.Context, targetId string, acls []TargetAcl) error {
+	params := url.Values{}
+	params.Add("api", "SYNO.Core.ISCSI.Target")
+	params.Add("method", "set")
+	params.Add("version", "1")
+	params.Add("target_id", strconv.Quote(targetId))
+
+	if acls == nil {
+		acls = []TargetAcl{}
+	}
+	js, err := json.Marshal(acls)
+	if err != nil {
+		return err
+	}
+	params.Add("acls", string(js))
+
+	if logger.WebapiDebug {
+		log.WithContext(ctx).Debugln(params)
+	}
+
+	resp, err := dsm.sendRequest(ctx, "", &struct{}{}, params, "webapi/entry.cgi")
+	if err != nil {
+		return errCodeMapping(resp.ErrorCode, err)
+	}
+	return nil
+}
+
+func (dsm *DSM) TargetCreate(ctx context.Context, spec TargetCreateSpec) (string, error) {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.ISCSI.Target")
 	params.Add("method", "create")
 	params.Add("version", "1")
 	params.Add("name", spec.Name)
-	params.Add("auth_type", "0")
+	params.Add("auth_type", strconv.Itoa(spec.AuthType))
 	params.Add("iqn", spec.Iqn)
+	if spec.AuthType != TargetAuthNone {
+		params.Add("user", spec.User)
+		params.Add("password", spec.Password)
+	}
+	if spec.AuthType == TargetAuthMutualChap {
+		params.Add("mutual_user", spec.MutualUser)
+		params.Add("mutual_password", spec.MutualPassword)
+	}
 
 	type TrgCreateResp struct {
 		TargetId int `json:"target_id"`
 	}
 
-	resp, err := dsm.sendRequest("", &TrgCreateResp{}, params, "webapi/entry.cgi")
+	resp, err := dsm.sendRequest(ctx, "", &TrgCreateResp{}, params, "webapi/entry.cgi")
 	if err != nil {
 		return "", errCodeMapping(resp.ErrorCode, err)
 	}
@@ -342,7 +441,7 @@ func (dsm *DSM) TargetCreate(spec TargetCreateSpec) (string, error) {
 	return strconv.Itoa(trgResp.TargetId), nil
 }
 
-func (dsm *DSM) LunMapTarget(targetIds []string, lunUuid string) error {
+func (dsm *DSM) LunMapTarget(ctx context.Context, targetIds []string, lunUuid string) error {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.ISCSI.LUN")
 	params.Add("method", "map_target")
@@ -351,45 +450,60 @@ func (dsm *DSM) LunMapTarget(targetIds []string, lunUuid string) error {
 	params.Add("target_ids", fmt.Sprintf("[%s]", strings.Join(targetIds, ",")))
 
 	if logger.WebapiDebug {
-		log.Debugln(params)
+		log.WithContext(ctx).Debugln(params)
 	}
 
-	resp, err := dsm.sendRequest("", &struct{}{}, params, "webapi/entry.cgi")
+	resp, err := dsm.sendRequest(ctx, "", &struct{}{}, params, "webapi/entry.cgi")
 	if err != nil {
 		return errCodeMapping(resp.ErrorCode, err)
 	}
 	return nil
 }
 
-func (dsm *DSM) LunDelete(lunUuid string) error {
+func (dsm *DSM) LunUnmapTarget(ctx context.Context, targetIds []string, lunUuid string) error {
+	params := url.Values{}
+	params.Add("api", "SYNO.Core.ISCSI.LUN")
+	params.Add("method", "unmap_target")
+	params.Add("version", "1")
+	params.Add("uuid", strconv.Quote(lunUuid))
+	params.Add("target_ids", fmt.Sprintf("[%s]", strings.Join(targetIds, ",")))
+
+	resp, err := dsm.sendRequest(ctx, "", &struct{}{}, params, "webapi/entry.cgi")
+	if err != nil {
+		return errCodeMapping(resp.ErrorCode, err)
+	}
+	return nil
+}
+
+func (dsm *DSM) LunDelete(ctx context.Context, lunUuid string) error {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.ISCSI.LUN")
 	params.Add("method", "delete")
 	params.Add("version", "1")
 	params.Add("uuid", strconv.Quote(lunUuid))
 
-	resp, err := dsm.sendRequest("", &struct{}{}, params, "webapi/entry.cgi")
+	resp, err := dsm.sendRequest(ctx, "", &struct{}{}, params, "webapi/entry.cgi")
 	if err != nil {
 		return errCodeMapping(resp.ErrorCode, err)
 	}
 	return nil
 }
 
-func (dsm *DSM) TargetDelete(targetName string) error {
+func (dsm *DSM) TargetDelete(ctx context.Context, targetName string) error {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.ISCSI.Target")
 	params.Add("method", "delete")
 	params.Add("version", "1")
 	params.Add("target_id", strconv.Quote(targetName))
 
-	resp, err := dsm.sendRequest("", &struct{}{}, params, "webapi/entry.cgi")
+	resp, err := dsm.sendRequest(ctx, "", &struct{}{}, params, "webapi/entry.cgi")
 	if err != nil {
 		return errCodeMapping(resp.ErrorCode, err)
 	}
 	return nil
 }
 
-func (dsm *DSM) SnapshotCreate(spec SnapshotCreateSpec) (string, error) {
+func (dsm *DSM) SnapshotCreate(ctx context.Context, spec SnapshotCreateSpec) (string, error) {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.ISCSI.LUN")
 	params.Add("method", "take_snapshot")
@@ -405,7 +519,7 @@ func (dsm *DSM) SnapshotCreate(spec SnapshotCreateSpec) (string, error) {
 		Uuid string `json:"snapshot_uuid"`
 	}
 
-	resp, err := dsm.sendRequest("", &SnapshotCreateResp{}, params, "webapi/entry.cgi")
+	resp, err := dsm.sendRequest(ctx, "", &SnapshotCreateResp{}, params, "webapi/entry.cgi")
 	if err != nil {
 		return "", errCodeMapping(resp.ErrorCode, err)
 	}
@@ -418,21 +532,36 @@ func (dsm *DSM) SnapshotCreate(spec SnapshotCreateSpec) (string, error) {
 	return snapshotResp.Uuid, nil
 }
 
-func (dsm *DSM) SnapshotDelete(snapshotUuid string) error {
+func (dsm *DSM) SnapshotDelete(ctx context.Context, snapshotUuid string) error {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.ISCSI.LUN")
 	params.Add("method", "delete_snapshot")
 	params.Add("version", "1")
 	params.Add("snapshot_uuid", strconv.Quote(snapshotUuid))
 
-	resp, err := dsm.sendRequest("", &struct{}{}, params, "webapi/entry.cgi")
+	resp, err := dsm.sendRequest(ctx, "", &struct{}{}, params, "webapi/entry.cgi")
+	if err != nil {
+		return errCodeMapping(resp.ErrorCode, err)
+	}
+	return nil
+}
+
+func (dsm *DSM) SnapshotLockSet(ctx context.Context, snapshotUuid string, isLocked bool) error {
+	params := url.Values{}
+	params.Add("api", "SYNO.Core.ISCSI.LUN")
+	params.Add("method", "set_snapshot")
+	params.Add("version", "1")
+	params.Add("snapshot_uuid", strconv.Quote(snapshotUuid))
+	params.Add("is_locked", strconv.FormatBool(isLocked))
+
+	resp, err := dsm.sendRequest(ctx, "", &struct{}{}, params, "webapi/entry.cgi")
 	if err != nil {
 		return errCodeMapping(resp.ErrorCode, err)
 	}
 	return nil
 }
 
-func (dsm *DSM) SnapshotGet(snapshotUuid string) (SnapshotInfo, error) {
+func (dsm *DSM) SnapshotGet(ctx context.Context, snapshotUuid string) (SnapshotInfo, error) {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.ISCSI.LUN")
 	params.Add("method", "get_snapshot")
@@ -444,7 +573,7 @@ func (dsm *DSM) SnapshotGet(snapshotUuid string) (SnapshotInfo, error) {
 	}
 	info := Info{}
 
-	resp, err := dsm.sendRequest("", &info, params, "webapi/entry.cgi")
+	resp, err := dsm.sendRequest(ctx, "", &info, params, "webapi/entry.cgi")
 	if err != nil {
 		return SnapshotInfo{}, errCodeMapping(resp.ErrorCode, err)
 	}
@@ -452,7 +581,7 @@ func (dsm *DSM) SnapshotGet(snapshotUuid string) (SnapshotInfo, error) {
 	return info.Snapshot, nil
 }
 
-func (dsm *DSM) SnapshotList(lunUuid string) ([]SnapshotInfo, error) {
+func (dsm *DSM) SnapshotList(ctx context.Context, lunUuid string) ([]SnapshotInfo, error) {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.ISCSI.LUN")
 	params.Add("method", "list_snapshot")
@@ -463,7 +592,7 @@ func (dsm *DSM) SnapshotList(lunUuid string) ([]SnapshotInfo, error) {
 		Snapshots []SnapshotInfo `json:"snapshots"`
 	}
 
-	resp, err := dsm.sendRequest("", &Infos{}, params, "webapi/entry.cgi")
+	resp, err := dsm.sendRequest(ctx, "", &Infos{}, params, "webapi/entry.cgi")
 	if err != nil {
 		return nil, errCodeMapping(resp.ErrorCode, err)
 	}
@@ -476,7 +605,7 @@ func (dsm *DSM) SnapshotList(lunUuid string) ([]SnapshotInfo, error) {
 	return infos.Snapshots, nil
 }
 
-func (dsm *DSM) SnapshotClone(spec SnapshotCloneSpec) (string, error) {
+func (dsm *DSM) SnapshotClone(ctx context.Context, spec SnapshotCloneSpec) (string, error) {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.ISCSI.LUN")
 	params.Add("method", "clone_snapshot")
@@ -489,7 +618,7 @@ func (dsm *DSM) SnapshotClone(spec SnapshotCloneSpec) (string, error) {
 		Uuid string `json:"cloned_lun_uuid"`
 	}
 
-	resp, err := dsm.sendRequest("", &SnapshotCloneResp{}, params, "webapi/entry.cgi")
+	resp, err := dsm.sendRequest(ctx, "", &SnapshotCloneResp{}, params, "webapi/entry.cgi")
 	if err != nil {
 		return "", errCodeMapping(resp.ErrorCode, err)
 	}
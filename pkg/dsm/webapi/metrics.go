@@ -0,0 +1,66 @@
+/*
+ * Copyright 2021 Synology Inc.
+ */
+
+package webapi
+
+import (
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics of the requests sent to DSM, labeled by API name and method
+var (
+	requestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "synology_csi",
+		Subsystem: "dsm",
+		Name:      "requests_total",
+		Help:      "Number of requests sent to DSM.",
+	}, []string{"api", "method"})
+
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "synology_csi",
+		Subsystem: "dsm",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of the requests sent to DSM.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"api", "method"})
+
+	errorsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "synology_csi",
+		Subsystem: "dsm",
+		Name:      "errors_total",
+		Help:      "Number of failed requests to DSM by DSM error code, \"transport\" if DSM didn't answer.",
+	}, []string{"api", "method", "code"})
+
+	requestsQueued = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "synology_csi",
+		Subsystem: "dsm",
+		Name:      "requests_queued",
+		Help:      "Number of requests waiting for the concurrency limit of their DSM.",
+	}, []string{"api", "method"})
+)
+
+func init() {
+	prometheus.MustRegister(requestsTotal, requestDuration, errorsTotal, requestsQueued)
+}
+
+// observeRequest records a request to DSM that took elapsed and ended with resp and err
+func observeRequest(params url.Values, elapsed time.Duration, resp Response, err error) {
+	api, method := params.Get("api"), params.Get("method")
+
+	requestsTotal.WithLabelValues(api, method).Inc()
+	requestDuration.WithLabelValues(api, method).Observe(elapsed.Seconds())
+	if err == nil {
+		return
+	}
+
+	code := "transport"
+	if resp.ErrorCode != 0 {
+		code = strconv.Itoa(resp.ErrorCode)
+	}
+	errorsTotal.WithLabelValues(api, method, code).Inc()
+}
@@ -0,0 +1,38 @@
+package webapi
+
+import (
+	"context"
+	"net/url"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSendRequest_metrics(t *testing.T) {
+	code := 0
+	dsm := newTestDSM(t, func(params url.Values) (interface{}, int) {
+		return map[string]interface{}{"snapshot": map[string]interface{}{"uuid": "snap-uuid"}}, code
+	})
+
+	api, method := "SYNO.Core.ISCSI.LUN", "get_snapshot"
+	requests := testutil.ToFloat64(requestsTotal.WithLabelValues(api, method))
+	failures := testutil.ToFloat64(errorsTotal.WithLabelValues(api, method, "18990002"))
+
+	if _, err := dsm.SnapshotGet(context.Background(), "snap-uuid"); err != nil {
+		t.Fatalf("SnapshotGet() error = %v", err)
+	}
+	code = 18990002
+	if _, err := dsm.SnapshotGet(context.Background(), "snap-uuid"); err == nil {
+		t.Fatalf("SnapshotGet() of failing request succeeded")
+	}
+
+	if got := testutil.ToFloat64(requestsTotal.WithLabelValues(api, method)) - requests; got != 2 {
+		t.Errorf("requests_total increased by %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(errorsTotal.WithLabelValues(api, method, "18990002")) - failures; got != 1 {
+		t.Errorf("errors_total increased by %v, want 1", got)
+	}
+	if got := testutil.CollectAndCount(requestDuration); got == 0 {
+		t.Errorf("request_duration_seconds has no series")
+	}
+}
@@ -0,0 +1,87 @@
+/*
+ * Copyright 2021 Synology Inc.
+ */
+
+package webapi
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/http/httpproxy"
+)
+
+// ProxyOptions configure the proxy the requests to DSM go through. Without URL the
+// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables are used.
+type ProxyOptions struct {
+	URL string
+	// NoProxy are the hosts reached without URL, in the format of NO_PROXY
+	NoProxy string
+	// CaPEM holds the CAs trusted for the certificate of an HTTPS proxy instead of the
+	// system ones. The certificate of DSM is still verified as TLSOptions tell.
+	CaPEM []byte
+}
+
+// proxyFunc returns the Proxy function of the transport of DSM
+func (opts ProxyOptions) proxyFunc() (func(*http.Request) (*url.URL, error), error) {
+	config := httpproxy.FromEnvironment()
+	if opts.URL != "" {
+		proxyURL, err := url.Parse(opts.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %v", err)
+		}
+		if proxyURL.Scheme != "http" && proxyURL.Scheme != "https" || proxyURL.Host == "" {
+			return nil, fmt.Errorf("proxy URL must be http://<host>[:<port>] or https://<host>[:<port>]")
+		}
+		config = &httpproxy.Config{HTTPProxy: opts.URL, HTTPSProxy: opts.URL, NoProxy: opts.NoProxy}
+	}
+
+	proxy := config.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return proxy(req.URL)
+	}, nil
+}
+
+// dsmProxy returns the Proxy function of the transport of DSM and the proxy DSM is
+// reached through, nil if there is none
+func (dsm *DSM) dsmProxy() (func(*http.Request) (*url.URL, error), *url.URL, error) {
+	proxy, err := dsm.Proxy.proxyFunc()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	scheme := "http"
+	if dsm.Https {
+		scheme = "https"
+	}
+	proxyURL, err := proxy(&http.Request{URL: &url.URL{Scheme: scheme, Host: fmt.Sprintf("%s:%d", dsm.Ip, dsm.Port)}})
+	if err != nil {
+		return nil, nil, err
+	}
+	return proxy, proxyURL, nil
+}
+
+// proxyTLSDialer returns the DialTLSContext of a transport whose requests all go through
+// the HTTPS proxy proxyURL, nil for other proxies. The transport would otherwise verify the
+// certificate of the proxy with the TLS config of DSM, i.e. against the CAs or the pin of
+// DSM; the connections to DSM tunneled through the proxy still use that config.
+func proxyTLSDialer(proxyURL *url.URL, caPEM []byte) (func(ctx context.Context, network, addr string) (net.Conn, error), error) {
+	if proxyURL == nil || proxyURL.Scheme != "https" {
+		return nil, nil
+	}
+
+	config := &tls.Config{}
+	if len(caPEM) > 0 {
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificate found in the proxy CA bundle")
+		}
+	}
+	dialer := &tls.Dialer{Config: config}
+	return dialer.DialContext, nil
+}
@@ -0,0 +1,196 @@
+package webapi
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHttpClient_proxy(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     map[string]string
+		opts    ProxyOptions
+		host    string
+		want    string
+		wantErr bool
+	}{
+		{name: "no proxy", host: "dsm.example.com:5000"},
+		{
+			name: "environment",
+			env:  map[string]string{"HTTP_PROXY": "http://env-proxy:3128"},
+			host: "dsm.example.com:5000", want: "http://env-proxy:3128",
+		},
+		{
+			name: "environment NO_PROXY",
+			env:  map[string]string{"HTTP_PROXY": "http://env-proxy:3128", "NO_PROXY": ".example.com"},
+			host: "dsm.example.com:5000",
+		},
+		{
+			name: "configured",
+			env:  map[string]string{"HTTP_PROXY": "http://env-proxy:3128"},
+			opts: ProxyOptions{URL: "https://proxy.example.net:8443"},
+			host: "dsm.example.com:5000", want: "https://proxy.example.net:8443",
+		},
+		{
+			name: "configured NO_PROXY host",
+			opts: ProxyOptions{URL: "http://proxy.example.net:3128", NoProxy: "dsm.example.com,10.0.0.0/8"},
+			host: "dsm.example.com:5000",
+		},
+		{
+			name: "configured NO_PROXY CIDR",
+			opts: ProxyOptions{URL: "http://proxy.example.net:3128", NoProxy: "dsm.example.com,10.0.0.0/8"},
+			host: "10.1.2.3:5000",
+		},
+		{
+			name: "configured NO_PROXY not matching",
+			opts: ProxyOptions{URL: "http://proxy.example.net:3128", NoProxy: "dsm.example.com,10.0.0.0/8"},
+			host: "dsm2.example.com:5000", want: "http://proxy.example.net:3128",
+		},
+		{
+			name: "environment NO_PROXY ignored",
+			env:  map[string]string{"NO_PROXY": "*"},
+			opts: ProxyOptions{URL: "http://proxy.example.net:3128"},
+			host: "dsm.example.com:5000", want: "http://proxy.example.net:3128",
+		},
+		{name: "invalid scheme", opts: ProxyOptions{URL: "ftp://proxy.example.net"}, wantErr: true},
+		{name: "missing host", opts: ProxyOptions{URL: "proxy.example.net:3128"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{"HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "http_proxy", "https_proxy", "no_proxy", "REQUEST_METHOD"} {
+				t.Setenv(key, tt.env[key])
+			}
+			dsm := &DSM{Ip: "dsm.example.com", Port: 5000, Proxy: tt.opts}
+
+			client, err := dsm.httpClient()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("httpClient() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			proxyURL, err := client.Transport.(*http.Transport).Proxy(&http.Request{URL: &url.URL{Scheme: "http", Host: tt.host}})
+			if err != nil {
+				t.Fatalf("Proxy() error = %v", err)
+			}
+			got := ""
+			if proxyURL != nil {
+				got = proxyURL.String()
+			}
+			if got != tt.want {
+				t.Errorf("Proxy() of %s = %q, want %q", tt.host, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHttpClient_httpsProxy(t *testing.T) {
+	var mu sync.Mutex
+	proxied := []string{}
+	proxy := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		proxied = append(proxied, r.URL.Host)
+		mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "data": map[string]string{"sid": "sid"}})
+	}))
+	t.Cleanup(proxy.Close)
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: proxy.Certificate().Raw})
+
+	tests := []struct {
+		name    string
+		opts    ProxyOptions
+		wantErr string
+	}{
+		{name: "proxy CA", opts: ProxyOptions{URL: proxy.URL, CaPEM: caPEM}},
+		{name: "system CAs", opts: ProxyOptions{URL: proxy.URL}, wantErr: "certificate"},
+		{name: "invalid proxy CA", opts: ProxyOptions{URL: proxy.URL, CaPEM: []byte("not a certificate")}, wantErr: "no certificate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dsm := &DSM{Ip: "dsm.example.com", Port: 5000, Proxy: tt.opts}
+
+			err := dsm.Login(context.Background())
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("Login() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Login() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(proxied) == 0 || proxied[0] != "dsm.example.com:5000" {
+		t.Errorf("proxy received requests for %v, want dsm.example.com:5000", proxied)
+	}
+}
+
+func TestHttpClient_httpsProxyTunnel(t *testing.T) {
+	dsmServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "data": map[string]string{"sid": "sid"}})
+	}))
+	t.Cleanup(dsmServer.Close)
+	// tunnels every CONNECT to dsmServer, whatever host it asks for
+	proxy := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		upstream, err := net.Dial("tcp", dsmServer.Listener.Addr().String())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		conn, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		go func() {
+			io.Copy(upstream, conn)
+			upstream.Close()
+		}()
+		io.Copy(conn, upstream)
+		conn.Close()
+	}))
+	t.Cleanup(proxy.Close)
+	proxyCaPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: proxy.Certificate().Raw})
+	sum := sha256.Sum256(dsmServer.Certificate().Raw)
+	dsmPin := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name    string
+		tls     TLSOptions
+		wantErr string
+	}{
+		{name: "pinned DSM certificate", tls: TLSOptions{Fingerprint: dsmPin}},
+		{name: "wrong DSM pin", tls: TLSOptions{Fingerprint: strings.Repeat("00", sha256.Size)}, wantErr: "doesn't match"},
+		{name: "proxy CA not trusted for DSM", wantErr: "certificate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dsm := &DSM{Ip: "dsm.example.com", Port: 5001, Https: true, TLS: tt.tls, Proxy: ProxyOptions{URL: proxy.URL, CaPEM: proxyCaPEM}}
+
+			err := dsm.Login(context.Background())
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("Login() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Login() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+/*
+ * Copyright 2021 Synology Inc.
+ */
+
+package webapi
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/cenkalti/backoff/v4"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
+)
+
+// RetryPolicy bounds the retries of the requests which are safe to send again
+type RetryPolicy struct {
+	// MaxAttempts includes the first attempt, 1 disables retries
+	MaxAttempts     int
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+	// MaxElapsedTime is shortened to the deadline of the request context
+	MaxElapsedTime time.Duration
+	// StatusCodes and ErrorCodes are the HTTP and DSM codes worth a retry,
+	// transport errors are always retried
+	StatusCodes []int
+	ErrorCodes  []int
+}
+
+// Retry is the policy of all the requests sent to DSM
+var Retry = RetryPolicy{
+	MaxAttempts:     3,
+	InitialInterval: 500 * time.Millisecond,
+	MaxInterval:     5 * time.Second,
+	MaxElapsedTime:  30 * time.Second,
+	StatusCodes:     []int{500, 502, 503, 504},
+}
+
+// idempotentMethods are the webapi methods which can be sent again without changing
+// the result: queries, and setters replacing a setting with the same value. Creating,
+// deleting, cloning, mapping and logging in are never retried, e.g. an OTP code is
+// only valid once and a snapshot taken twice is two snapshots.
+var idempotentMethods = []string{
+	"get", "list", "load", "info", "get_snapshot", "list_snapshot", "set", "save", "set_snapshot",
+}
+
+// isIdempotent tells if the request can be retried
+func isIdempotent(params url.Values) bool {
+	return utils.SliceContains(idempotentMethods, params.Get("method"))
+}
+
+// isRetryable tells if the policy retries a request which ended with resp and err
+func (p RetryPolicy) isRetryable(resp Response, err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var netErr net.Error
+	var urlErr *url.Error
+	if errors.As(err, &netErr) || errors.As(err, &urlErr) {
+		return true
+	}
+	for _, code := range p.StatusCodes {
+		if resp.StatusCode == code {
+			return true
+		}
+	}
+	for _, code := range p.ErrorCodes {
+		if resp.ErrorCode == code {
+			return true
+		}
+	}
+	return false
+}
+
+// backOff returns the exponential backoff with jitter between the attempts of a request
+func (p RetryPolicy) backOff(ctx context.Context) backoff.BackOff {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = p.InitialInterval
+	b.MaxInterval = p.MaxInterval
+	b.RandomizationFactor = 0.5
+	b.MaxElapsedTime = p.MaxElapsedTime
+	if deadline, ok := ctx.Deadline(); ok && (b.MaxElapsedTime == 0 || time.Until(deadline) < b.MaxElapsedTime) {
+		b.MaxElapsedTime = time.Until(deadline)
+	}
+	b.Reset()
+
+	var bo backoff.BackOff = b
+	if p.MaxAttempts > 0 {
+		bo = backoff.WithMaxRetries(bo, uint64(p.MaxAttempts-1))
+	}
+	return backoff.WithContext(bo, ctx)
+}
+
+// do runs send once, or until it succeeds or fails for good if the request is idempotent
+func (p RetryPolicy) do(ctx context.Context, params url.Values, send func() (Response, error)) (Response, error) {
+	if p.MaxAttempts == 1 || !isIdempotent(params) {
+		return send()
+	}
+
+	var resp Response
+	operation := func() error {
+		var err error
+		resp, err = send()
+		if err != nil && !p.isRetryable(resp, err) {
+			return backoff.Permanent(err)
+		}
+		return err
+	}
+	notify := func(err error, wait time.Duration) {
+		log.WithContext(ctx).Warnf("Request %s of %s failed, retrying in %v: %v", params.Get("method"), params.Get("api"), wait.Round(time.Millisecond), err)
+	}
+
+	err := backoff.RetryNotify(operation, p.backOff(ctx), notify)
+	return resp, err
+}
@@ -0,0 +1,123 @@
+package webapi
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newFlakyDSM returns a DSM whose server fails the first failures requests with fail
+func newFlakyDSM(t *testing.T, failures int32, fail func(w http.ResponseWriter)) (*DSM, *int32) {
+	t.Helper()
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) <= failures {
+			fail(w)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "data": map[string]interface{}{}})
+	}))
+	return newServerDSM(t, server), &requests
+}
+
+func unavailable(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusServiceUnavailable)
+}
+
+func connectionReset(w http.ResponseWriter) {
+	conn, _, _ := w.(http.Hijacker).Hijack()
+	conn.Close()
+}
+
+func withRetry(t *testing.T, policy RetryPolicy) {
+	t.Helper()
+	saved := Retry
+	t.Cleanup(func() { Retry = saved })
+	Retry = policy
+}
+
+func testRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts:     3,
+		InitialInterval: time.Millisecond,
+		MaxInterval:     5 * time.Millisecond,
+		MaxElapsedTime:  time.Second,
+		StatusCodes:     []int{http.StatusServiceUnavailable},
+	}
+}
+
+func queryParams(method string) url.Values {
+	params := url.Values{}
+	params.Add("api", "SYNO.Core.ISCSI.LUN")
+	params.Add("method", method)
+	params.Add("version", "1")
+	return params
+}
+
+func TestSendRequest_retry(t *testing.T) {
+	withRetry(t, testRetryPolicy())
+
+	tests := []struct {
+		name         string
+		method       string
+		fail         func(w http.ResponseWriter)
+		wantErr      bool
+		wantRequests int32
+	}{
+		{name: "unavailable", method: "list", fail: unavailable, wantRequests: 3},
+		{name: "connection reset", method: "get", fail: connectionReset, wantRequests: 3},
+		{name: "create isn't idempotent", method: "create", fail: unavailable, wantErr: true, wantRequests: 1},
+		{name: "delete isn't idempotent", method: "delete", fail: connectionReset, wantErr: true, wantRequests: 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dsm, requests := newFlakyDSM(t, 2, tt.fail)
+
+			_, err := dsm.sendRequest(context.Background(), "", &struct{}{}, queryParams(tt.method), "webapi/entry.cgi")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("sendRequest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := atomic.LoadInt32(requests); got != tt.wantRequests {
+				t.Errorf("sendRequest() sent %d requests, want %d", got, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestSendRequest_retryBounds(t *testing.T) {
+	withRetry(t, testRetryPolicy())
+
+	dsm, requests := newFlakyDSM(t, 5, unavailable)
+	if _, err := dsm.sendRequest(context.Background(), "", &struct{}{}, queryParams("list"), "webapi/entry.cgi"); err == nil {
+		t.Fatalf("sendRequest() succeeded after %d requests, want an error", atomic.LoadInt32(requests))
+	}
+	if got := atomic.LoadInt32(requests); got != 3 {
+		t.Errorf("sendRequest() sent %d requests, want MaxAttempts 3", got)
+	}
+
+	// the deadline of the context cuts the retries short
+	policy := testRetryPolicy()
+	policy.MaxAttempts = 0
+	policy.InitialInterval, policy.MaxInterval = 20*time.Millisecond, 20*time.Millisecond
+	withRetry(t, policy)
+
+	dsm, requests = newFlakyDSM(t, 1000, unavailable)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := dsm.sendRequest(ctx, "", &struct{}{}, queryParams("list"), "webapi/entry.cgi"); err == nil {
+		t.Fatalf("sendRequest() succeeded, want an error")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("sendRequest() retried for %v past the deadline of the context", elapsed)
+	}
+	if got := atomic.LoadInt32(requests); got < 2 {
+		t.Errorf("sendRequest() sent %d requests, want retries until the deadline", got)
+	}
+}
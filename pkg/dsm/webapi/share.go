@@ -3,6 +3,7 @@
 package webapi
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net/url"
@@ -21,6 +22,7 @@ type ShareInfo struct {
 	EnableRecycleBin    bool   `json:"enable_recycle_bin"`
 	RecycleBinAdminOnly bool   `json:"recycle_bin_admin_only"`
 	Encryption          int    `json:"encryption"`                  // field for create
+	EncPassphrase       Passphrase `json:"enc_passwd,omitempty"`    // field for create
 	QuotaForCreate      *int64 `json:"share_quota,omitempty"`
 	QuotaValueInMB      int64  `json:"quota_value"`                 // field for get
 	SupportSnapshot     bool   `json:"support_snapshot"`            // field for get
@@ -28,6 +30,32 @@ type ShareInfo struct {
 	NameOrg             string `json:"name_org"`                    // required for clone
 }
 
+// Encryption states of shares as DSM reports them
+const (
+	ShareEncryptionNone     = 0
+	ShareEncryptionUnlocked = 1 // encrypted and mounted
+	ShareEncryptionLocked   = 2 // encrypted and not mounted, e.g. after a reboot without auto-mount
+)
+
+// IsLocked tells if the share is encrypted and must be unlocked on DSM to be used
+func (info ShareInfo) IsLocked() bool {
+	return info.Encryption == ShareEncryptionLocked
+}
+
+// Passphrase is a secret sent to DSM, printed masked
+type Passphrase string
+
+func (p Passphrase) String() string {
+	if p == "" {
+		return ""
+	}
+	return "***"
+}
+
+func (p Passphrase) GoString() string {
+	return strconv.Quote(p.String())
+}
+
 type ShareUpdateInfo struct {
 	Name                string `json:"name"`                        // required
 	VolPath             string `json:"vol_path"`                    // required
@@ -91,25 +119,25 @@ type NfsInfo struct {
 func shareErrCodeMapping(errCode int, oriErr error) error {
 	switch errCode {
 	case 402: // No such share
-		return utils.NoSuchShareError("")
+		return utils.DsmError{Code: errCode, Err: utils.NoSuchShareError("")}
 	case 403: // Invalid input value
-		return utils.BadParametersError("")
+		return utils.DsmError{Code: errCode, Err: utils.BadParametersError("")}
 	case 3301: // already exists
-		return utils.AlreadyExistError("")
+		return utils.DsmError{Code: errCode, Err: utils.AlreadyExistError("")}
 	case 3309:
-		return utils.ShareReachMaxCountError("")
+		return utils.DsmError{Code: errCode, Err: utils.ShareReachMaxCountError("")}
 	case 3328:
-		return utils.ShareSystemBusyError("")
+		return utils.DsmError{Code: errCode, Err: utils.ShareSystemBusyError("")}
 	}
 
 	if errCode >= 3300 {
-		return utils.ShareDefaultError{errCode}
+		return utils.ShareDefaultError{ErrCode: errCode}
 	}
 	return oriErr
 }
 
 // ----------------------- Share APIs -----------------------
-func (dsm *DSM) ShareGet(shareName string) (ShareInfo, error) {
+func (dsm *DSM) ShareGet(ctx context.Context, shareName string) (ShareInfo, error) {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.Share")
 	params.Add("method", "get")
@@ -119,12 +147,12 @@ func (dsm *DSM) ShareGet(shareName string) (ShareInfo, error) {
 
 	info := ShareInfo{}
 
-	resp, err := dsm.sendRequest("", &info, params, "webapi/entry.cgi")
+	resp, err := dsm.sendRequest(ctx, "", &info, params, "webapi/entry.cgi")
 
 	return info, shareErrCodeMapping(resp.ErrorCode, err)
 }
 
-func (dsm *DSM) ShareList() ([]ShareInfo, error) {
+func (dsm *DSM) ShareList(ctx context.Context) ([]ShareInfo, error) {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.Share")
 	params.Add("method", "list")
@@ -135,7 +163,7 @@ func (dsm *DSM) ShareList() ([]ShareInfo, error) {
 		Shares []ShareInfo `json:"shares"`
 	}
 
-	resp, err := dsm.sendRequest("", &ShareInfos{}, params, "webapi/entry.cgi")
+	resp, err := dsm.sendRequest(ctx, "", &ShareInfos{}, params, "webapi/entry.cgi")
 	if err != nil {
 		return nil, shareErrCodeMapping(resp.ErrorCode, err)
 	}
@@ -148,7 +176,7 @@ func (dsm *DSM) ShareList() ([]ShareInfo, error) {
 	return infos.Shares, nil
 }
 
-func (dsm *DSM) ShareCreate(spec ShareCreateSpec) error {
+func (dsm *DSM) ShareCreate(ctx context.Context, spec ShareCreateSpec) error {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.Share")
 	params.Add("method", "create")
@@ -161,12 +189,12 @@ func (dsm *DSM) ShareCreate(spec ShareCreateSpec) error {
 	}
 	params.Add("shareinfo", string(js))
 
-	resp, err := dsm.sendRequest("", &struct{}{}, params, "webapi/entry.cgi")
+	resp, err := dsm.sendRequest(ctx, "", &struct{}{}, params, "webapi/entry.cgi")
 
 	return shareErrCodeMapping(resp.ErrorCode, err)
 }
 
-func (dsm *DSM) ShareClone(spec ShareCloneSpec) (string, error) {
+func (dsm *DSM) ShareClone(ctx context.Context, spec ShareCloneSpec) (string, error) {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.Share")
 	params.Add("method", "clone")
@@ -193,7 +221,7 @@ func (dsm *DSM) ShareClone(spec ShareCloneSpec) (string, error) {
 		Name string `json:"name"`
 	}
 
-	resp, err := dsm.sendRequest("", &ShareCreateResp{}, params, "webapi/entry.cgi")
+	resp, err := dsm.sendRequest(ctx, "", &ShareCreateResp{}, params, "webapi/entry.cgi")
 	if err != nil {
 		return "", shareErrCodeMapping(resp.ErrorCode, err)
 	}
@@ -206,19 +234,19 @@ func (dsm *DSM) ShareClone(spec ShareCloneSpec) (string, error) {
 	return shareResp.Name, nil
 }
 
-func (dsm *DSM) ShareDelete(shareName string) error {
+func (dsm *DSM) ShareDelete(ctx context.Context, shareName string) error {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.Share")
 	params.Add("method", "delete")
 	params.Add("version", "1")
 	params.Add("name", fmt.Sprintf("[%s]", strconv.Quote(shareName)))
 
-	resp, err := dsm.sendRequest("", &struct{}{}, params, "webapi/entry.cgi")
+	resp, err := dsm.sendRequest(ctx, "", &struct{}{}, params, "webapi/entry.cgi")
 
 	return shareErrCodeMapping(resp.ErrorCode, err)
 }
 
-func (dsm *DSM) ShareSet(shareName string, updateInfo ShareUpdateInfo) error {
+func (dsm *DSM) ShareSet(ctx context.Context, shareName string, updateInfo ShareUpdateInfo) error {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.Share")
 	params.Add("method", "set")
@@ -232,25 +260,25 @@ func (dsm *DSM) ShareSet(shareName string, updateInfo ShareUpdateInfo) error {
 	params.Add("shareinfo", string(js))
 
 	if logger.WebapiDebug {
-		log.Debugln(params)
+		log.WithContext(ctx).Debugln(params)
 	}
 
-	resp, err := dsm.sendRequest("", &struct{}{}, params, "webapi/entry.cgi")
+	resp, err := dsm.sendRequest(ctx, "", &struct{}{}, params, "webapi/entry.cgi")
 
 	return shareErrCodeMapping(resp.ErrorCode, err)
 }
 
-func (dsm *DSM) SetShareQuota(shareInfo ShareInfo, newSizeInMB int64) error {
+func (dsm *DSM) SetShareQuota(ctx context.Context, shareInfo ShareInfo, newSizeInMB int64) error {
 	updateInfo := ShareUpdateInfo{
 		Name:           shareInfo.Name,
 		VolPath:        shareInfo.VolPath,
 		QuotaForCreate: &newSizeInMB,
 	}
-	return dsm.ShareSet(shareInfo.Name, updateInfo)
+	return dsm.ShareSet(ctx, shareInfo.Name, updateInfo)
 }
 
 // ----------------------- Share Snapshot APIs -----------------------
-func (dsm *DSM) ShareSnapshotCreate(spec ShareSnapshotCreateSpec) (string, error) {
+func (dsm *DSM) ShareSnapshotCreate(ctx context.Context, spec ShareSnapshotCreateSpec) (string, error) {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.Share.Snapshot")
 	params.Add("method", "create")
@@ -273,7 +301,7 @@ func (dsm *DSM) ShareSnapshotCreate(spec ShareSnapshotCreateSpec) (string, error
 	params.Add("snapinfo", string(js))
 
 	var snapTime string
-	resp, err := dsm.sendRequest("", &snapTime, params, "webapi/entry.cgi")
+	resp, err := dsm.sendRequest(ctx, "", &snapTime, params, "webapi/entry.cgi")
 	if err != nil {
 		return "", shareErrCodeMapping(resp.ErrorCode, err)
 	}
@@ -281,7 +309,7 @@ func (dsm *DSM) ShareSnapshotCreate(spec ShareSnapshotCreateSpec) (string, error
 	return snapTime, nil // "GMT+08-2022.01.14-19.18.29"
 }
 
-func (dsm *DSM) ShareSnapshotList(name string) ([]ShareSnapshotInfo, error) {
+func (dsm *DSM) ShareSnapshotList(ctx context.Context, name string) ([]ShareSnapshotInfo, error) {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.Share.Snapshot")
 	params.Add("method", "list")
@@ -294,7 +322,7 @@ func (dsm *DSM) ShareSnapshotList(name string) ([]ShareSnapshotInfo, error) {
 		Total     int                 `json:"total"`
 	}
 
-	resp, err := dsm.sendRequest("", &Infos{}, params, "webapi/entry.cgi")
+	resp, err := dsm.sendRequest(ctx, "", &Infos{}, params, "webapi/entry.cgi")
 	if err != nil {
 		return nil, shareErrCodeMapping(resp.ErrorCode, err)
 	}
@@ -307,7 +335,7 @@ func (dsm *DSM) ShareSnapshotList(name string) ([]ShareSnapshotInfo, error) {
 	return infos.Snapshots, nil
 }
 
-func (dsm *DSM) ShareSnapshotDelete(snapTime string, shareName string) error {
+func (dsm *DSM) ShareSnapshotDelete(ctx context.Context, snapTime string, shareName string) error {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.Share.Snapshot")
 	params.Add("method", "delete")
@@ -316,7 +344,7 @@ func (dsm *DSM) ShareSnapshotDelete(snapTime string, shareName string) error {
 	params.Add("snapshots", fmt.Sprintf("[%s]", strconv.Quote(snapTime))) // ["GMT+08-2022.01.14-19.18.29"]
 
 	var objmap []map[string]interface{}
-	resp, err := dsm.sendRequest("", &objmap, params, "webapi/entry.cgi")
+	resp, err := dsm.sendRequest(ctx, "", &objmap, params, "webapi/entry.cgi")
 	if err != nil {
 		return shareErrCodeMapping(resp.ErrorCode, err)
 	}
@@ -328,8 +356,31 @@ func (dsm *DSM) ShareSnapshotDelete(snapTime string, shareName string) error {
 	return nil
 }
 
+func (dsm *DSM) ShareSnapshotLockSet(ctx context.Context, snapTime string, shareName string, isLocked bool) error {
+	params := url.Values{}
+	params.Add("api", "SYNO.Core.Share.Snapshot")
+	params.Add("method", "set")
+	params.Add("version", "1")
+	params.Add("name", strconv.Quote(shareName))
+	params.Add("snapshot", strconv.Quote(snapTime))
+
+	js, err := json.Marshal(struct {
+		IsLocked bool `json:"lock"`
+	}{isLocked})
+	if err != nil {
+		return err
+	}
+	params.Add("snapinfo", string(js))
+
+	resp, err := dsm.sendRequest(ctx, "", &struct{}{}, params, "webapi/entry.cgi")
+	if err != nil {
+		return shareErrCodeMapping(resp.ErrorCode, err)
+	}
+	return nil
+}
+
 // ----------------------- Share Permission APIs -----------------------
-func (dsm *DSM) SharePermissionSet(spec SharePermissionSetSpec) error {
+func (dsm *DSM) SharePermissionSet(ctx context.Context, spec SharePermissionSetSpec) error {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.Share.Permission")
 	params.Add("method", "set")
@@ -344,15 +395,15 @@ func (dsm *DSM) SharePermissionSet(spec SharePermissionSetSpec) error {
 	params.Add("permissions", string(js))
 
 	if logger.WebapiDebug {
-		log.Debugln(params)
+		log.WithContext(ctx).Debugln(params)
 	}
 
-	resp, err := dsm.sendRequest("", &struct{}{}, params, "webapi/entry.cgi")
+	resp, err := dsm.sendRequest(ctx, "", &struct{}{}, params, "webapi/entry.cgi")
 
 	return shareErrCodeMapping(resp.ErrorCode, err)
 }
 
-func (dsm *DSM) SharePermissionList(shareName string, userGroupType string) ([]SharePermission, error) {
+func (dsm *DSM) SharePermissionList(ctx context.Context, shareName string, userGroupType string) ([]SharePermission, error) {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.Share.Permission")
 	params.Add("method", "list")
@@ -364,7 +415,7 @@ func (dsm *DSM) SharePermissionList(shareName string, userGroupType string) ([]S
 		Permissions []SharePermission `json:"items"`
 	}
 
-	resp, err := dsm.sendRequest("", &SharePermissions{}, params, "webapi/entry.cgi")
+	resp, err := dsm.sendRequest(ctx, "", &SharePermissions{}, params, "webapi/entry.cgi")
 	if err != nil {
 		return nil, shareErrCodeMapping(resp.ErrorCode, err)
 	}
@@ -385,6 +436,15 @@ type SecurityFlavor struct {
 	Sys              bool `json:"sys"`
 }
 
+// Squash modes of PrivilegeRule.RootSquash
+const (
+	NfsRootSquashNoMapping   = "root"
+	NfsRootSquashRootToAdmin = "admin"
+	NfsRootSquashRootToGuest = "guest"
+	NfsRootSquashAllToAdmin  = "all_admin"
+	NfsRootSquashAllToGuest  = "all_guest"
+)
+
 type PrivilegeRule struct {
 	Async          bool           `json:"async"`
 	Client         string         `json:"client"`
@@ -400,7 +460,7 @@ type SharePrivilege struct {
 	Rule      []PrivilegeRule `json:"rule"`
 }
 
-func (dsm *DSM) ShareNfsPrivilegeSave(privilege SharePrivilege) error {
+func (dsm *DSM) ShareNfsPrivilegeSave(ctx context.Context, privilege SharePrivilege) error {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.FileServ.NFS.SharePrivilege")
 	params.Add("method", "save")
@@ -413,7 +473,7 @@ func (dsm *DSM) ShareNfsPrivilegeSave(privilege SharePrivilege) error {
 	}
 	params.Add("rule", string(js))
 
-	_, err = dsm.sendRequest("", &struct{}{}, params, "webapi/entry.cgi")
+	_, err = dsm.sendRequest(ctx, "", &struct{}{}, params, "webapi/entry.cgi")
 	if err != nil {
 		return err
 	}
@@ -421,7 +481,7 @@ func (dsm *DSM) ShareNfsPrivilegeSave(privilege SharePrivilege) error {
 	return nil
 }
 
-func (dsm *DSM) ShareNfsPrivilegeLoad(shareName string) (SharePrivilege, error) {
+func (dsm *DSM) ShareNfsPrivilegeLoad(ctx context.Context, shareName string) (SharePrivilege, error) {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.FileServ.NFS.SharePrivilege")
 	params.Add("method", "load")
@@ -429,7 +489,7 @@ func (dsm *DSM) ShareNfsPrivilegeLoad(shareName string) (SharePrivilege, error)
 	params.Add("version", "1")
 
 	info := SharePrivilege{}
-	_, err := dsm.sendRequest("", &info, params, "webapi/entry.cgi")
+	_, err := dsm.sendRequest(ctx, "", &info, params, "webapi/entry.cgi")
 	if err != nil {
 		return SharePrivilege{}, err
 	}
@@ -437,14 +497,14 @@ func (dsm *DSM) ShareNfsPrivilegeLoad(shareName string) (SharePrivilege, error)
 	return info, nil
 }
 
-func (dsm *DSM) NfsGet() (NfsInfo, error) {
+func (dsm *DSM) NfsGet(ctx context.Context) (NfsInfo, error) {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.FileServ.NFS")
 	params.Add("method", "get")
 	params.Add("version", "2")
 
 	info := NfsInfo{}
-	_, err := dsm.sendRequest("", &info, params, "webapi/entry.cgi")
+	_, err := dsm.sendRequest(ctx, "", &info, params, "webapi/entry.cgi")
 	if err != nil {
 		return NfsInfo{}, err
 	}
@@ -452,7 +512,7 @@ func (dsm *DSM) NfsGet() (NfsInfo, error) {
 	return info, nil
 }
 
-func (dsm *DSM) NfsSet(enableV3 bool, enableV4 bool, enabledMinorVer int) error {
+func (dsm *DSM) NfsSet(ctx context.Context, enableV3 bool, enableV4 bool, enabledMinorVer int) error {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.FileServ.NFS")
 	params.Add("method", "set")
@@ -462,7 +522,7 @@ func (dsm *DSM) NfsSet(enableV3 bool, enableV4 bool, enabledMinorVer int) error
 	params.Add("enable_nfs_v4", strconv.FormatBool(enableV4))
 	params.Add("enabled_minor_ver", strconv.Itoa(enabledMinorVer))
 
-	_, err := dsm.sendRequest("", &struct{}{}, params, "webapi/entry.cgi")
+	_, err := dsm.sendRequest(ctx, "", &struct{}{}, params, "webapi/entry.cgi")
 	if err != nil {
 		return err
 	}
@@ -3,6 +3,7 @@
 package webapi
 
 import (
+	"context"
 	"fmt"
 	"strconv"
 	"net/url"
@@ -19,7 +20,7 @@ type VolInfo struct {
 	Location  string `json:"location"`
 }
 
-func (dsm *DSM) VolumeList() ([]VolInfo, error) {
+func (dsm *DSM) VolumeList(ctx context.Context) ([]VolInfo, error) {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.Storage.Volume")
 	params.Add("method", "list")
@@ -32,7 +33,7 @@ func (dsm *DSM) VolumeList() ([]VolInfo, error) {
 		Vols []VolInfo `json:"volumes"`
 	}
 
-	resp, err := dsm.sendRequest("", &VolInfos{}, params, "webapi/entry.cgi")
+	resp, err := dsm.sendRequest(ctx, "", &VolInfos{}, params, "webapi/entry.cgi")
 	if err != nil {
 		return nil, err
 	}
@@ -45,7 +46,7 @@ func (dsm *DSM) VolumeList() ([]VolInfo, error) {
 	return volInfos.Vols, nil
 }
 
-func (dsm *DSM) VolumeGet(name string) (VolInfo, error) {
+func (dsm *DSM) VolumeGet(ctx context.Context, name string) (VolInfo, error) {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.Storage.Volume")
 	params.Add("method", "get")
@@ -57,7 +58,7 @@ func (dsm *DSM) VolumeGet(name string) (VolInfo, error) {
 	}
 	info := Info{}
 
-	_, err := dsm.sendRequest("", &info, params, "webapi/entry.cgi")
+	_, err := dsm.sendRequest(ctx, "", &info, params, "webapi/entry.cgi")
 	if err != nil {
 		return VolInfo{}, err
 	}
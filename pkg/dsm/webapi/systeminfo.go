@@ -3,8 +3,11 @@
 package webapi
 
 import (
+	"context"
 	"fmt"
 	"net/url"
+	"regexp"
+	"strconv"
 	"strings"
 )
 
@@ -28,14 +31,14 @@ type NetworkInterface struct {
 	UseDhcp    bool   `json:"use_dhcp"`
 }
 
-func (dsm *DSM) DsmInfoGet() (*DsmInfo, error) {
+func (dsm *DSM) DsmInfoGet(ctx context.Context) (*DsmInfo, error) {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.System")
 	params.Add("method", "info")
 	params.Add("version", "1")
 	params.Add("type", "network")
 
-	resp, err := dsm.sendRequest("", &DsmInfo{}, params, "webapi/entry.cgi")
+	resp, err := dsm.sendRequest(ctx, "", &DsmInfo{}, params, "webapi/entry.cgi")
 	if err != nil {
 		return nil, err
 	}
@@ -48,13 +51,60 @@ func (dsm *DSM) DsmInfoGet() (*DsmInfo, error) {
 	return dsmInfo, nil
 }
 
-func (dsm *DSM) DsmSystemInfoGet() (*DsmSysInfo, error) {
+// First DSM major versions supporting the LUN features
+const (
+	lunQosMinMajorVersion    = 7
+	lun4KnMinMajorVersion    = 7
+	lunShrinkMinMajorVersion = 7
+)
+
+var firmwareVersionRe = regexp.MustCompile(`^DSM (\d+)\.`)
+
+// dsmMajorVersion parses the major version of a firmware version like "DSM 7.1.1-42962"
+func dsmMajorVersion(firmwareVer string) (int, error) {
+	m := firmwareVersionRe.FindStringSubmatch(firmwareVer)
+	if m == nil {
+		return 0, fmt.Errorf("Unknown firmware version: %q", firmwareVer)
+	}
+	return strconv.Atoi(m[1])
+}
+
+// SupportsLunQos tells if the firmware of the DSM can limit the IOPS and throughput of LUNs
+func (dsm *DSM) SupportsLunQos(ctx context.Context) (bool, string, error) {
+	return dsm.isMajorVersionAtLeast(ctx, lunQosMinMajorVersion)
+}
+
+// SupportsLun4Kn tells if the firmware of the DSM can create LUNs with 4096-byte logical blocks
+func (dsm *DSM) SupportsLun4Kn(ctx context.Context) (bool, string, error) {
+	return dsm.isMajorVersionAtLeast(ctx, lun4KnMinMajorVersion)
+}
+
+// SupportsLunShrink tells if the firmware of the DSM can reduce the size of LUNs
+func (dsm *DSM) SupportsLunShrink(ctx context.Context) (bool, string, error) {
+	return dsm.isMajorVersionAtLeast(ctx, lunShrinkMinMajorVersion)
+}
+
+// isMajorVersionAtLeast compares the firmware of the DSM to minMajor, it also returns the firmware version
+func (dsm *DSM) isMajorVersionAtLeast(ctx context.Context, minMajor int) (bool, string, error) {
+	info, err := dsm.DsmSystemInfoGet(ctx)
+	if err != nil {
+		return false, "", err
+	}
+	// an unknown firmware, like DSM UC, isn't trusted with newer features
+	major, err := dsmMajorVersion(info.FirmwareVer)
+	if err != nil {
+		return false, info.FirmwareVer, nil
+	}
+	return major >= minMajor, info.FirmwareVer, nil
+}
+
+func (dsm *DSM) DsmSystemInfoGet(ctx context.Context) (*DsmSysInfo, error) {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.System")
 	params.Add("method", "info")
 	params.Add("version", "1")
 
-	resp, err := dsm.sendRequest("", &DsmSysInfo{}, params, "webapi/entry.cgi")
+	resp, err := dsm.sendRequest(ctx, "", &DsmSysInfo{}, params, "webapi/entry.cgi")
 	if err != nil {
 		return nil, err
 	}
@@ -68,7 +118,7 @@ func (dsm *DSM) DsmSystemInfoGet() (*DsmSysInfo, error) {
 }
 
 
-func (dsm *DSM) NetworkInterfaceList(relayNode string) ([]NetworkInterface, error) {
+func (dsm *DSM) NetworkInterfaceList(ctx context.Context, relayNode string) ([]NetworkInterface, error) {
 	params := url.Values{}
 	params.Add("api", "SYNO.Core.Network.Interface")
 	params.Add("method", "list")
@@ -81,7 +131,7 @@ func (dsm *DSM) NetworkInterfaceList(relayNode string) ([]NetworkInterface, erro
 	ifaces := []NetworkInterface{}
 	validIfaces := []NetworkInterface{}
 
-	_, err := dsm.sendRequest("", &ifaces, params, "webapi/entry.cgi")
+	_, err := dsm.sendRequest(ctx, "", &ifaces, params, "webapi/entry.cgi")
 	if err != nil {
 		return nil, err
 	}
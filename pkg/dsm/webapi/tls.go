@@ -0,0 +1,134 @@
+/*
+ * Copyright 2021 Synology Inc.
+ */
+
+package webapi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// TLSOptions configure how the certificate of DSM is verified over HTTPS
+type TLSOptions struct {
+	// CaPEM holds the CAs trusted for DSM instead of the system ones
+	CaPEM []byte
+	// Fingerprint pins the SHA-256 of the DSM certificate, in hex with or without colons.
+	// A pinned certificate doesn't need to be signed by a trusted CA unless CaPEM is set.
+	Fingerprint        string
+	InsecureSkipVerify bool
+}
+
+// httpClient returns the client shared by all requests to the DSM
+func (dsm *DSM) httpClient() (*http.Client, error) {
+	dsm.clientOnce.Do(func() {
+		transport := dsm.newTransport()
+		proxy, proxyURL, err := dsm.dsmProxy()
+		if err != nil {
+			dsm.clientErr = fmt.Errorf("Invalid proxy options for DSM [%s]: %v", dsm.Ip, err)
+			return
+		}
+		if transport.DialTLSContext, err = proxyTLSDialer(proxyURL, dsm.Proxy.CaPEM); err != nil {
+			dsm.clientErr = fmt.Errorf("Invalid proxy options for DSM [%s]: %v", dsm.Ip, err)
+			return
+		}
+		transport.Proxy = proxy
+		if proxyURL != nil {
+			log.Infof("Requests to DSM [%s] go through proxy %s", dsm.Ip, proxyURL.Redacted())
+		}
+
+		dialer := dsm.Dialer
+		if dialer == nil {
+			if dialer, err = dsm.Transport.dialer(); err != nil {
+				dsm.clientErr = fmt.Errorf("Invalid transport options for DSM [%s]: %v", dsm.Ip, err)
+				return
+			}
+		}
+		if dialer != nil {
+			// the tunnel or socket replaces the proxy, which would be dialed through it
+			if dsm.Proxy.URL != "" {
+				dsm.clientErr = fmt.Errorf("DSM [%s] can't have both a proxy and a dial address", dsm.Ip)
+				return
+			}
+			transport.Proxy = nil
+			transport.DialTLSContext = nil
+			transport.DialContext = dialer.DialContext
+			if dsm.Transport.redirected() {
+				log.Infof("Connections to DSM [%s] are opened to %s %s", dsm.Ip, dsm.Transport.network(), dsm.Transport.DialAddress)
+			}
+		}
+		if !dsm.Https {
+			dsm.client = &http.Client{Transport: transport}
+			return
+		}
+
+		tlsConfig, err := newTLSConfig(dsm.TLS)
+		if err != nil {
+			dsm.clientErr = fmt.Errorf("Invalid TLS options for DSM [%s]: %v", dsm.Ip, err)
+			return
+		}
+		if dsm.TLS.InsecureSkipVerify {
+			log.Warnf("Certificate verification of DSM [%s] is disabled by insecureSkipVerify", dsm.Ip)
+		}
+		transport.TLSClientConfig = tlsConfig
+		dsm.client = &http.Client{Transport: transport}
+	})
+	return dsm.client, dsm.clientErr
+}
+
+func newTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: opts.InsecureSkipVerify}
+
+	if len(opts.CaPEM) > 0 {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(opts.CaPEM) {
+			return nil, fmt.Errorf("no certificate found in the CA bundle")
+		}
+		config.RootCAs = pool
+	}
+
+	if opts.Fingerprint == "" {
+		return config, nil
+	}
+
+	pin, err := hex.DecodeString(strings.ReplaceAll(opts.Fingerprint, ":", ""))
+	if err != nil || len(pin) != sha256.Size {
+		return nil, fmt.Errorf("certificate fingerprint must be a hex SHA-256 digest")
+	}
+
+	// the pin replaces the verification by the system CAs, so it is done by hand
+	verifyChain := !opts.InsecureSkipVerify && config.RootCAs != nil
+	config.InsecureSkipVerify = true
+	config.VerifyConnection = func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return fmt.Errorf("DSM sent no certificate")
+		}
+		leaf := state.PeerCertificates[0]
+		if sum := sha256.Sum256(leaf.Raw); !bytes.Equal(sum[:], pin) {
+			return fmt.Errorf("certificate fingerprint %x doesn't match the pinned one", sum)
+		}
+		if !verifyChain {
+			return nil
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, cert := range state.PeerCertificates[1:] {
+			intermediates.AddCert(cert)
+		}
+		_, err := leaf.Verify(x509.VerifyOptions{
+			DNSName:       state.ServerName,
+			Roots:         config.RootCAs,
+			Intermediates: intermediates,
+		})
+		return err
+	}
+	return config, nil
+}
@@ -0,0 +1,63 @@
+package webapi
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHttpClient_tls(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "data": map[string]string{"sid": "sid"}})
+	}))
+	addr := newServerDSM(t, server)
+	cert := server.Certificate()
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	sum := sha256.Sum256(cert.Raw)
+	fingerprint := hex.EncodeToString(sum[:])
+
+	tests := []struct {
+		name    string
+		opts    TLSOptions
+		wantErr string
+	}{
+		{name: "system CAs", wantErr: "certificate"},
+		{name: "custom CA", opts: TLSOptions{CaPEM: caPEM}},
+		{name: "pinned certificate", opts: TLSOptions{Fingerprint: strings.ToUpper(fingerprint)}},
+		{name: "pinned certificate and CA", opts: TLSOptions{CaPEM: caPEM, Fingerprint: fingerprint}},
+		{name: "wrong pin", opts: TLSOptions{Fingerprint: strings.Repeat("00", sha256.Size)}, wantErr: "doesn't match"},
+		{name: "invalid pin", opts: TLSOptions{Fingerprint: "abc"}, wantErr: "hex SHA-256"},
+		{name: "invalid CA", opts: TLSOptions{CaPEM: []byte("not a certificate")}, wantErr: "no certificate"},
+		{name: "insecure", opts: TLSOptions{InsecureSkipVerify: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dsm := &DSM{Ip: addr.Ip, Port: addr.Port, Https: true, TLS: tt.opts}
+
+			err := dsm.Login(context.Background())
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("Login() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("Login() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHttpClient_reused(t *testing.T) {
+	dsm := &DSM{Https: true}
+	first, err := dsm.httpClient()
+	if err != nil {
+		t.Fatalf("httpClient() error = %v", err)
+	}
+	if second, _ := dsm.httpClient(); second != first {
+		t.Errorf("httpClient() returned a new client for the second request")
+	}
+}
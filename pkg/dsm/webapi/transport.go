@@ -0,0 +1,96 @@
+/*
+ * Copyright 2021 Synology Inc.
+ */
+
+package webapi
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Transports the connections to DSM are opened over
+const (
+	TransportTCP  = "tcp"
+	TransportUnix = "unix"
+)
+
+// dialTimeout is the timeout of the connections opened to a dial address, as the one of
+// http.DefaultTransport
+const dialTimeout = 30 * time.Second
+
+// TransportOptions configure where the connections to DSM are opened, for a DSM only
+// reachable through an SSH local forward or the Unix socket of a sidecar. The requests
+// are still made to the host and port of the DSM, and its certificate still verified
+// for them.
+type TransportOptions struct {
+	// Type is TransportTCP, the default, or TransportUnix
+	Type string
+	// DialAddress is the host:port, e.g. the local end of an SSH tunnel, or the path of
+	// the Unix socket every connection is opened to. The host and port of the DSM are
+	// dialed if it isn't set.
+	DialAddress string
+}
+
+// Dialer opens the connections the requests to DSM are sent on
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+}
+
+// fixedDialer opens every connection to the same address, whichever is asked for
+type fixedDialer struct {
+	network string
+	address string
+	dialer  *net.Dialer
+}
+
+func (d *fixedDialer) DialContext(ctx context.Context, _, _ string) (net.Conn, error) {
+	return d.dialer.DialContext(ctx, d.network, d.address)
+}
+
+// Validate checks the type and the dial address of the transport
+func (opts TransportOptions) Validate() error {
+	switch opts.Type {
+	case "", TransportTCP:
+		if opts.DialAddress == "" {
+			return nil
+		}
+		if _, _, err := net.SplitHostPort(opts.DialAddress); err != nil {
+			return fmt.Errorf("dial address of the tcp transport must be <host>:<port>: %v", err)
+		}
+		return nil
+	case TransportUnix:
+		if opts.DialAddress == "" {
+			return fmt.Errorf("the unix transport needs the path of the socket as dial address")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown transport %q, must be %s or %s", opts.Type, TransportTCP, TransportUnix)
+}
+
+// redirected tells if the connections are opened elsewhere than to the DSM
+func (opts TransportOptions) redirected() bool {
+	return opts.DialAddress != ""
+}
+
+// network is the network of the dial address, TransportTCP if the type isn't set
+func (opts TransportOptions) network() string {
+	if opts.Type == "" {
+		return TransportTCP
+	}
+	return opts.Type
+}
+
+// dialer returns the dialer of the transport, nil to dial the DSM itself
+func (opts TransportOptions) dialer() (Dialer, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+	if !opts.redirected() {
+		return nil, nil
+	}
+
+	return &fixedDialer{network: opts.network(), address: opts.DialAddress, dialer: &net.Dialer{Timeout: dialTimeout}}, nil
+}
@@ -0,0 +1,164 @@
+package webapi
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// newTransportTestServer returns an unstarted server answering the login and LUN list
+// requests, recording the Host of each request
+func newTransportTestServer(t *testing.T, hosts *[]string) *httptest.Server {
+	t.Helper()
+	var mu sync.Mutex
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		*hosts = append(*hosts, r.Host)
+		mu.Unlock()
+
+		var data interface{} = map[string]interface{}{}
+		switch r.URL.Query().Get("api") {
+		case "SYNO.API.Info":
+			data = map[string]ApiInfo{"SYNO.API.Auth": {MinVersion: 6, MaxVersion: 7, Path: "auth.cgi"}}
+		case "SYNO.API.Auth":
+			data = map[string]string{"sid": "sid"}
+		case "SYNO.Core.ISCSI.LUN":
+			data = map[string]interface{}{"luns": []LunInfo{{Name: "k8s-csi-pvc-1", Uuid: "lun-uuid"}}}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"success": true, "data": data})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func listenUnix(t *testing.T) (net.Listener, string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "dsm.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("Failed to listen on %s: %v", path, err)
+	}
+	return listener, path
+}
+
+func assertTransportWorks(t *testing.T, dsm *DSM, hosts *[]string) {
+	t.Helper()
+	if err := dsm.Login(context.Background()); err != nil {
+		t.Fatalf("Login() error = %v", err)
+	}
+	luns, err := dsm.LunList(context.Background())
+	if err != nil {
+		t.Fatalf("LunList() error = %v", err)
+	}
+	if len(luns) != 1 || luns[0].Uuid != "lun-uuid" {
+		t.Errorf("LunList() = %+v, want the LUN of the server", luns)
+	}
+	// the requests are still made to the DSM, whatever they are sent through
+	for _, host := range *hosts {
+		if host != "dsm.example.com:5001" {
+			t.Errorf("request sent for host %s, want dsm.example.com:5001", host)
+		}
+	}
+	if len(*hosts) == 0 {
+		t.Errorf("no request reached the server")
+	}
+}
+
+func TestTransport_unixSocket(t *testing.T) {
+	hosts := []string{}
+	server := newTransportTestServer(t, &hosts)
+	listener, path := listenUnix(t)
+	server.Listener = listener
+	server.Start()
+
+	dsm := &DSM{Ip: "dsm.example.com", Port: 5001, Transport: TransportOptions{Type: TransportUnix, DialAddress: path}}
+	assertTransportWorks(t, dsm, &hosts)
+}
+
+func TestTransport_unixSocketHttps(t *testing.T) {
+	hosts := []string{}
+	server := newTransportTestServer(t, &hosts)
+	listener, path := listenUnix(t)
+	server.Listener = listener
+	server.StartTLS()
+
+	// the certificate of the DSM is still verified through the socket
+	sum := sha256.Sum256(server.Certificate().Raw)
+	dsm := &DSM{
+		Ip: "dsm.example.com", Port: 5001, Https: true,
+		TLS:       TLSOptions{Fingerprint: hex.EncodeToString(sum[:])},
+		Transport: TransportOptions{Type: TransportUnix, DialAddress: path},
+	}
+	assertTransportWorks(t, dsm, &hosts)
+
+	wrongPin := &DSM{
+		Ip: "dsm.example.com", Port: 5001, Https: true,
+		TLS:       TLSOptions{Fingerprint: hex.EncodeToString(make([]byte, sha256.Size))},
+		Transport: TransportOptions{Type: TransportUnix, DialAddress: path},
+	}
+	if err := wrongPin.Login(context.Background()); err == nil {
+		t.Errorf("Login() with a wrong certificate pin succeeded")
+	}
+}
+
+func TestTransport_dialAddress(t *testing.T) {
+	hosts := []string{}
+	server := newTransportTestServer(t, &hosts)
+	server.Start()
+
+	// e.g. the local end of an SSH tunnel to a DSM whose name doesn't resolve here
+	dsm := &DSM{Ip: "dsm.example.com", Port: 5001, Transport: TransportOptions{DialAddress: server.Listener.Addr().String()}}
+	assertTransportWorks(t, dsm, &hosts)
+}
+
+func TestTransport_dialer(t *testing.T) {
+	hosts := []string{}
+	server := newTransportTestServer(t, &hosts)
+	listener, path := listenUnix(t)
+	server.Listener = listener
+	server.Start()
+
+	dsm := &DSM{Ip: "dsm.example.com", Port: 5001, Dialer: &fixedDialer{network: "unix", address: path, dialer: &net.Dialer{}}}
+	assertTransportWorks(t, dsm, &hosts)
+}
+
+func TestTransportOptions_Validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    TransportOptions
+		wantErr bool
+	}{
+		{name: "default"},
+		{name: "tcp", opts: TransportOptions{Type: TransportTCP}},
+		{name: "tcp dial address", opts: TransportOptions{DialAddress: "127.0.0.1:15001"}},
+		{name: "tcp dial address without port", opts: TransportOptions{DialAddress: "127.0.0.1"}, wantErr: true},
+		{name: "unix", opts: TransportOptions{Type: TransportUnix, DialAddress: "/run/dsm/dsm.sock"}},
+		{name: "unix without socket", opts: TransportOptions{Type: TransportUnix}, wantErr: true},
+		{name: "unknown", opts: TransportOptions{Type: "ssh", DialAddress: "127.0.0.1:22"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.opts.Validate(); (err != nil) != tt.wantErr {
+				t.Errorf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestHttpClient_dialAddressWithProxy(t *testing.T) {
+	dsm := &DSM{
+		Ip: "dsm.example.com", Port: 5001,
+		Proxy:     ProxyOptions{URL: "http://proxy.example.net:3128"},
+		Transport: TransportOptions{DialAddress: "127.0.0.1:15001"},
+	}
+	if _, err := dsm.httpClient(); err == nil {
+		t.Errorf("httpClient() with a proxy and a dial address succeeded")
+	}
+}
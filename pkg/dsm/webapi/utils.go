@@ -3,6 +3,7 @@
 package webapi
 
 import (
+	"context"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	"net"
@@ -12,29 +13,30 @@ import (
 	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
 )
 
-func (dsm *DSM) IsUC() bool {
-	dsmSysInfo, err := dsm.DsmSystemInfoGet()
+func (dsm *DSM) IsUC(ctx context.Context) bool {
+	dsmSysInfo, err := dsm.DsmSystemInfoGet(ctx)
     if err != nil {
-        log.Errorf("Failed to get DSM[%s] system info", dsm.Ip)
+        log.WithContext(ctx).Errorf("Failed to get DSM[%s] system info", dsm.Ip)
         return false
     }
 	return strings.Contains(dsmSysInfo.FirmwareVer, "DSM UC")
 }
 
-func (dsm *DSM) GetAnotherController() (*DSM, error) {
+func (dsm *DSM) GetAnotherController(ctx context.Context) (*DSM, error) {
 	anotherDsm := &DSM{
 		Port:     dsm.Port,
 		Username: dsm.Username,
 		Password: dsm.Password,
 		Https:    dsm.Https,
+		TLS:      dsm.TLS,
 	}
 
-	netListA, err := dsm.NetworkInterfaceList("node0")
+	netListA, err := dsm.NetworkInterfaceList(ctx, "node0")
 	if err != nil {
 		return nil, fmt.Errorf("Failed to get DSM network list of controller A. %v", err)
 	}
 
-	netListB, err := dsm.NetworkInterfaceList("node1")
+	netListB, err := dsm.NetworkInterfaceList(ctx, "node1")
 	if err != nil {
 		return nil, fmt.Errorf("Failed to get DSM network list of controller B. %v", err)
 	}
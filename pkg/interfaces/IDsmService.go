@@ -3,6 +3,8 @@
 package interfaces
 
 import (
+	"context"
+
 	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/common"
 	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
 	"github.com/SynologyOpenSource/synology-csi/pkg/models"
@@ -15,16 +17,20 @@ type IDsmService interface {
 	RemoveAllDsms()
 	GetDsm(ip string) (*webapi.DSM, error)
 	GetDsmsCount() int
-	ListDsmVolumes(ip string) ([]webapi.VolInfo, error)
-	CreateVolume(spec *models.CreateK8sVolumeSpec) (*models.K8sVolumeRespSpec, error)
-	DeleteVolume(volId string) error
-	ListVolumes() []*models.K8sVolumeRespSpec
-	GetVolume(volId string) *models.K8sVolumeRespSpec
-	ExpandVolume(volId string, newSize int64) (*models.K8sVolumeRespSpec, error)
-	CreateSnapshot(spec *models.CreateK8sVolumeSnapshotSpec) (*models.K8sSnapshotRespSpec, error)
-	DeleteSnapshot(snapshotUuid string) error
-	ListAllSnapshots() []*models.K8sSnapshotRespSpec
-	ListSnapshots(volId string) []*models.K8sSnapshotRespSpec
-	GetVolumeByName(volName string) *models.K8sVolumeRespSpec
-	GetSnapshotByName(snapshotName string) *models.K8sSnapshotRespSpec
+	ListDsmVolumes(ctx context.Context, ip string) ([]webapi.VolInfo, error)
+	CreateVolume(ctx context.Context, spec *models.CreateK8sVolumeSpec) (*models.K8sVolumeRespSpec, error)
+	DeleteVolume(ctx context.Context, volId string) error
+	ListVolumes(ctx context.Context) []*models.K8sVolumeRespSpec
+	GetVolume(ctx context.Context, volId string) *models.K8sVolumeRespSpec
+	ExpandVolume(ctx context.Context, volId string, newSize int64) (*models.K8sVolumeRespSpec, error)
+	PublishVolume(ctx context.Context, volId string, iqn string, readonly bool) error
+	UnpublishVolume(ctx context.Context, volId string, iqn string) error
+	CreateSnapshot(ctx context.Context, spec *models.CreateK8sVolumeSnapshotSpec) (*models.K8sSnapshotRespSpec, error)
+	DeleteSnapshot(ctx context.Context, snapshotUuid string) error
+	ListAllSnapshots(ctx context.Context) []*models.K8sSnapshotRespSpec
+	ListSnapshots(ctx context.Context, volId string) []*models.K8sSnapshotRespSpec
+	GetSnapshotByUuid(ctx context.Context, snapshotUuid string) *models.K8sSnapshotRespSpec
+	GetVolumeByName(ctx context.Context, volName string) *models.K8sVolumeRespSpec
+	GetSnapshotByName(ctx context.Context, snapshotName string) *models.K8sSnapshotRespSpec
+	UnhealthyDsms() map[string]error
 }
\ No newline at end of file
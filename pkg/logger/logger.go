@@ -87,6 +87,7 @@ func setLogLevel(logLevel string) {	// debug, info, warn, error, fatal
 
 func Init(logLevel string) {
 	logrus.AddHook(NewCallerHook())
+	logrus.AddHook(&RequestIdHook{})
 	logrus.SetOutput(os.Stdout)
 	setLogLevel(logLevel)
 	logrus.SetFormatter(&nested.Formatter{
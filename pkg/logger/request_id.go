@@ -0,0 +1,54 @@
+// Copyright 2021 Synology Inc.
+
+package logger
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RequestIdField is the field of the log lines of a request which has an ID
+const RequestIdField = "reqId"
+
+type requestIdKey struct{}
+
+// NewRequestId returns a random ID for a request which didn't come with one
+func NewRequestId() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
+
+// WithRequestId returns ctx carrying the correlation ID of the request it belongs to
+func WithRequestId(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIdKey{}, id)
+}
+
+// RequestId returns the correlation ID of ctx, empty if it has none
+func RequestId(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+// RequestIdHook adds the correlation ID of the context of a log entry, logged with
+// logrus.WithContext(ctx), to its fields
+type RequestIdHook struct{}
+
+func (hook *RequestIdHook) Fire(entry *logrus.Entry) error {
+	if id := RequestId(entry.Context); id != "" {
+		entry.Data[RequestIdField] = id
+	}
+	return nil
+}
+
+func (hook *RequestIdHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
@@ -4,6 +4,7 @@ package models
 
 import (
 	"fmt"
+	"strings"
 )
 
 const (
@@ -18,6 +19,10 @@ const (
 	LunTypeBlun      = "BLUN"               // thin provision, mapped to type 263
 	LunTypeBlunThick = "BLUN_THICK"         // thick provision, mapped to type 259
 	MaxIqnLen = 128
+	MaxLunDescLen = 127
+	MaxLunNameLen = 128
+	LunBlockSize512 = 512
+	LunBlockSize4Kn = 4096
 
 	// Share definitions
 	MaxShareLen     = 32
@@ -29,16 +34,55 @@ const (
 
 	// CSI definitions
 	TargetPrefix            = "k8s-csi"
+	// SharedTargetPrefix names the targets shared by LUNs, the underscore can't be in a PV name
+	SharedTargetPrefix      = "k8s-csi_shared-"
 	LunPrefix               = "k8s-csi"
 	IqnPrefix               = "iqn.2000-01.com.synology:"
 	SharePrefix             = "k8s-csi"
 	ShareSnapshotDescPrefix = "(Do not change)"
+	DryRunVolumePrefix      = "dry-run-"
 )
 
 func GenLunName(volName string) string {
 	return fmt.Sprintf("%s-%s", LunPrefix, volName)
 }
 
+func GenTargetName(volName string) string {
+	return fmt.Sprintf("%s-%s", TargetPrefix, volName)
+}
+
+// GenSharedTargetName names the index-th target shared by LUNs, starting at 1
+func GenSharedTargetName(index int) string {
+	return fmt.Sprintf("%s%d", SharedTargetPrefix, index)
+}
+
+// GenLunDescription tells which PVC and PV a LUN backs, cut to the length DSM accepts
+func GenLunDescription(pvcNamespace string, pvcName string, pvName string) string {
+	desc := ""
+	if pvcName != "" {
+		desc = pvcNamespace + "/" + pvcName
+	}
+	if pvName != "" {
+		if desc != "" {
+			desc += " "
+		}
+		desc += "(" + pvName + ")"
+	}
+	if len(desc) > MaxLunDescLen {
+		return desc[:MaxLunDescLen]
+	}
+	return desc
+}
+
+// LunDescriptionNamespace returns the PVC namespace in a description made by GenLunDescription
+func LunDescriptionNamespace(desc string) string {
+	namespace, _, found := strings.Cut(desc, "/")
+	if !found {
+		return ""
+	}
+	return namespace
+}
+
 func GenShareName(volName string) string {
 	shareName := fmt.Sprintf("%s-%s", SharePrefix, volName)
 	if len(shareName) > MaxShareLen {
@@ -46,3 +90,52 @@ func GenShareName(volName string) string {
 	}
 	return shareName
 }
+
+// lunTypesByFsType are the LUN types DSM can create on a volume of each fs type,
+// mapped to whether they are thin provisioned
+var lunTypesByFsType = map[string]map[string]bool{
+	FsTypeExt4:  {LunTypeFile: false, LunTypeThin: true, LunTypeAdv: true},
+	FsTypeBtrfs: {LunTypeBlun: true, LunTypeBlunThick: false},
+}
+
+// IsThinLunType tells if lunType is thin provisioned, it fails for unknown types
+func IsThinLunType(lunType string) (bool, error) {
+	for _, types := range lunTypesByFsType {
+		if thin, ok := types[lunType]; ok {
+			return thin, nil
+		}
+	}
+	return false, fmt.Errorf("Unknown LUN type: %s", lunType)
+}
+
+// snapshotLunTypes are the LUN types DSM can take snapshots of, the other ones are legacy
+// LUNs without advanced features
+var snapshotLunTypes = map[string]bool{LunTypeAdv: true, LunTypeBlun: true, LunTypeBlunThick: true}
+
+// LunTypeSupportsSnapshots tells if DSM can take snapshots of a LUN of lunType
+func LunTypeSupportsSnapshots(lunType string) bool {
+	return snapshotLunTypes[lunType]
+}
+
+// lunTypeIds are the LUN types DSM reports by number, the driver only knows those of Btrfs LUNs
+var lunTypeIds = map[int]string{263: LunTypeBlun, 259: LunTypeBlunThick}
+
+// LunTypeName returns the LUN type of the type number DSM reports, empty if it isn't known
+func LunTypeName(id int) string {
+	return lunTypeIds[id]
+}
+
+// shrinkLunTypes are the LUN types DSM can shrink. Only thin Btrfs LUNs are trusted, thick
+// LUNs and legacy ext4 LUNs are refused.
+var shrinkLunTypes = map[string]bool{LunTypeBlun: true}
+
+// LunTypeSupportsShrink tells if DSM can shrink a LUN of lunType
+func LunTypeSupportsShrink(lunType string) bool {
+	return shrinkLunTypes[lunType]
+}
+
+// IsLunTypeSupported tells if a LUN of lunType can be created on a volume of fsType
+func IsLunTypeSupported(lunType string, fsType string) bool {
+	_, ok := lunTypesByFsType[fsType][lunType]
+	return ok
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
+	"github.com/SynologyOpenSource/synology-csi/pkg/utils"
 )
 
 type CreateK8sVolumeSpec struct {
@@ -18,6 +19,8 @@ type CreateK8sVolumeSpec struct {
 	Size             int64
 	Type             string
 	ThinProvisioning bool
+	// Snapshots requires a LUN type DSM can take snapshots of
+	Snapshots        bool
 	TargetName       string
 	MultipleSession  bool
 	SourceSnapshotId string
@@ -25,6 +28,83 @@ type CreateK8sVolumeSpec struct {
 	Protocol         string
 	NfsVersion       string
 	DevAttribs       map[string]bool
+	Chap             *ChapCredentials
+	// DryRun validates the spec against DSM without changing anything
+	DryRun           bool
+	// Sites are the topology sites the volume may be placed in, most preferred
+	// first. Empty allows any DSM.
+	Sites            []string
+	// Qos limits the IOPS and throughput of the LUN, unset is unlimited
+	Qos              webapi.LunQos
+	// BlockSize is the logical block size of the LUN in bytes, 0 is the DSM default
+	BlockSize        int
+	// NfsExport configures the NFS privilege rules of the share, nil keeps the defaults
+	NfsExport        *NfsExportOptions
+	// EncryptionPassphrase encrypts the share, which is unencrypted if it is empty
+	EncryptionPassphrase webapi.Passphrase
+	// Profile is the credential profile of the DSMs the volume may be created on, "" for
+	// the DSMs without profile
+	Profile          string
+	// ParentShare is the existing NFS share the volume is a subdirectory of, named SubDir.
+	// SubDirOnDelete is what DeleteVolume does with it, SubDirDelete or SubDirRetain.
+	ParentShare      string
+	SubDir           string
+	SubDirOnDelete   string
+}
+
+// NfsExportOptions are the NFS privilege rule settings of a share
+type NfsExportOptions struct {
+	// Clients are the IPs or CIDRs allowed to mount the share, empty allows the nodes
+	Clients    []string
+	RootSquash string
+	ReadOnly   bool
+	Sync       bool
+}
+
+// PrivilegeRules returns the NFS privilege rules of the share, one per client.
+// nodeIps are used if no client is configured.
+func (o *NfsExportOptions) PrivilegeRules(nodeIps []string) []webapi.PrivilegeRule {
+	opts := NfsExportOptions{RootSquash: webapi.NfsRootSquashNoMapping}
+	if o != nil {
+		opts = *o
+	}
+	clients := opts.Clients
+	if len(clients) == 0 {
+		clients = nodeIps
+	}
+	privilege := utils.AuthTypeReadWrite
+	if opts.ReadOnly {
+		privilege = utils.AuthTypeReadOnly
+	}
+
+	rules := []webapi.PrivilegeRule{}
+	for _, client := range clients {
+		rules = append(rules, webapi.PrivilegeRule{
+			Async:      !opts.Sync,
+			Client:     client,
+			Crossmnt:   true,
+			Insecure:   true,
+			Privilege:  string(privilege),
+			RootSquash: opts.RootSquash,
+			SecurityFlavor: webapi.SecurityFlavor{
+				Sys: true,
+			},
+		})
+	}
+	return rules
+}
+
+// ChapCredentials authenticate the initiator to the target, and with Mutual
+// set also the target to the initiator
+type ChapCredentials struct {
+	User           string
+	Password       string
+	MutualUser     string
+	MutualPassword string
+}
+
+func (c *ChapCredentials) Mutual() bool {
+	return c.MutualUser != ""
 }
 
 type K8sVolumeRespSpec struct {
@@ -39,6 +119,22 @@ type K8sVolumeRespSpec struct {
 	Share             webapi.ShareInfo
 	Protocol          string
 	BaseDir           string
+	// SubDir is the subdirectory of the share in BaseDir the volume is, empty for a whole share
+	SubDir            string
+}
+
+// LunMappingIndex returns the LUN number of the volume within its target, which is
+// shared by other LUNs when the driver maps several LUNs to each target
+func (v *K8sVolumeRespSpec) LunMappingIndex() int {
+	for _, mapping := range v.Target.MappedLuns {
+		if mapping.LunUuid == v.Lun.Uuid {
+			return mapping.MappingIndex
+		}
+	}
+	if len(v.Target.MappedLuns) > 0 {
+		return v.Target.MappedLuns[0].MappingIndex
+	}
+	return 0
 }
 
 type K8sSnapshotRespSpec struct {
@@ -47,12 +143,28 @@ type K8sSnapshotRespSpec struct {
 	Uuid              string
 	ParentName        string
 	ParentUuid        string
+	ParentVolumeId    string // ID of the volume of the parent, in the version of the driver
 	Status            string
 	SizeInBytes       int64
+	UsedSizeInBytes   int64 // space consumed by the snapshot, 0 if DSM doesn't tell
 	CreateTime        int64
 	Time              string // only for share snapshot delete
 	RootPath          string
 	Protocol          string
+	IsLocked          bool
+}
+
+// SourceVolumeId returns the ID of the volume of the parent, its UUID if it isn't known
+func (s *K8sSnapshotRespSpec) SourceVolumeId() string {
+	if s.ParentVolumeId != "" {
+		return s.ParentVolumeId
+	}
+	return s.ParentUuid
+}
+
+// IsReady tells if DSM completed the snapshot, so it can be restored
+func (s *K8sSnapshotRespSpec) IsReady() bool {
+	return s.Status == "Healthy"
 }
 
 type CreateK8sVolumeSnapshotSpec struct {
@@ -70,6 +182,12 @@ type NodeStageVolumeSpec struct {
 	Dsm               string
 	Source            string
 	FormatOptions     string
+	FsType            string
+	FsckMode          string
+	Chap              *ChapCredentials
+	SpaceReclamation  bool
+	Discard           bool
+	NfsExport         *NfsExportOptions
 }
 
 type ByVolumeId []*K8sVolumeRespSpec
@@ -0,0 +1,177 @@
+// Copyright 2021 Synology Inc.
+
+package models
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Versions of the volume IDs. A volume keeps the ID it was created with for its whole life,
+// so every version ever written must still be decoded.
+const (
+	// VolumeIdV0 is the UUID of the LUN or share alone, the IDs of the volumes created
+	// before IDs were versioned
+	VolumeIdV0 = 0
+	// VolumeIdV1 is "v1:<type>:<uuid>:<dsm>", the DSM last as IPv6 addresses have colons.
+	// Subdirectories of a share are "v1:subdir:<share uuid>:<subdir>:<onDelete>:<dsm>".
+	VolumeIdV1 = 1
+
+	VolumeIdLatest = VolumeIdV1
+)
+
+// Types of the volumes in their IDs. SMB and NFS shares aren't told apart, as the protocol
+// of a share is only known from its NFS rules, which may be saved after it is created.
+const (
+	VolumeIdTypeLun    = "lun"
+	VolumeIdTypeShare  = "share"
+	VolumeIdTypeSubDir = "subdir" // a subdirectory of an NFS share
+)
+
+// What DeleteVolume does with the subdirectory of a volume, as DSM keeps its contents
+// once deleted nowhere but in the snapshots of the share
+const (
+	SubDirDelete = "delete"
+	SubDirRetain = "retain"
+)
+
+// maxVolumeIdLength is the longest volume ID CSI allows
+const maxVolumeIdLength = 128
+
+// volumeIdVersionPrefix starts the IDs of version 1 and later, which UUIDs can't start with
+const volumeIdVersionPrefix = "v"
+
+// VolumeIdSpec is what a volume ID tells about its volume. The fields a version doesn't
+// encode are empty.
+type VolumeIdSpec struct {
+	Version int
+	Type    string // VolumeIdTypeLun, VolumeIdTypeShare or VolumeIdTypeSubDir
+	Uuid    string // of the LUN or share
+	DsmIp   string
+	// SubDir is the subdirectory in the share of the volumes of VolumeIdTypeSubDir, and
+	// OnDelete what DeleteVolume does with it, SubDirDelete or SubDirRetain
+	SubDir   string
+	OnDelete string
+}
+
+// EncodeVolumeID returns the ID of the volume in the format of spec.Version
+func EncodeVolumeID(spec VolumeIdSpec) (string, error) {
+	if spec.Uuid == "" {
+		return "", fmt.Errorf("Volume ID has no UUID")
+	}
+
+	switch spec.Version {
+	case VolumeIdV0:
+		if spec.Type == VolumeIdTypeSubDir {
+			return "", fmt.Errorf("Volume ID v0 can't encode a subdirectory, got %+v", spec)
+		}
+		return spec.Uuid, nil
+	case VolumeIdV1:
+		if spec.Type != VolumeIdTypeLun && spec.Type != VolumeIdTypeShare && spec.Type != VolumeIdTypeSubDir {
+			return "", fmt.Errorf("Unknown volume type %q", spec.Type)
+		}
+		if spec.DsmIp == "" {
+			return "", fmt.Errorf("Volume ID v1 needs a DSM, got %+v", spec)
+		}
+		if strings.Contains(spec.Uuid, ":") {
+			return "", fmt.Errorf("UUID of a volume ID v1 can't have colons, got %+v", spec)
+		}
+		if spec.Type != VolumeIdTypeSubDir {
+			return strings.Join([]string{volumeIdVersionPrefix + "1", spec.Type, spec.Uuid, spec.DsmIp}, ":"), nil
+		}
+		if err := ValidateSubDir(spec.SubDir); err != nil {
+			return "", err
+		}
+		if spec.OnDelete != SubDirDelete && spec.OnDelete != SubDirRetain {
+			return "", fmt.Errorf("Unknown onDelete %q of subdirectory %s", spec.OnDelete, spec.SubDir)
+		}
+		id := strings.Join([]string{volumeIdVersionPrefix + "1", spec.Type, spec.Uuid, spec.SubDir, spec.OnDelete, spec.DsmIp}, ":")
+		if len(id) > maxVolumeIdLength {
+			return "", fmt.Errorf("Volume ID %s is longer than %d bytes, the subdirectory must be shorter", id, maxVolumeIdLength)
+		}
+		return id, nil
+	}
+	return "", fmt.Errorf("Unsupported volume ID version %d", spec.Version)
+}
+
+// DecodeVolumeID returns what the ID of a volume tells, whichever version wrote it
+func DecodeVolumeID(id string) (VolumeIdSpec, error) {
+	if id == "" {
+		return VolumeIdSpec{}, fmt.Errorf("Volume ID is empty")
+	}
+
+	version, fields, versioned := parseVolumeIdVersion(id)
+	if !versioned {
+		return VolumeIdSpec{Version: VolumeIdV0, Uuid: id}, nil
+	}
+
+	switch version {
+	case VolumeIdV1:
+		if strings.HasPrefix(fields, VolumeIdTypeSubDir+":") {
+			return decodeSubDirVolumeID(id, strings.TrimPrefix(fields, VolumeIdTypeSubDir+":"))
+		}
+		parts := strings.SplitN(fields, ":", 3)
+		if len(parts) != 3 || (parts[0] != VolumeIdTypeLun && parts[0] != VolumeIdTypeShare) || parts[1] == "" || parts[2] == "" {
+			return VolumeIdSpec{}, fmt.Errorf("Malformed volume ID v1: %s", id)
+		}
+		return VolumeIdSpec{Version: VolumeIdV1, Type: parts[0], Uuid: parts[1], DsmIp: parts[2]}, nil
+	}
+	return VolumeIdSpec{}, fmt.Errorf("Volume ID %s has version %d, which is newer than this driver supports", id, version)
+}
+
+// decodeSubDirVolumeID decodes the fields of a subdirectory after "v1:subdir:"
+func decodeSubDirVolumeID(id string, fields string) (VolumeIdSpec, error) {
+	parts := strings.SplitN(fields, ":", 4)
+	if len(parts) != 4 || parts[0] == "" || ValidateSubDir(parts[1]) != nil ||
+		(parts[2] != SubDirDelete && parts[2] != SubDirRetain) || parts[3] == "" {
+		return VolumeIdSpec{}, fmt.Errorf("Malformed volume ID v1: %s", id)
+	}
+	return VolumeIdSpec{Version: VolumeIdV1, Type: VolumeIdTypeSubDir, Uuid: parts[0], SubDir: parts[1], OnDelete: parts[2], DsmIp: parts[3]}, nil
+}
+
+// ValidateSubDir checks that a subdirectory is a single directory name the volume IDs can hold
+func ValidateSubDir(subDir string) error {
+	if subDir == "" || subDir == "." || subDir == ".." || strings.ContainsAny(subDir, "/:") {
+		return fmt.Errorf("Invalid subdirectory %q, must be a directory name without slashes or colons", subDir)
+	}
+	return nil
+}
+
+// parseVolumeIdVersion splits "v<version>:<fields>", versioned is false for the IDs of version 0
+func parseVolumeIdVersion(id string) (version int, fields string, versioned bool) {
+	head, fields, found := strings.Cut(id, ":")
+	if !found || !strings.HasPrefix(head, volumeIdVersionPrefix) {
+		return VolumeIdV0, "", false
+	}
+	version, err := strconv.Atoi(strings.TrimPrefix(head, volumeIdVersionPrefix))
+	if err != nil || version < 1 {
+		return VolumeIdV0, "", false
+	}
+	return version, fields, true
+}
+
+// SameVolume tells if two IDs, maybe of different versions, are of the same volume
+func SameVolume(id1, id2 string) bool {
+	if id1 == id2 {
+		return true
+	}
+	spec1, err1 := DecodeVolumeID(id1)
+	spec2, err2 := DecodeVolumeID(id2)
+	if err1 != nil || err2 != nil {
+		return false
+	}
+	return spec1.Matches(spec2)
+}
+
+// Matches tells if both specs may be of the same volume, the fields a version doesn't
+// encode matching any value
+func (spec VolumeIdSpec) Matches(other VolumeIdSpec) bool {
+	if spec.Uuid != other.Uuid || spec.SubDir != other.SubDir {
+		return false
+	}
+	if spec.Type != "" && other.Type != "" && spec.Type != other.Type {
+		return false
+	}
+	return spec.DsmIp == "" || other.DsmIp == "" || spec.DsmIp == other.DsmIp
+}
@@ -0,0 +1,112 @@
+package models
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodeVolumeID(t *testing.T) {
+	tests := []struct {
+		name    string
+		id      string
+		want    VolumeIdSpec
+		wantErr bool
+	}{
+		// v0, the IDs of the volumes created before versioning
+		{name: "v0 lun", id: "3c4a5f2e-1b8d-4e6a-9c0f-7d2b1a3e5f60", want: VolumeIdSpec{Uuid: "3c4a5f2e-1b8d-4e6a-9c0f-7d2b1a3e5f60"}},
+		{name: "v0 dry run", id: DryRunVolumePrefix + "pvc-1", want: VolumeIdSpec{Uuid: DryRunVolumePrefix + "pvc-1"}},
+		{name: "v0 with colon", id: "vendor:uuid", want: VolumeIdSpec{Uuid: "vendor:uuid"}},
+		{
+			name: "v1 lun",
+			id:   "v1:lun:3c4a5f2e-1b8d-4e6a-9c0f-7d2b1a3e5f60:10.0.0.1",
+			want: VolumeIdSpec{Version: VolumeIdV1, Type: VolumeIdTypeLun, Uuid: "3c4a5f2e-1b8d-4e6a-9c0f-7d2b1a3e5f60", DsmIp: "10.0.0.1"},
+		},
+		{
+			name: "v1 share on ipv6",
+			id:   "v1:share:share-uuid:fd00::1",
+			want: VolumeIdSpec{Version: VolumeIdV1, Type: VolumeIdTypeShare, Uuid: "share-uuid", DsmIp: "fd00::1"},
+		},
+		{
+			name: "v1 subdir",
+			id:   "v1:subdir:share-uuid:pvc-1:retain:10.0.0.1",
+			want: VolumeIdSpec{Version: VolumeIdV1, Type: VolumeIdTypeSubDir, Uuid: "share-uuid", DsmIp: "10.0.0.1", SubDir: "pvc-1", OnDelete: SubDirRetain},
+		},
+		{name: "empty", id: "", wantErr: true},
+		{name: "v1 without dsm", id: "v1:lun:uuid", wantErr: true},
+		{name: "v1 unknown type", id: "v1:disk:uuid:10.0.0.1", wantErr: true},
+		{name: "v1 subdir without onDelete", id: "v1:subdir:share-uuid:pvc-1:10.0.0.1", wantErr: true},
+		{name: "v1 subdir escaping the share", id: "v1:subdir:share-uuid:..:delete:10.0.0.1", wantErr: true},
+		{name: "newer version", id: "v2:lun:uuid:10.0.0.1:pool", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := DecodeVolumeID(tt.id)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("DecodeVolumeID(%q) error = %v, wantErr %v", tt.id, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("DecodeVolumeID(%q) = %+v, want %+v", tt.id, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncodeVolumeID(t *testing.T) {
+	for _, spec := range []VolumeIdSpec{
+		{Version: VolumeIdV0, Uuid: "lun-uuid"},
+		{Version: VolumeIdV1, Type: VolumeIdTypeLun, Uuid: "lun-uuid", DsmIp: "10.0.0.1"},
+		{Version: VolumeIdV1, Type: VolumeIdTypeShare, Uuid: "share-uuid", DsmIp: "fd00::1"},
+		{Version: VolumeIdV1, Type: VolumeIdTypeSubDir, Uuid: "share-uuid", DsmIp: "fd00::1", SubDir: "pvc-1", OnDelete: SubDirDelete},
+	} {
+		id, err := EncodeVolumeID(spec)
+		if err != nil {
+			t.Fatalf("EncodeVolumeID(%+v) error = %v", spec, err)
+		}
+		if got, err := DecodeVolumeID(id); err != nil || got != spec {
+			t.Errorf("DecodeVolumeID(EncodeVolumeID(%+v)) = %+v, %v", spec, got, err)
+		}
+	}
+
+	for _, spec := range []VolumeIdSpec{
+		{Version: VolumeIdV1, Type: VolumeIdTypeLun, DsmIp: "10.0.0.1"},
+		{Version: VolumeIdV1, Type: VolumeIdTypeLun, Uuid: "lun-uuid"},
+		{Version: VolumeIdV1, Type: "iscsi", Uuid: "lun-uuid", DsmIp: "10.0.0.1"},
+		{Version: VolumeIdLatest + 1, Type: VolumeIdTypeLun, Uuid: "lun-uuid", DsmIp: "10.0.0.1"},
+		{Version: VolumeIdV0, Type: VolumeIdTypeSubDir, Uuid: "share-uuid", SubDir: "pvc-1", OnDelete: SubDirDelete},
+		{Version: VolumeIdV1, Type: VolumeIdTypeSubDir, Uuid: "share-uuid", DsmIp: "10.0.0.1", SubDir: "a/b", OnDelete: SubDirDelete},
+		{Version: VolumeIdV1, Type: VolumeIdTypeSubDir, Uuid: "share-uuid", DsmIp: "10.0.0.1", SubDir: "pvc-1"},
+		{Version: VolumeIdV1, Type: VolumeIdTypeSubDir, Uuid: "share-uuid", DsmIp: "10.0.0.1", SubDir: strings.Repeat("d", 100), OnDelete: SubDirDelete},
+	} {
+		if id, err := EncodeVolumeID(spec); err == nil {
+			t.Errorf("EncodeVolumeID(%+v) = %q, want an error", spec, id)
+		}
+	}
+
+	// CSI limits volume IDs to 128 bytes
+	long := VolumeIdSpec{Version: VolumeIdLatest, Type: VolumeIdTypeShare, Uuid: strings.Repeat("f", 36), DsmIp: "fd00:1234:5678:9abc:def0:1234:5678:9abc"}
+	if id, _ := EncodeVolumeID(long); len(id) > 128 {
+		t.Errorf("EncodeVolumeID() = %q, longer than 128 bytes", id)
+	}
+}
+
+func TestSameVolume(t *testing.T) {
+	tests := []struct {
+		id1, id2 string
+		want     bool
+	}{
+		{id1: "lun-uuid", id2: "lun-uuid", want: true},
+		{id1: "lun-uuid", id2: "v1:lun:lun-uuid:10.0.0.1", want: true},
+		{id1: "v1:lun:lun-uuid:10.0.0.1", id2: "v1:lun:lun-uuid:10.0.0.2", want: false},
+		{id1: "v1:lun:uuid:10.0.0.1", id2: "v1:share:uuid:10.0.0.1", want: false},
+		{id1: "lun-uuid", id2: "other-uuid", want: false},
+		{id1: "", id2: "v1:lun:lun-uuid:10.0.0.1", want: false},
+		// the subdirectories of a share aren't the share
+		{id1: "share-uuid", id2: "v1:subdir:share-uuid:pvc-1:delete:10.0.0.1", want: false},
+		{id1: "v1:subdir:share-uuid:pvc-1:delete:10.0.0.1", id2: "v1:subdir:share-uuid:pvc-2:delete:10.0.0.1", want: false},
+	}
+	for _, tt := range tests {
+		if got := SameVolume(tt.id1, tt.id2); got != tt.want {
+			t.Errorf("SameVolume(%q, %q) = %v, want %v", tt.id1, tt.id2, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright 2021 Synology Inc.
+ */
+
+package tracing
+
+import (
+	"context"
+	"os"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+)
+
+// ServiceName is the service.name of the spans of the driver
+const ServiceName = "synology-csi"
+
+const instrumentationName = "github.com/SynologyOpenSource/synology-csi"
+
+// Attributes of the spans
+const (
+	AttrVolumeId   = attribute.Key("csi.volume_id")
+	AttrVolumeName = attribute.Key("csi.volume_name")
+	AttrSnapshotId = attribute.Key("csi.snapshot_id")
+	AttrDsmHost    = attribute.Key("dsm.host")
+	AttrDsmApi     = attribute.Key("dsm.api")
+	AttrDsmMethod  = attribute.Key("dsm.method")
+	AttrDsmError   = attribute.Key("dsm.error_code")
+)
+
+// Enabled tells if the spans are exported, to endpoint or to the OTLP endpoint of the
+// environment. Without one the global provider stays the no-op one of OpenTelemetry.
+func Enabled(endpoint string) bool {
+	return endpoint != "" || os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" || os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") != ""
+}
+
+// Init exports the spans to the OTLP gRPC collector at endpoint, a host:port, or at the one
+// of the OTEL_EXPORTER_OTLP_* environment variables if it is empty. insecure disables TLS
+// to the collector. The returned function flushes the remaining spans, it does nothing if
+// tracing isn't Enabled.
+func Init(ctx context.Context, endpoint string, insecure bool) (func(context.Context) error, error) {
+	if !Enabled(endpoint) {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	opts := []otlptracegrpc.Option{}
+	if endpoint != "" {
+		opts = append(opts, otlptracegrpc.WithEndpoint(endpoint))
+	}
+	if insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	exporter, err := otlptracegrpc.New(ctx, opts...)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName(ServiceName))),
+	)
+	SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// SetTracerProvider makes provider the one of the spans of the driver and propagates the
+// W3C trace context of the callers which send one
+func SetTracerProvider(provider trace.TracerProvider) {
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+}
+
+// Start starts a span of the driver, a child of the span of ctx if it has one
+func Start(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End records err, if any, on span and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// metadataCarrier reads the trace context of the gRPC metadata of a call
+type metadataCarrier metadata.MD
+
+func (c metadataCarrier) Get(key string) string {
+	if values := metadata.MD(c).Get(key); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+func (c metadataCarrier) Set(key, value string) { metadata.MD(c).Set(key, value) }
+
+func (c metadataCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// ExtractGRPC returns ctx with the span of the caller of a gRPC call, if its metadata has one
+func ExtractGRPC(ctx context.Context) context.Context {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ctx
+	}
+	return otel.GetTextMapPropagator().Extract(ctx, metadataCarrier(md))
+}
@@ -4,6 +4,9 @@ package utils
 
 import (
 	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type OutOfFreeSpaceError string
@@ -24,6 +27,17 @@ type ShareSystemBusyError string
 type ShareDefaultError struct {
 	ErrCode int
 }
+type NoSuchFileError string
+type DsmError struct {
+	Code int   // error code of the DSM response
+	Err  error // the meaning of Code, nil if it isn't known
+}
+type ApiVersionError struct {
+	Api        string
+	Versions   []int // versions the driver can send
+	MinVersion int   // range of versions DSM supports
+	MaxVersion int
+}
 
 func (_ OutOfFreeSpaceError) Error() string {
 	return "Out of free space"
@@ -80,3 +94,29 @@ func (_ ShareSystemBusyError) Error() string {
 func (e ShareDefaultError) Error() string {
 	return fmt.Sprintf("Share API error. Error code: %d", e.ErrCode)
 }
+
+// File Station errors
+func (_ NoSuchFileError) Error() string {
+	return "No such file or directory"
+}
+
+// API errors
+func (e DsmError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("DSM Api error. Error code:%d", e.Code)
+	}
+	return fmt.Sprintf("%v (DSM error code %d)", e.Err, e.Code)
+}
+
+func (e DsmError) Unwrap() error {
+	return e.Err
+}
+
+func (e ApiVersionError) Error() string {
+	return fmt.Sprintf("DSM supports versions %d to %d of %s, but the driver needs one of %v", e.MinVersion, e.MaxVersion, e.Api, e.Versions)
+}
+
+// GRPCStatus makes the CSI calls failing on an unsupported API fail with FailedPrecondition
+func (e ApiVersionError) GRPCStatus() *status.Status {
+	return status.New(codes.FailedPrecondition, e.Error())
+}
@@ -0,0 +1,76 @@
+package hostexec
+
+import (
+	"sync"
+	"time"
+)
+
+// defaultCacheTTL bounds how long a lookup result is trusted, so binaries
+// installed on the host after startup are eventually picked up
+const defaultCacheTTL = 5 * time.Minute
+
+// envCacheKey is the cache key for the /usr/bin/env existence check. It can't
+// collide with a command name because those never contain a NUL byte.
+const envCacheKey = "\x00env"
+
+// CacheInvalidator is implemented by executors that memoize command lookups
+type CacheInvalidator interface {
+	InvalidateCache()
+}
+
+type lookupEntry struct {
+	path    string
+	found   bool
+	expires time.Time
+}
+
+// lookupCache memoizes filesystem probes made while resolving commands. It is
+// safe for concurrent use.
+type lookupCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	now     func() time.Time
+	entries map[string]lookupEntry
+}
+
+func newLookupCache(ttl time.Duration) *lookupCache {
+	return &lookupCache{
+		ttl:     ttl,
+		now:     time.Now,
+		entries: make(map[string]lookupEntry),
+	}
+}
+
+func (c *lookupCache) get(key string) (lookupEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return lookupEntry{}, false
+	}
+	if c.now().After(e.expires) {
+		delete(c.entries, key)
+		return lookupEntry{}, false
+	}
+
+	return e, true
+}
+
+func (c *lookupCache) put(key string, path string, found bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries[key] = lookupEntry{
+		path:    path,
+		found:   found,
+		expires: c.now().Add(c.ttl),
+	}
+}
+
+func (c *lookupCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[string]lookupEntry)
+}
@@ -0,0 +1,152 @@
+package hostexec
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"k8s.io/utils/exec"
+)
+
+// Invocation is a command as it would have been executed on the host, after
+// command mapping and chroot/env wrapping
+type Invocation struct {
+	Cmd  string
+	Args []string
+}
+
+// FakeResult is the programmed outcome of a single fake command
+type FakeResult struct {
+	Output []byte
+	Err    error
+	// Delay is how long the command runs. A command run with a context is
+	// killed when the context is done first.
+	Delay time.Duration
+}
+
+// Fake is an Executor that applies the same wrapping as the real one but only
+// records the resulting invocations instead of running them
+type Fake struct {
+	*hostexec
+	rec *recorder
+}
+
+// NewFake returns a recording Executor. Unlike New it does not require the
+// chroot directory to exist.
+func NewFake(cmdMap map[string]string, chrootDir string, opts ...Option) *Fake {
+	rec := &recorder{}
+	h := &hostexec{
+		Executor:   rec,
+		commandMap: cmdMap,
+		chrootDir:  chrootDir,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	return &Fake{hostexec: h, rec: rec}
+}
+
+// Respond queues results that are returned by the next commands in order.
+// Commands run with an empty queue succeed without output.
+func (f *Fake) Respond(results ...FakeResult) {
+	f.rec.mu.Lock()
+	defer f.rec.mu.Unlock()
+
+	f.rec.results = append(f.rec.results, results...)
+}
+
+// Invocations returns the commands created so far
+func (f *Fake) Invocations() []Invocation {
+	f.rec.mu.Lock()
+	defer f.rec.mu.Unlock()
+
+	return append([]Invocation(nil), f.rec.invocations...)
+}
+
+// recorder is the exec.Interface behind Fake
+type recorder struct {
+	mu          sync.Mutex
+	invocations []Invocation
+	results     []FakeResult
+}
+
+func (r *recorder) Command(cmd string, args ...string) exec.Cmd {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.invocations = append(r.invocations, Invocation{Cmd: cmd, Args: append([]string(nil), args...)})
+
+	var res FakeResult
+	if len(r.results) > 0 {
+		res, r.results = r.results[0], r.results[1:]
+	}
+
+	return &fakeCmd{ctx: context.Background(), result: res}
+}
+
+func (r *recorder) CommandContext(ctx context.Context, cmd string, args ...string) exec.Cmd {
+	c := r.Command(cmd, args...).(*fakeCmd)
+	c.ctx = ctx
+	return c
+}
+
+func (r *recorder) LookPath(file string) (string, error) {
+	return file, nil
+}
+
+// fakeCmd replays a FakeResult
+type fakeCmd struct {
+	ctx    context.Context
+	result FakeResult
+	stdout io.Writer
+}
+
+// output replays the result once its delay passed, or returns the error of the
+// context killing the command first
+func (c *fakeCmd) output() ([]byte, error) {
+	if c.result.Delay > 0 {
+		timer := time.NewTimer(c.result.Delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-c.ctx.Done():
+			return nil, c.ctx.Err()
+		}
+	}
+	return c.result.Output, c.result.Err
+}
+
+func (c *fakeCmd) wait() error {
+	_, err := c.output()
+	return err
+}
+
+func (c *fakeCmd) Run() error {
+	out, err := c.output()
+	if c.stdout != nil && out != nil {
+		if _, err := c.stdout.Write(out); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+func (c *fakeCmd) CombinedOutput() ([]byte, error) { return c.output() }
+func (c *fakeCmd) Output() ([]byte, error)         { return c.output() }
+func (c *fakeCmd) SetDir(string)                   {}
+func (c *fakeCmd) SetStdin(io.Reader)              {}
+func (c *fakeCmd) SetStdout(out io.Writer)         { c.stdout = out }
+func (c *fakeCmd) SetStderr(io.Writer)             {}
+func (c *fakeCmd) SetEnv([]string)                 {}
+func (c *fakeCmd) StdoutPipe() (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(c.result.Output)), nil
+}
+func (c *fakeCmd) StderrPipe() (io.ReadCloser, error) {
+	return io.NopCloser(bytes.NewReader(nil)), nil
+}
+func (c *fakeCmd) Start() error { return nil }
+func (c *fakeCmd) Wait() error  { return c.wait() }
+func (c *fakeCmd) Stop()        {}
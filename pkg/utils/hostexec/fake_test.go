@@ -0,0 +1,60 @@
+package hostexec
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	f := NewFake(map[string]string{"iscsiadm": "/sbin/iscsiadm"}, "/nonexistent-host")
+	f.Respond(
+		FakeResult{Output: []byte("tcp: [1] 10.0.0.1:3260,1 iqn.2000-01.com.synology:test")},
+		FakeResult{Err: errors.New("exit status 21")},
+	)
+
+	out, err := f.Command("iscsiadm", "-m", "session").CombinedOutput()
+	if err != nil || len(out) == 0 {
+		t.Errorf("CombinedOutput() = %q, %v, want programmed output", out, err)
+	}
+	if _, err := f.Command("iscsiadm", "-m", "node").CombinedOutput(); err == nil {
+		t.Errorf("CombinedOutput() error = nil, want programmed error")
+	}
+	if err := f.Command("iscsiadm", "-m", "iface").Run(); err != nil {
+		t.Errorf("Run() error = %v, want nil once results are exhausted", err)
+	}
+
+	want := []Invocation{
+		{Cmd: "/usr/sbin/chroot", Args: []string{"/nonexistent-host", "/sbin/iscsiadm", "-m", "session"}},
+		{Cmd: "/usr/sbin/chroot", Args: []string{"/nonexistent-host", "/sbin/iscsiadm", "-m", "node"}},
+		{Cmd: "/usr/sbin/chroot", Args: []string{"/nonexistent-host", "/sbin/iscsiadm", "-m", "iface"}},
+	}
+	if got := f.Invocations(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Invocations() = %v, want %v", got, want)
+	}
+}
+
+func TestFake_commandTimeout(t *testing.T) {
+	f := NewFake(nil, "", WithDefaultTimeout(time.Hour), WithCommandTimeouts(map[string]time.Duration{"multipath": 20 * time.Millisecond}))
+	f.Respond(FakeResult{Delay: 5 * time.Second}, FakeResult{Delay: 50 * time.Millisecond})
+
+	start := time.Now()
+	_, err := f.Command("multipath", "-ll").CombinedOutput()
+	var timeoutErr TimeoutError
+	if !errors.As(err, &timeoutErr) || timeoutErr.Cmd != "multipath" || timeoutErr.Timeout != 20*time.Millisecond {
+		t.Errorf("CombinedOutput() error = %v, want multipath timed out", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("CombinedOutput() error = %v, want DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("CombinedOutput() took %v, want the command killed by its timeout", elapsed)
+	}
+
+	// commands without a timeout of their own fall back to the default one
+	if err := f.Command("blkid", "/dev/sdb").Run(); err != nil {
+		t.Errorf("Run() error = %v, want blkid bounded by the default timeout only", err)
+	}
+}
@@ -1,5 +1,5 @@
 // Package hostexec automatically wraps commands executed with kubernetes hostexec into
-// chrooted commands
+// chrooted (or nsenter'd) commands
 package hostexec
 
 import (
@@ -7,8 +7,12 @@ import (
 	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"sort"
 	"strings"
+	"time"
 
+	log "github.com/sirupsen/logrus"
 	"k8s.io/utils/exec"
 )
 
@@ -22,30 +26,338 @@ var defaultSearchPath = []string{
 	"/bin",
 }
 
+// defaultChrootBinary is used when the chroot executable was never looked up
+const defaultChrootBinary = "/usr/sbin/chroot"
+
+// ErrChrootBinaryNotFound is returned by New when the chroot strategy is used
+// but no chroot executable could be found
+var ErrChrootBinaryNotFound = errors.New("chroot binary not found")
+
 // Executor is mostly k8s.io/utils/exec compatible interface for the portions
 // that synology-csi uses.
 type Executor interface {
 	Command(string, ...string) exec.Cmd
 	CommandContext(context.Context, string, ...string) exec.Cmd
+	LookPath(string) (string, error)
+}
+
+// Resolver is implemented by executors that can report how a command would
+// be run without executing it
+type Resolver interface {
+	Resolve(string, ...string) (string, []string)
+}
+
+// Strategy selects how commands are moved into the host environment
+type Strategy int
+
+const (
+	// StrategyChroot runs commands under chroot(8) when a chroot
+	// directory is configured
+	StrategyChroot Strategy = iota
+	// StrategyNsenter runs commands in the mount and network namespaces of
+	// the host init process
+	StrategyNsenter
+)
+
+// ParseStrategy converts a strategy name ("chroot" or "nsenter") to a Strategy
+func ParseStrategy(name string) (Strategy, error) {
+	switch name {
+	case "", "chroot":
+		return StrategyChroot, nil
+	case "nsenter":
+		return StrategyNsenter, nil
+	}
+	return StrategyChroot, fmt.Errorf("unknown execution strategy: %s", name)
 }
 
+// Logger receives debug output describing how commands are wrapped.
+// *logrus.Logger satisfies this interface.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+}
+
+// wrapper rewrites a resolved command so it executes in the host environment
+type wrapper func(cmd string, args ...string) (string, []string)
+
 type hostexec struct {
 	Executor
 	commandMap map[string]string
 	chrootDir  string
+	searchPath []string
+	cache      *lookupCache
+	stat       func(string) (os.FileInfo, error)
+	wrapper    wrapper
+	logger     Logger
+	validate   bool
+	env        []string
+	strategy   Strategy
+	// chrootBinary is the chroot executable in the driver's filesystem
+	chrootBinary string
+	timeout      time.Duration
+	// cmdTimeouts are the timeouts of individual commands, by name
+	cmdTimeouts map[string]time.Duration
+	retry       *RetryPolicy
+	// overrides holds executors for commands whose CommandSpec redirects or
+	// skips the chroot
+	overrides map[string]*hostexec
+}
+
+// CommandSpec describes how a single command is resolved and executed
+type CommandSpec struct {
+	// Path is the full path of the executable, empty to search for it
+	Path string
+	// SkipChroot runs the command in the driver's own filesystem
+	SkipChroot bool
+	// ChrootDir runs the command chrooted into this directory instead of the
+	// executor-wide one
+	ChrootDir string
+}
+
+// Option configures optional behaviour of a hostexec instance
+type Option func(*hostexec)
+
+// WithSearchPath overrides the ordered list of directories used to resolve
+// commands given without an absolute path
+func WithSearchPath(dirs ...string) Option {
+	return func(h *hostexec) {
+		h.searchPath = append([]string{}, dirs...)
+	}
+}
+
+// WithStrategy selects the execution strategy. StrategyChroot is the default.
+func WithStrategy(strategy Strategy) Option {
+	return func(h *hostexec) {
+		h.strategy = strategy
+		switch strategy {
+		case StrategyNsenter:
+			h.wrapper = wrapNsenter
+		default:
+			h.wrapper = h.wrapChroot
+		}
+	}
+}
+
+// WithLogger sets the logger used to trace wrapped commands. The logrus
+// standard logger is used by default, so traces only show at debug level.
+func WithLogger(logger Logger) Option {
+	return func(h *hostexec) {
+		h.logger = logger
+	}
+}
+
+// WithEnv passes additional environment variables to commands run through
+// /usr/bin/env. Each entry is either KEY=VALUE or a bare KEY whose value is
+// taken from the driver's own environment; unset bare keys are skipped. The
+// variables are not applied when env is unavailable in the chroot.
+func WithEnv(vars ...string) Option {
+	return func(h *hostexec) {
+		h.env = append(h.env, vars...)
+	}
+}
+
+// WithCommandValidation makes New check that every command mapping resolves
+// to an existing file inside the chroot directory
+func WithCommandValidation() Option {
+	return func(h *hostexec) {
+		h.validate = true
+	}
+}
+
+// WithChrootBinary sets the location of the chroot executable instead of
+// searching the default path for it
+func WithChrootBinary(path string) Option {
+	return func(h *hostexec) {
+		h.chrootBinary = path
+	}
+}
+
+// WithDefaultTimeout bounds commands started through Command, or through
+// CommandContext with a context that has no deadline. A deadline supplied by
+// the caller always takes precedence, even when it is longer than the default.
+func WithDefaultTimeout(timeout time.Duration) Option {
+	return func(h *hostexec) {
+		h.timeout = timeout
+	}
+}
+
+// WithCommandTimeouts bounds the given commands, by the name they are run
+// with, instead of the default timeout. A timeout of zero keeps the default.
+func WithCommandTimeouts(timeouts map[string]time.Duration) Option {
+	return func(h *hostexec) {
+		h.cmdTimeouts = timeouts
+	}
+}
+
+// WithCacheTTL sets how long resolved command paths are memoized. A ttl of
+// zero or less disables the cache.
+func WithCacheTTL(ttl time.Duration) Option {
+	return func(h *hostexec) {
+		if ttl <= 0 {
+			h.cache = nil
+			return
+		}
+		h.cache = newLookupCache(ttl)
+	}
 }
 
 // New creates an instance of hostexec to execute commands in the given environment
-func New(cmdMap map[string]string, chrootDir string) (Executor, error) {
+func New(cmdMap map[string]string, chrootDir string, opts ...Option) (Executor, error) {
+	return NewWithExecutor(exec.New(), cmdMap, chrootDir, opts...)
+}
+
+// NewWithExecutor is like New but runs the wrapped commands through base
+// instead of exec.New()
+func NewWithExecutor(base exec.Interface, cmdMap map[string]string, chrootDir string, opts ...Option) (Executor, error) {
+	h, err := newHostexec(base, cmdMap, chrootDir, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if h.validate && chrootDir != "" {
+		if err := h.validateCommandMap(); err != nil {
+			return nil, err
+		}
+	}
+
+	return h, nil
+}
+
+// NewWithCommandSpecs is like NewWithExecutor but allows individual commands to
+// bypass or redirect the chroot
+func NewWithCommandSpecs(base exec.Interface, specs map[string]CommandSpec, chrootDir string, opts ...Option) (Executor, error) {
+	cmdMap := make(map[string]string, len(specs))
+	for cmd, spec := range specs {
+		cmdMap[cmd] = spec.Path
+	}
+
+	h, err := newHostexec(base, cmdMap, chrootDir, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	for cmd, spec := range specs {
+		if !spec.SkipChroot && spec.ChrootDir == "" {
+			continue
+		}
+
+		o := *h
+		o.overrides = nil
+		o.cache = nil
+		if h.cache != nil {
+			o.cache = newLookupCache(h.cache.ttl)
+		}
+		if spec.SkipChroot {
+			o.chrootDir = ""
+			o.wrapper = wrapNone
+		} else {
+			if o.chrootDir, err = cleanChrootDir(spec.ChrootDir); err != nil {
+				return nil, fmt.Errorf("%s: %w", cmd, err)
+			}
+			if err := o.findChrootBinary(defaultSearchPath); err != nil {
+				return nil, err
+			}
+			o.wrapper = o.wrapChroot
+		}
+
+		if h.overrides == nil {
+			h.overrides = make(map[string]*hostexec)
+		}
+		h.overrides[cmd] = &o
+	}
+
+	if h.validate && chrootDir != "" {
+		if err := h.validateCommandMap(); err != nil {
+			return nil, err
+		}
+	}
+
+	return h, nil
+}
+
+// cleanChrootDir normalizes dir and checks that it is an existing directory
+func cleanChrootDir(dir string) (string, error) {
+	dir = filepath.Clean(dir)
+	fileinfo, err := os.Stat(dir)
+	if err != nil || !fileinfo.IsDir() {
+		return "", errors.New("chroot directory does not exist or is not a directory")
+	}
+
+	return dir, nil
+}
+
+func newHostexec(base exec.Interface, cmdMap map[string]string, chrootDir string, opts ...Option) (*hostexec, error) {
 	// If chroot directory is defined, check that directory exists or return an error
 	if chrootDir != "" {
-		fileinfo, err := os.Stat(chrootDir)
-		if err != nil || !fileinfo.IsDir() {
-			return nil, errors.New("chroot directory does not exist or is not a directory")
+		var err error
+		if chrootDir, err = cleanChrootDir(chrootDir); err != nil {
+			return nil, err
 		}
 	}
 
-	return &hostexec{exec.New(), cmdMap, chrootDir}, nil
+	h := &hostexec{
+		Executor:   base,
+		commandMap: cmdMap,
+		chrootDir:  chrootDir,
+		cache:      newLookupCache(defaultCacheTTL),
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	if chrootDir != "" && h.strategy == StrategyChroot {
+		if err := h.findChrootBinary(defaultSearchPath); err != nil {
+			return nil, err
+		}
+	}
+
+	return h, nil
+}
+
+// findChrootBinary locates the chroot executable in dirs unless it was configured
+func (h *hostexec) findChrootBinary(dirs []string) error {
+	if h.chrootBinary != "" {
+		return nil
+	}
+
+	for _, dir := range dirs {
+		path := filepath.Join(dir, "chroot")
+		if fileinfo, err := os.Stat(path); err == nil && !fileinfo.IsDir() {
+			h.chrootBinary = path
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%w in %s", ErrChrootBinaryNotFound, strings.Join(dirs, ", "))
+}
+
+// validateCommandMap returns an error naming every mapping that does not point
+// to an existing file inside the chroot directory
+func (h *hostexec) validateCommandMap() error {
+	var broken []string
+	for cmd, path := range h.commandMap {
+		if path == "" {
+			continue
+		}
+		fileinfo, err := os.Stat(h.forCmd(cmd).hostPath(path))
+		if err != nil || fileinfo.IsDir() {
+			broken = append(broken, fmt.Sprintf("%s => %s", cmd, path))
+		}
+	}
+
+	if len(broken) == 0 {
+		return nil
+	}
+
+	sort.Strings(broken)
+	return fmt.Errorf("command mappings not found in chroot %s: %s", h.chrootDir, strings.Join(broken, ", "))
+}
+
+func (h *hostexec) getSearchPath() []string {
+	if len(h.searchPath) == 0 {
+		return defaultSearchPath
+	}
+
+	return h.searchPath
 }
 
 func (h *hostexec) resolveCmd(cmd string, args ...string) (string, []string) {
@@ -57,34 +369,100 @@ func (h *hostexec) resolveCmd(cmd string, args ...string) (string, []string) {
 	return c, args
 }
 
+// InvalidateCache drops all memoized lookups so the next command probes the
+// filesystem again
+func (h *hostexec) InvalidateCache() {
+	if h.cache != nil {
+		h.cache.invalidate()
+	}
+	for _, o := range h.overrides {
+		o.InvalidateCache()
+	}
+}
+
+// forCmd returns the executor configured for cmd
+func (h *hostexec) forCmd(cmd string) *hostexec {
+	if o, ok := h.overrides[cmd]; ok {
+		return o
+	}
+
+	return h
+}
+
+func (h *hostexec) statPath(path string) (os.FileInfo, error) {
+	if h.stat != nil {
+		return h.stat(path)
+	}
+	return os.Stat(path)
+}
+
+// cached returns the memoized result for key, running probe on a miss
+func (h *hostexec) cached(key string, probe func() (string, bool)) (string, bool) {
+	if h.cache == nil {
+		return probe()
+	}
+
+	if e, ok := h.cache.get(key); ok {
+		return e.path, e.found
+	}
+
+	path, found := probe()
+	h.cache.put(key, path, found)
+	return path, found
+}
+
+// isPath reports whether cmd is an absolute or relative path rather than a
+// bare command name to be looked up. Windows paths like C:\tools\iscsicli.exe
+// count on any OS, backslashes are never part of a command name.
+func isPath(cmd string) bool {
+	return filepath.IsAbs(cmd) || strings.ContainsAny(cmd, `/\`)
+}
+
+// hostPath returns where path lives from the driver's point of view, i.e.
+// prefixed with the chroot directory when one is set
+func (h *hostexec) hostPath(path string) string {
+	if h.chrootDir == "" {
+		return path
+	}
+	return filepath.Join(h.chrootDir, path)
+}
+
+// envExists reports whether /usr/bin/env is available in the execution environment
+func (h *hostexec) envExists() bool {
+	_, found := h.cached(envCacheKey, func() (string, bool) {
+		envPath := h.hostPath("/usr/bin/env")
+		_, err := h.statPath(envPath)
+		return envPath, !os.IsNotExist(err)
+	})
+
+	return found
+}
+
+// searchCmd looks for cmd in the search path and returns its absolute path
+// relative to the chroot directory
+func (h *hostexec) searchCmd(cmd string) (string, bool) {
+	return h.cached(cmd, func() (string, bool) {
+		for _, dir := range h.getSearchPath() {
+			// The chroot prefix is only used for probing as it will be added by wrapChroot
+			testPath := filepath.Join(dir, cmd)
+			if _, err := h.statPath(h.hostPath(testPath)); err == nil {
+				return testPath, true
+			}
+		}
+		return "", false
+	})
+}
+
 func (h *hostexec) wrapEnv(cmd string, args ...string) (string, []string) {
-	if strings.ContainsAny(cmd, "/") {
+	if isPath(cmd) {
 		return cmd, args
 	}
 
-	// Check if we're in a chroot environment and if /usr/bin/env exists
-	envPath := "/usr/bin/env"
-	if h.chrootDir != "" {
-		envPath = h.chrootDir + "/usr/bin/env"
-	}
-	
-	// Check if env exists, if not, try to find the command directly
-	if _, err := os.Stat(envPath); os.IsNotExist(err) {
-		// On Talos and similar systems, /usr/bin/env might not exist
-		// Try to find the command in the default search paths
-		for _, dir := range defaultSearchPath {
-			testPath := dir + "/" + cmd
-			if h.chrootDir != "" {
-				testPath = h.chrootDir + testPath
-			}
-			if _, err := os.Stat(testPath); err == nil {
-				// Found the command, use its full path
-				if h.chrootDir != "" {
-					// Remove the chroot prefix as it will be added by wrapChroot
-					return strings.TrimPrefix(testPath, h.chrootDir), args
-				}
-				return testPath, args
-			}
+	// On Talos and similar systems, /usr/bin/env might not exist
+	// Try to find the command in the search paths
+	if !h.envExists() {
+		if path, ok := h.searchCmd(cmd); ok {
+			return path, args
 		}
 		// If we can't find the command, fall back to using it without path
 		// and let the shell handle it
@@ -92,38 +470,265 @@ func (h *hostexec) wrapEnv(cmd string, args ...string) (string, []string) {
 	}
 
 	// Normal path with env available
-	sp := fmt.Sprintf("PATH=%s", strings.Join(defaultSearchPath, ":"))
-	args = append([]string{"-i", sp, cmd}, args...)
+	sp := fmt.Sprintf("PATH=%s", strings.Join(h.getSearchPath(), ":"))
+	envArgs := append([]string{"-i", sp}, h.envVars()...)
+	args = append(append(envArgs, cmd), args...)
 	cmd = "/usr/bin/env"
 
 	return cmd, args
 }
 
+// envVars expands the allow-listed environment variables into KEY=VALUE form
+func (h *hostexec) envVars() []string {
+	var vars []string
+	for _, kv := range h.env {
+		if strings.Contains(kv, "=") {
+			vars = append(vars, kv)
+			continue
+		}
+		if v, ok := os.LookupEnv(kv); ok {
+			vars = append(vars, kv+"="+v)
+		}
+	}
+
+	return vars
+}
+
 func (h *hostexec) wrapChroot(cmd string, args ...string) (string, []string) {
 	if h.chrootDir == "" {
 		return cmd, args
 	}
 
 	args = append([]string{h.chrootDir, cmd}, args...)
-	cmd = "/usr/sbin/chroot"
+	cmd = h.chrootBinary
+	if cmd == "" {
+		cmd = defaultChrootBinary
+	}
 
 	return cmd, args
 }
 
+// wrapNsenter runs the command in the mount and network namespaces of PID 1,
+// which requires the container to share the host PID namespace
+func wrapNsenter(cmd string, args ...string) (string, []string) {
+	args = append([]string{"--mount=/proc/1/ns/mnt", "--net=/proc/1/ns/net", "--", cmd}, args...)
+	cmd = "nsenter"
+
+	return cmd, args
+}
+
+// wrapNone leaves the command untouched
+func wrapNone(cmd string, args ...string) (string, []string) {
+	return cmd, args
+}
+
+// wrapHost applies the configured execution strategy, defaulting to chroot
+func (h *hostexec) wrapHost(cmd string, args ...string) (string, []string) {
+	if h.wrapper == nil {
+		return h.wrapChroot(cmd, args...)
+	}
+
+	return h.wrapper(cmd, args...)
+}
+
 func (h *hostexec) wrap(cmd string, args ...string) (string, []string) {
+	if o, ok := h.overrides[cmd]; ok {
+		return o.wrap(cmd, args...)
+	}
+
+	origCmd := cmd
 	cmd, args = h.resolveCmd(cmd, args...)
+	resolvedCmd := cmd
 	cmd, args = h.wrapEnv(cmd, args...)
-	cmd, args = h.wrapChroot(cmd, args...)
+	envCmd := cmd
+	cmd, args = h.wrapHost(cmd, args...)
+
+	h.logWrap(origCmd, resolvedCmd, envCmd, cmd, args)
 
 	return cmd, args
 }
 
+// logWrap traces each stage of wrap at debug level
+func (h *hostexec) logWrap(origCmd, resolvedCmd, envCmd, cmd string, args []string) {
+	logger := h.logger
+	if logger == nil {
+		logger = log.StandardLogger()
+	}
+
+	search := "none"
+	if envCmd == "/usr/bin/env" && resolvedCmd != envCmd {
+		search = "env PATH"
+	} else if envCmd != resolvedCmd {
+		search = filepath.Dir(envCmd)
+	}
+
+	logger.Debugf("hostexec: command=%q resolved=%q search=%q host-wrapped=%t argv=%q",
+		origCmd, resolvedCmd, search, cmd != envCmd, redactArgs(append([]string{cmd}, args...)))
+}
+
+// redactArgs masks passwords in traced arguments: the value of password=value
+// options, and the first argument following one that names a password, such as
+// "--name node.session.auth.password --value secret"
+func redactArgs(args []string) []string {
+	redacted := make([]string, len(args))
+	pending := false
+	for i, arg := range args {
+		redacted[i] = arg
+		if pending && !strings.HasPrefix(arg, "-") {
+			redacted[i] = "***"
+			pending = false
+			continue
+		}
+		if strings.Contains(arg, "=") {
+			// also covers comma separated options like mount -o user=a,password=b
+			options := strings.Split(arg, ",")
+			for j, option := range options {
+				if key, _, found := strings.Cut(option, "="); found && strings.Contains(strings.ToLower(key), "password") {
+					options[j] = key + "=***"
+				}
+			}
+			redacted[i] = strings.Join(options, ",")
+		} else if strings.Contains(strings.ToLower(arg), "password") {
+			pending = true
+		}
+	}
+	return redacted
+}
+
+// Resolve returns the final command and arguments that Command would execute
+func (h *hostexec) Resolve(cmd string, args ...string) (string, []string) {
+	return h.wrap(cmd, args...)
+}
+
+// LookPath resolves cmd the same way Command would and returns its absolute
+// path relative to the chroot directory
+func (h *hostexec) LookPath(cmd string) (string, error) {
+	if o, ok := h.overrides[cmd]; ok {
+		return o.LookPath(cmd)
+	}
+
+	cmd, _ = h.resolveCmd(cmd)
+	if isPath(cmd) {
+		if _, err := h.statPath(h.hostPath(cmd)); err == nil {
+			return cmd, nil
+		}
+	} else if path, ok := h.searchCmd(cmd); ok {
+		return path, nil
+	}
+
+	return "", fmt.Errorf("%s: %w", cmd, exec.ErrExecutableNotFound)
+}
+
+// commandTimeout returns the timeout of cmd, the default one if it has none of its own
+func (h *hostexec) commandTimeout(cmd string) time.Duration {
+	if timeout := h.cmdTimeouts[cmd]; timeout > 0 {
+		return timeout
+	}
+	if timeout := h.cmdTimeouts[filepath.Base(cmd)]; timeout > 0 {
+		return timeout
+	}
+	return h.timeout
+}
+
 func (h *hostexec) Command(cmd string, args ...string) exec.Cmd {
+	if h.commandTimeout(cmd) > 0 {
+		return h.CommandContext(context.Background(), cmd, args...)
+	}
+
 	cmd, args = h.wrap(cmd, args...)
+	if h.retry != nil {
+		return newRetryCmd(context.Background(), *h.retry, func() exec.Cmd {
+			return h.Executor.Command(cmd, args...)
+		})
+	}
+
 	return h.Executor.Command(cmd, args...)
 }
 
 func (h *hostexec) CommandContext(ctx context.Context, cmd string, args ...string) exec.Cmd {
+	name := cmd
+	timeout := h.commandTimeout(cmd)
 	cmd, args = h.wrap(cmd, args...)
-	return h.Executor.CommandContext(ctx, cmd, args...)
+
+	// The timeout covers all retry attempts
+	var cancel context.CancelFunc
+	if _, ok := ctx.Deadline(); !ok && timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+
+	var c exec.Cmd
+	if h.retry != nil {
+		c = newRetryCmd(ctx, *h.retry, func() exec.Cmd {
+			return h.Executor.CommandContext(ctx, cmd, args...)
+		})
+	} else {
+		c = h.Executor.CommandContext(ctx, cmd, args...)
+	}
+
+	if cancel != nil {
+		return &timeoutCmd{Cmd: c, ctx: ctx, cancel: cancel, name: name, timeout: timeout}
+	}
+	return c
+}
+
+// TimeoutError is returned by a command killed because it ran longer than its
+// timeout. It matches context.DeadlineExceeded with errors.Is.
+type TimeoutError struct {
+	Cmd     string
+	Timeout time.Duration
+	Err     error
+}
+
+func (e TimeoutError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("%s timed out after %v", e.Cmd, e.Timeout)
+	}
+	return fmt.Sprintf("%s timed out after %v (%v)", e.Cmd, e.Timeout, e.Err)
+}
+
+func (e TimeoutError) Is(target error) bool {
+	return target == context.DeadlineExceeded
+}
+
+func (e TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// timeoutCmd releases the timeout context once the command finished, and
+// reports a command killed by it as a TimeoutError
+type timeoutCmd struct {
+	exec.Cmd
+	ctx     context.Context
+	cancel  context.CancelFunc
+	name    string
+	timeout time.Duration
+}
+
+func (c *timeoutCmd) timeoutError(err error) error {
+	if err != nil && errors.Is(c.ctx.Err(), context.DeadlineExceeded) {
+		return TimeoutError{Cmd: c.name, Timeout: c.timeout, Err: err}
+	}
+	return err
+}
+
+func (c *timeoutCmd) Run() error {
+	defer c.cancel()
+	return c.timeoutError(c.Cmd.Run())
+}
+
+func (c *timeoutCmd) CombinedOutput() ([]byte, error) {
+	defer c.cancel()
+	out, err := c.Cmd.CombinedOutput()
+	return out, c.timeoutError(err)
+}
+
+func (c *timeoutCmd) Output() ([]byte, error) {
+	defer c.cancel()
+	out, err := c.Cmd.Output()
+	return out, c.timeoutError(err)
+}
+
+func (c *timeoutCmd) Wait() error {
+	defer c.cancel()
+	return c.timeoutError(c.Cmd.Wait())
 }
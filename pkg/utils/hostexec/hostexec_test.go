@@ -1,12 +1,20 @@
 package hostexec
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/sirupsen/logrus"
 	"k8s.io/utils/exec"
 )
 
@@ -98,6 +106,76 @@ func TestHostexec_wrapEnv(t *testing.T) {
 	}
 }
 
+func TestHostexec_wrapEnvSearchPath(t *testing.T) {
+	chrootDir, err := os.MkdirTemp("", "chroot_test")
+	if err != nil {
+		t.Fatalf("Temporary directory creation failed: %v", err)
+	}
+	defer os.RemoveAll(chrootDir)
+
+	// Only /opt/bin/iscsiadm exists in the chroot and there is no /usr/bin/env
+	if err := os.MkdirAll(filepath.Join(chrootDir, "opt", "bin"), 0755); err != nil {
+		t.Fatalf("Failed to create search dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(chrootDir, "opt", "bin", "iscsiadm"), nil, 0755); err != nil {
+		t.Fatalf("Failed to create binary: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		searchPath []string
+		wantCmd    string
+	}{
+		{
+			name:       "default search path misses binary",
+			searchPath: nil,
+			wantCmd:    "iscsiadm",
+		},
+		{
+			name:       "custom search path finds binary",
+			searchPath: []string{"/usr/sbin", "/opt/bin"},
+			wantCmd:    "/opt/bin/iscsiadm",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := New(nil, chrootDir, WithSearchPath(tt.searchPath...))
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			h := e.(*hostexec)
+
+			c, a := h.wrapEnv("iscsiadm", "-m", "session")
+			if c != tt.wantCmd {
+				t.Errorf("wrapEnv() c = %v, want %v", c, tt.wantCmd)
+			}
+			if !reflect.DeepEqual(a, []string{"-m", "session"}) {
+				t.Errorf("wrapEnv() a = %v, want %v", a, []string{"-m", "session"})
+			}
+		})
+	}
+
+	t.Run("custom search path in env PATH", func(t *testing.T) {
+		if err := os.MkdirAll(filepath.Join(chrootDir, "usr", "bin"), 0755); err != nil {
+			t.Fatalf("Failed to create env dir: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(chrootDir, "usr", "bin", "env"), nil, 0755); err != nil {
+			t.Fatalf("Failed to create env: %v", err)
+		}
+		defer os.Remove(filepath.Join(chrootDir, "usr", "bin", "env"))
+
+		h := &hostexec{chrootDir: chrootDir, searchPath: []string{"/opt/bin", "/run/current-system/sw/bin"}}
+		c, a := h.wrapEnv("iscsiadm")
+		wantArgs := []string{"-i", "PATH=/opt/bin:/run/current-system/sw/bin", "iscsiadm"}
+		if c != "/usr/bin/env" {
+			t.Errorf("wrapEnv() c = %v, want %v", c, "/usr/bin/env")
+		}
+		if !reflect.DeepEqual(a, wantArgs) {
+			t.Errorf("wrapEnv() a = %v, want %v", a, wantArgs)
+		}
+	})
+}
+
 func TestHostexec_resolveCmd(t *testing.T) {
 	tests := []struct {
 		name        string
@@ -202,6 +280,64 @@ func TestHostexec_wrapChroot(t *testing.T) {
 	}
 }
 
+func TestHostexec_wrapHost(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy Strategy
+		chroot   string
+		wantCmd  string
+		wantArgs []string
+	}{
+		{
+			name:     "chroot strategy",
+			strategy: StrategyChroot,
+			chroot:   "/host",
+			wantCmd:  "/usr/sbin/chroot",
+			wantArgs: []string{"/host", "/bin/echo", "hello", "world"},
+		},
+		{
+			name:     "chroot strategy without chroot dir",
+			strategy: StrategyChroot,
+			chroot:   "",
+			wantCmd:  "/bin/echo",
+			wantArgs: []string{"hello", "world"},
+		},
+		{
+			name:     "nsenter strategy",
+			strategy: StrategyNsenter,
+			chroot:   "",
+			wantCmd:  "nsenter",
+			wantArgs: []string{"--mount=/proc/1/ns/mnt", "--net=/proc/1/ns/net", "--", "/bin/echo", "hello", "world"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &hostexec{chrootDir: tt.chroot}
+			WithStrategy(tt.strategy)(h)
+
+			c, a := h.wrapHost("/bin/echo", "hello", "world")
+			if c != tt.wantCmd {
+				t.Errorf("wrapHost() c = %v, want %v", c, tt.wantCmd)
+			}
+			if !reflect.DeepEqual(a, tt.wantArgs) {
+				t.Errorf("wrapHost() a = %v, want %v", a, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestParseStrategy(t *testing.T) {
+	for name, want := range map[string]Strategy{"": StrategyChroot, "chroot": StrategyChroot, "nsenter": StrategyNsenter} {
+		got, err := ParseStrategy(name)
+		if err != nil || got != want {
+			t.Errorf("ParseStrategy(%q) = %v, %v, want %v", name, got, err, want)
+		}
+	}
+	if _, err := ParseStrategy("ssh"); err == nil {
+		t.Errorf("ParseStrategy(%q) expected error", "ssh")
+	}
+}
+
 func TestHostexec_wrap(t *testing.T) {
 	tests := []struct {
 		name     string
@@ -391,3 +527,607 @@ func TestHostexec_CommandContext(t *testing.T) {
 		t.Errorf("Command() c = %v, want %v", c, successCmd)
 	}
 }
+
+func TestHostexec_lookupCache(t *testing.T) {
+	// countingStat pretends only /host/usr/sbin/iscsiadm exists
+	calls := map[string]int{}
+	var mu sync.Mutex
+	countingStat := func(path string) (os.FileInfo, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls[path]++
+		if path == "/host/usr/sbin/iscsiadm" {
+			return nil, nil
+		}
+		return nil, os.ErrNotExist
+	}
+
+	h := &hostexec{
+		chrootDir: "/host",
+		cache:     newLookupCache(time.Minute),
+		stat:      countingStat,
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.wrapEnv("iscsiadm")
+		}()
+	}
+	wg.Wait()
+
+	for i := 0; i < 5; i++ {
+		c, _ := h.wrapEnv("iscsiadm")
+		if c != "/usr/sbin/iscsiadm" {
+			t.Fatalf("wrapEnv() c = %v, want %v", c, "/usr/sbin/iscsiadm")
+		}
+	}
+
+	// Concurrent first lookups may race, but repeated lookups must not stat again
+	before := calls["/host/usr/sbin/iscsiadm"]
+	h.wrapEnv("iscsiadm")
+	if calls["/host/usr/sbin/iscsiadm"] != before {
+		t.Errorf("stat called again for a cached command")
+	}
+
+	t.Run("single lookup stats once", func(t *testing.T) {
+		h.InvalidateCache()
+		calls = map[string]int{}
+		for i := 0; i < 3; i++ {
+			h.wrapEnv("iscsiadm")
+		}
+		if calls["/host/usr/bin/env"] != 1 {
+			t.Errorf("env stat calls = %d, want 1", calls["/host/usr/bin/env"])
+		}
+		if calls["/host/usr/sbin/iscsiadm"] != 1 {
+			t.Errorf("iscsiadm stat calls = %d, want 1", calls["/host/usr/sbin/iscsiadm"])
+		}
+	})
+
+	t.Run("invalidate probes again", func(t *testing.T) {
+		calls = map[string]int{}
+		h.wrapEnv("iscsiadm")
+		h.InvalidateCache()
+		h.wrapEnv("iscsiadm")
+		if calls["/host/usr/sbin/iscsiadm"] != 1 {
+			t.Errorf("iscsiadm stat calls = %d, want 1", calls["/host/usr/sbin/iscsiadm"])
+		}
+	})
+
+	t.Run("expired entries probe again", func(t *testing.T) {
+		now := time.Now()
+		h.cache = newLookupCache(time.Minute)
+		h.cache.now = func() time.Time { return now }
+		calls = map[string]int{}
+
+		h.wrapEnv("iscsiadm")
+		now = now.Add(2 * time.Minute)
+		h.wrapEnv("iscsiadm")
+		if calls["/host/usr/sbin/iscsiadm"] != 2 {
+			t.Errorf("iscsiadm stat calls = %d, want 2", calls["/host/usr/sbin/iscsiadm"])
+		}
+	})
+}
+
+// recordingLogger captures debug output for assertions
+type recordingLogger struct {
+	lines []string
+}
+
+func (l *recordingLogger) Debugf(format string, args ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, args...))
+}
+
+func TestHostexec_logWrap(t *testing.T) {
+	tests := []struct {
+		name   string
+		cmd    string
+		chroot string
+		cmdMap map[string]string
+		stat   func(string) (os.FileInfo, error)
+		want   string
+	}{
+		{
+			name:   "mapped command with chroot",
+			cmd:    "iscsiadm",
+			chroot: "/host",
+			cmdMap: map[string]string{"iscsiadm": "/usr/sbin/iscsiadm"},
+			want:   `hostexec: command="iscsiadm" resolved="/usr/sbin/iscsiadm" search="none" host-wrapped=true argv=["/usr/sbin/chroot" "/host" "/usr/sbin/iscsiadm" "-m" "session"]`,
+		},
+		{
+			name:   "bare command found in search path",
+			cmd:    "iscsiadm",
+			chroot: "",
+			stat: func(path string) (os.FileInfo, error) {
+				if path == "/sbin/iscsiadm" {
+					return nil, nil
+				}
+				return nil, os.ErrNotExist
+			},
+			want: `hostexec: command="iscsiadm" resolved="iscsiadm" search="/sbin" host-wrapped=false argv=["/sbin/iscsiadm" "-m" "session"]`,
+		},
+		{
+			name:   "bare command through env",
+			cmd:    "iscsiadm",
+			chroot: "",
+			stat:   func(string) (os.FileInfo, error) { return nil, nil },
+			want:   `hostexec: command="iscsiadm" resolved="iscsiadm" search="env PATH" host-wrapped=false argv=["/usr/bin/env" "-i" "PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin" "iscsiadm" "-m" "session"]`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &recordingLogger{}
+			h := &hostexec{
+				commandMap: tt.cmdMap,
+				chrootDir:  tt.chroot,
+				stat:       tt.stat,
+			}
+			WithLogger(l)(h)
+
+			h.wrap(tt.cmd, "-m", "session")
+			if len(l.lines) != 1 || l.lines[0] != tt.want {
+				t.Errorf("wrap() logged %q, want %q", l.lines, tt.want)
+			}
+		})
+	}
+
+	t.Run("silent at default verbosity", func(t *testing.T) {
+		var buf bytes.Buffer
+		l := logrus.New()
+		l.SetOutput(&buf)
+		l.SetLevel(logrus.InfoLevel)
+
+		h := &hostexec{}
+		WithLogger(l)(h)
+		h.wrap("/bin/echo", "hello")
+		if buf.Len() != 0 {
+			t.Errorf("wrap() logged %q at info level", buf.String())
+		}
+	})
+}
+
+func TestNew_commandValidation(t *testing.T) {
+	chrootDir, err := os.MkdirTemp("", "chroot_test")
+	if err != nil {
+		t.Fatalf("Temporary directory creation failed: %v", err)
+	}
+	defer os.RemoveAll(chrootDir)
+
+	if err := os.MkdirAll(filepath.Join(chrootDir, "usr", "sbin"), 0755); err != nil {
+		t.Fatalf("Failed to create search dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(chrootDir, "usr", "sbin", "iscsiadm"), nil, 0755); err != nil {
+		t.Fatalf("Failed to create binary: %v", err)
+	}
+
+	cmdMap := map[string]string{
+		"iscsiadm":   "/usr/sbin/iscsiadm",
+		"multipath":  "/usr/sbin/multpath",
+		"multipathd": "",
+	}
+
+	if _, err := New(cmdMap, chrootDir); err != nil {
+		t.Errorf("New() without validation error = %v", err)
+	}
+
+	_, err = New(cmdMap, chrootDir, WithCommandValidation())
+	if err == nil {
+		t.Fatalf("New() with validation expected error")
+	}
+	if !strings.Contains(err.Error(), "multipath => /usr/sbin/multpath") {
+		t.Errorf("New() error = %v, want broken multipath mapping", err)
+	}
+	if strings.Contains(err.Error(), "iscsiadm") || strings.Contains(err.Error(), "multipathd") {
+		t.Errorf("New() error = %v, want only broken mappings", err)
+	}
+
+	delete(cmdMap, "multipath")
+	if _, err := New(cmdMap, chrootDir, WithCommandValidation()); err != nil {
+		t.Errorf("New() with valid mappings error = %v", err)
+	}
+}
+
+func TestHostexec_LookPath(t *testing.T) {
+	chrootDir, err := os.MkdirTemp("", "chroot_test")
+	if err != nil {
+		t.Fatalf("Temporary directory creation failed: %v", err)
+	}
+	defer os.RemoveAll(chrootDir)
+
+	for _, p := range []string{"usr/sbin/iscsiadm", "opt/bin/multipath"} {
+		if err := os.MkdirAll(filepath.Join(chrootDir, filepath.Dir(p)), 0755); err != nil {
+			t.Fatalf("Failed to create search dir: %v", err)
+		}
+		if err := os.WriteFile(filepath.Join(chrootDir, p), nil, 0755); err != nil {
+			t.Fatalf("Failed to create binary: %v", err)
+		}
+	}
+
+	h := &hostexec{
+		commandMap: map[string]string{"multipath": "/opt/bin/multipath", "nvme": "/opt/bin/nvme"},
+		chrootDir:  chrootDir,
+	}
+
+	tests := []struct {
+		name    string
+		cmd     string
+		want    string
+		wantErr bool
+	}{
+		{name: "found on search path", cmd: "iscsiadm", want: "/usr/sbin/iscsiadm"},
+		{name: "found via command map", cmd: "multipath", want: "/opt/bin/multipath"},
+		{name: "mapped but missing", cmd: "nvme", wantErr: true},
+		{name: "not found", cmd: "multipathd", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := h.LookPath(tt.cmd)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LookPath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr && !errors.Is(err, exec.ErrExecutableNotFound) {
+				t.Errorf("LookPath() error = %v, want ErrExecutableNotFound", err)
+			}
+			if got != tt.want {
+				t.Errorf("LookPath() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostexec_wrapEnvExtraVars(t *testing.T) {
+	t.Setenv("HOSTEXEC_TEST_LANG", "C")
+	t.Setenv("HOSTEXEC_TEST_UNRELATED", "leak")
+
+	h := &hostexec{}
+	WithEnv("LC_ALL=C", "HOSTEXEC_TEST_LANG", "HOSTEXEC_TEST_UNSET")(h)
+
+	cmd, args := h.wrapEnv("multipath", "-ll")
+	wantArgs := []string{
+		"-i",
+		"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin",
+		"LC_ALL=C",
+		"HOSTEXEC_TEST_LANG=C",
+		"multipath",
+		"-ll",
+	}
+	if cmd != "/usr/bin/env" {
+		t.Errorf("wrapEnv() cmd = %v, want %v", cmd, "/usr/bin/env")
+	}
+	if !reflect.DeepEqual(args, wantArgs) {
+		t.Errorf("wrapEnv() args = %v, want %v", args, wantArgs)
+	}
+}
+
+func TestNew_chrootDirNormalization(t *testing.T) {
+	chrootDir, err := os.MkdirTemp("", "chroot_test")
+	if err != nil {
+		t.Fatalf("Temporary directory creation failed: %v", err)
+	}
+	defer os.RemoveAll(chrootDir)
+
+	if err := os.MkdirAll(filepath.Join(chrootDir, "usr", "sbin"), 0755); err != nil {
+		t.Fatalf("Failed to create search dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(chrootDir, "usr", "sbin", "iscsiadm"), nil, 0755); err != nil {
+		t.Fatalf("Failed to create binary: %v", err)
+	}
+
+	wantCmd := "/usr/sbin/chroot"
+	wantArgs := []string{chrootDir, "/usr/sbin/iscsiadm", "-m", "session"}
+
+	tests := []struct {
+		name      string
+		chrootDir string
+	}{
+		{name: "clean", chrootDir: chrootDir},
+		{name: "trailing slash", chrootDir: chrootDir + "/"},
+		{name: "doubled slash", chrootDir: chrootDir + "//"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, err := New(nil, tt.chrootDir)
+			if err != nil {
+				t.Fatalf("New() error = %v", err)
+			}
+			cmd, args := e.(*hostexec).wrap("iscsiadm", "-m", "session")
+			if cmd != wantCmd {
+				t.Errorf("wrap() cmd = %v, want %v", cmd, wantCmd)
+			}
+			if !reflect.DeepEqual(args, wantArgs) {
+				t.Errorf("wrap() args = %v, want %v", args, wantArgs)
+			}
+		})
+	}
+}
+
+func TestNewWithCommandSpecs(t *testing.T) {
+	chrootDir, err := os.MkdirTemp("", "chroot_test")
+	if err != nil {
+		t.Fatalf("Temporary directory creation failed: %v", err)
+	}
+	defer os.RemoveAll(chrootDir)
+
+	altDir, err := os.MkdirTemp("", "chroot_alt_test")
+	if err != nil {
+		t.Fatalf("Temporary directory creation failed: %v", err)
+	}
+	defer os.RemoveAll(altDir)
+
+	fake := NewFake(nil, "")
+	e, err := NewWithCommandSpecs(fake, map[string]CommandSpec{
+		"iscsiadm": {Path: "/usr/sbin/iscsiadm"},
+		"helper":   {Path: "/csi/helper", SkipChroot: true},
+		"nvme":     {Path: "/usr/sbin/nvme", ChrootDir: altDir + "/"},
+	}, chrootDir)
+	if err != nil {
+		t.Fatalf("NewWithCommandSpecs() error = %v", err)
+	}
+	h := e.(*hostexec)
+
+	tests := []struct {
+		name     string
+		cmd      string
+		wantCmd  string
+		wantArgs []string
+	}{
+		{
+			name:     "default chroot",
+			cmd:      "iscsiadm",
+			wantCmd:  "/usr/sbin/chroot",
+			wantArgs: []string{chrootDir, "/usr/sbin/iscsiadm", "-v"},
+		},
+		{
+			name:     "skip chroot",
+			cmd:      "helper",
+			wantCmd:  "/csi/helper",
+			wantArgs: []string{"-v"},
+		},
+		{
+			name:     "per-command chroot",
+			cmd:      "nvme",
+			wantCmd:  "/usr/sbin/chroot",
+			wantArgs: []string{altDir, "/usr/sbin/nvme", "-v"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, args := h.wrap(tt.cmd, "-v")
+			if cmd != tt.wantCmd {
+				t.Errorf("wrap() cmd = %v, want %v", cmd, tt.wantCmd)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("wrap() args = %v, want %v", args, tt.wantArgs)
+			}
+		})
+	}
+
+	// the commands run through the base executor
+	if err := e.Command("helper", "-v").Run(); err != nil {
+		t.Fatalf("Command() error = %v", err)
+	}
+	want := []Invocation{{Cmd: "/csi/helper", Args: []string{"-v"}}}
+	if got := fake.Invocations(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Invocations() = %v, want %v", got, want)
+	}
+
+	if _, err := NewWithCommandSpecs(exec.New(), map[string]CommandSpec{
+		"nvme": {ChrootDir: "/invalid/path"},
+	}, chrootDir); err == nil {
+		t.Errorf("NewWithCommandSpecs() with invalid per-command chroot expected error")
+	}
+}
+
+func TestHostexec_findChrootBinary(t *testing.T) {
+	binDir, err := os.MkdirTemp("", "chroot_bin_test")
+	if err != nil {
+		t.Fatalf("Temporary directory creation failed: %v", err)
+	}
+	defer os.RemoveAll(binDir)
+
+	emptyDir := filepath.Join(binDir, "empty")
+	if err := os.Mkdir(emptyDir, 0755); err != nil {
+		t.Fatalf("Failed to create dir: %v", err)
+	}
+
+	h := &hostexec{chrootDir: "/host"}
+	err = h.findChrootBinary([]string{emptyDir, binDir})
+	if !errors.Is(err, ErrChrootBinaryNotFound) {
+		t.Fatalf("findChrootBinary() error = %v, want ErrChrootBinaryNotFound", err)
+	}
+	if !strings.Contains(err.Error(), emptyDir) || !strings.Contains(err.Error(), binDir) {
+		t.Errorf("findChrootBinary() error = %v, want searched directories listed", err)
+	}
+
+	if err := os.WriteFile(filepath.Join(binDir, "chroot"), nil, 0755); err != nil {
+		t.Fatalf("Failed to create binary: %v", err)
+	}
+	if err := h.findChrootBinary([]string{emptyDir, binDir}); err != nil {
+		t.Fatalf("findChrootBinary() error = %v", err)
+	}
+	if cmd, _ := h.wrapChroot("ls"); cmd != filepath.Join(binDir, "chroot") {
+		t.Errorf("wrapChroot() cmd = %v, want %v", cmd, filepath.Join(binDir, "chroot"))
+	}
+}
+
+func TestNew_chrootBinaryOverride(t *testing.T) {
+	chrootDir, err := os.MkdirTemp("", "chroot_test")
+	if err != nil {
+		t.Fatalf("Temporary directory creation failed: %v", err)
+	}
+	defer os.RemoveAll(chrootDir)
+
+	e, err := New(nil, chrootDir, WithChrootBinary("/usr/bin/chroot"))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	cmd, args := e.(*hostexec).wrap("/sbin/blkid")
+	if cmd != "/usr/bin/chroot" {
+		t.Errorf("wrap() cmd = %v, want %v", cmd, "/usr/bin/chroot")
+	}
+	if want := []string{chrootDir, "/sbin/blkid"}; !reflect.DeepEqual(args, want) {
+		t.Errorf("wrap() args = %v, want %v", args, want)
+	}
+}
+
+func TestHostexec_CommandContextDefaultTimeout(t *testing.T) {
+	e, err := New(nil, "", WithDefaultTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+
+	start := time.Now()
+	if err := e.CommandContext(context.Background(), "sleep", "5").Run(); err == nil {
+		t.Errorf("Run() error = nil, want command killed by default timeout")
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("Run() took %v, want default timeout to fire", elapsed)
+	}
+
+	// The caller's deadline wins over the shorter default
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := e.CommandContext(ctx, "sleep", "0.2").Run(); err != nil {
+		t.Errorf("Run() error = %v, want caller deadline to take precedence", err)
+	}
+}
+
+func TestHostexec_Resolve(t *testing.T) {
+	chrootDir, err := os.MkdirTemp("", "chroot_test")
+	if err != nil {
+		t.Fatalf("Temporary directory creation failed: %v", err)
+	}
+	defer os.RemoveAll(chrootDir)
+
+	if err := os.MkdirAll(filepath.Join(chrootDir, "sbin"), 0755); err != nil {
+		t.Fatalf("Failed to create search dir: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(chrootDir, "sbin", "blkid"), nil, 0755); err != nil {
+		t.Fatalf("Failed to create binary: %v", err)
+	}
+
+	e, err := New(map[string]string{"iscsiadm": "/opt/iscsi/iscsiadm"}, chrootDir, WithChrootBinary("/usr/sbin/chroot"))
+	if err != nil {
+		t.Fatalf("New() error = %v", err)
+	}
+	r, ok := e.(Resolver)
+	if !ok {
+		t.Fatalf("New() executor does not implement Resolver")
+	}
+
+	tests := []struct {
+		name     string
+		cmd      string
+		args     []string
+		wantCmd  string
+		wantArgs []string
+	}{
+		{
+			name:     "mapped",
+			cmd:      "iscsiadm",
+			args:     []string{"-m", "session"},
+			wantCmd:  "/usr/sbin/chroot",
+			wantArgs: []string{chrootDir, "/opt/iscsi/iscsiadm", "-m", "session"},
+		},
+		{
+			name:     "unmapped found on search path",
+			cmd:      "blkid",
+			args:     []string{"/dev/sda"},
+			wantCmd:  "/usr/sbin/chroot",
+			wantArgs: []string{chrootDir, "/sbin/blkid", "/dev/sda"},
+		},
+		{
+			name:     "unmapped not found",
+			cmd:      "e2fsck",
+			wantCmd:  "/usr/sbin/chroot",
+			wantArgs: []string{chrootDir, "e2fsck"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cmd, args := r.Resolve(tt.cmd, tt.args...)
+			if cmd != tt.wantCmd {
+				t.Errorf("Resolve() cmd = %v, want %v", cmd, tt.wantCmd)
+			}
+			if !reflect.DeepEqual(args, tt.wantArgs) {
+				t.Errorf("Resolve() args = %v, want %v", args, tt.wantArgs)
+			}
+		})
+	}
+}
+
+func TestIsPath(t *testing.T) {
+	tests := []struct {
+		cmd  string
+		want bool
+	}{
+		{cmd: "iscsiadm", want: false},
+		{cmd: "mkfs.ext4", want: false},
+		{cmd: "iscsicli.exe", want: false},
+		{cmd: "/usr/sbin/iscsiadm", want: true},
+		{cmd: "./iscsiadm", want: true},
+		{cmd: filepath.Join("sbin", "iscsiadm"), want: true},
+		{cmd: `C:\tools\iscsicli.exe`, want: true},
+		{cmd: "C:/tools/iscsicli.exe", want: true},
+		{cmd: `bin\echo`, want: true},
+	}
+	for _, tt := range tests {
+		if got := isPath(tt.cmd); got != tt.want {
+			t.Errorf("isPath(%q) = %v, want %v", tt.cmd, got, tt.want)
+		}
+	}
+}
+
+func TestNewWithExecutor(t *testing.T) {
+	var gotCmd string
+	var gotArgs []string
+	base := &dummyInterface{
+		commandFunc: func(cmd string, args ...string) exec.Cmd {
+			gotCmd, gotArgs = cmd, args
+			return dummyCmd{}
+		},
+	}
+
+	e, err := NewWithExecutor(base, map[string]string{"iscsiadm": "/sbin/iscsiadm"}, "")
+	if err != nil {
+		t.Fatalf("NewWithExecutor() error = %v", err)
+	}
+	if err := e.Command("iscsiadm", "-m", "session").Run(); err != nil {
+		t.Errorf("Run() error = %v", err)
+	}
+
+	if gotCmd != "/sbin/iscsiadm" {
+		t.Errorf("base Command() cmd = %v, want %v", gotCmd, "/sbin/iscsiadm")
+	}
+	if want := []string{"-m", "session"}; !reflect.DeepEqual(gotArgs, want) {
+		t.Errorf("base Command() args = %v, want %v", gotArgs, want)
+	}
+}
+
+func TestRedactArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		want []string
+	}{
+		{
+			args: []string{"iscsiadm", "-m", "node", "--name", "node.session.auth.password", "--value", "secret"},
+			want: []string{"iscsiadm", "-m", "node", "--name", "node.session.auth.password", "--value", "***"},
+		},
+		{
+			args: []string{"mount", "-o", "username=user,password=secret"},
+			want: []string{"mount", "-o", "username=user,password=***"},
+		},
+		{
+			args: []string{"iscsiadm", "-m", "session"},
+			want: []string{"iscsiadm", "-m", "session"},
+		},
+	}
+	for _, tt := range tests {
+		if got := redactArgs(tt.args); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("redactArgs(%q) = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
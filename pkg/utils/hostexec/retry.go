@@ -0,0 +1,133 @@
+package hostexec
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"k8s.io/utils/exec"
+)
+
+// RetryPolicy describes how Run, Output and CombinedOutput are retried when a
+// command fails
+type RetryPolicy struct {
+	// MaxAttempts is the total number of attempts, including the first one
+	MaxAttempts int
+	// BaseDelay is the wait before the second attempt
+	BaseDelay time.Duration
+	// Factor multiplies the delay after every attempt, values below 1 keep it constant
+	Factor float64
+	// Retryable decides whether a failed attempt is retried given its output
+	// (nil for Run) and error. A nil Retryable retries every error.
+	Retryable func(output []byte, err error) bool
+}
+
+// WithRetry retries failed commands according to policy. Commands with stdin
+// set are never retried because the reader can't be replayed.
+func WithRetry(policy RetryPolicy) Option {
+	return func(h *hostexec) {
+		h.retry = &policy
+	}
+}
+
+// retryCmd builds a fresh exec.Cmd for every attempt and replays the setters
+// called on it
+type retryCmd struct {
+	ctx    context.Context
+	policy RetryPolicy
+	build  func() exec.Cmd
+	setup  []func(exec.Cmd)
+	stdin  bool
+	// started is the command used by Start, Wait and the pipes, which are
+	// never retried
+	started exec.Cmd
+}
+
+func newRetryCmd(ctx context.Context, policy RetryPolicy, build func() exec.Cmd) *retryCmd {
+	return &retryCmd{ctx: ctx, policy: policy, build: build}
+}
+
+func (c *retryCmd) newCmd() exec.Cmd {
+	cmd := c.build()
+	for _, f := range c.setup {
+		f(cmd)
+	}
+	return cmd
+}
+
+// do runs attempt until it succeeds, the policy gives up or ctx is done
+func (c *retryCmd) do(attempt func(exec.Cmd) ([]byte, error)) ([]byte, error) {
+	delay := c.policy.BaseDelay
+	for i := 1; ; i++ {
+		out, err := attempt(c.newCmd())
+		if err == nil || c.stdin || i >= c.policy.MaxAttempts {
+			return out, err
+		}
+		if c.policy.Retryable != nil && !c.policy.Retryable(out, err) {
+			return out, err
+		}
+
+		select {
+		case <-c.ctx.Done():
+			return out, err
+		case <-time.After(delay):
+		}
+		if c.policy.Factor > 1 {
+			delay = time.Duration(float64(delay) * c.policy.Factor)
+		}
+	}
+}
+
+func (c *retryCmd) Run() error {
+	_, err := c.do(func(cmd exec.Cmd) ([]byte, error) {
+		return nil, cmd.Run()
+	})
+	return err
+}
+
+func (c *retryCmd) CombinedOutput() ([]byte, error) {
+	return c.do(exec.Cmd.CombinedOutput)
+}
+
+func (c *retryCmd) Output() ([]byte, error) {
+	return c.do(exec.Cmd.Output)
+}
+
+func (c *retryCmd) SetDir(dir string) {
+	c.setup = append(c.setup, func(cmd exec.Cmd) { cmd.SetDir(dir) })
+}
+
+func (c *retryCmd) SetStdin(in io.Reader) {
+	c.stdin = true
+	c.setup = append(c.setup, func(cmd exec.Cmd) { cmd.SetStdin(in) })
+}
+
+func (c *retryCmd) SetStdout(out io.Writer) {
+	c.setup = append(c.setup, func(cmd exec.Cmd) { cmd.SetStdout(out) })
+}
+
+func (c *retryCmd) SetStderr(out io.Writer) {
+	c.setup = append(c.setup, func(cmd exec.Cmd) { cmd.SetStderr(out) })
+}
+
+func (c *retryCmd) SetEnv(env []string) {
+	c.setup = append(c.setup, func(cmd exec.Cmd) { cmd.SetEnv(env) })
+}
+
+func (c *retryCmd) startedCmd() exec.Cmd {
+	if c.started == nil {
+		c.started = c.newCmd()
+	}
+	return c.started
+}
+
+func (c *retryCmd) StdoutPipe() (io.ReadCloser, error) { return c.startedCmd().StdoutPipe() }
+func (c *retryCmd) StderrPipe() (io.ReadCloser, error) { return c.startedCmd().StderrPipe() }
+func (c *retryCmd) Start() error                       { return c.startedCmd().Start() }
+func (c *retryCmd) Wait() error                        { return c.startedCmd().Wait() }
+
+func (c *retryCmd) Stop() {
+	if c.started != nil {
+		c.started.Stop()
+	}
+}
@@ -0,0 +1,70 @@
+package hostexec
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetry(t *testing.T) {
+	transient := FakeResult{Output: []byte("device not settled"), Err: errors.New("exit status 1")}
+	fatal := FakeResult{Output: []byte("no such target"), Err: errors.New("exit status 21")}
+	ok := FakeResult{Output: []byte("ok")}
+
+	policy := RetryPolicy{
+		MaxAttempts: 5,
+		BaseDelay:   time.Millisecond,
+		Factor:      2,
+		Retryable: func(out []byte, err error) bool {
+			return bytes.Contains(out, []byte("not settled"))
+		},
+	}
+
+	tests := []struct {
+		name         string
+		policy       RetryPolicy
+		results      []FakeResult
+		wantErr      bool
+		wantAttempts int
+	}{
+		{
+			name:         "fail twice then succeed",
+			policy:       policy,
+			results:      []FakeResult{transient, transient, ok},
+			wantErr:      false,
+			wantAttempts: 3,
+		},
+		{
+			name:         "non-retryable error",
+			policy:       policy,
+			results:      []FakeResult{transient, fatal, ok},
+			wantErr:      true,
+			wantAttempts: 2,
+		},
+		{
+			name:         "attempts exhausted",
+			policy:       RetryPolicy{MaxAttempts: 2},
+			results:      []FakeResult{transient, transient, ok},
+			wantErr:      true,
+			wantAttempts: 2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := NewFake(nil, "", WithRetry(tt.policy))
+			f.Respond(tt.results...)
+
+			out, err := f.Command("/sbin/multipath", "-r").CombinedOutput()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CombinedOutput() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && string(out) != "ok" {
+				t.Errorf("CombinedOutput() out = %q, want %q", out, "ok")
+			}
+			if got := len(f.Invocations()); got != tt.wantAttempts {
+				t.Errorf("attempts = %d, want %d", got, tt.wantAttempts)
+			}
+		})
+	}
+}
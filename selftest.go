@@ -0,0 +1,112 @@
+/*
+ * Copyright 2021 Synology Inc.
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/driver"
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/common"
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/service"
+	"github.com/SynologyOpenSource/synology-csi/pkg/logger"
+)
+
+var (
+	selfTestParams  = map[string]string{}
+	selfTestWorkDir = ""
+	selfTestTimeout = 10 * time.Minute
+)
+
+var selfTestCmd = &cobra.Command{
+	Use:   "selftest",
+	Short: "Create a volume, mount it on this node, write and read a file, and delete it",
+	Long: `Check the driver works end to end on this node with the StorageClass
+parameters given by --params: a 1Gi volume, or --min-volume-size, is created, staged and published under
+--work-dir as the node server would for a pod, a file is written and read back,
+and the volume is unpublished, unstaged and deleted. Whatever was set up is torn
+down even if a stage fails. Each stage is reported with its duration, and the
+command fails if any stage did. It needs the privileges of the node plugin.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		logger.Init(logLevel)
+		if err := configureDriver(); err != nil {
+			return err
+		}
+
+		workDir := selfTestWorkDir
+		if workDir == "" {
+			dir, err := os.MkdirTemp("", "synology-csi-selftest-")
+			if err != nil {
+				return fmt.Errorf("Failed to create work directory: %v", err)
+			}
+			workDir = dir
+			defer os.Remove(workDir)
+		}
+		// the sessions and staged volumes of the running node plugin are left alone
+		driver.StateDir = filepath.Join(workDir, "state")
+		defer os.RemoveAll(driver.StateDir)
+
+		info, err := common.LoadConfig(csiClientInfoPath)
+		if err != nil {
+			return fmt.Errorf("Failed to read config: %v", err)
+		}
+		dsmService := service.NewDsmService()
+		for _, client := range info.Clients {
+			if err := dsmService.AddDsm(client); err != nil {
+				return fmt.Errorf("Failed to add DSM: %s, error: %v", client.Host, err)
+			}
+		}
+		defer dsmService.RemoveAllDsms()
+
+		cmdExecutor, err := newCommandExecutor()
+		if err != nil {
+			return err
+		}
+		drv, err := driver.NewControllerAndNodeDriver(csiNodeID, csiEndpoint, dsmService, driver.NewTools(cmdExecutor))
+		if err != nil {
+			return fmt.Errorf("Failed to create driver: %v", err)
+		}
+
+		ctx, cancel := context.WithTimeout(cmd.Context(), selfTestTimeout)
+		defer cancel()
+		report := drv.SelfTest(ctx, selfTestParams, workDir)
+		printSelfTestReport(report)
+		if !report.Passed() {
+			return fmt.Errorf("Self-test failed")
+		}
+		return nil
+	},
+}
+
+func printSelfTestReport(report *driver.SelfTestReport) {
+	if report.VolumeId != "" {
+		fmt.Printf("Volume: %s\n", report.VolumeId)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "STAGE\tRESULT\tDURATION\tERROR")
+	for _, stage := range report.Stages {
+		result, errMsg := "pass", "-"
+		if stage.Err != nil {
+			result, errMsg = "fail", stage.Err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%v\t%s\n", stage.Name, result, stage.Duration.Round(time.Millisecond), errMsg)
+	}
+	w.Flush()
+}
+
+func addSelfTestFlags(cmd *cobra.Command) {
+	cmd.Flags().StringToStringVar(&selfTestParams, "params", selfTestParams, "StorageClass parameters of the volume, e.g. protocol=iscsi,fsType=ext4,location=/volume1")
+	cmd.Flags().StringVar(&selfTestWorkDir, "work-dir", selfTestWorkDir, "Directory the volume is mounted under (default: a new temporary directory)")
+	cmd.Flags().DurationVar(&selfTestTimeout, "timeout", selfTestTimeout, "Timeout of the stages before the cleanup, which always runs")
+	cmd.Flags().SortFlags = false
+}
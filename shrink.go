@@ -0,0 +1,96 @@
+/*
+ * Copyright 2021 Synology Inc.
+ */
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	"k8s.io/apimachinery/pkg/api/resource"
+
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/common"
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/service"
+	"github.com/SynologyOpenSource/synology-csi/pkg/logger"
+)
+
+var (
+	shrinkVolumeId       = ""
+	shrinkSize           = ""
+	shrinkFilesystemSize = ""
+	shrinkConfirm        = false
+)
+
+var shrinkLunCmd = &cobra.Command{
+	Use:   "shrink-lun",
+	Short: "Shrink the LUN of a volume whose filesystem was shrunk first",
+	Long: `Shrink the LUN of a volume to --size, which the driver never does by itself.
+The filesystem on the LUN must have been shrunk to --filesystem-size first, and
+the volume must be unmounted from every node. Only thin Btrfs LUNs of DSM 7.0 or
+later are shrunk. The preconditions are only checked unless --confirm is given.
+The PV keeps its capacity in Kubernetes.`,
+	Args:         cobra.NoArgs,
+	SilenceUsage: true,
+	RunE: func(cmd *cobra.Command, _ []string) error {
+		logger.Init(logLevel)
+		ctx := cmd.Context()
+
+		if shrinkVolumeId == "" {
+			return fmt.Errorf("--volume-id is needed")
+		}
+		newSize, err := parseShrinkSize("size", shrinkSize)
+		if err != nil {
+			return err
+		}
+		fsSize, err := parseShrinkSize("filesystem-size", shrinkFilesystemSize)
+		if err != nil {
+			return err
+		}
+
+		info, err := common.LoadConfig(csiClientInfoPath)
+		if err != nil {
+			return fmt.Errorf("Failed to read config: %v", err)
+		}
+		dsmService := service.NewDsmService()
+		for _, client := range info.Clients {
+			if err := dsmService.AddDsm(client); err != nil {
+				return fmt.Errorf("Failed to add DSM: %s, error: %v", client.Host, err)
+			}
+		}
+		defer dsmService.RemoveAllDsms()
+
+		spec := service.ShrinkLunSpec{VolumeId: shrinkVolumeId, NewSize: newSize, FilesystemSize: fsSize, DryRun: !shrinkConfirm}
+		volume, err := dsmService.ShrinkLun(ctx, spec)
+		if err != nil {
+			return err
+		}
+		if spec.DryRun {
+			fmt.Printf("Dry run: LUN %s of DSM %s would be shrunk from %d to %d bytes, add --confirm to shrink it.\n",
+				volume.Lun.Name, volume.DsmIp, volume.Lun.Size, newSize)
+			return nil
+		}
+		fmt.Printf("Shrunk LUN %s of DSM %s to %d bytes.\n", volume.Lun.Name, volume.DsmIp, newSize)
+		return nil
+	},
+}
+
+// parseShrinkSize reads a size flag given as a quantity, e.g. 10Gi
+func parseShrinkSize(flag string, value string) (int64, error) {
+	if value == "" {
+		return 0, fmt.Errorf("--%s is needed", flag)
+	}
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil || quantity.Sign() <= 0 {
+		return 0, fmt.Errorf("Invalid --%s %q, must be a positive quantity like 10Gi", flag, value)
+	}
+	return quantity.Value(), nil
+}
+
+func addShrinkLunFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&shrinkVolumeId, "volume-id", shrinkVolumeId, "Volume handle of the PV whose LUN is shrunk")
+	cmd.Flags().StringVar(&shrinkSize, "size", shrinkSize, "New size of the LUN, e.g. 10Gi")
+	cmd.Flags().StringVar(&shrinkFilesystemSize, "filesystem-size", shrinkFilesystemSize, "Size the filesystem on the LUN was shrunk to, at most --size")
+	cmd.Flags().BoolVar(&shrinkConfirm, "confirm", shrinkConfirm, "Shrink the LUN, otherwise only the preconditions are checked")
+	cmd.Flags().SortFlags = false
+}
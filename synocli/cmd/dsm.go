@@ -4,14 +4,17 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"github.com/spf13/cobra"
 	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/common"
+	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/service"
 	"github.com/SynologyOpenSource/synology-csi/pkg/dsm/webapi"
 )
 
 var https = false
+var insecureSkipVerify = false
 var port = -1
 
 var cmdDsm = &cobra.Command{
@@ -42,9 +45,10 @@ var cmdDsmLogin = &cobra.Command{
 			Password: args[2],
 			Port:     defaultPort,
 			Https:    https,
+			TLS:      webapi.TLSOptions{InsecureSkipVerify: insecureSkipVerify},
 		}
 
-		err := dsmApi.Login()
+		err := dsmApi.Login(context.Background())
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
@@ -82,7 +86,7 @@ func LoginDsmForTest(id int) (*webapi.DSM, error) {
 		return nil, fmt.Errorf("Failed to list dsms: %v", err)
 	}
 
-	if err := dsms[0].Login(); err != nil {
+	if err := dsms[0].Login(context.Background()); err != nil {
 		return nil, fmt.Errorf("Failed to login to DSM: [%s]. err: %v", dsms[0].Ip, err)
 	}
 
@@ -106,12 +110,29 @@ func ListDsms(id int) ([]*webapi.DSM, error) {
 			continue
 		}
 
+		tlsOptions, err := service.LoadTLSOptions(info.Clients[i])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid TLS options for DSM [%s]: %v", info.Clients[i].Host, err)
+		}
+		proxyOptions, err := service.LoadProxyOptions(info.Clients[i])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid proxy options for DSM [%s]: %v", info.Clients[i].Host, err)
+		}
+		transportOptions, err := service.LoadTransportOptions(info.Clients[i])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid transport options for DSM [%s]: %v", info.Clients[i].Host, err)
+		}
+
 		dsm := &webapi.DSM{
 			Ip:       info.Clients[i].Host,
 			Port:     info.Clients[i].Port,
 			Username: info.Clients[i].Username,
 			Password: info.Clients[i].Password,
 			Https:    info.Clients[i].Https,
+			TLS:      tlsOptions,
+			Proxy:    proxyOptions,
+
+			Transport: transportOptions,
 		}
 		dsms = append(dsms, dsm)
 	}
@@ -127,5 +148,6 @@ func init() {
 	cmdDsm.AddCommand(cmdDsmList)
 
 	cmdDsmLogin.PersistentFlags().BoolVar(&https, "https", false, "Use HTTPS to login DSM")
+	cmdDsmLogin.PersistentFlags().BoolVar(&insecureSkipVerify, "insecure-skip-verify", false, "Don't verify the HTTPS certificate of DSM")
 	cmdDsmLogin.PersistentFlags().IntVarP(&port, "port", "p", -1, "Use assigned port to login DSM")
 }
\ No newline at end of file
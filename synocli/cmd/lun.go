@@ -4,6 +4,7 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"text/tabwriter"
@@ -33,17 +34,17 @@ var cmdLunList = &cobra.Command{
 
 		lunInfos := make(map[string][]webapi.LunInfo)
 		for _, dsm := range dsms {
-			if err := dsm.Login(); err != nil {
+			if err := dsm.Login(context.Background()); err != nil {
 				fmt.Printf("Failed to login to DSM: [%s]. err: %v\n", dsm.Ip, err)
 				os.Exit(1)
 			}
-			infos, err := dsm.LunList()
+			infos, err := dsm.LunList(context.Background())
 			if err != nil {
 				fmt.Println(err)
 				os.Exit(1)
 			}
 			lunInfos[dsm.Ip] = infos
-			dsm.Logout()
+			dsm.Logout(context.Background())
 		}
 
 		tw := tabwriter.NewWriter(os.Stdout, 8, 0, 2, ' ', 0)
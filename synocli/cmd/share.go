@@ -4,6 +4,7 @@
 package cmd
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"strings"
@@ -35,10 +36,10 @@ var cmdShareGet = &cobra.Command{
 			os.Exit(1)
 		}
 		defer func() {
-			dsm.Logout()
+			dsm.Logout(context.Background())
 		}()
 
-		share, err := dsm.ShareGet(args[0])
+		share, err := dsm.ShareGet(context.Background(), args[0])
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
@@ -60,17 +61,17 @@ var cmdShareList = &cobra.Command{
 
 		shareInfos := make(map[string][]webapi.ShareInfo)
 		for _, dsm := range dsms {
-			if err := dsm.Login(); err != nil {
+			if err := dsm.Login(context.Background()); err != nil {
 				fmt.Printf("Failed to login to DSM: [%s]. err: %v\n", dsm.Ip, err)
 				os.Exit(1)
 			}
-			shares, err := dsm.ShareList()
+			shares, err := dsm.ShareList(context.Background())
 			if err != nil {
 				fmt.Println(err)
 				os.Exit(1)
 			}
 			shareInfos[dsm.Ip] = shares
-			dsm.Logout()
+			dsm.Logout(context.Background())
 		}
 
 		tw := tabwriter.NewWriter(os.Stdout, 8, 0, 2, ' ', 0)
@@ -119,7 +120,7 @@ var cmdShareCreate = &cobra.Command{
 			os.Exit(1)
 		}
 		defer func() {
-			dsm.Logout()
+			dsm.Logout(context.Background())
 		}()
 
 		var size int64 = 0
@@ -146,13 +147,13 @@ var cmdShareCreate = &cobra.Command{
 		}
 
 		fmt.Printf("spec = %#v, sizeInMB = %d\n", testSpec, sizeInMB)
-		err = dsm.ShareCreate(testSpec)
+		err = dsm.ShareCreate(context.Background(), testSpec)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
 
-		share, err := dsm.ShareGet(args[0])
+		share, err := dsm.ShareGet(context.Background(), args[0])
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
@@ -173,10 +174,10 @@ var cmdShareDelete = &cobra.Command{
 			os.Exit(1)
 		}
 		defer func() {
-			dsm.Logout()
+			dsm.Logout(context.Background())
 		}()
 
-		err = dsm.ShareDelete(args[0])
+		err = dsm.ShareDelete(context.Background(), args[0])
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
@@ -196,7 +197,7 @@ var cmdShareClone = &cobra.Command{
 			os.Exit(1)
 		}
 		defer func() {
-			dsm.Logout()
+			dsm.Logout(context.Background())
 		}()
 
 		fromSnapshot := false
@@ -210,14 +211,14 @@ var cmdShareClone = &cobra.Command{
 		snapshot := ""
 		if fromSnapshot {
 			snapshot = srcName
-			shares, err := dsm.ShareList()
+			shares, err := dsm.ShareList(context.Background())
 			if err != nil {
 				fmt.Println(err)
 				os.Exit(1)
 			}
 
 			for _, share := range shares {
-				snaps, err := dsm.ShareSnapshotList(share.Name)
+				snaps, err := dsm.ShareSnapshotList(context.Background(), share.Name)
 				if err != nil {
 					fmt.Println(err)
 					os.Exit(1)
@@ -241,7 +242,7 @@ var cmdShareClone = &cobra.Command{
 		} else {
 			orgShareName = srcName
 		}
-		srcShare, err := dsm.ShareGet(orgShareName)
+		srcShare, err := dsm.ShareGet(context.Background(), orgShareName)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
@@ -260,13 +261,13 @@ var cmdShareClone = &cobra.Command{
 			},
 		}
 		fmt.Printf("newName: %s, fromSnapshot: %v (%s), orgShareName: %s\n", newName, fromSnapshot, snapshot, orgShareName)
-		_, err = dsm.ShareClone(shareSpec)
+		_, err = dsm.ShareClone(context.Background(), shareSpec)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
 
-		share, err := dsm.ShareGet(newName)
+		share, err := dsm.ShareGet(context.Background(), newName)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
@@ -287,7 +288,7 @@ var cmdShareSnapshotCreate = &cobra.Command{
 			os.Exit(1)
 		}
 		defer func() {
-			dsm.Logout()
+			dsm.Logout(context.Background())
 		}()
 
 		spec := webapi.ShareSnapshotCreateSpec{
@@ -297,14 +298,14 @@ var cmdShareSnapshotCreate = &cobra.Command{
 		}
 
 		fmt.Printf("spec = %#v\n", spec)
-		snapTime, err := dsm.ShareSnapshotCreate(spec)
+		snapTime, err := dsm.ShareSnapshotCreate(context.Background(), spec)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
 		fmt.Printf("resp = %s\n", snapTime)
 
-		snaps, err := dsm.ShareSnapshotList(spec.ShareName)
+		snaps, err := dsm.ShareSnapshotList(context.Background(), spec.ShareName)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
@@ -333,10 +334,10 @@ var cmdShareSnapshotDelete = &cobra.Command{
 			os.Exit(1)
 		}
 		defer func() {
-			dsm.Logout()
+			dsm.Logout(context.Background())
 		}()
 
-		if err := dsm.ShareSnapshotDelete(args[1], args[0]); err != nil {
+		if err := dsm.ShareSnapshotDelete(context.Background(), args[1], args[0]); err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
@@ -346,18 +347,18 @@ var cmdShareSnapshotDelete = &cobra.Command{
 
 func shareSnapshotListAll(dsm *webapi.DSM, shareName string) ([]webapi.ShareSnapshotInfo, error) {
 	if shareName != "" {
-		return dsm.ShareSnapshotList(shareName)
+		return dsm.ShareSnapshotList(context.Background(), shareName)
 	}
 
 	var infos []webapi.ShareSnapshotInfo
-	shares, err := dsm.ShareList()
+	shares, err := dsm.ShareList(context.Background())
 	if err != nil {
 		fmt.Println(err)
 		return nil, err
 	}
 
 	for _, share := range shares {
-		snaps, err := dsm.ShareSnapshotList(share.Name)
+		snaps, err := dsm.ShareSnapshotList(context.Background(), share.Name)
 		if err != nil {
 			fmt.Println(err)
 			return nil, err
@@ -379,7 +380,7 @@ var cmdShareSnapshotList = &cobra.Command{
 			os.Exit(1)
 		}
 		defer func() {
-			dsm.Logout()
+			dsm.Logout(context.Background())
 		}()
 
 		shareName := ""
@@ -428,7 +429,7 @@ func createSharePermission(name string, acl string) *webapi.SharePermission {
 }
 
 func getShareLocalUserPermission(dsm *webapi.DSM, shareName string, userName string) (*webapi.SharePermission, error) {
-	infos, err := dsm.SharePermissionList(shareName, "local_user")
+	infos, err := dsm.SharePermissionList(context.Background(), shareName, "local_user")
 	if err != nil {
 		return nil, err
 	}
@@ -451,7 +452,7 @@ var cmdSharePermissionList = &cobra.Command{
 			os.Exit(1)
 		}
 		defer func() {
-			dsm.Logout()
+			dsm.Logout(context.Background())
 		}()
 
 		userGroupType := "local_user"
@@ -459,7 +460,7 @@ var cmdSharePermissionList = &cobra.Command{
 			userGroupType = args[1]
 		}
 
-		infos, err := dsm.SharePermissionList(args[0], userGroupType)
+		infos, err := dsm.SharePermissionList(context.Background(), args[0], userGroupType)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
@@ -496,7 +497,7 @@ var cmdSharePermissionSet = &cobra.Command{
 			os.Exit(1)
 		}
 		defer func() {
-			dsm.Logout()
+			dsm.Logout(context.Background())
 		}()
 
 		shareName := args[0]
@@ -516,7 +517,7 @@ var cmdSharePermissionSet = &cobra.Command{
 		}
 
 		fmt.Printf("spec = %#v\n", spec)
-		if err := dsm.SharePermissionSet(spec); err != nil {
+		if err := dsm.SharePermissionSet(context.Background(), spec); err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
@@ -541,7 +542,7 @@ var cmdShareSet = &cobra.Command{
 			os.Exit(1)
 		}
 		defer func() {
-			dsm.Logout()
+			dsm.Logout(context.Background())
 		}()
 
 		shareName := args[0]
@@ -551,7 +552,7 @@ var cmdShareSet = &cobra.Command{
 			os.Exit(1)
 		}
 
-		share, err := dsm.ShareGet(shareName)
+		share, err := dsm.ShareGet(context.Background(), shareName)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)
@@ -564,12 +565,12 @@ var cmdShareSet = &cobra.Command{
 			VolPath:        share.VolPath,
 			QuotaForCreate: &newSizeInMB,
 		}
-		if err := dsm.ShareSet(shareName, updateInfo); err != nil {
+		if err := dsm.ShareSet(context.Background(), shareName, updateInfo); err != nil {
 			fmt.Println(err)
 			os.Exit(1)
 		}
 
-		newShare, err := dsm.ShareGet(shareName)
+		newShare, err := dsm.ShareGet(context.Background(), shareName)
 		if err != nil {
 			fmt.Println(err)
 			os.Exit(1)